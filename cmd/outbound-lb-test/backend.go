@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// SourceIPHeader carries the address a backend request came from, i.e. the
+// outbound IP the proxy used.
+const SourceIPHeader = "X-Source-IP"
+
+// backend is a local HTTP server reporting the source IP of each request.
+// Requests from failed source IPs get 503, and /hold requests block until
+// released.
+type backend struct {
+	server   *http.Server
+	addr     string
+	failed   map[string]bool
+	held     int
+	release  chan struct{}
+	mu       sync.Mutex
+	listener net.Listener
+}
+
+// startBackend starts the backend on a free loopback port.
+func startBackend() (*backend, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	b := &backend{
+		addr:     ln.Addr().String(),
+		failed:   make(map[string]bool),
+		release:  make(chan struct{}),
+		listener: ln,
+	}
+	b.server = &http.Server{Handler: b}
+	go b.server.Serve(ln)
+	return b, nil
+}
+
+// URL returns the backend URL for path.
+func (b *backend) URL(path string) string {
+	return "http://" + b.addr + path
+}
+
+// Close stops the backend and releases held requests.
+func (b *backend) Close() {
+	b.Release()
+	b.server.Close()
+}
+
+// SetFailed makes requests from ip fail (or succeed again).
+func (b *backend) SetFailed(ip string, failed bool) {
+	b.mu.Lock()
+	b.failed[ip] = failed
+	b.mu.Unlock()
+}
+
+// Held returns the number of /hold requests currently blocked.
+func (b *backend) Held() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.held
+}
+
+// Release unblocks all held requests. Later /hold requests block again.
+func (b *backend) Release() {
+	b.mu.Lock()
+	close(b.release)
+	b.release = make(chan struct{})
+	b.mu.Unlock()
+}
+
+func (b *backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	w.Header().Set(SourceIPHeader, ip)
+
+	b.mu.Lock()
+	failed := b.failed[ip]
+	release := b.release
+	if r.URL.Path == "/hold" && !failed {
+		b.held++
+	}
+	b.mu.Unlock()
+
+	if failed {
+		http.Error(w, "source IP marked failed", http.StatusServiceUnavailable)
+		return
+	}
+	if r.URL.Path == "/hold" {
+		<-release
+		b.mu.Lock()
+		b.held--
+		b.mu.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"source_ip": ip, "path": r.URL.Path})
+}
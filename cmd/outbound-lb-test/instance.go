@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// instance is an outbound-lb process started with a generated config file.
+type instance struct {
+	cmd         *exec.Cmd
+	configPath  string
+	port        int
+	metricsPort int
+	client      *http.Client
+	logs        *syncBuffer
+	done        chan error
+}
+
+// startInstance writes cfg (plus free listening ports) to a config file in
+// dir, starts binary with it and waits until the proxy is ready.
+func startInstance(ctx context.Context, binary, dir string, cfg map[string]any, verbose bool) (*instance, error) {
+	port, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+	metricsPort, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+
+	inst := &instance{
+		configPath:  filepath.Join(dir, "config.yaml"),
+		port:        port,
+		metricsPort: metricsPort,
+		logs:        &syncBuffer{},
+		done:        make(chan error, 1),
+	}
+	if err := inst.writeConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	proxyURL := &url.URL{Scheme: "http", Host: net.JoinHostPort("127.0.0.1", strconv.Itoa(port))}
+	inst.client = &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), DisableKeepAlives: true},
+		Timeout:   30 * time.Second,
+	}
+
+	inst.cmd = exec.Command(binary, "--config", inst.configPath)
+	var out io.Writer = inst.logs
+	if verbose {
+		out = io.MultiWriter(inst.logs, os.Stderr)
+	}
+	inst.cmd.Stdout = out
+	inst.cmd.Stderr = out
+	if err := inst.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start %s: %w", binary, err)
+	}
+	go func() { inst.done <- inst.cmd.Wait() }()
+
+	if err := inst.waitReady(ctx); err != nil {
+		inst.Stop()
+		return nil, err
+	}
+	return inst, nil
+}
+
+// writeConfig writes cfg with the listening ports of the instance.
+func (inst *instance) writeConfig(cfg map[string]any) error {
+	full := map[string]any{
+		"port":         inst.port,
+		"metrics_port": inst.metricsPort,
+		"log_level":    "info",
+	}
+	for k, v := range cfg {
+		full[k] = v
+	}
+	data, err := yaml.Marshal(full)
+	if err != nil {
+		return err
+	}
+	// Write and rename so the watcher never sees a partial file
+	tmp := inst.configPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, inst.configPath)
+}
+
+// Reload rewrites the config file and signals the process to reload it.
+func (inst *instance) Reload(cfg map[string]any) error {
+	if err := inst.writeConfig(cfg); err != nil {
+		return err
+	}
+	return inst.cmd.Process.Signal(syscall.SIGHUP)
+}
+
+// waitReady polls /ready until it answers 200, the process exits or ctx ends.
+func (inst *instance) waitReady(ctx context.Context) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-inst.done:
+			return fmt.Errorf("outbound-lb exited before becoming ready (%v):\n%s", err, inst.logs.String())
+		case <-ctx.Done():
+			return fmt.Errorf("outbound-lb not ready: %w", ctx.Err())
+		case <-ticker.C:
+			resp, err := http.Get(inst.metricsURL("/ready"))
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode == http.StatusOK {
+					return nil
+				}
+			}
+		}
+	}
+}
+
+// Stop terminates the process gracefully, killing it if it does not exit.
+func (inst *instance) Stop() {
+	inst.cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-inst.done:
+	case <-time.After(10 * time.Second):
+		inst.cmd.Process.Kill()
+		<-inst.done
+	}
+}
+
+func (inst *instance) metricsURL(path string) string {
+	return "http://" + net.JoinHostPort("127.0.0.1", strconv.Itoa(inst.metricsPort)) + path
+}
+
+// Get sends a GET request for target through the proxy and returns the
+// status and the outbound IP the backend saw.
+func (inst *instance) Get(target string) (int, string, error) {
+	resp, err := inst.client.Get(target)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, resp.Header.Get(SourceIPHeader), nil
+}
+
+// GetJSON decodes a JSON endpoint of the metrics server into v.
+func (inst *instance) GetJSON(path string, v any) error {
+	resp, err := http.Get(inst.metricsURL(path))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: status %d", path, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// freePort returns a TCP port that was free a moment ago.
+func freePort() (int, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent writes.
+type syncBuffer struct {
+	buf bytes.Buffer
+	mu  sync.Mutex
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,173 @@
+// Package main is an end-to-end test harness for outbound-lb. It starts the
+// real binary against a local backend using several loopback IPs as outbound
+// addresses and runs scripted scenarios, exiting non-zero if any fails.
+//
+// Linux routes all of 127.0.0.0/8 to the loopback interface. On macOS the
+// extra addresses must be aliased first:
+//
+//	sudo ifconfig lo0 alias 127.0.0.2
+//	sudo ifconfig lo0 alias 127.0.0.3
+//	sudo ifconfig lo0 alias 127.0.0.4
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+func main() {
+	var (
+		binary   string
+		ips      []string
+		selected []string
+		timeout  time.Duration
+		verbose  bool
+		list     bool
+	)
+	pflag.StringVar(&binary, "binary", "", "Path to the outbound-lb binary (default: next to this binary, then $PATH)")
+	pflag.StringSliceVar(&ips, "ips", []string{"127.0.0.2", "127.0.0.3", "127.0.0.4"}, "Loopback IPs to use as outbound IPs")
+	pflag.StringSliceVar(&selected, "scenarios", nil, "Scenarios to run (default: all)")
+	pflag.DurationVar(&timeout, "timeout", 60*time.Second, "Timeout per scenario")
+	pflag.BoolVarP(&verbose, "verbose", "v", false, "Stream outbound-lb logs to stderr")
+	pflag.BoolVar(&list, "list", false, "List scenarios and exit")
+	pflag.Parse()
+
+	if list {
+		for _, sc := range scenarios {
+			fmt.Printf("%-18s %s\n", sc.name, sc.description)
+		}
+		return
+	}
+
+	if err := run(binary, ips, selected, timeout, verbose); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func run(binary string, ips, selected []string, timeout time.Duration, verbose bool) error {
+	for _, name := range selected {
+		if !slices.ContainsFunc(scenarios, func(sc scenario) bool { return sc.name == name }) {
+			return fmt.Errorf("unknown scenario %q (see --list)", name)
+		}
+	}
+
+	binary, err := findBinary(binary)
+	if err != nil {
+		return err
+	}
+	if err := checkIPs(ips); err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, sc := range scenarios {
+		if len(selected) > 0 && !slices.Contains(selected, sc.name) {
+			continue
+		}
+		start := time.Now()
+		err := runScenario(sc, binary, ips, timeout, verbose)
+		elapsed := time.Since(start).Round(10 * time.Millisecond)
+		switch {
+		case errors.Is(err, errSkipped):
+			fmt.Printf("--- SKIP: %s (needs at least %d IPs)\n", sc.name, sc.minIPs)
+		case err != nil:
+			failed++
+			fmt.Printf("--- FAIL: %s (%s)\n    %v\n", sc.name, elapsed, err)
+		default:
+			fmt.Printf("--- PASS: %s (%s)\n", sc.name, elapsed)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d scenario(s) failed", failed)
+	}
+	fmt.Println("PASS")
+	return nil
+}
+
+// runScenario runs sc with a fresh backend and working directory, stopping
+// the instance it started. On failure the instance logs are appended to the
+// error unless they were already streamed.
+func runScenario(sc scenario, binary string, ips []string, timeout time.Duration, verbose bool) error {
+	if len(ips) < sc.minIPs {
+		return errSkipped
+	}
+
+	dir, err := os.MkdirTemp("", "outbound-lb-test-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	b, err := startBackend()
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	e := &env{ctx: ctx, binary: binary, ips: ips, dir: dir, verbose: verbose, backend: b}
+	err = sc.run(e)
+	if e.inst != nil {
+		e.inst.Stop()
+		if err != nil && !verbose {
+			err = fmt.Errorf("%w\n\nlast outbound-lb logs:\n%s", err, tail(e.inst.logs.String(), 40))
+		}
+	}
+	return err
+}
+
+// tail returns the last n lines of s.
+func tail(s string, n int) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// findBinary resolves the outbound-lb binary to test.
+func findBinary(binary string) (string, error) {
+	if binary != "" {
+		return binary, nil
+	}
+	if exe, err := os.Executable(); err == nil {
+		candidate := filepath.Join(filepath.Dir(exe), "outbound-lb")
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, nil
+		}
+	}
+	path, err := exec.LookPath("outbound-lb")
+	if err != nil {
+		return "", errors.New("outbound-lb binary not found (build it with 'make build' and pass --binary bin/outbound-lb)")
+	}
+	return path, nil
+}
+
+// checkIPs verifies every IP can be bound locally.
+func checkIPs(ips []string) error {
+	if len(ips) == 0 {
+		return errors.New("no IPs given")
+	}
+	for _, ip := range ips {
+		ln, err := net.Listen("tcp", net.JoinHostPort(strings.TrimSpace(ip), "0"))
+		if err != nil {
+			return fmt.Errorf("IP %s is not usable on this host (on macOS alias it with 'sudo ifconfig lo0 alias %s'): %w", ip, ip, err)
+		}
+		ln.Close()
+	}
+	return nil
+}
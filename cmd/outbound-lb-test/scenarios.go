@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// errSkipped marks a scenario that cannot run with the given IPs.
+var errSkipped = errors.New("skipped")
+
+// env is what a scenario runs with.
+type env struct {
+	ctx     context.Context
+	binary  string
+	ips     []string
+	dir     string
+	verbose bool
+	backend *backend
+	inst    *instance
+}
+
+// scenario is a scripted end-to-end check.
+type scenario struct {
+	name        string
+	description string
+	minIPs      int
+	run         func(e *env) error
+}
+
+// scenarios lists all scenarios in the order they run.
+var scenarios = []scenario{
+	{
+		name:        "distribution",
+		description: "requests succeed and are spread over every outbound IP",
+		minIPs:      1,
+		run:         runDistribution,
+	},
+	{
+		name:        "ip-failure",
+		description: "an IP failing its health check stops receiving traffic until it recovers",
+		minIPs:      2,
+		run:         runIPFailure,
+	},
+	{
+		name:        "config-reload",
+		description: "removing an IP from the config file and reloading moves traffic off it",
+		minIPs:      2,
+		run:         runConfigReload,
+	},
+	{
+		name:        "limit-saturation",
+		description: "requests beyond the connection limits are rejected with 503 and recorded",
+		minIPs:      1,
+		run:         runLimitSaturation,
+	},
+}
+
+// baseConfig returns the config shared by all scenarios.
+func (e *env) baseConfig(ips []string) map[string]any {
+	return map[string]any{
+		"ips":          ips,
+		"timeout":      "5s",
+		"idle_timeout": "10s",
+	}
+}
+
+// start starts an instance with cfg for the rest of the scenario.
+func (e *env) start(cfg map[string]any) error {
+	inst, err := startInstance(e.ctx, e.binary, e.dir, cfg, e.verbose)
+	if err != nil {
+		return err
+	}
+	e.inst = inst
+	return nil
+}
+
+// batch sends n requests to path and returns how many each outbound IP got.
+// Any status other than 200 is an error.
+func (e *env) batch(n int, path string) (map[string]int, error) {
+	perIP := make(map[string]int)
+	for i := 0; i < n; i++ {
+		status, ip, err := e.inst.Get(e.backend.URL(path))
+		if err != nil {
+			return nil, err
+		}
+		if status != http.StatusOK {
+			return nil, fmt.Errorf("request %d: status %d", i+1, status)
+		}
+		if !slices.Contains(e.ips, ip) {
+			return nil, fmt.Errorf("request %d: backend saw source IP %q, not an outbound IP", i+1, ip)
+		}
+		perIP[ip]++
+	}
+	return perIP, nil
+}
+
+// eventually calls check until it succeeds or timeout passes, returning the
+// last error.
+func (e *env) eventually(timeout time.Duration, check func() error) error {
+	ctx, cancel := context.WithTimeout(e.ctx, timeout)
+	defer cancel()
+	for {
+		err := check()
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("not met after %s: %w", timeout, err)
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+func runDistribution(e *env) error {
+	if err := e.start(e.baseConfig(e.ips)); err != nil {
+		return err
+	}
+
+	n := 20 * len(e.ips)
+	perIP, err := e.batch(n, "/")
+	if err != nil {
+		return err
+	}
+	for _, ip := range e.ips {
+		if perIP[ip] == 0 {
+			return fmt.Errorf("IP %s received none of %d requests: %v", ip, n, perIP)
+		}
+	}
+
+	var stats struct {
+		TotalRequests int64 `json:"total_requests"`
+	}
+	if err := e.inst.GetJSON("/stats", &stats); err != nil {
+		return err
+	}
+	if stats.TotalRequests < int64(n) {
+		return fmt.Errorf("/stats reports %d requests, want at least %d", stats.TotalRequests, n)
+	}
+	return nil
+}
+
+func runIPFailure(e *env) error {
+	cfg := e.baseConfig(e.ips)
+	cfg["health_check_enabled"] = true
+	cfg["health_check_type"] = "http"
+	cfg["health_check_target"] = e.backend.URL("/health")
+	cfg["health_check_interval"] = "500ms"
+	cfg["health_check_timeout"] = "1s"
+	cfg["health_check_failure_threshold"] = 1
+	cfg["health_check_success_threshold"] = 1
+	if err := e.start(cfg); err != nil {
+		return err
+	}
+
+	failed := e.ips[0]
+	e.backend.SetFailed(failed, true)
+	err := e.eventually(15*time.Second, func() error {
+		perIP, err := e.batch(3*len(e.ips), "/")
+		if err != nil {
+			return err
+		}
+		if perIP[failed] > 0 {
+			return fmt.Errorf("failed IP %s still received traffic: %v", failed, perIP)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("after failing %s: %w", failed, err)
+	}
+
+	e.backend.SetFailed(failed, false)
+	err = e.eventually(15*time.Second, func() error {
+		perIP, err := e.batch(3*len(e.ips), "/")
+		if err != nil {
+			return err
+		}
+		if perIP[failed] == 0 {
+			return fmt.Errorf("recovered IP %s received no traffic: %v", failed, perIP)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("after recovering %s: %w", failed, err)
+	}
+	return nil
+}
+
+func runConfigReload(e *env) error {
+	if err := e.start(e.baseConfig(e.ips)); err != nil {
+		return err
+	}
+
+	removed := e.ips[0]
+	if err := e.inst.Reload(e.baseConfig(e.ips[1:])); err != nil {
+		return err
+	}
+	err := e.eventually(10*time.Second, func() error {
+		perIP, err := e.batch(3*len(e.ips), "/")
+		if err != nil {
+			return err
+		}
+		if perIP[removed] > 0 {
+			return fmt.Errorf("removed IP %s still received traffic: %v", removed, perIP)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("after removing %s: %w", removed, err)
+	}
+
+	if err := e.inst.Reload(e.baseConfig(e.ips)); err != nil {
+		return err
+	}
+	err = e.eventually(10*time.Second, func() error {
+		perIP, err := e.batch(3*len(e.ips), "/")
+		if err != nil {
+			return err
+		}
+		if perIP[removed] == 0 {
+			return fmt.Errorf("re-added IP %s received no traffic: %v", removed, perIP)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("after re-adding %s: %w", removed, err)
+	}
+	return nil
+}
+
+func runLimitSaturation(e *env) error {
+	const perIP = 2
+	cfg := e.baseConfig(e.ips)
+	cfg["max_conns_per_ip"] = perIP
+	cfg["max_conns_total"] = 1000
+	if err := e.start(cfg); err != nil {
+		return err
+	}
+	defer e.backend.Release()
+
+	// Fill every connection slot with requests the backend holds open
+	capacity := perIP * len(e.ips)
+	statuses := make([]int, capacity)
+	errs := make([]error, capacity)
+	var wg sync.WaitGroup
+	for i := 0; i < capacity; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses[i], _, errs[i] = e.inst.Get(e.backend.URL("/hold"))
+		}()
+	}
+	err := e.eventually(10*time.Second, func() error {
+		if held := e.backend.Held(); held != capacity {
+			return fmt.Errorf("backend holds %d requests, want %d", held, capacity)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Everything beyond the limits is turned away
+	extra := len(e.ips) + 1
+	for i := 0; i < extra; i++ {
+		status, _, err := e.inst.Get(e.backend.URL("/"))
+		if err != nil {
+			return err
+		}
+		if status != http.StatusServiceUnavailable {
+			return fmt.Errorf("request over the limits: status %d, want 503", status)
+		}
+	}
+
+	e.backend.Release()
+	wg.Wait()
+	for i := range statuses {
+		if errs[i] != nil {
+			return fmt.Errorf("held request: %w", errs[i])
+		}
+		if statuses[i] != http.StatusOK {
+			return fmt.Errorf("held request: status %d, want 200", statuses[i])
+		}
+	}
+
+	var rejections struct {
+		Rejections []struct {
+			Reason string `json:"reason"`
+		} `json:"rejections"`
+	}
+	if err := e.inst.GetJSON("/debug/rejections", &rejections); err != nil {
+		return err
+	}
+	if len(rejections.Rejections) < extra {
+		return fmt.Errorf("/debug/rejections lists %d rejections, want at least %d", len(rejections.Rejections), extra)
+	}
+
+	// Freed slots are usable again
+	if _, err := e.batch(len(e.ips), "/"); err != nil {
+		return fmt.Errorf("after releasing: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/config"
+	"github.com/cr0hn/outbound-lb/internal/logger"
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
+)
+
+// initAdmin creates the metrics server with its health, admin, event and
+// debug endpoints, and their access control.
+func (a *app) initAdmin() error {
+	cfg := a.cfg
+	a.metricsServer = metrics.NewServer(cfg.MetricsPort, a.stats)
+	a.metricsServer.SetDrainControl(a.bal.SetDrain)
+
+	// /drain starts the same graceful shutdown as SIGTERM, for preStop hooks
+	a.metricsServer.SetShutdown(func() {
+		a.drainOnce.Do(func() { close(a.drainCh) })
+	})
+	if cfg.ReadyRequiresHealthyIP && a.healthChecker != nil {
+		a.metricsServer.SetReadyCheck(func() error {
+			if !a.healthChecker.AnyHealthy() {
+				return errors.New("no healthy outbound IP")
+			}
+			return nil
+		})
+	}
+	a.metricsServer.Handle("/events", a.eventStream)
+	metricsUser, metricsPass, _ := cfg.GetMetricsCredentials()
+	for _, entry := range cfg.MetricsAllow {
+		if prefix, err := netutil.ParsePrefix(entry); err == nil {
+			a.metricsAllow = append(a.metricsAllow, prefix)
+		}
+	}
+	a.metricsServer.SetAccess(metricsUser, metricsPass, a.metricsAllow)
+	if metricsUser == "" && len(a.metricsAllow) == 0 {
+		logger.Info("admin_endpoints_disabled", "reason", "/drain and /admin/ require metrics_auth or metrics_allow")
+	}
+	if cfg.MetricsDebug {
+		a.metricsServer.EnableDebug()
+		if metricsUser == "" && len(a.metricsAllow) == 0 {
+			logger.Warn("metrics_debug_unprotected", "reason", "profiles are served to any client; set metrics_auth or metrics_allow")
+		}
+	}
+	if cfg.MetricsTLSCert != "" {
+		if err := a.metricsServer.ReloadTLS(cfg.MetricsTLSCert, cfg.MetricsTLSKey); err != nil {
+			return fmt.Errorf("loading metrics certificate: %w", err)
+		}
+	}
+	if cfg.RejectionHistory > 0 {
+		a.metricsServer.SetRejections(func() any { return a.proxyServer.Rejections() })
+	}
+	return nil
+}
+
+// startMetrics serves the metrics server on its port and unix socket, and
+// starts the periodic metrics pushes.
+func (a *app) startMetrics() error {
+	cfg := a.cfg
+
+	// Periodic pushes for hosts Prometheus cannot scrape
+	if (cfg.PushgatewayURL != "" || cfg.RemoteWriteURL != "") && cfg.PushInterval > 0 {
+		go pushPeriodically(cfg, a.pushStop)
+	}
+
+	metricsLn, err := a.proxyServer.Listen(net.JoinHostPort(cfg.MetricsBind, strconv.Itoa(cfg.MetricsPort)))
+	if err != nil {
+		return fmt.Errorf("metrics server: %w", err)
+	}
+	go func() {
+		logger.Info("starting metrics server",
+			"port", cfg.MetricsPort,
+			"bind", cfg.MetricsBind,
+			"tls", cfg.MetricsTLSCert != "",
+			"auth_enabled", cfg.MetricsAuth != "",
+		)
+		if err := a.metricsServer.Serve(metricsLn); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("metrics server error", "error", err)
+		}
+	}()
+
+	if cfg.MetricsListenUnix != "" {
+		mode, _ := cfg.UnixSocketFileMode()
+		metricsUnixLn, err := netutil.ListenUnix(cfg.MetricsListenUnix, mode)
+		if err != nil {
+			return fmt.Errorf("metrics server: %w", err)
+		}
+		go func() {
+			logger.Info("starting metrics unix listener", "path", cfg.MetricsListenUnix)
+			if err := a.metricsServer.ServeUnix(metricsUnixLn); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("metrics server error", "error", err)
+			}
+		}()
+	}
+	return nil
+}
+
+// reloadMetricsAuth re-reads the metrics credentials from the
+// --metrics-auth-file file, if set, keeping the current ones on failure.
+func (a *app) reloadMetricsAuth() {
+	cfg := a.cfg
+	if cfg.MetricsAuthFile == "" {
+		return
+	}
+	creds, err := config.ReadSecretFile(cfg.MetricsAuthFile)
+	user, pass, ok := strings.Cut(creds, ":")
+	switch {
+	case err != nil:
+		logger.Error("metrics_auth_reload_failed", "error", err)
+	case !ok:
+		logger.Error("metrics_auth_reload_failed", "path", cfg.MetricsAuthFile, "error", "must hold user:pass")
+	default:
+		a.metricsServer.SetAccess(user, pass, a.metricsAllow)
+		logger.Info("metrics_auth_loaded", "path", cfg.MetricsAuthFile)
+	}
+}
+
+// pushMetrics pushes the current metrics to the Pushgateway and the
+// remote-write endpoint, if set, logging failures and successes at level.
+func pushMetrics(cfg *config.Config, level string) {
+	if cfg.PushgatewayURL != "" {
+		if err := metrics.Push(cfg.PushgatewayURL, cfg.PushgatewayJob); err != nil {
+			logger.Error("metrics push failed", "url", cfg.PushgatewayURL, "error", err)
+		} else {
+			logger.Log(level, "metrics pushed", "url", cfg.PushgatewayURL, "job", cfg.PushgatewayJob)
+		}
+	}
+	if cfg.RemoteWriteURL != "" {
+		instance, _ := os.Hostname()
+		if err := metrics.RemoteWrite(cfg.RemoteWriteURL, cfg.PushgatewayJob, instance); err != nil {
+			logger.Error("metrics remote write failed", "error", err)
+		} else {
+			logger.Log(level, "metrics remote written", "job", cfg.PushgatewayJob)
+		}
+	}
+}
+
+// pushPeriodically pushes the metrics every cfg.PushInterval until stop is
+// closed.
+func pushPeriodically(cfg *config.Config, stop <-chan struct{}) {
+	ticker := time.NewTicker(cfg.PushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			pushMetrics(cfg, "debug")
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/balancer"
+	"github.com/cr0hn/outbound-lb/internal/gossip"
+	"github.com/cr0hn/outbound-lb/internal/logger"
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+	"github.com/cr0hn/outbound-lb/internal/registry"
+	"github.com/cr0hn/outbound-lb/internal/store"
+)
+
+// initCluster starts gossiping the connection counts with the other
+// instances and opens the store shared with them, if configured.
+func (a *app) initCluster() error {
+	cfg := a.cfg
+
+	// Count the connections of the other instances against the per-IP limit
+	if cfg.ClusterBind != "" {
+		node, err := gossip.New(gossip.Config{
+			Bind:     cfg.ClusterBind,
+			Peers:    cfg.ClusterPeers,
+			Interval: cfg.ClusterInterval,
+			Secret:   cfg.ClusterSecret,
+		}, a.lim.Counts, a.lim.SetPeerCounts)
+		if err != nil {
+			return fmt.Errorf("starting cluster membership: %w", err)
+		}
+		a.clusterNode = node
+		a.clusterNode.Start()
+		logger.Info("cluster_configured",
+			"bind", a.clusterNode.Addr().String(),
+			"peers", cfg.ClusterPeers,
+			"interval", cfg.ClusterInterval,
+		)
+	}
+
+	// Share the selection history and the quotas with the other instances
+	if cfg.SharedStateURL != "" {
+		st, err := store.Open(cfg.SharedStateURL)
+		if err != nil {
+			return fmt.Errorf("opening shared state store: %w", err)
+		}
+		a.sharedStore = st
+		logger.Info("shared_state_configured",
+			"prefix", cfg.SharedStatePrefix,
+			"interval", cfg.SharedStateInterval,
+		)
+	}
+	return nil
+}
+
+// initState restores the balancer history and counters where the last run
+// left them, and saves them periodically, if a state directory is set.
+func (a *app) initState() error {
+	if a.cfg.StateDir == "" {
+		return nil
+	}
+	fileStore, err := store.NewFile(a.cfg.StateDir)
+	if err != nil {
+		return fmt.Errorf("opening state directory: %w", err)
+	}
+	a.stateStore = fileStore
+	loadState(a.stateStore, a.bal, a.stats)
+	go saveStatePeriodically(a.cfg.StateInterval, func() { saveState(a.stateStore, a.bal, a.stats) }, a.stateStop)
+	return nil
+}
+
+// initRegistry sets up the two-tier deployment: as a frontend, agents
+// register their outbound IPs, used through the agents; as an agent, the
+// outbound IPs of this instance are announced to a frontend.
+func (a *app) initRegistry() error {
+	cfg := a.cfg
+	if cfg.RegistryServe {
+		a.reg = registry.New(cfg.RegistryToken, func(upstreams map[netip.Addr]*url.URL) {
+			added, removed := a.proxyServer.SetRemoteIPs(upstreams)
+			logger.Info("registry_ips_updated", "remote_ips", len(upstreams), "added", added, "removed", removed)
+		})
+		a.reg.Start()
+		a.metricsServer.Handle("/registry", a.reg)
+		logger.Info("registry_serving", "port", cfg.MetricsPort, "path", "/registry")
+	}
+	if cfg.RegistryURL != "" {
+		a.agent = registry.NewAgent(cfg.RegistryURL, cfg.RegistryAdvertiseURL, cfg.RegistryToken, cfg.RegistryInterval, a.outboundIPs)
+		a.agent.Start()
+		logger.Info("registry_agent_started", "registry", cfg.RegistryURL, "interval", cfg.RegistryInterval)
+	}
+
+	// Multi-instance state for /cluster/status
+	if a.reg != nil || a.agent != nil {
+		reg, agent := a.reg, a.agent
+		a.metricsServer.SetClusterStatus(func() any { return registry.ClusterStatus(reg, agent) })
+	}
+	return nil
+}
+
+// leaveRegistry stops announcing this instance to the frontend and stops
+// serving the registry.
+func (a *app) leaveRegistry() {
+	if a.agent != nil {
+		a.agent.Stop()
+	}
+	if a.reg != nil {
+		a.reg.Stop()
+	}
+}
+
+// closeCluster stops gossiping, closes the shared store and saves the state
+// a last time.
+func (a *app) closeCluster() {
+	if a.clusterNode != nil {
+		a.clusterNode.Stop()
+	}
+	if a.sharedStore != nil {
+		a.sharedStore.Close()
+	}
+	if a.stateStore != nil {
+		close(a.stateStop)
+		saveState(a.stateStore, a.bal, a.stats)
+		a.stateStore.Close()
+	}
+}
+
+// statsKey is the store key the statistics counters are saved under.
+const statsKey = "stats:counters"
+
+// stateTimeout bounds saving or restoring the state.
+const stateTimeout = 10 * time.Second
+
+// loadState restores the balancer state and the statistics counters saved
+// in st. Failures are logged and start from scratch.
+func loadState(st store.Store, bal balancer.Balancer, stats *metrics.StatsCollector) {
+	ctx, cancel := context.WithTimeout(context.Background(), stateTimeout)
+	defer cancel()
+
+	entries, err := bal.LoadState(ctx, st)
+	if err != nil {
+		logger.Warn("state_restore_failed", "state", "balancer", "error", err)
+	}
+	var counters metrics.Counters
+	if err := store.GetJSON(ctx, st, statsKey, &counters); err == nil {
+		stats.RestoreCounters(counters)
+	} else if !errors.Is(err, store.ErrNotFound) {
+		logger.Warn("state_restore_failed", "state", "stats", "error", err)
+	}
+	logger.Info("state_restored", "history_entries", entries, "total_requests", counters.TotalRequests)
+}
+
+// saveState saves the balancer state and the statistics counters to st.
+func saveState(st store.Store, bal balancer.Balancer, stats *metrics.StatsCollector) {
+	ctx, cancel := context.WithTimeout(context.Background(), stateTimeout)
+	defer cancel()
+
+	if err := bal.SaveState(ctx, st); err != nil {
+		logger.Warn("state_save_failed", "state", "balancer", "error", err)
+	}
+	if err := store.SetJSON(ctx, st, statsKey, stats.Counters(), 0); err != nil {
+		logger.Warn("state_save_failed", "state", "stats", "error", err)
+	}
+}
+
+// saveStatePeriodically calls save every interval until stop is closed.
+func saveStatePeriodically(interval time.Duration, save func(), stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			save()
+		case <-stop:
+			return
+		}
+	}
+}
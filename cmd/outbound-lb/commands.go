@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+
+	"github.com/cr0hn/outbound-lb/internal/config"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
+)
+
+const usage = `Usage: outbound-lb [command] [flags]
+
+Commands:
+  serve          Run the proxy (default when no command is given)
+  validate       Check the configuration and exit
+  print-config   Print the effective configuration as YAML
+  test-ip IP     Make a request from an outbound IP and report timings
+  help           Show this help
+
+Run "outbound-lb <command> --help" for the flags of a command.
+`
+
+func main() {
+	name, args := "serve", os.Args[1:]
+	// Flags without a command run the proxy, as before commands existed
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	switch name {
+	case "serve":
+		serve(args)
+	case "validate":
+		os.Exit(validate(args))
+	case "print-config":
+		os.Exit(printConfig(args))
+	case "test-ip":
+		os.Exit(testIP(args))
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", name, usage)
+		os.Exit(2)
+	}
+}
+
+// validate parses and validates the configuration like serve, reporting the
+// outbound IPs that are not assigned to this host.
+func validate(args []string) int {
+	cfg, err := config.ParseFlags(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration: %v\n", err)
+		return 1
+	}
+	for _, ip := range cfg.IPs {
+		if err := netutil.ValidateLocalIP(ip); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+		}
+	}
+	fmt.Printf("configuration is valid: %d outbound IPs, proxy port %d, metrics port %d\n",
+		len(cfg.IPs), cfg.Port, cfg.MetricsPort)
+	return 0
+}
+
+// printConfig prints the configuration serve would run with, from the
+// defaults, the config file, the environment and the flags, with secrets
+// redacted.
+func printConfig(args []string) int {
+	cfg, err := config.ParseFlags(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration: %v\n", err)
+		return 1
+	}
+	enc := yaml.NewEncoder(os.Stdout)
+	enc.SetIndent(2)
+	if err := enc.Encode(cfg.Redacted()); err != nil {
+		fmt.Fprintf(os.Stderr, "encoding configuration: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// testIP requests a URL from one outbound IP, without starting the proxy,
+// and reports the phase timings. It fails on connection errors and on
+// statuses of 400 and above.
+func testIP(args []string) int {
+	fs := pflag.NewFlagSet("test-ip", pflag.ExitOnError)
+	target := fs.String("target", "", "URL to request from the IP (required)")
+	timeout := fs.Duration("timeout", 10*time.Second, "Request timeout")
+	configFile := fs.String("config", "", "Config file to take the interface and fwmark of the IP from")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: outbound-lb test-ip IP --target URL [flags]\n\n%s", fs.FlagUsages())
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 || *target == "" {
+		fs.Usage()
+		return 2
+	}
+
+	addr, err := netutil.ParseAddr(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid IP %q\n", fs.Arg(0))
+		return 2
+	}
+	ip := addr.String()
+	var opts netutil.SocketOptions
+	if *configFile != "" {
+		fileCfg, err := config.LoadFromFile(*configFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		opts = fileCfg.SocketOptions()[addr]
+	}
+	if err := netutil.ValidateLocalIP(ip); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	}
+
+	dialer := &net.Dialer{
+		LocalAddr: &net.TCPAddr{IP: addr.AsSlice()},
+		Timeout:   *timeout,
+		Control:   opts.Control(),
+	}
+	client := &http.Client{
+		Transport: &http.Transport{DialContext: dialer.DialContext, DisableKeepAlives: true},
+		Timeout:   *timeout,
+		// Report the response of the target itself
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	var start, dnsStart, dnsDone, connectStart, connectDone, tlsStart, tlsDone, firstByte time.Time
+	var remote string
+	trace := &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone:           func(httptrace.DNSDoneInfo) { dnsDone = time.Now() },
+		ConnectStart:      func(string, string) { connectStart = time.Now() },
+		ConnectDone:       func(_, addr string, _ error) { connectDone, remote = time.Now(), addr },
+		TLSHandshakeStart: func() { tlsStart = time.Now() },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { tlsDone = time.Now() },
+		GotFirstResponseByte: func() {
+			firstByte = time.Now()
+		},
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodGet, *target, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid target: %v\n", err)
+		return 2
+	}
+
+	fmt.Printf("ip:       %s\ntarget:   %s\n", ip, *target)
+	start = time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Printf("error:    %v\n", err)
+		return 1
+	}
+	n, _ := io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	total := time.Since(start)
+
+	phase := func(name string, from, to time.Time) {
+		if !from.IsZero() && !to.IsZero() {
+			fmt.Printf("%-9s %s\n", name+":", to.Sub(from).Round(time.Microsecond))
+		}
+	}
+	fmt.Printf("remote:   %s\n", remote)
+	phase("dns", dnsStart, dnsDone)
+	phase("connect", connectStart, connectDone)
+	phase("tls", tlsStart, tlsDone)
+	phase("ttfb", start, firstByte)
+	fmt.Printf("total:    %s\n", total.Round(time.Microsecond))
+	fmt.Printf("status:   %s\nbytes:    %d\n", resp.Status, n)
+	if resp.StatusCode >= 400 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+
+	"github.com/cr0hn/outbound-lb/internal/config"
+	"github.com/cr0hn/outbound-lb/internal/logger"
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+	"github.com/cr0hn/outbound-lb/internal/proxy"
+	"github.com/cr0hn/outbound-lb/internal/socks"
+)
+
+// startListeners serves the proxy on its port, additional listeners and unix
+// socket, the gateway and the SOCKS5 server. Any of them failing exits the
+// process. The proxy is reported ready as it starts.
+func (a *app) startListeners() error {
+	go func() {
+		a.metricsServer.SetReady(true)
+		if err := a.proxyServer.Start(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("proxy server error", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	for _, addr := range a.proxyServer.ListenerAddrs() {
+		go func() {
+			if err := a.proxyServer.StartListener(addr); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("proxy listener error", "addr", addr, "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	if a.proxyServer.UnixEnabled() {
+		go func() {
+			if err := a.proxyServer.StartUnix(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("proxy unix listener error", "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	if a.proxyServer.GatewayEnabled() {
+		go func() {
+			if err := a.proxyServer.StartGateway(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("gateway server error", "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	if a.socksServer != nil {
+		go func() {
+			if err := a.socksServer.Start(); err != nil && !errors.Is(err, socks.ErrServerClosed) {
+				logger.Error("socks server error", "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
+	return nil
+}
+
+// stopAccepting closes the proxy and SOCKS5 listeners, leaving the open
+// connections alone.
+func (a *app) stopAccepting(ctx context.Context) {
+	if err := a.proxyServer.StopAccepting(ctx); err != nil {
+		logger.Error("proxy server shutdown error", "error", err)
+	}
+	if a.socksServer != nil {
+		a.socksServer.StopAccepting()
+	}
+}
+
+// stopListeners shuts the SOCKS5 and proxy servers down.
+func (a *app) stopListeners(ctx context.Context) {
+	if a.socksServer != nil {
+		if err := a.socksServer.Shutdown(ctx); err != nil {
+			logger.Error("socks server shutdown error", "error", err)
+		}
+	}
+	if err := a.proxyServer.Shutdown(ctx); err != nil {
+		logger.Error("proxy server shutdown error", "error", err)
+	}
+}
+
+// reloadCertificates re-reads the certificates of the proxy listener and the
+// additional listeners, the client CA bundle and the metrics certificate of
+// cfg from disk. Each keeps its current value when the new one cannot be
+// loaded.
+func reloadCertificates(cfg *config.Config, proxyServer *proxy.Server, metricsServer *metrics.Server) {
+	if err := proxyServer.ReloadTLS(cfg.ListenTLSCert, cfg.ListenTLSKey); err != nil {
+		logger.Error("listener_certificate_reload_failed", "error", err)
+	}
+	if err := proxyServer.ReloadClientCA(); err != nil {
+		logger.Error("client_ca_reload_failed", "error", err)
+	}
+	if err := proxyServer.ReloadListenerTLS(); err != nil {
+		logger.Error("listener_certificate_reload_failed", "error", err)
+	}
+	if cfg.MetricsTLSCert != "" {
+		if err := metricsServer.ReloadTLS(cfg.MetricsTLSCert, cfg.MetricsTLSKey); err != nil {
+			logger.Error("metrics_certificate_reload_failed", "error", err)
+		}
+	}
+}
@@ -3,20 +3,28 @@ package main
 
 import (
 	"context"
-	"errors"
-	"net/http"
+	"fmt"
+	"net/netip"
 	"os"
 	"os/signal"
+	"slices"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/cr0hn/outbound-lb/internal/balancer"
 	"github.com/cr0hn/outbound-lb/internal/config"
+	"github.com/cr0hn/outbound-lb/internal/gossip"
 	"github.com/cr0hn/outbound-lb/internal/health"
 	"github.com/cr0hn/outbound-lb/internal/limiter"
 	"github.com/cr0hn/outbound-lb/internal/logger"
 	"github.com/cr0hn/outbound-lb/internal/metrics"
+	"github.com/cr0hn/outbound-lb/internal/notify"
 	"github.com/cr0hn/outbound-lb/internal/proxy"
+	"github.com/cr0hn/outbound-lb/internal/registry"
+	"github.com/cr0hn/outbound-lb/internal/socks"
+	"github.com/cr0hn/outbound-lb/internal/store"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
 )
 
 // Version information set via ldflags at build time.
@@ -26,16 +34,120 @@ var (
 	date    = "unknown"
 )
 
-func main() {
+// app is a running proxy: its components, set up by the init methods of each
+// subsystem in the order of start, and stopped by shutdown.
+type app struct {
+	cfg         *config.Config
+	outboundIPs []netip.Addr
+	accessLog   *logger.AccessLog
+
+	stats          *metrics.StatsCollector
+	statsd         *metrics.StatsD
+	notifier       *notify.Notifier
+	eventStream    *notify.Stream
+	events         notify.Sink
+	lim            *limiter.Limiter
+	healthChecker  *health.HealthChecker
+	circuitBreaker *balancer.CircuitBreaker
+	bal            balancer.Balancer
+	proxyServer    *proxy.Server
+	socksServer    *socks.Server
+
+	// Cluster and stores, see cluster.go
+	clusterNode *gossip.Node
+	sharedStore store.Store
+	stateStore  store.Store
+	stateStop   chan struct{}
+	reg         *registry.Registry
+	agent       *registry.Agent
+
+	// Metrics server and admin endpoints, see admin.go
+	metricsServer *metrics.Server
+	metricsAllow  []netip.Prefix
+	drainCh       chan struct{}
+	drainOnce     sync.Once
+	pushStop      chan struct{}
+
+	// Configuration reload, see reload.go
+	cfgWatcher   *config.ConfigWatcher
+	updateMu     sync.Mutex
+	drainIPs     []string
+	discoverStop chan struct{}
+}
+
+// serve runs the proxy with the configuration from args, the environment and
+// the config file.
+func serve(args []string) {
 	// Parse configuration
-	cfg, err := config.ParseFlags()
+	cfg, err := config.ParseFlags(args)
 	if err != nil {
 		logger.Error("failed to parse configuration", "error", err)
 		os.Exit(1)
 	}
 
-	// Initialize logger
+	a := &app{
+		cfg:          cfg,
+		stateStop:    make(chan struct{}),
+		drainCh:      make(chan struct{}),
+		pushStop:     make(chan struct{}),
+		discoverStop: make(chan struct{}),
+	}
+	if err := a.start(); err != nil {
+		logger.Error("failed to start", "error", err)
+		os.Exit(1)
+	}
+	a.wait()
+	a.shutdown()
+}
+
+// start sets up the subsystems in order and starts serving.
+func (a *app) start() error {
+	for _, step := range []func() error{
+		a.initLogging,
+		a.initLimiter,
+		a.initCluster,
+		a.initBalancer,
+		a.initState,
+		a.initProxy,
+		a.initAdmin,
+		a.initRegistry,
+		a.initReload,
+		a.startMetrics,
+		a.startListeners,
+	} {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// initLogging sets up the log output, the access log and the outbound IPs
+// they report.
+func (a *app) initLogging() error {
+	cfg := a.cfg
 	logger.Init(cfg.LogLevel, cfg.LogFormat)
+	rotation := logger.Rotation{
+		MaxSize:    int64(cfg.LogMaxSize) << 20,
+		MaxAge:     cfg.LogMaxAge,
+		MaxBackups: cfg.LogMaxBackups,
+	}
+	switch {
+	case cfg.LogFile != "":
+		if err := logger.OpenLogFile(cfg.LogFile, rotation); err != nil {
+			return fmt.Errorf("opening log file: %w", err)
+		}
+	case cfg.Syslog != "":
+		if err := logger.OpenSyslog(cfg.Syslog, cfg.SyslogTag); err != nil {
+			return fmt.Errorf("connecting to syslog: %w", err)
+		}
+	case cfg.Journald:
+		if err := logger.OpenJournald(cfg.SyslogTag); err != nil {
+			return fmt.Errorf("connecting to journald: %w", err)
+		}
+	}
+	logger.SetRequestSampling(cfg.LogSampleRate)
+	metrics.SetRequestLogsSuppressedSource(logger.SuppressedRequests)
 	logger.Info("outbound-lb starting",
 		"version", version,
 		"commit", commit,
@@ -44,148 +156,359 @@ func main() {
 		"port", cfg.Port,
 		"metrics_port", cfg.MetricsPort,
 	)
+	outboundIPs, err := netutil.ParseAddrs(cfg.IPs)
+	if err != nil {
+		return fmt.Errorf("parsing outbound IPs: %w", err)
+	}
+	a.outboundIPs = outboundIPs
+
+	// Access log, written whatever the log level
+	if cfg.AccessLog != "" {
+		a.accessLog, err = logger.NewAccessLog(cfg.AccessLog, cfg.AccessLogFormat, rotation)
+		if err != nil {
+			return fmt.Errorf("opening access log: %w", err)
+		}
+		logger.SetAccessLog(a.accessLog)
+		logger.Info("access_log_enabled", "output", cfg.AccessLog, "format", cfg.AccessLogFormat)
+	}
+	return nil
+}
 
-	// Create components
-	stats := metrics.NewStatsCollector(cfg.IPs)
-	lim := limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, cfg.IPs)
-
-	// Create health checker if enabled
-	var healthChecker *health.HealthChecker
-	if cfg.HealthCheckEnabled {
-		var checker health.Checker
-		switch cfg.HealthCheckType {
-		case "http":
-			checker = health.NewHTTPChecker(cfg.HealthCheckTarget, cfg.HealthCheckTimeout)
-			logger.Info("health_check_configured", "type", "http", "target", cfg.HealthCheckTarget)
-		default:
-			checker = health.NewTCPChecker(cfg.HealthCheckTarget, cfg.HealthCheckTimeout)
-			logger.Info("health_check_configured", "type", "tcp", "target", cfg.HealthCheckTarget)
-		}
-
-		healthChecker = health.NewHealthChecker(health.HealthCheckerConfig{
-			IPs:              cfg.IPs,
-			Checker:          checker,
+// initLimiter creates the statistics collector, its StatsD and webhook
+// outputs, and the connection limiter.
+func (a *app) initLimiter() error {
+	cfg := a.cfg
+	a.stats = metrics.NewStatsCollector(a.outboundIPs)
+	metrics.SetHostAllowlist(cfg.MetricsHosts)
+	metrics.SetHostLabelMode(cfg.MetricsHostLabel, cfg.MetricsHostLimit)
+	if cfg.HostStats > 0 {
+		a.stats.EnableHostStats(cfg.HostStats)
+	}
+	if cfg.StatsDAddress != "" {
+		var err error
+		a.statsd, err = metrics.NewStatsD(cfg.StatsDAddress, cfg.StatsDPrefix, cfg.StatsDTags, cfg.StatsDDogStatsD)
+		if err != nil {
+			return fmt.Errorf("setting up statsd: %w", err)
+		}
+		a.stats.EnableStatsD(a.statsd)
+		logger.Info("statsd_enabled", "address", cfg.StatsDAddress, "dogstatsd", cfg.StatsDDogStatsD)
+	}
+	if len(cfg.WebhookURLs) > 0 {
+		a.notifier = notify.New(notify.Config{
+			URLs:          cfg.WebhookURLs,
+			Format:        cfg.WebhookFormat,
+			RatePerMinute: cfg.WebhookRate,
+			Retries:       cfg.WebhookRetries,
+		})
+		logger.Info("webhooks_enabled", "urls", len(cfg.WebhookURLs), "format", cfg.WebhookFormat)
+	}
+	a.lim = limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, a.outboundIPs)
+	a.lim.SetReserved(cfg.ReservedConnsHigh, cfg.ReservedConnsNormal)
+	a.stats.SetLimiterSource(a.lim.Info)
+	return nil
+}
+
+// initBalancer creates the health checker and the circuit breaker, if
+// enabled, and the balancer selecting the outbound IPs.
+func (a *app) initBalancer() error {
+	cfg := a.cfg
+
+	// Create health checker if active or passive checks are enabled
+	if cfg.HealthCheckEnabled || cfg.PassiveHealthEnabled {
+		hcCfg := health.HealthCheckerConfig{
+			IPs:              a.outboundIPs,
 			Interval:         cfg.HealthCheckInterval,
 			Timeout:          cfg.HealthCheckTimeout,
 			FailureThreshold: cfg.HealthCheckFailureThreshold,
 			SuccessThreshold: cfg.HealthCheckSuccessThreshold,
-		})
-		healthChecker.Start()
-	}
-
-	balCfg := balancer.Config{
-		IPs:           cfg.IPs,
-		HistoryWindow: int64(cfg.HistoryWindow.Seconds()),
-		HistorySize:   cfg.HistorySize,
-		Limiter:       lim,
-		HealthChecker: healthChecker,
-	}
-	bal := balancer.New(balCfg)
-	bal.Start()
-
-	// Create servers
-	proxyServer := proxy.NewServer(cfg, bal, lim, stats)
-	metricsServer := metrics.NewServer(cfg.MetricsPort, stats)
-
-	// Set up config watcher if config file is specified
-	var cfgWatcher *config.ConfigWatcher
-	if cfg.ConfigFile != "" {
-		var watcherErr error
-		cfgWatcher, watcherErr = config.NewConfigWatcher(cfg.ConfigFile, cfg)
-		if watcherErr != nil {
-			logger.Error("failed to create config watcher", "error", watcherErr)
+		}
+		if cfg.HealthCheckEnabled {
+			switch cfg.HealthCheckType {
+			case "http":
+				hcCfg.Checker = health.NewHTTPChecker(cfg.HealthCheckTarget, cfg.HealthCheckTimeout).WithSocketOptions(cfg.SocketOptions())
+				logger.Info("health_check_configured", "type", "http", "target", cfg.HealthCheckTarget)
+			default:
+				hcCfg.Checker = health.NewTCPChecker(cfg.HealthCheckTarget, cfg.HealthCheckTimeout).WithSocketOptions(cfg.SocketOptions())
+				logger.Info("health_check_configured", "type", "tcp", "target", cfg.HealthCheckTarget)
+			}
 		} else {
-			// Register callback for configuration changes
-			cfgWatcher.RegisterCallback(func(newCfg *config.Config) {
-				// Reconfigure logger
-				logger.Reconfigure(newCfg.LogLevel, newCfg.LogFormat)
-
-				// Update limiter
-				lim.UpdateLimits(newCfg.MaxConnsPerIP, newCfg.MaxConnsTotal)
-
-				// Update balancer history config
-				bal.UpdateHistoryConfig(newCfg.HistoryWindow, newCfg.HistorySize)
-			})
+			// Without active checks, traffic is the only way back to healthy
+			hcCfg.RetryAfter = cfg.PassiveHealthRetry
+		}
 
-			if startErr := cfgWatcher.Start(); startErr != nil {
-				logger.Error("failed to start config watcher", "error", startErr)
-			}
+		a.healthChecker = health.NewHealthChecker(hcCfg)
+		a.stats.SetHealthSource(a.healthChecker.Info)
+		if cfg.HealthCheckEnabled {
+			a.healthChecker.Start()
 		}
 	}
 
-	// Start metrics server
-	go func() {
-		logger.Info("starting metrics server", "port", cfg.MetricsPort)
-		if err := metricsServer.Start(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			logger.Error("metrics server error", "error", err)
+	balCfg := balancer.Config{
+		IPs:              a.outboundIPs,
+		HistoryWindow:    int64(cfg.HistoryWindow.Seconds()),
+		HistorySize:      cfg.HistorySize,
+		Limiter:          a.lim,
+		RotationPolicy:   balancer.RotationPolicy(cfg.RotationPolicy),
+		RotationEvery:    cfg.RotationEvery,
+		RotationInterval: cfg.RotationInterval,
+		WarmupPeriod:     cfg.WarmupPeriod,
+		CooldownAfter:    cfg.CooldownAfter,
+		CooldownDuration: cfg.CooldownDuration,
+		Weights:          cfg.Weights,
+	}
+	// Only set when enabled: a nil *HealthChecker in the interface is not nil
+	if a.healthChecker != nil {
+		balCfg.HealthChecker = a.healthChecker
+	}
+	if cfg.AffinityMode == "client" {
+		balCfg.AffinityWindow = cfg.AffinityWindow
+	}
+	if len(cfg.Pools) > 0 {
+		routes := make([]balancer.Route, 0, len(cfg.Routes))
+		for _, r := range cfg.Routes {
+			routes = append(routes, balancer.Route{Host: r.Host, Regex: r.Regex, Pool: r.Pool})
 		}
-	}()
-
-	// Start proxy server
-	go func() {
-		metricsServer.SetReady(true)
-		if err := proxyServer.Start(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			logger.Error("proxy server error", "error", err)
-			os.Exit(1)
+		router, err := balancer.NewRouter(cfg.Pools, routes)
+		if err != nil {
+			return fmt.Errorf("invalid routing configuration: %w", err)
 		}
-	}()
+		balCfg.Router = router
+	}
+	// Create circuit breaker if enabled
+	if cfg.CircuitBreakerEnabled {
+		a.circuitBreaker = balancer.NewCircuitBreaker(balancer.CircuitBreakerConfig{
+			FailureThreshold: cfg.CBFailureThreshold,
+			SuccessThreshold: cfg.CBSuccessThreshold,
+			Timeout:          cfg.CBTimeout,
+		})
+		balCfg.CircuitBreaker = a.circuitBreaker
+		a.stats.SetCircuitSource(a.circuitBreaker.Info)
+		logger.Info("circuit_breaker_configured",
+			"failure_threshold", cfg.CBFailureThreshold,
+			"success_threshold", cfg.CBSuccessThreshold,
+			"timeout", cfg.CBTimeout,
+		)
+	}
+	// Share the selection history with the other instances of the cluster
+	if a.sharedStore != nil {
+		balCfg.Shared = balancer.NewShared(a.sharedStore, cfg.SharedStatePrefix, cfg.SharedStateInterval)
+	}
+
+	// Runtime events go to the webhooks and the /events stream
+	a.eventStream = notify.NewStream(a.stats.SelectionsPerIP)
+	a.events = notify.Multi(a.notifier, a.eventStream)
+	watchEvents(a.events, a.lim, a.healthChecker, a.circuitBreaker)
+
+	a.bal = balancer.New(balCfg)
+	a.bal.Start()
+	for _, ip := range netutil.MustParseAddrs(cfg.DrainIPs) {
+		a.bal.SetDrain(ip, true)
+	}
+	a.stats.SetDrainSource(a.bal.Draining)
+	a.stats.SetBalancerSource(func() metrics.BalancerInfo {
+		return metrics.BalancerInfo(a.bal.GetStats())
+	})
+	return nil
+}
+
+// initProxy creates the proxy server and, if enabled, the SOCKS5 server
+// sharing it.
+func (a *app) initProxy() error {
+	cfg := a.cfg
+	a.proxyServer = proxy.NewServer(cfg, a.bal, a.lim, a.stats)
+	if cfg.PassiveHealthEnabled {
+		a.proxyServer.SetPassiveHealth(health.NewPassiveMonitor(a.healthChecker, cfg.PassiveHealthWindow, cfg.PassiveHealthErrorRate))
+		logger.Info("passive_health_configured",
+			"window", cfg.PassiveHealthWindow,
+			"error_rate", cfg.PassiveHealthErrorRate,
+			"active", cfg.HealthCheckEnabled,
+		)
+	}
+	if a.circuitBreaker != nil {
+		a.proxyServer.SetCircuitBreaker(a.circuitBreaker)
+	}
+	if a.sharedStore != nil {
+		a.proxyServer.SetQuotaStore(a.sharedStore)
+	}
+	if cfg.SocksPort != 0 {
+		a.socksServer = socks.NewServer(cfg.SocksPort, a.proxyServer, cfg.Timeout)
+	}
+	return nil
+}
 
-	// Set up signal handling
+// wait blocks until a shutdown signal or a drain request, handling the
+// reload and log reopen signals meanwhile.
+func (a *app) wait() {
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	if len(reopenSignals) > 0 {
+		// An empty list would relay every signal
+		signal.Notify(sigCh, reopenSignals...)
+	}
 
-	// Wait for signals
 	for {
-		sig := <-sigCh
+		var sig os.Signal
+		select {
+		case sig = <-sigCh:
+		case <-a.drainCh:
+		}
+		if sig == nil {
+			logger.Info("received drain request, shutting down")
+			return
+		}
 
 		// Handle SIGHUP for manual config reload
 		if sig == syscall.SIGHUP {
-			logger.Info("received SIGHUP, reloading configuration")
-			if cfgWatcher != nil {
-				if reloadErr := cfgWatcher.Reload(); reloadErr != nil {
-					logger.Error("config reload failed", "error", reloadErr)
-				}
+			a.reloadOnSignal()
+			continue
+		}
+
+		// Handle SIGUSR1 for reopening log files after external rotation
+		if slices.Contains(reopenSignals, sig) {
+			if err := logger.Reopen(); err != nil {
+				logger.Error("log reopen failed", "error", err)
 			} else {
-				logger.Warn("config reload requested but no config file specified")
+				logger.Info("log files reopened")
 			}
 			continue
 		}
 
 		// SIGINT or SIGTERM - shutdown
 		logger.Info("received shutdown signal", "signal", sig)
-		break
+		return
 	}
+}
 
-	// Graceful shutdown
-	if cfgWatcher != nil {
-		cfgWatcher.Stop()
+// shutdown stops the proxy gracefully: it leaves the cluster, stops
+// accepting connections, waits for the open ones and stops every component.
+func (a *app) shutdown() {
+	cfg := a.cfg
+	if a.cfgWatcher != nil {
+		a.cfgWatcher.Stop()
 	}
+	close(a.discoverStop)
+
+	// Leave the frontend pool before connections are drained
+	a.leaveRegistry()
 
-	metricsServer.SetReady(false)
+	shutdownStart := time.Now()
+	a.metricsServer.SetReady(false)
 
-	// Stop accepting new connections
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	// Keep serving while load balancers notice the failing readiness probe
+	if cfg.ShutdownDelay > 0 {
+		shutdownPhase("deregister", shutdownStart, "delay", cfg.ShutdownDelay.String())
+		time.Sleep(cfg.ShutdownDelay)
+	}
+
+	// Stop accepting new connections; with reuse_port a newer process
+	// listening on the same ports takes them over while this one drains
+	shutdownPhase("drain", shutdownStart, "timeout", cfg.ShutdownTimeout.String())
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
 	defer cancel()
+	a.stopAccepting(ctx)
 
 	// Wait for active connections
 	logger.Info("waiting for active connections to complete")
-	proxyServer.WaitForConnections(30 * time.Second)
+	if !a.proxyServer.WaitForConnections(cfg.ShutdownTimeout) {
+		if cfg.ShutdownForceClose {
+			shutdownPhase("force_close", shutdownStart)
+			n := a.proxyServer.CloseTunnels()
+			metrics.TunnelsForceClosed.Add(float64(n))
+			logger.Warn("tunnels_force_closed", "count", n)
+		} else {
+			logger.Info("waiting for open tunnels without timeout")
+			a.proxyServer.WaitForConnections(0)
+		}
+	}
 
 	// Shutdown servers
-	if err := proxyServer.Shutdown(ctx); err != nil {
-		logger.Error("proxy server shutdown error", "error", err)
-	}
+	shutdownPhase("stop", shutdownStart)
+	stopCtx, stopCancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer stopCancel()
+	a.stopListeners(stopCtx)
 
-	bal.Stop()
+	a.bal.Stop()
+	a.closeCluster()
 
 	// Stop health checker
-	if healthChecker != nil {
-		healthChecker.Stop()
+	if a.healthChecker != nil {
+		a.healthChecker.Stop()
+	}
+
+	// Push final metrics for runs that are never scraped
+	close(a.pushStop)
+	pushMetrics(cfg, "info")
+
+	if a.statsd != nil {
+		a.statsd.Close()
+	}
+	if a.notifier != nil {
+		a.notifier.Close()
 	}
 
-	if err := metricsServer.Shutdown(ctx); err != nil {
+	a.eventStream.Close()
+	if err := a.metricsServer.Shutdown(stopCtx); err != nil {
 		logger.Error("metrics server shutdown error", "error", err)
 	}
 
+	if a.accessLog != nil {
+		logger.SetAccessLog(nil)
+		if err := a.accessLog.Close(); err != nil {
+			logger.Error("access log close error", "error", err)
+		}
+	}
+
 	logger.Info("outbound-lb stopped")
+	logger.CloseOutput()
+}
+
+// shutdownPhase logs the start of a shutdown phase, with the time elapsed
+// since shutdown began, and reports it in the shutdown phase metric.
+func shutdownPhase(phase string, start time.Time, args ...any) {
+	for _, p := range []string{"deregister", "drain", "force_close", "stop"} {
+		v := 0.0
+		if p == phase {
+			v = 1
+		}
+		metrics.ShutdownPhase.WithLabelValues(p).Set(v)
+	}
+	logger.Info("shutdown_phase", append([]any{"phase", phase, "elapsed", time.Since(start).String()}, args...)...)
+}
+
+// watchEvents sends the state changes of the limiter, health checker and
+// circuit breaker (both optional) to n.
+func watchEvents(n notify.Sink, lim *limiter.Limiter, hc *health.HealthChecker, cb *balancer.CircuitBreaker) {
+	lim.SetOnSaturated(func(maxTotal int) {
+		n.Notify(notify.Event{
+			Type:    notify.EventLimiterSaturated,
+			Message: fmt.Sprintf("Total connection limit of %d reached", maxTotal),
+			Details: map[string]any{"max_conns_total": maxTotal},
+		})
+	})
+	if hc != nil {
+		hc.SetOnStateChange(func(ip netip.Addr, state health.HealthState, err error) {
+			switch state {
+			case health.StateUnhealthy:
+				e := notify.Event{Type: notify.EventIPUnhealthy, IP: ip.String(), Message: "Outbound IP " + ip.String() + " is unhealthy"}
+				if err != nil {
+					e.Message += ": " + err.Error()
+					e.Details = map[string]any{"error": err.Error()}
+				}
+				n.Notify(e)
+			case health.StateHealthy:
+				n.Notify(notify.Event{Type: notify.EventIPRecovered, IP: ip.String(), Message: "Outbound IP " + ip.String() + " recovered"})
+			}
+		})
+	}
+	if cb != nil {
+		cb.SetOnTransition(func(ip netip.Addr, from, to balancer.State) {
+			details := map[string]any{"from": from.String(), "to": to.String()}
+			switch to {
+			case balancer.StateOpen:
+				n.Notify(notify.Event{Type: notify.EventCircuitOpened, IP: ip.String(), Message: "Circuit opened for outbound IP " + ip.String(), Details: details})
+			case balancer.StateClosed:
+				n.Notify(notify.Event{Type: notify.EventCircuitClosed, IP: ip.String(), Message: "Circuit closed for outbound IP " + ip.String(), Details: details})
+			}
+		})
+	}
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/balancer"
+	"github.com/cr0hn/outbound-lb/internal/config"
+	"github.com/cr0hn/outbound-lb/internal/limiter"
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+	"github.com/cr0hn/outbound-lb/internal/proxy"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
+)
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 with the given
+// common name to dir and returns the certificate and key paths.
+func writeTestCert(t *testing.T, dir, cn string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// servedCN returns the common name of the certificate served at addr.
+func servedCN(t *testing.T, addr string) string {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("TLS handshake: %v", err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestReloadCertificates_WithoutConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "proxy-1")
+
+	cfg := config.DefaultConfig()
+	cfg.IPs = []string{"127.0.0.1"}
+	cfg.ListenTLSCert = certFile
+	cfg.ListenTLSKey = keyFile
+	if cfg.ConfigFile != "" || cfg.ConfigURL != "" {
+		t.Fatal("expected no config file")
+	}
+
+	ips := netutil.MustParseAddrs(cfg.IPs)
+	stats := metrics.NewStatsCollector(ips)
+	lim := limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, ips)
+	bal := balancer.New(balancer.Config{IPs: ips, HistoryWindow: 300, HistorySize: 100, Limiter: lim})
+	proxyServer := proxy.NewServer(cfg, bal, lim, stats)
+	metricsServer := metrics.NewServer(0, stats)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxyServer.Serve(ln)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		proxyServer.Shutdown(ctx)
+	})
+	addr := ln.Addr().String()
+	if cn := servedCN(t, addr); cn != "proxy-1" {
+		t.Fatalf("certificate CN = %q, want proxy-1", cn)
+	}
+
+	// What SIGHUP does without a config file
+	writeTestCert(t, dir, "proxy-2")
+	reloadCertificates(cfg, proxyServer, metricsServer)
+	if cn := servedCN(t, addr); cn != "proxy-2" {
+		t.Errorf("certificate CN after reload = %q, want proxy-2", cn)
+	}
+
+	// A broken pair keeps the current certificate
+	if err := os.WriteFile(keyFile, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reloadCertificates(cfg, proxyServer, metricsServer)
+	if cn := servedCN(t, addr); cn != "proxy-2" {
+		t.Errorf("certificate CN after failed reload = %q, want proxy-2", cn)
+	}
+}
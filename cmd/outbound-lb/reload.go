@@ -0,0 +1,208 @@
+package main
+
+import (
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/config"
+	"github.com/cr0hn/outbound-lb/internal/logger"
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+	"github.com/cr0hn/outbound-lb/internal/notify"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
+)
+
+// initReload starts re-discovering the local outbound IPs, if enabled, and
+// watching the config file or URL, if set, applying its changes.
+func (a *app) initReload() error {
+	cfg := a.cfg
+
+	// Re-discover local addresses so newly attached IPs are picked up
+	if cfg.DiscoverIPs && cfg.DiscoverInterval > 0 {
+		go rediscoverIPs(cfg.DiscoverInterval, cfg.DiscoverOutboundIPs, a.updateIPs, a.discoverStop)
+	}
+
+	if cfg.ConfigFile == "" && cfg.ConfigURL == "" {
+		return nil
+	}
+	var err error
+	if cfg.ConfigURL != "" {
+		var source config.Source
+		if source, err = config.NewSource(cfg.ConfigURL, cfg.ConfigURLTokenFile); err == nil {
+			a.cfgWatcher, err = config.NewRemoteConfigWatcher(source, cfg)
+		}
+	} else {
+		a.cfgWatcher, err = config.NewConfigWatcher(cfg.ConfigFile, cfg)
+	}
+	if err != nil {
+		// The proxy runs on with the configuration it started with
+		logger.Error("failed to create config watcher", "error", err)
+		a.cfgWatcher = nil
+		return nil
+	}
+
+	a.drainIPs = cfg.DrainIPs
+	a.cfgWatcher.RegisterCallback(a.applyConfig)
+	a.metricsServer.SetConfigPreview(func(data []byte) (any, error) {
+		return a.cfgWatcher.Preview(data)
+	})
+	if err := a.cfgWatcher.Start(); err != nil {
+		logger.Error("failed to start config watcher", "error", err)
+	}
+	return nil
+}
+
+// applyConfig applies the hot-reloadable settings of a reloaded
+// configuration to the running components.
+func (a *app) applyConfig(newCfg *config.Config) {
+	// Reconfigure logger
+	logger.Reconfigure(newCfg.LogLevel, newCfg.LogFormat)
+	logger.SetRequestSampling(newCfg.LogSampleRate)
+
+	// Update limiter
+	a.lim.UpdateLimits(newCfg.MaxConnsPerIP, newCfg.MaxConnsTotal)
+
+	// Update balancer history config
+	a.bal.UpdateHistoryConfig(newCfg.HistoryWindow, newCfg.HistorySize)
+
+	// Add and remove outbound IPs
+	a.updateIPs(netutil.MustParseAddrs(newCfg.IPs))
+
+	// Apply drain_ips changes; drains set through the admin API are kept
+	// unless the IP is listed or unlisted here
+	for _, ip := range newCfg.DrainIPs {
+		if !slices.Contains(a.drainIPs, ip) {
+			if err := a.bal.SetDrain(netutil.MustParseAddr(ip), true); err != nil {
+				logger.Warn("drain_ip_ignored", "ip", ip, "error", err)
+			}
+		}
+	}
+	for _, ip := range a.drainIPs {
+		if !slices.Contains(newCfg.DrainIPs, ip) {
+			a.bal.SetDrain(netutil.MustParseAddr(ip), false)
+		}
+	}
+	a.drainIPs = newCfg.DrainIPs
+
+	// Update per-IP selection weights
+	a.bal.UpdateWeights(newCfg.Weights)
+
+	// Update connection timeouts and rebuild upstream transports
+	a.proxyServer.UpdateTimeouts(newCfg)
+	if a.socksServer != nil {
+		a.socksServer.SetTimeout(newCfg.Timeout)
+	}
+
+	// Update metrics host label allowlist
+	metrics.SetHostAllowlist(newCfg.MetricsHosts)
+
+	// Pick up rotated or moved certificates
+	reloadCertificates(newCfg, a.proxyServer, a.metricsServer)
+
+	// Pick up added, removed or changed proxy accounts and keys
+	if err := a.proxyServer.ReloadAuthFile(); err != nil {
+		logger.Error("auth_file_reload_failed", "error", err)
+	}
+	if err := a.proxyServer.ReloadAuthKeys(); err != nil {
+		logger.Error("auth_keys_reload_failed", "error", err)
+	}
+	a.reloadSecrets()
+
+	a.events.Notify(notify.Event{
+		Type:    notify.EventConfigReloaded,
+		Message: "Configuration reloaded from " + a.cfgWatcher.Location(),
+	})
+}
+
+// reloadOnSignal reloads the configuration on SIGHUP. Certificates and
+// secrets are rotated even without a config file or when it fails to
+// reload.
+func (a *app) reloadOnSignal() {
+	logger.Info("received SIGHUP, reloading configuration")
+	current := a.cfg
+	if a.cfgWatcher != nil {
+		err := a.cfgWatcher.Reload()
+		if err == nil {
+			// The reload callback re-read the certificates and secrets
+			return
+		}
+		logger.Error("config reload failed", "error", err)
+		current = a.cfgWatcher.Current()
+	}
+	reloadCertificates(current, a.proxyServer, a.metricsServer)
+	a.reloadSecrets()
+}
+
+// reloadSecrets re-reads the secrets given as files, for rotation without a
+// restart.
+func (a *app) reloadSecrets() {
+	if err := a.proxyServer.ReloadHMACSecret(); err != nil {
+		logger.Error("auth_hmac_secret_reload_failed", "error", err)
+	}
+	a.reloadMetricsAuth()
+	if a.cfg.RegistryTokenFile != "" {
+		token, err := config.ReadSecretFile(a.cfg.RegistryTokenFile)
+		if err != nil {
+			logger.Error("registry_token_reload_failed", "error", err)
+		} else {
+			if a.reg != nil {
+				a.reg.SetToken(token)
+			}
+			if a.agent != nil {
+				a.agent.SetToken(token)
+			}
+			logger.Info("registry_token_loaded", "path", a.cfg.RegistryTokenFile)
+		}
+	}
+}
+
+// updateIPs applies a new set of local outbound IPs; removed IPs drain
+// gracefully.
+func (a *app) updateIPs(ips []netip.Addr) {
+	a.updateMu.Lock()
+	defer a.updateMu.Unlock()
+
+	added, removed := a.proxyServer.UpdateIPs(ips)
+	if a.agent != nil && (len(added) > 0 || len(removed) > 0) {
+		a.agent.SetIPs(ips)
+	}
+	if a.healthChecker != nil {
+		for _, ip := range added {
+			a.healthChecker.AddIP(ip)
+		}
+		for _, ip := range removed {
+			a.healthChecker.RemoveIP(ip)
+		}
+	}
+}
+
+// rediscoverIPs discovers the outbound addresses every interval and passes
+// them to apply until stop is closed. Failed or empty discoveries keep the
+// current IPs.
+func rediscoverIPs(interval time.Duration, discover func() ([]string, error), apply func([]netip.Addr), stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			found, err := discover()
+			if err != nil {
+				logger.Warn("ip_discovery_failed", "error", err)
+				continue
+			}
+			ips, err := netutil.ParseAddrs(found)
+			if err != nil {
+				logger.Warn("ip_discovery_failed", "error", err)
+				continue
+			}
+			if len(ips) == 0 {
+				logger.Warn("ip_discovery_empty")
+				continue
+			}
+			apply(ips)
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// reopenSignals make the log files reopen, after rotation by an external tool.
+var reopenSignals = []os.Signal{syscall.SIGUSR1}
@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// Client certificate fields naming the proxy user.
+const (
+	// CertIdentityCN names the user by the subject common name.
+	CertIdentityCN = "cn"
+	// CertIdentitySAN names the user by the first DNS name, email address or
+	// URI subject alternative name.
+	CertIdentitySAN = "san"
+)
+
+// LoadCertPool reads a PEM bundle of CA certificates.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no PEM certificates found", path)
+	}
+	return pool, nil
+}
+
+// CertUser returns the proxy user a verified client certificate names in
+// field, CertIdentityCN or CertIdentitySAN.
+func CertUser(cert *x509.Certificate, field string) (string, bool) {
+	switch field {
+	case CertIdentityCN:
+		return cert.Subject.CommonName, cert.Subject.CommonName != ""
+	case CertIdentitySAN:
+		switch {
+		case len(cert.DNSNames) > 0:
+			return cert.DNSNames[0], true
+		case len(cert.EmailAddresses) > 0:
+			return cert.EmailAddresses[0], true
+		case len(cert.URIs) > 0:
+			return cert.URIs[0].String(), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCertUser(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://example.test/scraper")
+	tests := []struct {
+		name  string
+		cert  x509.Certificate
+		field string
+		want  string
+		ok    bool
+	}{
+		{"cn", x509.Certificate{Subject: pkix.Name{CommonName: "tenant-a"}, DNSNames: []string{"a.example.test"}}, CertIdentityCN, "tenant-a", true},
+		{"empty cn", x509.Certificate{DNSNames: []string{"a.example.test"}}, CertIdentityCN, "", false},
+		{"san dns", x509.Certificate{Subject: pkix.Name{CommonName: "tenant-a"}, DNSNames: []string{"a.example.test"}}, CertIdentitySAN, "a.example.test", true},
+		{"san email", x509.Certificate{EmailAddresses: []string{"ci@example.test"}}, CertIdentitySAN, "ci@example.test", true},
+		{"san uri", x509.Certificate{URIs: []*url.URL{spiffe}}, CertIdentitySAN, "spiffe://example.test/scraper", true},
+		{"no san", x509.Certificate{Subject: pkix.Name{CommonName: "tenant-a"}}, CertIdentitySAN, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := CertUser(&tt.cert, tt.field)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("CertUser() = %q, %v, want %q, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestLoadCertPool_Invalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(path, []byte("not a certificate"), 0o600)
+	if _, err := LoadCertPool(path); err == nil {
+		t.Error("LoadCertPool() accepted a file without certificates")
+	}
+	if _, err := LoadCertPool(filepath.Join(t.TempDir(), "missing.pem")); err == nil {
+		t.Error("LoadCertPool() accepted a missing file")
+	}
+}
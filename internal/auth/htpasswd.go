@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash is compared against for unknown users, so a lookup takes as long
+// whether or not the user exists.
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("outbound-lb"), bcrypt.DefaultCost)
+	return hash
+})
+
+// Users is a set of proxy accounts read from an htpasswd-style file.
+type Users struct {
+	hashes map[string][]byte
+
+	// verified holds the SHA-256 of the last password accepted for each
+	// user, so repeated requests do not pay the bcrypt cost
+	mu       sync.Mutex
+	verified map[string][sha256.Size]byte
+}
+
+// LoadUsers reads the accounts of the htpasswd-style file at path.
+func LoadUsers(path string) (*Users, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users, err := ParseUsers(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return users, nil
+}
+
+// ParseUsers reads accounts as "user:hash" lines, where hash is a bcrypt hash
+// as written by "htpasswd -B". Blank lines and lines starting with '#' are
+// skipped.
+func ParseUsers(r io.Reader) (*Users, error) {
+	u := &Users{
+		hashes:   make(map[string][]byte),
+		verified: make(map[string][sha256.Size]byte),
+	}
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("line %d: want user:hash", n)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("line %d: user %q: only bcrypt hashes are supported", n, user)
+		}
+		if _, dup := u.hashes[user]; dup {
+			return nil, fmt.Errorf("line %d: duplicate user %q", n, user)
+		}
+		u.hashes[user] = []byte(hash)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Len returns the number of accounts.
+func (u *Users) Len() int {
+	return len(u.hashes)
+}
+
+// Verify reports whether pass is the password of user.
+func (u *Users) Verify(user, pass string) bool {
+	hash, ok := u.hashes[user]
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(pass))
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(pass))
+	u.mu.Lock()
+	last, cached := u.verified[user]
+	u.mu.Unlock()
+	if cached && subtle.ConstantTimeCompare(sum[:], last[:]) == 1 {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(pass)) != nil {
+		return false
+	}
+	u.mu.Lock()
+	u.verified[user] = sum
+	u.mu.Unlock()
+	return true
+}
@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func hashPassword(t *testing.T, pass string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(hash)
+}
+
+func TestParseUsers(t *testing.T) {
+	file := "# proxy accounts\n" +
+		"alice:" + hashPassword(t, "wonderland") + "\n" +
+		"\n" +
+		"bob:" + hashPassword(t, "builder") + "\n"
+
+	users, err := ParseUsers(strings.NewReader(file))
+	if err != nil {
+		t.Fatalf("ParseUsers() error: %v", err)
+	}
+	if users.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", users.Len())
+	}
+
+	tests := []struct {
+		user, pass string
+		want       bool
+	}{
+		{"alice", "wonderland", true},
+		{"alice", "wonderland", true}, // served from the verified cache
+		{"bob", "builder", true},
+		{"alice", "builder", false},
+		{"bob", "", false},
+		{"carol", "wonderland", false},
+	}
+	for _, tt := range tests {
+		if got := users.Verify(tt.user, tt.pass); got != tt.want {
+			t.Errorf("Verify(%q, %q) = %v, want %v", tt.user, tt.pass, got, tt.want)
+		}
+	}
+}
+
+func TestParseUsers_Errors(t *testing.T) {
+	hash := hashPassword(t, "secret")
+	tests := []struct {
+		name string
+		file string
+	}{
+		{"missing hash", "alice\n"},
+		{"empty user", ":" + hash + "\n"},
+		{"plain text", "alice:secret\n"},
+		{"md5 hash", "alice:$apr1$salt$hash\n"},
+		{"duplicate", "alice:" + hash + "\nalice:" + hash + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseUsers(strings.NewReader(tt.file)); err == nil {
+				t.Error("ParseUsers() succeeded, want error")
+			}
+		})
+	}
+}
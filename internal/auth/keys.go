@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Keys is a set of API keys read from a keys file, each belonging to a
+// proxy user.
+type Keys struct {
+	users map[[sha256.Size]byte]string
+}
+
+// LoadKeys reads the API keys of the keys file at path.
+func LoadKeys(path string) (*Keys, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	keys, err := ParseKeys(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return keys, nil
+}
+
+// ParseKeys reads API keys as "user:hash" lines, where hash is the hex
+// SHA-256 of the key, as printed by "printf %s KEY | sha256sum". Blank lines
+// and lines starting with '#' are skipped. A user may have several keys.
+func ParseKeys(r io.Reader) (*Keys, error) {
+	k := &Keys{users: make(map[[sha256.Size]byte]string)}
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("line %d: want user:hash", n)
+		}
+		b, err := hex.DecodeString(hash)
+		if err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("line %d: user %q: hash must be a hex SHA-256", n, user)
+		}
+		sum := [sha256.Size]byte(b)
+		if other, dup := k.users[sum]; dup {
+			return nil, fmt.Errorf("line %d: user %q: key already belongs to %q", n, user, other)
+		}
+		k.users[sum] = user
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Len returns the number of keys.
+func (k *Keys) Len() int {
+	return len(k.users)
+}
+
+// Lookup returns the user key belongs to.
+func (k *Keys) Lookup(key string) (string, bool) {
+	user, ok := k.users[sha256.Sum256([]byte(key))]
+	return user, ok
+}
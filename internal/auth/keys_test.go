@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func keyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestParseKeys(t *testing.T) {
+	file := "# API keys\n" +
+		"ci:" + keyHash("k-ci-1") + "\n" +
+		"ci:" + keyHash("k-ci-2") + "\n" +
+		"scraper:" + strings.ToUpper(keyHash("k-scraper")) + "\n"
+
+	keys, err := ParseKeys(strings.NewReader(file))
+	if err != nil {
+		t.Fatalf("ParseKeys() error: %v", err)
+	}
+	if keys.Len() != 3 {
+		t.Errorf("Len() = %d, want 3", keys.Len())
+	}
+
+	tests := []struct {
+		key  string
+		user string
+		ok   bool
+	}{
+		{"k-ci-1", "ci", true},
+		{"k-ci-2", "ci", true},
+		{"k-scraper", "scraper", true},
+		{"k-unknown", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		user, ok := keys.Lookup(tt.key)
+		if user != tt.user || ok != tt.ok {
+			t.Errorf("Lookup(%q) = %q, %v, want %q, %v", tt.key, user, ok, tt.user, tt.ok)
+		}
+	}
+}
+
+func TestParseKeys_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+	}{
+		{"missing hash", "ci\n"},
+		{"empty user", ":" + keyHash("k") + "\n"},
+		{"plain key", "ci:k-ci-1\n"},
+		{"short hash", "ci:abcdef\n"},
+		{"shared key", "ci:" + keyHash("k") + "\nscraper:" + keyHash("k") + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseKeys(strings.NewReader(tt.file)); err == nil {
+				t.Error("ParseKeys() succeeded, want error")
+			}
+		})
+	}
+}
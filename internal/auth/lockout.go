@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// Lockout bans clients that fail to authenticate too often.
+type Lockout struct {
+	maxFailures int
+	window      time.Duration
+	ban         time.Duration
+	clients     map[string]*failures
+	swept       time.Time
+	mu          sync.Mutex
+	now         func() time.Time
+}
+
+// failures are the recent authentication failures of a client.
+type failures struct {
+	count       int
+	since       time.Time // start of the counting window
+	bannedUntil time.Time
+}
+
+// NewLockout creates a Lockout banning a client for ban once it failed
+// maxFailures times within window.
+func NewLockout(maxFailures int, window, ban time.Duration) *Lockout {
+	return &Lockout{
+		maxFailures: maxFailures,
+		window:      window,
+		ban:         ban,
+		clients:     make(map[string]*failures),
+		now:         time.Now,
+	}
+}
+
+// Banned reports whether client is banned, and until when.
+func (l *Lockout) Banned(client string) (time.Time, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, ok := l.clients[client]
+	if !ok || !l.now().Before(f.bannedUntil) {
+		return time.Time{}, false
+	}
+	return f.bannedUntil, true
+}
+
+// Fail counts an authentication failure of client. When it reaches the
+// maximum within the window, the client is banned and Fail returns the end
+// of the ban.
+func (l *Lockout) Fail(client string) (time.Time, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+	f, ok := l.clients[client]
+	if !ok || now.Sub(f.since) > l.window {
+		f = &failures{since: now}
+		l.clients[client] = f
+	}
+	f.count++
+	if f.count < l.maxFailures {
+		return time.Time{}, false
+	}
+	f.count = 0
+	f.since = now
+	f.bannedUntil = now.Add(l.ban)
+	return f.bannedUntil, true
+}
+
+// sweep forgets clients whose window and ban are over, at most once per
+// window. l.mu must be held.
+func (l *Lockout) sweep(now time.Time) {
+	if now.Sub(l.swept) < l.window {
+		return
+	}
+	l.swept = now
+	for client, f := range l.clients {
+		if now.Sub(f.since) > l.window && !now.Before(f.bannedUntil) {
+			delete(l.clients, client)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockout(t *testing.T) {
+	l := NewLockout(3, time.Minute, 10*time.Minute)
+	now := time.Unix(1700000000, 0)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if _, banned := l.Fail("192.0.2.1"); banned {
+			t.Fatalf("failure %d banned the client", i+1)
+		}
+	}
+	until, banned := l.Fail("192.0.2.1")
+	if !banned || !until.Equal(now.Add(10*time.Minute)) {
+		t.Fatalf("third Fail() = %v, %v, want a ban until %v", until, banned, now.Add(10*time.Minute))
+	}
+	if _, banned := l.Banned("192.0.2.1"); !banned {
+		t.Error("Banned() = false during the ban")
+	}
+	// Clients are counted separately
+	if _, banned := l.Banned("192.0.2.2"); banned {
+		t.Error("Banned() = true for another client")
+	}
+
+	now = now.Add(10 * time.Minute)
+	if _, banned := l.Banned("192.0.2.1"); banned {
+		t.Error("Banned() = true after the ban")
+	}
+}
+
+func TestLockout_Window(t *testing.T) {
+	l := NewLockout(3, time.Minute, 10*time.Minute)
+	now := time.Unix(1700000000, 0)
+	l.now = func() time.Time { return now }
+
+	l.Fail("192.0.2.1")
+	l.Fail("192.0.2.1")
+	// Failures older than the window are forgotten
+	now = now.Add(2 * time.Minute)
+	if _, banned := l.Fail("192.0.2.1"); banned {
+		t.Error("Fail() banned the client for failures outside the window")
+	}
+	if len(l.clients) != 1 {
+		t.Errorf("tracked clients = %d, want 1", len(l.clients))
+	}
+
+	// Idle clients are swept
+	now = now.Add(2 * time.Minute)
+	l.Fail("192.0.2.2")
+	if _, ok := l.clients["192.0.2.1"]; ok {
+		t.Error("idle client was not swept")
+	}
+}
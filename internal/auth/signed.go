@@ -0,0 +1,63 @@
+// Package auth provides proxy credential helpers.
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrMalformedCredential is returned when a signed credential cannot be parsed.
+	ErrMalformedCredential = errors.New("malformed signed credential")
+	// ErrInvalidSignature is returned when the credential signature does not match.
+	ErrInvalidSignature = errors.New("invalid credential signature")
+	// ErrCredentialExpired is returned when the credential expiry has passed.
+	ErrCredentialExpired = errors.New("credential expired")
+)
+
+// SignCredential returns a signed username of the form "<id>.<expires>.<signature>",
+// where expires is a Unix timestamp and signature is the base64url-encoded
+// HMAC-SHA256 of "<id>.<expires>" keyed with secret.
+func SignCredential(secret, id string, expires time.Time) string {
+	payload := id + "." + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + sign(secret, payload)
+}
+
+// VerifyCredential validates a signed username and returns the embedded id.
+func VerifyCredential(secret, username string, now time.Time) (string, error) {
+	sigIdx := strings.LastIndexByte(username, '.')
+	if sigIdx <= 0 {
+		return "", ErrMalformedCredential
+	}
+	payload, sig := username[:sigIdx], username[sigIdx+1:]
+
+	expIdx := strings.LastIndexByte(payload, '.')
+	if expIdx <= 0 {
+		return "", ErrMalformedCredential
+	}
+	id := payload[:expIdx]
+	expires, err := strconv.ParseInt(payload[expIdx+1:], 10, 64)
+	if err != nil {
+		return "", ErrMalformedCredential
+	}
+
+	if !hmac.Equal([]byte(sig), []byte(sign(secret, payload))) {
+		return "", ErrInvalidSignature
+	}
+	if now.Unix() >= expires {
+		return "", ErrCredentialExpired
+	}
+	return id, nil
+}
+
+// sign returns the base64url-encoded HMAC-SHA256 of payload.
+func sign(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
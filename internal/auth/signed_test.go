@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSignVerifyCredential(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	cred := SignCredential("secret", "job-42", now.Add(time.Hour))
+
+	id, err := VerifyCredential("secret", cred, now)
+	if err != nil {
+		t.Fatalf("VerifyCredential() error: %v", err)
+	}
+	if id != "job-42" {
+		t.Errorf("expected id job-42, got %s", id)
+	}
+}
+
+func TestVerifyCredential_IDWithDots(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	cred := SignCredential("secret", "team.scraper", now.Add(time.Minute))
+
+	id, err := VerifyCredential("secret", cred, now)
+	if err != nil {
+		t.Fatalf("VerifyCredential() error: %v", err)
+	}
+	if id != "team.scraper" {
+		t.Errorf("expected id team.scraper, got %s", id)
+	}
+}
+
+func TestVerifyCredential_Errors(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	valid := SignCredential("secret", "job", now.Add(time.Hour))
+
+	tests := []struct {
+		name     string
+		secret   string
+		username string
+		wantErr  error
+	}{
+		{"expired", "secret", SignCredential("secret", "job", now.Add(-time.Second)), ErrCredentialExpired},
+		{"wrong secret", "other", valid, ErrInvalidSignature},
+		{"tampered id", "secret", "admin" + valid[3:], ErrInvalidSignature},
+		{"plain username", "secret", "alice", ErrMalformedCredential},
+		{"bad expiry", "secret", "job.soon.sig", ErrMalformedCredential},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := VerifyCredential(tt.secret, tt.username, now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("VerifyCredential() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
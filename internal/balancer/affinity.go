@@ -0,0 +1,90 @@
+// Package balancer provides IP load balancing algorithms.
+package balancer
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// clientKey is the context key for the client identity.
+type clientKey struct{}
+
+// ContextWithClient returns a new context carrying the client identity
+// (authenticated proxy user or client IP) used for session affinity.
+func ContextWithClient(ctx context.Context, client string) context.Context {
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+// ClientFromContext extracts the client identity from the context.
+// Returns empty string if no client is present.
+func ClientFromContext(ctx context.Context) string {
+	if client, ok := ctx.Value(clientKey{}).(string); ok {
+		return client
+	}
+	return ""
+}
+
+// affinitySession is a client's pinned IP and when the pin expires.
+type affinitySession struct {
+	ip      netip.Addr
+	expires time.Time
+}
+
+// Affinity pins clients to an outbound IP for a sliding session window.
+type Affinity struct {
+	window   time.Duration
+	sessions map[string]affinitySession
+	mu       sync.Mutex
+}
+
+// NewAffinity creates a new Affinity with the given session window.
+func NewAffinity(window time.Duration) *Affinity {
+	return &Affinity{
+		window:   window,
+		sessions: make(map[string]affinitySession),
+	}
+}
+
+// Get returns the IP pinned to the client, if the session has not expired.
+func (a *Affinity) Get(client string) (netip.Addr, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s, ok := a.sessions[client]
+	if !ok || time.Now().After(s.expires) {
+		return netip.Addr{}, false
+	}
+	return s.ip, true
+}
+
+// Set pins the client to ip and extends the session window.
+func (a *Affinity) Set(client string, ip netip.Addr) {
+	a.mu.Lock()
+	a.sessions[client] = affinitySession{ip: ip, expires: time.Now().Add(a.window)}
+	a.mu.Unlock()
+}
+
+// Cleanup removes expired sessions and returns how many were removed.
+func (a *Affinity) Cleanup() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	removed := 0
+	for client, s := range a.sessions {
+		if now.After(s.expires) {
+			delete(a.sessions, client)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Len returns the number of tracked sessions.
+func (a *Affinity) Len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.sessions)
+}
@@ -0,0 +1,120 @@
+package balancer
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
+)
+
+func TestAffinity_GetSet(t *testing.T) {
+	a := NewAffinity(time.Minute)
+
+	if _, ok := a.Get("client-1"); ok {
+		t.Error("expected no session for unknown client")
+	}
+
+	a.Set("client-1", netip.MustParseAddr("192.168.1.1"))
+	ip, ok := a.Get("client-1")
+	if !ok || ip != netip.MustParseAddr("192.168.1.1") {
+		t.Errorf("expected 192.168.1.1, got %q (ok=%v)", ip, ok)
+	}
+}
+
+func TestAffinity_Expiry(t *testing.T) {
+	a := NewAffinity(10 * time.Millisecond)
+	a.Set("client-1", netip.MustParseAddr("192.168.1.1"))
+
+	time.Sleep(20 * time.Millisecond)
+
+	if _, ok := a.Get("client-1"); ok {
+		t.Error("expected session to expire")
+	}
+	if removed := a.Cleanup(); removed != 1 {
+		t.Errorf("expected 1 removed session, got %d", removed)
+	}
+	if a.Len() != 0 {
+		t.Errorf("expected 0 sessions, got %d", a.Len())
+	}
+}
+
+func TestClientFromContext(t *testing.T) {
+	if got := ClientFromContext(context.Background()); got != "" {
+		t.Errorf("expected empty client, got %q", got)
+	}
+
+	ctx := ContextWithClient(context.Background(), "user:alice")
+	if got := ClientFromContext(ctx); got != "user:alice" {
+		t.Errorf("expected user:alice, got %q", got)
+	}
+}
+
+func TestLRUSelect_Affinity(t *testing.T) {
+	cfg := Config{
+		IPs:            netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3"}),
+		HistoryWindow:  300,
+		HistorySize:    100,
+		Limiter:        &mockLimiter{},
+		AffinityWindow: time.Minute,
+	}
+	bal := NewLRU(cfg)
+	ctx := ContextWithClient(context.Background(), "10.0.0.1")
+
+	first, err := bal.SelectWithContext(ctx, "a.example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	bal.Record("a.example.com", first)
+
+	// Same client stays on the same IP, even for other hosts
+	for _, host := range []string{"a.example.com", "b.example.com", "c.example.com"} {
+		ip, err := bal.SelectWithContext(ctx, host)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if ip != first {
+			t.Errorf("expected pinned IP %s for %s, got %s", first, host, ip)
+		}
+		bal.Record(host, ip)
+	}
+
+	// Another client is balanced independently
+	other := ContextWithClient(context.Background(), "10.0.0.2")
+	ip, _ := bal.SelectWithContext(other, "a.example.com")
+	if ip == first {
+		t.Errorf("expected different IP for new client on a.example.com, got %s", ip)
+	}
+}
+
+func TestLRUSelect_AffinityUnavailableIP(t *testing.T) {
+	lim := &mockLimiter{unavailable: map[netip.Addr]bool{}}
+	cfg := Config{
+		IPs:            netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2"}),
+		HistoryWindow:  300,
+		HistorySize:    100,
+		Limiter:        lim,
+		AffinityWindow: time.Minute,
+	}
+	bal := NewLRU(cfg)
+	ctx := ContextWithClient(context.Background(), "10.0.0.1")
+
+	first, _ := bal.SelectWithContext(ctx, "example.com")
+	lim.unavailable[first] = true
+
+	ip, err := bal.SelectWithContext(ctx, "example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ip == first {
+		t.Errorf("expected a new IP when pinned IP %s is unavailable", first)
+	}
+
+	// The client is re-pinned to the new IP
+	lim.unavailable[first] = false
+	again, _ := bal.SelectWithContext(ctx, "example.com")
+	if again != ip {
+		t.Errorf("expected re-pinned IP %s, got %s", ip, again)
+	}
+}
@@ -1,14 +1,23 @@
 // Package balancer provides IP load balancing algorithms.
 package balancer
 
-import "time"
+import (
+	"context"
+	"net/netip"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/store"
+)
 
 // Balancer is the interface for IP selection algorithms.
 type Balancer interface {
 	// Select returns the best IP to use for the given host.
-	Select(host string) (string, error)
+	Select(host string) (netip.Addr, error)
+	// SelectWithContext is like Select but takes request-scoped inputs such as
+	// the client identity (see ContextWithClient).
+	SelectWithContext(ctx context.Context, host string) (netip.Addr, error)
 	// Record records that an IP was used for a host.
-	Record(host, ip string)
+	Record(host string, ip netip.Addr)
 	// GetStats returns balancer statistics.
 	GetStats() Stats
 	// Start starts background goroutines.
@@ -17,6 +26,21 @@ type Balancer interface {
 	Stop()
 	// UpdateHistoryConfig updates history configuration at runtime.
 	UpdateHistoryConfig(window time.Duration, size int)
+	// UpdateWeights replaces the per-IP selection weights at runtime.
+	UpdateWeights(weights map[string]int)
+	// AddIP adds an outbound IP to the selection set at runtime.
+	AddIP(ip netip.Addr)
+	// RemoveIP removes an outbound IP from the selection set at runtime.
+	RemoveIP(ip netip.Addr)
+	// SetDrain puts an outbound IP into or out of drain mode.
+	SetDrain(ip netip.Addr, drain bool) error
+	// Draining returns the outbound IPs in drain mode.
+	Draining() []netip.Addr
+	// SaveState writes the selection history and rotation state to a store.
+	SaveState(ctx context.Context, s store.Store) error
+	// LoadState restores the selection history and rotation state saved in
+	// a store.
+	LoadState(ctx context.Context, s store.Store) (int, error)
 }
 
 // Stats holds balancer statistics.
@@ -24,32 +48,64 @@ type Stats struct {
 	TotalHosts   int            `json:"total_hosts"`
 	TotalEntries int            `json:"total_entries"`
 	EntriesPerIP map[string]int `json:"entries_per_ip"`
+	// PeerEntriesPerIP is the history of the other instances of the cluster
+	// per IP, with shared state.
+	PeerEntriesPerIP map[string]int `json:"peer_entries_per_ip,omitempty"`
 }
 
 // Config holds balancer configuration.
 type Config struct {
-	IPs           []string
+	IPs           []netip.Addr
 	HistoryWindow int64 // in seconds
 	HistorySize   int
 	Limiter       IPLimiter
 	HealthChecker IPHealthChecker
+	// AffinityWindow pins each client to one IP across all hosts for this
+	// long after its last request (0 disables session affinity).
+	AffinityWindow time.Duration
+	// RotationPolicy overrides the LRU heuristic with deterministic rotation.
+	RotationPolicy RotationPolicy
+	// RotationEvery is the number of requests per IP for RotationEveryN.
+	RotationEvery int
+	// RotationInterval is the time per IP for RotationInterval.
+	RotationInterval time.Duration
+	// Router restricts selection to a named IP pool per destination host.
+	Router *Router
+	// WarmupPeriod ramps the share of selections for recovered or newly
+	// added IPs from zero to full over this period (0 disables warm-up).
+	WarmupPeriod time.Duration
+	// CooldownAfter excludes an IP for a host once it has been used this many
+	// times for the host within the history window (0 disables cooldowns).
+	CooldownAfter int
+	// CooldownDuration is how long the IP stays excluded for that host.
+	CooldownDuration time.Duration
+	// CircuitBreaker excludes IPs whose circuit is open (nil disables).
+	CircuitBreaker *CircuitBreaker
+	// Weights scales each IP's share of LRU selections; IPs without a
+	// weight count as 1.
+	Weights map[string]int
+	// Shared exchanges the selection history with the other instances of a
+	// cluster (nil keeps it local).
+	Shared *Shared
 }
 
 // IPLimiter is the interface for checking IP availability.
 type IPLimiter interface {
-	IsIPAvailable(ip string) bool
+	IsIPAvailable(ip netip.Addr) bool
 	// GetAvailableIPs returns IPs that have available connection slots.
 	// The returned slice is borrowed from a pool; caller MUST call ReleaseAvailableIPs
 	// when done with the slice to return it to the pool.
-	GetAvailableIPs(ips []string) []string
+	GetAvailableIPs(ips []netip.Addr) []netip.Addr
+	// ReleaseAvailableIPs returns a slice obtained from GetAvailableIPs.
+	ReleaseAvailableIPs(ips []netip.Addr)
 }
 
 // IPHealthChecker is the interface for checking IP health status.
 type IPHealthChecker interface {
 	// IsHealthy returns true if the IP is healthy.
-	IsHealthy(ip string) bool
+	IsHealthy(ip netip.Addr) bool
 	// GetHealthyIPs filters the given IPs and returns only the healthy ones.
-	GetHealthyIPs(ips []string) []string
+	GetHealthyIPs(ips []netip.Addr) []netip.Addr
 }
 
 // New creates a new LRU balancer.
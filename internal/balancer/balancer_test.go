@@ -1,24 +1,28 @@
 package balancer
 
 import (
+	"net/netip"
 	"testing"
 	"time"
+
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
 )
 
 // mockLimiter is a mock implementation of IPLimiter.
 type mockLimiter struct {
-	unavailable map[string]bool
+	unavailable map[netip.Addr]bool
+	released    int
 }
 
-func (m *mockLimiter) IsIPAvailable(ip string) bool {
+func (m *mockLimiter) IsIPAvailable(ip netip.Addr) bool {
 	if m.unavailable == nil {
 		return true
 	}
 	return !m.unavailable[ip]
 }
 
-func (m *mockLimiter) GetAvailableIPs(ips []string) []string {
-	available := make([]string, 0, len(ips))
+func (m *mockLimiter) GetAvailableIPs(ips []netip.Addr) []netip.Addr {
+	available := make([]netip.Addr, 0, len(ips))
 	for _, ip := range ips {
 		if m.IsIPAvailable(ip) {
 			available = append(available, ip)
@@ -27,9 +31,13 @@ func (m *mockLimiter) GetAvailableIPs(ips []string) []string {
 	return available
 }
 
+func (m *mockLimiter) ReleaseAvailableIPs(ips []netip.Addr) {
+	m.released++
+}
+
 func TestLRUSelect_SingleIP(t *testing.T) {
 	cfg := Config{
-		IPs:           []string{"192.168.1.1"},
+		IPs:           netutil.MustParseAddrs([]string{"192.168.1.1"}),
 		HistoryWindow: 300,
 		HistorySize:   100,
 		Limiter:       &mockLimiter{},
@@ -41,14 +49,14 @@ func TestLRUSelect_SingleIP(t *testing.T) {
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	if ip != "192.168.1.1" {
+	if ip != netip.MustParseAddr("192.168.1.1") {
 		t.Errorf("expected 192.168.1.1, got %s", ip)
 	}
 }
 
 func TestLRUSelect_MultipleIPs(t *testing.T) {
 	cfg := Config{
-		IPs:           []string{"192.168.1.1", "192.168.1.2", "192.168.1.3"},
+		IPs:           netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3"}),
 		HistoryWindow: 300,
 		HistorySize:   100,
 		Limiter:       &mockLimiter{},
@@ -90,7 +98,7 @@ func TestLRUSelect_MultipleIPs(t *testing.T) {
 
 func TestLRUSelect_DistributionPerHost(t *testing.T) {
 	cfg := Config{
-		IPs:           []string{"192.168.1.1", "192.168.1.2"},
+		IPs:           netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2"}),
 		HistoryWindow: 300,
 		HistorySize:   100,
 		Limiter:       &mockLimiter{},
@@ -115,11 +123,11 @@ func TestLRUSelect_DistributionPerHost(t *testing.T) {
 
 func TestLRUSelect_RespectsLimiter(t *testing.T) {
 	cfg := Config{
-		IPs:           []string{"192.168.1.1", "192.168.1.2"},
+		IPs:           netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2"}),
 		HistoryWindow: 300,
 		HistorySize:   100,
 		Limiter: &mockLimiter{
-			unavailable: map[string]bool{"192.168.1.1": true},
+			unavailable: map[netip.Addr]bool{netip.MustParseAddr("192.168.1.1"): true},
 		},
 	}
 
@@ -131,7 +139,7 @@ func TestLRUSelect_RespectsLimiter(t *testing.T) {
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
-		if ip != "192.168.1.2" {
+		if ip != netip.MustParseAddr("192.168.1.2") {
 			t.Errorf("expected 192.168.1.2 (only available), got %s", ip)
 		}
 	}
@@ -139,13 +147,13 @@ func TestLRUSelect_RespectsLimiter(t *testing.T) {
 
 func TestLRUSelect_NoAvailableIPs(t *testing.T) {
 	cfg := Config{
-		IPs:           []string{"192.168.1.1", "192.168.1.2"},
+		IPs:           netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2"}),
 		HistoryWindow: 300,
 		HistorySize:   100,
 		Limiter: &mockLimiter{
-			unavailable: map[string]bool{
-				"192.168.1.1": true,
-				"192.168.1.2": true,
+			unavailable: map[netip.Addr]bool{
+				netip.MustParseAddr("192.168.1.1"): true,
+				netip.MustParseAddr("192.168.1.2"): true,
 			},
 		},
 	}
@@ -163,7 +171,7 @@ func TestHistory_GetFiltered(t *testing.T) {
 
 	// Add entries
 	for i := 0; i < 10; i++ {
-		h.Record("example.com", "192.168.1.1")
+		h.Record("example.com", netip.MustParseAddr("192.168.1.1"))
 	}
 
 	// Get filtered with size limit
@@ -176,8 +184,8 @@ func TestHistory_GetFiltered(t *testing.T) {
 func TestHostHistory_Add(t *testing.T) {
 	hh := NewHostHistory()
 
-	hh.Add("192.168.1.1")
-	hh.Add("192.168.1.2")
+	hh.Add(netip.MustParseAddr("192.168.1.1"))
+	hh.Add(netip.MustParseAddr("192.168.1.2"))
 
 	if hh.Len() != 2 {
 		t.Errorf("expected 2 entries, got %d", hh.Len())
@@ -2,8 +2,12 @@
 package balancer
 
 import (
+	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/metrics"
 )
 
 // State represents the circuit breaker state.
@@ -53,6 +57,8 @@ func DefaultCircuitBreakerConfig() CircuitBreakerConfig {
 
 // ipState holds the circuit breaker state for a single IP.
 type ipState struct {
+	addr        netip.Addr
+	ip          string // addr as a metric label
 	failures    int
 	successes   int
 	state       State
@@ -62,20 +68,22 @@ type ipState struct {
 // CircuitBreaker manages circuit breaker state per IP.
 type CircuitBreaker struct {
 	mu     sync.RWMutex
-	states map[string]*ipState
+	states map[netip.Addr]*ipState
 	config CircuitBreakerConfig
+	// onTransition is called on every state transition (nil when unset).
+	onTransition atomic.Pointer[func(ip netip.Addr, from, to State)]
 }
 
 // NewCircuitBreaker creates a new circuit breaker with the given configuration.
 func NewCircuitBreaker(config CircuitBreakerConfig) *CircuitBreaker {
 	return &CircuitBreaker{
-		states: make(map[string]*ipState),
+		states: make(map[netip.Addr]*ipState),
 		config: config,
 	}
 }
 
 // getOrCreateState returns the state for an IP, creating it if necessary.
-func (cb *CircuitBreaker) getOrCreateState(ip string) *ipState {
+func (cb *CircuitBreaker) getOrCreateState(ip netip.Addr) *ipState {
 	cb.mu.RLock()
 	state, exists := cb.states[ip]
 	cb.mu.RUnlock()
@@ -92,14 +100,34 @@ func (cb *CircuitBreaker) getOrCreateState(ip string) *ipState {
 		return state
 	}
 
-	state = &ipState{state: StateClosed}
+	state = &ipState{addr: ip, ip: ip.String(), state: StateClosed}
 	cb.states[ip] = state
+	metrics.CircuitState.WithLabelValues(state.ip).Set(float64(StateClosed))
 	return state
 }
 
+// transition moves an IP's circuit to a new state and records it in metrics.
+// Callers must hold cb.mu for writing.
+func (cb *CircuitBreaker) transition(state *ipState, to State) {
+	from := state.state
+	state.state = to
+	metrics.CircuitState.WithLabelValues(state.ip).Set(float64(to))
+	metrics.CircuitTransitions.WithLabelValues(state.ip, from.String(), to.String()).Inc()
+	if fn := cb.onTransition.Load(); fn != nil {
+		(*fn)(state.addr, from, to)
+	}
+}
+
+// SetOnTransition sets a function called on every circuit state transition.
+// It runs with the circuit breaker locked, so it must not block or call back
+// into the circuit breaker.
+func (cb *CircuitBreaker) SetOnTransition(fn func(ip netip.Addr, from, to State)) {
+	cb.onTransition.Store(&fn)
+}
+
 // IsHealthy checks if an IP is considered healthy (circuit not open).
 // Returns true if requests should be allowed to this IP.
-func (cb *CircuitBreaker) IsHealthy(ip string) bool {
+func (cb *CircuitBreaker) IsHealthy(ip netip.Addr) bool {
 	cb.mu.RLock()
 	state, exists := cb.states[ip]
 	cb.mu.RUnlock()
@@ -117,7 +145,7 @@ func (cb *CircuitBreaker) IsHealthy(ip string) bool {
 	case StateOpen:
 		// Check if timeout has elapsed
 		if time.Since(state.lastFailure) >= cb.config.Timeout {
-			state.state = StateHalfOpen
+			cb.transition(state, StateHalfOpen)
 			state.successes = 0
 			return true // Allow one request to test
 		}
@@ -130,7 +158,7 @@ func (cb *CircuitBreaker) IsHealthy(ip string) bool {
 }
 
 // RecordSuccess records a successful request to an IP.
-func (cb *CircuitBreaker) RecordSuccess(ip string) {
+func (cb *CircuitBreaker) RecordSuccess(ip netip.Addr) {
 	cb.mu.Lock()
 	defer cb.mu.Unlock()
 
@@ -144,7 +172,7 @@ func (cb *CircuitBreaker) RecordSuccess(ip string) {
 		state.successes++
 		if state.successes >= cb.config.SuccessThreshold {
 			// Close the circuit
-			state.state = StateClosed
+			cb.transition(state, StateClosed)
 			state.failures = 0
 			state.successes = 0
 		}
@@ -155,7 +183,7 @@ func (cb *CircuitBreaker) RecordSuccess(ip string) {
 }
 
 // RecordFailure records a failed request to an IP.
-func (cb *CircuitBreaker) RecordFailure(ip string) {
+func (cb *CircuitBreaker) RecordFailure(ip netip.Addr) {
 	state := cb.getOrCreateState(ip)
 
 	cb.mu.Lock()
@@ -167,17 +195,17 @@ func (cb *CircuitBreaker) RecordFailure(ip string) {
 	case StateClosed:
 		state.failures++
 		if state.failures >= cb.config.FailureThreshold {
-			state.state = StateOpen
+			cb.transition(state, StateOpen)
 		}
 	case StateHalfOpen:
 		// Any failure in half-open opens the circuit again
-		state.state = StateOpen
+		cb.transition(state, StateOpen)
 		state.successes = 0
 	}
 }
 
 // GetState returns the current state for an IP.
-func (cb *CircuitBreaker) GetState(ip string) State {
+func (cb *CircuitBreaker) GetState(ip netip.Addr) State {
 	cb.mu.RLock()
 	defer cb.mu.RUnlock()
 
@@ -201,8 +229,8 @@ func (cb *CircuitBreaker) GetStats() map[string]struct {
 		Failures int
 	})
 
-	for ip, state := range cb.states {
-		stats[ip] = struct {
+	for addr, state := range cb.states {
+		stats[addr.String()] = struct {
 			State    State
 			Failures int
 		}{
@@ -214,16 +242,35 @@ func (cb *CircuitBreaker) GetStats() map[string]struct {
 	return stats
 }
 
+// Info returns the circuit state of all IPs for the /stats endpoint.
+func (cb *CircuitBreaker) Info() map[string]metrics.CircuitInfo {
+	cb.mu.RLock()
+	defer cb.mu.RUnlock()
+
+	info := make(map[string]metrics.CircuitInfo, len(cb.states))
+	for addr, state := range cb.states {
+		info[addr.String()] = metrics.CircuitInfo{
+			State:    state.state.String(),
+			Failures: state.failures,
+		}
+	}
+	return info
+}
+
 // Reset resets the circuit breaker state for an IP.
-func (cb *CircuitBreaker) Reset(ip string) {
+func (cb *CircuitBreaker) Reset(ip netip.Addr) {
 	cb.mu.Lock()
 	defer cb.mu.Unlock()
 	delete(cb.states, ip)
+	metrics.CircuitState.WithLabelValues(ip.String()).Set(float64(StateClosed))
 }
 
 // ResetAll resets all circuit breaker states.
 func (cb *CircuitBreaker) ResetAll() {
 	cb.mu.Lock()
 	defer cb.mu.Unlock()
-	cb.states = make(map[string]*ipState)
+	for addr := range cb.states {
+		metrics.CircuitState.WithLabelValues(addr.String()).Set(float64(StateClosed))
+	}
+	cb.states = make(map[netip.Addr]*ipState)
 }
@@ -1,21 +1,27 @@
 package balancer
 
 import (
+	"net/netip"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
 )
 
 func TestCircuitBreaker_InitialState(t *testing.T) {
 	cb := NewCircuitBreaker(DefaultCircuitBreakerConfig())
 
 	// New IP should be healthy
-	if !cb.IsHealthy("192.168.1.1") {
+	if !cb.IsHealthy(netip.MustParseAddr("192.168.1.1")) {
 		t.Error("new IP should be healthy")
 	}
 
 	// State should be closed
-	if state := cb.GetState("192.168.1.1"); state != StateClosed {
+	if state := cb.GetState(netip.MustParseAddr("192.168.1.1")); state != StateClosed {
 		t.Errorf("expected StateClosed, got %s", state)
 	}
 }
@@ -31,14 +37,14 @@ func TestCircuitBreaker_OpensAfterFailures(t *testing.T) {
 
 	// Record failures up to threshold
 	for i := 0; i < 3; i++ {
-		cb.RecordFailure(ip)
+		cb.RecordFailure(netip.MustParseAddr(ip))
 	}
 
 	// Circuit should now be open
-	if cb.IsHealthy(ip) {
+	if cb.IsHealthy(netip.MustParseAddr(ip)) {
 		t.Error("circuit should be open after threshold failures")
 	}
-	if state := cb.GetState(ip); state != StateOpen {
+	if state := cb.GetState(netip.MustParseAddr(ip)); state != StateOpen {
 		t.Errorf("expected StateOpen, got %s", state)
 	}
 }
@@ -53,22 +59,22 @@ func TestCircuitBreaker_SuccessResetsFailures(t *testing.T) {
 	ip := "192.168.1.1"
 
 	// Record some failures
-	cb.RecordFailure(ip)
-	cb.RecordFailure(ip)
+	cb.RecordFailure(netip.MustParseAddr(ip))
+	cb.RecordFailure(netip.MustParseAddr(ip))
 
 	// Record success
-	cb.RecordSuccess(ip)
+	cb.RecordSuccess(netip.MustParseAddr(ip))
 
 	// Should still be healthy
-	if !cb.IsHealthy(ip) {
+	if !cb.IsHealthy(netip.MustParseAddr(ip)) {
 		t.Error("circuit should be healthy after success")
 	}
 
 	// Record more failures - shouldn't open because failures were reset
-	cb.RecordFailure(ip)
-	cb.RecordFailure(ip)
+	cb.RecordFailure(netip.MustParseAddr(ip))
+	cb.RecordFailure(netip.MustParseAddr(ip))
 
-	if !cb.IsHealthy(ip) {
+	if !cb.IsHealthy(netip.MustParseAddr(ip)) {
 		t.Error("circuit should still be healthy - failures were reset")
 	}
 }
@@ -83,10 +89,10 @@ func TestCircuitBreaker_TransitionsToHalfOpen(t *testing.T) {
 	ip := "192.168.1.1"
 
 	// Open the circuit
-	cb.RecordFailure(ip)
-	cb.RecordFailure(ip)
+	cb.RecordFailure(netip.MustParseAddr(ip))
+	cb.RecordFailure(netip.MustParseAddr(ip))
 
-	if cb.IsHealthy(ip) {
+	if cb.IsHealthy(netip.MustParseAddr(ip)) {
 		t.Error("circuit should be open")
 	}
 
@@ -94,10 +100,10 @@ func TestCircuitBreaker_TransitionsToHalfOpen(t *testing.T) {
 	time.Sleep(60 * time.Millisecond)
 
 	// Should transition to half-open and allow request
-	if !cb.IsHealthy(ip) {
+	if !cb.IsHealthy(netip.MustParseAddr(ip)) {
 		t.Error("circuit should be half-open and allow request")
 	}
-	if state := cb.GetState(ip); state != StateHalfOpen {
+	if state := cb.GetState(netip.MustParseAddr(ip)); state != StateHalfOpen {
 		t.Errorf("expected StateHalfOpen, got %s", state)
 	}
 }
@@ -112,19 +118,19 @@ func TestCircuitBreaker_ClosesAfterSuccessInHalfOpen(t *testing.T) {
 	ip := "192.168.1.1"
 
 	// Open the circuit
-	cb.RecordFailure(ip)
-	cb.RecordFailure(ip)
+	cb.RecordFailure(netip.MustParseAddr(ip))
+	cb.RecordFailure(netip.MustParseAddr(ip))
 
 	// Wait for timeout to transition to half-open
 	time.Sleep(60 * time.Millisecond)
-	cb.IsHealthy(ip) // This triggers the transition
+	cb.IsHealthy(netip.MustParseAddr(ip)) // This triggers the transition
 
 	// Record successes in half-open
-	cb.RecordSuccess(ip)
-	cb.RecordSuccess(ip)
+	cb.RecordSuccess(netip.MustParseAddr(ip))
+	cb.RecordSuccess(netip.MustParseAddr(ip))
 
 	// Circuit should be closed now
-	if state := cb.GetState(ip); state != StateClosed {
+	if state := cb.GetState(netip.MustParseAddr(ip)); state != StateClosed {
 		t.Errorf("expected StateClosed after successes, got %s", state)
 	}
 }
@@ -139,18 +145,18 @@ func TestCircuitBreaker_ReopensOnFailureInHalfOpen(t *testing.T) {
 	ip := "192.168.1.1"
 
 	// Open the circuit
-	cb.RecordFailure(ip)
-	cb.RecordFailure(ip)
+	cb.RecordFailure(netip.MustParseAddr(ip))
+	cb.RecordFailure(netip.MustParseAddr(ip))
 
 	// Wait for timeout to transition to half-open
 	time.Sleep(60 * time.Millisecond)
-	cb.IsHealthy(ip) // This triggers the transition
+	cb.IsHealthy(netip.MustParseAddr(ip)) // This triggers the transition
 
 	// Fail in half-open state
-	cb.RecordFailure(ip)
+	cb.RecordFailure(netip.MustParseAddr(ip))
 
 	// Circuit should be open again
-	if state := cb.GetState(ip); state != StateOpen {
+	if state := cb.GetState(netip.MustParseAddr(ip)); state != StateOpen {
 		t.Errorf("expected StateOpen after failure in half-open, got %s", state)
 	}
 }
@@ -161,18 +167,18 @@ func TestCircuitBreaker_Reset(t *testing.T) {
 
 	// Open the circuit
 	for i := 0; i < 5; i++ {
-		cb.RecordFailure(ip)
+		cb.RecordFailure(netip.MustParseAddr(ip))
 	}
 
-	if cb.IsHealthy(ip) {
+	if cb.IsHealthy(netip.MustParseAddr(ip)) {
 		t.Error("circuit should be open")
 	}
 
 	// Reset
-	cb.Reset(ip)
+	cb.Reset(netip.MustParseAddr(ip))
 
 	// Should be healthy again
-	if !cb.IsHealthy(ip) {
+	if !cb.IsHealthy(netip.MustParseAddr(ip)) {
 		t.Error("circuit should be healthy after reset")
 	}
 }
@@ -184,7 +190,7 @@ func TestCircuitBreaker_ResetAll(t *testing.T) {
 	for i := 0; i < 3; i++ {
 		ip := "192.168.1." + string(rune('1'+i))
 		for j := 0; j < 5; j++ {
-			cb.RecordFailure(ip)
+			cb.RecordFailure(netip.MustParseAddr(ip))
 		}
 	}
 
@@ -193,7 +199,7 @@ func TestCircuitBreaker_ResetAll(t *testing.T) {
 	// All should be healthy
 	for i := 0; i < 3; i++ {
 		ip := "192.168.1." + string(rune('1'+i))
-		if !cb.IsHealthy(ip) {
+		if !cb.IsHealthy(netip.MustParseAddr(ip)) {
 			t.Errorf("IP %s should be healthy after reset all", ip)
 		}
 	}
@@ -216,11 +222,11 @@ func TestCircuitBreaker_Concurrent(t *testing.T) {
 		go func(id int) {
 			defer wg.Done()
 			for j := 0; j < 100; j++ {
-				cb.IsHealthy(ip)
+				cb.IsHealthy(netip.MustParseAddr(ip))
 				if j%2 == 0 {
-					cb.RecordFailure(ip)
+					cb.RecordFailure(netip.MustParseAddr(ip))
 				} else {
-					cb.RecordSuccess(ip)
+					cb.RecordSuccess(netip.MustParseAddr(ip))
 				}
 			}
 		}(i)
@@ -235,9 +241,9 @@ func TestCircuitBreaker_Concurrent(t *testing.T) {
 func TestCircuitBreaker_GetStats(t *testing.T) {
 	cb := NewCircuitBreaker(DefaultCircuitBreakerConfig())
 
-	cb.RecordFailure("192.168.1.1")
-	cb.RecordFailure("192.168.1.1")
-	cb.RecordFailure("192.168.1.2")
+	cb.RecordFailure(netip.MustParseAddr("192.168.1.1"))
+	cb.RecordFailure(netip.MustParseAddr("192.168.1.1"))
+	cb.RecordFailure(netip.MustParseAddr("192.168.1.2"))
 
 	stats := cb.GetStats()
 
@@ -270,3 +276,107 @@ func TestState_String(t *testing.T) {
 		}
 	}
 }
+
+func TestLRUSelect_SkipsOpenCircuit(t *testing.T) {
+	cb := NewCircuitBreaker(CircuitBreakerConfig{
+		FailureThreshold: 1,
+		SuccessThreshold: 1,
+		Timeout:          time.Minute,
+	})
+	cfg := Config{
+		IPs:            netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2"}),
+		HistoryWindow:  300,
+		HistorySize:    100,
+		Limiter:        &mockLimiter{},
+		CircuitBreaker: cb,
+	}
+	bal := NewLRU(cfg)
+
+	cb.RecordFailure(netip.MustParseAddr("192.168.1.1"))
+	for i := 0; i < 5; i++ {
+		ip, err := bal.Select("example.com")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if ip != netip.MustParseAddr("192.168.1.2") {
+			t.Errorf("expected IP with closed circuit, got %s", ip)
+		}
+		bal.Record("example.com", ip)
+	}
+
+	// All circuits open: degrade gracefully instead of failing
+	cb.RecordFailure(netip.MustParseAddr("192.168.1.2"))
+	if _, err := bal.Select("example.com"); err != nil {
+		t.Errorf("expected graceful degradation, got %v", err)
+	}
+
+	info := cb.Info()
+	if info["192.168.1.1"].State != "open" || info["192.168.1.1"].Failures != 1 {
+		t.Errorf("unexpected circuit info: %+v", info)
+	}
+}
+
+func TestCircuitBreaker_Metrics(t *testing.T) {
+	cb := NewCircuitBreaker(CircuitBreakerConfig{
+		FailureThreshold: 2,
+		SuccessThreshold: 1,
+		Timeout:          10 * time.Millisecond,
+	})
+	ip := "10.99.0.1"
+	opened := metrics.CircuitTransitions.WithLabelValues(ip, "closed", "open")
+	halfOpened := metrics.CircuitTransitions.WithLabelValues(ip, "open", "half-open")
+	closed := metrics.CircuitTransitions.WithLabelValues(ip, "half-open", "closed")
+
+	cb.RecordFailure(netip.MustParseAddr(ip))
+	cb.RecordFailure(netip.MustParseAddr(ip))
+	if got := testutil.ToFloat64(metrics.CircuitState.WithLabelValues(ip)); got != float64(StateOpen) {
+		t.Errorf("circuit state gauge = %v, want %v", got, float64(StateOpen))
+	}
+	if got := testutil.ToFloat64(opened); got != 1 {
+		t.Errorf("closed->open transitions = %v, want 1", got)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	cb.IsHealthy(netip.MustParseAddr(ip))
+	cb.RecordSuccess(netip.MustParseAddr(ip))
+	if got := testutil.ToFloat64(halfOpened); got != 1 {
+		t.Errorf("open->half-open transitions = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(closed); got != 1 {
+		t.Errorf("half-open->closed transitions = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(metrics.CircuitState.WithLabelValues(ip)); got != float64(StateClosed) {
+		t.Errorf("circuit state gauge = %v, want %v", got, float64(StateClosed))
+	}
+}
+
+func TestCircuitBreaker_OnTransition(t *testing.T) {
+	cb := NewCircuitBreaker(CircuitBreakerConfig{
+		FailureThreshold: 1,
+		SuccessThreshold: 1,
+		Timeout:          10 * time.Millisecond,
+	})
+	var got []string
+	cb.SetOnTransition(func(ip netip.Addr, from, to State) {
+		got = append(got, ip.String()+" "+from.String()+"->"+to.String())
+	})
+
+	cb.RecordFailure(netip.MustParseAddr("10.98.0.1"))
+	time.Sleep(20 * time.Millisecond)
+	cb.IsHealthy(netip.MustParseAddr("10.98.0.1"))
+	cb.RecordSuccess(netip.MustParseAddr("10.98.0.1"))
+
+	want := []string{
+		"10.98.0.1 closed->open",
+		"10.98.0.1 open->half-open",
+		"10.98.0.1 half-open->closed",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("transitions = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("transition %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Package balancer provides IP load balancing algorithms.
+package balancer
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/logger"
+)
+
+// Cooldown excludes an IP for a host for a fixed duration once it has been
+// used N times for that host within the history window, modeling per-IP
+// rate limits on the target side.
+type Cooldown struct {
+	after    int
+	duration time.Duration
+	until    map[string]map[netip.Addr]time.Time
+	mu       sync.RWMutex
+}
+
+// NewCooldown creates a new Cooldown that triggers after the given number of uses.
+func NewCooldown(after int, duration time.Duration) *Cooldown {
+	return &Cooldown{
+		after:    after,
+		duration: duration,
+		until:    make(map[string]map[netip.Addr]time.Time),
+	}
+}
+
+// Observe starts a cooldown for ip on host if uses has reached the threshold.
+// Returns true if a new cooldown was started.
+func (c *Cooldown) Observe(host string, ip netip.Addr, uses int) bool {
+	if uses < c.after {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ips, ok := c.until[host]
+	if !ok {
+		ips = make(map[netip.Addr]time.Time)
+		c.until[host] = ips
+	}
+	ips[ip] = time.Now().Add(c.duration)
+	return true
+}
+
+// Active reports whether ip is cooling down for host.
+func (c *Cooldown) Active(host string, ip netip.Addr, now time.Time) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	until, ok := c.until[host][ip]
+	return ok && now.Before(until)
+}
+
+// Filter removes IPs cooling down for host from available, in place.
+// If every IP is cooling down, available is returned unchanged.
+func (c *Cooldown) Filter(host string, available []netip.Addr) []netip.Addr {
+	c.mu.RLock()
+	_, ok := c.until[host]
+	c.mu.RUnlock()
+	if !ok {
+		return available
+	}
+
+	now := time.Now()
+	cooling := 0
+	for _, ip := range available {
+		if c.Active(host, ip, now) {
+			cooling++
+		}
+	}
+	if cooling == 0 {
+		return available
+	}
+	if cooling == len(available) {
+		logger.Debug("all_ips_cooling_down", "host", host, "using_all", true, "total_ips", len(available))
+		return available
+	}
+
+	// A new slice: available may be the balancer's own list of IPs
+	out := make([]netip.Addr, 0, len(available)-cooling)
+	for _, ip := range available {
+		if !c.Active(host, ip, now) {
+			out = append(out, ip)
+		}
+	}
+	return out
+}
+
+// Cleanup removes expired cooldowns and returns how many were removed.
+func (c *Cooldown) Cleanup() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	removed := 0
+	for host, ips := range c.until {
+		for addr, until := range ips {
+			if !now.Before(until) {
+				delete(ips, addr)
+				removed++
+			}
+		}
+		if len(ips) == 0 {
+			delete(c.until, host)
+		}
+	}
+	return removed
+}
@@ -0,0 +1,112 @@
+package balancer
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
+)
+
+func TestCooldown_Observe(t *testing.T) {
+	c := NewCooldown(3, time.Minute)
+	now := time.Now()
+
+	if c.Observe("example.com", netip.MustParseAddr("192.168.1.1"), 2) {
+		t.Error("expected no cooldown below threshold")
+	}
+	if !c.Observe("example.com", netip.MustParseAddr("192.168.1.1"), 3) {
+		t.Error("expected cooldown at threshold")
+	}
+	if !c.Active("example.com", netip.MustParseAddr("192.168.1.1"), now) {
+		t.Error("expected IP to be cooling down for host")
+	}
+	if c.Active("other.com", netip.MustParseAddr("192.168.1.1"), now) {
+		t.Error("expected cooldown to be per host")
+	}
+	if c.Active("example.com", netip.MustParseAddr("192.168.1.1"), now.Add(2*time.Minute)) {
+		t.Error("expected cooldown to end after duration")
+	}
+}
+
+func TestCooldown_FilterAndCleanup(t *testing.T) {
+	c := NewCooldown(1, 20*time.Millisecond)
+	c.Observe("example.com", netip.MustParseAddr("192.168.1.1"), 1)
+
+	available := netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2"})
+	got := c.Filter("example.com", available)
+	if len(got) != 1 || got[0] != netip.MustParseAddr("192.168.1.2") {
+		t.Errorf("expected only 192.168.1.2, got %v", got)
+	}
+	if available[0] != netip.MustParseAddr("192.168.1.1") {
+		t.Errorf("Filter() modified its input: %v", available)
+	}
+
+	// All cooling down falls back to every available IP
+	if got := c.Filter("example.com", netutil.MustParseAddrs([]string{"192.168.1.1"})); len(got) != 1 {
+		t.Errorf("expected fallback to all IPs, got %v", got)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if removed := c.Cleanup(); removed != 1 {
+		t.Errorf("expected 1 removed cooldown, got %d", removed)
+	}
+}
+
+func TestLRUSelect_Cooldown(t *testing.T) {
+	cfg := Config{
+		IPs:              netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2"}),
+		HistoryWindow:    300,
+		HistorySize:      100,
+		Limiter:          &mockLimiter{},
+		RotationPolicy:   RotationEveryN,
+		RotationEvery:    100,
+		CooldownAfter:    3,
+		CooldownDuration: time.Minute,
+	}
+	bal := NewLRU(cfg)
+
+	// every-n would keep the host on one IP; the cooldown forces a switch after 3 uses
+	var used []netip.Addr
+	for i := 0; i < 4; i++ {
+		ip, err := bal.Select("example.com")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		bal.Record("example.com", ip)
+		used = append(used, ip)
+	}
+	if used[3] == used[0] {
+		t.Errorf("expected a different IP after cooldown, got %v", used)
+	}
+	if released := cfg.Limiter.(*mockLimiter).released; released != 4 {
+		t.Errorf("ReleaseAvailableIPs() called %d times, want 4", released)
+	}
+}
+
+func TestLRUSelect_CooldownWithoutLimiter(t *testing.T) {
+	ips := netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3"})
+	bal := NewLRU(Config{
+		IPs:              slices.Clone(ips),
+		HistoryWindow:    300,
+		HistorySize:      100,
+		CooldownAfter:    1,
+		CooldownDuration: time.Minute,
+	})
+
+	for i := 0; i < 3; i++ {
+		ip, err := bal.Select("example.com")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		bal.Record("example.com", ip)
+	}
+	// Filtering the candidates must not rewrite the balancer's IPs
+	bal.mu.RLock()
+	got := slices.Clone(bal.ips)
+	bal.mu.RUnlock()
+	if !slices.Equal(got, ips) {
+		t.Errorf("IPs after cooldowns = %v, want %v", got, ips)
+	}
+}
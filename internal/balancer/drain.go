@@ -0,0 +1,53 @@
+// Package balancer provides IP load balancing algorithms.
+package balancer
+
+import (
+	"errors"
+	"net/netip"
+	"slices"
+
+	"github.com/cr0hn/outbound-lb/internal/logger"
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+)
+
+// ErrUnknownIP is returned when an operation names an IP that is not an
+// outbound IP of the balancer.
+var ErrUnknownIP = errors.New("unknown outbound IP")
+
+// SetDrain puts ip into drain mode, or takes it out again. A draining IP gets
+// no new selections, even when no other IP is available, while connections
+// already using it are left to finish.
+func (l *LRU) SetDrain(ip netip.Addr, drain bool) error {
+	l.mu.Lock()
+	if !slices.Contains(l.ips, ip) {
+		l.mu.Unlock()
+		return ErrUnknownIP
+	}
+	if slices.Contains(l.drained, ip) == drain {
+		l.mu.Unlock()
+		return nil
+	}
+	// Copy on write: Select works on the slice without holding the lock
+	if drain {
+		l.drained = append(slices.Clip(l.drained), ip)
+	} else {
+		l.drained = slices.DeleteFunc(slices.Clone(l.drained), func(s netip.Addr) bool { return s == ip })
+	}
+	l.mu.Unlock()
+
+	if drain {
+		metrics.IPDraining.WithLabelValues(ip.String()).Set(1)
+		logger.Info("ip_drain_started", "ip", ip)
+	} else {
+		metrics.IPDraining.WithLabelValues(ip.String()).Set(0)
+		logger.Info("ip_drain_stopped", "ip", ip)
+	}
+	return nil
+}
+
+// Draining returns the IPs in drain mode.
+func (l *LRU) Draining() []netip.Addr {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return slices.Clone(l.drained)
+}
@@ -0,0 +1,60 @@
+package balancer
+
+import (
+	"errors"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
+)
+
+func TestLRU_SetDrain(t *testing.T) {
+	lru := NewLRU(Config{
+		IPs:           netutil.MustParseAddrs([]string{"10.0.0.1", "10.0.0.2"}),
+		HistoryWindow: 300,
+		HistorySize:   100,
+		Limiter:       &mockLimiter{},
+	})
+
+	if err := lru.SetDrain(netip.MustParseAddr("10.0.0.1"), true); err != nil {
+		t.Fatalf("SetDrain() error: %v", err)
+	}
+	if got := lru.Draining(); !slices.Equal(got, []netip.Addr{netip.MustParseAddr("10.0.0.1")}) {
+		t.Errorf("expected 10.0.0.1 draining, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.IPDraining.WithLabelValues("10.0.0.1")); got != 1 {
+		t.Errorf("expected draining gauge 1, got %v", got)
+	}
+
+	counts := selectCounts(lru, "example.com", 4)
+	if counts[netip.MustParseAddr("10.0.0.1")] != 0 {
+		t.Errorf("expected draining IP not to be selected, got %v", counts)
+	}
+
+	// No fallback to draining IPs
+	lru.SetDrain(netip.MustParseAddr("10.0.0.2"), true)
+	if _, err := lru.Select("example.com"); !errors.Is(err, ErrNoAvailableIPs) {
+		t.Errorf("expected ErrNoAvailableIPs with all IPs draining, got %v", err)
+	}
+
+	lru.SetDrain(netip.MustParseAddr("10.0.0.1"), false)
+	lru.SetDrain(netip.MustParseAddr("10.0.0.2"), false)
+	if got := lru.Draining(); len(got) != 0 {
+		t.Errorf("expected no draining IPs, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.IPDraining.WithLabelValues("10.0.0.1")); got != 0 {
+		t.Errorf("expected draining gauge 0, got %v", got)
+	}
+	counts = selectCounts(lru, "other.example.com", 4)
+	if counts[netip.MustParseAddr("10.0.0.1")] != 2 || counts[netip.MustParseAddr("10.0.0.2")] != 2 {
+		t.Errorf("expected an even split after draining stopped, got %v", counts)
+	}
+
+	if err := lru.SetDrain(netip.MustParseAddr("10.0.0.9"), true); !errors.Is(err, ErrUnknownIP) {
+		t.Errorf("expected ErrUnknownIP, got %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+// Package balancer provides IP load balancing algorithms.
+package balancer
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+)
+
+// excludeKey is the context key for IPs excluded from selection.
+type excludeKey struct{}
+
+// ContextWithExcluded returns a new context that keeps the given IPs out of
+// selection, e.g. IPs a request already failed through. Unlike health and
+// circuit filtering there is no fallback: if every candidate is excluded,
+// selection fails with ErrNoAvailableIPs.
+func ContextWithExcluded(ctx context.Context, ips ...netip.Addr) context.Context {
+	return context.WithValue(ctx, excludeKey{}, ips)
+}
+
+// ExcludedFromContext extracts the excluded IPs from the context.
+func ExcludedFromContext(ctx context.Context) []netip.Addr {
+	ips, _ := ctx.Value(excludeKey{}).([]netip.Addr)
+	return ips
+}
+
+// withoutExcluded returns ips minus the excluded ones. ips is not modified.
+func withoutExcluded(ips, excluded []netip.Addr) []netip.Addr {
+	if len(excluded) == 0 {
+		return ips
+	}
+	result := make([]netip.Addr, 0, len(ips))
+	for _, ip := range ips {
+		if !slices.Contains(excluded, ip) {
+			result = append(result, ip)
+		}
+	}
+	return result
+}
+
+// requireKey is the context key for the only IP allowed for selection.
+type requireKey struct{}
+
+// ContextWithRequiredIP returns a new context that restricts selection to ip,
+// e.g. the IP a frontend instance chose for a request it sent to this one.
+// If ip is not available, selection fails with ErrNoAvailableIPs.
+func ContextWithRequiredIP(ctx context.Context, ip netip.Addr) context.Context {
+	return context.WithValue(ctx, requireKey{}, ip)
+}
+
+// RequiredIPFromContext extracts the required IP from the context. Returns
+// the zero Addr if none is set.
+func RequiredIPFromContext(ctx context.Context) netip.Addr {
+	ip, _ := ctx.Value(requireKey{}).(netip.Addr)
+	return ip
+}
+
+// onlyRequired returns the IPs of ips equal to required, or ips itself when
+// required is the zero Addr.
+func onlyRequired(ips []netip.Addr, required netip.Addr) []netip.Addr {
+	if !required.IsValid() {
+		return ips
+	}
+	var result []netip.Addr
+	for _, ip := range ips {
+		if ip == required {
+			result = append(result, ip)
+		}
+	}
+	return result
+}
+
+// familiesKey is the context key for the address families of the destination.
+type familiesKey struct{}
+
+// families holds which address families the destination resolved to.
+type families struct {
+	ipv4, ipv6 bool
+}
+
+// ContextWithFamilies returns a new context that prefers outbound IPs of the
+// address families the destination resolved to. If no candidate is of one of
+// them, selection is not restricted and the dial reports the failure.
+func ContextWithFamilies(ctx context.Context, ipv4, ipv6 bool) context.Context {
+	return context.WithValue(ctx, familiesKey{}, families{ipv4: ipv4, ipv6: ipv6})
+}
+
+// onlyFamilies returns the IPs of ips in the families set in ctx, or ips
+// itself when none are set or none of ips match.
+func onlyFamilies(ctx context.Context, ips []netip.Addr) []netip.Addr {
+	f, ok := ctx.Value(familiesKey{}).(families)
+	if !ok || (!f.ipv4 && !f.ipv6) {
+		return ips
+	}
+	var result []netip.Addr
+	for _, ip := range ips {
+		is4 := ip.Is4()
+		if (is4 && f.ipv4) || (!is4 && f.ipv6) {
+			result = append(result, ip)
+		}
+	}
+	if len(result) == 0 {
+		return ips
+	}
+	return result
+}
+
+// preferredFamilyKey is the context key for the preferred address family.
+type preferredFamilyKey struct{}
+
+// ContextWithPreferredFamily returns a new context that selects outbound IPs
+// of the preferred family (IPv4 when ipv4 is set, IPv6 otherwise) as long as
+// one of them is available.
+func ContextWithPreferredFamily(ctx context.Context, ipv4 bool) context.Context {
+	return context.WithValue(ctx, preferredFamilyKey{}, ipv4)
+}
+
+// preferFamily returns the IPs of ips in the preferred family set in ctx, or
+// ips itself when none is set or none of ips match.
+func preferFamily(ctx context.Context, ips []netip.Addr) []netip.Addr {
+	ipv4, ok := ctx.Value(preferredFamilyKey{}).(bool)
+	if !ok {
+		return ips
+	}
+	var result []netip.Addr
+	for _, ip := range ips {
+		if ip.Is4() == ipv4 {
+			result = append(result, ip)
+		}
+	}
+	if len(result) == 0 {
+		return ips
+	}
+	return result
+}
@@ -0,0 +1,123 @@
+package balancer
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
+)
+
+func TestLRUSelect_Excluded(t *testing.T) {
+	lru := NewLRU(Config{
+		IPs:           netutil.MustParseAddrs([]string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}),
+		HistoryWindow: 300,
+		HistorySize:   100,
+	})
+
+	ctx := ContextWithExcluded(context.Background(), netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2"))
+	for i := 0; i < 5; i++ {
+		ip, err := lru.SelectWithContext(ctx, "example.com")
+		if err != nil {
+			t.Fatalf("SelectWithContext() error = %v", err)
+		}
+		if ip != netip.MustParseAddr("10.0.0.3") {
+			t.Errorf("selected excluded IP %s", ip)
+		}
+		lru.Record("example.com", ip)
+	}
+
+	ctx = ContextWithExcluded(context.Background(), netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("10.0.0.3"))
+	if _, err := lru.SelectWithContext(ctx, "example.com"); err != ErrNoAvailableIPs {
+		t.Errorf("expected ErrNoAvailableIPs with every IP excluded, got %v", err)
+	}
+}
+
+func TestLRUSelect_RequiredIP(t *testing.T) {
+	lru := NewLRU(Config{
+		IPs:           netutil.MustParseAddrs([]string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}),
+		HistoryWindow: 300,
+		HistorySize:   100,
+	})
+
+	ctx := ContextWithRequiredIP(context.Background(), netip.MustParseAddr("10.0.0.2"))
+	for i := 0; i < 5; i++ {
+		ip, err := lru.SelectWithContext(ctx, "example.com")
+		if err != nil {
+			t.Fatalf("SelectWithContext() error = %v", err)
+		}
+		if ip != netip.MustParseAddr("10.0.0.2") {
+			t.Errorf("selected %s, want the required IP 10.0.0.2", ip)
+		}
+		lru.Record("example.com", ip)
+	}
+
+	ctx = ContextWithRequiredIP(context.Background(), netip.MustParseAddr("10.0.0.9"))
+	if _, err := lru.SelectWithContext(ctx, "example.com"); err != ErrNoAvailableIPs {
+		t.Errorf("expected ErrNoAvailableIPs for an unknown required IP, got %v", err)
+	}
+}
+
+func TestLRUSelect_Families(t *testing.T) {
+	lru := NewLRU(Config{
+		IPs:           netutil.MustParseAddrs([]string{"10.0.0.1", "2001:db8::1", "2001:db8::2"}),
+		HistoryWindow: 300,
+		HistorySize:   100,
+	})
+
+	ctx := ContextWithFamilies(context.Background(), true, false)
+	for i := 0; i < 3; i++ {
+		ip, err := lru.SelectWithContext(ctx, "v4only.example.com")
+		if err != nil {
+			t.Fatalf("SelectWithContext() error = %v", err)
+		}
+		if ip != netip.MustParseAddr("10.0.0.1") {
+			t.Errorf("selected %s for an IPv4-only destination", ip)
+		}
+		lru.Record("v4only.example.com", ip)
+	}
+
+	ctx = ContextWithFamilies(context.Background(), false, true)
+	for i := 0; i < 4; i++ {
+		ip, err := lru.SelectWithContext(ctx, "v6only.example.com")
+		if err != nil {
+			t.Fatalf("SelectWithContext() error = %v", err)
+		}
+		if ip == netip.MustParseAddr("10.0.0.1") {
+			t.Errorf("selected %s for an IPv6-only destination", ip)
+		}
+		lru.Record("v6only.example.com", ip)
+	}
+
+	// Without a matching IP selection is not restricted
+	v4only := NewLRU(Config{IPs: netutil.MustParseAddrs([]string{"10.0.0.1"}), HistoryWindow: 300, HistorySize: 100})
+	if ip, err := v4only.SelectWithContext(ctx, "v6only.example.com"); err != nil || ip != netip.MustParseAddr("10.0.0.1") {
+		t.Errorf("SelectWithContext() = %q, %v, want 10.0.0.1", ip, err)
+	}
+}
+
+func TestLRUSelect_PreferredFamily(t *testing.T) {
+	lru := NewLRU(Config{
+		IPs:           netutil.MustParseAddrs([]string{"10.0.0.1", "10.0.0.2", "2001:db8::1"}),
+		HistoryWindow: 300,
+		HistorySize:   100,
+	})
+
+	ctx := ContextWithPreferredFamily(context.Background(), false)
+	for i := 0; i < 3; i++ {
+		ip, err := lru.SelectWithContext(ctx, "dual.example.com")
+		if err != nil {
+			t.Fatalf("SelectWithContext() error = %v", err)
+		}
+		if ip != netip.MustParseAddr("2001:db8::1") {
+			t.Errorf("selected %s with IPv6 preferred", ip)
+		}
+		lru.Record("dual.example.com", ip)
+	}
+
+	// Once no IP of the preferred family is available, the other one is used
+	ctx = ContextWithExcluded(ctx, netip.MustParseAddr("2001:db8::1"))
+	if ip, err := lru.SelectWithContext(ctx, "dual.example.com"); err != nil || ip == netip.MustParseAddr("2001:db8::1") {
+		t.Errorf("SelectWithContext() = %q, %v, want an IPv4 IP", ip, err)
+	}
+}
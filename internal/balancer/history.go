@@ -2,13 +2,14 @@
 package balancer
 
 import (
+	"net/netip"
 	"sync"
 	"time"
 )
 
 // Entry represents a single usage record.
 type Entry struct {
-	IP        string
+	Addr      netip.Addr
 	Timestamp time.Time
 }
 
@@ -26,11 +27,11 @@ func NewHostHistory() *HostHistory {
 }
 
 // Add adds an entry to the history.
-func (h *HostHistory) Add(ip string) {
+func (h *HostHistory) Add(ip netip.Addr) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 	h.entries = append(h.entries, Entry{
-		IP:        ip,
+		Addr:      ip,
 		Timestamp: time.Now(),
 	})
 }
@@ -53,6 +54,25 @@ func (h *HostHistory) GetFiltered(window time.Duration, maxSize int) []Entry {
 	return result
 }
 
+// Count returns how many of the entries GetFiltered would return are for ip,
+// without copying them.
+func (h *HostHistory) Count(ip netip.Addr, window time.Duration, maxSize int) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	cutoff := time.Now().Add(-window)
+	seen, count := 0, 0
+	for i := len(h.entries) - 1; i >= 0 && seen < maxSize; i-- {
+		if h.entries[i].Timestamp.After(cutoff) {
+			seen++
+			if h.entries[i].Addr == ip {
+				count++
+			}
+		}
+	}
+	return count
+}
+
 // Cleanup removes expired entries.
 func (h *HostHistory) Cleanup(window time.Duration) int {
 	h.mu.Lock()
@@ -132,7 +152,7 @@ func (h *History) GetOrCreate(host string) *HostHistory {
 }
 
 // Record records an IP usage for a host.
-func (h *History) Record(host, ip string) {
+func (h *History) Record(host string, ip netip.Addr) {
 	// Check if we've reached the global limit
 	if h.maxTotalEntries > 0 {
 		h.mu.Lock()
@@ -197,6 +217,19 @@ func (h *History) GetFiltered(host string, window time.Duration, maxSize int) []
 	return hh.GetFiltered(window, maxSize)
 }
 
+// Count returns how many filtered entries for a host are for ip.
+func (h *History) Count(host string, ip netip.Addr, window time.Duration, maxSize int) int {
+	h.mu.RLock()
+	hh, exists := h.hosts[host]
+	h.mu.RUnlock()
+
+	if !exists {
+		return 0
+	}
+
+	return hh.Count(ip, window, maxSize)
+}
+
 // Cleanup removes expired entries from all hosts.
 func (h *History) Cleanup(window time.Duration) (removedEntries, removedHosts int) {
 	h.mu.Lock()
@@ -231,7 +264,7 @@ func (h *History) Stats() (totalHosts, totalEntries int, entriesPerIP map[string
 		hh.mu.RLock()
 		for _, e := range hh.entries {
 			totalEntries++
-			entriesPerIP[e.IP]++
+			entriesPerIP[e.Addr.String()]++
 		}
 		hh.mu.RUnlock()
 	}
@@ -1,6 +1,7 @@
 package balancer
 
 import (
+	"net/netip"
 	"sync"
 	"testing"
 	"time"
@@ -19,13 +20,13 @@ func TestNewHostHistory(t *testing.T) {
 func TestHostHistory_AddAndLen(t *testing.T) {
 	hh := NewHostHistory()
 
-	hh.Add("192.168.1.1")
+	hh.Add(netip.MustParseAddr("192.168.1.1"))
 	if hh.Len() != 1 {
 		t.Errorf("expected 1 entry, got %d", hh.Len())
 	}
 
-	hh.Add("192.168.1.2")
-	hh.Add("192.168.1.3")
+	hh.Add(netip.MustParseAddr("192.168.1.2"))
+	hh.Add(netip.MustParseAddr("192.168.1.3"))
 	if hh.Len() != 3 {
 		t.Errorf("expected 3 entries, got %d", hh.Len())
 	}
@@ -36,7 +37,7 @@ func TestHostHistory_GetFiltered_SizeLimit(t *testing.T) {
 
 	// Add 20 entries
 	for i := 0; i < 20; i++ {
-		hh.Add("192.168.1.1")
+		hh.Add(netip.MustParseAddr("192.168.1.1"))
 	}
 
 	// Get with size limit of 5
@@ -50,7 +51,7 @@ func TestHostHistory_GetFiltered_TimeWindow(t *testing.T) {
 	hh := NewHostHistory()
 
 	// Add entry
-	hh.Add("192.168.1.1")
+	hh.Add(netip.MustParseAddr("192.168.1.1"))
 
 	// Get with very small window (entries should be filtered)
 	time.Sleep(10 * time.Millisecond)
@@ -70,9 +71,9 @@ func TestHostHistory_Cleanup(t *testing.T) {
 	hh := NewHostHistory()
 
 	// Add entries
-	hh.Add("192.168.1.1")
-	hh.Add("192.168.1.2")
-	hh.Add("192.168.1.3")
+	hh.Add(netip.MustParseAddr("192.168.1.1"))
+	hh.Add(netip.MustParseAddr("192.168.1.2"))
+	hh.Add(netip.MustParseAddr("192.168.1.3"))
 
 	if hh.Len() != 3 {
 		t.Fatalf("expected 3 entries before cleanup, got %d", hh.Len())
@@ -94,7 +95,7 @@ func TestHostHistory_Cleanup_KeepRecent(t *testing.T) {
 	hh := NewHostHistory()
 
 	// Add entry
-	hh.Add("192.168.1.1")
+	hh.Add(netip.MustParseAddr("192.168.1.1"))
 
 	// Cleanup with large window (should keep entry)
 	removed := hh.Cleanup(time.Hour)
@@ -117,7 +118,7 @@ func TestHostHistory_Concurrent(t *testing.T) {
 		go func() {
 			defer wg.Done()
 			for j := 0; j < 100; j++ {
-				hh.Add("192.168.1.1")
+				hh.Add(netip.MustParseAddr("192.168.1.1"))
 			}
 		}()
 	}
@@ -175,9 +176,9 @@ func TestHistory_GetOrCreate(t *testing.T) {
 func TestHistory_Record(t *testing.T) {
 	h := NewHistory()
 
-	h.Record("host1.com", "192.168.1.1")
-	h.Record("host1.com", "192.168.1.2")
-	h.Record("host2.com", "192.168.1.1")
+	h.Record("host1.com", netip.MustParseAddr("192.168.1.1"))
+	h.Record("host1.com", netip.MustParseAddr("192.168.1.2"))
+	h.Record("host2.com", netip.MustParseAddr("192.168.1.1"))
 
 	entries1 := h.GetFiltered("host1.com", time.Hour, 100)
 	if len(entries1) != 2 {
@@ -202,8 +203,8 @@ func TestHistory_GetFiltered_NonexistentHost(t *testing.T) {
 func TestHistory_Cleanup(t *testing.T) {
 	h := NewHistory()
 
-	h.Record("host1.com", "192.168.1.1")
-	h.Record("host2.com", "192.168.1.2")
+	h.Record("host1.com", netip.MustParseAddr("192.168.1.1"))
+	h.Record("host2.com", netip.MustParseAddr("192.168.1.2"))
 
 	// Wait and cleanup
 	time.Sleep(10 * time.Millisecond)
@@ -220,10 +221,10 @@ func TestHistory_Cleanup(t *testing.T) {
 func TestHistory_Stats(t *testing.T) {
 	h := NewHistory()
 
-	h.Record("host1.com", "192.168.1.1")
-	h.Record("host1.com", "192.168.1.1")
-	h.Record("host1.com", "192.168.1.2")
-	h.Record("host2.com", "192.168.1.1")
+	h.Record("host1.com", netip.MustParseAddr("192.168.1.1"))
+	h.Record("host1.com", netip.MustParseAddr("192.168.1.1"))
+	h.Record("host1.com", netip.MustParseAddr("192.168.1.2"))
+	h.Record("host2.com", netip.MustParseAddr("192.168.1.1"))
 
 	totalHosts, totalEntries, entriesPerIP := h.Stats()
 
@@ -255,7 +256,7 @@ func TestHistory_Concurrent(t *testing.T) {
 			for j := 0; j < 100; j++ {
 				host := hosts[j%len(hosts)]
 				ip := ips[j%len(ips)]
-				h.Record(host, ip)
+				h.Record(host, netip.MustParseAddr(ip))
 			}
 		}(i)
 	}
@@ -280,12 +281,12 @@ func TestHistory_Concurrent(t *testing.T) {
 func TestEntry_Fields(t *testing.T) {
 	now := time.Now()
 	e := Entry{
-		IP:        "192.168.1.1",
+		Addr:      netip.MustParseAddr("192.168.1.1"),
 		Timestamp: now,
 	}
 
-	if e.IP != "192.168.1.1" {
-		t.Errorf("expected IP 192.168.1.1, got %s", e.IP)
+	if e.Addr != netip.MustParseAddr("192.168.1.1") {
+		t.Errorf("expected IP 192.168.1.1, got %s", e.Addr)
 	}
 	if e.Timestamp != now {
 		t.Errorf("expected timestamp %v, got %v", now, e.Timestamp)
@@ -2,13 +2,16 @@
 package balancer
 
 import (
+	"context"
 	"errors"
-	"math"
+	"net/netip"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/cr0hn/outbound-lb/internal/logger"
 	"github.com/cr0hn/outbound-lb/internal/metrics"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
 )
 
 var (
@@ -18,8 +21,8 @@ var (
 
 // selectContext holds temporary maps used during Select() to avoid allocations.
 type selectContext struct {
-	usageCount map[string]int
-	lastUsed   map[string]time.Time
+	usageCount map[netip.Addr]int
+	lastUsed   map[netip.Addr]time.Time
 }
 
 // selectContextPool is a sync.Pool for reusing selectContext in Select().
@@ -27,20 +30,34 @@ type selectContext struct {
 var selectContextPool = sync.Pool{
 	New: func() any {
 		return &selectContext{
-			usageCount: make(map[string]int, 16),
-			lastUsed:   make(map[string]time.Time, 16),
+			usageCount: make(map[netip.Addr]int, 16),
+			lastUsed:   make(map[netip.Addr]time.Time, 16),
 		}
 	},
 }
 
+// historyMetricsInterval is how often the history gauges are refreshed.
+// Computing them walks the whole history, so it is kept off the Record path.
+const historyMetricsInterval = 5 * time.Second
+
 // LRU implements the Least Recently Used per Host algorithm.
 type LRU struct {
-	ips           []string
+	ips           []netip.Addr
+	drained       []netip.Addr
 	historyWindow time.Duration
 	historySize   int
+	weights       map[netip.Addr]int
 	limiter       IPLimiter
 	healthChecker IPHealthChecker
+	breaker       *CircuitBreaker
 	history       *History
+	affinity      *Affinity
+	rotation      *Rotation
+	router        *Router
+	warmup        *Warmup
+	cooldown      *Cooldown
+	shared        *Shared
+	healthySince  func(ip netip.Addr) time.Time
 	stopCh        chan struct{}
 	wg            sync.WaitGroup
 	mu            sync.RWMutex
@@ -48,15 +65,35 @@ type LRU struct {
 
 // NewLRU creates a new LRU balancer.
 func NewLRU(cfg Config) *LRU {
-	return &LRU{
+	l := &LRU{
 		ips:           cfg.IPs,
 		historyWindow: time.Duration(cfg.HistoryWindow) * time.Second,
 		historySize:   cfg.HistorySize,
 		limiter:       cfg.Limiter,
 		healthChecker: cfg.HealthChecker,
+		breaker:       cfg.CircuitBreaker,
+		router:        cfg.Router,
+		shared:        cfg.Shared,
+		weights:       weightsByAddr(cfg.Weights),
 		history:       NewHistory(),
 		stopCh:        make(chan struct{}),
 	}
+	if cfg.AffinityWindow > 0 {
+		l.affinity = NewAffinity(cfg.AffinityWindow)
+	}
+	if cfg.RotationPolicy != "" && cfg.RotationPolicy != RotationLRU {
+		l.rotation = NewRotation(cfg.RotationPolicy, cfg.RotationEvery, cfg.RotationInterval)
+	}
+	if cfg.CooldownAfter > 0 {
+		l.cooldown = NewCooldown(cfg.CooldownAfter, cfg.CooldownDuration)
+	}
+	if cfg.WarmupPeriod > 0 {
+		l.warmup = NewWarmup(cfg.WarmupPeriod)
+		if rt, ok := cfg.HealthChecker.(IPRecoveryTracker); ok {
+			l.healthySince = rt.HealthySince
+		}
+	}
+	return l
 }
 
 // UpdateHistoryConfig updates the history configuration at runtime.
@@ -68,27 +105,117 @@ func (l *LRU) UpdateHistoryConfig(window time.Duration, size int) {
 	logger.Info("history_config_updated", "window", window, "size", size)
 }
 
-// Start starts the background cleanup goroutine.
+// UpdateWeights replaces the per-IP selection weights at runtime.
+func (l *LRU) UpdateWeights(weights map[string]int) {
+	byAddr := weightsByAddr(weights)
+	l.mu.Lock()
+	l.weights = byAddr
+	l.mu.Unlock()
+	logger.Info("ip_weights_updated", "weights", weights)
+}
+
+// AddIP adds ip to the selection set. It goes through warm-up if enabled.
+func (l *LRU) AddIP(ip netip.Addr) {
+	l.mu.Lock()
+	if slices.Contains(l.ips, ip) {
+		l.mu.Unlock()
+		return
+	}
+	// Copy on write: Select works on the slice without holding the lock
+	l.ips = append(slices.Clip(l.ips), ip)
+	l.mu.Unlock()
+
+	logger.Info("balancer_ip_added", "ip", ip)
+	l.StartWarmup(ip)
+}
+
+// RemoveIP removes ip from the selection set; routed pools skip it as well.
+// Connections already using it are not affected.
+func (l *LRU) RemoveIP(ip netip.Addr) {
+	l.mu.Lock()
+	i := slices.Index(l.ips, ip)
+	if i < 0 {
+		l.mu.Unlock()
+		return
+	}
+	l.ips = slices.Delete(slices.Clone(l.ips), i, i+1)
+	wasDrained := slices.Contains(l.drained, ip)
+	if wasDrained {
+		l.drained = slices.DeleteFunc(slices.Clone(l.drained), func(s netip.Addr) bool { return s == ip })
+	}
+	l.mu.Unlock()
+
+	if wasDrained {
+		metrics.IPDraining.DeleteLabelValues(ip.String())
+	}
+
+	logger.Info("balancer_ip_removed", "ip", ip)
+}
+
+// activeOnly returns the IPs of ips that are in the selection set, reusing ips
+// when all of them are.
+func activeOnly(ips, active []netip.Addr) []netip.Addr {
+	for i, ip := range ips {
+		if slices.Contains(active, ip) {
+			continue
+		}
+		result := slices.Clone(ips[:i])
+		for _, ip := range ips[i+1:] {
+			if slices.Contains(active, ip) {
+				result = append(result, ip)
+			}
+		}
+		return result
+	}
+	return ips
+}
+
+// weightsByAddr keys weights by normalized address, dropping invalid IPs and
+// non-positive weights. Returns nil when no weights are set.
+func weightsByAddr(weights map[string]int) map[netip.Addr]int {
+	if len(weights) == 0 {
+		return nil
+	}
+	byAddr := make(map[netip.Addr]int, len(weights))
+	for ip, w := range weights {
+		if addr, err := netutil.ParseAddr(ip); err == nil && w > 0 {
+			byAddr[addr] = w
+		}
+	}
+	return byAddr
+}
+
+// Start starts the background cleanup goroutine and, with shared state, the
+// history exchange with the peers.
 func (l *LRU) Start() {
 	l.wg.Add(1)
 	go l.cleanupLoop()
+	if l.shared != nil {
+		l.wg.Add(1)
+		go l.syncLoop()
+	}
 }
 
-// Stop stops the background cleanup goroutine.
+// Stop stops the background goroutines.
 func (l *LRU) Stop() {
 	close(l.stopCh)
 	l.wg.Wait()
 }
 
-// cleanupLoop periodically cleans up expired history entries.
+// cleanupLoop periodically cleans up expired history entries and refreshes
+// the history metrics.
 func (l *LRU) cleanupLoop() {
 	defer l.wg.Done()
 
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
+	metricsTicker := time.NewTicker(historyMetricsInterval)
+	defer metricsTicker.Stop()
 
 	for {
 		select {
+		case <-metricsTicker.C:
+			l.updateHistoryMetrics()
 		case <-ticker.C:
 			l.mu.RLock()
 			window := l.historyWindow
@@ -96,10 +223,19 @@ func (l *LRU) cleanupLoop() {
 
 			removedEntries, removedHosts := l.history.Cleanup(window)
 			if removedEntries > 0 || removedHosts > 0 {
-				// Update metrics
-				hosts, entries, _ := l.history.Stats()
-				metrics.HistoryHosts.Set(float64(hosts))
-				metrics.HistoryEntries.Set(float64(entries))
+				l.updateHistoryMetrics()
+			}
+			if l.affinity != nil {
+				l.affinity.Cleanup()
+			}
+			if l.rotation != nil {
+				l.rotation.Cleanup(window)
+			}
+			if l.warmup != nil {
+				l.warmup.Cleanup()
+			}
+			if l.cooldown != nil {
+				l.cooldown.Cleanup()
 			}
 		case <-l.stopCh:
 			return
@@ -107,28 +243,97 @@ func (l *LRU) cleanupLoop() {
 	}
 }
 
+// updateHistoryMetrics sets the history gauges from the current history.
+func (l *LRU) updateHistoryMetrics() {
+	hosts, entries, _ := l.history.Stats()
+	metrics.HistoryHosts.Set(float64(hosts))
+	metrics.HistoryEntries.Set(float64(entries))
+}
+
 // Select returns the best IP to use for the given host.
 // Algorithm:
 // 1. Get history for the host within window and size limits
 // 2. Count usage per IP in the filtered history
 // 3. Exclude IPs that have reached connection limits
 // 4. Select IP with lowest usage count (tie-break by oldest last use)
-func (l *LRU) Select(host string) (string, error) {
+func (l *LRU) Select(host string) (netip.Addr, error) {
+	return l.SelectWithContext(context.Background(), host)
+}
+
+// SelectWithContext returns the best IP to use for the given host.
+// With session affinity enabled, a client that still has an active session
+// keeps its pinned IP as long as that IP is available.
+func (l *LRU) SelectWithContext(ctx context.Context, host string) (netip.Addr, error) {
 	logger.Trace("balancer_select_start", "host", host)
 
+	l.mu.RLock()
+	candidates := l.ips
+	drained := l.drained
+	l.mu.RUnlock()
+
 	// Get available IPs (not at connection limit)
-	availableIPs := l.getAvailableIPs()
+	// Restrict candidates to the pool of the client or, failing that, the
+	// pool routed for this host, if any
+	if pool := PoolFromContext(ctx); pool != "" {
+		ips, _ := l.router.Pool(pool)
+		logger.Trace("balancer_client_pool", "host", host, "pool", pool, "pool_size", len(ips))
+		candidates = activeOnly(ips, candidates)
+	} else if pool, ips, ok := l.router.Match(host); ok {
+		logger.Trace("balancer_route_matched", "host", host, "pool", pool, "pool_size", len(ips))
+		candidates = activeOnly(ips, candidates)
+	}
+	candidates = onlyRequired(candidates, RequiredIPFromContext(ctx))
+	candidates = onlyFamilies(ctx, candidates)
+
+	availableIPs := l.getAvailableIPs(withoutExcluded(withoutExcluded(candidates, drained), ExcludedFromContext(ctx)))
+	if l.limiter != nil {
+		defer l.limiter.ReleaseAvailableIPs(availableIPs)
+	}
 	if len(availableIPs) == 0 {
-		logger.Trace("balancer_no_available_ips", "host", host, "total_ips", len(l.ips))
-		return "", ErrNoAvailableIPs
+		logger.Trace("balancer_no_available_ips", "host", host, "total_ips", len(candidates))
+		return netip.Addr{}, ErrNoAvailableIPs
+	}
+
+	// IPs that hit their per-host use budget sit out the cooldown
+	if l.cooldown != nil {
+		availableIPs = l.cooldown.Filter(host, availableIPs)
 	}
 
+	// Freshly recovered or added IPs only get a growing share of selections
+	if l.warmup != nil {
+		availableIPs = l.warmup.Filter(availableIPs, l.healthySince)
+	}
+
+	// Dual-stack destinations go through the preferred family while it has
+	// an IP available
+	availableIPs = preferFamily(ctx, availableIPs)
+
 	logger.Trace("balancer_available_ips", "host", host, "count", len(availableIPs), "ips", availableIPs)
 
+	client := ClientFromContext(ctx)
+	if l.affinity != nil && client != "" {
+		if ip, ok := l.affinity.Get(client); ok && slices.Contains(availableIPs, ip) {
+			l.affinity.Set(client, ip)
+			logger.Trace("balancer_affinity_hit", "host", host, "client", client, "selected", ip)
+			return ip, nil
+		}
+	}
+
+	// Deterministic rotation replaces the LRU heuristic
+	if l.rotation != nil {
+		selectedIP := l.rotation.Next(host, candidates, availableIPs)
+		logger.Trace("balancer_rotation_selected", "host", host, "selected", selectedIP)
+		if l.affinity != nil && client != "" {
+			l.affinity.Set(client, selectedIP)
+		}
+		return selectedIP, nil
+	}
+
 	// Get history config under lock
 	l.mu.RLock()
 	window := l.historyWindow
 	size := l.historySize
+	weights := l.weights
 	l.mu.RUnlock()
 
 	// Get filtered history for this host
@@ -136,36 +341,47 @@ func (l *LRU) Select(host string) (string, error) {
 	logger.Trace("balancer_history_entries", "host", host, "count", len(entries), "window", window, "max_size", size)
 
 	// Get context from pool to avoid allocations
-	ctx := selectContextPool.Get().(*selectContext)
+	sc := selectContextPool.Get().(*selectContext)
 	defer func() {
 		// Clear maps and return to pool
-		clear(ctx.usageCount)
-		clear(ctx.lastUsed)
-		selectContextPool.Put(ctx)
+		clear(sc.usageCount)
+		clear(sc.lastUsed)
+		selectContextPool.Put(sc)
 	}()
 
 	// Count usage per IP and track last use time
 	for _, e := range entries {
-		ctx.usageCount[e.IP]++
-		if t, exists := ctx.lastUsed[e.IP]; !exists || e.Timestamp.After(t) {
-			ctx.lastUsed[e.IP] = e.Timestamp
+		sc.usageCount[e.Addr]++
+		if t, exists := sc.lastUsed[e.Addr]; !exists || e.Timestamp.After(t) {
+			sc.lastUsed[e.Addr] = e.Timestamp
 		}
 	}
+	// Selections of the other instances count as well
+	if l.shared != nil {
+		l.shared.addUsage(host, sc.usageCount, sc.lastUsed)
+	}
 
-	// Find IP with lowest usage among available IPs
-	var selectedIP string
-	minUsage := math.MaxInt
+	// Find IP with lowest usage per unit of weight among available IPs
+	var selectedIP netip.Addr
+	var minUsage int
+	minWeight := 1
 	var oldestUse time.Time
 
 	for _, ip := range availableIPs {
-		usage := ctx.usageCount[ip]
-		lastUse := ctx.lastUsed[ip]
+		usage := sc.usageCount[ip]
+		lastUse := sc.lastUsed[ip]
+		weight := 1
+		if w, ok := weights[ip]; ok {
+			weight = w
+		}
 
-		if usage < minUsage {
-			minUsage = usage
+		// Compare usage/weight without dividing: usage/weight < minUsage/minWeight
+		load, minLoad := usage*minWeight, minUsage*weight
+		if !selectedIP.IsValid() || load < minLoad {
+			minUsage, minWeight = usage, weight
 			selectedIP = ip
 			oldestUse = lastUse
-		} else if usage == minUsage {
+		} else if load == minLoad {
 			// Tie-break: prefer IP with oldest last use (or never used)
 			if lastUse.IsZero() || lastUse.Before(oldestUse) {
 				selectedIP = ip
@@ -174,36 +390,59 @@ func (l *LRU) Select(host string) (string, error) {
 		}
 	}
 
-	logger.Trace("balancer_selection_complete", "host", host, "selected", selectedIP, "usage_count", minUsage, "usage_counts", ctx.usageCount)
+	logger.Trace("balancer_selection_complete", "host", host, "selected", selectedIP, "usage_count", minUsage, "usage_counts", sc.usageCount)
+
+	if l.affinity != nil && client != "" {
+		l.affinity.Set(client, selectedIP)
+	}
 	return selectedIP, nil
 }
 
+// StartWarmup begins the warm-up ramp for ip, e.g. after adding it at runtime.
+// It is a no-op when warm-up is disabled.
+func (l *LRU) StartWarmup(ip netip.Addr) {
+	if l.warmup != nil {
+		l.warmup.Start(ip)
+		logger.Info("ip_warmup_started", "ip", ip)
+	}
+}
+
 // Record records that an IP was used for a host.
-func (l *LRU) Record(host, ip string) {
+func (l *LRU) Record(host string, ip netip.Addr) {
 	l.history.Record(host, ip)
 
-	// Update metrics
-	hosts, entries, _ := l.history.Stats()
-	metrics.HistoryHosts.Set(float64(hosts))
-	metrics.HistoryEntries.Set(float64(entries))
+	if l.cooldown != nil {
+		l.mu.RLock()
+		window := l.historyWindow
+		size := l.historySize
+		l.mu.RUnlock()
+
+		uses := l.history.Count(host, ip, window, size)
+		if l.cooldown.Observe(host, ip, uses) {
+			metrics.IPCooldowns.WithLabelValues(ip.String()).Inc()
+			logger.Debug("ip_cooldown_started", "host", host, "ip", ip, "uses", uses)
+		}
+	}
 }
 
 // GetStats returns balancer statistics.
 func (l *LRU) GetStats() Stats {
 	hosts, entries, entriesPerIP := l.history.Stats()
-	return Stats{
+	stats := Stats{
 		TotalHosts:   hosts,
 		TotalEntries: entries,
 		EntriesPerIP: entriesPerIP,
 	}
+	if l.shared != nil {
+		stats.PeerEntriesPerIP = l.shared.PerIP()
+	}
+	return stats
 }
 
-// getAvailableIPs returns IPs that are healthy and haven't reached connection limits.
-// Applies health check filter first, then limiter filter.
-// Implements graceful degradation: if all IPs are unhealthy, uses all IPs.
-func (l *LRU) getAvailableIPs() []string {
-	ips := l.ips
-
+// getAvailableIPs returns the given IPs that are healthy and haven't reached connection limits.
+// Applies health check filter first, then circuit breaker, then limiter filter.
+// Implements graceful degradation: if all IPs are unhealthy or open, uses them anyway.
+func (l *LRU) getAvailableIPs(ips []netip.Addr) []netip.Addr {
 	// 1. Filter by health check (if configured)
 	if l.healthChecker != nil {
 		healthyIPs := l.healthChecker.GetHealthyIPs(ips)
@@ -215,7 +454,22 @@ func (l *LRU) getAvailableIPs() []string {
 		}
 	}
 
-	// 2. Filter by limiter (connection limits)
+	// 2. Filter by circuit breaker (if configured)
+	if l.breaker != nil {
+		closed := make([]netip.Addr, 0, len(ips))
+		for _, ip := range ips {
+			if l.breaker.IsHealthy(ip) {
+				closed = append(closed, ip)
+			}
+		}
+		if len(closed) == 0 {
+			logger.Warn("all_circuits_open", "using_all", true, "total_ips", len(ips))
+		} else {
+			ips = closed
+		}
+	}
+
+	// 3. Filter by limiter (connection limits)
 	if l.limiter != nil {
 		return l.limiter.GetAvailableIPs(ips)
 	}
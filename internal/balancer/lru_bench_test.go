@@ -2,13 +2,16 @@ package balancer
 
 import (
 	"fmt"
+	"net/netip"
 	"sync"
 	"testing"
+
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
 )
 
 func BenchmarkLRU_Select(b *testing.B) {
 	cfg := Config{
-		IPs:           []string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4"},
+		IPs:           netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4"}),
 		HistoryWindow: 300,
 		HistorySize:   100,
 		Limiter:       &mockLimiter{},
@@ -27,7 +30,7 @@ func BenchmarkLRU_Select(b *testing.B) {
 
 func BenchmarkLRU_Select_MultipleHosts(b *testing.B) {
 	cfg := Config{
-		IPs:           []string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4"},
+		IPs:           netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4"}),
 		HistoryWindow: 300,
 		HistorySize:   100,
 		Limiter:       &mockLimiter{},
@@ -52,7 +55,7 @@ func BenchmarkLRU_Select_MultipleHosts(b *testing.B) {
 
 func BenchmarkLRU_Select_Parallel(b *testing.B) {
 	cfg := Config{
-		IPs:           []string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4"},
+		IPs:           netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4"}),
 		HistoryWindow: 300,
 		HistorySize:   1000,
 		Limiter:       &mockLimiter{},
@@ -81,7 +84,7 @@ func BenchmarkLRU_Select_Parallel(b *testing.B) {
 
 func BenchmarkLRU_Select_HighContention(b *testing.B) {
 	cfg := Config{
-		IPs:           []string{"192.168.1.1", "192.168.1.2"},
+		IPs:           netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2"}),
 		HistoryWindow: 300,
 		HistorySize:   1000,
 		Limiter:       &mockLimiter{},
@@ -106,7 +109,7 @@ func BenchmarkHistory_Record(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		history.Record("example.com", "192.168.1.1")
+		history.Record("example.com", netip.MustParseAddr("192.168.1.1"))
 	}
 }
 
@@ -120,7 +123,7 @@ func BenchmarkHistory_Record_MultipleHosts(b *testing.B) {
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		host := hosts[i%len(hosts)]
-		history.Record(host, "192.168.1.1")
+		history.Record(host, netip.MustParseAddr("192.168.1.1"))
 	}
 }
 
@@ -136,7 +139,7 @@ func BenchmarkHistory_Record_Parallel(b *testing.B) {
 		i := 0
 		for pb.Next() {
 			host := hosts[i%len(hosts)]
-			history.Record(host, "192.168.1.1")
+			history.Record(host, netip.MustParseAddr("192.168.1.1"))
 			i++
 		}
 	})
@@ -147,7 +150,7 @@ func BenchmarkHistory_GetFiltered(b *testing.B) {
 
 	// Pre-populate with data
 	for i := 0; i < 1000; i++ {
-		history.Record("example.com", "192.168.1.1")
+		history.Record("example.com", netip.MustParseAddr("192.168.1.1"))
 	}
 
 	b.ResetTimer()
@@ -166,17 +169,18 @@ func BenchmarkHistory_WithBounds(b *testing.B) {
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		host := hosts[i%len(hosts)]
-		history.Record(host, "192.168.1.1")
+		history.Record(host, netip.MustParseAddr("192.168.1.1"))
 	}
 }
 
 func BenchmarkSelectContextPool(b *testing.B) {
 	// Test the selectContext pool efficiency
+	addr := netip.MustParseAddr("192.168.1.1")
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
 			ctx := selectContextPool.Get().(*selectContext)
-			ctx.usageCount["test"] = 1
-			ctx.lastUsed["test"] = ctx.lastUsed["test"] // Simulate access
+			ctx.usageCount[addr] = 1
+			ctx.lastUsed[addr] = ctx.lastUsed[addr] // Simulate access
 			clear(ctx.usageCount)
 			clear(ctx.lastUsed)
 			selectContextPool.Put(ctx)
@@ -186,7 +190,7 @@ func BenchmarkSelectContextPool(b *testing.B) {
 
 func BenchmarkLRU_GetAvailableIPs(b *testing.B) {
 	cfg := Config{
-		IPs:           []string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4", "192.168.1.5", "192.168.1.6", "192.168.1.7", "192.168.1.8"},
+		IPs:           netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4", "192.168.1.5", "192.168.1.6", "192.168.1.7", "192.168.1.8"}),
 		HistoryWindow: 300,
 		HistorySize:   100,
 		Limiter:       &mockLimiter{},
@@ -196,13 +200,13 @@ func BenchmarkLRU_GetAvailableIPs(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_ = lru.getAvailableIPs()
+		_ = lru.getAvailableIPs(lru.ips)
 	}
 }
 
 func BenchmarkLRU_GetAvailableIPs_Parallel(b *testing.B) {
 	cfg := Config{
-		IPs:           []string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4", "192.168.1.5", "192.168.1.6", "192.168.1.7", "192.168.1.8"},
+		IPs:           netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4", "192.168.1.5", "192.168.1.6", "192.168.1.7", "192.168.1.8"}),
 		HistoryWindow: 300,
 		HistorySize:   100,
 		Limiter:       &mockLimiter{},
@@ -213,7 +217,7 @@ func BenchmarkLRU_GetAvailableIPs_Parallel(b *testing.B) {
 	b.ResetTimer()
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
-			_ = lru.getAvailableIPs()
+			_ = lru.getAvailableIPs(lru.ips)
 		}
 	})
 }
@@ -221,7 +225,7 @@ func BenchmarkLRU_GetAvailableIPs_Parallel(b *testing.B) {
 // Benchmark to compare allocation patterns
 func BenchmarkLRU_SelectAllocationTest(b *testing.B) {
 	cfg := Config{
-		IPs:           []string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4"},
+		IPs:           netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4"}),
 		HistoryWindow: 300,
 		HistorySize:   100,
 		Limiter:       &mockLimiter{},
@@ -1,14 +1,20 @@
 package balancer
 
 import (
+	"net/netip"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
 )
 
 func TestLRU_StartStop(t *testing.T) {
 	cfg := Config{
-		IPs:           []string{"192.168.1.1"},
+		IPs:           netutil.MustParseAddrs([]string{"192.168.1.1"}),
 		HistoryWindow: 300,
 		HistorySize:   100,
 		Limiter:       &mockLimiter{},
@@ -37,7 +43,7 @@ func TestLRU_StartStop(t *testing.T) {
 
 func TestLRU_Concurrent(t *testing.T) {
 	cfg := Config{
-		IPs:           []string{"192.168.1.1", "192.168.1.2", "192.168.1.3"},
+		IPs:           netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3"}),
 		HistoryWindow: 300,
 		HistorySize:   1000,
 		Limiter:       &mockLimiter{},
@@ -80,7 +86,7 @@ func TestLRU_Concurrent(t *testing.T) {
 
 func TestLRU_CleanupLoop(t *testing.T) {
 	cfg := Config{
-		IPs:           []string{"192.168.1.1"},
+		IPs:           netutil.MustParseAddrs([]string{"192.168.1.1"}),
 		HistoryWindow: 1, // 1 second window
 		HistorySize:   100,
 		Limiter:       &mockLimiter{},
@@ -89,8 +95,8 @@ func TestLRU_CleanupLoop(t *testing.T) {
 	lru := NewLRU(cfg)
 
 	// Add some entries
-	lru.Record("example.com", "192.168.1.1")
-	lru.Record("example.com", "192.168.1.1")
+	lru.Record("example.com", netip.MustParseAddr("192.168.1.1"))
+	lru.Record("example.com", netip.MustParseAddr("192.168.1.1"))
 
 	stats := lru.GetStats()
 	if stats.TotalEntries != 2 {
@@ -111,7 +117,7 @@ func TestLRU_CleanupLoop(t *testing.T) {
 
 func TestLRU_LRUBehavior(t *testing.T) {
 	cfg := Config{
-		IPs:           []string{"192.168.1.1", "192.168.1.2", "192.168.1.3"},
+		IPs:           netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3"}),
 		HistoryWindow: 300,
 		HistorySize:   100,
 		Limiter:       &mockLimiter{},
@@ -147,7 +153,7 @@ func TestLRU_LRUBehavior(t *testing.T) {
 
 func TestLRU_HostIsolation(t *testing.T) {
 	cfg := Config{
-		IPs:           []string{"192.168.1.1", "192.168.1.2"},
+		IPs:           netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2"}),
 		HistoryWindow: 300,
 		HistorySize:   100,
 		Limiter:       &mockLimiter{},
@@ -174,14 +180,14 @@ func TestLRU_HostIsolation(t *testing.T) {
 
 func TestLRU_getAvailableIPs_AllAvailable(t *testing.T) {
 	cfg := Config{
-		IPs:           []string{"192.168.1.1", "192.168.1.2"},
+		IPs:           netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2"}),
 		HistoryWindow: 300,
 		HistorySize:   100,
 		Limiter:       &mockLimiter{},
 	}
 
 	lru := NewLRU(cfg)
-	available := lru.getAvailableIPs()
+	available := lru.getAvailableIPs(lru.ips)
 
 	if len(available) != 2 {
 		t.Errorf("expected 2 available IPs, got %d", len(available))
@@ -190,23 +196,23 @@ func TestLRU_getAvailableIPs_AllAvailable(t *testing.T) {
 
 func TestLRU_getAvailableIPs_SomeUnavailable(t *testing.T) {
 	cfg := Config{
-		IPs:           []string{"192.168.1.1", "192.168.1.2", "192.168.1.3"},
+		IPs:           netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3"}),
 		HistoryWindow: 300,
 		HistorySize:   100,
 		Limiter: &mockLimiter{
-			unavailable: map[string]bool{"192.168.1.2": true},
+			unavailable: map[netip.Addr]bool{netip.MustParseAddr("192.168.1.2"): true},
 		},
 	}
 
 	lru := NewLRU(cfg)
-	available := lru.getAvailableIPs()
+	available := lru.getAvailableIPs(lru.ips)
 
 	if len(available) != 2 {
 		t.Errorf("expected 2 available IPs, got %d", len(available))
 	}
 
 	for _, ip := range available {
-		if ip == "192.168.1.2" {
+		if ip == netip.MustParseAddr("192.168.1.2") {
 			t.Error("192.168.1.2 should not be in available list")
 		}
 	}
@@ -214,14 +220,14 @@ func TestLRU_getAvailableIPs_SomeUnavailable(t *testing.T) {
 
 func TestLRU_getAvailableIPs_NilLimiter(t *testing.T) {
 	cfg := Config{
-		IPs:           []string{"192.168.1.1", "192.168.1.2"},
+		IPs:           netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2"}),
 		HistoryWindow: 300,
 		HistorySize:   100,
 		Limiter:       nil,
 	}
 
 	lru := NewLRU(cfg)
-	available := lru.getAvailableIPs()
+	available := lru.getAvailableIPs(lru.ips)
 
 	if len(available) != 2 {
 		t.Errorf("expected 2 available IPs with nil limiter, got %d", len(available))
@@ -231,7 +237,7 @@ func TestLRU_getAvailableIPs_NilLimiter(t *testing.T) {
 func TestLRU_Select_PoolReuse(t *testing.T) {
 	// Test that the sync.Pool for selectContext is working correctly
 	cfg := Config{
-		IPs:           []string{"192.168.1.1", "192.168.1.2", "192.168.1.3"},
+		IPs:           netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3"}),
 		HistoryWindow: 300,
 		HistorySize:   1000,
 		Limiter:       &mockLimiter{},
@@ -279,3 +285,131 @@ func TestLRU_Select_PoolReuse(t *testing.T) {
 		t.Errorf("expected %d entries, got %d", expectedEntries, stats.TotalEntries)
 	}
 }
+
+func selectCounts(lru *LRU, host string, n int) map[netip.Addr]int {
+	counts := make(map[netip.Addr]int)
+	for i := 0; i < n; i++ {
+		ip, err := lru.Select(host)
+		if err != nil {
+			panic(err)
+		}
+		lru.Record(host, ip)
+		counts[ip]++
+	}
+	return counts
+}
+
+func TestLRU_Weights(t *testing.T) {
+	lru := NewLRU(Config{
+		IPs:           netutil.MustParseAddrs([]string{"10.0.0.1", "10.0.0.2"}),
+		HistoryWindow: 300,
+		HistorySize:   100,
+		Limiter:       &mockLimiter{},
+		Weights:       map[string]int{"10.0.0.1": 3},
+	})
+
+	counts := selectCounts(lru, "example.com", 40)
+	if counts[netip.MustParseAddr("10.0.0.1")] != 30 || counts[netip.MustParseAddr("10.0.0.2")] != 10 {
+		t.Errorf("expected a 30/10 split, got %v", counts)
+	}
+}
+
+func TestLRU_UpdateWeights(t *testing.T) {
+	lru := NewLRU(Config{
+		IPs:           netutil.MustParseAddrs([]string{"10.0.0.1", "10.0.0.2"}),
+		HistoryWindow: 300,
+		HistorySize:   100,
+		Limiter:       &mockLimiter{},
+	})
+
+	counts := selectCounts(lru, "a.example.com", 20)
+	if counts[netip.MustParseAddr("10.0.0.1")] != 10 || counts[netip.MustParseAddr("10.0.0.2")] != 10 {
+		t.Errorf("expected an even split without weights, got %v", counts)
+	}
+
+	lru.UpdateWeights(map[string]int{"10.0.0.2": 4})
+	counts = selectCounts(lru, "b.example.com", 20)
+	if counts[netip.MustParseAddr("10.0.0.1")] != 4 || counts[netip.MustParseAddr("10.0.0.2")] != 16 {
+		t.Errorf("expected a 4/16 split after update, got %v", counts)
+	}
+
+	lru.UpdateWeights(nil)
+	counts = selectCounts(lru, "c.example.com", 20)
+	if counts[netip.MustParseAddr("10.0.0.1")] != 10 || counts[netip.MustParseAddr("10.0.0.2")] != 10 {
+		t.Errorf("expected an even split after clearing weights, got %v", counts)
+	}
+}
+
+func TestWeightsByAddr(t *testing.T) {
+	got := weightsByAddr(map[string]int{"::ffff:10.0.0.1": 2, "bogus": 3, "10.0.0.2": 0})
+	if len(got) != 1 || got[netip.MustParseAddr("10.0.0.1")] != 2 {
+		t.Errorf("unexpected weights: %v", got)
+	}
+	if weightsByAddr(nil) != nil {
+		t.Error("expected nil for no weights")
+	}
+}
+
+func TestLRU_HistoryMetrics(t *testing.T) {
+	lru := NewLRU(Config{
+		IPs:           netutil.MustParseAddrs([]string{"10.0.0.1", "10.0.0.2"}),
+		HistoryWindow: 300,
+		HistorySize:   100,
+		Limiter:       &mockLimiter{},
+	})
+	metrics.HistoryHosts.Set(0)
+	metrics.HistoryEntries.Set(0)
+
+	lru.Record("a.example.com", netip.MustParseAddr("10.0.0.1"))
+	lru.Record("a.example.com", netip.MustParseAddr("10.0.0.2"))
+	lru.Record("b.example.com", netip.MustParseAddr("10.0.0.1"))
+
+	// Record leaves the gauges to the periodic refresh
+	if got := testutil.ToFloat64(metrics.HistoryEntries); got != 0 {
+		t.Errorf("expected gauges untouched by Record, got %v entries", got)
+	}
+
+	lru.updateHistoryMetrics()
+	if got := testutil.ToFloat64(metrics.HistoryHosts); got != 2 {
+		t.Errorf("expected 2 hosts, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.HistoryEntries); got != 3 {
+		t.Errorf("expected 3 entries, got %v", got)
+	}
+}
+
+func TestLRU_AddRemoveIP(t *testing.T) {
+	router, err := NewRouter(map[string][]string{"pool": {"10.0.0.1", "10.0.0.2"}}, []Route{{Host: "routed.example.com", Pool: "pool"}})
+	if err != nil {
+		t.Fatalf("NewRouter() error: %v", err)
+	}
+	lru := NewLRU(Config{
+		IPs:           netutil.MustParseAddrs([]string{"10.0.0.1", "10.0.0.2"}),
+		HistoryWindow: 300,
+		HistorySize:   100,
+		Limiter:       &mockLimiter{},
+		Router:        router,
+	})
+
+	lru.AddIP(netip.MustParseAddr("10.0.0.3"))
+	lru.AddIP(netip.MustParseAddr("10.0.0.3"))
+	counts := selectCounts(lru, "a.example.com", 9)
+	if len(counts) != 3 || counts[netip.MustParseAddr("10.0.0.3")] != 3 {
+		t.Errorf("expected an even split over 3 IPs, got %v", counts)
+	}
+
+	lru.RemoveIP(netip.MustParseAddr("10.0.0.1"))
+	counts = selectCounts(lru, "b.example.com", 6)
+	if counts[netip.MustParseAddr("10.0.0.1")] != 0 {
+		t.Errorf("expected removed IP not to be selected, got %v", counts)
+	}
+	counts = selectCounts(lru, "routed.example.com", 4)
+	if counts[netip.MustParseAddr("10.0.0.2")] != 4 {
+		t.Errorf("expected removed IP to be skipped in its pool, got %v", counts)
+	}
+
+	lru.RemoveIP(netip.MustParseAddr("10.0.0.2"))
+	if _, err := lru.Select("routed.example.com"); err != ErrNoAvailableIPs {
+		t.Errorf("expected ErrNoAvailableIPs for an emptied pool, got %v", err)
+	}
+}
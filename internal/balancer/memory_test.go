@@ -2,6 +2,7 @@ package balancer
 
 import (
 	"fmt"
+	"net/netip"
 	"runtime"
 	"testing"
 	"time"
@@ -26,7 +27,7 @@ func TestHistory_MemoryBounds(t *testing.T) {
 	numHosts := 100000
 	for i := 0; i < numHosts; i++ {
 		host := fmt.Sprintf("host%d.example.com", i)
-		history.Record(host, "192.168.1.1")
+		history.Record(host, netip.MustParseAddr("192.168.1.1"))
 	}
 
 	// Get final memory stats
@@ -65,7 +66,7 @@ func TestHistory_MemoryUnbounded(t *testing.T) {
 	numHosts := 10000
 	for i := 0; i < numHosts; i++ {
 		host := fmt.Sprintf("host%d.example.com", i)
-		history.Record(host, "192.168.1.1")
+		history.Record(host, netip.MustParseAddr("192.168.1.1"))
 	}
 
 	var m2 runtime.MemStats
@@ -90,7 +91,7 @@ func TestHistory_CleanupWithBounds(t *testing.T) {
 
 	// Add entries that will expire
 	for i := 0; i < 50; i++ {
-		history.Record("example.com", "192.168.1.1")
+		history.Record("example.com", netip.MustParseAddr("192.168.1.1"))
 	}
 
 	// Wait for entries to age
@@ -98,7 +99,7 @@ func TestHistory_CleanupWithBounds(t *testing.T) {
 
 	// Add more entries to trigger eviction
 	for i := 0; i < 100; i++ {
-		history.Record(fmt.Sprintf("host%d.com", i), "192.168.1.1")
+		history.Record(fmt.Sprintf("host%d.com", i), netip.MustParseAddr("192.168.1.1"))
 	}
 
 	// Cleanup old entries
@@ -125,13 +126,13 @@ func TestHistory_EvictionOrder(t *testing.T) {
 	// Add entries with distinct timestamps
 	hosts := []string{"first.com", "second.com", "third.com"}
 	for _, host := range hosts {
-		history.Record(host, "192.168.1.1")
+		history.Record(host, netip.MustParseAddr("192.168.1.1"))
 		time.Sleep(10 * time.Millisecond) // Ensure distinct timestamps
 	}
 
 	// Add more entries to force eviction
 	for i := 0; i < 5; i++ {
-		history.Record("new.com", "192.168.1.1")
+		history.Record("new.com", netip.MustParseAddr("192.168.1.1"))
 	}
 
 	// The oldest host (first.com) should have been evicted
@@ -152,7 +153,7 @@ func TestHistory_ConcurrentWithBounds(t *testing.T) {
 		go func(id int) {
 			for j := 0; j < 1000; j++ {
 				host := fmt.Sprintf("host%d-%d.com", id, j)
-				history.Record(host, "192.168.1.1")
+				history.Record(host, netip.MustParseAddr("192.168.1.1"))
 			}
 			done <- true
 		}(i)
@@ -184,7 +185,7 @@ func BenchmarkHistory_RecordWithBounds(b *testing.B) {
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		host := hosts[i%len(hosts)]
-		history.Record(host, "192.168.1.1")
+		history.Record(host, netip.MustParseAddr("192.168.1.1"))
 	}
 }
 
@@ -199,6 +200,6 @@ func BenchmarkHistory_RecordWithBoundsEviction(b *testing.B) {
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		host := hosts[i%len(hosts)]
-		history.Record(host, "192.168.1.1")
+		history.Record(host, netip.MustParseAddr("192.168.1.1"))
 	}
 }
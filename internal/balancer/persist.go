@@ -0,0 +1,178 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/store"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
+)
+
+// stateKey is the store key the balancer state is saved under.
+const stateKey = "balancer:state"
+
+// savedEntry is a history entry as saved to the store.
+type savedEntry struct {
+	IP   string `json:"ip"`
+	Time int64  `json:"t"` // Unix milliseconds
+}
+
+// savedRotation is the rotation state of a host as saved to the store.
+type savedRotation struct {
+	IP       string `json:"ip"`
+	Count    int    `json:"n"`
+	Since    int64  `json:"since"`
+	LastUsed int64  `json:"t"`
+}
+
+// savedState is the balancer state as saved to the store: the selection
+// history per host, oldest first, and the rotation state per host.
+type savedState struct {
+	History  map[string][]savedEntry  `json:"history"`
+	Rotation map[string]savedRotation `json:"rotation,omitempty"`
+}
+
+// export returns the entries of every host, oldest first.
+func (h *History) export() map[string][]savedEntry {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	saved := make(map[string][]savedEntry, len(h.hosts))
+	for host, hh := range h.hosts {
+		hh.mu.RLock()
+		entries := make([]savedEntry, 0, len(hh.entries))
+		for _, e := range hh.entries {
+			entries = append(entries, savedEntry{IP: e.Addr.String(), Time: e.Timestamp.UnixMilli()})
+		}
+		hh.mu.RUnlock()
+		if len(entries) > 0 {
+			saved[host] = entries
+		}
+	}
+	return saved
+}
+
+// restore adds the saved entries of each host that are within window, at
+// most maxSize per host, before the entries recorded since start. Returns the
+// number of entries restored.
+func (h *History) restore(saved map[string][]savedEntry, window time.Duration, maxSize int) int {
+	cutoff := time.Now().Add(-window)
+	restored := 0
+	for host, entries := range saved {
+		var keep []Entry
+		for _, s := range entries {
+			ts := time.UnixMilli(s.Time)
+			addr, err := netutil.ParseAddr(s.IP)
+			if err != nil || !ts.After(cutoff) {
+				continue
+			}
+			keep = append(keep, Entry{Addr: addr, Timestamp: ts})
+		}
+		if len(keep) > maxSize {
+			keep = keep[len(keep)-maxSize:]
+		}
+		if len(keep) == 0 {
+			continue
+		}
+
+		hh := h.GetOrCreate(host)
+		hh.mu.Lock()
+		hh.entries = append(keep, hh.entries...)
+		hh.mu.Unlock()
+		restored += len(keep)
+	}
+
+	if h.maxTotalEntries > 0 {
+		h.mu.Lock()
+		h.totalEntries += restored
+		for h.totalEntries > h.maxTotalEntries {
+			h.evictOldestLocked()
+		}
+		h.mu.Unlock()
+	}
+	return restored
+}
+
+// export returns the rotation state of every host.
+func (r *Rotation) export() map[string]savedRotation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	saved := make(map[string]savedRotation, len(r.hosts))
+	for host, st := range r.hosts {
+		var ip string
+		if st.ip.IsValid() {
+			ip = st.ip.String()
+		}
+		saved[host] = savedRotation{
+			IP:       ip,
+			Count:    st.count,
+			Since:    st.since.UnixMilli(),
+			LastUsed: st.lastUsed.UnixMilli(),
+		}
+	}
+	return saved
+}
+
+// restore sets the saved rotation state of the hosts used within maxIdle
+// that have not been used since start.
+func (r *Rotation) restore(saved map[string]savedRotation, maxIdle time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cutoff := time.Now().Add(-maxIdle)
+	for host, s := range saved {
+		lastUsed := time.UnixMilli(s.LastUsed)
+		if _, ok := r.hosts[host]; ok || lastUsed.Before(cutoff) {
+			continue
+		}
+		var ip netip.Addr
+		if s.IP != "" {
+			addr, err := netutil.ParseAddr(s.IP)
+			if err != nil {
+				continue
+			}
+			ip = addr
+		}
+		r.hosts[host] = &rotationState{
+			ip:       ip,
+			count:    s.Count,
+			since:    time.UnixMilli(s.Since),
+			lastUsed: lastUsed,
+		}
+	}
+}
+
+// SaveState writes the selection history and the rotation state to s.
+func (l *LRU) SaveState(ctx context.Context, s store.Store) error {
+	state := savedState{History: l.history.export()}
+	if l.rotation != nil {
+		state.Rotation = l.rotation.export()
+	}
+	return store.SetJSON(ctx, s, stateKey, state, 0)
+}
+
+// LoadState restores the selection history and the rotation state saved in
+// s, dropping what left the history window since, and returns the number of
+// history entries restored. A store without saved state restores nothing.
+func (l *LRU) LoadState(ctx context.Context, s store.Store) (int, error) {
+	var state savedState
+	if err := store.GetJSON(ctx, s, stateKey, &state); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	l.mu.RLock()
+	window, size := l.historyWindow, l.historySize
+	l.mu.RUnlock()
+	n := l.history.restore(state.History, window, size)
+	if l.rotation != nil {
+		l.rotation.restore(state.Rotation, window)
+	}
+	l.updateHistoryMetrics()
+	return n, nil
+}
@@ -0,0 +1,95 @@
+package balancer
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/store"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
+)
+
+func TestLRU_SaveLoadState(t *testing.T) {
+	ctx := context.Background()
+	st, err := store.NewFile(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{
+		IPs:           netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2"}),
+		HistoryWindow: 300,
+		HistorySize:   100,
+		Limiter:       &mockLimiter{},
+	}
+
+	before := NewLRU(cfg)
+	for range 3 {
+		before.Record("example.com", netip.MustParseAddr("192.168.1.1"))
+	}
+	before.Record("other.com", netip.MustParseAddr("192.168.1.2"))
+	if err := before.SaveState(ctx, st); err != nil {
+		t.Fatalf("SaveState() error: %v", err)
+	}
+
+	after := NewLRU(cfg)
+	n, err := after.LoadState(ctx, st)
+	if err != nil {
+		t.Fatalf("LoadState() error: %v", err)
+	}
+	if n != 4 {
+		t.Errorf("expected 4 restored entries, got %d", n)
+	}
+	if got := after.GetStats(); got.TotalHosts != 2 || got.EntriesPerIP["192.168.1.1"] != 3 {
+		t.Errorf("unexpected stats after restore: %+v", got)
+	}
+	// The restored history keeps steering selections away from the used IP
+	if ip, _ := after.Select("example.com"); ip != netip.MustParseAddr("192.168.1.2") {
+		t.Errorf("expected 192.168.1.2, got %s", ip)
+	}
+
+	// Entries that left the history window are not restored
+	expired := NewLRU(cfg)
+	expired.UpdateHistoryConfig(time.Nanosecond, 100)
+	if n, _ := expired.LoadState(ctx, st); n != 0 {
+		t.Errorf("expected expired entries to be dropped, got %d", n)
+	}
+
+	// Nothing saved yet restores nothing
+	empty, _ := store.NewFile(t.TempDir())
+	if n, err := NewLRU(cfg).LoadState(ctx, empty); n != 0 || err != nil {
+		t.Errorf("LoadState() on an empty store = %d, %v", n, err)
+	}
+}
+
+func TestLRU_SaveLoadState_Rotation(t *testing.T) {
+	ctx := context.Background()
+	st := store.NewMemory()
+	cfg := Config{
+		IPs:            netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2"}),
+		HistoryWindow:  300,
+		HistorySize:    100,
+		Limiter:        &mockLimiter{},
+		RotationPolicy: RotationEveryN,
+		RotationEvery:  3,
+	}
+
+	before := NewLRU(cfg)
+	first, _ := before.Select("example.com")
+	before.Select("example.com")
+	if err := before.SaveState(ctx, st); err != nil {
+		t.Fatalf("SaveState() error: %v", err)
+	}
+
+	// The restarted balancer uses the IP once more before switching
+	after := NewLRU(cfg)
+	if _, err := after.LoadState(ctx, st); err != nil {
+		t.Fatalf("LoadState() error: %v", err)
+	}
+	if ip, _ := after.Select("example.com"); ip != first {
+		t.Errorf("expected %s for the third request, got %s", first, ip)
+	}
+	if ip, _ := after.Select("example.com"); ip == first {
+		t.Errorf("expected a switch after %d requests, got %s again", cfg.RotationEvery, ip)
+	}
+}
@@ -0,0 +1,118 @@
+// Package balancer provides IP load balancing algorithms.
+package balancer
+
+import (
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+// RotationPolicy selects how IPs are rotated per host.
+type RotationPolicy string
+
+const (
+	// RotationLRU uses the least-recently-used history heuristic (default).
+	RotationLRU RotationPolicy = "lru"
+	// RotationPerRequest switches to the next IP on every request to a host.
+	RotationPerRequest RotationPolicy = "per-request"
+	// RotationEveryN switches to the next IP after N requests to a host.
+	RotationEveryN RotationPolicy = "every-n"
+	// RotationInterval switches to the next IP after a fixed time per host.
+	RotationInterval RotationPolicy = "interval"
+)
+
+// rotationState tracks the current IP for a host.
+type rotationState struct {
+	ip       netip.Addr
+	count    int
+	since    time.Time
+	lastUsed time.Time
+}
+
+// Rotation implements deterministic per-host IP rotation.
+type Rotation struct {
+	policy   RotationPolicy
+	every    int
+	interval time.Duration
+	hosts    map[string]*rotationState
+	mu       sync.Mutex
+}
+
+// NewRotation creates a new Rotation. every is used by RotationEveryN and
+// interval by RotationInterval.
+func NewRotation(policy RotationPolicy, every int, interval time.Duration) *Rotation {
+	if policy == RotationPerRequest {
+		policy, every = RotationEveryN, 1
+	}
+	if every < 1 {
+		every = 1
+	}
+	return &Rotation{
+		policy:   policy,
+		every:    every,
+		interval: interval,
+		hosts:    make(map[string]*rotationState),
+	}
+}
+
+// Next returns the IP to use for host. ips is the configured IP order and
+// available the subset that can currently be used (must not be empty).
+func (r *Rotation) Next(host string, ips, available []netip.Addr) netip.Addr {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	st, ok := r.hosts[host]
+	if !ok {
+		st = &rotationState{}
+		r.hosts[host] = st
+	}
+	st.lastUsed = now
+
+	if st.ip.IsValid() && slices.Contains(available, st.ip) && !r.due(st, now) {
+		st.count++
+		return st.ip
+	}
+
+	st.ip = nextIP(st.ip, ips, available)
+	st.count = 1
+	st.since = now
+	return st.ip
+}
+
+// due reports whether the host should move on to the next IP.
+func (r *Rotation) due(st *rotationState, now time.Time) bool {
+	if r.policy == RotationInterval {
+		return now.Sub(st.since) >= r.interval
+	}
+	return st.count >= r.every
+}
+
+// nextIP returns the first available IP after current in ips order, wrapping around.
+func nextIP(current netip.Addr, ips, available []netip.Addr) netip.Addr {
+	start := slices.Index(ips, current) + 1
+	for i := 0; i < len(ips); i++ {
+		ip := ips[(start+i)%len(ips)]
+		if slices.Contains(available, ip) {
+			return ip
+		}
+	}
+	return available[0]
+}
+
+// Cleanup removes hosts not used within maxIdle and returns how many were removed.
+func (r *Rotation) Cleanup(maxIdle time.Duration) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cutoff := time.Now().Add(-maxIdle)
+	removed := 0
+	for host, st := range r.hosts {
+		if st.lastUsed.Before(cutoff) {
+			delete(r.hosts, host)
+			removed++
+		}
+	}
+	return removed
+}
@@ -0,0 +1,120 @@
+package balancer
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
+)
+
+func TestRotation_PerRequest(t *testing.T) {
+	ips := netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3"})
+	r := NewRotation(RotationPerRequest, 0, 0)
+
+	want := netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.1"})
+	for i, w := range want {
+		if got := r.Next("example.com", ips, ips); got != w {
+			t.Errorf("request %d: expected %s, got %s", i, w, got)
+		}
+	}
+}
+
+func TestRotation_EveryN(t *testing.T) {
+	ips := netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2"})
+	r := NewRotation(RotationEveryN, 3, 0)
+
+	want := netutil.MustParseAddrs([]string{
+		"192.168.1.1", "192.168.1.1", "192.168.1.1",
+		"192.168.1.2", "192.168.1.2", "192.168.1.2",
+		"192.168.1.1",
+	})
+	for i, w := range want {
+		if got := r.Next("example.com", ips, ips); got != w {
+			t.Errorf("request %d: expected %s, got %s", i, w, got)
+		}
+	}
+}
+
+func TestRotation_Interval(t *testing.T) {
+	ips := netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2"})
+	r := NewRotation(RotationInterval, 0, 20*time.Millisecond)
+
+	first := r.Next("example.com", ips, ips)
+	if got := r.Next("example.com", ips, ips); got != first {
+		t.Errorf("expected %s within interval, got %s", first, got)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	if got := r.Next("example.com", ips, ips); got == first {
+		t.Errorf("expected rotation after interval, still on %s", got)
+	}
+}
+
+func TestRotation_PerHost(t *testing.T) {
+	ips := netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2"})
+	r := NewRotation(RotationEveryN, 2, 0)
+
+	r.Next("a.com", ips, ips)
+	r.Next("a.com", ips, ips)
+	if got := r.Next("b.com", ips, ips); got != netip.MustParseAddr("192.168.1.1") {
+		t.Errorf("expected independent rotation for b.com, got %s", got)
+	}
+	if got := r.Next("a.com", ips, ips); got != netip.MustParseAddr("192.168.1.2") {
+		t.Errorf("expected a.com to rotate, got %s", got)
+	}
+}
+
+func TestRotation_SkipsUnavailable(t *testing.T) {
+	ips := netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3"})
+	r := NewRotation(RotationPerRequest, 0, 0)
+
+	r.Next("example.com", ips, ips) // .1
+	available := netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.3"})
+	if got := r.Next("example.com", ips, available); got != netip.MustParseAddr("192.168.1.3") {
+		t.Errorf("expected 192.168.1.3, got %s", got)
+	}
+
+	// Current IP becoming unavailable forces an early switch
+	r = NewRotation(RotationEveryN, 10, 0)
+	r.Next("example.com", ips, ips) // .1
+	if got := r.Next("example.com", ips, netutil.MustParseAddrs([]string{"192.168.1.2"})); got != netip.MustParseAddr("192.168.1.2") {
+		t.Errorf("expected 192.168.1.2, got %s", got)
+	}
+}
+
+func TestRotation_Cleanup(t *testing.T) {
+	ips := netutil.MustParseAddrs([]string{"192.168.1.1"})
+	r := NewRotation(RotationPerRequest, 0, 0)
+	r.Next("example.com", ips, ips)
+
+	time.Sleep(10 * time.Millisecond)
+	if removed := r.Cleanup(5 * time.Millisecond); removed != 1 {
+		t.Errorf("expected 1 removed host, got %d", removed)
+	}
+}
+
+func TestLRUSelect_RotationPolicy(t *testing.T) {
+	cfg := Config{
+		IPs:            netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2"}),
+		HistoryWindow:  300,
+		HistorySize:    100,
+		Limiter:        &mockLimiter{},
+		RotationPolicy: RotationEveryN,
+		RotationEvery:  2,
+	}
+	bal := NewLRU(cfg)
+
+	want := netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.1", "192.168.1.2", "192.168.1.2"})
+	for i, w := range want {
+		ip, err := bal.Select("example.com")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if ip != w {
+			t.Errorf("request %d: expected %s, got %s", i, w, ip)
+		}
+		bal.Record("example.com", ip)
+	}
+}
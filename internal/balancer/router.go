@@ -0,0 +1,101 @@
+// Package balancer provides IP load balancing algorithms.
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
+)
+
+// Route maps destination hosts to a named IP pool.
+// Exactly one of Host (glob) or Regex must be set.
+type Route struct {
+	Host  string
+	Regex string
+	Pool  string
+}
+
+// compiledRoute is a Route with its matcher prepared.
+type compiledRoute struct {
+	host netutil.HostPattern
+	pool string
+}
+
+// Router restricts selection to a pool of IPs based on the destination host.
+type Router struct {
+	pools  map[string][]netip.Addr
+	routes []compiledRoute
+}
+
+// NewRouter creates a Router. Routes are evaluated in order; the first match wins.
+func NewRouter(pools map[string][]string, routes []Route) (*Router, error) {
+	r := &Router{
+		pools:  make(map[string][]netip.Addr, len(pools)),
+		routes: make([]compiledRoute, 0, len(routes)),
+	}
+	for name, ips := range pools {
+		addrs, err := netutil.ParseAddrs(ips)
+		if err != nil {
+			return nil, fmt.Errorf("pool %s: %w", name, err)
+		}
+		r.pools[name] = addrs
+	}
+	for i, route := range routes {
+		if _, ok := pools[route.Pool]; !ok {
+			return nil, fmt.Errorf("route %d: unknown pool %q", i, route.Pool)
+		}
+		host, err := netutil.CompileHostPattern(route.Host, route.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("route %d: %w", i, err)
+		}
+		if host.IsZero() {
+			return nil, fmt.Errorf("route %d: host or regex is required", i)
+		}
+		r.routes = append(r.routes, compiledRoute{host: host, pool: route.Pool})
+	}
+	return r, nil
+}
+
+// Pool returns the IPs of the named pool.
+func (r *Router) Pool(name string) ([]netip.Addr, bool) {
+	if r == nil {
+		return nil, false
+	}
+	ips, ok := r.pools[name]
+	return ips, ok
+}
+
+// poolKey is the context key for the pool a selection is restricted to.
+type poolKey struct{}
+
+// ContextWithPool returns a new context that restricts selection to the named
+// pool, e.g. the pool of the proxy user, regardless of the routes. If the pool
+// is unknown or none of its IPs is available, selection fails with
+// ErrNoAvailableIPs.
+func ContextWithPool(ctx context.Context, pool string) context.Context {
+	return context.WithValue(ctx, poolKey{}, pool)
+}
+
+// PoolFromContext extracts the pool name from the context.
+func PoolFromContext(ctx context.Context) string {
+	pool, _ := ctx.Value(poolKey{}).(string)
+	return pool
+}
+
+// Match returns the pool name and IPs for the given destination (host or host:port).
+// Returns ok=false when no route matches.
+func (r *Router) Match(hostport string) (pool string, ips []netip.Addr, ok bool) {
+	if r == nil || len(r.routes) == 0 {
+		return "", nil, false
+	}
+
+	host := netutil.HostOf(hostport)
+	for _, route := range r.routes {
+		if route.host.Match(host) {
+			return route.pool, r.pools[route.pool], true
+		}
+	}
+	return "", nil, false
+}
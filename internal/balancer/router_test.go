@@ -0,0 +1,145 @@
+package balancer
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
+)
+
+func TestNewRouter_Errors(t *testing.T) {
+	pools := map[string][]string{"dc": {"10.0.0.1"}}
+
+	tests := []struct {
+		name   string
+		routes []Route
+	}{
+		{"unknown pool", []Route{{Host: "*.example.com", Pool: "residential"}}},
+		{"missing matcher", []Route{{Pool: "dc"}}},
+		{"host and regex", []Route{{Host: "a.com", Regex: "a", Pool: "dc"}}},
+		{"invalid regex", []Route{{Regex: "(", Pool: "dc"}}},
+		{"invalid glob", []Route{{Host: "[", Pool: "dc"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewRouter(pools, tt.routes); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestRouter_Match(t *testing.T) {
+	pools := map[string][]string{
+		"residential": {"10.0.0.1", "10.0.0.2"},
+		"datacenter":  {"10.0.1.1"},
+	}
+	router, err := NewRouter(pools, []Route{
+		{Host: "*.shop.example", Pool: "residential"},
+		{Regex: `^api[0-9]+\.example\.com$`, Pool: "datacenter"},
+	})
+	if err != nil {
+		t.Fatalf("NewRouter() error: %v", err)
+	}
+
+	tests := []struct {
+		host     string
+		wantPool string
+		wantOK   bool
+	}{
+		{"www.shop.example:443", "residential", true},
+		{"WWW.Shop.Example", "residential", true},
+		{"api12.example.com:80", "datacenter", true},
+		{"api.example.com", "", false},
+		{"other.com", "", false},
+	}
+
+	for _, tt := range tests {
+		pool, ips, ok := router.Match(tt.host)
+		if ok != tt.wantOK || pool != tt.wantPool {
+			t.Errorf("Match(%q) = %q, %v; want %q, %v", tt.host, pool, ok, tt.wantPool, tt.wantOK)
+		}
+		if ok && len(ips) != len(pools[pool]) {
+			t.Errorf("Match(%q) returned %d IPs, want %d", tt.host, len(ips), len(pools[pool]))
+		}
+	}
+}
+
+func TestRouter_NilMatch(t *testing.T) {
+	var router *Router
+	if _, _, ok := router.Match("example.com"); ok {
+		t.Error("expected nil router to match nothing")
+	}
+}
+
+func TestLRUSelect_Router(t *testing.T) {
+	router, err := NewRouter(map[string][]string{
+		"residential": {"192.168.1.2", "192.168.1.3"},
+	}, []Route{{Host: "*.shop.example", Pool: "residential"}})
+	if err != nil {
+		t.Fatalf("NewRouter() error: %v", err)
+	}
+
+	cfg := Config{
+		IPs:           netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3"}),
+		HistoryWindow: 300,
+		HistorySize:   100,
+		Limiter:       &mockLimiter{},
+		Router:        router,
+	}
+	bal := NewLRU(cfg)
+
+	for i := 0; i < 6; i++ {
+		ip, err := bal.SelectWithContext(context.Background(), "www.shop.example:443")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if ip == netip.MustParseAddr("192.168.1.1") {
+			t.Fatalf("selected IP %s outside of routed pool", ip)
+		}
+		bal.Record("www.shop.example:443", ip)
+	}
+
+	// Unrouted hosts use all IPs
+	seen := make(map[netip.Addr]bool)
+	for i := 0; i < 3; i++ {
+		ip, _ := bal.Select("other.example")
+		bal.Record("other.example", ip)
+		seen[ip] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("expected unrouted host to use all 3 IPs, got %v", seen)
+	}
+}
+
+func TestLRUSelect_ContextPool(t *testing.T) {
+	router, err := NewRouter(map[string][]string{
+		"residential": {"192.168.1.2"},
+		"datacenter":  {"192.168.1.3"},
+	}, []Route{{Host: "*.shop.example", Pool: "residential"}})
+	if err != nil {
+		t.Fatalf("NewRouter() error: %v", err)
+	}
+	bal := NewLRU(Config{
+		IPs:           netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3"}),
+		HistoryWindow: 300,
+		HistorySize:   100,
+		Limiter:       &mockLimiter{},
+		Router:        router,
+	})
+
+	// The client's pool wins over the route of the host
+	ctx := ContextWithPool(context.Background(), "datacenter")
+	for _, host := range []string{"www.shop.example", "other.example"} {
+		ip, err := bal.SelectWithContext(ctx, host)
+		if err != nil || ip != netip.MustParseAddr("192.168.1.3") {
+			t.Errorf("SelectWithContext(%s) = %s, %v, want the datacenter IP", host, ip, err)
+		}
+	}
+
+	if _, err := bal.SelectWithContext(ContextWithPool(context.Background(), "missing"), "other.example"); err != ErrNoAvailableIPs {
+		t.Errorf("unknown pool error = %v, want ErrNoAvailableIPs", err)
+	}
+}
@@ -0,0 +1,233 @@
+package balancer
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/netip"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/logger"
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+	"github.com/cr0hn/outbound-lb/internal/store"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
+)
+
+// sharedStaleAfter is how many sync intervals a snapshot lives in the store,
+// and how long the peer usage is kept when the store cannot be reached.
+const sharedStaleAfter = 3
+
+// sharedUsage is the use of one IP for one host within the history window.
+type sharedUsage struct {
+	Count int   `json:"n"`
+	Last  int64 `json:"t"` // Unix milliseconds of the last use
+}
+
+// sharedSnapshot is the selection history an instance publishes.
+type sharedSnapshot struct {
+	Hosts map[string]map[string]sharedUsage `json:"hosts"`
+}
+
+// peerUsage is the use of one IP for one host summed over the peers.
+type peerUsage struct {
+	count int
+	last  time.Time
+}
+
+// sharedView is the selection history of the peers, merged.
+type sharedView struct {
+	hosts   map[string]map[netip.Addr]peerUsage
+	perIP   map[string]int
+	peers   int
+	updated time.Time
+}
+
+// Shared exchanges the selection history with the other instances of a
+// cluster through a store, so that replicas spread their selections for a
+// host over the IPs together instead of each on its own. Every interval, an
+// instance publishes the usage of its history and reads the usage of its
+// peers, which selections then count on top of the local history. The peer
+// usage is kept in memory, so selections never wait on the store; when the
+// store cannot be reached, it is dropped after a few intervals and
+// selections fall back to the local history.
+type Shared struct {
+	store    store.Store
+	prefix   string
+	id       string
+	interval time.Duration
+	view     atomic.Pointer[sharedView]
+}
+
+// NewShared creates the shared state of an instance. Instances sharing a
+// store and a prefix form a cluster.
+func NewShared(s store.Store, prefix string, interval time.Duration) *Shared {
+	host, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return &Shared{
+		store:    s,
+		prefix:   prefix + ":balancer:",
+		id:       host + "-" + hex.EncodeToString(suffix),
+		interval: interval,
+	}
+}
+
+// Sync publishes the local usage and refreshes the usage of the peers.
+func (s *Shared) Sync(ctx context.Context, local sharedSnapshot) error {
+	if err := store.SetJSON(ctx, s.store, s.prefix+s.id, local, sharedStaleAfter*s.interval); err != nil {
+		return err
+	}
+	keys, err := s.store.Keys(ctx, s.prefix)
+	if err != nil {
+		return err
+	}
+
+	view := &sharedView{
+		hosts:   make(map[string]map[netip.Addr]peerUsage),
+		perIP:   make(map[string]int),
+		updated: time.Now(),
+	}
+	for _, key := range keys {
+		if key == s.prefix+s.id {
+			continue
+		}
+		var peer sharedSnapshot
+		if err := store.GetJSON(ctx, s.store, key, &peer); err != nil {
+			// Expired since listed, or written by an incompatible version
+			logger.Debug("shared_state_peer_skipped", "key", key, "error", err)
+			continue
+		}
+		view.peers++
+		for host, ips := range peer.Hosts {
+			usage := view.hosts[host]
+			if usage == nil {
+				usage = make(map[netip.Addr]peerUsage, len(ips))
+				view.hosts[host] = usage
+			}
+			for ip, u := range ips {
+				addr, err := netutil.ParseAddr(ip)
+				if err != nil {
+					continue
+				}
+				p := usage[addr]
+				p.count += u.Count
+				if last := time.UnixMilli(u.Last); last.After(p.last) {
+					p.last = last
+				}
+				usage[addr] = p
+				view.perIP[addr.String()] += u.Count
+			}
+		}
+	}
+	s.view.Store(view)
+	metrics.SharedStatePeers.Set(float64(view.peers))
+	return nil
+}
+
+// current returns the peer usage, or nil when it is stale.
+func (s *Shared) current() *sharedView {
+	view := s.view.Load()
+	if view == nil || time.Since(view.updated) > sharedStaleAfter*s.interval {
+		return nil
+	}
+	return view
+}
+
+// addUsage adds the peer usage of host to the usage counts and last use
+// times of a selection.
+func (s *Shared) addUsage(host string, count map[netip.Addr]int, last map[netip.Addr]time.Time) {
+	view := s.current()
+	if view == nil {
+		return
+	}
+	for addr, u := range view.hosts[host] {
+		count[addr] += u.count
+		if t, ok := last[addr]; !ok || u.last.After(t) {
+			last[addr] = u.last
+		}
+	}
+}
+
+// PerIP returns the entries of the peers per IP, or nil when the peer usage
+// is stale.
+func (s *Shared) PerIP() map[string]int {
+	if view := s.current(); view != nil {
+		return view.perIP
+	}
+	return nil
+}
+
+// Leave removes the snapshot of this instance so that peers stop counting
+// it right away.
+func (s *Shared) Leave(ctx context.Context) error {
+	return s.store.Delete(ctx, s.prefix+s.id)
+}
+
+// snapshot returns the usage of the history within window, keeping at most
+// maxSize entries per host like selections do.
+func (h *History) snapshot(window time.Duration, maxSize int) sharedSnapshot {
+	h.mu.RLock()
+	hosts := make([]string, 0, len(h.hosts))
+	for host := range h.hosts {
+		hosts = append(hosts, host)
+	}
+	h.mu.RUnlock()
+
+	snap := sharedSnapshot{Hosts: make(map[string]map[string]sharedUsage, len(hosts))}
+	for _, host := range hosts {
+		entries := h.GetFiltered(host, window, maxSize)
+		if len(entries) == 0 {
+			continue
+		}
+		usage := make(map[string]sharedUsage)
+		for _, e := range entries {
+			ip := e.Addr.String()
+			u := usage[ip]
+			u.Count++
+			u.Last = max(u.Last, e.Timestamp.UnixMilli())
+			usage[ip] = u
+		}
+		snap.Hosts[host] = usage
+	}
+	return snap
+}
+
+// syncLoop exchanges the selection history with the peers every interval
+// until the balancer stops, then leaves the cluster.
+func (l *LRU) syncLoop() {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(l.shared.interval)
+	defer ticker.Stop()
+
+	exchange := func() {
+		l.mu.RLock()
+		window := l.historyWindow
+		size := l.historySize
+		l.mu.RUnlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), l.shared.interval)
+		defer cancel()
+		if err := l.shared.Sync(ctx, l.history.snapshot(window, size)); err != nil {
+			metrics.SharedStateErrors.Inc()
+			logger.Warn("shared_state_sync_failed", "error", err)
+		}
+	}
+
+	exchange()
+	for {
+		select {
+		case <-ticker.C:
+			exchange()
+		case <-l.stopCh:
+			ctx, cancel := context.WithTimeout(context.Background(), l.shared.interval)
+			defer cancel()
+			if err := l.shared.Leave(ctx); err != nil {
+				logger.Warn("shared_state_leave_failed", "error", err)
+			}
+			return
+		}
+	}
+}
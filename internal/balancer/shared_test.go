@@ -0,0 +1,108 @@
+package balancer
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/store"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
+)
+
+func sharedLRU(s *Shared) *LRU {
+	return NewLRU(Config{
+		IPs:           netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2"}),
+		HistoryWindow: 300,
+		HistorySize:   100,
+		Limiter:       &mockLimiter{},
+		Shared:        s,
+	})
+}
+
+// syncShared exchanges the history of every instance, then once more so
+// that each one reads the latest snapshot of the others.
+func syncShared(t *testing.T, instances ...*LRU) {
+	t.Helper()
+	for range 2 {
+		for _, l := range instances {
+			if err := l.shared.Sync(context.Background(), l.history.snapshot(l.historyWindow, l.historySize)); err != nil {
+				t.Fatalf("Sync() error: %v", err)
+			}
+		}
+	}
+}
+
+func TestShared_PeerUsageSteersSelection(t *testing.T) {
+	st := store.NewMemory()
+	a := sharedLRU(NewShared(st, "test", time.Minute))
+	b := sharedLRU(NewShared(st, "test", time.Minute))
+
+	// Instance a has used 192.168.1.1 for the host three times
+	for range 3 {
+		a.Record("example.com", netip.MustParseAddr("192.168.1.1"))
+	}
+	syncShared(t, a, b)
+
+	// Instance b has no local history, but picks the IP a used least
+	ip, err := b.Select("example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ip != netip.MustParseAddr("192.168.1.2") {
+		t.Errorf("expected 192.168.1.2, got %s", ip)
+	}
+
+	stats := b.GetStats()
+	if stats.PeerEntriesPerIP["192.168.1.1"] != 3 {
+		t.Errorf("expected 3 peer entries for 192.168.1.1, got %v", stats.PeerEntriesPerIP)
+	}
+	if stats.TotalEntries != 0 {
+		t.Errorf("expected no local entries, got %d", stats.TotalEntries)
+	}
+}
+
+func TestShared_StaleViewFallsBack(t *testing.T) {
+	st := store.NewMemory()
+	a := sharedLRU(NewShared(st, "test", 10*time.Millisecond))
+	b := sharedLRU(NewShared(st, "test", 10*time.Millisecond))
+
+	for range 3 {
+		a.Record("example.com", netip.MustParseAddr("192.168.1.1"))
+	}
+	b.Record("example.com", netip.MustParseAddr("192.168.1.2"))
+	syncShared(t, a, b)
+	if ip, _ := b.Select("example.com"); ip != netip.MustParseAddr("192.168.1.2") {
+		t.Errorf("expected 192.168.1.2 counting the peer usage, got %s", ip)
+	}
+
+	// Without syncs, the peer usage is dropped after a few intervals
+	time.Sleep(sharedStaleAfter*10*time.Millisecond + 10*time.Millisecond)
+	if got := b.shared.PerIP(); got != nil {
+		t.Errorf("expected stale peer usage to be dropped, got %v", got)
+	}
+	if ip, _ := b.Select("example.com"); ip != netip.MustParseAddr("192.168.1.1") {
+		t.Errorf("expected local-only selection of 192.168.1.1, got %s", ip)
+	}
+}
+
+func TestShared_Leave(t *testing.T) {
+	st := store.NewMemory()
+	a := sharedLRU(NewShared(st, "test", time.Minute))
+	b := sharedLRU(NewShared(st, "test", time.Minute))
+	other := sharedLRU(NewShared(st, "other", time.Minute))
+
+	a.Record("example.com", netip.MustParseAddr("192.168.1.1"))
+	syncShared(t, a, b, other)
+	if got := other.shared.PerIP(); len(got) != 0 {
+		t.Errorf("expected no peers across prefixes, got %v", got)
+	}
+
+	if err := a.shared.Leave(context.Background()); err != nil {
+		t.Fatalf("Leave() error: %v", err)
+	}
+	syncShared(t, b)
+	if got := b.shared.PerIP(); len(got) != 0 {
+		t.Errorf("expected no peer usage after leave, got %v", got)
+	}
+}
@@ -0,0 +1,110 @@
+// Package balancer provides IP load balancing algorithms.
+package balancer
+
+import (
+	"math/rand/v2"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// IPRecoveryTracker is implemented by health checkers that know when an IP
+// last recovered, so recovered IPs can be warmed up.
+type IPRecoveryTracker interface {
+	// HealthySince returns when the IP last recovered (zero if it never failed).
+	HealthySince(ip netip.Addr) time.Time
+}
+
+// Warmup ramps the share of selections for freshly recovered or added IPs
+// linearly from zero to full over a fixed period.
+type Warmup struct {
+	period  time.Duration
+	started map[netip.Addr]time.Time
+	mu      sync.RWMutex
+}
+
+// NewWarmup creates a new Warmup with the given ramp period.
+func NewWarmup(period time.Duration) *Warmup {
+	return &Warmup{
+		period:  period,
+		started: make(map[netip.Addr]time.Time),
+	}
+}
+
+// Start begins the warm-up ramp for ip now.
+func (w *Warmup) Start(ip netip.Addr) {
+	w.mu.Lock()
+	w.started[ip] = time.Now()
+	w.mu.Unlock()
+}
+
+// Weight returns the share of traffic ip should receive, from 0 (just started)
+// to 1 (fully warm). since is an additional ramp start (e.g. from the health
+// checker); the most recent start wins.
+func (w *Warmup) Weight(ip netip.Addr, since, now time.Time) float64 {
+	w.mu.RLock()
+	started := w.started[ip]
+	w.mu.RUnlock()
+
+	if since.After(started) {
+		started = since
+	}
+	if started.IsZero() {
+		return 1
+	}
+	elapsed := now.Sub(started)
+	if elapsed >= w.period {
+		return 1
+	}
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(elapsed) / float64(w.period)
+}
+
+// Filter drops warming IPs from available with probability 1-weight, in place.
+// If every IP would be dropped, available is returned unchanged.
+func (w *Warmup) Filter(available []netip.Addr, sinceFn func(netip.Addr) time.Time) []netip.Addr {
+	now := time.Now()
+	keep := make([]bool, len(available))
+	kept := 0
+	for i, ip := range available {
+		var since time.Time
+		if sinceFn != nil {
+			since = sinceFn(ip)
+		}
+		weight := w.Weight(ip, since, now)
+		if weight >= 1 || rand.Float64() < weight {
+			keep[i] = true
+			kept++
+		}
+	}
+	if kept == 0 || kept == len(available) {
+		return available
+	}
+
+	// A new slice: available may be the balancer's own list of IPs
+	out := make([]netip.Addr, 0, kept)
+	for i, ip := range available {
+		if keep[i] {
+			out = append(out, ip)
+		}
+	}
+	return out
+}
+
+// Cleanup removes IPs whose ramp has completed and returns how many were removed.
+func (w *Warmup) Cleanup() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	cutoff := time.Now().Add(-w.period)
+	removed := 0
+	for addr, started := range w.started {
+		if started.Before(cutoff) {
+			delete(w.started, addr)
+			removed++
+		}
+	}
+	return removed
+}
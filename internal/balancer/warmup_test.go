@@ -0,0 +1,101 @@
+package balancer
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
+)
+
+type mockRecoveryTracker struct {
+	since map[netip.Addr]time.Time
+}
+
+func (m *mockRecoveryTracker) IsHealthy(ip netip.Addr) bool { return true }
+
+func (m *mockRecoveryTracker) GetHealthyIPs(ips []netip.Addr) []netip.Addr { return ips }
+
+func (m *mockRecoveryTracker) HealthySince(ip netip.Addr) time.Time { return m.since[ip] }
+
+func TestWarmup_Weight(t *testing.T) {
+	w := NewWarmup(time.Minute)
+	now := time.Now()
+
+	if got := w.Weight(netip.MustParseAddr("192.168.1.1"), time.Time{}, now); got != 1 {
+		t.Errorf("expected weight 1 for IP never warmed up, got %v", got)
+	}
+	if got := w.Weight(netip.MustParseAddr("192.168.1.1"), now.Add(-30*time.Second), now); got != 0.5 {
+		t.Errorf("expected weight 0.5 halfway through ramp, got %v", got)
+	}
+	if got := w.Weight(netip.MustParseAddr("192.168.1.1"), now.Add(-2*time.Minute), now); got != 1 {
+		t.Errorf("expected weight 1 after ramp, got %v", got)
+	}
+
+	w.Start(netip.MustParseAddr("192.168.1.2"))
+	if got := w.Weight(netip.MustParseAddr("192.168.1.2"), time.Time{}, time.Now()); got >= 0.1 {
+		t.Errorf("expected weight near 0 right after Start, got %v", got)
+	}
+}
+
+func TestWarmup_FilterKeepsAtLeastOne(t *testing.T) {
+	w := NewWarmup(time.Hour)
+	w.Start(netip.MustParseAddr("192.168.1.1"))
+	w.Start(netip.MustParseAddr("192.168.1.2"))
+
+	available := []string{"192.168.1.1", "192.168.1.2"}
+	if got := w.Filter(netutil.MustParseAddrs(available), nil); len(got) != 2 {
+		t.Errorf("expected all IPs kept when every IP is cold, got %v", got)
+	}
+}
+
+func TestWarmup_FilterCopies(t *testing.T) {
+	w := NewWarmup(time.Hour)
+	w.Start(netip.MustParseAddr("192.168.1.1"))
+
+	available := netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2"})
+	got := w.Filter(available, nil)
+	if len(got) != 1 || got[0] != netip.MustParseAddr("192.168.1.2") {
+		t.Errorf("expected only 192.168.1.2, got %v", got)
+	}
+	if available[0] != netip.MustParseAddr("192.168.1.1") {
+		t.Errorf("Filter() modified its input: %v", available)
+	}
+}
+
+func TestLRUSelect_WarmupAfterRecovery(t *testing.T) {
+	tracker := &mockRecoveryTracker{since: map[netip.Addr]time.Time{
+		netip.MustParseAddr("192.168.1.2"): time.Now(),
+	}}
+	cfg := Config{
+		IPs:           netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2"}),
+		HistoryWindow: 300,
+		HistorySize:   100,
+		Limiter:       &mockLimiter{},
+		HealthChecker: tracker,
+		WarmupPeriod:  time.Hour,
+	}
+	bal := NewLRU(cfg)
+
+	warming := 0
+	for i := 0; i < 100; i++ {
+		ip, err := bal.Select("example.com")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if ip == netip.MustParseAddr("192.168.1.2") {
+			warming++
+		}
+		bal.Record("example.com", ip)
+	}
+	if warming > 5 {
+		t.Errorf("expected recovering IP to get almost no traffic, got %d/100", warming)
+	}
+
+	// Once the ramp is over, traffic is balanced again
+	tracker.since[netip.MustParseAddr("192.168.1.2")] = time.Now().Add(-2 * time.Hour)
+	ip, _ := bal.Select("example.com")
+	if ip != netip.MustParseAddr("192.168.1.2") {
+		t.Errorf("expected least used IP 192.168.1.2 after warm-up, got %s", ip)
+	}
+}
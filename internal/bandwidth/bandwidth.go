@@ -0,0 +1,235 @@
+// Package bandwidth caps byte rates with token buckets and measures the
+// throughput of users and outbound IPs.
+package bandwidth
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Bucket is a token bucket of bytes refilled at a fixed rate, holding up to
+// one second's worth.
+type Bucket struct {
+	rate     float64 // bytes per second
+	tokens   float64
+	refilled time.Time
+	mu       sync.Mutex
+	now      func() time.Time
+}
+
+// NewBucket creates a full Bucket refilled at rate bytes per second.
+func NewBucket(rate int64) *Bucket {
+	return newBucket(rate, time.Now)
+}
+
+func newBucket(rate int64, now func() time.Time) *Bucket {
+	return &Bucket{rate: float64(rate), tokens: float64(rate), refilled: now(), now: now}
+}
+
+// Reserve takes n bytes from the bucket, going into debt if it holds fewer,
+// and returns how long to wait until the debt is repaid.
+func (b *Bucket) Reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.refilled).Seconds()*b.rate)
+	b.refilled = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Limits are the byte rates, in bytes per second and counting both
+// directions, of each scope. Zero values are unlimited.
+type Limits struct {
+	// PerTunnel caps each tunnel or HTTP response.
+	PerTunnel int64
+	// PerUser caps all traffic of an authenticated user.
+	PerUser int64
+	// PerIP caps all traffic through an outbound IP.
+	PerIP int64
+}
+
+// meter is the shared bucket and byte count of a user or outbound IP.
+type meter struct {
+	bucket *Bucket // nil when unlimited
+	bytes  atomic.Int64
+}
+
+// Limiter hands out throttles sharing per-user and per-IP buckets, and
+// measures the throughput of each user and IP.
+type Limiter struct {
+	limits  Limits
+	users   map[string]*meter
+	ips     map[string]*meter
+	sampled time.Time
+	mu      sync.Mutex
+	now     func() time.Time
+	sleep   func(time.Duration)
+	stopCh  chan struct{}
+	wg      sync.WaitGroup
+}
+
+// New creates a Limiter enforcing limits.
+func New(limits Limits) *Limiter {
+	return &Limiter{
+		limits:  limits,
+		users:   make(map[string]*meter),
+		ips:     make(map[string]*meter),
+		sampled: time.Now(),
+		now:     time.Now,
+		sleep:   time.Sleep,
+		stopCh:  make(chan struct{}),
+	}
+}
+
+// Throttle returns the throttle of one tunnel or HTTP response of user
+// (empty if anonymous) through ip. A nil Limiter returns a nil Throttle.
+func (l *Limiter) Throttle(user, ip string) *Throttle {
+	if l == nil {
+		return nil
+	}
+	t := &Throttle{sleep: l.sleep}
+	if l.limits.PerTunnel > 0 {
+		t.buckets = append(t.buckets, newBucket(l.limits.PerTunnel, l.now))
+	}
+
+	l.mu.Lock()
+	t.meters = append(t.meters, l.meter(l.ips, ip, l.limits.PerIP))
+	if user != "" {
+		t.meters = append(t.meters, l.meter(l.users, user, l.limits.PerUser))
+	}
+	l.mu.Unlock()
+
+	for _, m := range t.meters {
+		if m.bucket != nil {
+			t.buckets = append(t.buckets, m.bucket)
+		}
+	}
+	return t
+}
+
+// meter returns the meter of key in meters, creating it with a bucket of rate
+// if missing. l.mu must be held.
+func (l *Limiter) meter(meters map[string]*meter, key string, rate int64) *meter {
+	m, ok := meters[key]
+	if !ok {
+		m = &meter{}
+		if rate > 0 {
+			m.bucket = newBucket(rate, l.now)
+		}
+		meters[key] = m
+	}
+	return m
+}
+
+// Sample returns the throughput of each user and IP seen so far, in bytes
+// per second since the previous sample.
+func (l *Limiter) Sample() (users, ips map[string]float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	elapsed := now.Sub(l.sampled).Seconds()
+	l.sampled = now
+	rates := func(meters map[string]*meter) map[string]float64 {
+		result := make(map[string]float64, len(meters))
+		for key, m := range meters {
+			bytes := m.bytes.Swap(0)
+			if elapsed > 0 {
+				result[key] = float64(bytes) / elapsed
+			}
+		}
+		return result
+	}
+	return rates(l.users), rates(l.ips)
+}
+
+// Start samples the throughput every interval in the background, passing it
+// to report.
+func (l *Limiter) Start(interval time.Duration, report func(users, ips map[string]float64)) {
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				report(l.Sample())
+			case <-l.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the background sampling.
+func (l *Limiter) Stop() {
+	close(l.stopCh)
+	l.wg.Wait()
+}
+
+// Throttle paces the bytes of one tunnel or HTTP response against its own
+// bucket and the buckets of its user and outbound IP.
+type Throttle struct {
+	buckets []*Bucket
+	meters  []*meter
+	sleep   func(time.Duration)
+}
+
+// Wait counts n transferred bytes and blocks until every bucket allows them.
+// A nil Throttle does nothing.
+func (t *Throttle) Wait(n int) {
+	if t == nil {
+		return
+	}
+	for _, m := range t.meters {
+		m.bytes.Add(int64(n))
+	}
+	var delay time.Duration
+	for _, b := range t.buckets {
+		delay = max(delay, b.Reserve(n))
+	}
+	if delay > 0 {
+		t.sleep(delay)
+	}
+}
+
+// Chunk returns size, lowered to the smallest rate of the buckets so that a
+// transfer of that many bytes waits about a second at most.
+func (t *Throttle) Chunk(size int) int {
+	if t == nil {
+		return size
+	}
+	for _, b := range t.buckets {
+		size = min(size, max(int(b.rate), 1))
+	}
+	return size
+}
+
+// Reader returns r with its reads paced by t.
+func (t *Throttle) Reader(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &throttledReader{r: r, t: t}
+}
+
+type throttledReader struct {
+	r io.Reader
+	t *Throttle
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	n, err := tr.r.Read(p[:tr.t.Chunk(len(p))])
+	if n > 0 {
+		tr.t.Wait(n)
+	}
+	return n, err
+}
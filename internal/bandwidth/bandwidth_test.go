@@ -0,0 +1,117 @@
+package bandwidth
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBucket_Reserve(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	b := newBucket(1000, func() time.Time { return now })
+
+	// A full bucket lets a second's worth through at once
+	if d := b.Reserve(1000); d != 0 {
+		t.Errorf("Reserve(1000) on a full bucket = %v, want 0", d)
+	}
+	if d := b.Reserve(500); d != 500*time.Millisecond {
+		t.Errorf("Reserve(500) on an empty bucket = %v, want 500ms", d)
+	}
+
+	// The debt is repaid at the rate, and the bucket never holds more than a
+	// second's worth
+	now = now.Add(10 * time.Second)
+	if d := b.Reserve(1000); d != 0 {
+		t.Errorf("Reserve(1000) after a pause = %v, want 0", d)
+	}
+	if d := b.Reserve(100); d != 100*time.Millisecond {
+		t.Errorf("Reserve(100) = %v, want 100ms", d)
+	}
+}
+
+func TestLimiter_Throttle(t *testing.T) {
+	l := New(Limits{PerTunnel: 1000, PerUser: 2000, PerIP: 4000})
+	now := time.Unix(1700000000, 0)
+	l.now = func() time.Time { return now }
+	var slept time.Duration
+	l.sleep = func(d time.Duration) { slept += d }
+
+	alice := l.Throttle("alice", "10.0.0.1")
+	if len(alice.buckets) != 3 {
+		t.Fatalf("buckets = %d, want tunnel, IP and user", len(alice.buckets))
+	}
+	// Anonymous clients have no user bucket
+	if anon := l.Throttle("", "10.0.0.1"); len(anon.buckets) != 2 {
+		t.Errorf("anonymous buckets = %d, want 2", len(anon.buckets))
+	}
+
+	// The tunnel bucket is the tightest
+	alice.Wait(1500)
+	if slept != 500*time.Millisecond {
+		t.Errorf("slept %v, want 500ms", slept)
+	}
+
+	// A second tunnel of alice shares her user bucket, holding 500 bytes
+	slept = 0
+	l.Throttle("alice", "10.0.0.2").Wait(1000)
+	if slept != 250*time.Millisecond {
+		t.Errorf("second tunnel slept %v, want 250ms", slept)
+	}
+
+	if got := alice.Chunk(32 * 1024); got != 1000 {
+		t.Errorf("Chunk() = %d, want 1000", got)
+	}
+}
+
+func TestLimiter_Sample(t *testing.T) {
+	l := New(Limits{})
+	now := time.Unix(1700000000, 0)
+	l.now = func() time.Time { return now }
+	l.sampled = now
+
+	throttle := l.Throttle("alice", "10.0.0.1")
+	if len(throttle.buckets) != 0 {
+		t.Fatalf("buckets = %d without limits, want 0", len(throttle.buckets))
+	}
+	throttle.Wait(3000)
+	l.Throttle("", "10.0.0.2").Wait(1000)
+
+	now = now.Add(2 * time.Second)
+	users, ips := l.Sample()
+	if users["alice"] != 1500 || ips["10.0.0.1"] != 1500 || ips["10.0.0.2"] != 500 {
+		t.Errorf("Sample() = %v, %v", users, ips)
+	}
+
+	// Idle users and IPs drop to zero
+	now = now.Add(2 * time.Second)
+	users, ips = l.Sample()
+	if rate, ok := users["alice"]; !ok || rate != 0 {
+		t.Errorf("idle user rate = %v, %v, want 0", rate, ok)
+	}
+	if ips["10.0.0.1"] != 0 {
+		t.Errorf("idle IP rate = %v, want 0", ips["10.0.0.1"])
+	}
+}
+
+func TestThrottle_Reader(t *testing.T) {
+	l := New(Limits{PerTunnel: 10})
+	var waits int
+	l.sleep = func(time.Duration) { waits++ }
+
+	var out bytes.Buffer
+	n, err := io.Copy(&out, l.Throttle("", "10.0.0.1").Reader(strings.NewReader(strings.Repeat("x", 35))))
+	if err != nil || n != 35 {
+		t.Fatalf("Copy() = %d, %v", n, err)
+	}
+	// Reads are cut to the rate, and only the first fits in the full bucket
+	if waits != 3 {
+		t.Errorf("waits = %d, want 3", waits)
+	}
+
+	var nilThrottle *Throttle
+	if r := strings.NewReader(""); nilThrottle.Reader(r) != r {
+		t.Error("nil Throttle wrapped the reader")
+	}
+}
@@ -0,0 +1,97 @@
+package config
+
+import (
+	"net/url"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// redacted replaces secrets in Redacted.
+const redacted = "REDACTED"
+
+// MarshalYAML encodes the configuration. Entries of ips with options are
+// written as mappings, so that the output can be loaded again.
+func (c Config) MarshalYAML() (any, error) {
+	type plain Config
+	var node yaml.Node
+	if err := node.Encode((*plain)(&c)); err != nil {
+		return nil, err
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value != "ips" {
+			continue
+		}
+		for j, item := range node.Content[i+1].Content {
+			opts, ok := c.IPOptions[item.Value]
+			if !ok {
+				continue
+			}
+			var entry yaml.Node
+			if err := entry.Encode(ipEntry{Addr: item.Value, IPOptions: opts}); err != nil {
+				return nil, err
+			}
+			node.Content[i+1].Content[j] = &entry
+		}
+	}
+	return &node, nil
+}
+
+// Redacted returns a copy of the configuration with passwords, secrets and
+// tokens replaced, for display.
+func (c *Config) Redacted() *Config {
+	r := *c
+	if r.Auth != "" {
+		r.Auth = redactCredentials(r.Auth)
+	}
+	if r.MetricsAuth != "" {
+		r.MetricsAuth = redactCredentials(r.MetricsAuth)
+	}
+	if r.AuthHMACSecret != "" {
+		r.AuthHMACSecret = redacted
+	}
+	if r.RegistryToken != "" {
+		r.RegistryToken = redacted
+	}
+	if r.ClusterSecret != "" {
+		r.ClusterSecret = redacted
+	}
+	r.PushgatewayURL = redactURL(r.PushgatewayURL, false)
+	r.RemoteWriteURL = redactURL(r.RemoteWriteURL, false)
+	r.RegistryURL = redactURL(r.RegistryURL, false)
+	r.RegistryAdvertiseURL = redactURL(r.RegistryAdvertiseURL, false)
+	r.SharedStateURL = redactURL(r.SharedStateURL, false)
+	// Webhook URLs such as Slack's carry their secret in the path
+	r.WebhookURLs = make([]string, len(c.WebhookURLs))
+	for i, u := range c.WebhookURLs {
+		r.WebhookURLs[i] = redactURL(u, true)
+	}
+	return &r
+}
+
+// redactCredentials replaces the password of "user:password" credentials.
+func redactCredentials(creds string) string {
+	if user, _, ok := strings.Cut(creds, ":"); ok {
+		return user + ":" + redacted
+	}
+	return redacted
+}
+
+// redactURL replaces the password of rawURL and, with path set, its path and
+// query.
+func redactURL(rawURL string, path bool) string {
+	if rawURL == "" {
+		return ""
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return redacted
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	}
+	if path && (u.Path != "" || u.RawQuery != "") {
+		u.Path, u.RawPath, u.RawQuery = "/"+redacted, "", ""
+	}
+	return u.String()
+}
@@ -0,0 +1,412 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/logger"
+)
+
+const (
+	// sourceTimeout bounds a single request to a configuration source.
+	sourceTimeout = 10 * time.Second
+	// sourceWait is how long a Consul blocking query waits for a change.
+	sourceWait = 5 * time.Minute
+)
+
+// sourceRetryDelay is the wait before a failed watch is retried.
+var sourceRetryDelay = 5 * time.Second
+
+// errKeyNotFound is returned when the configuration key does not exist.
+var errKeyNotFound = errors.New("key not found")
+
+// Source is a key-value store holding the configuration as YAML under a
+// key, so that a fleet of instances can be configured centrally.
+type Source interface {
+	// Fetch returns the configuration.
+	Fetch(ctx context.Context) ([]byte, error)
+	// Watch calls changed each time the configuration changes, until ctx
+	// is done. Failed requests are logged and retried.
+	Watch(ctx context.Context, changed func())
+	// String returns the URL of the configuration without credentials.
+	String() string
+}
+
+// NewSource returns the Source of a configuration URL:
+//
+//	consul://host:8500/path/to/key[?dc=...]
+//	etcd://[user@]host:2379/path/to/key
+//
+// The "+https" scheme suffix (consul+https, etcd+https) uses HTTPS. The
+// Consul token, or the password of the etcd user, is read from tokenFile if
+// set, or else from the CONSUL_HTTP_TOKEN or ETCDCTL_PASSWORD environment
+// variable. Neither is accepted in the URL, which shows up in process
+// listings.
+func NewSource(rawURL, tokenFile string) (Source, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		// Not the *url.Error itself: it quotes the URL with its credentials
+		return nil, fmt.Errorf("invalid config url: %w", errors.Unwrap(err))
+	}
+
+	// Credentials are left out of logs and errors
+	display := *u
+	display.User = nil
+
+	kind, secure := strings.CutSuffix(u.Scheme, "+https")
+	scheme := "http"
+	if secure {
+		scheme = "https"
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || key == "" {
+		return nil, fmt.Errorf("invalid config url %q: host and key are required", display.String())
+	}
+
+	base := scheme + "://" + u.Host
+	client := &http.Client{}
+	switch kind {
+	case "consul":
+		if u.Query().Has("token") {
+			return nil, errors.New("invalid config url: the Consul token goes in CONSUL_HTTP_TOKEN or config-url-token-file, not in the url")
+		}
+		token := os.Getenv("CONSUL_HTTP_TOKEN")
+		if tokenFile != "" {
+			if token, err = ReadSecretFile(tokenFile); err != nil {
+				return nil, fmt.Errorf("invalid config url token file: %w", err)
+			}
+		}
+		return &consulSource{
+			base:    base,
+			key:     key,
+			token:   token,
+			dc:      u.Query().Get("dc"),
+			client:  client,
+			display: display.String(),
+		}, nil
+	case "etcd":
+		if _, ok := u.User.Password(); ok {
+			return nil, errors.New("invalid config url: the etcd password goes in ETCDCTL_PASSWORD or config-url-token-file, not in the url")
+		}
+		s := &etcdSource{base: base, key: "/" + key, client: client, display: display.String()}
+		if u.User != nil {
+			s.user = u.User.Username()
+			s.password = os.Getenv("ETCDCTL_PASSWORD")
+			if tokenFile != "" {
+				if s.password, err = ReadSecretFile(tokenFile); err != nil {
+					return nil, fmt.Errorf("invalid config url token file: %w", err)
+				}
+			}
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("invalid config url %q: scheme must be consul or etcd", display.String())
+	}
+}
+
+// LoadFromURL loads configuration from the key-value store of a
+// configuration URL (see NewSource).
+func LoadFromURL(rawURL, tokenFile string) (*Config, error) {
+	src, err := NewSource(rawURL, tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sourceTimeout)
+	defer cancel()
+	data, err := src.Fetch(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", src, err)
+	}
+	return parseConfig(data)
+}
+
+// sleepContext waits for d, reporting false if ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// consulSource reads the configuration from the Consul KV store, watching
+// it with blocking queries.
+type consulSource struct {
+	base    string
+	key     string
+	token   string
+	dc      string
+	client  *http.Client
+	display string
+}
+
+func (s *consulSource) String() string { return s.display }
+
+func (s *consulSource) Fetch(ctx context.Context) ([]byte, error) {
+	data, _, err := s.get(ctx, 0)
+	return data, err
+}
+
+func (s *consulSource) Watch(ctx context.Context, changed func()) {
+	var index uint64
+	for {
+		_, next, err := s.get(ctx, index)
+		if ctx.Err() != nil {
+			return
+		}
+		// A deleted key is a change too; the reload reports the error
+		if err != nil && !errors.Is(err, errKeyNotFound) {
+			logger.Warn("config_source_error", "source", s.display, "error", err)
+			if !sleepContext(ctx, sourceRetryDelay) {
+				return
+			}
+			continue
+		}
+		// The first query only learns the index of the loaded configuration
+		if index != 0 && next != index {
+			changed()
+		}
+		// Consul resets indexes that go backwards and requires them positive
+		index = max(next, 1)
+	}
+}
+
+// get reads the key, blocking until its index passes index when index is
+// set, and returns the value with its index.
+func (s *consulSource) get(ctx context.Context, index uint64) ([]byte, uint64, error) {
+	query := url.Values{"raw": {""}}
+	if s.dc != "" {
+		query.Set("dc", s.dc)
+	}
+	timeout := sourceTimeout
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", strconv.Itoa(int(sourceWait.Seconds()))+"s")
+		// Consul adds up to wait/16 of jitter
+		timeout += sourceWait + sourceWait/16
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.base+"/v1/kv/"+s.key+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if s.token != "" {
+		req.Header.Set("X-Consul-Token", s.token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	next, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		data, err := io.ReadAll(resp.Body)
+		return data, next, err
+	case http.StatusNotFound:
+		return nil, next, errKeyNotFound
+	default:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, 0, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+}
+
+// etcdSource reads the configuration from etcd through its v3 JSON gateway,
+// watching it with a watch stream.
+type etcdSource struct {
+	base     string
+	key      string
+	user     string
+	password string
+	client   *http.Client
+	display  string
+}
+
+// The JSON gateway encodes bytes as base64 and 64-bit integers as strings.
+type etcdHeader struct {
+	Revision int64 `json:"revision,string"`
+}
+
+type etcdRangeResponse struct {
+	Header etcdHeader `json:"header"`
+	KVs    []struct {
+		Value []byte `json:"value"`
+	} `json:"kvs"`
+}
+
+type etcdWatchResponse struct {
+	Result struct {
+		Header          etcdHeader `json:"header"`
+		Canceled        bool       `json:"canceled"`
+		CancelReason    string     `json:"cancel_reason"`
+		CompactRevision int64      `json:"compact_revision,string"`
+		Events          []struct {
+			Type string `json:"type"`
+		} `json:"events"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (s *etcdSource) String() string { return s.display }
+
+func (s *etcdSource) Fetch(ctx context.Context) ([]byte, error) {
+	r, err := s.rangeKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.KVs) == 0 {
+		return nil, errKeyNotFound
+	}
+	return r.KVs[0].Value, nil
+}
+
+func (s *etcdSource) Watch(ctx context.Context, changed func()) {
+	// Revision of the last change seen; the stream resumes after it
+	var revision int64
+	for {
+		var err error
+		if revision == 0 {
+			var r *etcdRangeResponse
+			if r, err = s.rangeKey(ctx); err == nil {
+				revision = r.Header.Revision
+			}
+		}
+		if err == nil {
+			err = s.watch(ctx, revision+1, func(rev int64) {
+				revision = rev
+				changed()
+			})
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Warn("config_source_error", "source", s.display, "error", err)
+		if !sleepContext(ctx, sourceRetryDelay) {
+			return
+		}
+	}
+}
+
+// rangeKey reads the key.
+func (s *etcdSource) rangeKey(ctx context.Context) (*etcdRangeResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, sourceTimeout)
+	defer cancel()
+	resp, err := s.post(ctx, "/v3/kv/range", map[string]any{"key": []byte(s.key)})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var r etcdRangeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// watch streams the changes of the key from the start revision, calling
+// changed with the revision of each, until the stream ends.
+func (s *etcdSource) watch(ctx context.Context, start int64, changed func(rev int64)) error {
+	resp, err := s.post(ctx, "/v3/watch", map[string]any{
+		"create_request": map[string]any{"key": []byte(s.key), "start_revision": start},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var r etcdWatchResponse
+		if err := dec.Decode(&r); err != nil {
+			if err == io.EOF {
+				return errors.New("watch stream closed")
+			}
+			return err
+		}
+		if r.Error != nil {
+			return errors.New(r.Error.Message)
+		}
+		if r.Result.Canceled {
+			if r.Result.CompactRevision > 0 {
+				// Changes since start were compacted away; reload the
+				// current configuration and resume from it
+				changed(r.Result.Header.Revision)
+			}
+			return fmt.Errorf("watch canceled: %s", r.Result.CancelReason)
+		}
+		if len(r.Result.Events) > 0 {
+			changed(r.Result.Header.Revision)
+		}
+	}
+}
+
+// post sends a JSON gateway request, authenticating first when credentials
+// are set, and fails on error statuses.
+func (s *etcdSource) post(ctx context.Context, path string, body any) (*http.Response, error) {
+	var token string
+	if s.user != "" {
+		resp, err := s.do(ctx, "/v3/auth/authenticate", map[string]string{"name": s.user, "password": s.password}, "")
+		if err != nil {
+			return nil, fmt.Errorf("authenticating: %w", err)
+		}
+		var auth struct {
+			Token string `json:"token"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&auth)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("authenticating: %w", err)
+		}
+		token = auth.Token
+	}
+	return s.do(ctx, path, body, token)
+}
+
+// do sends a single JSON gateway request.
+func (s *etcdSource) do(ctx context.Context, path string, body any, token string) (*http.Response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.base+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var e struct {
+			Message string `json:"message"`
+		}
+		if json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&e) == nil && e.Message != "" {
+			return nil, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, e.Message)
+		}
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp, nil
+}
@@ -2,6 +2,13 @@
 package config
 
 import (
+	"context"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -9,16 +16,24 @@ import (
 	"github.com/fsnotify/fsnotify"
 
 	"github.com/cr0hn/outbound-lb/internal/logger"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
 )
 
-// ConfigWatcher watches a configuration file for changes and notifies callbacks.
+// ConfigWatcher watches a configuration file, or a remote configuration
+// source, for changes and notifies callbacks.
 type ConfigWatcher struct {
 	path      string
+	source    Source
 	current   atomic.Value // *Config
 	watcher   *fsnotify.Watcher
 	callbacks []func(*Config)
 	stopCh    chan struct{}
 	mu        sync.RWMutex
+
+	// Listener TLS files, the credentials and API keys files and the secret
+	// files also trigger a reload when they change
+	files       []string
+	watchedDirs map[string]bool
 }
 
 // NewConfigWatcher creates a new ConfigWatcher for the given config file path.
@@ -29,26 +44,49 @@ func NewConfigWatcher(path string, initial *Config) (*ConfigWatcher, error) {
 	}
 
 	cw := &ConfigWatcher{
-		path:    path,
-		watcher: watcher,
-		stopCh:  make(chan struct{}),
+		path:        path,
+		watcher:     watcher,
+		stopCh:      make(chan struct{}),
+		watchedDirs: make(map[string]bool),
 	}
 	cw.current.Store(initial)
 
 	return cw, nil
 }
 
-// Start begins watching the configuration file for changes.
+// NewRemoteConfigWatcher creates a new ConfigWatcher for a remote
+// configuration source.
+func NewRemoteConfigWatcher(source Source, initial *Config) (*ConfigWatcher, error) {
+	cw, err := NewConfigWatcher("", initial)
+	if err != nil {
+		return nil, err
+	}
+	cw.source = source
+	return cw, nil
+}
+
+// Start begins watching the configuration for changes.
 func (w *ConfigWatcher) Start() error {
-	if err := w.watcher.Add(w.path); err != nil {
+	if w.source != nil {
+		go w.watchSource()
+	} else if err := w.watcher.Add(w.path); err != nil {
 		return err
 	}
+	w.watchFiles(w.Current())
 
 	go w.watchLoop()
-	logger.Info("config_watcher_started", "path", w.path)
+	logger.Info("config_watcher_started", "path", w.Location())
 	return nil
 }
 
+// Location returns the config file path or the remote configuration URL.
+func (w *ConfigWatcher) Location() string {
+	if w.source != nil {
+		return w.source.String()
+	}
+	return w.path
+}
+
 // Stop stops the configuration watcher.
 func (w *ConfigWatcher) Stop() {
 	close(w.stopCh)
@@ -68,11 +106,57 @@ func (w *ConfigWatcher) RegisterCallback(fn func(*Config)) {
 	w.mu.Unlock()
 }
 
-// Reload manually reloads the configuration file.
+// Reload manually reloads the configuration.
 func (w *ConfigWatcher) Reload() error {
 	return w.reload()
 }
 
+// watchFiles watches the listener certificates and keys and the credentials
+// and API keys files of cfg. Their directories are watched, as such files are usually
+// replaced by renaming a new file over the old one rather than rewritten in
+// place.
+func (w *ConfigWatcher) watchFiles(cfg *Config) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	watch := []string{cfg.ListenTLSCert, cfg.ListenTLSKey, cfg.ListenTLSClientCA, cfg.AuthFile, cfg.AuthKeysFile, cfg.MetricsTLSCert, cfg.MetricsTLSKey,
+		cfg.MetricsAuthFile, cfg.AuthHMACSecretFile, cfg.RegistryTokenFile}
+	for _, l := range cfg.Listeners {
+		watch = append(watch, l.TLSCert, l.TLSKey)
+	}
+
+	var files []string
+	for _, f := range watch {
+		if f == "" {
+			continue
+		}
+		f = filepath.Clean(f)
+		files = append(files, f)
+
+		dir := filepath.Dir(f)
+		if w.watchedDirs[dir] {
+			continue
+		}
+		if err := w.watcher.Add(dir); err != nil {
+			logger.Warn("config_watcher_error", "path", dir, "error", err)
+			continue
+		}
+		w.watchedDirs[dir] = true
+	}
+	w.files = files
+}
+
+// isWatched reports whether a change to name should trigger a reload.
+func (w *ConfigWatcher) isWatched(name string) bool {
+	name = filepath.Clean(name)
+	if w.path != "" && name == filepath.Clean(w.path) {
+		return true
+	}
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return slices.Contains(w.files, name)
+}
+
 // watchLoop watches for file changes with debouncing.
 func (w *ConfigWatcher) watchLoop() {
 	var debounceTimer *time.Timer
@@ -86,7 +170,7 @@ func (w *ConfigWatcher) watchLoop() {
 			}
 
 			// Only react to write and create events
-			if event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+			if event.Op&(fsnotify.Write|fsnotify.Create) != 0 && w.isWatched(event.Name) {
 				// Debounce: reset timer on each event
 				if debounceTimer != nil {
 					debounceTimer.Stop()
@@ -113,20 +197,30 @@ func (w *ConfigWatcher) watchLoop() {
 	}
 }
 
-// reload loads the configuration from file and notifies callbacks.
+// watchSource reloads the configuration when the remote source changes.
+func (w *ConfigWatcher) watchSource() {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-w.stopCh
+		cancel()
+	}()
+	w.source.Watch(ctx, func() {
+		if err := w.reload(); err != nil {
+			logger.Error("config_reload_failed", "error", err)
+		}
+	})
+}
+
+// reload loads the configuration and notifies callbacks.
 func (w *ConfigWatcher) reload() error {
-	newCfg, err := LoadFromFile(w.path)
+	oldCfg := w.Current()
+	newCfg, err := w.prepare(oldCfg, nil)
 	if err != nil {
 		return err
 	}
 
-	// Validate the new configuration (only reloadable fields matter)
-	if err := w.validateReloadable(newCfg); err != nil {
-		return err
-	}
-
-	oldCfg := w.Current()
 	w.current.Store(newCfg)
+	w.watchFiles(newCfg)
 
 	// Log what changed
 	w.logChanges(oldCfg, newCfg)
@@ -141,12 +235,139 @@ func (w *ConfigWatcher) reload() error {
 		cb(newCfg)
 	}
 
-	logger.Info("config_reloaded", "path", w.path)
+	logger.Info("config_reloaded", "path", w.Location())
 	return nil
 }
 
+// Preview is what a reload would do.
+type Preview struct {
+	Changes []Change `json:"changes"`
+	// RestartRequired reports whether some changes need a restart.
+	RestartRequired bool `json:"restart_required"`
+}
+
+// Preview reports what reloading the configuration from data (YAML), or
+// from the config file or source when data is nil, would change, without
+// applying it. It fails when the reload would be rejected.
+func (w *ConfigWatcher) Preview(data []byte) (*Preview, error) {
+	oldCfg := w.Current()
+	newCfg, err := w.prepare(oldCfg, data)
+	if err != nil {
+		return nil, err
+	}
+	p := &Preview{Changes: Diff(oldCfg, newCfg)}
+	if p.Changes == nil {
+		p.Changes = []Change{}
+	}
+	for _, c := range p.Changes {
+		if c.Restart != "" {
+			p.RestartRequired = true
+		}
+	}
+	return p, nil
+}
+
+// prepare loads the configuration to reload from data (YAML), or from the
+// config file or source when data is nil, completes it from oldCfg and
+// validates it.
+func (w *ConfigWatcher) prepare(oldCfg *Config, data []byte) (*Config, error) {
+	var newCfg *Config
+	var err error
+	if data == nil && w.source != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), sourceTimeout)
+		data, err = w.source.Fetch(ctx)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", w.source, err)
+		}
+		if data == nil {
+			// An empty value is an empty configuration, not the file
+			data = []byte{}
+		}
+	}
+	if data == nil {
+		newCfg, err = LoadFromFile(w.path)
+	} else {
+		newCfg, err = parseConfig(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if oldCfg.DiscoverIPs {
+		// Discovery settings need a restart; the pool is re-discovered
+		newCfg.DiscoverIPs = true
+		newCfg.DiscoverFilter = oldCfg.DiscoverFilter
+		newCfg.DiscoverInterval = oldCfg.DiscoverInterval
+		newCfg.DiscoverProvider = oldCfg.DiscoverProvider
+		newCfg.DiscoverPublicOnly = oldCfg.DiscoverPublicOnly
+		if newCfg.IPs, err = oldCfg.DiscoverOutboundIPs(); err != nil {
+			return nil, &ValidationError{Field: "ips", Message: err.Error()}
+		}
+		if len(newCfg.IPs) == 0 {
+			// Keep the current pool rather than dropping every IP
+			newCfg.IPs = oldCfg.IPs
+		}
+	} else {
+		// IPs given by flag or environment only are kept
+		if len(newCfg.IPs) == 0 {
+			newCfg.IPs = oldCfg.IPs
+		}
+		if newCfg.IPs, err = netutil.ExpandIPs(newCfg.IPs); err != nil {
+			return nil, &ValidationError{Field: "ips", Message: err.Error()}
+		}
+	}
+
+	// A listener certificate given by flag or environment only is kept
+	if newCfg.ListenTLSCert == "" && newCfg.ListenTLSKey == "" {
+		newCfg.ListenTLSCert = oldCfg.ListenTLSCert
+		newCfg.ListenTLSKey = oldCfg.ListenTLSKey
+	}
+	if newCfg.ListenTLSClientCA == "" {
+		newCfg.ListenTLSClientCA = oldCfg.ListenTLSClientCA
+	}
+	if newCfg.MetricsTLSCert == "" && newCfg.MetricsTLSKey == "" {
+		newCfg.MetricsTLSCert = oldCfg.MetricsTLSCert
+		newCfg.MetricsTLSKey = oldCfg.MetricsTLSKey
+	}
+	// Likewise credentials and API keys files
+	if newCfg.AuthFile == "" {
+		newCfg.AuthFile = oldCfg.AuthFile
+	}
+	if newCfg.AuthKeysFile == "" {
+		newCfg.AuthKeysFile = oldCfg.AuthKeysFile
+	}
+	// And secret files, which are read again to check them
+	if newCfg.MetricsAuthFile == "" && newCfg.MetricsAuth == "" {
+		newCfg.MetricsAuthFile = oldCfg.MetricsAuthFile
+	}
+	if newCfg.AuthHMACSecretFile == "" && newCfg.AuthHMACSecret == "" {
+		newCfg.AuthHMACSecretFile = oldCfg.AuthHMACSecretFile
+	}
+	if newCfg.RegistryTokenFile == "" && newCfg.RegistryToken == "" {
+		newCfg.RegistryTokenFile = oldCfg.RegistryTokenFile
+	}
+	if newCfg.ClusterSecretFile == "" && newCfg.ClusterSecret == "" {
+		newCfg.ClusterSecretFile = oldCfg.ClusterSecretFile
+	}
+	if err := newCfg.readSecretFiles(); err != nil {
+		return nil, err
+	}
+
+	// Validate the new configuration (only reloadable fields matter)
+	if err := w.validateReloadable(newCfg); err != nil {
+		return nil, err
+	}
+	return newCfg, nil
+}
+
 // validateReloadable validates only the hot-reloadable configuration fields.
 func (w *ConfigWatcher) validateReloadable(cfg *Config) error {
+	// Validate outbound IPs
+	if _, err := netutil.ParseAddrs(cfg.IPs); err != nil {
+		return &ValidationError{Field: "ips", Message: err.Error()}
+	}
+
 	// Validate log level
 	validLevels := map[string]bool{"trace": true, "debug": true, "info": true, "warn": true, "error": true}
 	if !validLevels[cfg.LogLevel] {
@@ -158,6 +379,9 @@ func (w *ConfigWatcher) validateReloadable(cfg *Config) error {
 	if !validFormats[cfg.LogFormat] {
 		return &ValidationError{Field: "log_format", Message: "must be json or text"}
 	}
+	if cfg.LogSampleRate < 1 {
+		return &ValidationError{Field: "log_sample_rate", Message: "must be at least 1"}
+	}
 
 	// Validate limits
 	if cfg.MaxConnsPerIP < 1 {
@@ -175,45 +399,310 @@ func (w *ConfigWatcher) validateReloadable(cfg *Config) error {
 		return &ValidationError{Field: "history_size", Message: "must be at least 1"}
 	}
 
+	// Validate timeouts
+	if cfg.Timeout <= 0 {
+		return &ValidationError{Field: "timeout", Message: "must be positive"}
+	}
+	if cfg.IdleTimeout <= 0 {
+		return &ValidationError{Field: "idle_timeout", Message: "must be positive"}
+	}
+	if cfg.ResponseHeaderTimeout < 0 {
+		return &ValidationError{Field: "response_header_timeout", Message: "cannot be negative"}
+	}
+
+	// Validate rotated metrics credentials
+	if cfg.MetricsAuthFile != "" && !strings.Contains(cfg.MetricsAuth, ":") {
+		return &ValidationError{Field: "metrics_auth_file", Message: "must hold user:pass"}
+	}
+
+	// Validate listener TLS files
+	if (cfg.ListenTLSCert == "") != (cfg.ListenTLSKey == "") {
+		return &ValidationError{Field: "listen_tls_cert", Message: "listen_tls_cert and listen_tls_key must be set together"}
+	}
+
+	// Validate weights
+	for _, w := range cfg.Weights {
+		if w < 1 {
+			return &ValidationError{Field: "weights", Message: "must be at least 1"}
+		}
+	}
+
 	return nil
 }
 
-// logChanges logs which configuration values changed.
-func (w *ConfigWatcher) logChanges(old, new *Config) {
+// Change is a configuration field that differs between two configurations.
+type Change struct {
+	Field string `json:"field"`
+	// Old and New are the values of hot-reloaded fields; they are left out
+	// for fields needing a restart, which include credentials.
+	Old any `json:"old,omitempty"`
+	New any `json:"new,omitempty"`
+	// Restart is why the change is ignored until a restart (empty for
+	// changes applied on reload).
+	Restart string `json:"restart,omitempty"`
+}
+
+// Diff returns the fields that differ between the old and new
+// configurations, as applied by a reload.
+func Diff(old, new *Config) []Change {
+	var changes []Change
+	changed := func(field string, o, n any) {
+		// Durations read better as strings than as nanoseconds in JSON
+		if d, ok := o.(time.Duration); ok {
+			o, n = d.String(), n.(time.Duration).String()
+		}
+		changes = append(changes, Change{Field: field, Old: o, New: n})
+	}
+	ignored := func(field, reason string) {
+		changes = append(changes, Change{Field: field, Restart: reason})
+	}
+
 	if old.LogLevel != new.LogLevel {
-		logger.Info("config_changed", "field", "log_level", "old", old.LogLevel, "new", new.LogLevel)
+		changed("log_level", old.LogLevel, new.LogLevel)
 	}
 	if old.LogFormat != new.LogFormat {
-		logger.Info("config_changed", "field", "log_format", "old", old.LogFormat, "new", new.LogFormat)
+		changed("log_format", old.LogFormat, new.LogFormat)
+	}
+	if old.LogSampleRate != new.LogSampleRate {
+		changed("log_sample_rate", old.LogSampleRate, new.LogSampleRate)
 	}
 	if old.MaxConnsPerIP != new.MaxConnsPerIP {
-		logger.Info("config_changed", "field", "max_conns_per_ip", "old", old.MaxConnsPerIP, "new", new.MaxConnsPerIP)
+		changed("max_conns_per_ip", old.MaxConnsPerIP, new.MaxConnsPerIP)
 	}
 	if old.MaxConnsTotal != new.MaxConnsTotal {
-		logger.Info("config_changed", "field", "max_conns_total", "old", old.MaxConnsTotal, "new", new.MaxConnsTotal)
+		changed("max_conns_total", old.MaxConnsTotal, new.MaxConnsTotal)
 	}
 	if old.HistoryWindow != new.HistoryWindow {
-		logger.Info("config_changed", "field", "history_window", "old", old.HistoryWindow, "new", new.HistoryWindow)
+		changed("history_window", old.HistoryWindow, new.HistoryWindow)
 	}
 	if old.HistorySize != new.HistorySize {
-		logger.Info("config_changed", "field", "history_size", "old", old.HistorySize, "new", new.HistorySize)
+		changed("history_size", old.HistorySize, new.HistorySize)
+	}
+	if !slicesEqual(old.DrainIPs, new.DrainIPs) {
+		changed("drain_ips", old.DrainIPs, new.DrainIPs)
+	}
+	if !maps.Equal(old.Weights, new.Weights) {
+		changed("weights", old.Weights, new.Weights)
 	}
 
-	// Warn about non-reloadable fields that changed
-	if len(old.IPs) != len(new.IPs) || !slicesEqual(old.IPs, new.IPs) {
-		logger.Warn("config_change_ignored", "field", "ips", "reason", "requires restart")
+	if !slicesEqual(old.IPs, new.IPs) {
+		changed("ips", old.IPs, new.IPs)
+	}
+	if old.ListenTLSCert != "" && (old.ListenTLSCert != new.ListenTLSCert || old.ListenTLSKey != new.ListenTLSKey) {
+		changed("listen_tls_cert", old.ListenTLSCert, new.ListenTLSCert)
+	}
+	if old.Timeout != new.Timeout {
+		changed("timeout", old.Timeout, new.Timeout)
+	}
+	if old.IdleTimeout != new.IdleTimeout {
+		changed("idle_timeout", old.IdleTimeout, new.IdleTimeout)
+	}
+	if old.TCPKeepAlive != new.TCPKeepAlive {
+		changed("tcp_keepalive", old.TCPKeepAlive, new.TCPKeepAlive)
 	}
+	if old.IdleConnTimeout != new.IdleConnTimeout {
+		changed("idle_conn_timeout", old.IdleConnTimeout, new.IdleConnTimeout)
+	}
+	if old.TLSHandshakeTimeout != new.TLSHandshakeTimeout {
+		changed("tls_handshake_timeout", old.TLSHandshakeTimeout, new.TLSHandshakeTimeout)
+	}
+	if old.ExpectContinueTimeout != new.ExpectContinueTimeout {
+		changed("expect_continue_timeout", old.ExpectContinueTimeout, new.ExpectContinueTimeout)
+	}
+	if old.ResponseHeaderTimeout != new.ResponseHeaderTimeout {
+		changed("response_header_timeout", old.ResponseHeaderTimeout, new.ResponseHeaderTimeout)
+	}
+
+	// Fields that are only applied on restart
 	if old.Port != new.Port {
-		logger.Warn("config_change_ignored", "field", "port", "reason", "requires restart")
+		ignored("port", "requires restart")
 	}
 	if old.MetricsPort != new.MetricsPort {
-		logger.Warn("config_change_ignored", "field", "metrics_port", "reason", "requires restart")
+		ignored("metrics_port", "requires restart")
+	}
+	if old.SocksPort != new.SocksPort {
+		ignored("socks_port", "requires restart")
+	}
+	if old.GatewayPort != new.GatewayPort {
+		ignored("gateway_port", "requires restart")
+	}
+	if old.ReusePort != new.ReusePort {
+		ignored("reuse_port", "requires restart")
+	}
+	if old.MetricsHostLabel != new.MetricsHostLabel || old.MetricsHostLimit != new.MetricsHostLimit {
+		ignored("metrics_host_label", "requires restart")
+	}
+	if old.LogFile != new.LogFile || old.LogMaxSize != new.LogMaxSize || old.LogMaxAge != new.LogMaxAge || old.LogMaxBackups != new.LogMaxBackups {
+		ignored("log_file", "requires restart")
+	}
+	if old.Syslog != new.Syslog || old.SyslogTag != new.SyslogTag || old.Journald != new.Journald {
+		ignored("syslog", "requires restart")
+	}
+	if old.AccessLog != new.AccessLog || old.AccessLogFormat != new.AccessLogFormat {
+		ignored("access_log", "requires restart")
+	}
+	if old.PushgatewayURL != new.PushgatewayURL || old.PushgatewayJob != new.PushgatewayJob ||
+		old.RemoteWriteURL != new.RemoteWriteURL || old.PushInterval != new.PushInterval {
+		ignored("push", "requires restart")
+	}
+	if old.StatsDAddress != new.StatsDAddress || old.StatsDPrefix != new.StatsDPrefix ||
+		!slicesEqual(old.StatsDTags, new.StatsDTags) || old.StatsDDogStatsD != new.StatsDDogStatsD {
+		ignored("statsd", "requires restart")
+	}
+	if !slicesEqual(old.WebhookURLs, new.WebhookURLs) || old.WebhookFormat != new.WebhookFormat ||
+		old.WebhookRate != new.WebhookRate || old.WebhookRetries != new.WebhookRetries {
+		ignored("webhook", "requires restart")
+	}
+	if old.HostStats != new.HostStats {
+		ignored("host_stats", "requires restart")
+	}
+	if old.MetricsBind != new.MetricsBind || old.MetricsTLSCert != new.MetricsTLSCert || old.MetricsTLSKey != new.MetricsTLSKey {
+		ignored("metrics_bind", "requires restart")
+	}
+	// Secrets read from files are rotated when the files change; other
+	// changes to secrets need a restart
+	if old.MetricsAuthFile != new.MetricsAuthFile {
+		ignored("metrics_auth_file", "requires restart for security")
+	} else if (old.MetricsAuthFile == "" && old.MetricsAuth != new.MetricsAuth) || !slicesEqual(old.MetricsAllow, new.MetricsAllow) {
+		ignored("metrics_auth", "requires restart")
+	}
+	if old.MetricsDebug != new.MetricsDebug {
+		ignored("metrics_debug", "requires restart")
+	}
+	if !slices.Equal(old.Listeners, new.Listeners) {
+		ignored("listeners", "requires restart")
+	}
+	if old.ListenUnix != new.ListenUnix || old.MetricsListenUnix != new.MetricsListenUnix || old.UnixSocketMode != new.UnixSocketMode {
+		ignored("listen_unix", "requires restart")
+	}
+	if old.ListenTLSCert == "" && new.ListenTLSCert != "" {
+		ignored("listen_tls_cert", "requires restart")
+	}
+	if old.ListenTLSClientCA != new.ListenTLSClientCA || old.ListenTLSClientCertRequired != new.ListenTLSClientCertRequired || old.ListenTLSClientIdentity != new.ListenTLSClientIdentity {
+		ignored("listen_tls_client_ca", "requires restart for security")
+	}
+	if old.HTTP2 != new.HTTP2 {
+		ignored("http2", "requires restart")
+	}
+	if !slices.Equal(old.ProxyProtocolTrusted, new.ProxyProtocolTrusted) {
+		ignored("proxy_protocol_trusted", "requires restart")
+	}
+	if !slices.Equal(old.EgressSelectTrusted, new.EgressSelectTrusted) {
+		ignored("egress_select_trusted", "requires restart")
+	}
+	if !slices.Equal(old.ClientAllow, new.ClientAllow) || !slices.Equal(old.ClientDeny, new.ClientDeny) {
+		ignored("client_allow", "requires restart for security")
+	}
+	if old.AnonymityMode != new.AnonymityMode {
+		ignored("anonymity_mode", "requires restart")
+	}
+	if old.ExposeEgressHeader != new.ExposeEgressHeader {
+		ignored("expose_egress_header", "requires restart")
+	}
+	if old.BlockPrivateDestinations != new.BlockPrivateDestinations {
+		ignored("block_private_destinations", "requires restart")
+	}
+	if !slices.Equal(old.ConnectAllowedPorts, new.ConnectAllowedPorts) {
+		ignored("connect_allowed_ports", "requires restart")
+	}
+	if !slices.Equal(old.AllowedMethods, new.AllowedMethods) || !slices.Equal(old.DeniedMethods, new.DeniedMethods) {
+		ignored("allowed_methods", "requires restart")
+	}
+	if !slices.Equal(old.DNSServers, new.DNSServers) || !maps.EqualFunc(old.DNSServersPerIP, new.DNSServersPerIP, slices.Equal) {
+		ignored("dns_servers", "requires restart")
+	}
+	if !maps.Equal(old.IPOptions, new.IPOptions) {
+		ignored("ips.options", "requires restart")
+	}
+	if old.PreferFamily != new.PreferFamily {
+		ignored("prefer_family", "requires restart")
+	}
+	if old.DNSCacheSize != new.DNSCacheSize || old.DNSCacheNegativeTTL != new.DNSCacheNegativeTTL {
+		ignored("dns_cache", "requires restart")
+	}
+	if old.UpstreamHTTP3 != new.UpstreamHTTP3 {
+		ignored("upstream_http3", "requires restart")
 	}
 	if old.Auth != new.Auth {
-		logger.Warn("config_change_ignored", "field", "auth", "reason", "requires restart for security")
+		ignored("auth", "requires restart for security")
 	}
-	if old.Timeout != new.Timeout {
-		logger.Warn("config_change_ignored", "field", "timeout", "reason", "requires restart")
+	if old.AuthHMACSecretFile != new.AuthHMACSecretFile {
+		ignored("auth_hmac_secret_file", "requires restart for security")
+	} else if old.AuthHMACSecretFile == "" && old.AuthHMACSecret != new.AuthHMACSecret {
+		ignored("auth_hmac_secret", "requires restart for security")
+	}
+	if old.SharedStateURL != new.SharedStateURL || old.SharedStatePrefix != new.SharedStatePrefix || old.SharedStateInterval != new.SharedStateInterval {
+		ignored("shared_state", "requires restart")
+	}
+	if old.ClusterBind != new.ClusterBind || !slices.Equal(old.ClusterPeers, new.ClusterPeers) || old.ClusterInterval != new.ClusterInterval {
+		ignored("cluster", "requires restart")
+	}
+	if old.ClusterSecretFile != new.ClusterSecretFile {
+		ignored("cluster_secret_file", "requires restart for security")
+	} else if old.ClusterSecret != new.ClusterSecret {
+		ignored("cluster_secret", "requires restart for security")
+	}
+	if old.StateDir != new.StateDir || old.StateInterval != new.StateInterval {
+		ignored("state_dir", "requires restart")
+	}
+	if old.RegistryTokenFile != new.RegistryTokenFile {
+		ignored("registry_token_file", "requires restart for security")
+	} else if old.RegistryTokenFile == "" && old.RegistryToken != new.RegistryToken {
+		ignored("registry_token", "requires restart for security")
+	}
+	if old.AuthFile != new.AuthFile {
+		ignored("auth_file", "requires restart for security")
+	}
+	if old.AuthKeysFile != new.AuthKeysFile || old.AuthKeyHeader != new.AuthKeyHeader {
+		ignored("auth_keys_file", "requires restart for security")
+	}
+	if old.AuthMaxFailures != new.AuthMaxFailures || old.AuthFailureWindow != new.AuthFailureWindow || old.AuthBanDuration != new.AuthBanDuration {
+		ignored("auth_max_failures", "requires restart")
+	}
+	if !reflect.DeepEqual(old.Users, new.Users) {
+		ignored("users", "requires restart")
+	}
+	if old.MaxRequestBody != new.MaxRequestBody || old.MaxResponseBody != new.MaxResponseBody {
+		ignored("max_request_body", "requires restart")
+	}
+	if old.BandwidthPerTunnel != new.BandwidthPerTunnel || old.BandwidthPerUser != new.BandwidthPerUser || old.BandwidthPerIP != new.BandwidthPerIP {
+		ignored("bandwidth", "requires restart")
+	}
+	if old.DefaultPriority != new.DefaultPriority || old.ReservedConnsHigh != new.ReservedConnsHigh || old.ReservedConnsNormal != new.ReservedConnsNormal {
+		ignored("priority", "requires restart")
+	}
+	if old.MaxTunnelDuration != new.MaxTunnelDuration || old.MaxTunnelIdle != new.MaxTunnelIdle {
+		ignored("max_tunnel_duration", "requires restart")
+	}
+	if old.ClientMaxConns != new.ClientMaxConns {
+		ignored("client_max_conns", "requires restart")
+	}
+	if old.QueueSize != new.QueueSize || old.QueueTimeout != new.QueueTimeout {
+		ignored("queue_size", "requires restart")
+	}
+	if old.MaxRPS != new.MaxRPS || old.HostMaxRPS != new.HostMaxRPS || old.RateLimitMaxWait != new.RateLimitMaxWait || old.RateLimitMaxWaiters != new.RateLimitMaxWaiters {
+		ignored("max_rps", "requires restart")
+	}
+	if old.UserMaxConns != new.UserMaxConns || old.UserMaxRequestsPerMinute != new.UserMaxRequestsPerMinute || old.UserMaxBytesPerDay != new.UserMaxBytesPerDay {
+		ignored("user_quotas", "requires restart")
+	}
+	if old.ReadyRequiresHealthyIP != new.ReadyRequiresHealthyIP {
+		ignored("ready_requires_healthy_ip", "requires restart")
+	}
+	if old.ShutdownDelay != new.ShutdownDelay || old.ShutdownTimeout != new.ShutdownTimeout || old.ShutdownForceClose != new.ShutdownForceClose {
+		ignored("shutdown_timeout", "requires restart")
+	}
+	return changes
+}
+
+// logChanges logs which configuration values changed.
+func (w *ConfigWatcher) logChanges(old, new *Config) {
+	for _, c := range Diff(old, new) {
+		if c.Restart != "" {
+			logger.Warn("config_change_ignored", "field", c.Field, "reason", c.Restart)
+		} else {
+			logger.Info("config_changed", "field", c.Field, "old", c.Old, "new", c.New)
+		}
 	}
 }
 
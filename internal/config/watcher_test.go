@@ -0,0 +1,136 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiff(t *testing.T) {
+	old := DefaultConfig()
+	old.IPs = []string{"192.168.1.1"}
+	new := *old
+	new.MaxConnsTotal = old.MaxConnsTotal + 10
+	new.HistoryWindow = 2 * time.Minute
+	new.Port = 8080
+	new.Auth = "alice:secret"
+	new.Timeout = 10 * time.Second
+
+	changes := Diff(old, &new)
+	byField := make(map[string]Change, len(changes))
+	for _, c := range changes {
+		byField[c.Field] = c
+	}
+	if len(changes) != 5 {
+		t.Errorf("changes = %+v, want 5", changes)
+	}
+	if c := byField["max_conns_total"]; c.Restart != "" || c.New != new.MaxConnsTotal {
+		t.Errorf("max_conns_total = %+v", c)
+	}
+	if c := byField["history_window"]; c.Old != old.HistoryWindow.String() || c.New != "2m0s" {
+		t.Errorf("history_window = %+v, want durations as strings", c)
+	}
+	if c := byField["timeout"]; c.Restart != "" || c.New != "10s" {
+		t.Errorf("timeout = %+v, want a reloadable change", c)
+	}
+	if c := byField["port"]; c.Restart != "requires restart" {
+		t.Errorf("port = %+v", c)
+	}
+	if c := byField["auth"]; c.Restart == "" || c.Old != nil || c.New != nil {
+		t.Errorf("auth = %+v, want restart without values", c)
+	}
+	if got := Diff(old, old); len(got) != 0 {
+		t.Errorf("Diff of identical configurations = %+v", got)
+	}
+}
+
+func TestConfigWatcher_Preview(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("ips: [192.168.1.1]\nmax_conns_per_ip: 50\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	initial := DefaultConfig()
+	initial.IPs = []string{"192.168.1.1"}
+	w, err := NewConfigWatcher(path, initial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.watcher.Close()
+
+	p, err := w.Preview(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Changes) != 1 || p.Changes[0].Field != "max_conns_per_ip" || p.RestartRequired {
+		t.Errorf("preview of the file = %+v", p)
+	}
+	if w.Current() != initial {
+		t.Error("Preview applied the configuration")
+	}
+
+	p, err = w.Preview([]byte("ips: [192.168.1.1]\nport: 8080\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Changes) != 1 || p.Changes[0].Field != "port" || !p.RestartRequired {
+		t.Errorf("preview of the body = %+v", p)
+	}
+
+	if _, err := w.Preview([]byte("ips: [192.168.1.1]\nmax_conns_total: 0\n")); err == nil {
+		t.Error("expected an error for a configuration the reload would reject")
+	}
+	if _, err := w.Preview([]byte("ips: [")); err == nil {
+		t.Error("expected an error for invalid YAML")
+	}
+}
+
+func TestConfigWatcher_SecretFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	secret := filepath.Join(dir, "metrics-auth")
+	if err := os.WriteFile(path, []byte("ips: [192.168.1.1]\nmetrics_auth_file: "+secret+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(secret, []byte("admin:one\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	initial, err := LoadFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := initial.readSecretFiles(); err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewConfigWatcher(path, initial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.watcher.Close()
+
+	// A rotated secret is applied, not reported as needing a restart
+	if err := os.WriteFile(secret, []byte("admin:two\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := w.Preview(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Changes) != 0 {
+		t.Errorf("changes = %+v, want none for a rotated secret", p.Changes)
+	}
+	if err := w.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.Current().MetricsAuth; got != "admin:two" {
+		t.Errorf("MetricsAuth = %q, want the rotated credentials", got)
+	}
+
+	// Invalid credentials are rejected
+	if err := os.WriteFile(secret, []byte("no-colon\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Reload(); err == nil {
+		t.Error("Reload() accepted credentials without a password")
+	}
+}
@@ -197,3 +197,106 @@ func TestConfig_Validate_MetricsPorts(t *testing.T) {
 		t.Error("metrics port > 65535 should be invalid")
 	}
 }
+
+func TestLoadFromFile_Failover(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "failover.yml")
+
+	configContent := `
+ips:
+  - 127.0.0.1
+failover:
+  - host: api.example.com
+    fallbacks:
+      - api-eu.example.com
+      - api-us.example.com:8443
+`
+	if err := os.WriteFile(configPath, []byte(configContent), 0644); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+
+	cfg, err := LoadFromFile(configPath)
+	if err != nil {
+		t.Fatalf("LoadFromFile() error: %v", err)
+	}
+
+	if len(cfg.Failover) != 1 {
+		t.Fatalf("expected 1 failover rule, got %d", len(cfg.Failover))
+	}
+	rule := cfg.Failover[0]
+	if rule.Host != "api.example.com" {
+		t.Errorf("expected host api.example.com, got %s", rule.Host)
+	}
+	if len(rule.Fallbacks) != 2 || rule.Fallbacks[1] != "api-us.example.com:8443" {
+		t.Errorf("unexpected fallbacks: %v", rule.Fallbacks)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() error: %v", err)
+	}
+}
+
+func TestLoadFromFile_PoolsAndRoutes(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "pools.yml")
+
+	configContent := `
+ips:
+  - 10.0.0.1
+  - 10.0.0.2
+  - 10.0.1.1
+pools:
+  residential: [10.0.0.1, 10.0.0.2]
+  datacenter: [10.0.1.1]
+routes:
+  - host: "*.shop.example"
+    pool: residential
+  - regex: '^api[0-9]+\.example\.com$'
+    pool: datacenter
+`
+	if err := os.WriteFile(configPath, []byte(configContent), 0644); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+
+	cfg, err := LoadFromFile(configPath)
+	if err != nil {
+		t.Fatalf("LoadFromFile() error: %v", err)
+	}
+
+	if len(cfg.Pools["residential"]) != 2 || len(cfg.Pools["datacenter"]) != 1 {
+		t.Errorf("unexpected pools: %v", cfg.Pools)
+	}
+	if len(cfg.Routes) != 2 || cfg.Routes[1].Pool != "datacenter" {
+		t.Errorf("unexpected routes: %v", cfg.Routes)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() error: %v", err)
+	}
+}
+
+func TestLoadFromFile_Weights(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "weights.yml")
+
+	configContent := `
+ips:
+  - 10.0.0.1
+  - 10.0.0.2
+weights:
+  10.0.0.1: 3
+`
+	if err := os.WriteFile(configPath, []byte(configContent), 0644); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+
+	cfg, err := LoadFromFile(configPath)
+	if err != nil {
+		t.Fatalf("LoadFromFile() error: %v", err)
+	}
+
+	if cfg.Weights["10.0.0.1"] != 3 || len(cfg.Weights) != 1 {
+		t.Errorf("unexpected weights: %v", cfg.Weights)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() error: %v", err)
+	}
+}
@@ -0,0 +1,283 @@
+package dns
+
+import (
+	"container/list"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// CacheOptions configures the lookup cache of a Resolver.
+type CacheOptions struct {
+	// Size is the maximum number of cached hosts; 0 disables the cache.
+	Size int
+	// NegativeTTL caps how long not-found results are cached; 0 disables
+	// negative caching.
+	NegativeTTL time.Duration
+}
+
+// cacheEntry is the cached result of a lookup.
+type cacheEntry struct {
+	host    string
+	addrs   []netip.Addr
+	err     error
+	expires time.Time
+}
+
+// cache is an LRU cache of lookup results, each kept until the TTL of the
+// records it was built from runs out.
+type cache struct {
+	mu          sync.Mutex
+	size        int
+	negativeTTL time.Duration
+	entries     map[string]*list.Element
+	order       *list.List // most recently used first
+	now         func() time.Time
+}
+
+func newCache(opts CacheOptions) *cache {
+	return &cache{
+		size:        opts.Size,
+		negativeTTL: opts.NegativeTTL,
+		entries:     make(map[string]*list.Element, opts.Size),
+		order:       list.New(),
+		now:         time.Now,
+	}
+}
+
+// get returns the cached result for host, if any and not expired.
+func (c *cache) get(host string) ([]netip.Addr, error, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[host]
+	if !ok {
+		return nil, nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, host)
+		return nil, nil, false
+	}
+	c.order.MoveToFront(elem)
+	return slices.Clone(entry.addrs), entry.err, true
+}
+
+// add caches the result of looking up host. Addresses are kept for the
+// lowest TTL of the answers; not-found errors for the TTL announced by the
+// zone, at most negativeTTL. Results whose TTL is unknown, such as those
+// from the hosts file, and other errors are not cached.
+func (c *cache) add(host string, addrs []netip.Addr, err error, ttls *ttlRecorder) {
+	var ttl time.Duration
+	switch {
+	case err == nil:
+		answer, ok := ttls.answerTTL()
+		if !ok {
+			return
+		}
+		ttl = answer
+	case isNotFound(err):
+		ttl = c.negativeTTL
+		if negative, ok := ttls.negativeTTL(); ok && negative < ttl {
+			ttl = negative
+		}
+	default:
+		return
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &cacheEntry{host: host, addrs: slices.Clone(addrs), err: err, expires: c.now().Add(ttl)}
+	if elem, ok := c.entries[host]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[host] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).host)
+	}
+}
+
+// isNotFound reports whether err says the host does not exist.
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// ttlRecorderKey is the context key for the ttlRecorder of a lookup.
+type ttlRecorderKey struct{}
+
+// ttlRecorder collects the TTLs of the responses read during a lookup, which
+// net.Resolver does not report.
+type ttlRecorder struct {
+	mu          sync.Mutex
+	answer      uint32
+	hasAnswer   bool
+	negative    uint32
+	hasNegative bool
+}
+
+// answerTTL returns the lowest TTL of the answers received.
+func (t *ttlRecorder) answerTTL() (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return time.Duration(t.answer) * time.Second, t.hasAnswer
+}
+
+// negativeTTL returns the lowest negative caching TTL of the responses
+// without answers.
+func (t *ttlRecorder) negativeTTL() (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return time.Duration(t.negative) * time.Second, t.hasNegative
+}
+
+// record reads the TTLs of a DNS response: the lowest TTL of its address
+// and alias answers or, for a response without answers, the negative
+// caching TTL of its SOA record (RFC 2308).
+func (t *ttlRecorder) record(msg []byte) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil || !h.Response || p.SkipAllQuestions() != nil {
+		return
+	}
+
+	var answer uint32
+	answered := false
+	for {
+		ah, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return
+		}
+		switch ah.Type {
+		case dnsmessage.TypeA, dnsmessage.TypeAAAA, dnsmessage.TypeCNAME:
+			if !answered || ah.TTL < answer {
+				answer = ah.TTL
+			}
+			answered = true
+		}
+		if p.SkipAnswer() != nil {
+			return
+		}
+	}
+
+	if answered {
+		t.mu.Lock()
+		if !t.hasAnswer || answer < t.answer {
+			t.answer = answer
+		}
+		t.hasAnswer = true
+		t.mu.Unlock()
+		return
+	}
+
+	for {
+		ah, err := p.AuthorityHeader()
+		if err != nil {
+			return
+		}
+		if ah.Type != dnsmessage.TypeSOA {
+			if p.SkipAuthority() != nil {
+				return
+			}
+			continue
+		}
+		soa, err := p.SOAResource()
+		if err != nil {
+			return
+		}
+		negative := min(ah.TTL, soa.MinTTL)
+		t.mu.Lock()
+		if !t.hasNegative || negative < t.negative {
+			t.negative = negative
+		}
+		t.hasNegative = true
+		t.mu.Unlock()
+		return
+	}
+}
+
+// recordingDial wraps the Dial function of a net.Resolver so the responses
+// read from its connections are passed to the ttlRecorder of the lookup.
+func recordingDial(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		ttls, ok := ctx.Value(ttlRecorderKey{}).(*ttlRecorder)
+		if !ok {
+			return conn, nil
+		}
+		// net.Resolver tells datagram connections from stream ones by
+		// whether they implement net.PacketConn
+		if pc, ok := conn.(net.PacketConn); ok {
+			return &recordingPacketConn{PacketConn: pc, conn: conn, ttls: ttls}, nil
+		}
+		return &recordingStreamConn{Conn: conn, ttls: ttls}, nil
+	}
+}
+
+// recordingPacketConn records the TTLs of the datagrams read from a UDP
+// connection.
+type recordingPacketConn struct {
+	net.PacketConn
+	conn net.Conn
+	ttls *ttlRecorder
+}
+
+func (c *recordingPacketConn) Read(p []byte) (int, error) {
+	n, err := c.conn.Read(p)
+	if n > 0 {
+		c.ttls.record(p[:n])
+	}
+	return n, err
+}
+
+func (c *recordingPacketConn) Write(p []byte) (int, error) {
+	return c.conn.Write(p)
+}
+
+func (c *recordingPacketConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// recordingStreamConn records the TTLs of the length-prefixed messages read
+// from a TCP connection.
+type recordingStreamConn struct {
+	net.Conn
+	ttls *ttlRecorder
+	buf  []byte
+}
+
+func (c *recordingStreamConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.buf = append(c.buf, p[:n]...)
+	for len(c.buf) >= 2 {
+		length := int(binary.BigEndian.Uint16(c.buf))
+		if len(c.buf) < 2+length {
+			break
+		}
+		c.ttls.record(c.buf[2 : 2+length])
+		c.buf = c.buf[2+length:]
+	}
+	return n, err
+}
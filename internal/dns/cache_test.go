@@ -0,0 +1,141 @@
+package dns
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestResolver_Cache(t *testing.T) {
+	ns, queries := startNameserver(t, map[string]netip.Addr{
+		"api.example.test": netip.MustParseAddr("192.0.2.10"),
+	})
+	r := New([]string{ns}, "", CacheOptions{Size: 10, NegativeTTL: 5 * time.Second})
+	now := time.Now()
+	r.cache.now = func() time.Time { return now }
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	lookup := func(host string) ([]netip.Addr, error) {
+		t.Helper()
+		return r.LookupNetIP(ctx, host)
+	}
+
+	if _, err := lookup("api.example.test"); err != nil {
+		t.Fatal(err)
+	}
+	sent := queries.Load()
+	addrs, err := lookup("API.example.test")
+	if err != nil || len(addrs) != 1 || addrs[0] != netip.MustParseAddr("192.0.2.10") {
+		t.Fatalf("cached LookupNetIP() = %v, %v", addrs, err)
+	}
+	if queries.Load() != sent {
+		t.Error("a cached host was looked up again")
+	}
+
+	// Not-found hosts are cached for the negative TTL
+	if _, err := lookup("missing.example.test"); err == nil {
+		t.Fatal("LookupNetIP(missing) succeeded")
+	}
+	sent = queries.Load()
+	if _, err := lookup("missing.example.test"); !isNotFound(err) {
+		t.Errorf("cached LookupNetIP(missing) error = %v, want not found", err)
+	}
+	if queries.Load() != sent {
+		t.Error("a cached not-found host was looked up again")
+	}
+
+	// The negative entry expires first, then the answer after its 60s TTL
+	now = now.Add(10 * time.Second)
+	lookup("missing.example.test")
+	lookup("api.example.test")
+	if got := queries.Load() - sent; got != 2 {
+		t.Errorf("%d queries after the negative TTL, want 2 (A and AAAA of the missing host)", got)
+	}
+	now = now.Add(time.Minute)
+	sent = queries.Load()
+	lookup("api.example.test")
+	if queries.Load() == sent {
+		t.Error("a host was served from the cache after its TTL")
+	}
+}
+
+func TestCache_Eviction(t *testing.T) {
+	c := newCache(CacheOptions{Size: 2})
+	ttls := &ttlRecorder{answer: 60, hasAnswer: true}
+	addr := []netip.Addr{netip.MustParseAddr("192.0.2.1")}
+
+	c.add("a.test", addr, nil, ttls)
+	c.add("b.test", addr, nil, ttls)
+	c.get("a.test")
+	c.add("c.test", addr, nil, ttls)
+
+	if _, _, ok := c.get("b.test"); ok {
+		t.Error("the least recently used host was not evicted")
+	}
+	for _, host := range []string{"a.test", "c.test"} {
+		if _, _, ok := c.get(host); !ok {
+			t.Errorf("%s was evicted", host)
+		}
+	}
+
+	// Results with an unknown TTL are not cached
+	c.add("hosts-file.test", addr, nil, &ttlRecorder{})
+	if _, _, ok := c.get("hosts-file.test"); ok {
+		t.Error("a result without TTL was cached")
+	}
+}
+
+func TestTTLRecorder_Record(t *testing.T) {
+	name := dnsmessage.MustNewName("www.example.test.")
+	pack := func(msg dnsmessage.Message) []byte {
+		t.Helper()
+		msg.Header.Response = true
+		msg.Questions = []dnsmessage.Question{{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}}
+		b, err := msg.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	header := func(typ dnsmessage.Type, ttl uint32) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: name, Type: typ, Class: dnsmessage.ClassINET, TTL: ttl}
+	}
+
+	ttls := &ttlRecorder{}
+	ttls.record(pack(dnsmessage.Message{Answers: []dnsmessage.Resource{
+		{Header: header(dnsmessage.TypeCNAME, 300), Body: &dnsmessage.CNAMEResource{CNAME: name}},
+		{Header: header(dnsmessage.TypeA, 30), Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}},
+	}}))
+	ttls.record(pack(dnsmessage.Message{Answers: []dnsmessage.Resource{
+		{Header: header(dnsmessage.TypeAAAA, 120), Body: &dnsmessage.AAAAResource{}},
+	}}))
+	if got, ok := ttls.answerTTL(); !ok || got != 30*time.Second {
+		t.Errorf("answerTTL() = %v, %v, want 30s", got, ok)
+	}
+
+	ttls.record(pack(dnsmessage.Message{
+		Header: dnsmessage.Header{RCode: dnsmessage.RCodeNameError},
+		Authorities: []dnsmessage.Resource{{
+			Header: header(dnsmessage.TypeSOA, 900),
+			Body:   &dnsmessage.SOAResource{NS: name, MBox: name, MinTTL: 15},
+		}},
+	}))
+	if got, ok := ttls.negativeTTL(); !ok || got != 15*time.Second {
+		t.Errorf("negativeTTL() = %v, %v, want 15s", got, ok)
+	}
+
+	// Queries and garbage are ignored
+	ignored := &ttlRecorder{}
+	ignored.record([]byte("not a dns message"))
+	query, _ := (&dnsmessage.Message{Answers: []dnsmessage.Resource{
+		{Header: header(dnsmessage.TypeA, 1), Body: &dnsmessage.AResource{}},
+	}}).Pack()
+	ignored.record(query)
+	if _, ok := ignored.answerTTL(); ok {
+		t.Error("a TTL was recorded from a query or garbage")
+	}
+}
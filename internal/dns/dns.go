@@ -0,0 +1,277 @@
+// Package dns resolves destination hosts for the proxy, through the system
+// resolver or custom nameservers, optionally chosen per outbound IP.
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
+)
+
+// defaultPort is the port of nameservers given without one.
+const defaultPort = "53"
+
+// Resolver resolves host names and dials the resulting addresses.
+type Resolver struct {
+	resolver *net.Resolver
+	label    string // "system" or "custom", for metrics
+	cache    *cache // nil when caching is disabled
+}
+
+// New creates a Resolver querying nameservers ("host" or "host:port", port 53
+// by default), from localIP when set. Queries rotate over the nameservers so
+// a retried query goes to the next one. Without nameservers the nameservers
+// of the system configuration are used and localIP is ignored.
+func New(nameservers []string, localIP string, cacheOpts CacheOptions) *Resolver {
+	r := &Resolver{resolver: net.DefaultResolver, label: "system"}
+	var dial func(ctx context.Context, network, address string) (net.Conn, error)
+	if len(nameservers) > 0 {
+		r.label = "custom"
+		dial = rotatingDial(nameservers, localIP)
+	}
+	if cacheOpts.Size > 0 {
+		r.cache = newCache(cacheOpts)
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		dial = recordingDial(dial)
+	}
+	if dial != nil {
+		r.resolver = &net.Resolver{PreferGo: true, Dial: dial}
+	}
+	return r
+}
+
+// rotatingDial returns a net.Resolver Dial function connecting to the
+// nameservers in turn, from localIP when set.
+func rotatingDial(nameservers []string, localIP string) func(ctx context.Context, network, address string) (net.Conn, error) {
+
+	servers := make([]string, len(nameservers))
+	for i, ns := range nameservers {
+		servers[i] = NameserverAddr(ns)
+	}
+	var next atomic.Uint32
+	var local net.IP
+	if localIP != "" {
+		local = net.ParseIP(localIP)
+	}
+
+	return func(ctx context.Context, network, _ string) (net.Conn, error) {
+		server := servers[int(next.Add(1)-1)%len(servers)]
+		dialer := &net.Dialer{}
+		if local != nil {
+			switch network {
+			case "udp", "udp4", "udp6":
+				dialer.LocalAddr = &net.UDPAddr{IP: local}
+			default:
+				dialer.LocalAddr = &net.TCPAddr{IP: local}
+			}
+		}
+		return dialer.DialContext(ctx, network, server)
+	}
+}
+
+// NameserverAddr returns the "host:port" address of a nameserver given as
+// "host" or "host:port".
+func NameserverAddr(ns string) string {
+	if _, _, err := net.SplitHostPort(ns); err == nil {
+		return ns
+	}
+	return net.JoinHostPort(ns, defaultPort)
+}
+
+// LookupNetIP returns the addresses of host, IPv4-mapped IPv6 addresses
+// unmapped. IP literals are returned as is, without a lookup. With caching
+// enabled, results are served from the cache while their TTL lasts.
+func (r *Resolver) LookupNetIP(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr.Unmap()}, nil
+	}
+	if r.cache == nil {
+		return r.lookup(ctx, host)
+	}
+
+	host = strings.ToLower(host)
+	if addrs, err, ok := r.cache.get(host); ok {
+		metrics.DNSCacheHits.Inc()
+		return addrs, err
+	}
+	metrics.DNSCacheMisses.Inc()
+	ttls := &ttlRecorder{}
+	addrs, err := r.lookup(context.WithValue(ctx, ttlRecorderKey{}, ttls), host)
+	r.cache.add(host, addrs, err, ttls)
+	return addrs, err
+}
+
+// lookup queries the nameservers for the addresses of host.
+func (r *Resolver) lookup(ctx context.Context, host string) ([]netip.Addr, error) {
+	start := time.Now()
+	addrs, err := r.resolver.LookupNetIP(ctx, "ip", host)
+	metrics.DNSLookupDuration.WithLabelValues(r.label).Observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.DNSLookupFailures.WithLabelValues(failureReason(err)).Inc()
+		return nil, err
+	}
+	for i, addr := range addrs {
+		addrs[i] = addr.Unmap()
+	}
+	return addrs, nil
+}
+
+// failureReason returns the metric label for a lookup error.
+func failureReason(err error) string {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		switch {
+		case dnsErr.IsNotFound:
+			return "not_found"
+		case dnsErr.IsTimeout:
+			return "timeout"
+		}
+	}
+	return "error"
+}
+
+// AddrCheck decides whether an address a host resolved to may be dialed,
+// returning a non-nil error to refuse it.
+type AddrCheck func(host string, addr netip.AddrPort) error
+
+// addrCheckKey is the context key for the AddrCheck of a dial.
+type addrCheckKey struct{}
+
+// ContextWithAddrCheck returns a context whose dials through a Resolver only
+// connect when check accepts every address the host resolved to.
+func ContextWithAddrCheck(ctx context.Context, check AddrCheck) context.Context {
+	return context.WithValue(ctx, addrCheckKey{}, check)
+}
+
+// CheckAddrs applies the AddrCheck of ctx, if any, to the addresses host
+// resolved to, returning the error of the first one refused.
+func CheckAddrs(ctx context.Context, host string, port int, addrs []netip.Addr) error {
+	check, ok := ctx.Value(addrCheckKey{}).(AddrCheck)
+	if !ok {
+		return nil
+	}
+	for _, addr := range addrs {
+		if err := check(host, netip.AddrPortFrom(addr, uint16(port))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DialContext resolves the host of address and connects to its addresses in
+// order with dialer until one succeeds. When the dialer is bound to a local
+// address, only addresses of the same family are tried. The addresses are
+// checked with the AddrCheck of ctx and dialed as literals, so the host
+// cannot be re-resolved to another address between the check and the dial.
+func (r *Resolver) DialContext(ctx context.Context, dialer *net.Dialer, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if dialer.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dialer.Timeout)
+		defer cancel()
+	}
+
+	addrs, err := r.LookupNetIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	portNum, _ := strconv.Atoi(port)
+	if err := CheckAddrs(ctx, host, portNum, addrs); err != nil {
+		return nil, err
+	}
+	if local, ok := dialer.LocalAddr.(*net.TCPAddr); ok && local != nil && local.IP != nil {
+		addrs = SameFamily(addrs, local.IP.To4() != nil)
+		if len(addrs) == 0 {
+			return nil, &net.OpError{Op: "dial", Net: network, Source: local, Err: &net.AddrError{Err: "no suitable address found", Addr: host}}
+		}
+	}
+
+	var lastErr error
+	for _, addr := range addrs {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(addr.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// SameFamily returns the IPv4 addresses of addrs, or the IPv6 ones when ipv4
+// is false.
+func SameFamily(addrs []netip.Addr, ipv4 bool) []netip.Addr {
+	result := make([]netip.Addr, 0, len(addrs))
+	for _, addr := range addrs {
+		if addr.Is4() == ipv4 {
+			result = append(result, addr)
+		}
+	}
+	return result
+}
+
+// Resolvers holds the default resolver and the resolvers of outbound IPs
+// that have their own nameservers.
+type Resolvers struct {
+	def   *Resolver
+	perIP map[netip.Addr]*Resolver
+}
+
+// NewResolvers creates the resolvers for the default nameservers and the
+// per-IP nameservers, each with its own cache. Queries of an outbound IP with
+// its own nameservers are sent from that IP. Entries of invalid IPs are
+// ignored.
+func NewResolvers(nameservers []string, perIP map[string][]string, cacheOpts CacheOptions) *Resolvers {
+	rs := &Resolvers{
+		def:   New(nameservers, "", cacheOpts),
+		perIP: make(map[netip.Addr]*Resolver, len(perIP)),
+	}
+	for ip, servers := range perIP {
+		addr, err := netutil.ParseAddr(ip)
+		if err != nil {
+			continue
+		}
+		rs.perIP[addr] = New(servers, ip, cacheOpts)
+	}
+	return rs
+}
+
+// Default returns the resolver used when no outbound IP is involved.
+func (rs *Resolvers) Default() *Resolver {
+	return rs.def
+}
+
+// For returns the resolver for connections through ip.
+func (rs *Resolvers) For(ip netip.Addr) *Resolver {
+	if r, ok := rs.perIP[ip]; ok {
+		return r
+	}
+	return rs.def
+}
+
+// Families reports which address families addrs contain.
+func Families(addrs []netip.Addr) (ipv4, ipv6 bool) {
+	for _, addr := range addrs {
+		if addr.Is4() {
+			ipv4 = true
+		} else {
+			ipv6 = true
+		}
+	}
+	return ipv4, ipv6
+}
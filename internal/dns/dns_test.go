@@ -0,0 +1,160 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// startNameserver serves A queries on a loopback UDP port, answering names
+// in records and NXDOMAIN for others. It returns the address and the number
+// of queries received.
+func startNameserver(t *testing.T, records map[string]netip.Addr) (string, *atomic.Int32) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	var queries atomic.Int32
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var msg dnsmessage.Message
+			if err := msg.Unpack(buf[:n]); err != nil || len(msg.Questions) != 1 {
+				continue
+			}
+			queries.Add(1)
+			q := msg.Questions[0]
+			msg.Header.Response = true
+			msg.Header.RecursionAvailable = true
+			name := strings.TrimSuffix(q.Name.String(), ".")
+			ip, ok := records[name]
+			switch {
+			case !ok:
+				msg.Header.RCode = dnsmessage.RCodeNameError
+			case q.Type == dnsmessage.TypeA && ip.Is4():
+				msg.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+					Body:   &dnsmessage.AResource{A: ip.As4()},
+				}}
+			}
+			out, err := msg.Pack()
+			if err != nil {
+				continue
+			}
+			pc.WriteTo(out, addr)
+		}
+	}()
+	return pc.LocalAddr().String(), &queries
+}
+
+func TestNameserverAddr(t *testing.T) {
+	tests := map[string]string{
+		"1.1.1.1":                   "1.1.1.1:53",
+		"1.1.1.1:5353":              "1.1.1.1:5353",
+		"2606:4700:4700::1111":      "[2606:4700:4700::1111]:53",
+		"[2606:4700:4700::1111]:53": "[2606:4700:4700::1111]:53",
+	}
+	for in, want := range tests {
+		if got := NameserverAddr(in); got != want {
+			t.Errorf("NameserverAddr(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestResolver_Custom(t *testing.T) {
+	ns, queries := startNameserver(t, map[string]netip.Addr{
+		"api.example.test": netip.MustParseAddr("192.0.2.10"),
+	})
+	r := New([]string{ns}, "127.0.0.1", CacheOptions{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := r.LookupNetIP(ctx, "api.example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != netip.MustParseAddr("192.0.2.10") {
+		t.Errorf("LookupNetIP() = %v, want [192.0.2.10]", addrs)
+	}
+	if queries.Load() == 0 {
+		t.Error("the custom nameserver was not queried")
+	}
+
+	_, err = r.LookupNetIP(ctx, "missing.example.test")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("LookupNetIP(missing) error = %v, want not found", err)
+	}
+
+	// IP literals are not looked up
+	before := queries.Load()
+	if addrs, err := r.LookupNetIP(ctx, "::ffff:192.0.2.1"); err != nil || addrs[0] != netip.MustParseAddr("192.0.2.1") {
+		t.Errorf("LookupNetIP(literal) = %v, %v", addrs, err)
+	}
+	if queries.Load() != before {
+		t.Error("an IP literal was looked up")
+	}
+}
+
+func TestResolver_DialContext(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	ns, _ := startNameserver(t, map[string]netip.Addr{
+		"backend.example.test": netip.MustParseAddr("127.0.0.1"),
+	})
+	r := New([]string{ns}, "", CacheOptions{})
+
+	dialer := &net.Dialer{Timeout: 5 * time.Second, LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}}
+	conn, err := r.DialContext(context.Background(), dialer, "tcp", net.JoinHostPort("backend.example.test", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := conn.RemoteAddr().String(); got != ln.Addr().String() {
+		t.Errorf("connected to %s, want %s", got, ln.Addr())
+	}
+	conn.Close()
+
+	// An IPv6 local address cannot reach an IPv4-only host
+	dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP("::1")}
+	if _, err := r.DialContext(context.Background(), dialer, "tcp", net.JoinHostPort("backend.example.test", port)); err == nil {
+		t.Error("DialContext() from ::1 to an IPv4-only host succeeded")
+	}
+}
+
+func TestResolvers_For(t *testing.T) {
+	rs := NewResolvers(nil, map[string][]string{"192.0.2.1": {"192.0.2.53"}}, CacheOptions{})
+	if rs.For(netip.MustParseAddr("192.0.2.1")) == rs.Default() {
+		t.Error("IP with its own nameservers got the default resolver")
+	}
+	if rs.For(netip.MustParseAddr("192.0.2.2")) != rs.Default() {
+		t.Error("IP without nameservers did not get the default resolver")
+	}
+}
@@ -0,0 +1,426 @@
+// Package gossip provides cluster membership over UDP gossip, through which
+// instances exchange their connection counts per outbound IP.
+package gossip
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mrand "math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/logger"
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
+)
+
+const (
+	// fanout is how many random members each round is sent to, on top of
+	// the seed peers.
+	fanout = 3
+	// deadAfter is how many intervals a member may go without a newer state
+	// before it is considered gone.
+	deadAfter = 5
+	// maxPacket is the largest message sent or accepted.
+	maxPacket = 64 * 1024
+)
+
+// state is what a member announces about itself. Seq grows with every round
+// of its owner, so that newer states replace older ones however they travel.
+type state struct {
+	ID     string           `json:"id"`
+	Addr   string           `json:"addr,omitempty"` // empty for the sender
+	Seq    uint64           `json:"seq"`
+	Counts map[string]int64 `json:"counts,omitempty"`
+	Left   bool             `json:"left,omitempty"`
+}
+
+// message is a gossip packet: the state of the sender and of every member it
+// knows.
+type message struct {
+	From   string  `json:"from"`
+	States []state `json:"states"`
+}
+
+// tombstone is a member gone, kept so that stale states of it still
+// gossiped by others do not bring it back.
+type tombstone struct {
+	seq uint64
+	at  time.Time
+}
+
+// member is another instance of the cluster.
+type member struct {
+	addr    *net.UDPAddr
+	seq     uint64
+	counts  map[string]int64     // as received, relayed to other members
+	perIP   map[netip.Addr]int64 // counts with valid IPs
+	updated time.Time            // last time a newer state arrived
+}
+
+// Config configures a Node.
+type Config struct {
+	// Bind is the UDP address to listen on, e.g. ":7946".
+	Bind string
+	// Peers are the host:port addresses of members to join through. They
+	// are contacted every round, so partitions heal once they are reachable.
+	Peers []string
+	// Interval is how often the state is gossiped.
+	Interval time.Duration
+	// Secret authenticates the messages with HMAC-SHA256 (empty sends them
+	// unauthenticated). Every member must use the same secret.
+	Secret string
+}
+
+// Node is the membership of this instance in a cluster. Every interval, it
+// sends its connection counts and those of the members it knows to a few
+// random members and to the seed peers, so that counts reach the whole
+// cluster within a few rounds. Members whose state stops advancing are
+// dropped after a few intervals, and their counts with them.
+type Node struct {
+	cfg      Config
+	id       string
+	conn     *net.UDPConn
+	local    func() map[netip.Addr]int64
+	onUpdate func(map[netip.Addr]int64)
+	seq      uint64
+	members  map[string]*member
+	dead     map[string]tombstone
+	mu       sync.Mutex
+	stopCh   chan struct{}
+	wg       sync.WaitGroup
+}
+
+// New creates a node listening on cfg.Bind. local returns the connection
+// counts of this instance per IP; onUpdate receives the counts of the other
+// members summed per IP whenever they change.
+func New(cfg Config, local func() map[netip.Addr]int64, onUpdate func(map[netip.Addr]int64)) (*Node, error) {
+	addr, err := net.ResolveUDPAddr("udp", cfg.Bind)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cluster bind address: %w", err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("cluster listen: %w", err)
+	}
+
+	host, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return &Node{
+		cfg:      cfg,
+		id:       host + "-" + hex.EncodeToString(suffix),
+		conn:     conn,
+		local:    local,
+		onUpdate: onUpdate,
+		// Restarted members announce a higher seq than before the restart
+		seq:     uint64(time.Now().UnixNano()),
+		members: make(map[string]*member),
+		dead:    make(map[string]tombstone),
+		stopCh:  make(chan struct{}),
+	}, nil
+}
+
+// Addr returns the address the node listens on.
+func (n *Node) Addr() net.Addr {
+	return n.conn.LocalAddr()
+}
+
+// Start starts receiving and gossiping.
+func (n *Node) Start() {
+	n.wg.Add(2)
+	go n.receiveLoop()
+	go n.gossipLoop()
+}
+
+// Stop announces that this instance leaves, so that members drop its counts
+// right away, and stops the node.
+func (n *Node) Stop() {
+	close(n.stopCh)
+
+	n.mu.Lock()
+	n.seq++
+	msg := message{From: n.id, States: []state{{ID: n.id, Seq: n.seq, Left: true}}}
+	targets := n.targetsLocked(len(n.members))
+	n.mu.Unlock()
+	n.send(msg, n.withPeers(targets))
+
+	n.conn.Close()
+	n.wg.Wait()
+}
+
+// Members returns the number of other members currently known.
+func (n *Node) Members() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.members)
+}
+
+func (n *Node) gossipLoop() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(n.cfg.Interval)
+	defer ticker.Stop()
+
+	n.round()
+	for {
+		select {
+		case <-ticker.C:
+			n.round()
+		case <-n.stopCh:
+			return
+		}
+	}
+}
+
+// round expires the members gone silent and gossips the known states.
+func (n *Node) round() {
+	counts := make(map[string]int64)
+	for ip, c := range n.local() {
+		counts[ip.String()] = c
+	}
+	now := time.Now()
+	n.mu.Lock()
+	changed := false
+	for id, m := range n.members {
+		if now.Sub(m.updated) > deadAfter*n.cfg.Interval {
+			n.removeLocked(id, m.seq)
+			logger.Info("cluster_member_failed", "member", id, "addr", m.addr.String())
+			changed = true
+		}
+	}
+	for id, t := range n.dead {
+		// By then every member has dropped it as well
+		if now.Sub(t.at) > 2*deadAfter*n.cfg.Interval {
+			delete(n.dead, id)
+		}
+	}
+
+	n.seq++
+	msg := message{From: n.id, States: []state{{ID: n.id, Seq: n.seq, Counts: counts}}}
+	for id, m := range n.members {
+		msg.States = append(msg.States, state{ID: id, Addr: m.addr.String(), Seq: m.seq, Counts: m.counts})
+	}
+	targets := n.targetsLocked(fanout)
+	totals := n.totalsLocked()
+	n.mu.Unlock()
+
+	if changed {
+		n.onUpdate(totals)
+	}
+	n.send(msg, n.withPeers(targets))
+}
+
+// targetsLocked returns up to count random members. Must be called with mu
+// held.
+func (n *Node) targetsLocked(count int) []*net.UDPAddr {
+	ids := make([]string, 0, len(n.members))
+	for id := range n.members {
+		ids = append(ids, id)
+	}
+	mrand.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+
+	targets := make([]*net.UDPAddr, 0, min(count, len(ids)))
+	for i := 0; i < len(ids) && i < count; i++ {
+		targets = append(targets, n.members[ids[i]].addr)
+	}
+	return targets
+}
+
+// withPeers adds the seed peers not already in targets. Peers are resolved
+// every time, so that DNS names follow rescheduled members.
+func (n *Node) withPeers(targets []*net.UDPAddr) []*net.UDPAddr {
+	seen := make(map[string]bool, len(targets))
+	for _, addr := range targets {
+		seen[addr.String()] = true
+	}
+	for _, peer := range n.cfg.Peers {
+		addr, err := net.ResolveUDPAddr("udp", peer)
+		if err != nil {
+			logger.Debug("cluster_peer_unresolved", "peer", peer, "error", err)
+			continue
+		}
+		if !seen[addr.String()] {
+			seen[addr.String()] = true
+			targets = append(targets, addr)
+		}
+	}
+	return targets
+}
+
+// send writes msg to every target.
+func (n *Node) send(msg message, targets []*net.UDPAddr) {
+	if len(targets) == 0 {
+		return
+	}
+	packet, err := n.encode(msg)
+	if err != nil {
+		logger.Warn("cluster_message_too_large", "error", err)
+		return
+	}
+	for _, addr := range targets {
+		if _, err := n.conn.WriteToUDP(packet, addr); err != nil {
+			logger.Debug("cluster_send_failed", "addr", addr.String(), "error", err)
+		}
+	}
+}
+
+// encode marshals msg, prefixed with its HMAC when a secret is set.
+func (n *Node) encode(msg message) ([]byte, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	if n.cfg.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(n.cfg.Secret))
+		mac.Write(data)
+		data = append(mac.Sum(nil), data...)
+	}
+	if len(data) > maxPacket {
+		return nil, fmt.Errorf("%d bytes (at most %d)", len(data), maxPacket)
+	}
+	return data, nil
+}
+
+// errInvalidMAC is returned for messages not signed with the secret.
+var errInvalidMAC = errors.New("invalid message authentication code")
+
+// decode verifies and unmarshals a packet.
+func (n *Node) decode(packet []byte) (message, error) {
+	var msg message
+	if n.cfg.Secret != "" {
+		if len(packet) < sha256.Size {
+			return msg, errInvalidMAC
+		}
+		mac := hmac.New(sha256.New, []byte(n.cfg.Secret))
+		mac.Write(packet[sha256.Size:])
+		if !hmac.Equal(mac.Sum(nil), packet[:sha256.Size]) {
+			return msg, errInvalidMAC
+		}
+		packet = packet[sha256.Size:]
+	}
+	err := json.Unmarshal(packet, &msg)
+	return msg, err
+}
+
+func (n *Node) receiveLoop() {
+	defer n.wg.Done()
+
+	buf := make([]byte, maxPacket)
+	for {
+		size, src, err := n.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-n.stopCh:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Debug("cluster_receive_failed", "error", err)
+			continue
+		}
+		msg, err := n.decode(buf[:size])
+		if err != nil {
+			metrics.ClusterInvalidMessages.Inc()
+			logger.Debug("cluster_message_invalid", "addr", src.String(), "error", err)
+			continue
+		}
+		n.merge(msg, src)
+	}
+}
+
+// merge applies the states of msg that are newer than the known ones.
+func (n *Node) merge(msg message, src *net.UDPAddr) {
+	now := time.Now()
+	n.mu.Lock()
+	changed := false
+	for _, s := range msg.States {
+		if s.ID == n.id || s.ID == "" {
+			continue
+		}
+		m := n.members[s.ID]
+		if (m != nil && s.Seq <= m.seq) || (m == nil && s.Seq <= n.dead[s.ID].seq) {
+			continue
+		}
+		if s.Left {
+			if m != nil {
+				logger.Info("cluster_member_left", "member", s.ID, "addr", m.addr.String())
+			}
+			n.removeLocked(s.ID, s.Seq)
+			changed = true
+			continue
+		}
+
+		addr := src
+		if s.ID != msg.From {
+			var err error
+			if addr, err = net.ResolveUDPAddr("udp", s.Addr); err != nil {
+				continue
+			}
+		}
+		if m == nil {
+			m = &member{}
+			n.members[s.ID] = m
+			delete(n.dead, s.ID)
+			logger.Info("cluster_member_joined", "member", s.ID, "addr", addr.String())
+		}
+		if s.ID == msg.From || m.addr == nil {
+			m.addr = addr
+		}
+		m.seq = s.Seq
+		m.counts = s.Counts
+		m.perIP = parseCounts(s.Counts)
+		m.updated = now
+		changed = true
+	}
+	totals := n.totalsLocked()
+	n.mu.Unlock()
+
+	if changed {
+		n.onUpdate(totals)
+	}
+}
+
+// removeLocked drops a member and leaves a tombstone. Must be called with
+// mu held.
+func (n *Node) removeLocked(id string, seq uint64) {
+	delete(n.members, id)
+	n.dead[id] = tombstone{seq: seq, at: time.Now()}
+}
+
+// totalsLocked sums the counts of the members per IP and updates the member
+// gauge. Must be called with mu held.
+func (n *Node) totalsLocked() map[netip.Addr]int64 {
+	totals := make(map[netip.Addr]int64)
+	for _, m := range n.members {
+		for ip, c := range m.perIP {
+			totals[ip] += c
+		}
+	}
+	metrics.ClusterMembers.Set(float64(len(n.members)))
+	return totals
+}
+
+// parseCounts keys counts received from a member by IP, dropping entries
+// that are not valid IPs.
+func parseCounts(counts map[string]int64) map[netip.Addr]int64 {
+	perIP := make(map[netip.Addr]int64, len(counts))
+	for ip, c := range counts {
+		addr, err := netutil.ParseAddr(ip)
+		if err != nil {
+			continue
+		}
+		perIP[addr] += c
+	}
+	return perIP
+}
@@ -0,0 +1,114 @@
+package gossip
+
+import (
+	"maps"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testNode is a node with fixed local counts, recording the peer counts it
+// receives.
+type testNode struct {
+	*Node
+	mu     sync.Mutex
+	totals map[netip.Addr]int64
+}
+
+func (tn *testNode) peerTotals() map[netip.Addr]int64 {
+	tn.mu.Lock()
+	defer tn.mu.Unlock()
+	return maps.Clone(tn.totals)
+}
+
+func startNode(t *testing.T, secret string, counts map[netip.Addr]int64, peers ...string) *testNode {
+	t.Helper()
+	tn := &testNode{}
+	node, err := New(Config{Bind: "127.0.0.1:0", Peers: peers, Interval: 20 * time.Millisecond, Secret: secret},
+		func() map[netip.Addr]int64 { return counts },
+		func(totals map[netip.Addr]int64) {
+			tn.mu.Lock()
+			tn.totals = totals
+			tn.mu.Unlock()
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tn.Node = node
+	node.Start()
+	return tn
+}
+
+// waitFor polls cond until it holds or a second passes.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNode_ExchangesCounts(t *testing.T) {
+	a := startNode(t, "s3cret", map[netip.Addr]int64{netip.MustParseAddr("10.0.0.1"): 2})
+	defer a.Stop()
+	seed := a.Addr().String()
+	b := startNode(t, "s3cret", map[netip.Addr]int64{netip.MustParseAddr("10.0.0.1"): 3, netip.MustParseAddr("10.0.0.2"): 1}, seed)
+	defer b.Stop()
+	// c only knows a, and learns about b through it
+	c := startNode(t, "s3cret", map[netip.Addr]int64{netip.MustParseAddr("10.0.0.2"): 4}, seed)
+	defer c.Stop()
+
+	waitFor(t, "full membership", func() bool {
+		return a.Members() == 2 && b.Members() == 2 && c.Members() == 2
+	})
+	waitFor(t, "peer counts", func() bool {
+		got := a.peerTotals()
+		return got[netip.MustParseAddr("10.0.0.1")] == 3 && got[netip.MustParseAddr("10.0.0.2")] == 5
+	})
+	waitFor(t, "peer counts through gossip", func() bool {
+		got := c.peerTotals()
+		return got[netip.MustParseAddr("10.0.0.1")] == 5 && got[netip.MustParseAddr("10.0.0.2")] == 1
+	})
+}
+
+func TestNode_Leave(t *testing.T) {
+	a := startNode(t, "", map[netip.Addr]int64{})
+	defer a.Stop()
+	b := startNode(t, "", map[netip.Addr]int64{netip.MustParseAddr("10.0.0.1"): 3}, a.Addr().String())
+
+	waitFor(t, "join", func() bool { return a.peerTotals()[netip.MustParseAddr("10.0.0.1")] == 3 })
+	b.Stop()
+	waitFor(t, "leave", func() bool { return a.Members() == 0 && a.peerTotals()[netip.MustParseAddr("10.0.0.1")] == 0 })
+
+	// Stale states of the member gone do not bring it back
+	a.mu.Lock()
+	_, dead := a.dead[b.id]
+	a.mu.Unlock()
+	if !dead {
+		t.Error("expected a tombstone for the member that left")
+	}
+}
+
+func TestNode_RejectsWrongSecret(t *testing.T) {
+	a := startNode(t, "s3cret", map[netip.Addr]int64{})
+	defer a.Stop()
+	b := startNode(t, "other", map[netip.Addr]int64{netip.MustParseAddr("10.0.0.1"): 3}, a.Addr().String())
+	defer b.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+	if a.Members() != 0 {
+		t.Errorf("expected messages with a wrong secret to be dropped, got %d members", a.Members())
+	}
+}
+
+func TestParseCounts(t *testing.T) {
+	got := parseCounts(map[string]int64{"10.0.0.1": 2, "::ffff:10.0.0.1": 1, "bogus": 5})
+	want := map[netip.Addr]int64{netip.MustParseAddr("10.0.0.1"): 3}
+	if !maps.Equal(got, want) {
+		t.Errorf("parseCounts() = %v, want %v", got, want)
+	}
+}
@@ -5,13 +5,17 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/netip"
 	"time"
+
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
 )
 
 // HTTPChecker implements health checking via HTTP request.
 type HTTPChecker struct {
-	url     string // Full URL (e.g., "http://httpbin.org/status/200")
-	timeout time.Duration
+	url      string // Full URL (e.g., "http://httpbin.org/status/200")
+	timeout  time.Duration
+	sockopts map[netip.Addr]netutil.SocketOptions
 }
 
 // NewHTTPChecker creates a new HTTP health checker.
@@ -22,16 +26,22 @@ func NewHTTPChecker(url string, timeout time.Duration) *HTTPChecker {
 	}
 }
 
+// WithSocketOptions sets socket options on the checks from the IPs in opts,
+// as on their proxied connections.
+func (c *HTTPChecker) WithSocketOptions(opts map[netip.Addr]netutil.SocketOptions) *HTTPChecker {
+	c.sockopts = opts
+	return c
+}
+
 // Check performs an HTTP GET health check from the given source IP.
-func (c *HTTPChecker) Check(ctx context.Context, sourceIP string) error {
+func (c *HTTPChecker) Check(ctx context.Context, sourceIP netip.Addr) error {
 	// Create a transport with the source IP bound
 	transport := &http.Transport{
 		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
 			dialer := &net.Dialer{
-				LocalAddr: &net.TCPAddr{
-					IP: net.ParseIP(sourceIP),
-				},
-				Timeout: c.timeout,
+				LocalAddr: net.TCPAddrFromAddrPort(netip.AddrPortFrom(sourceIP, 0)),
+				Timeout:   c.timeout,
+				Control:   c.sockopts[sourceIP].Control(),
 			}
 			return dialer.DialContext(ctx, network, addr)
 		},
@@ -4,6 +4,7 @@ import (
 	"context"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"testing"
 	"time"
 )
@@ -17,7 +18,7 @@ func TestHTTPChecker_Check_Success(t *testing.T) {
 	checker := NewHTTPChecker(server.URL, 5*time.Second)
 
 	ctx := context.Background()
-	err := checker.Check(ctx, "127.0.0.1")
+	err := checker.Check(ctx, netip.MustParseAddr("127.0.0.1"))
 
 	if err != nil {
 		t.Errorf("expected check to succeed, got error: %v", err)
@@ -33,7 +34,7 @@ func TestHTTPChecker_Check_Redirect(t *testing.T) {
 	checker := NewHTTPChecker(server.URL, 5*time.Second)
 
 	ctx := context.Background()
-	err := checker.Check(ctx, "127.0.0.1")
+	err := checker.Check(ctx, netip.MustParseAddr("127.0.0.1"))
 
 	// 3xx should be considered success
 	if err != nil {
@@ -50,7 +51,7 @@ func TestHTTPChecker_Check_ServerError(t *testing.T) {
 	checker := NewHTTPChecker(server.URL, 5*time.Second)
 
 	ctx := context.Background()
-	err := checker.Check(ctx, "127.0.0.1")
+	err := checker.Check(ctx, netip.MustParseAddr("127.0.0.1"))
 
 	if err == nil {
 		t.Error("expected 500 to fail check")
@@ -66,7 +67,7 @@ func TestHTTPChecker_Check_ClientError(t *testing.T) {
 	checker := NewHTTPChecker(server.URL, 5*time.Second)
 
 	ctx := context.Background()
-	err := checker.Check(ctx, "127.0.0.1")
+	err := checker.Check(ctx, netip.MustParseAddr("127.0.0.1"))
 
 	if err == nil {
 		t.Error("expected 404 to fail check")
@@ -78,7 +79,7 @@ func TestHTTPChecker_Check_ConnectionRefused(t *testing.T) {
 	checker := NewHTTPChecker("http://127.0.0.1:59999/health", 1*time.Second)
 
 	ctx := context.Background()
-	err := checker.Check(ctx, "127.0.0.1")
+	err := checker.Check(ctx, netip.MustParseAddr("127.0.0.1"))
 
 	if err == nil {
 		t.Error("expected connection refused to fail check")
@@ -96,7 +97,7 @@ func TestHTTPChecker_Check_Timeout(t *testing.T) {
 	checker := NewHTTPChecker(server.URL, 100*time.Millisecond)
 
 	ctx := context.Background()
-	err := checker.Check(ctx, "127.0.0.1")
+	err := checker.Check(ctx, netip.MustParseAddr("127.0.0.1"))
 
 	if err == nil {
 		t.Error("expected timeout to fail check")
@@ -115,7 +116,7 @@ func TestHTTPChecker_Check_ContextCancellation(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	cancel() // Cancel immediately
 
-	err := checker.Check(ctx, "127.0.0.1")
+	err := checker.Check(ctx, netip.MustParseAddr("127.0.0.1"))
 
 	if err == nil {
 		t.Error("expected context cancellation to fail check")
@@ -126,7 +127,7 @@ func TestHTTPChecker_Check_InvalidURL(t *testing.T) {
 	checker := NewHTTPChecker("://invalid-url", 1*time.Second)
 
 	ctx := context.Background()
-	err := checker.Check(ctx, "127.0.0.1")
+	err := checker.Check(ctx, netip.MustParseAddr("127.0.0.1"))
 
 	if err == nil {
 		t.Error("expected invalid URL to fail check")
@@ -4,13 +4,17 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"net/netip"
 	"time"
+
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
 )
 
 // TCPChecker implements health checking via TCP connection.
 type TCPChecker struct {
-	target  string // host:port (e.g., "1.1.1.1:443")
-	timeout time.Duration
+	target   string // host:port (e.g., "1.1.1.1:443")
+	timeout  time.Duration
+	sockopts map[netip.Addr]netutil.SocketOptions
 }
 
 // NewTCPChecker creates a new TCP health checker.
@@ -21,14 +25,20 @@ func NewTCPChecker(target string, timeout time.Duration) *TCPChecker {
 	}
 }
 
+// WithSocketOptions sets socket options on the checks from the IPs in opts,
+// as on their proxied connections.
+func (c *TCPChecker) WithSocketOptions(opts map[netip.Addr]netutil.SocketOptions) *TCPChecker {
+	c.sockopts = opts
+	return c
+}
+
 // Check performs a TCP connection health check from the given source IP.
-func (c *TCPChecker) Check(ctx context.Context, sourceIP string) error {
+func (c *TCPChecker) Check(ctx context.Context, sourceIP netip.Addr) error {
 	// Create a dialer with the source IP
 	dialer := &net.Dialer{
-		LocalAddr: &net.TCPAddr{
-			IP: net.ParseIP(sourceIP),
-		},
-		Timeout: c.timeout,
+		LocalAddr: net.TCPAddrFromAddrPort(netip.AddrPortFrom(sourceIP, 0)),
+		Timeout:   c.timeout,
+		Control:   c.sockopts[sourceIP].Control(),
 	}
 
 	// Dial with context
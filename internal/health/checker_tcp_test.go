@@ -3,6 +3,7 @@ package health
 import (
 	"context"
 	"net"
+	"net/netip"
 	"testing"
 	"time"
 )
@@ -29,7 +30,7 @@ func TestTCPChecker_Check_Success(t *testing.T) {
 	checker := NewTCPChecker(listener.Addr().String(), 5*time.Second)
 
 	ctx := context.Background()
-	err = checker.Check(ctx, "127.0.0.1")
+	err = checker.Check(ctx, netip.MustParseAddr("127.0.0.1"))
 
 	if err != nil {
 		t.Errorf("expected check to succeed, got error: %v", err)
@@ -41,7 +42,7 @@ func TestTCPChecker_Check_Failure(t *testing.T) {
 	checker := NewTCPChecker("127.0.0.1:59999", 1*time.Second)
 
 	ctx := context.Background()
-	err := checker.Check(ctx, "127.0.0.1")
+	err := checker.Check(ctx, netip.MustParseAddr("127.0.0.1"))
 
 	if err == nil {
 		t.Error("expected check to fail, but it succeeded")
@@ -56,7 +57,7 @@ func TestTCPChecker_Check_Timeout(t *testing.T) {
 	defer cancel()
 
 	start := time.Now()
-	err := checker.Check(ctx, "127.0.0.1")
+	err := checker.Check(ctx, netip.MustParseAddr("127.0.0.1"))
 	elapsed := time.Since(start)
 
 	if err == nil {
@@ -83,7 +84,7 @@ func TestTCPChecker_Check_ContextCancellation(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	cancel()
 
-	err = checker.Check(ctx, "127.0.0.1")
+	err = checker.Check(ctx, netip.MustParseAddr("127.0.0.1"))
 
 	if err == nil {
 		t.Error("expected check to fail due to context cancellation")
@@ -3,7 +3,9 @@ package health
 
 import (
 	"context"
+	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cr0hn/outbound-lb/internal/logger"
@@ -14,40 +16,46 @@ import (
 type Checker interface {
 	// Check performs a health check from the given source IP.
 	// Returns nil if the check succeeds, error otherwise.
-	Check(ctx context.Context, sourceIP string) error
+	Check(ctx context.Context, sourceIP netip.Addr) error
 }
 
 // HealthCheckerConfig holds configuration for the HealthChecker.
 type HealthCheckerConfig struct {
-	IPs              []string
+	IPs              []netip.Addr
 	Checker          Checker
 	Interval         time.Duration
 	Timeout          time.Duration
 	FailureThreshold int
 	SuccessThreshold int
+	// RetryAfter lets traffic through to unhealthy IPs again once they have not
+	// been observed for this long, and through recovering IPs at all times.
+	// Used with passive checks only, where traffic is the only way to recover.
+	RetryAfter time.Duration
 }
 
 // HealthChecker manages health checking for multiple IPs.
 type HealthChecker struct {
 	config   HealthCheckerConfig
-	statuses map[string]*IPStatus
+	statuses map[netip.Addr]*IPStatus
 	stopCh   chan struct{}
 	wg       sync.WaitGroup
 	mu       sync.RWMutex
+	// onStateChange is called when an IP changes state (nil when unset).
+	onStateChange atomic.Pointer[func(ip netip.Addr, state HealthState, err error)]
 }
 
 // NewHealthChecker creates a new HealthChecker.
 func NewHealthChecker(cfg HealthCheckerConfig) *HealthChecker {
 	hc := &HealthChecker{
 		config:   cfg,
-		statuses: make(map[string]*IPStatus, len(cfg.IPs)),
+		statuses: make(map[netip.Addr]*IPStatus, len(cfg.IPs)),
 		stopCh:   make(chan struct{}),
 	}
 
 	for _, ip := range cfg.IPs {
-		hc.statuses[ip] = NewIPStatus(ip)
+		hc.statuses[ip] = NewIPStatus(ip.String())
 		// Initialize metrics
-		metrics.IPHealthStatus.WithLabelValues(ip).Set(1) // Start as healthy
+		metrics.IPHealthStatus.WithLabelValues(ip.String()).Set(1) // Start as healthy
 	}
 
 	return hc
@@ -72,8 +80,36 @@ func (hc *HealthChecker) Stop() {
 	logger.Info("health_checker_stopped")
 }
 
+// AddIP starts checking ip. It starts as healthy and is checked from the
+// next round on.
+func (hc *HealthChecker) AddIP(ip netip.Addr) {
+	hc.mu.Lock()
+	if _, ok := hc.statuses[ip]; ok {
+		hc.mu.Unlock()
+		return
+	}
+	hc.statuses[ip] = NewIPStatus(ip.String())
+	hc.mu.Unlock()
+
+	metrics.IPHealthStatus.WithLabelValues(ip.String()).Set(1)
+	hc.updateAggregateMetrics()
+}
+
+// RemoveIP stops checking ip and drops its health state.
+func (hc *HealthChecker) RemoveIP(ip netip.Addr) {
+	hc.mu.Lock()
+	status, ok := hc.statuses[ip]
+	delete(hc.statuses, ip)
+	hc.mu.Unlock()
+
+	if ok {
+		metrics.IPHealthStatus.DeleteLabelValues(status.IP)
+		hc.updateAggregateMetrics()
+	}
+}
+
 // IsHealthy returns true if the IP is in a healthy state.
-func (hc *HealthChecker) IsHealthy(ip string) bool {
+func (hc *HealthChecker) IsHealthy(ip netip.Addr) bool {
 	hc.mu.RLock()
 	status, ok := hc.statuses[ip]
 	hc.mu.RUnlock()
@@ -81,30 +117,72 @@ func (hc *HealthChecker) IsHealthy(ip string) bool {
 	if !ok {
 		return true // Unknown IPs are considered healthy
 	}
-	return status.IsHealthy()
+	return hc.usable(status)
+}
+
+// usable reports whether traffic may be sent through the IP.
+func (hc *HealthChecker) usable(status *IPStatus) bool {
+	if hc.config.RetryAfter <= 0 {
+		return status.IsHealthy()
+	}
+	status.mu.RLock()
+	defer status.mu.RUnlock()
+	switch status.State {
+	case StateUnhealthy:
+		return time.Since(status.LastCheck) >= hc.config.RetryAfter
+	default:
+		return true
+	}
+}
+
+// AnyHealthy reports whether traffic may be sent through at least one of
+// the checked IPs.
+func (hc *HealthChecker) AnyHealthy() bool {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+
+	for _, status := range hc.statuses {
+		if hc.usable(status) {
+			return true
+		}
+	}
+	return false
+}
+
+// HealthySince returns when the IP last recovered from unhealthy.
+// Returns the zero time for unknown IPs and IPs that never failed.
+func (hc *HealthChecker) HealthySince(ip netip.Addr) time.Time {
+	hc.mu.RLock()
+	status, ok := hc.statuses[ip]
+	hc.mu.RUnlock()
+
+	if !ok {
+		return time.Time{}
+	}
+	return status.GetHealthySince()
 }
 
 // healthyIPsPool is a pool for slices used in GetHealthyIPs to reduce allocations.
 var healthyIPsPool = sync.Pool{
 	New: func() any {
-		s := make([]string, 0, 64)
+		s := make([]netip.Addr, 0, 64)
 		return &s
 	},
 }
 
 // GetHealthyIPs filters the given IPs and returns only the healthy ones.
 // Returns a slice from a pool; the caller should not retain the slice.
-func (hc *HealthChecker) GetHealthyIPs(ips []string) []string {
+func (hc *HealthChecker) GetHealthyIPs(ips []netip.Addr) []netip.Addr {
 	hc.mu.RLock()
 	defer hc.mu.RUnlock()
 
 	// Get slice from pool
-	resultPtr := healthyIPsPool.Get().(*[]string)
+	resultPtr := healthyIPsPool.Get().(*[]netip.Addr)
 	result := (*resultPtr)[:0]
 
 	for _, ip := range ips {
 		status, ok := hc.statuses[ip]
-		if !ok || status.IsHealthy() {
+		if !ok || hc.usable(status) {
 			result = append(result, ip)
 		}
 	}
@@ -126,6 +204,25 @@ func (hc *HealthChecker) GetAllStatus() []StatusInfo {
 	return result
 }
 
+// Info returns the health check state of all IPs for the /stats endpoint.
+func (hc *HealthChecker) Info() map[string]metrics.HealthInfo {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+
+	info := make(map[string]metrics.HealthInfo, len(hc.statuses))
+	for addr, status := range hc.statuses {
+		s := status.GetInfo()
+		info[addr.String()] = metrics.HealthInfo{
+			State:                s.State,
+			ConsecutiveFailures:  s.ConsecutiveFailures,
+			ConsecutiveSuccesses: s.ConsecutiveSuccesses,
+			LastCheck:            s.LastCheck,
+			LastError:            s.LastError,
+		}
+	}
+	return info
+}
+
 // checkLoop runs periodic health checks.
 func (hc *HealthChecker) checkLoop() {
 	defer hc.wg.Done()
@@ -151,7 +248,7 @@ func (hc *HealthChecker) checkAll() {
 	var wg sync.WaitGroup
 
 	hc.mu.RLock()
-	ips := make([]string, 0, len(hc.statuses))
+	ips := make([]netip.Addr, 0, len(hc.statuses))
 	for ip := range hc.statuses {
 		ips = append(ips, ip)
 	}
@@ -159,7 +256,7 @@ func (hc *HealthChecker) checkAll() {
 
 	for _, ip := range ips {
 		wg.Add(1)
-		go func(ip string) {
+		go func(ip netip.Addr) {
 			defer wg.Done()
 			hc.checkIP(ip)
 		}(ip)
@@ -170,7 +267,7 @@ func (hc *HealthChecker) checkAll() {
 }
 
 // checkIP performs a health check on a single IP.
-func (hc *HealthChecker) checkIP(ip string) {
+func (hc *HealthChecker) checkIP(ip netip.Addr) {
 	ctx, cancel := context.WithTimeout(context.Background(), hc.config.Timeout)
 	defer cancel()
 
@@ -179,8 +276,28 @@ func (hc *HealthChecker) checkIP(ip string) {
 	duration := time.Since(start)
 
 	// Record metrics
-	metrics.HealthCheckDuration.WithLabelValues(ip).Observe(duration.Seconds())
+	label := ip.String()
+	metrics.HealthCheckDuration.WithLabelValues(label).Observe(duration.Seconds())
+	if err != nil {
+		metrics.HealthCheckTotal.WithLabelValues(label, "failure").Inc()
+	} else {
+		metrics.HealthCheckTotal.WithLabelValues(label, "success").Inc()
+	}
+
+	hc.record(ip, err)
+	if err == nil {
+		logger.Trace("health_check_success", "ip", ip, "duration", duration)
+	}
+}
+
+// Observe feeds the outcome of real traffic through ip into the health state
+// machine (passive health checking). A nil err counts as a success.
+func (hc *HealthChecker) Observe(ip netip.Addr, err error) {
+	hc.record(ip, err)
+}
 
+// record applies a check result to the IP's state and reports state changes.
+func (hc *HealthChecker) record(ip netip.Addr, err error) {
 	hc.mu.RLock()
 	status, ok := hc.statuses[ip]
 	hc.mu.RUnlock()
@@ -190,7 +307,6 @@ func (hc *HealthChecker) checkIP(ip string) {
 	}
 
 	if err != nil {
-		metrics.HealthCheckTotal.WithLabelValues(ip, "failure").Inc()
 		changed := status.RecordFailure(err, hc.config.FailureThreshold)
 		if changed {
 			newState := status.GetState()
@@ -200,8 +316,9 @@ func (hc *HealthChecker) checkIP(ip string) {
 				"error", err.Error(),
 			)
 			if newState == StateUnhealthy {
-				metrics.IPHealthStatus.WithLabelValues(ip).Set(0)
+				metrics.IPHealthStatus.WithLabelValues(status.IP).Set(0)
 			}
+			hc.stateChanged(ip, newState, err)
 		} else {
 			logger.Debug("health_check_failed",
 				"ip", ip,
@@ -210,7 +327,6 @@ func (hc *HealthChecker) checkIP(ip string) {
 			)
 		}
 	} else {
-		metrics.HealthCheckTotal.WithLabelValues(ip, "success").Inc()
 		changed := status.RecordSuccess(hc.config.SuccessThreshold)
 		if changed {
 			newState := status.GetState()
@@ -219,14 +335,26 @@ func (hc *HealthChecker) checkIP(ip string) {
 				"state", newState.String(),
 			)
 			if newState == StateHealthy {
-				metrics.IPHealthStatus.WithLabelValues(ip).Set(1)
+				metrics.IPHealthStatus.WithLabelValues(status.IP).Set(1)
 			}
-		} else {
-			logger.Trace("health_check_success", "ip", ip, "duration", duration)
+			hc.stateChanged(ip, newState, nil)
 		}
 	}
 }
 
+// SetOnStateChange sets a function called when an IP changes state, with the
+// check error that caused it (nil for successes).
+func (hc *HealthChecker) SetOnStateChange(fn func(ip netip.Addr, state HealthState, err error)) {
+	hc.onStateChange.Store(&fn)
+}
+
+// stateChanged calls the function set by SetOnStateChange.
+func (hc *HealthChecker) stateChanged(ip netip.Addr, state HealthState, err error) {
+	if fn := hc.onStateChange.Load(); fn != nil {
+		(*fn)(ip, state, err)
+	}
+}
+
 // updateAggregateMetrics updates the aggregate health metrics.
 func (hc *HealthChecker) updateAggregateMetrics() {
 	hc.mu.RLock()
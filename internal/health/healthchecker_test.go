@@ -3,32 +3,35 @@ package health
 import (
 	"context"
 	"errors"
+	"net/netip"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
 )
 
 // mockChecker is a mock implementation of Checker for testing.
 type mockChecker struct {
 	mu         sync.Mutex
-	results    map[string]error // ip -> error (nil = success)
+	results    map[netip.Addr]error // ip -> error (nil = success)
 	checkCount atomic.Int64
 }
 
 func newMockChecker() *mockChecker {
 	return &mockChecker{
-		results: make(map[string]error),
+		results: make(map[netip.Addr]error),
 	}
 }
 
-func (m *mockChecker) SetResult(ip string, err error) {
+func (m *mockChecker) SetResult(ip netip.Addr, err error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	m.results[ip] = err
 }
 
-func (m *mockChecker) Check(ctx context.Context, sourceIP string) error {
+func (m *mockChecker) Check(ctx context.Context, sourceIP netip.Addr) error {
 	m.checkCount.Add(1)
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -196,7 +199,7 @@ func TestIPStatus_GetInfo(t *testing.T) {
 func TestHealthChecker_IsHealthy(t *testing.T) {
 	checker := newMockChecker()
 	hc := NewHealthChecker(HealthCheckerConfig{
-		IPs:              []string{"192.168.1.1", "192.168.1.2"},
+		IPs:              netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2"}),
 		Checker:          checker,
 		Interval:         time.Hour, // Long interval so we control checks manually
 		Timeout:          time.Second,
@@ -205,23 +208,59 @@ func TestHealthChecker_IsHealthy(t *testing.T) {
 	})
 
 	// All IPs should start healthy
-	if !hc.IsHealthy("192.168.1.1") {
+	if !hc.IsHealthy(netip.MustParseAddr("192.168.1.1")) {
 		t.Error("expected IP to be healthy initially")
 	}
-	if !hc.IsHealthy("192.168.1.2") {
+	if !hc.IsHealthy(netip.MustParseAddr("192.168.1.2")) {
 		t.Error("expected IP to be healthy initially")
 	}
 
 	// Unknown IPs should be considered healthy
-	if !hc.IsHealthy("10.0.0.1") {
+	if !hc.IsHealthy(netip.MustParseAddr("10.0.0.1")) {
 		t.Error("expected unknown IP to be healthy")
 	}
 }
 
+func TestHealthChecker_AddRemoveIP(t *testing.T) {
+	checker := newMockChecker()
+	hc := NewHealthChecker(HealthCheckerConfig{
+		IPs:              netutil.MustParseAddrs([]string{"192.168.1.1"}),
+		Checker:          checker,
+		Interval:         time.Hour,
+		Timeout:          time.Second,
+		FailureThreshold: 1,
+		SuccessThreshold: 1,
+	})
+
+	hc.AddIP(netip.MustParseAddr("192.168.1.2"))
+	if len(hc.GetAllStatus()) != 2 {
+		t.Fatalf("expected 2 statuses, got %d", len(hc.GetAllStatus()))
+	}
+
+	hc.Observe(netip.MustParseAddr("192.168.1.2"), errors.New("connection refused"))
+	if hc.IsHealthy(netip.MustParseAddr("192.168.1.2")) {
+		t.Error("expected added IP to be health checked")
+	}
+
+	// Adding a known IP keeps its state
+	hc.AddIP(netip.MustParseAddr("192.168.1.2"))
+	if hc.IsHealthy(netip.MustParseAddr("192.168.1.2")) {
+		t.Error("expected re-adding to keep the health state")
+	}
+
+	hc.RemoveIP(netip.MustParseAddr("192.168.1.2"))
+	if len(hc.GetAllStatus()) != 1 {
+		t.Errorf("expected 1 status, got %d", len(hc.GetAllStatus()))
+	}
+	if !hc.IsHealthy(netip.MustParseAddr("192.168.1.2")) {
+		t.Error("expected removed IP to be unknown")
+	}
+}
+
 func TestHealthChecker_GetHealthyIPs(t *testing.T) {
 	checker := newMockChecker()
 	hc := NewHealthChecker(HealthCheckerConfig{
-		IPs:              []string{"192.168.1.1", "192.168.1.2", "192.168.1.3"},
+		IPs:              netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3"}),
 		Checker:          checker,
 		Interval:         time.Hour,
 		Timeout:          time.Second,
@@ -231,13 +270,13 @@ func TestHealthChecker_GetHealthyIPs(t *testing.T) {
 
 	// Mark one IP as unhealthy
 	hc.mu.Lock()
-	status := hc.statuses["192.168.1.2"]
+	status := hc.statuses[netip.MustParseAddr("192.168.1.2")]
 	status.mu.Lock()
 	status.State = StateUnhealthy
 	status.mu.Unlock()
 	hc.mu.Unlock()
 
-	healthyIPs := hc.GetHealthyIPs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3"})
+	healthyIPs := hc.GetHealthyIPs(netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3"}))
 
 	if len(healthyIPs) != 2 {
 		t.Errorf("expected 2 healthy IPs, got %d", len(healthyIPs))
@@ -245,19 +284,48 @@ func TestHealthChecker_GetHealthyIPs(t *testing.T) {
 
 	// Check that 192.168.1.2 is not in the result
 	for _, ip := range healthyIPs {
-		if ip == "192.168.1.2" {
+		if ip == netip.MustParseAddr("192.168.1.2") {
 			t.Error("unhealthy IP should not be in result")
 		}
 	}
 }
 
+func TestHealthChecker_AnyHealthy(t *testing.T) {
+	hc := NewHealthChecker(HealthCheckerConfig{
+		IPs:              netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2"}),
+		Checker:          newMockChecker(),
+		Interval:         time.Hour,
+		Timeout:          time.Second,
+		FailureThreshold: 2,
+		SuccessThreshold: 2,
+	})
+
+	setState := func(ip string, state HealthState) {
+		hc.mu.Lock()
+		status := hc.statuses[netip.MustParseAddr(ip)]
+		status.mu.Lock()
+		status.State = state
+		status.mu.Unlock()
+		hc.mu.Unlock()
+	}
+
+	setState("192.168.1.1", StateUnhealthy)
+	if !hc.AnyHealthy() {
+		t.Error("expected a healthy IP while one remains")
+	}
+	setState("192.168.1.2", StateUnhealthy)
+	if hc.AnyHealthy() {
+		t.Error("expected no healthy IP once all are unhealthy")
+	}
+}
+
 func TestHealthChecker_CheckLoop(t *testing.T) {
 	checker := newMockChecker()
 	// Make 192.168.1.2 fail
-	checker.SetResult("192.168.1.2", errors.New("connection refused"))
+	checker.SetResult(netip.MustParseAddr("192.168.1.2"), errors.New("connection refused"))
 
 	hc := NewHealthChecker(HealthCheckerConfig{
-		IPs:              []string{"192.168.1.1", "192.168.1.2"},
+		IPs:              netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2"}),
 		Checker:          checker,
 		Interval:         50 * time.Millisecond,
 		Timeout:          time.Second,
@@ -273,12 +341,12 @@ func TestHealthChecker_CheckLoop(t *testing.T) {
 	hc.Stop()
 
 	// 192.168.1.1 should be healthy
-	if !hc.IsHealthy("192.168.1.1") {
+	if !hc.IsHealthy(netip.MustParseAddr("192.168.1.1")) {
 		t.Error("expected 192.168.1.1 to be healthy")
 	}
 
 	// 192.168.1.2 should be unhealthy after 2 failures
-	if hc.IsHealthy("192.168.1.2") {
+	if hc.IsHealthy(netip.MustParseAddr("192.168.1.2")) {
 		t.Error("expected 192.168.1.2 to be unhealthy")
 	}
 }
@@ -286,10 +354,10 @@ func TestHealthChecker_CheckLoop(t *testing.T) {
 func TestHealthChecker_Recovery(t *testing.T) {
 	checker := newMockChecker()
 	// Start with 192.168.1.1 failing
-	checker.SetResult("192.168.1.1", errors.New("connection refused"))
+	checker.SetResult(netip.MustParseAddr("192.168.1.1"), errors.New("connection refused"))
 
 	hc := NewHealthChecker(HealthCheckerConfig{
-		IPs:              []string{"192.168.1.1"},
+		IPs:              netutil.MustParseAddrs([]string{"192.168.1.1"}),
 		Checker:          checker,
 		Interval:         30 * time.Millisecond,
 		Timeout:          time.Second,
@@ -302,12 +370,12 @@ func TestHealthChecker_Recovery(t *testing.T) {
 	// Wait for unhealthy
 	time.Sleep(100 * time.Millisecond)
 
-	if hc.IsHealthy("192.168.1.1") {
+	if hc.IsHealthy(netip.MustParseAddr("192.168.1.1")) {
 		t.Error("expected IP to be unhealthy")
 	}
 
 	// Fix the IP
-	checker.SetResult("192.168.1.1", nil)
+	checker.SetResult(netip.MustParseAddr("192.168.1.1"), nil)
 
 	// Wait for recovery (needs 2 successes)
 	time.Sleep(150 * time.Millisecond)
@@ -315,7 +383,7 @@ func TestHealthChecker_Recovery(t *testing.T) {
 	hc.Stop()
 
 	// Should be healthy again
-	if !hc.IsHealthy("192.168.1.1") {
+	if !hc.IsHealthy(netip.MustParseAddr("192.168.1.1")) {
 		t.Error("expected IP to recover and be healthy")
 	}
 }
@@ -323,7 +391,7 @@ func TestHealthChecker_Recovery(t *testing.T) {
 func TestHealthChecker_GetAllStatus(t *testing.T) {
 	checker := newMockChecker()
 	hc := NewHealthChecker(HealthCheckerConfig{
-		IPs:              []string{"192.168.1.1", "192.168.1.2"},
+		IPs:              netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2"}),
 		Checker:          checker,
 		Interval:         time.Hour,
 		Timeout:          time.Second,
@@ -350,6 +418,26 @@ func TestHealthChecker_GetAllStatus(t *testing.T) {
 	}
 }
 
+func TestHealthChecker_Info(t *testing.T) {
+	hc := NewHealthChecker(HealthCheckerConfig{
+		IPs:              netutil.MustParseAddrs([]string{"192.168.1.1"}),
+		Checker:          newMockChecker(),
+		Interval:         time.Hour,
+		Timeout:          time.Second,
+		FailureThreshold: 1,
+		SuccessThreshold: 1,
+	})
+	hc.Observe(netip.MustParseAddr("192.168.1.1"), errors.New("connection refused"))
+
+	got, ok := hc.Info()["192.168.1.1"]
+	if !ok {
+		t.Fatal("expected health info for 192.168.1.1")
+	}
+	if got.State != "unhealthy" || got.ConsecutiveFailures != 1 || got.LastError != "connection refused" {
+		t.Errorf("unexpected health info: %+v", got)
+	}
+}
+
 func TestHealthState_String(t *testing.T) {
 	tests := []struct {
 		state    HealthState
@@ -367,3 +455,21 @@ func TestHealthState_String(t *testing.T) {
 		}
 	}
 }
+
+func TestIPStatus_HealthySince(t *testing.T) {
+	status := NewIPStatus("192.168.1.1")
+	if !status.GetHealthySince().IsZero() {
+		t.Error("expected zero HealthySince for IP that never failed")
+	}
+
+	status.RecordFailure(errors.New("down"), 1)
+	status.RecordSuccess(2)
+	if !status.GetHealthySince().IsZero() {
+		t.Error("expected zero HealthySince while recovering")
+	}
+
+	status.RecordSuccess(2)
+	if status.GetHealthySince().IsZero() {
+		t.Error("expected HealthySince to be set after recovery")
+	}
+}
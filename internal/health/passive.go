@@ -0,0 +1,84 @@
+// Package health provides IP health checking functionality.
+package health
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+
+	"github.com/cr0hn/outbound-lb/internal/logger"
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+)
+
+// PassiveMonitor feeds the outcomes of proxied traffic into a HealthChecker,
+// so IPs are marked unhealthy without (or in addition to) active checks.
+//
+// Connection failures count as failed checks right away. Responses are
+// evaluated in windows of window responses per IP: a window whose 5xx rate
+// reaches errorRate percent counts as a failed check, any other window as a
+// successful one.
+type PassiveMonitor struct {
+	hc        *HealthChecker
+	window    int
+	errorRate int
+	windows   map[netip.Addr]*responseWindow
+	mu        sync.Mutex
+}
+
+// responseWindow counts the responses seen through an IP in the current window.
+type responseWindow struct {
+	total     int
+	serverErr int
+}
+
+// NewPassiveMonitor creates a PassiveMonitor reporting to hc.
+// errorRate is the percentage of 5xx responses that fails a window.
+func NewPassiveMonitor(hc *HealthChecker, window, errorRate int) *PassiveMonitor {
+	if window < 1 {
+		window = 1
+	}
+	return &PassiveMonitor{
+		hc:        hc,
+		window:    window,
+		errorRate: errorRate,
+		windows:   make(map[netip.Addr]*responseWindow),
+	}
+}
+
+// ObserveError records a failure to reach the upstream through ip.
+func (pm *PassiveMonitor) ObserveError(ip netip.Addr, err error) {
+	metrics.PassiveHealthFailures.WithLabelValues(ip.String(), "connect").Inc()
+	logger.Debug("passive_health_failure", "ip", ip, "reason", "connect", "error", err)
+	pm.hc.Observe(ip, err)
+}
+
+// ObserveResponse records an upstream response with the given status code
+// received through ip.
+func (pm *PassiveMonitor) ObserveResponse(ip netip.Addr, statusCode int) {
+	pm.mu.Lock()
+	w, ok := pm.windows[ip]
+	if !ok {
+		w = &responseWindow{}
+		pm.windows[ip] = w
+	}
+	w.total++
+	if statusCode >= 500 {
+		w.serverErr++
+	}
+	if w.total < pm.window {
+		pm.mu.Unlock()
+		return
+	}
+	serverErr, total := w.serverErr, w.total
+	*w = responseWindow{}
+	pm.mu.Unlock()
+
+	if serverErr*100 >= pm.errorRate*total {
+		metrics.PassiveHealthFailures.WithLabelValues(ip.String(), "5xx_rate").Inc()
+		logger.Debug("passive_health_failure", "ip", ip, "reason", "5xx_rate",
+			"server_errors", serverErr, "responses", total)
+		pm.hc.Observe(ip, fmt.Errorf("%d of last %d responses were 5xx", serverErr, total))
+		return
+	}
+	pm.hc.Observe(ip, nil)
+}
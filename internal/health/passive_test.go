@@ -0,0 +1,136 @@
+package health
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
+)
+
+func newPassiveChecker(retryAfter time.Duration) *HealthChecker {
+	return NewHealthChecker(HealthCheckerConfig{
+		IPs:              netutil.MustParseAddrs([]string{"10.0.0.1", "10.0.0.2"}),
+		FailureThreshold: 2,
+		SuccessThreshold: 2,
+		RetryAfter:       retryAfter,
+	})
+}
+
+func TestPassiveMonitor_ConnectFailures(t *testing.T) {
+	hc := newPassiveChecker(0)
+	pm := NewPassiveMonitor(hc, 10, 50)
+
+	pm.ObserveError(netip.MustParseAddr("10.0.0.1"), errors.New("dial tcp: connection refused"))
+	if !hc.IsHealthy(netip.MustParseAddr("10.0.0.1")) {
+		t.Fatal("IP should stay healthy below the failure threshold")
+	}
+	pm.ObserveError(netip.MustParseAddr("10.0.0.1"), errors.New("dial tcp: connection refused"))
+	if hc.IsHealthy(netip.MustParseAddr("10.0.0.1")) {
+		t.Error("IP should be unhealthy after threshold connect failures")
+	}
+	if !hc.IsHealthy(netip.MustParseAddr("10.0.0.2")) {
+		t.Error("other IPs should not be affected")
+	}
+}
+
+func TestPassiveMonitor_ServerErrorRate(t *testing.T) {
+	hc := newPassiveChecker(0)
+	pm := NewPassiveMonitor(hc, 4, 50)
+
+	// Two windows with half of the responses failing
+	for i := 0; i < 2; i++ {
+		pm.ObserveResponse(netip.MustParseAddr("10.0.0.1"), 200)
+		pm.ObserveResponse(netip.MustParseAddr("10.0.0.1"), 502)
+		pm.ObserveResponse(netip.MustParseAddr("10.0.0.1"), 200)
+		if !hc.IsHealthy(netip.MustParseAddr("10.0.0.1")) {
+			t.Fatal("window is only evaluated once full")
+		}
+		pm.ObserveResponse(netip.MustParseAddr("10.0.0.1"), 503)
+	}
+	if hc.IsHealthy(netip.MustParseAddr("10.0.0.1")) {
+		t.Error("IP should be unhealthy after two failing windows")
+	}
+}
+
+func TestPassiveMonitor_GoodWindowResetsFailures(t *testing.T) {
+	hc := newPassiveChecker(0)
+	pm := NewPassiveMonitor(hc, 4, 50)
+
+	pm.ObserveError(netip.MustParseAddr("10.0.0.1"), errors.New("dial tcp: i/o timeout"))
+	for i := 0; i < 4; i++ {
+		pm.ObserveResponse(netip.MustParseAddr("10.0.0.1"), 200)
+	}
+	pm.ObserveError(netip.MustParseAddr("10.0.0.1"), errors.New("dial tcp: i/o timeout"))
+
+	if !hc.IsHealthy(netip.MustParseAddr("10.0.0.1")) {
+		t.Error("failures separated by a good window should not be consecutive")
+	}
+}
+
+func TestHealthChecker_RetryAfter(t *testing.T) {
+	hc := newPassiveChecker(50 * time.Millisecond)
+	pm := NewPassiveMonitor(hc, 1, 50)
+
+	pm.ObserveError(netip.MustParseAddr("10.0.0.1"), errors.New("dial tcp: connection refused"))
+	pm.ObserveError(netip.MustParseAddr("10.0.0.1"), errors.New("dial tcp: connection refused"))
+	if hc.IsHealthy(netip.MustParseAddr("10.0.0.1")) {
+		t.Fatal("IP should be unhealthy")
+	}
+	if got := hc.GetHealthyIPs(netutil.MustParseAddrs([]string{"10.0.0.1", "10.0.0.2"})); len(got) != 1 {
+		t.Fatalf("GetHealthyIPs() = %v, want only 10.0.0.2", got)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !hc.IsHealthy(netip.MustParseAddr("10.0.0.1")) {
+		t.Fatal("unhealthy IP should receive traffic again after RetryAfter")
+	}
+
+	// A good response moves it to recovering, which keeps receiving traffic
+	pm.ObserveResponse(netip.MustParseAddr("10.0.0.1"), 200)
+	if hc.statuses[netip.MustParseAddr("10.0.0.1")].GetState() != StateRecovering {
+		t.Fatal("IP should be recovering")
+	}
+	if !hc.IsHealthy(netip.MustParseAddr("10.0.0.1")) {
+		t.Error("recovering IP should receive traffic with RetryAfter set")
+	}
+	pm.ObserveResponse(netip.MustParseAddr("10.0.0.1"), 200)
+	if hc.statuses[netip.MustParseAddr("10.0.0.1")].GetState() != StateHealthy {
+		t.Error("IP should be healthy after success threshold")
+	}
+}
+
+func TestHealthChecker_OnStateChange(t *testing.T) {
+	hc := newPassiveChecker(0)
+	var states []HealthState
+	var lastErr error
+	hc.SetOnStateChange(func(ip netip.Addr, state HealthState, err error) {
+		if ip != netip.MustParseAddr("10.0.0.1") {
+			t.Errorf("state change for %s, want 10.0.0.1", ip)
+		}
+		states = append(states, state)
+		lastErr = err
+	})
+
+	hc.Observe(netip.MustParseAddr("10.0.0.1"), errors.New("refused"))
+	if len(states) != 0 {
+		t.Fatalf("state changes below the failure threshold: %v", states)
+	}
+	hc.Observe(netip.MustParseAddr("10.0.0.1"), errors.New("refused"))
+	if len(states) != 1 || states[0] != StateUnhealthy || lastErr == nil {
+		t.Fatalf("state changes = %v (err %v), want unhealthy with error", states, lastErr)
+	}
+
+	hc.Observe(netip.MustParseAddr("10.0.0.1"), nil)
+	hc.Observe(netip.MustParseAddr("10.0.0.1"), nil)
+	want := []HealthState{StateUnhealthy, StateRecovering, StateHealthy}
+	if len(states) != len(want) {
+		t.Fatalf("state changes = %v, want %v", states, want)
+	}
+	for i := range want {
+		if states[i] != want[i] {
+			t.Errorf("state change %d = %v, want %v", i, states[i], want[i])
+		}
+	}
+}
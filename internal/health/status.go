@@ -40,7 +40,9 @@ type IPStatus struct {
 	ConsecutiveSuccesses int
 	LastCheck            time.Time
 	LastError            error
-	mu                   sync.RWMutex
+	// HealthySince is when the IP last recovered (zero if it never failed).
+	HealthySince time.Time
+	mu           sync.RWMutex
 }
 
 // NewIPStatus creates a new IPStatus for the given IP.
@@ -87,6 +89,7 @@ func (s *IPStatus) RecordSuccess(successThreshold int) bool {
 		// Need successThreshold consecutive successes to become healthy
 		if s.ConsecutiveSuccesses >= successThreshold {
 			s.State = StateHealthy
+			s.HealthySince = s.LastCheck
 		}
 	case StateHealthy:
 		// Already healthy, nothing to do
@@ -124,6 +127,13 @@ func (s *IPStatus) RecordFailure(err error, failureThreshold int) bool {
 	return oldState != s.State
 }
 
+// GetHealthySince returns when the IP last recovered (zero if it never failed).
+func (s *IPStatus) GetHealthySince() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.HealthySince
+}
+
 // GetInfo returns a copy of the status info for external use.
 func (s *IPStatus) GetInfo() StatusInfo {
 	s.mu.RLock()
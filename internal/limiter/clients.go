@@ -0,0 +1,58 @@
+package limiter
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrClientLimitReached is returned when a client has as many open
+// connections as allowed.
+var ErrClientLimitReached = errors.New("connection limit reached for client")
+
+// Clients caps the concurrent connections of each client, so that one client
+// cannot take the whole total connection budget.
+type Clients struct {
+	max   int
+	conns map[string]int
+	mu    sync.Mutex
+}
+
+// NewClients creates Clients allowing up to maxPerClient concurrent
+// connections per client. Zero is unlimited.
+func NewClients(maxPerClient int) *Clients {
+	return &Clients{max: maxPerClient, conns: make(map[string]int)}
+}
+
+// Acquire takes one of the connections of client. It returns a function
+// giving the connection back, to be called exactly once, or
+// ErrClientLimitReached.
+func (c *Clients) Acquire(client string) (func(), error) {
+	if c == nil || c.max <= 0 {
+		return func() {}, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conns[client] >= c.max {
+		return nil, ErrClientLimitReached
+	}
+	c.conns[client]++
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		// Forget idle clients so the map only holds active ones
+		if c.conns[client]--; c.conns[client] <= 0 {
+			delete(c.conns, client)
+		}
+	}, nil
+}
+
+// Count returns the open connections of client.
+func (c *Clients) Count(client string) int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conns[client]
+}
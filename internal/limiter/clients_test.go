@@ -0,0 +1,59 @@
+package limiter
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestClients_Acquire(t *testing.T) {
+	c := NewClients(2)
+
+	release1, err := c.Acquire("10.0.0.1")
+	if err != nil {
+		t.Fatalf("Acquire() error = %v", err)
+	}
+	if _, err := c.Acquire("10.0.0.1"); err != nil {
+		t.Fatalf("second Acquire() error = %v", err)
+	}
+	if _, err := c.Acquire("10.0.0.1"); !errors.Is(err, ErrClientLimitReached) {
+		t.Errorf("third Acquire() error = %v, want ErrClientLimitReached", err)
+	}
+
+	// Other clients have their own budget
+	if _, err := c.Acquire("user:alice"); err != nil {
+		t.Errorf("Acquire() for another client error = %v", err)
+	}
+
+	release1()
+	if got := c.Count("10.0.0.1"); got != 1 {
+		t.Errorf("Count() = %d, want 1", got)
+	}
+	if _, err := c.Acquire("10.0.0.1"); err != nil {
+		t.Errorf("Acquire() after release error = %v", err)
+	}
+}
+
+func TestClients_ForgetsIdleClients(t *testing.T) {
+	c := NewClients(1)
+	release, err := c.Acquire("10.0.0.1")
+	if err != nil {
+		t.Fatalf("Acquire() error = %v", err)
+	}
+	release()
+	if len(c.conns) != 0 {
+		t.Errorf("conns = %v, want idle clients forgotten", c.conns)
+	}
+}
+
+func TestClients_Unlimited(t *testing.T) {
+	for _, c := range []*Clients{nil, NewClients(0)} {
+		for i := 0; i < 100; i++ {
+			if _, err := c.Acquire("10.0.0.1"); err != nil {
+				t.Fatalf("Acquire() error = %v", err)
+			}
+		}
+		if got := c.Count("10.0.0.1"); got != 0 {
+			t.Errorf("Count() = %d, want 0 when unlimited", got)
+		}
+	}
+}
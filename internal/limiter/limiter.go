@@ -3,10 +3,12 @@ package limiter
 
 import (
 	"errors"
+	"net/netip"
 	"sync"
 	"sync/atomic"
 
 	"github.com/cr0hn/outbound-lb/internal/logger"
+	"github.com/cr0hn/outbound-lb/internal/metrics"
 )
 
 var (
@@ -20,7 +22,7 @@ var (
 // This reduces allocations in the hot path.
 var availableIPsPool = sync.Pool{
 	New: func() any {
-		return make([]string, 0, 16)
+		return make([]netip.Addr, 0, 16)
 	},
 }
 
@@ -28,15 +30,36 @@ var availableIPsPool = sync.Pool{
 type Limiter struct {
 	maxPerIP atomic.Int32
 	maxTotal atomic.Int32
-	total    atomic.Int64
-	perIP    map[string]*atomic.Int64
-	mu       sync.RWMutex
+	// reservedHigh and reservedNormal are total slots kept for connections
+	// of at least that priority
+	reservedHigh   atomic.Int32
+	reservedNormal atomic.Int32
+	total          atomic.Int64
+	perIP          map[netip.Addr]*atomic.Int64
+	mu             sync.RWMutex
+	released       atomic.Pointer[chan struct{}]
+
+	// draining holds the IPs with more connections than maxPerIP after it
+	// was lowered, until their connections fall under it. Guarded by mu.
+	draining      map[netip.Addr]struct{}
+	drainingCount atomic.Int32
+
+	// saturated is set when the total limit is reached and cleared once
+	// usage falls to half of it, so that onSaturated is not called on every
+	// connection while the limiter hovers at the limit.
+	saturated   atomic.Bool
+	onSaturated atomic.Pointer[func(maxTotal int)]
+
+	// peers holds the connections of the other cluster members per IP,
+	// counted against maxPerIP (nil outside a cluster).
+	peers atomic.Pointer[map[netip.Addr]int64]
 }
 
 // New creates a new Limiter.
-func New(maxPerIP, maxTotal int, ips []string) *Limiter {
+func New(maxPerIP, maxTotal int, ips []netip.Addr) *Limiter {
 	l := &Limiter{
-		perIP: make(map[string]*atomic.Int64),
+		perIP:    make(map[netip.Addr]*atomic.Int64, len(ips)),
+		draining: make(map[netip.Addr]struct{}),
 	}
 	l.maxPerIP.Store(int32(maxPerIP))
 	l.maxTotal.Store(int32(maxTotal))
@@ -46,19 +69,96 @@ func New(maxPerIP, maxTotal int, ips []string) *Limiter {
 	return l
 }
 
-// UpdateLimits updates the connection limits at runtime.
+// UpdateLimits updates the connection limits at runtime. IPs left with more
+// connections than the new per-IP limit are marked as draining: they take no
+// new connection until their count falls under the limit.
 func (l *Limiter) UpdateLimits(maxPerIP, maxTotal int) {
 	l.maxPerIP.Store(int32(maxPerIP))
 	l.maxTotal.Store(int32(maxTotal))
+	l.rebalance()
+	l.notify()
 	logger.Info("limits_updated", "max_per_ip", maxPerIP, "max_total", maxTotal)
 }
 
-// Acquire attempts to acquire a connection slot for the given IP.
+// rebalance marks the IPs over the per-IP limit as draining and clears the
+// others.
+func (l *Limiter) rebalance() {
+	maxPerIP := int64(l.maxPerIP.Load())
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, counter := range l.perIP {
+		l.updateDraining(key, counter.Load(), maxPerIP)
+	}
+}
+
+// updateDraining marks key as draining while count exceeds maxPerIP and
+// reports the excess. l.mu must be held for writing.
+func (l *Limiter) updateDraining(key netip.Addr, count, maxPerIP int64) {
+	_, draining := l.draining[key]
+	over := count - maxPerIP
+	switch {
+	case over > 0:
+		if !draining {
+			l.draining[key] = struct{}{}
+			l.drainingCount.Add(1)
+			logger.Warn("ip_limit_draining", "ip", key.String(), "connections", count, "max_per_ip", maxPerIP)
+		}
+		metrics.IPOverLimit.WithLabelValues(key.String()).Set(float64(over))
+	case draining:
+		delete(l.draining, key)
+		l.drainingCount.Add(-1)
+		metrics.IPOverLimit.DeleteLabelValues(key.String())
+		logger.Info("ip_limit_drained", "ip", key.String(), "connections", count, "max_per_ip", maxPerIP)
+	}
+}
+
+// OverLimit returns how many connections of ip exceed the per-IP limit while
+// it drains after the limit was lowered, or 0.
+func (l *Limiter) OverLimit(ip netip.Addr) int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if _, draining := l.draining[ip]; !draining {
+		return 0
+	}
+	return max(l.perIP[ip].Load()-int64(l.maxPerIP.Load()), 0)
+}
+
+// AddIP starts tracking connections for ip.
+func (l *Limiter) AddIP(ip netip.Addr) {
+	l.mu.Lock()
+	if _, exists := l.perIP[ip]; !exists {
+		l.perIP[ip] = &atomic.Int64{}
+	}
+	l.mu.Unlock()
+	l.notify()
+}
+
+// RemoveIP stops tracking connections for ip. Callers should let its
+// connections drain first: releases of connections still open are only
+// counted against the total.
+func (l *Limiter) RemoveIP(ip netip.Addr) {
+	l.mu.Lock()
+	l.updateDraining(ip, 0, 0)
+	delete(l.perIP, ip)
+	l.mu.Unlock()
+}
+
+// Acquire attempts to acquire a connection slot of normal priority for the
+// given IP. Returns nil if successful, error if limit reached.
+func (l *Limiter) Acquire(ip netip.Addr) error {
+	return l.AcquirePriority(ip, PriorityNormal)
+}
+
+// AcquirePriority attempts to acquire a connection slot of priority p for the
+// given IP, leaving the slots reserved for higher priorities alone, in total
+// and on the IP.
 // Returns nil if successful, error if limit reached.
 // Uses CAS loops to prevent TOCTOU race conditions.
-func (l *Limiter) Acquire(ip string) error {
+func (l *Limiter) AcquirePriority(ip netip.Addr, p Priority) error {
 	maxTotal := int64(l.maxTotal.Load())
 	maxPerIP := int64(l.maxPerIP.Load())
+	available := maxTotal - l.reservedAbove(p)
+	availableOnIP := maxPerIP - l.reservedAboveOnIP(p, maxPerIP, maxTotal)
 
 	// Atomically increment total counter with CAS loop
 	for {
@@ -66,7 +166,15 @@ func (l *Limiter) Acquire(ip string) error {
 		if current >= maxTotal {
 			return ErrTotalLimitReached
 		}
+		if current >= available {
+			return ErrReservedLimitReached
+		}
 		if l.total.CompareAndSwap(current, current+1) {
+			if current+1 == maxTotal && l.saturated.CompareAndSwap(false, true) {
+				if fn := l.onSaturated.Load(); fn != nil {
+					(*fn)(int(maxTotal))
+				}
+			}
 			break
 		}
 	}
@@ -86,13 +194,18 @@ func (l *Limiter) Acquire(ip string) error {
 	}
 
 	// Atomically increment per-IP counter with CAS loop
+	peers := l.peerCount(ip)
 	for {
 		ipCount := counter.Load()
-		if ipCount >= maxPerIP {
+		if ipCount+peers >= maxPerIP {
 			// Rollback total counter since we can't acquire
 			l.total.Add(-1)
 			return ErrIPLimitReached
 		}
+		if ipCount+peers >= availableOnIP {
+			l.total.Add(-1)
+			return ErrIPReservedLimitReached
+		}
 		if counter.CompareAndSwap(ipCount, ipCount+1) {
 			break
 		}
@@ -101,20 +214,78 @@ func (l *Limiter) Acquire(ip string) error {
 	return nil
 }
 
+// Limits returns the current per-IP and total connection limits.
+func (l *Limiter) Limits() (maxPerIP, maxTotal int) {
+	return int(l.maxPerIP.Load()), int(l.maxTotal.Load())
+}
+
 // Release releases a connection slot for the given IP.
-func (l *Limiter) Release(ip string) {
+func (l *Limiter) Release(ip netip.Addr) {
 	l.mu.RLock()
 	counter, exists := l.perIP[ip]
 	l.mu.RUnlock()
 
 	if exists {
-		counter.Add(-1)
+		count := counter.Add(-1)
+		if l.drainingCount.Load() > 0 {
+			l.mu.Lock()
+			if _, draining := l.draining[ip]; draining {
+				l.updateDraining(ip, count, int64(l.maxPerIP.Load()))
+			}
+			l.mu.Unlock()
+		}
+	}
+	if l.total.Add(-1) <= int64(l.maxTotal.Load())/2 && l.saturated.Load() {
+		l.saturated.Store(false)
+	}
+	l.notify()
+}
+
+// SetPeerCounts sets the connections per IP of the other members of the
+// cluster. They count against the per-IP limit, so that it applies to the
+// whole fleet; the total limit stays per instance.
+func (l *Limiter) SetPeerCounts(counts map[netip.Addr]int64) {
+	l.peers.Store(&counts)
+	l.notify()
+}
+
+// peerCount returns the connections of the other cluster members for key.
+func (l *Limiter) peerCount(key netip.Addr) int64 {
+	if peers := l.peers.Load(); peers != nil {
+		return (*peers)[key]
+	}
+	return 0
+}
+
+// SetOnSaturated sets a function called when connections reach the total
+// limit. It is called again only after usage has fallen to half the limit.
+func (l *Limiter) SetOnSaturated(fn func(maxTotal int)) {
+	l.onSaturated.Store(&fn)
+}
+
+// Released returns a channel closed the next time a connection slot may have
+// become free: on a release, a limit update or a new IP.
+func (l *Limiter) Released() <-chan struct{} {
+	for {
+		if ch := l.released.Load(); ch != nil {
+			return *ch
+		}
+		ch := make(chan struct{})
+		if l.released.CompareAndSwap(nil, &ch) {
+			return ch
+		}
+	}
+}
+
+// notify wakes the callers waiting on Released.
+func (l *Limiter) notify() {
+	if ch := l.released.Swap(nil); ch != nil {
+		close(*ch)
 	}
-	l.total.Add(-1)
 }
 
 // GetIPCount returns the current connection count for an IP.
-func (l *Limiter) GetIPCount(ip string) int64 {
+func (l *Limiter) GetIPCount(ip netip.Addr) int64 {
 	l.mu.RLock()
 	counter, exists := l.perIP[ip]
 	l.mu.RUnlock()
@@ -125,13 +296,26 @@ func (l *Limiter) GetIPCount(ip string) int64 {
 	return counter.Load()
 }
 
+// Counts returns the connection count of each IP with connections.
+func (l *Limiter) Counts() map[netip.Addr]int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	counts := make(map[netip.Addr]int64, len(l.perIP))
+	for addr, counter := range l.perIP {
+		if n := counter.Load(); n > 0 {
+			counts[addr] = n
+		}
+	}
+	return counts
+}
+
 // GetTotalCount returns the current total connection count.
 func (l *Limiter) GetTotalCount() int64 {
 	return l.total.Load()
 }
 
 // IsIPAvailable checks if an IP has available connection slots.
-func (l *Limiter) IsIPAvailable(ip string) bool {
+func (l *Limiter) IsIPAvailable(ip netip.Addr) bool {
 	l.mu.RLock()
 	counter, exists := l.perIP[ip]
 	l.mu.RUnlock()
@@ -139,14 +323,14 @@ func (l *Limiter) IsIPAvailable(ip string) bool {
 	if !exists {
 		return true
 	}
-	return counter.Load() < int64(l.maxPerIP.Load())
+	return counter.Load()+l.peerCount(ip) < int64(l.maxPerIP.Load())
 }
 
 // GetAvailableIPs returns IPs that have available connection slots.
 // The returned slice is borrowed from a pool; caller MUST call ReleaseAvailableIPs
 // when done with the slice to return it to the pool.
-func (l *Limiter) GetAvailableIPs(ips []string) []string {
-	available := availableIPsPool.Get().([]string)
+func (l *Limiter) GetAvailableIPs(ips []netip.Addr) []netip.Addr {
+	available := availableIPsPool.Get().([]netip.Addr)
 	available = available[:0] // Reset length without reallocating
 
 	for _, ip := range ips {
@@ -159,22 +343,50 @@ func (l *Limiter) GetAvailableIPs(ips []string) []string {
 
 // ReleaseAvailableIPs returns a slice obtained from GetAvailableIPs back to the pool.
 // The slice should not be used after calling this function.
-func ReleaseAvailableIPs(s []string) {
+func ReleaseAvailableIPs(s []netip.Addr) {
 	if cap(s) <= 64 { // Don't pool very large slices
 		availableIPsPool.Put(s[:0])
 	}
 }
 
+// ReleaseAvailableIPs returns a slice obtained from GetAvailableIPs back to
+// the pool, like the ReleaseAvailableIPs function.
+func (l *Limiter) ReleaseAvailableIPs(s []netip.Addr) {
+	ReleaseAvailableIPs(s)
+}
+
 // Stats returns current limiter statistics.
 func (l *Limiter) Stats() map[string]int64 {
 	stats := make(map[string]int64)
 	stats["total"] = l.total.Load()
 
 	l.mu.RLock()
-	for ip, counter := range l.perIP {
-		stats[ip] = counter.Load()
+	for addr, counter := range l.perIP {
+		stats[addr.String()] = counter.Load()
 	}
 	l.mu.RUnlock()
 
 	return stats
 }
+
+// Info returns connection usage against the limits for the /stats endpoint.
+func (l *Limiter) Info() metrics.LimiterInfo {
+	maxPerIP, maxTotal := l.Limits()
+	info := metrics.LimiterInfo{
+		Active:   l.total.Load(),
+		MaxTotal: maxTotal,
+		MaxPerIP: maxPerIP,
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	info.PerIP = make(map[string]metrics.IPUsage, len(l.perIP))
+	for addr, counter := range l.perIP {
+		usage := metrics.IPUsage{Active: counter.Load(), Limit: maxPerIP, Peers: l.peerCount(addr)}
+		if _, draining := l.draining[addr]; draining {
+			usage.OverLimit = max(usage.Active-int64(maxPerIP), 0)
+		}
+		info.PerIP[addr.String()] = usage
+	}
+	return info
+}
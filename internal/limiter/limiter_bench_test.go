@@ -2,11 +2,14 @@ package limiter
 
 import (
 	"fmt"
+	"net/netip"
 	"testing"
+
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
 )
 
 func BenchmarkLimiter_AcquireRelease(b *testing.B) {
-	ips := []string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4"}
+	ips := netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4"})
 	lim := New(1000, 10000, ips)
 
 	b.ResetTimer()
@@ -19,7 +22,7 @@ func BenchmarkLimiter_AcquireRelease(b *testing.B) {
 }
 
 func BenchmarkLimiter_AcquireRelease_Parallel(b *testing.B) {
-	ips := []string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4"}
+	ips := netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4"})
 	lim := New(100000, 1000000, ips)
 
 	b.ResetTimer()
@@ -37,21 +40,21 @@ func BenchmarkLimiter_AcquireRelease_Parallel(b *testing.B) {
 
 func BenchmarkLimiter_AcquireRelease_HighContention(b *testing.B) {
 	// Single IP - maximum contention
-	ips := []string{"192.168.1.1"}
+	ips := netutil.MustParseAddrs([]string{"192.168.1.1"})
 	lim := New(100000, 1000000, ips)
 
 	b.ResetTimer()
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
-			if err := lim.Acquire("192.168.1.1"); err == nil {
-				lim.Release("192.168.1.1")
+			if err := lim.Acquire(ips[0]); err == nil {
+				lim.Release(ips[0])
 			}
 		}
 	})
 }
 
 func BenchmarkLimiter_IsIPAvailable(b *testing.B) {
-	ips := []string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4"}
+	ips := netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4"})
 	lim := New(100, 1000, ips)
 
 	// Acquire some connections
@@ -66,7 +69,7 @@ func BenchmarkLimiter_IsIPAvailable(b *testing.B) {
 }
 
 func BenchmarkLimiter_IsIPAvailable_Parallel(b *testing.B) {
-	ips := []string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4"}
+	ips := netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4"})
 	lim := New(100, 1000, ips)
 
 	// Acquire some connections
@@ -85,7 +88,7 @@ func BenchmarkLimiter_IsIPAvailable_Parallel(b *testing.B) {
 }
 
 func BenchmarkLimiter_GetAvailableIPs(b *testing.B) {
-	ips := []string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4", "192.168.1.5", "192.168.1.6", "192.168.1.7", "192.168.1.8"}
+	ips := netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4", "192.168.1.5", "192.168.1.6", "192.168.1.7", "192.168.1.8"})
 	lim := New(100, 1000, ips)
 
 	// Make half unavailable
@@ -103,7 +106,7 @@ func BenchmarkLimiter_GetAvailableIPs(b *testing.B) {
 }
 
 func BenchmarkLimiter_GetAvailableIPs_Parallel(b *testing.B) {
-	ips := []string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4", "192.168.1.5", "192.168.1.6", "192.168.1.7", "192.168.1.8"}
+	ips := netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4", "192.168.1.5", "192.168.1.6", "192.168.1.7", "192.168.1.8"})
 	lim := New(100, 1000, ips)
 
 	b.ResetTimer()
@@ -116,7 +119,7 @@ func BenchmarkLimiter_GetAvailableIPs_Parallel(b *testing.B) {
 }
 
 func BenchmarkLimiter_GetIPCount(b *testing.B) {
-	ips := []string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4"}
+	ips := netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4"})
 	lim := New(100, 1000, ips)
 
 	// Acquire some connections
@@ -131,7 +134,7 @@ func BenchmarkLimiter_GetIPCount(b *testing.B) {
 }
 
 func BenchmarkLimiter_GetTotalCount(b *testing.B) {
-	ips := []string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4"}
+	ips := netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4"})
 	lim := New(100, 1000, ips)
 
 	// Acquire some connections
@@ -146,7 +149,7 @@ func BenchmarkLimiter_GetTotalCount(b *testing.B) {
 }
 
 func BenchmarkLimiter_Stats(b *testing.B) {
-	ips := []string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4"}
+	ips := netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4"})
 	lim := New(100, 1000, ips)
 
 	// Acquire some connections
@@ -161,7 +164,7 @@ func BenchmarkLimiter_Stats(b *testing.B) {
 }
 
 func BenchmarkLimiter_UpdateLimits(b *testing.B) {
-	ips := []string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4"}
+	ips := netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4"})
 	lim := New(100, 1000, ips)
 
 	b.ResetTimer()
@@ -174,9 +177,9 @@ func BenchmarkAvailableIPsPool(b *testing.B) {
 	// Test the pool efficiency
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
-			s := availableIPsPool.Get().([]string)
+			s := availableIPsPool.Get().([]netip.Addr)
 			s = s[:0]
-			s = append(s, "test1", "test2", "test3")
+			s = append(s, netip.Addr{}, netip.Addr{}, netip.Addr{})
 			ReleaseAvailableIPs(s)
 		}
 	})
@@ -186,9 +189,9 @@ func BenchmarkAvailableIPsPool(b *testing.B) {
 func BenchmarkLimiter_ScalingIPs(b *testing.B) {
 	for _, numIPs := range []int{4, 8, 16, 32, 64} {
 		b.Run(fmt.Sprintf("IPs_%d", numIPs), func(b *testing.B) {
-			ips := make([]string, numIPs)
+			ips := make([]netip.Addr, numIPs)
 			for i := range ips {
-				ips[i] = fmt.Sprintf("192.168.%d.%d", i/256, i%256)
+				ips[i] = netip.AddrFrom4([4]byte{192, 168, byte(i / 256), byte(i % 256)})
 			}
 			lim := New(100, numIPs*100, ips)
 
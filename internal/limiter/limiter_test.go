@@ -1,19 +1,26 @@
 package limiter
 
 import (
+	"errors"
+	"net/netip"
 	"sync"
 	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
 )
 
 func TestLimiter_Acquire(t *testing.T) {
-	l := New(2, 5, []string{"192.168.1.1", "192.168.1.2"})
+	l := New(2, 5, netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2"}))
 
 	// Should succeed
-	if err := l.Acquire("192.168.1.1"); err != nil {
+	if err := l.Acquire(netip.MustParseAddr("192.168.1.1")); err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
 
-	if l.GetIPCount("192.168.1.1") != 1 {
+	if l.GetIPCount(netip.MustParseAddr("192.168.1.1")) != 1 {
 		t.Error("expected IP count to be 1")
 	}
 
@@ -23,12 +30,12 @@ func TestLimiter_Acquire(t *testing.T) {
 }
 
 func TestLimiter_Release(t *testing.T) {
-	l := New(2, 5, []string{"192.168.1.1"})
+	l := New(2, 5, netutil.MustParseAddrs([]string{"192.168.1.1"}))
 
-	l.Acquire("192.168.1.1")
-	l.Release("192.168.1.1")
+	l.Acquire(netip.MustParseAddr("192.168.1.1"))
+	l.Release(netip.MustParseAddr("192.168.1.1"))
 
-	if l.GetIPCount("192.168.1.1") != 0 {
+	if l.GetIPCount(netip.MustParseAddr("192.168.1.1")) != 0 {
 		t.Error("expected IP count to be 0 after release")
 	}
 
@@ -38,77 +45,77 @@ func TestLimiter_Release(t *testing.T) {
 }
 
 func TestLimiter_PerIPLimit(t *testing.T) {
-	l := New(2, 100, []string{"192.168.1.1"})
+	l := New(2, 100, netutil.MustParseAddrs([]string{"192.168.1.1"}))
 
 	// Should succeed twice
-	if err := l.Acquire("192.168.1.1"); err != nil {
+	if err := l.Acquire(netip.MustParseAddr("192.168.1.1")); err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
-	if err := l.Acquire("192.168.1.1"); err != nil {
+	if err := l.Acquire(netip.MustParseAddr("192.168.1.1")); err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
 
 	// Third should fail
-	if err := l.Acquire("192.168.1.1"); err != ErrIPLimitReached {
+	if err := l.Acquire(netip.MustParseAddr("192.168.1.1")); err != ErrIPLimitReached {
 		t.Errorf("expected ErrIPLimitReached, got %v", err)
 	}
 }
 
 func TestLimiter_TotalLimit(t *testing.T) {
-	l := New(10, 3, []string{"192.168.1.1", "192.168.1.2"})
+	l := New(10, 3, netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2"}))
 
 	// Should succeed three times
-	l.Acquire("192.168.1.1")
-	l.Acquire("192.168.1.1")
-	l.Acquire("192.168.1.2")
+	l.Acquire(netip.MustParseAddr("192.168.1.1"))
+	l.Acquire(netip.MustParseAddr("192.168.1.1"))
+	l.Acquire(netip.MustParseAddr("192.168.1.2"))
 
 	// Fourth should fail
-	if err := l.Acquire("192.168.1.2"); err != ErrTotalLimitReached {
+	if err := l.Acquire(netip.MustParseAddr("192.168.1.2")); err != ErrTotalLimitReached {
 		t.Errorf("expected ErrTotalLimitReached, got %v", err)
 	}
 }
 
 func TestLimiter_IsIPAvailable(t *testing.T) {
-	l := New(2, 100, []string{"192.168.1.1"})
+	l := New(2, 100, netutil.MustParseAddrs([]string{"192.168.1.1"}))
 
-	if !l.IsIPAvailable("192.168.1.1") {
+	if !l.IsIPAvailable(netip.MustParseAddr("192.168.1.1")) {
 		t.Error("expected IP to be available")
 	}
 
-	l.Acquire("192.168.1.1")
-	l.Acquire("192.168.1.1")
+	l.Acquire(netip.MustParseAddr("192.168.1.1"))
+	l.Acquire(netip.MustParseAddr("192.168.1.1"))
 
-	if l.IsIPAvailable("192.168.1.1") {
+	if l.IsIPAvailable(netip.MustParseAddr("192.168.1.1")) {
 		t.Error("expected IP to be unavailable after reaching limit")
 	}
 }
 
 func TestLimiter_GetAvailableIPs(t *testing.T) {
-	l := New(1, 100, []string{"192.168.1.1", "192.168.1.2"})
+	l := New(1, 100, netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2"}))
 
-	available := l.GetAvailableIPs([]string{"192.168.1.1", "192.168.1.2"})
+	available := l.GetAvailableIPs(netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2"}))
 	if len(available) != 2 {
 		t.Errorf("expected 2 available IPs, got %d", len(available))
 	}
 
-	l.Acquire("192.168.1.1")
+	l.Acquire(netip.MustParseAddr("192.168.1.1"))
 
-	available = l.GetAvailableIPs([]string{"192.168.1.1", "192.168.1.2"})
+	available = l.GetAvailableIPs(netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2"}))
 	if len(available) != 1 {
 		t.Errorf("expected 1 available IP, got %d", len(available))
 	}
 }
 
 func TestLimiter_Concurrent(t *testing.T) {
-	l := New(100, 1000, []string{"192.168.1.1"})
+	l := New(100, 1000, netutil.MustParseAddrs([]string{"192.168.1.1"}))
 
 	var wg sync.WaitGroup
 	for i := 0; i < 100; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			if err := l.Acquire("192.168.1.1"); err == nil {
-				l.Release("192.168.1.1")
+			if err := l.Acquire(netip.MustParseAddr("192.168.1.1")); err == nil {
+				l.Release(netip.MustParseAddr("192.168.1.1"))
 			}
 		}()
 	}
@@ -122,7 +129,7 @@ func TestLimiter_Concurrent(t *testing.T) {
 func TestLimiter_StressTest_RaceCondition(t *testing.T) {
 	// Stress test to verify CAS-based atomic operations prevent race conditions
 	// Run with -race flag to detect data races
-	l := New(100, 500, []string{"192.168.1.1", "192.168.1.2", "192.168.1.3"})
+	l := New(100, 500, netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3"}))
 
 	const numGoroutines = 1000
 	const iterations = 100
@@ -133,7 +140,7 @@ func TestLimiter_StressTest_RaceCondition(t *testing.T) {
 	for i := 0; i < numGoroutines; i++ {
 		go func(id int) {
 			defer wg.Done()
-			ip := []string{"192.168.1.1", "192.168.1.2", "192.168.1.3"}[id%3]
+			ip := netip.AddrFrom4([4]byte{192, 168, 1, byte(id%3 + 1)})
 			for j := 0; j < iterations; j++ {
 				if err := l.Acquire(ip); err == nil {
 					// Small delay to increase contention
@@ -149,7 +156,7 @@ func TestLimiter_StressTest_RaceCondition(t *testing.T) {
 		t.Errorf("expected total count to be 0 after stress test, got %d", l.GetTotalCount())
 	}
 
-	for _, ip := range []string{"192.168.1.1", "192.168.1.2", "192.168.1.3"} {
+	for _, ip := range netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3"}) {
 		if count := l.GetIPCount(ip); count != 0 {
 			t.Errorf("expected IP %s count to be 0, got %d", ip, count)
 		}
@@ -160,20 +167,20 @@ func TestLimiter_StressTest_LimitEnforcement(t *testing.T) {
 	// Test that limits are never exceeded even under high contention
 	maxPerIP := 10
 	maxTotal := 25
-	l := New(maxPerIP, maxTotal, []string{"192.168.1.1", "192.168.1.2", "192.168.1.3"})
+	l := New(maxPerIP, maxTotal, netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3"}))
 
 	const numGoroutines = 100
 	var wg sync.WaitGroup
 	wg.Add(numGoroutines)
 
 	maxTotalObserved := int64(0)
-	maxPerIPObserved := make(map[string]int64)
+	maxPerIPObserved := make(map[netip.Addr]int64)
 	var mu sync.Mutex
 
 	for i := 0; i < numGoroutines; i++ {
 		go func(id int) {
 			defer wg.Done()
-			ip := []string{"192.168.1.1", "192.168.1.2", "192.168.1.3"}[id%3]
+			ip := netip.AddrFrom4([4]byte{192, 168, 1, byte(id%3 + 1)})
 
 			for j := 0; j < 50; j++ {
 				if err := l.Acquire(ip); err == nil {
@@ -210,15 +217,15 @@ func TestLimiter_StressTest_LimitEnforcement(t *testing.T) {
 
 func TestLimiter_Acquire_PerIPRollback(t *testing.T) {
 	// Test that total counter is rolled back when per-IP limit is reached
-	l := New(2, 100, []string{"192.168.1.1"})
+	l := New(2, 100, netutil.MustParseAddrs([]string{"192.168.1.1"}))
 
 	// Acquire twice to hit per-IP limit
-	l.Acquire("192.168.1.1")
-	l.Acquire("192.168.1.1")
+	l.Acquire(netip.MustParseAddr("192.168.1.1"))
+	l.Acquire(netip.MustParseAddr("192.168.1.1"))
 
 	// Third should fail and NOT increment total
 	initialTotal := l.GetTotalCount()
-	if err := l.Acquire("192.168.1.1"); err != ErrIPLimitReached {
+	if err := l.Acquire(netip.MustParseAddr("192.168.1.1")); err != ErrIPLimitReached {
 		t.Errorf("expected ErrIPLimitReached, got %v", err)
 	}
 
@@ -230,11 +237,11 @@ func TestLimiter_Acquire_PerIPRollback(t *testing.T) {
 }
 
 func TestLimiter_Stats(t *testing.T) {
-	l := New(10, 100, []string{"192.168.1.1", "192.168.1.2"})
+	l := New(10, 100, netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2"}))
 
-	l.Acquire("192.168.1.1")
-	l.Acquire("192.168.1.1")
-	l.Acquire("192.168.1.2")
+	l.Acquire(netip.MustParseAddr("192.168.1.1"))
+	l.Acquire(netip.MustParseAddr("192.168.1.1"))
+	l.Acquire(netip.MustParseAddr("192.168.1.2"))
 
 	stats := l.Stats()
 	if stats["total"] != 3 {
@@ -249,21 +256,21 @@ func TestLimiter_Stats(t *testing.T) {
 }
 
 func TestLimiter_UnknownIP(t *testing.T) {
-	l := New(10, 100, []string{"192.168.1.1"})
+	l := New(10, 100, netutil.MustParseAddrs([]string{"192.168.1.1"}))
 
 	// Should handle unknown IP
-	if err := l.Acquire("192.168.1.99"); err != nil {
+	if err := l.Acquire(netip.MustParseAddr("192.168.1.99")); err != nil {
 		t.Errorf("unexpected error for unknown IP: %v", err)
 	}
 
-	l.Release("192.168.1.99")
+	l.Release(netip.MustParseAddr("192.168.1.99"))
 }
 
 func TestLimiter_GetAvailableIPs_WithPool(t *testing.T) {
-	l := New(1, 100, []string{"192.168.1.1", "192.168.1.2", "192.168.1.3"})
+	l := New(1, 100, netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3"}))
 
 	// Get available IPs - should return all 3
-	available := l.GetAvailableIPs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3"})
+	available := l.GetAvailableIPs(netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3"}))
 	if len(available) != 3 {
 		t.Errorf("expected 3 available IPs, got %d", len(available))
 	}
@@ -272,10 +279,10 @@ func TestLimiter_GetAvailableIPs_WithPool(t *testing.T) {
 	ReleaseAvailableIPs(available)
 
 	// Acquire one IP
-	l.Acquire("192.168.1.1")
+	l.Acquire(netip.MustParseAddr("192.168.1.1"))
 
 	// Get available IPs again - should return 2
-	available2 := l.GetAvailableIPs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3"})
+	available2 := l.GetAvailableIPs(netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3"}))
 	if len(available2) != 2 {
 		t.Errorf("expected 2 available IPs, got %d", len(available2))
 	}
@@ -283,10 +290,10 @@ func TestLimiter_GetAvailableIPs_WithPool(t *testing.T) {
 	// Verify correct IPs are returned
 	hasIP2, hasIP3 := false, false
 	for _, ip := range available2 {
-		if ip == "192.168.1.2" {
+		if ip == netip.MustParseAddr("192.168.1.2") {
 			hasIP2 = true
 		}
-		if ip == "192.168.1.3" {
+		if ip == netip.MustParseAddr("192.168.1.3") {
 			hasIP3 = true
 		}
 	}
@@ -306,16 +313,16 @@ func TestReleaseAvailableIPs_LargeSlice(t *testing.T) {
 	}
 
 	// Should not panic and should not pool large slices
-	ReleaseAvailableIPs(large)
+	ReleaseAvailableIPs(netutil.MustParseAddrs(large))
 
 	// Create a small slice that should be pooled
 	small := make([]string, 0, 16)
 	small = append(small, "192.168.1.1")
-	ReleaseAvailableIPs(small)
+	ReleaseAvailableIPs(netutil.MustParseAddrs(small))
 }
 
 func TestLimiter_GetAvailableIPs_Pool_Concurrent(t *testing.T) {
-	l := New(10, 1000, []string{"192.168.1.1", "192.168.1.2", "192.168.1.3"})
+	l := New(10, 1000, netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3"}))
 
 	var wg sync.WaitGroup
 	for i := 0; i < 100; i++ {
@@ -323,7 +330,7 @@ func TestLimiter_GetAvailableIPs_Pool_Concurrent(t *testing.T) {
 		go func() {
 			defer wg.Done()
 			for j := 0; j < 50; j++ {
-				available := l.GetAvailableIPs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3"})
+				available := l.GetAvailableIPs(netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3"}))
 				if len(available) == 0 {
 					continue
 				}
@@ -336,3 +343,269 @@ func TestLimiter_GetAvailableIPs_Pool_Concurrent(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestLimiter_AddRemoveIP(t *testing.T) {
+	l := New(1, 5, netutil.MustParseAddrs([]string{"192.168.1.1"}))
+
+	l.AddIP(netip.MustParseAddr("192.168.1.2"))
+	if len(l.Stats()) != 3 {
+		t.Errorf("expected total plus 2 IPs in stats, got %v", l.Stats())
+	}
+	if err := l.Acquire(netip.MustParseAddr("192.168.1.2")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if l.IsIPAvailable(netip.MustParseAddr("192.168.1.2")) {
+		t.Error("expected added IP to be limited")
+	}
+
+	l.RemoveIP(netip.MustParseAddr("192.168.1.2"))
+	if len(l.Stats()) != 2 {
+		t.Errorf("expected total plus 1 IP in stats, got %v", l.Stats())
+	}
+
+	// Releasing a connection of a removed IP only affects the total
+	l.Release(netip.MustParseAddr("192.168.1.2"))
+	if l.GetTotalCount() != 0 {
+		t.Errorf("expected total count 0, got %d", l.GetTotalCount())
+	}
+	if l.GetIPCount(netip.MustParseAddr("192.168.1.2")) != 0 {
+		t.Errorf("expected no count for removed IP, got %d", l.GetIPCount(netip.MustParseAddr("192.168.1.2")))
+	}
+}
+
+func TestLimiter_ShrinkPerIPLimit(t *testing.T) {
+	ip := netip.MustParseAddr("192.168.1.1")
+	l := New(4, 10, []netip.Addr{ip})
+	for i := 0; i < 4; i++ {
+		if err := l.Acquire(ip); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	l.UpdateLimits(2, 10)
+	if got := l.OverLimit(ip); got != 2 {
+		t.Errorf("expected 2 connections over the limit, got %d", got)
+	}
+	if got := testutil.ToFloat64(metrics.IPOverLimit.WithLabelValues(ip.String())); got != 2 {
+		t.Errorf("expected over_limit gauge 2, got %v", got)
+	}
+	if err := l.Acquire(ip); err != ErrIPLimitReached {
+		t.Errorf("expected draining IP to refuse connections, got %v", err)
+	}
+
+	l.Release(ip)
+	if got := l.OverLimit(ip); got != 1 {
+		t.Errorf("expected 1 connection over the limit, got %d", got)
+	}
+
+	// At the limit the IP is no longer draining, but still full
+	l.Release(ip)
+	if got := l.OverLimit(ip); got != 0 {
+		t.Errorf("expected no connection over the limit, got %d", got)
+	}
+	if got := testutil.CollectAndCount(metrics.IPOverLimit); got != 0 {
+		t.Errorf("expected over_limit gauge removed, got %d series", got)
+	}
+	if err := l.Acquire(ip); err != ErrIPLimitReached {
+		t.Errorf("expected full IP to refuse connections, got %v", err)
+	}
+
+	l.Release(ip)
+	if err := l.Acquire(ip); err != nil {
+		t.Errorf("expected a connection under the limit, got %v", err)
+	}
+}
+
+func TestLimiter_RaisePerIPLimitEndsDraining(t *testing.T) {
+	ip := netip.MustParseAddr("192.168.1.1")
+	l := New(2, 10, []netip.Addr{ip})
+	for i := 0; i < 2; i++ {
+		if err := l.Acquire(ip); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	l.UpdateLimits(1, 10)
+	if got := l.OverLimit(ip); got != 1 {
+		t.Errorf("expected 1 connection over the limit, got %d", got)
+	}
+	l.UpdateLimits(3, 10)
+	if got := l.OverLimit(ip); got != 0 {
+		t.Errorf("expected draining to end when the limit is raised, got %d", got)
+	}
+	if err := l.Acquire(ip); err != nil {
+		t.Errorf("expected a connection under the raised limit, got %v", err)
+	}
+}
+
+func TestLimiter_Info(t *testing.T) {
+	l := New(3, 10, netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2"}))
+	for i := 0; i < 3; i++ {
+		if err := l.Acquire(netip.MustParseAddr("192.168.1.1")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	l.UpdateLimits(2, 10)
+
+	info := l.Info()
+	if info.Active != 3 || info.MaxTotal != 10 || info.MaxPerIP != 2 {
+		t.Errorf("unexpected totals: %+v", info)
+	}
+	if got := info.PerIP["192.168.1.1"]; got.Active != 3 || got.Limit != 2 || got.OverLimit != 1 {
+		t.Errorf("unexpected usage of draining IP: %+v", got)
+	}
+	if got := info.PerIP["192.168.1.2"]; got.Active != 0 || got.OverLimit != 0 {
+		t.Errorf("unexpected usage of idle IP: %+v", got)
+	}
+}
+
+func TestLimiter_ReservedSlots(t *testing.T) {
+	ip := netip.MustParseAddr("192.168.1.1")
+	l := New(10, 4, []netip.Addr{ip})
+	l.SetReserved(1, 1)
+
+	// Low priority may use the unreserved slots only
+	for i := 0; i < 2; i++ {
+		if err := l.AcquirePriority(ip, PriorityLow); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := l.AcquirePriority(ip, PriorityLow); err != ErrReservedLimitReached {
+		t.Errorf("expected low priority refused, got %v", err)
+	}
+
+	// Normal priority also takes the normal reservation
+	if err := l.Acquire(ip); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := l.Acquire(ip); err != ErrReservedLimitReached {
+		t.Errorf("expected normal priority refused, got %v", err)
+	}
+
+	// High priority takes the last slot
+	if err := l.AcquirePriority(ip, PriorityHigh); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := l.AcquirePriority(ip, PriorityHigh); err != ErrTotalLimitReached {
+		t.Errorf("expected high priority refused at the total limit, got %v", err)
+	}
+	if got := l.GetTotalCount(); got != 4 {
+		t.Errorf("expected total count 4, got %d", got)
+	}
+}
+
+func TestLimiter_ReservedSlotsPerIP(t *testing.T) {
+	ip1 := netip.MustParseAddr("192.168.1.1")
+	ip2 := netip.MustParseAddr("192.168.1.2")
+	l := New(4, 8, []netip.Addr{ip1, ip2})
+	l.SetReserved(2, 2) // a quarter of the slots each, so one per IP
+
+	// Low priority may use half of each IP's slots
+	for i := 0; i < 2; i++ {
+		if err := l.AcquirePriority(ip1, PriorityLow); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	err := l.AcquirePriority(ip1, PriorityLow)
+	if err != ErrIPReservedLimitReached || !errors.Is(err, ErrReservedLimitReached) {
+		t.Errorf("expected low priority refused on the IP, got %v", err)
+	}
+	if got := l.GetTotalCount(); got != 2 {
+		t.Errorf("expected total count 2 after rollback, got %d", got)
+	}
+
+	// The other IP still has unreserved slots
+	if err := l.AcquirePriority(ip2, PriorityLow); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Normal and high priority take the IP's reserved slots
+	if err := l.Acquire(ip1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := l.Acquire(ip1); err != ErrIPReservedLimitReached {
+		t.Errorf("expected normal priority refused on the IP, got %v", err)
+	}
+	if err := l.AcquirePriority(ip1, PriorityHigh); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := l.AcquirePriority(ip1, PriorityHigh); err != ErrIPLimitReached {
+		t.Errorf("expected high priority refused at the per-IP limit, got %v", err)
+	}
+}
+
+func TestParsePriority(t *testing.T) {
+	for _, name := range []string{"low", "normal", "high"} {
+		p, ok := ParsePriority(name)
+		if !ok || p.String() != name {
+			t.Errorf("ParsePriority(%q) = %v, %v", name, p, ok)
+		}
+	}
+	if p, ok := ParsePriority("urgent"); ok || p != PriorityNormal {
+		t.Errorf("ParsePriority(urgent) = %v, %v, want normal, false", p, ok)
+	}
+}
+
+func TestLimiter_OnSaturated(t *testing.T) {
+	ip := netip.MustParseAddr("192.168.1.1")
+	l := New(10, 4, []netip.Addr{ip})
+	calls := 0
+	l.SetOnSaturated(func(maxTotal int) {
+		calls++
+		if maxTotal != 4 {
+			t.Errorf("maxTotal = %d, want 4", maxTotal)
+		}
+	})
+
+	for range 4 {
+		l.Acquire(ip)
+	}
+	if calls != 1 {
+		t.Fatalf("calls at the limit = %d, want 1", calls)
+	}
+
+	// Hovering at the limit does not report it again
+	l.Release(ip)
+	l.Acquire(ip)
+	if calls != 1 {
+		t.Fatalf("calls after hovering at the limit = %d, want 1", calls)
+	}
+
+	// Falling to half the limit rearms it
+	l.Release(ip)
+	l.Release(ip)
+	l.Acquire(ip)
+	l.Acquire(ip)
+	if calls != 2 {
+		t.Errorf("calls after falling to half the limit = %d, want 2", calls)
+	}
+}
+
+func TestLimiter_PeerCounts(t *testing.T) {
+	l := New(3, 10, netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2"}))
+	l.Acquire(netip.MustParseAddr("192.168.1.1"))
+
+	// Two connections of other members leave room for none here
+	l.SetPeerCounts(map[netip.Addr]int64{netip.MustParseAddr("192.168.1.1"): 2})
+	if l.IsIPAvailable(netip.MustParseAddr("192.168.1.1")) {
+		t.Error("expected IP with peer connections at the limit to be unavailable")
+	}
+	if err := l.Acquire(netip.MustParseAddr("192.168.1.1")); err != ErrIPLimitReached {
+		t.Errorf("expected ErrIPLimitReached, got %v", err)
+	}
+	if err := l.Acquire(netip.MustParseAddr("192.168.1.2")); err != nil {
+		t.Errorf("expected other IPs to be unaffected, got %v", err)
+	}
+	if got := l.Info().PerIP["192.168.1.1"]; got.Active != 1 || got.Peers != 2 {
+		t.Errorf("unexpected usage: %+v", got)
+	}
+	if got := l.Counts(); len(got) != 2 || got[netip.MustParseAddr("192.168.1.1")] != 1 {
+		t.Errorf("unexpected local counts: %v", got)
+	}
+
+	// Peers releasing their connections free the slots
+	l.SetPeerCounts(nil)
+	if err := l.Acquire(netip.MustParseAddr("192.168.1.1")); err != nil {
+		t.Errorf("unexpected error after peers released: %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package limiter
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrReservedLimitReached is returned when the connection slots left are
+	// reserved for higher priorities.
+	ErrReservedLimitReached = errors.New("remaining connections reserved for higher priorities")
+	// ErrIPReservedLimitReached is returned when the connection slots left on
+	// an IP are reserved for higher priorities; other IPs may still have
+	// some. It wraps ErrReservedLimitReached.
+	ErrIPReservedLimitReached = fmt.Errorf("%w on this IP", ErrReservedLimitReached)
+)
+
+// Priority is the class of a connection. Slots reserved for a class may only
+// be taken by connections of that class or higher.
+type Priority int
+
+// Priorities, lowest first.
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+)
+
+// ParsePriority returns the priority named s ("low", "normal" or "high").
+// Unknown names return PriorityNormal and false.
+func ParsePriority(s string) (Priority, bool) {
+	switch s {
+	case "low":
+		return PriorityLow, true
+	case "normal":
+		return PriorityNormal, true
+	case "high":
+		return PriorityHigh, true
+	}
+	return PriorityNormal, false
+}
+
+// String returns the name of p.
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityHigh:
+		return "high"
+	}
+	return "normal"
+}
+
+// SetReserved reserves high of the total connection slots for high-priority
+// connections, and normal more for normal-priority or higher ones. Each IP
+// keeps the same share of its own slots, rounded down.
+func (l *Limiter) SetReserved(high, normal int) {
+	l.reservedHigh.Store(int32(high))
+	l.reservedNormal.Store(int32(normal))
+}
+
+// reservedAbove returns the total slots reserved for priorities above p.
+func (l *Limiter) reservedAbove(p Priority) int64 {
+	switch p {
+	case PriorityLow:
+		return int64(l.reservedHigh.Load() + l.reservedNormal.Load())
+	case PriorityNormal:
+		return int64(l.reservedHigh.Load())
+	}
+	return 0
+}
+
+// reservedAboveOnIP returns the slots of each IP reserved for priorities
+// above p: the share of maxPerIP that is reserved of maxTotal.
+func (l *Limiter) reservedAboveOnIP(p Priority, maxPerIP, maxTotal int64) int64 {
+	if maxTotal <= 0 {
+		return 0
+	}
+	return l.reservedAbove(p) * maxPerIP / maxTotal
+}
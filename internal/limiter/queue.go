@@ -0,0 +1,98 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrQueueFull is returned when a request cannot join the queue because
+	// it is disabled or holds as many requests as allowed.
+	ErrQueueFull = errors.New("connection queue full")
+	// ErrQueueTimeout is returned when a request waited the queue timeout
+	// without a connection slot being released.
+	ErrQueueTimeout = errors.New("connection queue timeout")
+)
+
+// Queue lets a bounded number of requests wait, for a bounded time, for a
+// connection slot of a Limiter to be released, absorbing short bursts over
+// the limits.
+type Queue struct {
+	limiter *Limiter
+	size    int64
+	timeout time.Duration
+	waiting atomic.Int64
+}
+
+// NewQueue creates a Queue of up to size requests waiting up to timeout for
+// a slot of l. A size of zero disables queueing.
+func NewQueue(l *Limiter, size int, timeout time.Duration) *Queue {
+	return &Queue{limiter: l, size: int64(size), timeout: timeout}
+}
+
+// Len returns the number of requests waiting.
+func (q *Queue) Len() int64 {
+	if q == nil {
+		return 0
+	}
+	return q.waiting.Load()
+}
+
+// Join adds a request to the queue. Callers should try to acquire a slot once
+// more after joining, so that no release is missed, before calling Wait. The
+// returned Waiter must be left with Leave. Returns ErrQueueFull if the queue
+// is disabled or full.
+func (q *Queue) Join() (*Waiter, error) {
+	if q == nil || q.size <= 0 {
+		return nil, ErrQueueFull
+	}
+	if q.waiting.Add(1) > q.size {
+		q.waiting.Add(-1)
+		return nil, ErrQueueFull
+	}
+	start := time.Now()
+	return &Waiter{
+		queue:    q,
+		start:    start,
+		deadline: start.Add(q.timeout),
+		released: q.limiter.Released(),
+	}, nil
+}
+
+// Waiter is a request waiting in a Queue.
+type Waiter struct {
+	queue    *Queue
+	start    time.Time
+	deadline time.Time
+	released <-chan struct{}
+}
+
+// Wait blocks until a connection slot may have been released since joining or
+// the previous Wait, after which the caller tries to acquire one again.
+// Returns ErrQueueTimeout once the queue timeout since joining has passed, or
+// the error of ctx if it ends first.
+func (w *Waiter) Wait(ctx context.Context) error {
+	remaining := time.Until(w.deadline)
+	if remaining <= 0 {
+		return ErrQueueTimeout
+	}
+	timer := time.NewTimer(remaining)
+	defer timer.Stop()
+	select {
+	case <-w.released:
+		w.released = w.queue.limiter.Released()
+		return nil
+	case <-timer.C:
+		return ErrQueueTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Leave removes the request from the queue and returns how long it waited.
+func (w *Waiter) Leave() time.Duration {
+	w.queue.waiting.Add(-1)
+	return time.Since(w.start)
+}
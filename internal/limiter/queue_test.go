@@ -0,0 +1,97 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
+)
+
+func TestQueue_Disabled(t *testing.T) {
+	q := NewQueue(New(1, 1, netutil.MustParseAddrs([]string{"192.168.1.1"})), 0, time.Second)
+	if _, err := q.Join(); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Join() error = %v, want ErrQueueFull", err)
+	}
+
+	var nilQueue *Queue
+	if _, err := nilQueue.Join(); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("nil Join() error = %v, want ErrQueueFull", err)
+	}
+}
+
+func TestQueue_Full(t *testing.T) {
+	q := NewQueue(New(1, 1, netutil.MustParseAddrs([]string{"192.168.1.1"})), 1, time.Second)
+	w, err := q.Join()
+	if err != nil {
+		t.Fatalf("Join() error = %v", err)
+	}
+	if _, err := q.Join(); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("second Join() error = %v, want ErrQueueFull", err)
+	}
+	if got := q.Len(); got != 1 {
+		t.Errorf("Len() = %d, want 1", got)
+	}
+
+	w.Leave()
+	if got := q.Len(); got != 0 {
+		t.Errorf("Len() after Leave = %d, want 0", got)
+	}
+	if _, err := q.Join(); err != nil {
+		t.Errorf("Join() after Leave error = %v", err)
+	}
+}
+
+func TestQueue_WaitRelease(t *testing.T) {
+	l := New(1, 1, netutil.MustParseAddrs([]string{"192.168.1.1"}))
+	if err := l.Acquire(netip.MustParseAddr("192.168.1.1")); err != nil {
+		t.Fatalf("Acquire() error = %v", err)
+	}
+	q := NewQueue(l, 1, 5*time.Second)
+	w, err := q.Join()
+	if err != nil {
+		t.Fatalf("Join() error = %v", err)
+	}
+	defer w.Leave()
+
+	// A release between joining and waiting must not be missed
+	l.Release(netip.MustParseAddr("192.168.1.1"))
+	if err := w.Wait(context.Background()); err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+	if err := l.Acquire(netip.MustParseAddr("192.168.1.1")); err != nil {
+		t.Errorf("Acquire() after Wait error = %v", err)
+	}
+}
+
+func TestQueue_WaitTimeout(t *testing.T) {
+	l := New(1, 1, netutil.MustParseAddrs([]string{"192.168.1.1"}))
+	q := NewQueue(l, 1, 20*time.Millisecond)
+	w, err := q.Join()
+	if err != nil {
+		t.Fatalf("Join() error = %v", err)
+	}
+	if err := w.Wait(context.Background()); !errors.Is(err, ErrQueueTimeout) {
+		t.Errorf("Wait() error = %v, want ErrQueueTimeout", err)
+	}
+	if waited := w.Leave(); waited < 20*time.Millisecond {
+		t.Errorf("Leave() = %v, want at least the timeout", waited)
+	}
+}
+
+func TestQueue_WaitCancelled(t *testing.T) {
+	q := NewQueue(New(1, 1, netutil.MustParseAddrs([]string{"192.168.1.1"})), 1, time.Second)
+	w, err := q.Join()
+	if err != nil {
+		t.Fatalf("Join() error = %v", err)
+	}
+	defer w.Leave()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := w.Wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Wait() error = %v, want context.Canceled", err)
+	}
+}
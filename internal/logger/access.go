@@ -0,0 +1,146 @@
+// Package logger provides structured logging using log/slog.
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Access log formats.
+const (
+	AccessFormatJSON = "json"
+	AccessFormatCLF  = "clf"
+)
+
+// clfTime is the timestamp layout of the Common Log Format.
+const clfTime = "02/Jan/2006:15:04:05 -0700"
+
+// accessLog is the access log set by SetAccessLog (nil when disabled).
+var accessLog atomic.Pointer[AccessLog]
+
+// AccessEntry is one proxied request in the access log.
+type AccessEntry struct {
+	Time       time.Time `json:"time"`
+	Method     string    `json:"method"`
+	Host       string    `json:"host"`
+	ClientIP   string    `json:"client_ip"`
+	OutboundIP string    `json:"outbound_ip"`
+	User       string    `json:"user"`
+	Status     int       `json:"status"`
+	BytesIn    int64     `json:"bytes_in"`
+	BytesOut   int64     `json:"bytes_out"`
+	DurationMS int64     `json:"duration_ms"`
+	RequestID  string    `json:"request_id,omitempty"`
+}
+
+// AccessLog writes one line per proxied request, whatever the application
+// log level.
+type AccessLog struct {
+	mu     sync.Mutex
+	w      io.Writer
+	file   *File // nil for stdout and stderr
+	format string
+}
+
+// NewAccessLog opens the access log at path ("stdout", "stderr" or a file,
+// appended to and rotated according to r) writing entries in format
+// (AccessFormatJSON or AccessFormatCLF).
+func NewAccessLog(path, format string, r Rotation) (*AccessLog, error) {
+	a := &AccessLog{format: format}
+	switch path {
+	case "stdout":
+		a.w = os.Stdout
+	case "stderr":
+		a.w = os.Stderr
+	default:
+		f, err := OpenFile(path, r)
+		if err != nil {
+			return nil, fmt.Errorf("opening access log: %w", err)
+		}
+		a.w, a.file = f, f
+	}
+	return a, nil
+}
+
+// Write appends e to the access log.
+func (a *AccessLog) Write(e AccessEntry) {
+	var line []byte
+	if a.format == AccessFormatCLF {
+		user := e.User
+		if user == "" {
+			user = "-"
+		}
+		line = fmt.Appendf(nil, "%s - %s [%s] \"%s %s\" %d %d %s %d\n",
+			e.ClientIP, user, e.Time.Format(clfTime), e.Method, e.Host,
+			e.Status, e.BytesOut, e.OutboundIP, e.DurationMS)
+	} else {
+		line, _ = json.Marshal(e)
+		line = append(line, '\n')
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.w.Write(line)
+}
+
+// Reopen reopens the access log file, for files rotated by an external tool.
+func (a *AccessLog) Reopen() error {
+	if a.file == nil {
+		return nil
+	}
+	return a.file.Reopen()
+}
+
+// Close closes the access log file.
+func (a *AccessLog) Close() error {
+	if a.file == nil {
+		return nil
+	}
+	return a.file.Close()
+}
+
+// SetAccessLog makes LogRequest also write to a (nil disables the access
+// log).
+func SetAccessLog(a *AccessLog) {
+	accessLog.Store(a)
+}
+
+// writeAccess writes a request logged by LogRequest to the access log, taking
+// the user and request ID from its additional key-value pairs.
+func writeAccess(method, host, sourceIP, outboundIP string, status int, duration int64, bytesIn, bytesOut int64, args []any) {
+	a := accessLog.Load()
+	if a == nil {
+		return
+	}
+	clientIP, _, err := net.SplitHostPort(sourceIP)
+	if err != nil {
+		clientIP = sourceIP
+	}
+	e := AccessEntry{
+		Time:       time.Now(),
+		Method:     method,
+		Host:       host,
+		ClientIP:   clientIP,
+		OutboundIP: outboundIP,
+		Status:     status,
+		BytesIn:    bytesIn,
+		BytesOut:   bytesOut,
+		DurationMS: duration,
+	}
+	for i := 0; i+1 < len(args); i += 2 {
+		value, _ := args[i+1].(string)
+		switch args[i] {
+		case "user":
+			e.User = value
+		case "request_id":
+			e.RequestID = value
+		}
+	}
+	a.Write(e)
+}
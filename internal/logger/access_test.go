@@ -0,0 +1,75 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogRequest_AccessLogJSON(t *testing.T) {
+	var buf bytes.Buffer
+	SetAccessLog(&AccessLog{w: &buf, format: AccessFormatJSON})
+	defer SetAccessLog(nil)
+
+	// The access log does not depend on the application log level
+	oldDefault := defaultLogger
+	defaultLogger = New("error", "json", &bytes.Buffer{})
+	defer func() { defaultLogger = oldDefault }()
+
+	LogRequest("GET", "example.com", "10.0.0.7:51234", "192.168.1.100", 200, 15, 10, 512,
+		"request_id", "req-1", "session_id", "sess-1", "user", "alice")
+
+	var e AccessEntry
+	if err := json.Unmarshal(buf.Bytes(), &e); err != nil {
+		t.Fatalf("failed to parse access log line %q: %v", buf.String(), err)
+	}
+	if e.Method != "GET" || e.Host != "example.com" || e.ClientIP != "10.0.0.7" || e.OutboundIP != "192.168.1.100" {
+		t.Errorf("unexpected request fields: %+v", e)
+	}
+	if e.User != "alice" || e.RequestID != "req-1" || e.Status != 200 || e.BytesIn != 10 || e.BytesOut != 512 || e.DurationMS != 15 {
+		t.Errorf("unexpected entry: %+v", e)
+	}
+}
+
+func TestLogRequest_AccessLogCLF(t *testing.T) {
+	var buf bytes.Buffer
+	SetAccessLog(&AccessLog{w: &buf, format: AccessFormatCLF})
+	defer SetAccessLog(nil)
+
+	LogRequest("CONNECT", "api.example.com:443", "10.0.0.7:51234", "192.168.1.100", 200, 1500, 100, 2048, "user", "")
+
+	line := buf.String()
+	if !strings.HasPrefix(line, "10.0.0.7 - - [") {
+		t.Errorf("expected client and anonymous user first, got %q", line)
+	}
+	if !strings.HasSuffix(line, `] "CONNECT api.example.com:443" 200 2048 192.168.1.100 1500`+"\n") {
+		t.Errorf("unexpected CLF line %q", line)
+	}
+}
+
+func TestNewAccessLog_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	a, err := NewAccessLog(path, AccessFormatJSON, Rotation{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	a.Write(AccessEntry{Method: "GET", Host: "example.com", Status: 200})
+	if err := a.Close(); err != nil {
+		t.Fatalf("unexpected close error: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read access log: %v", err)
+	}
+	if !strings.Contains(string(data), `"host":"example.com"`) {
+		t.Errorf("expected the entry in the file, got %q", data)
+	}
+
+	if _, err := NewAccessLog(filepath.Join(t.TempDir(), "missing", "access.log"), AccessFormatJSON, Rotation{}); err == nil {
+		t.Error("expected an error for a missing directory")
+	}
+}
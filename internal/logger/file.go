@@ -0,0 +1,171 @@
+// Package logger provides structured logging using log/slog.
+package logger
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTime is the timestamp layout appended to rotated files. It sorts
+// lexically in time order.
+const backupTime = "20060102T150405.000"
+
+// Rotation sets when a log file is rotated and how many rotated files are
+// kept. Zero values disable the corresponding limit.
+type Rotation struct {
+	// MaxSize is the size in bytes a file may reach before it is rotated.
+	MaxSize int64
+	// MaxAge is how long a file is written to before it is rotated.
+	MaxAge time.Duration
+	// MaxBackups is how many rotated files are kept, oldest removed first.
+	MaxBackups int
+}
+
+// File is a log file rotated by size and age. Rotated files are renamed to
+// the file name followed by the rotation time (e.g. proxy.log.20250102T150405.000).
+type File struct {
+	mu       sync.Mutex
+	path     string
+	rotation Rotation
+	f        *os.File
+	size     int64
+	opened   time.Time
+}
+
+// OpenFile opens the log file at path, appending to it, rotated according
+// to r.
+func OpenFile(path string, r Rotation) (*File, error) {
+	lf := &File{path: path, rotation: r}
+	if err := lf.open(); err != nil {
+		return nil, err
+	}
+	return lf, nil
+}
+
+// open opens lf.path. lf.mu must be held once lf is shared.
+func (lf *File) open() error {
+	f, err := os.OpenFile(lf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("opening log file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("opening log file: %w", err)
+	}
+	lf.f, lf.size, lf.opened = f, info.Size(), time.Now()
+	return nil
+}
+
+// Write appends p to the file, rotating it first if p would take it past
+// the maximum size or the file has reached the maximum age.
+func (lf *File) Write(p []byte) (int, error) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+
+	if lf.f == nil {
+		return 0, os.ErrClosed
+	}
+	if lf.due(len(p)) {
+		if err := lf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := lf.f.Write(p)
+	lf.size += int64(n)
+	return n, err
+}
+
+// due reports whether the file must be rotated before writing n bytes.
+// Empty files are never rotated. lf.mu must be held.
+func (lf *File) due(n int) bool {
+	if lf.size == 0 {
+		return false
+	}
+	r := lf.rotation
+	return (r.MaxSize > 0 && lf.size+int64(n) > r.MaxSize) ||
+		(r.MaxAge > 0 && time.Since(lf.opened) >= r.MaxAge)
+}
+
+// rotate renames the file to its backup name, opens a new one and removes
+// the backups over the limit. lf.mu must be held.
+func (lf *File) rotate() error {
+	lf.f.Close()
+	lf.f = nil
+	// A failed rename keeps appending to the same file rather than losing logs
+	renameErr := os.Rename(lf.path, lf.path+"."+time.Now().Format(backupTime))
+	if err := lf.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return fmt.Errorf("rotating log file: %w", renameErr)
+	}
+	lf.prune()
+	return nil
+}
+
+// prune removes the oldest backups beyond MaxBackups. lf.mu must be held.
+func (lf *File) prune() {
+	if lf.rotation.MaxBackups <= 0 {
+		return
+	}
+	backups := lf.backups()
+	if len(backups) <= lf.rotation.MaxBackups {
+		return
+	}
+	for _, name := range backups[:len(backups)-lf.rotation.MaxBackups] {
+		os.Remove(name)
+	}
+}
+
+// backups returns the paths of the rotated files, oldest first.
+func (lf *File) backups() []string {
+	dir, base := filepath.Split(lf.path)
+	entries, err := os.ReadDir(filepath.Clean(dir + "."))
+	if err != nil {
+		return nil
+	}
+	var backups []string
+	for _, e := range entries {
+		suffix, ok := strings.CutPrefix(e.Name(), base+".")
+		if !ok || e.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(backupTime, suffix); err != nil {
+			continue
+		}
+		backups = append(backups, filepath.Join(dir, e.Name()))
+	}
+	slices.Sort(backups)
+	return backups
+}
+
+// Reopen closes and reopens the file at its path, for files rotated by an
+// external tool such as logrotate.
+func (lf *File) Reopen() error {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+
+	if lf.f != nil {
+		lf.f.Close()
+	}
+	return lf.open()
+}
+
+// Close closes the file. Writes after Close fail.
+func (lf *File) Close() error {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+
+	if lf.f == nil {
+		return nil
+	}
+	err := lf.f.Close()
+	lf.f = nil
+	return err
+}
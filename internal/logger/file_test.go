@@ -0,0 +1,106 @@
+package logger
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFile_RotatesBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.log")
+	f, err := OpenFile(path, Rotation{MaxSize: 20, MaxBackups: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer f.Close()
+
+	for i := 0; i < 4; i++ {
+		if _, err := f.Write([]byte("0123456789abcdef\n")); err != nil {
+			t.Fatalf("write %d failed: %v", i, err)
+		}
+		// Backups are named after the rotation time in milliseconds
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	if got := len(f.backups()); got != 2 {
+		t.Errorf("expected 2 backups kept, got %d", got)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read log file: %v", err)
+	}
+	if string(data) != "0123456789abcdef\n" {
+		t.Errorf("expected only the last line in the current file, got %q", data)
+	}
+}
+
+func TestFile_RotatesByAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.log")
+	f, err := OpenFile(path, Rotation{MaxAge: time.Hour})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer f.Close()
+
+	f.Write([]byte("first\n"))
+	f.opened = time.Now().Add(-2 * time.Hour)
+	f.Write([]byte("second\n"))
+
+	backups := f.backups()
+	if len(backups) != 1 {
+		t.Fatalf("expected 1 backup, got %d", len(backups))
+	}
+	if data, _ := os.ReadFile(backups[0]); string(data) != "first\n" {
+		t.Errorf("expected the first line in the backup, got %q", data)
+	}
+}
+
+func TestFile_Reopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "proxy.log")
+	f, err := OpenFile(path, Rotation{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer f.Close()
+
+	f.Write([]byte("before\n"))
+	// Moved away as logrotate would
+	if err := os.Rename(path, filepath.Join(dir, "proxy.log.1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reopen(); err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	f.Write([]byte("after\n"))
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("expected the log file to be recreated: %v", err)
+	}
+	if string(data) != "after\n" {
+		t.Errorf("expected only the line written after reopening, got %q", data)
+	}
+}
+
+func TestOpenLogFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.log")
+	Init("info", "json")
+	if err := OpenLogFile(path, Rotation{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	Info("to_file", "key", "value")
+	if err := CloseOutput(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read log file: %v", err)
+	}
+	if !strings.Contains(string(data), `"msg":"to_file"`) {
+		t.Errorf("expected the message in the log file, got %q", data)
+	}
+}
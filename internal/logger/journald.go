@@ -0,0 +1,75 @@
+// Package logger provides structured logging using log/slog.
+package logger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// journaldSocket is the systemd-journald native protocol socket.
+var journaldSocket = "/run/systemd/journal/socket"
+
+// Journald sends log records to systemd-journald over its native protocol,
+// with the syslog priority and identifier as journal fields.
+type Journald struct {
+	mu   sync.Mutex
+	conn net.Conn
+	tag  string
+}
+
+// DialJournald connects to the local journald, sending messages with tag as
+// SYSLOG_IDENTIFIER.
+func DialJournald(tag string) (*Journald, error) {
+	conn, err := net.Dial("unixgram", journaldSocket)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to journald: %w", err)
+	}
+	return &Journald{conn: conn, tag: tag}, nil
+}
+
+// appendJournalField appends a KEY=value field, using the length-prefixed
+// form for values containing newlines.
+func appendJournalField(b []byte, key string, value []byte) []byte {
+	b = append(b, key...)
+	if bytes.IndexByte(value, '\n') < 0 {
+		b = append(b, '=')
+		b = append(b, value...)
+		return append(b, '\n')
+	}
+	b = append(b, '\n')
+	b = binary.LittleEndian.AppendUint64(b, uint64(len(value)))
+	b = append(b, value...)
+	return append(b, '\n')
+}
+
+// WriteLevel sends msg as the MESSAGE field with the syslog priority of
+// level.
+func (j *Journald) WriteLevel(level slog.Level, msg []byte) error {
+	var b []byte
+	b = appendJournalField(b, "PRIORITY", strconv.AppendInt(nil, int64(severity(level)), 10))
+	b = appendJournalField(b, "SYSLOG_IDENTIFIER", []byte(j.tag))
+	b = appendJournalField(b, "MESSAGE", msg)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, err := j.conn.Write(b)
+	return err
+}
+
+// Write sends p at info level.
+func (j *Journald) Write(p []byte) (int, error) {
+	if err := j.WriteLevel(slog.LevelInfo, bytes.TrimSuffix(p, []byte("\n"))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close closes the connection to journald.
+func (j *Journald) Close() error {
+	return j.conn.Close()
+}
@@ -3,10 +3,13 @@ package logger
 
 import (
 	"context"
+	"errors"
 	"io"
 	"log/slog"
+	"net/netip"
 	"os"
 	"sync"
+	"sync/atomic"
 )
 
 // LevelTrace is more verbose than debug, for detailed tracing.
@@ -17,7 +20,14 @@ var (
 	levelVar      = new(slog.LevelVar)
 	currentFormat string
 	output        io.Writer
+	logFile       *File     // set by OpenLogFile, for Reopen
+	outputCloser  io.Closer // nil when logging to stdout
 	mu            sync.RWMutex
+
+	// sampleEvery is N when LogRequest logs 1 in N successful requests
+	sampleEvery atomic.Int64
+	sampleCount atomic.Uint64
+	suppressed  atomic.Uint64
 )
 
 // Init initializes the global logger with the specified level and format.
@@ -33,6 +43,88 @@ func Init(level, format string) {
 	defaultLogger = newLogger(format, output)
 }
 
+// OpenLogFile makes the global logger write to the file at path instead of
+// stdout, rotated according to r.
+func OpenLogFile(path string, r Rotation) error {
+	f, err := OpenFile(path, r)
+	if err != nil {
+		return err
+	}
+	setOutput(f, f)
+	return nil
+}
+
+// OpenSyslog makes the global logger send records to the syslog server at
+// address (see ParseSyslogAddress) instead of stdout, with tag as the app
+// name.
+func OpenSyslog(address, tag string) error {
+	s, err := DialSyslog(address, tag)
+	if err != nil {
+		return err
+	}
+	setOutput(s, nil)
+	return nil
+}
+
+// OpenJournald makes the global logger send records to systemd-journald
+// instead of stdout, with tag as the syslog identifier.
+func OpenJournald(tag string) error {
+	j, err := DialJournald(tag)
+	if err != nil {
+		return err
+	}
+	setOutput(j, nil)
+	return nil
+}
+
+// setOutput replaces the output of the global logger with w, closing the
+// previous one. f is the log file Reopen reopens, if any.
+func setOutput(w io.WriteCloser, f *File) {
+	mu.Lock()
+	old := outputCloser
+	output, outputCloser, logFile = w, w, f
+	defaultLogger = newLogger(currentFormat, output)
+	mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+}
+
+// CloseOutput makes the global logger write to stdout again and closes the
+// log file, syslog or journald connection opened for it, if any.
+func CloseOutput() error {
+	mu.Lock()
+	old := outputCloser
+	if old != nil {
+		output, outputCloser, logFile = os.Stdout, nil, nil
+		defaultLogger = newLogger(currentFormat, output)
+	}
+	mu.Unlock()
+
+	if old == nil {
+		return nil
+	}
+	return old.Close()
+}
+
+// Reopen reopens the log file and the access log file, if any, so that
+// files moved away by an external tool such as logrotate are recreated.
+func Reopen() error {
+	mu.RLock()
+	f := logFile
+	mu.RUnlock()
+
+	var errs []error
+	if f != nil {
+		errs = append(errs, f.Reopen())
+	}
+	if a := accessLog.Load(); a != nil {
+		errs = append(errs, a.Reopen())
+	}
+	return errors.Join(errs...)
+}
+
 // parseLevel converts a string level to slog.Level.
 func parseLevel(level string) slog.Level {
 	switch level {
@@ -51,29 +143,37 @@ func parseLevel(level string) slog.Level {
 	}
 }
 
+// replaceLevel names the trace level of a record TRACE. Only the record
+// level is replaced; an attribute that is also called "level" may hold
+// anything and is left alone.
+func replaceLevel(groups []string, a slog.Attr) slog.Attr {
+	if a.Key == slog.LevelKey && len(groups) == 0 {
+		if level, ok := a.Value.Any().(slog.Level); ok && level == LevelTrace {
+			a.Value = slog.StringValue("TRACE")
+		}
+	}
+	return a
+}
+
 // newLogger creates a new logger with the current levelVar.
 func newLogger(format string, w io.Writer) *slog.Logger {
 	opts := &slog.HandlerOptions{
-		Level: levelVar,
-		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
-			if a.Key == slog.LevelKey {
-				level := a.Value.Any().(slog.Level)
-				if level == LevelTrace {
-					a.Value = slog.StringValue("TRACE")
-				}
-			}
-			return a
-		},
+		Level:       levelVar,
+		ReplaceAttr: replaceLevel,
 	}
 
-	var handler slog.Handler
-	if format == "json" {
-		handler = slog.NewJSONHandler(w, opts)
-	} else {
-		handler = slog.NewTextHandler(w, opts)
+	if lw, ok := w.(LevelWriter); ok {
+		return slog.New(newLevelHandler(format, opts, lw))
 	}
+	return slog.New(formatHandler(format, w, opts))
+}
 
-	return slog.New(handler)
+// formatHandler creates a JSON or text handler writing to w.
+func formatHandler(format string, w io.Writer, opts *slog.HandlerOptions) slog.Handler {
+	if format == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
 }
 
 // New creates a new logger with the specified configuration.
@@ -95,16 +195,8 @@ func New(level, format string, w io.Writer) *slog.Logger {
 	}
 
 	opts := &slog.HandlerOptions{
-		Level: lvl,
-		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
-			if a.Key == slog.LevelKey {
-				level := a.Value.Any().(slog.Level)
-				if level == LevelTrace {
-					a.Value = slog.StringValue("TRACE")
-				}
-			}
-			return a
-		},
+		Level:       lvl,
+		ReplaceAttr: replaceLevel,
 	}
 
 	var handler slog.Handler
@@ -120,8 +212,6 @@ func New(level, format string, w io.Writer) *slog.Logger {
 // Reconfigure changes the log level and/or format at runtime.
 func Reconfigure(level, format string) {
 	mu.Lock()
-	defer mu.Unlock()
-
 	levelVar.Set(parseLevel(level))
 
 	// Recreate handler if format changed
@@ -129,7 +219,9 @@ func Reconfigure(level, format string) {
 		currentFormat = format
 		defaultLogger = newLogger(format, output)
 	}
+	mu.Unlock()
 
+	// Logging takes the lock, so it must be released first
 	Info("logger_reconfigured", "level", level, "format", format)
 }
 
@@ -173,6 +265,11 @@ func Error(msg string, args ...any) {
 	Default().Error(msg, args...)
 }
 
+// Log logs at the named level (trace, debug, info, warn or error).
+func Log(level, msg string, args ...any) {
+	Default().Log(context.Background(), parseLevel(level), msg, args...)
+}
+
 // TraceContext logs at trace level with context.
 func TraceContext(ctx context.Context, msg string, args ...any) {
 	Default().Log(ctx, LevelTrace, msg, args...)
@@ -208,9 +305,39 @@ func WithGroup(name string) *slog.Logger {
 	return Default().WithGroup(name)
 }
 
-// LogRequest logs a proxy request with standard fields.
-func LogRequest(method, host, sourceIP, outboundIP string, status int, duration int64, bytesIn, bytesOut int64) {
-	Default().Info("request",
+// SetRequestSampling makes LogRequest log only 1 in n successful requests
+// (status below 400); failed requests are always logged. n <= 1 logs every
+// request.
+func SetRequestSampling(n int) {
+	sampleEvery.Store(int64(n))
+}
+
+// SuppressedRequests returns how many request entries LogRequest dropped by
+// sampling.
+func SuppressedRequests() uint64 {
+	return suppressed.Load()
+}
+
+// sampled reports whether a request with status is logged.
+func sampled(status int) bool {
+	n := sampleEvery.Load()
+	if n <= 1 || status == 0 || status >= 400 {
+		return true
+	}
+	return sampleCount.Add(1)%uint64(n) == 1
+}
+
+// LogRequest logs a proxy request with standard fields, and writes it to the
+// access log if one is set. Additional key-value pairs (e.g. request and
+// session IDs) are appended. Successful requests are sampled as set by
+// SetRequestSampling; the access log is not.
+func LogRequest(method, host, sourceIP, outboundIP string, status int, duration int64, bytesIn, bytesOut int64, args ...any) {
+	writeAccess(method, host, sourceIP, outboundIP, status, duration, bytesIn, bytesOut, args)
+	if !sampled(status) {
+		suppressed.Add(1)
+		return
+	}
+	allArgs := append([]any{
 		"method", method,
 		"host", host,
 		"source_ip", sourceIP,
@@ -219,11 +346,12 @@ func LogRequest(method, host, sourceIP, outboundIP string, status int, duration
 		"duration_ms", duration,
 		"bytes_in", bytesIn,
 		"bytes_out", bytesOut,
-	)
+	}, args...)
+	Default().Info("request", allArgs...)
 }
 
 // LogBalancerSelection logs IP selection by the balancer.
-func LogBalancerSelection(host, selectedIP string, candidateCount int) {
+func LogBalancerSelection(host string, selectedIP netip.Addr, candidateCount int) {
 	Default().Debug("balancer_selection",
 		"host", host,
 		"selected_ip", selectedIP,
@@ -232,7 +360,7 @@ func LogBalancerSelection(host, selectedIP string, candidateCount int) {
 }
 
 // LogConnectionLimit logs when a connection limit is reached.
-func LogConnectionLimit(limitType, ip string, current, max int) {
+func LogConnectionLimit(limitType string, ip netip.Addr, current, max int) {
 	Default().Warn("connection_limit_reached",
 		"limit_type", limitType,
 		"ip", ip,
@@ -2,8 +2,12 @@ package logger
 
 import (
 	"bytes"
+	"context"
+	"log/slog"
+	"net/netip"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestNew(t *testing.T) {
@@ -108,6 +112,48 @@ func TestLogRequest(t *testing.T) {
 	}
 }
 
+func TestLogRequest_ExtraArgs(t *testing.T) {
+	var buf bytes.Buffer
+	log := New("info", "json", &buf)
+	oldDefault := defaultLogger
+	defaultLogger = log
+	defer func() { defaultLogger = oldDefault }()
+
+	LogRequest("GET", "example.com", "127.0.0.1:1234", "192.168.1.1", 200, 100, 1024, 2048, "session_id", "sess-1")
+
+	if !strings.Contains(buf.String(), `"session_id":"sess-1"`) {
+		t.Errorf("expected session_id in output, got %s", buf.String())
+	}
+}
+
+func TestLogRequest_Sampling(t *testing.T) {
+	var buf bytes.Buffer
+	log := New("info", "json", &buf)
+	oldDefault := defaultLogger
+	defaultLogger = log
+	defer func() { defaultLogger = oldDefault }()
+
+	SetRequestSampling(10)
+	defer SetRequestSampling(1)
+	before := SuppressedRequests()
+
+	for i := 0; i < 100; i++ {
+		LogRequest("GET", "example.com", "127.0.0.1:1234", "192.168.1.1", 200, 100, 1024, 2048)
+	}
+	LogRequest("GET", "example.com", "127.0.0.1:1234", "192.168.1.1", 502, 100, 1024, 0)
+
+	lines := strings.Count(buf.String(), "\n")
+	if lines != 11 {
+		t.Errorf("expected 10 sampled successes and the failure logged, got %d lines", lines)
+	}
+	if !strings.Contains(buf.String(), `"status":502`) {
+		t.Error("expected the failed request to be logged")
+	}
+	if got := SuppressedRequests() - before; got != 90 {
+		t.Errorf("expected 90 suppressed entries, got %d", got)
+	}
+}
+
 func TestLogBalancerSelection(t *testing.T) {
 	var buf bytes.Buffer
 	log := New("debug", "json", &buf)
@@ -115,12 +161,15 @@ func TestLogBalancerSelection(t *testing.T) {
 	defaultLogger = log
 	defer func() { defaultLogger = oldDefault }()
 
-	LogBalancerSelection("example.com", "192.168.1.1", 3)
+	LogBalancerSelection("example.com", netip.MustParseAddr("192.168.1.1"), 3)
 
 	output := buf.String()
 	if !strings.Contains(output, "balancer_selection") {
 		t.Error("expected 'balancer_selection' in output")
 	}
+	if !strings.Contains(output, `"selected_ip":"192.168.1.1"`) {
+		t.Errorf("expected the selected IP in output, got %s", output)
+	}
 }
 
 func TestLogConnectionLimit(t *testing.T) {
@@ -130,7 +179,7 @@ func TestLogConnectionLimit(t *testing.T) {
 	defaultLogger = log
 	defer func() { defaultLogger = oldDefault }()
 
-	LogConnectionLimit("per_ip", "192.168.1.1", 100, 100)
+	LogConnectionLimit("per_ip", netip.MustParseAddr("192.168.1.1"), 100, 100)
 
 	output := buf.String()
 	if !strings.Contains(output, "connection_limit_reached") {
@@ -175,3 +224,51 @@ func TestDefault(t *testing.T) {
 		t.Error("expected non-nil default logger")
 	}
 }
+
+func TestReconfigure(t *testing.T) {
+	var buf bytes.Buffer
+	oldDefault, oldOutput, oldFormat := defaultLogger, output, currentFormat
+	output = &buf
+	currentFormat = "json"
+	defaultLogger = newLogger("json", &buf)
+	defer func() {
+		defaultLogger, output, currentFormat = oldDefault, oldOutput, oldFormat
+		levelVar.Set(slog.LevelInfo)
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		Reconfigure("debug", "text")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Reconfigure() did not return")
+	}
+
+	if !strings.Contains(buf.String(), "logger_reconfigured") {
+		t.Errorf("expected logger_reconfigured in output, got %q", buf.String())
+	}
+	Debug("debug after reconfigure")
+	if !strings.Contains(buf.String(), "msg=\"debug after reconfigure\"") {
+		t.Errorf("expected text debug output, got %q", buf.String())
+	}
+}
+
+func TestLevelAttribute(t *testing.T) {
+	var buf bytes.Buffer
+	log := New("trace", "json", &buf)
+
+	// Used to panic: only the record level holds a slog.Level
+	log.Info("logger_reconfigured", "level", "debug")
+	log.WithGroup("limits").Info("updated", "level", 3)
+	log.Log(context.Background(), LevelTrace, "traced")
+
+	out := buf.String()
+	for _, want := range []string{`"level":"debug"`, `"limits":{"level":3}`, `"level":"TRACE","msg":"traced"`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %s in output, got %q", want, out)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+// Package logger provides structured logging using log/slog.
+package logger
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// syslogFacility is the syslog facility messages are sent with (daemon).
+const syslogFacility = 3
+
+// syslogDialTimeout bounds connecting to the syslog server.
+const syslogDialTimeout = 5 * time.Second
+
+// rfc5424Time is the RFC 5424 timestamp layout (at most 6 fractional digits).
+const rfc5424Time = "2006-01-02T15:04:05.000000Z07:00"
+
+// LevelWriter is an output that receives each log record separately with its
+// level, such as syslog or journald. The logger formats the record with the
+// configured format and passes it without the trailing newline.
+type LevelWriter interface {
+	WriteLevel(level slog.Level, msg []byte) error
+}
+
+// severity returns the syslog severity of level.
+func severity(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3 // err
+	case level >= slog.LevelWarn:
+		return 4 // warning
+	case level >= slog.LevelInfo:
+		return 6 // info
+	default:
+		return 7 // debug
+	}
+}
+
+// levelHandler formats records with a JSON or text handler and passes each
+// to a LevelWriter.
+type levelHandler struct {
+	mu    *sync.Mutex // guards buf, shared with derived handlers
+	buf   *bytes.Buffer
+	inner slog.Handler // writes into buf
+	w     LevelWriter
+}
+
+// newLevelHandler creates a handler writing records in format to w.
+func newLevelHandler(format string, opts *slog.HandlerOptions, w LevelWriter) *levelHandler {
+	buf := new(bytes.Buffer)
+	return &levelHandler{mu: new(sync.Mutex), buf: buf, inner: formatHandler(format, buf, opts), w: w}
+}
+
+func (h *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+func (h *levelHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.buf.Reset()
+	if err := h.inner.Handle(ctx, r); err != nil {
+		return err
+	}
+	return h.w.WriteLevel(r.Level, bytes.TrimSuffix(h.buf.Bytes(), []byte("\n")))
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{mu: h.mu, buf: h.buf, inner: h.inner.WithAttrs(attrs), w: h.w}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{mu: h.mu, buf: h.buf, inner: h.inner.WithGroup(name), w: h.w}
+}
+
+// ParseSyslogAddress splits a syslog address (udp://host:port,
+// tcp://host:port or unix:///path) into a network and an address.
+func ParseSyslogAddress(address string) (network, addr string, err error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid syslog address %q: %w", address, err)
+	}
+	switch u.Scheme {
+	case "udp", "tcp":
+		if _, _, err := net.SplitHostPort(u.Host); err != nil {
+			return "", "", fmt.Errorf("invalid syslog address %q: %w", address, err)
+		}
+		return u.Scheme, u.Host, nil
+	case "unix":
+		if u.Path == "" {
+			return "", "", fmt.Errorf("invalid syslog address %q: missing socket path", address)
+		}
+		return "unix", u.Path, nil
+	}
+	return "", "", fmt.Errorf("invalid syslog address %q: scheme must be udp, tcp or unix", address)
+}
+
+// Syslog sends log records to a syslog server as RFC 5424 messages, one
+// datagram each over UDP and unix sockets and octet-counted over TCP.
+type Syslog struct {
+	mu       sync.Mutex
+	network  string
+	addr     string
+	tag      string
+	hostname string
+	conn     net.Conn
+}
+
+// DialSyslog connects to the syslog server at address (see
+// ParseSyslogAddress), sending messages with tag as the app name.
+func DialSyslog(address, tag string) (*Syslog, error) {
+	network, addr, err := ParseSyslogAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	s := &Syslog{network: network, addr: addr, tag: tag, hostname: hostname}
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// connect dials the syslog server. s.mu must be held once s is shared.
+func (s *Syslog) connect() error {
+	if s.network != "unix" {
+		conn, err := net.DialTimeout(s.network, s.addr, syslogDialTimeout)
+		if err != nil {
+			return fmt.Errorf("connecting to syslog: %w", err)
+		}
+		s.conn = conn
+		return nil
+	}
+	// Local syslog daemons listen on datagram or stream sockets
+	var err error
+	for _, network := range []string{"unixgram", "unix"} {
+		var conn net.Conn
+		if conn, err = net.DialTimeout(network, s.addr, syslogDialTimeout); err == nil {
+			s.conn = conn
+			return nil
+		}
+	}
+	return fmt.Errorf("connecting to syslog: %w", err)
+}
+
+// WriteLevel sends msg with the syslog severity of level, reconnecting once
+// if the connection was lost.
+func (s *Syslog) WriteLevel(level slog.Level, msg []byte) error {
+	frame := fmt.Appendf(nil, "<%d>1 %s %s %s %d - - %s",
+		syslogFacility*8+severity(level), time.Now().Format(rfc5424Time),
+		s.hostname, s.tag, os.Getpid(), msg)
+	if s.network == "tcp" {
+		// RFC 6587 octet counting
+		frame = append(strconv.AppendInt(nil, int64(len(frame)), 10), append([]byte(" "), frame...)...)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != nil {
+		if _, err := s.conn.Write(frame); err == nil {
+			return nil
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+	if err := s.connect(); err != nil {
+		return err
+	}
+	_, err := s.conn.Write(frame)
+	return err
+}
+
+// Write sends p at info level.
+func (s *Syslog) Write(p []byte) (int, error) {
+	if err := s.WriteLevel(slog.LevelInfo, bytes.TrimSuffix(p, []byte("\n"))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close closes the connection to the syslog server.
+func (s *Syslog) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
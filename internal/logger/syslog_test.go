@@ -0,0 +1,159 @@
+package logger
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSyslogAddress(t *testing.T) {
+	tests := []struct {
+		address     string
+		wantNetwork string
+		wantAddr    string
+		wantErr     bool
+	}{
+		{"udp://logs.example.com:514", "udp", "logs.example.com:514", false},
+		{"tcp://10.0.0.1:601", "tcp", "10.0.0.1:601", false},
+		{"unix:///dev/log", "unix", "/dev/log", false},
+		{"udp://logs.example.com", "", "", true},
+		{"unix://", "", "", true},
+		{"http://logs.example.com:514", "", "", true},
+	}
+	for _, tt := range tests {
+		network, addr, err := ParseSyslogAddress(tt.address)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, wantErr %v", tt.address, err, tt.wantErr)
+			continue
+		}
+		if network != tt.wantNetwork || addr != tt.wantAddr {
+			t.Errorf("%s: got %s %s, want %s %s", tt.address, network, addr, tt.wantNetwork, tt.wantAddr)
+		}
+	}
+}
+
+func TestSyslog_UDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	s, err := DialSyslog("udp://"+pc.LocalAddr().String(), "outbound-lb")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer s.Close()
+
+	l := slog.New(newLevelHandler("json", nil, s))
+	l.Warn("connection_limit_reached", "ip", "192.168.1.100")
+
+	buf := make([]byte, 2048)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("no message received: %v", err)
+	}
+	msg := string(buf[:n])
+	// daemon facility (3) * 8 + warning (4)
+	if !strings.HasPrefix(msg, "<28>1 ") {
+		t.Errorf("expected RFC 5424 header with priority 28, got %q", msg)
+	}
+	if !strings.Contains(msg, " outbound-lb ") || !strings.Contains(msg, `"msg":"connection_limit_reached"`) {
+		t.Errorf("expected app name and JSON record, got %q", msg)
+	}
+	if strings.HasSuffix(msg, "\n") {
+		t.Errorf("expected no trailing newline, got %q", msg)
+	}
+}
+
+func TestSyslog_TCPOctetCounting(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	s, err := DialSyslog("tcp://"+ln.Addr().String(), "outbound-lb")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer s.Close()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := s.WriteLevel(slog.LevelError, []byte("upstream failed")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	length, err := r.ReadString(' ')
+	if err != nil {
+		t.Fatalf("failed to read frame length: %v", err)
+	}
+	size, err := strconv.Atoi(strings.TrimSpace(length))
+	if err != nil {
+		t.Fatalf("invalid frame length %q", length)
+	}
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		t.Fatalf("failed to read frame: %v", err)
+	}
+	// daemon facility (3) * 8 + err (3)
+	if !strings.HasPrefix(string(frame), "<27>1 ") || !strings.HasSuffix(string(frame), " - - upstream failed") {
+		t.Errorf("unexpected frame %q", frame)
+	}
+}
+
+func TestJournald(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.sock")
+	pc, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("unix datagram sockets unavailable: %v", err)
+	}
+	defer pc.Close()
+
+	old := journaldSocket
+	journaldSocket = path
+	defer func() { journaldSocket = old }()
+
+	j, err := DialJournald("outbound-lb")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer j.Close()
+
+	if err := j.WriteLevel(slog.LevelInfo, []byte("line one\nline two")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	buf := make([]byte, 2048)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := pc.Read(buf)
+	if err != nil {
+		t.Fatalf("no message received: %v", err)
+	}
+	msg := string(buf[:n])
+	if !strings.HasPrefix(msg, "PRIORITY=6\nSYSLOG_IDENTIFIER=outbound-lb\nMESSAGE\n") {
+		t.Fatalf("unexpected fields %q", msg)
+	}
+	value := buf[len("PRIORITY=6\nSYSLOG_IDENTIFIER=outbound-lb\nMESSAGE\n"):n]
+	if size := binary.LittleEndian.Uint64(value[:8]); size != uint64(len("line one\nline two")) {
+		t.Errorf("expected the message length before a multi-line value, got %d", size)
+	}
+	if string(value[8:]) != "line one\nline two\n" {
+		t.Errorf("unexpected message value %q", value[8:])
+	}
+}
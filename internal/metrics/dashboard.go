@@ -0,0 +1,41 @@
+package metrics
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// dashboardHTML is the single-page dashboard, built on /stats, /events and
+// /debug/rejections.
+//
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// dashboardCSP keeps the dashboard from loading anything but its own inline
+// code and the endpoints of this server.
+const dashboardCSP = "default-src 'none'; connect-src 'self'; style-src 'unsafe-inline'; script-src 'unsafe-inline'"
+
+// dashboardHandler serves the dashboard.
+func (s *Server) dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", dashboardCSP)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(dashboardHTML)
+}
+
+// rootHandler redirects the server root to the dashboard and answers 404 for
+// unknown paths.
+func (s *Server) rootHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	// Relative, unlike http.Redirect, so that it works behind a path prefix
+	w.Header().Set("Location", "dashboard")
+	w.WriteHeader(http.StatusFound)
+}
@@ -3,17 +3,21 @@ package metrics
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
 )
 
 // TestMetricsEndpoint_PrometheusFormat tests that /metrics returns valid Prometheus format.
 func TestMetricsEndpoint_PrometheusFormat(t *testing.T) {
-	stats := NewStatsCollector([]string{"192.168.1.1", "192.168.1.2"})
+	stats := NewStatsCollector(netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2"}))
 	server := NewServer(0, stats)
 
 	// Create test server
@@ -65,15 +69,15 @@ func TestMetricsEndpoint_PrometheusFormat(t *testing.T) {
 
 // TestMetricsEndpoint_ContainsAllMetrics tests that all expected metrics are present.
 func TestMetricsEndpoint_ContainsAllMetrics(t *testing.T) {
-	stats := NewStatsCollector([]string{"192.168.1.1", "192.168.1.2"})
+	stats := NewStatsCollector(netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2"}))
 
 	// Trigger some metrics to ensure they're registered
 	stats.IncActiveConnections()
 	stats.IncTotalRequests()
 	stats.AddBytesSent(100)
 	stats.AddBytesReceived(50)
-	stats.IncConnectionsForIP("192.168.1.1")
-	stats.IncSelectionsForIP("192.168.1.1", "example.com")
+	stats.IncConnectionsForIP(netip.MustParseAddr("192.168.1.1"))
+	stats.IncSelectionsForIP(netip.MustParseAddr("192.168.1.1"), "example.com")
 
 	// Increment some Prometheus-only metrics
 	RequestsTotal.WithLabelValues("CONNECT", "200").Inc()
@@ -133,7 +137,7 @@ func TestMetricsEndpoint_ContainsAllMetrics(t *testing.T) {
 
 // TestHealthEndpoint_Integration tests the /health endpoint with a real HTTP server.
 func TestHealthEndpoint_Integration(t *testing.T) {
-	stats := NewStatsCollector([]string{"192.168.1.1"})
+	stats := NewStatsCollector(netutil.MustParseAddrs([]string{"192.168.1.1"}))
 	server := NewServer(0, stats)
 
 	// Use the server's handler directly
@@ -170,7 +174,7 @@ func TestHealthEndpoint_Integration(t *testing.T) {
 
 // TestReadyEndpoint_Integration tests the /ready endpoint with both states.
 func TestReadyEndpoint_Integration(t *testing.T) {
-	stats := NewStatsCollector([]string{"192.168.1.1"})
+	stats := NewStatsCollector(netutil.MustParseAddrs([]string{"192.168.1.1"}))
 	server := NewServer(0, stats)
 
 	t.Run("not ready", func(t *testing.T) {
@@ -219,7 +223,7 @@ func TestReadyEndpoint_Integration(t *testing.T) {
 // TestStatsEndpoint_Integration tests the /stats endpoint with various states.
 func TestStatsEndpoint_Integration(t *testing.T) {
 	ips := []string{"192.168.1.1", "192.168.1.2", "10.0.0.1"}
-	stats := NewStatsCollector(ips)
+	stats := NewStatsCollector(netutil.MustParseAddrs(ips))
 
 	// Simulate some activity
 	stats.IncActiveConnections()
@@ -229,11 +233,11 @@ func TestStatsEndpoint_Integration(t *testing.T) {
 	stats.IncTotalRequests()
 	stats.AddBytesSent(1500)
 	stats.AddBytesReceived(750)
-	stats.IncConnectionsForIP("192.168.1.1")
-	stats.IncConnectionsForIP("192.168.1.2")
-	stats.IncSelectionsForIP("192.168.1.1", "example.com")
-	stats.IncSelectionsForIP("192.168.1.1", "example.com")
-	stats.IncSelectionsForIP("192.168.1.2", "other.com")
+	stats.IncConnectionsForIP(netip.MustParseAddr("192.168.1.1"))
+	stats.IncConnectionsForIP(netip.MustParseAddr("192.168.1.2"))
+	stats.IncSelectionsForIP(netip.MustParseAddr("192.168.1.1"), "example.com")
+	stats.IncSelectionsForIP(netip.MustParseAddr("192.168.1.1"), "example.com")
+	stats.IncSelectionsForIP(netip.MustParseAddr("192.168.1.2"), "other.com")
 
 	server := NewServer(0, stats)
 
@@ -288,9 +292,341 @@ func TestStatsEndpoint_Integration(t *testing.T) {
 	}
 }
 
+// TestCircuitEndpoint tests /stats/circuit with and without a circuit breaker.
+func TestCircuitEndpoint(t *testing.T) {
+	stats := NewStatsCollector(netutil.MustParseAddrs([]string{"192.168.1.1"}))
+	server := NewServer(0, stats)
+
+	w := httptest.NewRecorder()
+	server.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stats/circuit", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 without a circuit breaker, got %d", w.Code)
+	}
+
+	stats.SetCircuitSource(func() map[string]CircuitInfo {
+		return map[string]CircuitInfo{"192.168.1.1": {State: "open", Failures: 5}}
+	})
+	w = httptest.NewRecorder()
+	server.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stats/circuit", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	var response map[string]CircuitInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to parse JSON response: %v", err)
+	}
+	if got := response["192.168.1.1"]; got.State != "open" || got.Failures != 5 {
+		t.Errorf("unexpected circuit info: %+v", got)
+	}
+}
+
+func TestHostsEndpoint(t *testing.T) {
+	stats := NewStatsCollector(netutil.MustParseAddrs([]string{"192.168.1.1"}))
+	server := NewServer(0, stats)
+
+	w := httptest.NewRecorder()
+	server.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stats/hosts", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 without host stats, got %d", w.Code)
+	}
+
+	stats.EnableHostStats(100)
+	stats.RecordHost("a.example.com", netip.MustParseAddr("192.168.1.1"), 10, 0, false)
+	stats.RecordHost("b.example.com", netip.MustParseAddr("192.168.1.1"), 10, 0, true)
+	stats.RecordHost("b.example.com", netip.MustParseAddr("192.168.1.1"), 10, 0, false)
+
+	w = httptest.NewRecorder()
+	server.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stats/hosts?top=1&sort=errors", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	var response struct {
+		Sort  string     `json:"sort"`
+		Hosts []HostInfo `json:"hosts"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to parse JSON response: %v", err)
+	}
+	if response.Sort != SortByErrors || len(response.Hosts) != 1 || response.Hosts[0].Host != "b.example.com" {
+		t.Errorf("unexpected response: %+v", response)
+	}
+
+	for _, query := range []string{"top=-1", "top=x", "sort=latency"} {
+		w = httptest.NewRecorder()
+		server.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stats/hosts?"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", query, w.Code)
+		}
+	}
+}
+
+// TestDrainEndpoint tests listing, starting and stopping drains via /admin/drain.
+func TestDrainEndpoint(t *testing.T) {
+	stats := NewStatsCollector(netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2"}))
+	server := NewServer(0, stats)
+	server.SetAccess("", "", []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")})
+
+	do := func(method, target string, want int) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		server.server.Handler.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		if w.Code != want {
+			t.Errorf("%s %s: expected status %d, got %d", method, target, want, w.Code)
+		}
+		return w
+	}
+
+	do(http.MethodGet, "/admin/drain", http.StatusNotFound)
+
+	var draining []netip.Addr
+	stats.SetDrainSource(func() []netip.Addr { return draining })
+	server.SetDrainControl(func(ip netip.Addr, drain bool) error {
+		if ip != netip.MustParseAddr("192.168.1.1") && ip != netip.MustParseAddr("192.168.1.2") {
+			return errors.New("unknown outbound IP")
+		}
+		draining = nil
+		if drain {
+			draining = []netip.Addr{ip}
+		}
+		return nil
+	})
+
+	do(http.MethodPost, "/admin/drain?ip=192.168.1.2", http.StatusOK)
+	w := do(http.MethodGet, "/admin/drain", http.StatusOK)
+	var response struct {
+		Draining []string `json:"draining"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to parse JSON response: %v", err)
+	}
+	if len(response.Draining) != 1 || response.Draining[0] != "192.168.1.2" {
+		t.Errorf("unexpected draining IPs: %v", response.Draining)
+	}
+	if got := stats.GetStats().Draining; len(got) != 1 {
+		t.Errorf("expected draining IP in stats, got %v", got)
+	}
+
+	do(http.MethodDelete, "/admin/drain?ip=192.168.1.2", http.StatusOK)
+	if got := stats.GetStats().Draining; len(got) != 0 {
+		t.Errorf("expected no draining IPs, got %v", got)
+	}
+
+	do(http.MethodPost, "/admin/drain", http.StatusBadRequest)
+	do(http.MethodPost, "/admin/drain?ip=not-an-ip", http.StatusBadRequest)
+	do(http.MethodPost, "/admin/drain?ip=10.0.0.1", http.StatusNotFound)
+	do(http.MethodPut, "/admin/drain?ip=192.168.1.1", http.StatusMethodNotAllowed)
+}
+
+func TestShutdownEndpoint(t *testing.T) {
+	server := NewServer(0, NewStatsCollector(netutil.MustParseAddrs([]string{"192.168.1.1"})))
+	server.SetAccess("", "", []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")})
+	server.SetReady(true)
+
+	do := func(method, target string, want int) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		server.server.Handler.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		if w.Code != want {
+			t.Errorf("%s %s: expected status %d, got %d", method, target, want, w.Code)
+		}
+	}
+
+	do(http.MethodGet, "/drain", http.StatusNotFound)
+	do(http.MethodGet, "/ready", http.StatusOK)
+
+	var calls int
+	server.SetShutdown(func() { calls++ })
+	do(http.MethodDelete, "/drain", http.StatusMethodNotAllowed)
+	do(http.MethodGet, "/drain", http.StatusMethodNotAllowed)
+	do(http.MethodPost, "/drain", http.StatusAccepted)
+	if calls != 1 {
+		t.Errorf("expected 1 shutdown call, got %d", calls)
+	}
+	do(http.MethodGet, "/ready", http.StatusServiceUnavailable)
+}
+
+func TestReadyCheck(t *testing.T) {
+	server := NewServer(0, NewStatsCollector(netutil.MustParseAddrs([]string{"192.168.1.1"})))
+	server.SetReady(true)
+
+	var healthy bool
+	server.SetReadyCheck(func() error {
+		if !healthy {
+			return errors.New("no healthy outbound IP")
+		}
+		return nil
+	})
+
+	w := httptest.NewRecorder()
+	server.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	var response map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to parse JSON response: %v", err)
+	}
+	if w.Code != http.StatusServiceUnavailable || response["reason"] != "no healthy outbound IP" {
+		t.Errorf("expected 503 with the check error, got %d %v", w.Code, response)
+	}
+
+	healthy = true
+	w = httptest.NewRecorder()
+	server.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200 once the check passes, got %d", w.Code)
+	}
+
+	// The check does not override an explicit not ready
+	server.SetReady(false)
+	w = httptest.NewRecorder()
+	server.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 while not ready, got %d", w.Code)
+	}
+}
+
+// TestClusterStatusEndpoint tests /cluster/status before and after a status
+// source is set.
+func TestClusterStatusEndpoint(t *testing.T) {
+	server := NewServer(0, NewStatsCollector(netutil.MustParseAddrs([]string{"192.168.1.1"})))
+
+	w := httptest.NewRecorder()
+	server.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/cluster/status", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 without multi-instance features, got %d", w.Code)
+	}
+
+	server.SetClusterStatus(func() any {
+		return map[string]any{"role": "frontend", "peers": []string{"agent-a"}}
+	})
+	w = httptest.NewRecorder()
+	server.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/cluster/status", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var response struct {
+		Role  string   `json:"role"`
+		Peers []string `json:"peers"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to parse JSON response: %v", err)
+	}
+	if response.Role != "frontend" || len(response.Peers) != 1 {
+		t.Errorf("unexpected cluster status: %+v", response)
+	}
+}
+
+// TestRejectionsEndpoint tests /debug/rejections before and after a source is
+// set.
+func TestRejectionsEndpoint(t *testing.T) {
+	server := NewServer(0, NewStatsCollector(netutil.MustParseAddrs([]string{"192.168.1.1"})))
+
+	w := httptest.NewRecorder()
+	server.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/rejections", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 with rejection history disabled, got %d", w.Code)
+	}
+
+	server.SetRejections(func() any {
+		return []map[string]any{{"reason": "no_ips", "host": "example.com"}}
+	})
+	w = httptest.NewRecorder()
+	server.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/rejections", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var response struct {
+		Rejections []struct {
+			Reason string `json:"reason"`
+		} `json:"rejections"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to parse JSON response: %v", err)
+	}
+	if len(response.Rejections) != 1 || response.Rejections[0].Reason != "no_ips" {
+		t.Errorf("unexpected rejections: %+v", response)
+	}
+}
+
+func TestConfigPreviewEndpoint(t *testing.T) {
+	server := NewServer(0, NewStatsCollector(netutil.MustParseAddrs([]string{"192.168.1.1"})))
+	server.SetAccess("", "", []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")})
+
+	w := httptest.NewRecorder()
+	server.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/config/preview", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 without a config file, got %d", w.Code)
+	}
+
+	var got []byte
+	server.SetConfigPreview(func(data []byte) (any, error) {
+		got = data
+		if string(data) == "bad" {
+			return nil, errors.New("max_conns_total: must be at least 1")
+		}
+		return map[string]any{"changes": []any{}, "restart_required": false}, nil
+	})
+
+	w = httptest.NewRecorder()
+	server.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/config/preview", nil))
+	if w.Code != http.StatusOK || got != nil {
+		t.Errorf("GET: expected 200 previewing the file, got %d with body %q", w.Code, got)
+	}
+
+	w = httptest.NewRecorder()
+	server.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/config/preview", strings.NewReader("port: 8080\n")))
+	if w.Code != http.StatusOK || string(got) != "port: 8080\n" {
+		t.Errorf("POST: expected 200 previewing the body, got %d with body %q", w.Code, got)
+	}
+
+	w = httptest.NewRecorder()
+	server.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/config/preview", strings.NewReader("bad")))
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "max_conns_total") {
+		t.Errorf("expected 422 with the error, got %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	server.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/config/preview", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an empty body, got %d", w.Code)
+	}
+}
+
+func TestDashboardEndpoint(t *testing.T) {
+	server := NewServer(0, NewStatsCollector(netutil.MustParseAddrs([]string{"192.168.1.1"})))
+
+	w := httptest.NewRecorder()
+	server.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/dashboard", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("expected HTML, got %q", ct)
+	}
+	if w.Header().Get("Content-Security-Policy") == "" {
+		t.Error("expected a Content-Security-Policy header")
+	}
+	for _, endpoint := range []string{`"stats"`, `"events"`, `"debug/rejections"`} {
+		if !strings.Contains(w.Body.String(), endpoint) {
+			t.Errorf("dashboard does not use %s", endpoint)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	server.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "dashboard" {
+		t.Errorf("expected / to redirect to the dashboard, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+
+	w = httptest.NewRecorder()
+	server.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/unknown", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown paths, got %d", w.Code)
+	}
+}
+
 // TestMetricsServer_FullIntegration tests the full server lifecycle.
 func TestMetricsServer_FullIntegration(t *testing.T) {
-	stats := NewStatsCollector([]string{"192.168.1.1", "192.168.1.2"})
+	stats := NewStatsCollector(netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2"}))
 	port := 19998 // Use a high port unlikely to be in use
 
 	server := NewServer(port, stats)
@@ -396,7 +732,7 @@ func TestMetricsServer_FullIntegration(t *testing.T) {
 // TestMetricsEndpoint_MetricValues tests that metrics have correct values.
 func TestMetricsEndpoint_MetricValues(t *testing.T) {
 	// Reset some counters by creating fresh stats
-	stats := NewStatsCollector([]string{"10.0.0.1"})
+	stats := NewStatsCollector(netutil.MustParseAddrs([]string{"10.0.0.1"}))
 
 	// Set specific values
 	stats.AddBytesSent(12345)
@@ -422,7 +758,7 @@ func TestMetricsEndpoint_MetricValues(t *testing.T) {
 
 // TestEndpoints_ContentType verifies all endpoints return correct Content-Type.
 func TestEndpoints_ContentType(t *testing.T) {
-	stats := NewStatsCollector([]string{"192.168.1.1"})
+	stats := NewStatsCollector(netutil.MustParseAddrs([]string{"192.168.1.1"}))
 	server := NewServer(0, stats)
 
 	tests := []struct {
@@ -0,0 +1,191 @@
+// Package metrics provides Prometheus metrics for the proxy.
+package metrics
+
+import (
+	"cmp"
+	"hash/fnv"
+	"maps"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OtherHostLabel is the host label value used for hosts outside the allowlist.
+const OtherHostLabel = "other"
+
+// Host label modes for SetHostLabelMode.
+const (
+	// HostLabelAll keeps every host, or only the allowlisted ones when an
+	// allowlist is set.
+	HostLabelAll = "all"
+	// HostLabelTop keeps the allowlisted hosts and the busiest ones.
+	HostLabelTop = "top"
+	// HostLabelHash keeps the allowlisted hosts and spreads the others over
+	// a fixed number of hash buckets.
+	HostLabelHash = "hash"
+	// HostLabelNone drops the host label for every host.
+	HostLabelNone = "none"
+)
+
+// topHostsFactor is how many more hosts than the labeled ones HostLabelTop
+// counts requests for.
+const topHostsFactor = 10
+
+// topHostsRefresh is how often HostLabelTop recomputes the busiest hosts.
+const topHostsRefresh = time.Minute
+
+// hostAllowlist holds the hosts that keep their own host label (nil = all hosts).
+var hostAllowlist atomic.Pointer[map[string]struct{}]
+
+// hostMode holds the host label mode (nil = HostLabelAll).
+var hostMode atomic.Pointer[hostLabelMode]
+
+// hostLabelMode is a host label mode with its limit.
+type hostLabelMode struct {
+	mode  string
+	limit int
+	top   *topHosts // HostLabelTop only
+}
+
+// SetHostAllowlist restricts the host label of host-labeled metrics to the
+// given hosts; all other hosts are reported as "other". An empty list keeps
+// every host, which is the default.
+func SetHostAllowlist(hosts []string) {
+	if len(hosts) == 0 {
+		hostAllowlist.Store(nil)
+		return
+	}
+	allowed := make(map[string]struct{}, len(hosts))
+	for _, h := range hosts {
+		allowed[strings.ToLower(strings.TrimSpace(h))] = struct{}{}
+	}
+	hostAllowlist.Store(&allowed)
+}
+
+// SetHostLabelMode sets how host-labeled metrics report the hosts outside
+// the allowlist: HostLabelAll (the default), HostLabelTop for the limit
+// busiest hosts, HostLabelHash for limit hash buckets, or HostLabelNone.
+func SetHostLabelMode(mode string, limit int) {
+	m := &hostLabelMode{mode: mode, limit: limit}
+	if mode == HostLabelTop {
+		m.top = newTopHosts(limit)
+	}
+	hostMode.Store(m)
+}
+
+// HostLabel returns the host label value for host (host or host:port)
+// according to the allowlist and the host label mode.
+func HostLabel(host string) string {
+	m := hostMode.Load()
+	if m != nil && m.mode == HostLabelNone {
+		return ""
+	}
+	allowed := hostAllowlist.Load()
+	if allowed == nil && (m == nil || m.mode == HostLabelAll) {
+		return host
+	}
+
+	name, _, err := net.SplitHostPort(host)
+	if err != nil {
+		name = host
+	}
+	name = strings.ToLower(name)
+	if allowed != nil {
+		if _, ok := (*allowed)[name]; ok {
+			return host
+		}
+	}
+
+	switch {
+	case m != nil && m.mode == HostLabelTop:
+		if m.top.observe(name) {
+			return host
+		}
+	case m != nil && m.mode == HostLabelHash:
+		return hashBucket(name, m.limit)
+	}
+	return OtherHostLabel
+}
+
+// hashBucket returns the label of the hash bucket of name among buckets.
+func hashBucket(name string, buckets int) string {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return "bucket-" + strconv.Itoa(int(h.Sum32()%uint32(max(buckets, 1))))
+}
+
+// topHosts ranks hosts by request count for HostLabelTop. Counts are kept for
+// up to topHostsFactor times n hosts, the least requested host making room
+// for a new one, and the n labeled hosts are recomputed every
+// topHostsRefresh so that a host keeps or loses its label for a while rather
+// than on every request.
+type topHosts struct {
+	mu        sync.Mutex
+	n         int
+	counts    map[string]int64
+	labeled   map[string]struct{}
+	refreshed time.Time
+}
+
+// newTopHosts creates a ranking labeling the n busiest hosts.
+func newTopHosts(n int) *topHosts {
+	return &topHosts{
+		n:         n,
+		counts:    make(map[string]int64),
+		labeled:   make(map[string]struct{}),
+		refreshed: time.Now(),
+	}
+}
+
+// observe counts a request to name and reports whether it keeps its label.
+func (t *topHosts) observe(name string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.counts[name]; !ok && len(t.counts) >= t.n*topHostsFactor {
+		t.evict()
+	}
+	t.counts[name]++
+
+	if time.Since(t.refreshed) >= topHostsRefresh {
+		t.refresh()
+	} else if len(t.labeled) < t.n {
+		// While there is room, new hosts are labeled right away
+		t.labeled[name] = struct{}{}
+	}
+	_, ok := t.labeled[name]
+	return ok
+}
+
+// evict drops the count of the least requested host. t.mu must be held.
+func (t *topHosts) evict() {
+	victim, fewest := "", int64(-1)
+	for name, count := range t.counts {
+		if fewest < 0 || count < fewest {
+			victim, fewest = name, count
+		}
+	}
+	delete(t.counts, victim)
+}
+
+// refresh labels the n busiest hosts and decays the counts. t.mu must be
+// held.
+func (t *topHosts) refresh() {
+	names := slices.Collect(maps.Keys(t.counts))
+	slices.SortFunc(names, func(a, b string) int {
+		return cmp.Compare(t.counts[b], t.counts[a])
+	})
+	clear(t.labeled)
+	for _, name := range names[:min(t.n, len(names))] {
+		t.labeled[name] = struct{}{}
+	}
+	// Halve the counts so the ranking follows recent traffic
+	for name := range t.counts {
+		t.counts[name] /= 2
+	}
+	t.refreshed = time.Now()
+}
@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHostLabel(t *testing.T) {
+	defer SetHostAllowlist(nil)
+
+	if got := HostLabel("api.example.com:443"); got != "api.example.com:443" {
+		t.Errorf("expected host kept without allowlist, got %s", got)
+	}
+
+	SetHostAllowlist([]string{"API.example.com", "shop.example.com"})
+
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{"api.example.com", "api.example.com"},
+		{"api.example.com:443", "api.example.com:443"},
+		{"shop.example.com:80", "shop.example.com:80"},
+		{"random.example.org:443", OtherHostLabel},
+		{"example.com", OtherHostLabel},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			if got := HostLabel(tt.host); got != tt.expected {
+				t.Errorf("HostLabel(%s) = %s, expected %s", tt.host, got, tt.expected)
+			}
+		})
+	}
+
+	SetHostAllowlist(nil)
+	if got := HostLabel("random.example.org"); got != "random.example.org" {
+		t.Errorf("expected allowlist to be cleared, got %s", got)
+	}
+}
+
+func TestHostLabel_Modes(t *testing.T) {
+	defer SetHostAllowlist(nil)
+	defer hostMode.Store(nil)
+
+	SetHostLabelMode(HostLabelNone, 0)
+	if got := HostLabel("api.example.com:443"); got != "" {
+		t.Errorf("expected no host label in none mode, got %s", got)
+	}
+
+	SetHostAllowlist([]string{"api.example.com"})
+	SetHostLabelMode(HostLabelHash, 8)
+	if got := HostLabel("api.example.com:443"); got != "api.example.com:443" {
+		t.Errorf("expected allowlisted host kept in hash mode, got %s", got)
+	}
+	bucket := HostLabel("random.example.org:443")
+	if !strings.HasPrefix(bucket, "bucket-") {
+		t.Errorf("expected a hash bucket, got %s", bucket)
+	}
+	if got := HostLabel("RANDOM.example.org:80"); got != bucket {
+		t.Errorf("expected the same bucket for the same host, got %s and %s", got, bucket)
+	}
+	SetHostAllowlist(nil)
+
+	SetHostLabelMode(HostLabelTop, 2)
+	HostLabel("a.example.com")
+	HostLabel("b.example.com")
+	if got := HostLabel("c.example.com"); got != OtherHostLabel {
+		t.Errorf("expected a host past the limit reported as other, got %s", got)
+	}
+	if got := HostLabel("a.example.com"); got != "a.example.com" {
+		t.Errorf("expected a labeled host kept, got %s", got)
+	}
+}
+
+func TestTopHosts_Refresh(t *testing.T) {
+	top := newTopHosts(1)
+	top.observe("a.example.com")
+	for range 3 {
+		top.observe("b.example.com")
+	}
+	if top.observe("b.example.com") {
+		t.Error("expected b.example.com unlabeled before the refresh")
+	}
+
+	top.refreshed = time.Now().Add(-topHostsRefresh)
+	if !top.observe("b.example.com") {
+		t.Error("expected the busiest host labeled after the refresh")
+	}
+	if top.observe("a.example.com") {
+		t.Error("expected a.example.com to lose its label after the refresh")
+	}
+}
+
+func TestTopHosts_Bounded(t *testing.T) {
+	top := newTopHosts(1)
+	for i := range 5 * topHostsFactor {
+		top.observe(fmt.Sprintf("host%d.example.com", i))
+	}
+	if len(top.counts) > topHostsFactor {
+		t.Errorf("expected at most %d counted hosts, got %d", topHostsFactor, len(top.counts))
+	}
+}
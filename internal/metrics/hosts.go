@@ -0,0 +1,136 @@
+// Package metrics provides Prometheus metrics for the proxy.
+package metrics
+
+import (
+	"cmp"
+	"maps"
+	"net/netip"
+	"slices"
+	"sync"
+)
+
+// Host stats sort orders for TopHosts.
+const (
+	SortByRequests = "requests"
+	SortByBytes    = "bytes"
+	SortByErrors   = "errors"
+)
+
+// HostInfo is the traffic to a single destination host.
+type HostInfo struct {
+	Host          string           `json:"host"`
+	Requests      int64            `json:"requests"`
+	Errors        int64            `json:"errors"`
+	ErrorRate     float64          `json:"error_rate"`
+	BytesSent     int64            `json:"bytes_sent"`
+	BytesReceived int64            `json:"bytes_received"`
+	RequestsPerIP map[string]int64 `json:"requests_per_ip"`
+}
+
+// hostTable aggregates traffic per destination host, keeping at most max
+// hosts: a new host replaces the one with the fewest requests, so the busiest
+// hosts stay tracked whatever the number of distinct destinations.
+type hostTable struct {
+	mu    sync.Mutex
+	max   int
+	hosts map[string]*HostInfo
+}
+
+// record adds a request to host through ip.
+func (t *hostTable) record(host string, ip netip.Addr, sent, received int64, failed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	h, ok := t.hosts[host]
+	if !ok {
+		if len(t.hosts) >= t.max {
+			t.evict()
+		}
+		h = &HostInfo{Host: host, RequestsPerIP: make(map[string]int64)}
+		t.hosts[host] = h
+	}
+	h.Requests++
+	if failed {
+		h.Errors++
+	}
+	h.BytesSent += max(sent, 0)
+	h.BytesReceived += max(received, 0)
+	if ip.IsValid() {
+		h.RequestsPerIP[ip.String()]++
+	}
+}
+
+// evict drops the host with the fewest requests. t.mu must be held.
+func (t *hostTable) evict() {
+	var victim *HostInfo
+	for _, h := range t.hosts {
+		if victim == nil || h.Requests < victim.Requests {
+			victim = h
+		}
+	}
+	if victim != nil {
+		delete(t.hosts, victim.Host)
+	}
+}
+
+// top returns copies of the n busiest hosts by the given order (all hosts
+// when n <= 0).
+func (t *hostTable) top(n int, by string) []HostInfo {
+	t.mu.Lock()
+	result := make([]HostInfo, 0, len(t.hosts))
+	for _, h := range t.hosts {
+		info := *h
+		info.RequestsPerIP = maps.Clone(h.RequestsPerIP)
+		if info.Requests > 0 {
+			info.ErrorRate = float64(info.Errors) / float64(info.Requests)
+		}
+		result = append(result, info)
+	}
+	t.mu.Unlock()
+
+	key := func(h HostInfo) int64 {
+		switch by {
+		case SortByBytes:
+			return h.BytesSent + h.BytesReceived
+		case SortByErrors:
+			return h.Errors
+		}
+		return h.Requests
+	}
+	slices.SortFunc(result, func(a, b HostInfo) int {
+		if c := cmp.Compare(key(b), key(a)); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Host, b.Host)
+	})
+	if n > 0 && len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
+
+// EnableHostStats starts aggregating traffic per destination host for
+// TopHosts, tracking at most maxHosts hosts.
+func (sc *StatsCollector) EnableHostStats(maxHosts int) {
+	sc.hosts.Store(&hostTable{max: maxHosts, hosts: make(map[string]*HostInfo)})
+}
+
+// RecordHost records a request to host through ip with the bytes sent to and
+// received from the client, and whether it failed (upstream error or 5xx).
+// Does nothing unless EnableHostStats was called.
+func (sc *StatsCollector) RecordHost(host string, ip netip.Addr, sent, received int64, failed bool) {
+	if t := sc.hosts.Load(); t != nil {
+		t.record(host, ip, sent, received, failed)
+	}
+}
+
+// TopHosts returns the n busiest destination hosts sorted by requests, bytes
+// or errors (all tracked hosts when n <= 0). Returns false if host stats are
+// not enabled.
+func (sc *StatsCollector) TopHosts(n int, by string) ([]HostInfo, bool) {
+	t := sc.hosts.Load()
+	if t == nil {
+		return nil, false
+	}
+	return t.top(n, by), true
+}
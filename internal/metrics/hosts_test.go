@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestHostStats_Disabled(t *testing.T) {
+	sc := NewStatsCollector(nil)
+	sc.RecordHost("example.com", netip.MustParseAddr("192.168.1.1"), 100, 10, false)
+	if _, ok := sc.TopHosts(10, SortByRequests); ok {
+		t.Error("expected host stats to be disabled by default")
+	}
+}
+
+func TestHostStats_Aggregation(t *testing.T) {
+	sc := NewStatsCollector(nil)
+	sc.EnableHostStats(10)
+
+	sc.RecordHost("a.example.com", netip.MustParseAddr("192.168.1.1"), 100, 10, false)
+	sc.RecordHost("a.example.com", netip.MustParseAddr("192.168.1.2"), 100, 10, true)
+	sc.RecordHost("a.example.com", netip.MustParseAddr("192.168.1.1"), 100, -1, false)
+	sc.RecordHost("b.example.com", netip.MustParseAddr("192.168.1.1"), 5000, 0, true)
+
+	hosts, ok := sc.TopHosts(0, SortByRequests)
+	if !ok {
+		t.Fatal("expected host stats to be enabled")
+	}
+	if len(hosts) != 2 {
+		t.Fatalf("expected 2 hosts, got %d", len(hosts))
+	}
+	a := hosts[0]
+	if a.Host != "a.example.com" || a.Requests != 3 || a.Errors != 1 {
+		t.Errorf("unexpected busiest host: %+v", a)
+	}
+	if a.BytesSent != 300 || a.BytesReceived != 20 {
+		t.Errorf("expected 300 bytes sent and 20 received, got %d and %d", a.BytesSent, a.BytesReceived)
+	}
+	if a.RequestsPerIP["192.168.1.1"] != 2 || a.RequestsPerIP["192.168.1.2"] != 1 {
+		t.Errorf("unexpected per-IP distribution: %v", a.RequestsPerIP)
+	}
+	if a.ErrorRate < 0.33 || a.ErrorRate > 0.34 {
+		t.Errorf("expected error rate 1/3, got %v", a.ErrorRate)
+	}
+
+	if hosts, _ := sc.TopHosts(1, SortByBytes); hosts[0].Host != "b.example.com" {
+		t.Errorf("expected b.example.com first by bytes, got %s", hosts[0].Host)
+	}
+	if hosts, _ := sc.TopHosts(1, SortByErrors); len(hosts) != 1 {
+		t.Errorf("expected top to limit the result to 1 host, got %d", len(hosts))
+	}
+}
+
+func TestHostStats_EvictsLeastRequested(t *testing.T) {
+	sc := NewStatsCollector(nil)
+	sc.EnableHostStats(2)
+
+	for range 3 {
+		sc.RecordHost("busy.example.com", netip.MustParseAddr("192.168.1.1"), 0, 0, false)
+	}
+	sc.RecordHost("rare.example.com", netip.MustParseAddr("192.168.1.1"), 0, 0, false)
+	sc.RecordHost("new.example.com", netip.MustParseAddr("192.168.1.1"), 0, 0, false)
+
+	hosts, _ := sc.TopHosts(0, SortByRequests)
+	if len(hosts) != 2 {
+		t.Fatalf("expected the table bounded to 2 hosts, got %d", len(hosts))
+	}
+	if hosts[0].Host != "busy.example.com" || hosts[1].Host != "new.example.com" {
+		t.Errorf("expected the least requested host evicted, got %s and %s", hosts[0].Host, hosts[1].Host)
+	}
+}
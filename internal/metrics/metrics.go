@@ -2,10 +2,15 @@
 package metrics
 
 import (
+	"net/netip"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
 )
 
 var (
@@ -34,6 +39,48 @@ var (
 		Help: "Total bytes received from clients",
 	})
 
+	// UpstreamBytesSent tracks total bytes sent to upstreams.
+	UpstreamBytesSent = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "outbound_lb_upstream_bytes_sent_total",
+		Help: "Total bytes sent to upstreams",
+	})
+
+	// UpstreamBytesReceived tracks total bytes received from upstreams.
+	UpstreamBytesReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "outbound_lb_upstream_bytes_received_total",
+		Help: "Total bytes received from upstreams",
+	})
+
+	// UpstreamBytesPerIP tracks bytes exchanged with upstreams per outbound IP.
+	UpstreamBytesPerIP = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "outbound_lb_upstream_ip_bytes_total",
+		Help: "Total bytes exchanged with upstreams per outbound IP and direction (sent, received)",
+	}, []string{"ip", "direction"})
+
+	// UpstreamPhaseDuration tracks the phases of upstream requests per
+	// outbound IP: DNS lookup, TCP connect, TLS handshake and time to first
+	// byte.
+	UpstreamPhaseDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "outbound_lb_upstream_phase_duration_seconds",
+		Help:    "Upstream request phase duration in seconds per outbound IP and phase (dns, connect, tls, ttfb)",
+		Buckets: []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"ip", "phase"})
+
+	// UpstreamResponses counts upstream responses per outbound IP and status
+	// class (1xx to 5xx).
+	UpstreamResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "outbound_lb_upstream_responses_total",
+		Help: "Total upstream responses per outbound IP and status class (1xx, 2xx, 3xx, 4xx, 5xx)",
+	}, []string{"ip", "class"})
+
+	// UpstreamErrors counts upstreams that could not be reached per outbound
+	// IP and error class (dns_not_found, dns_timeout, dns_error, tls_error,
+	// connect_error, upstream_error).
+	UpstreamErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "outbound_lb_upstream_errors_total",
+		Help: "Total upstream failures per outbound IP and error class",
+	}, []string{"ip", "class"})
+
 	// ActiveConnections tracks current active connections.
 	ActiveConnections = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "outbound_lb_active_connections",
@@ -46,6 +93,13 @@ var (
 		Help: "Current connections per outbound IP",
 	}, []string{"ip"})
 
+	// IPOverLimit tracks, per outbound IP draining after max_conns_per_ip was
+	// lowered below its connections, how many connections exceed the new cap.
+	IPOverLimit = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "outbound_lb_ip_over_limit",
+		Help: "Connections over max_conns_per_ip per draining outbound IP",
+	}, []string{"ip"})
+
 	// BalancerSelections tracks IP selections by the balancer.
 	BalancerSelections = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "outbound_lb_balancer_selections_total",
@@ -58,18 +112,242 @@ var (
 		Help: "Total connection rejections due to limits",
 	}, []string{"type"})
 
+	// DestinationDenied counts requests to destinations denied by the
+	// destination policy, by reason (rule, private).
+	DestinationDenied = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "outbound_lb_destination_denied_total",
+		Help: "Total requests denied by the destination policy by reason (rule, private)",
+	}, []string{"reason"})
+
+	// DNSLookupDuration tracks destination lookups by resolver (system, custom).
+	DNSLookupDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "outbound_lb_dns_lookup_duration_seconds",
+		Help:    "Destination DNS lookup duration in seconds by resolver (system, custom)",
+		Buckets: []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 5},
+	}, []string{"resolver"})
+
+	// DNSLookupFailures counts failed destination lookups by reason
+	// (not_found, timeout, error).
+	DNSLookupFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "outbound_lb_dns_lookup_failures_total",
+		Help: "Total failed destination DNS lookups by reason (not_found, timeout, error)",
+	}, []string{"reason"})
+
+	// DNSCacheHits counts destination lookups answered from the DNS cache.
+	DNSCacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "outbound_lb_dns_cache_hits_total",
+		Help: "Total destination DNS lookups answered from the cache",
+	})
+
+	// DNSCacheMisses counts destination lookups sent to the nameservers
+	// because the DNS cache had no live entry.
+	DNSCacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "outbound_lb_dns_cache_misses_total",
+		Help: "Total destination DNS lookups not found in the cache",
+	})
+
 	// AuthFailures tracks authentication failures.
 	AuthFailures = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "outbound_lb_auth_failures_total",
 		Help: "Total authentication failures",
 	})
 
+	// AuthBans counts client IPs banned for failing to authenticate too
+	// often.
+	AuthBans = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "outbound_lb_auth_bans_total",
+		Help: "Total client IPs banned after repeated authentication failures",
+	})
+
+	// ClientACLRejections counts clients refused by the client_allow and
+	// client_deny lists, by the list refusing them.
+	ClientACLRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "outbound_lb_client_acl_rejections_total",
+		Help: "Total client connections and requests refused by the client access lists",
+	}, []string{"list"})
+
+	// MethodRejections counts requests refused by the method policy, by
+	// request method.
+	MethodRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "outbound_lb_method_rejections_total",
+		Help: "Total requests refused by the allowed and denied methods",
+	}, []string{"method"})
+
+	// BodyLimitExceeded counts request and response bodies over the
+	// configured maximum size, by direction.
+	BodyLimitExceeded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "outbound_lb_body_limit_exceeded_total",
+		Help: "Total request and response bodies over max_request_body or max_response_body",
+	}, []string{"direction"})
+
+	// PriorityRejections counts requests refused because the connection
+	// slots left were reserved for higher priorities, by request priority.
+	PriorityRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "outbound_lb_priority_rejections_total",
+		Help: "Total requests refused because the connections left were reserved for higher priorities",
+	}, []string{"priority"})
+
+	// ClientLimitRejections counts requests refused because their client had
+	// as many open connections as client_max_conns allows.
+	ClientLimitRejections = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "outbound_lb_client_limit_rejections_total",
+		Help: "Total requests refused by the per-client connection limit",
+	})
+
+	// QueueDepth tracks the requests waiting in the connection queue for a
+	// connection slot.
+	QueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "outbound_lb_queue_depth",
+		Help: "Requests waiting in the connection queue for a connection slot",
+	})
+
+	// QueueWait tracks how long requests waited in the connection queue, by
+	// outcome ("acquired" or "timeout").
+	QueueWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "outbound_lb_queue_wait_seconds",
+		Help:    "Time requests waited in the connection queue for a connection slot",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"outcome"})
+
+	// RateLimited counts requests refused by the request rate limits, by
+	// scope ("global" or "host").
+	RateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "outbound_lb_rate_limited_total",
+		Help: "Total requests refused by the global and per-host request rate limits, or while too many requests waited for their turn",
+	}, []string{"scope"})
+
+	// RateLimitWait tracks how long requests over the rate waited for their
+	// turn.
+	RateLimitWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "outbound_lb_rate_limit_wait_seconds",
+		Help:    "Time requests over the request rate waited for their turn",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	// UserThroughput is the recent throughput of each authenticated user.
+	UserThroughput = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "outbound_lb_user_throughput_bytes_per_second",
+		Help: "Recent throughput per authenticated user, both directions",
+	}, []string{"user"})
+
+	// IPThroughput is the recent throughput through each outbound IP.
+	IPThroughput = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "outbound_lb_ip_throughput_bytes_per_second",
+		Help: "Recent throughput per outbound IP, both directions",
+	}, []string{"ip"})
+
+	// UserRequests counts proxy requests per authenticated user.
+	UserRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "outbound_lb_user_requests_total",
+		Help: "Total proxy requests per authenticated user",
+	}, []string{"user"})
+
+	// UserBytes tracks bytes exchanged with clients per authenticated user.
+	UserBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "outbound_lb_user_bytes_total",
+		Help: "Total bytes exchanged with clients per authenticated user and direction (sent, received)",
+	}, []string{"user", "direction"})
+
+	// UserQuotaRejections counts requests refused because a user was over
+	// one of its quotas.
+	UserQuotaRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "outbound_lb_user_quota_rejections_total",
+		Help: "Total requests refused per authenticated user and quota (connections, requests, bytes)",
+	}, []string{"user", "quota"})
+
 	// TunnelConnections tracks CONNECT tunnel connections.
 	TunnelConnections = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "outbound_lb_tunnel_connections_total",
 		Help: "Total CONNECT tunnel connections",
 	})
 
+	// TunnelDNSChanges counts open tunnels whose target host moved to other addresses.
+	TunnelDNSChanges = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "outbound_lb_tunnel_dns_changes_total",
+		Help: "Total open tunnels whose target host no longer resolves to the connected address",
+	})
+
+	// TunnelsDrained counts tunnels closed because their target host moved.
+	TunnelsDrained = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "outbound_lb_tunnels_drained_total",
+		Help: "Total tunnels closed because their target host no longer resolves to the connected address",
+	})
+
+	// TunnelsReaped counts tunnels closed by the reaper, by reason
+	// ("lifetime" or "idle").
+	TunnelsReaped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "outbound_lb_tunnels_reaped_total",
+		Help: "Total tunnels closed for exceeding max_tunnel_duration or max_tunnel_idle",
+	}, []string{"reason"})
+
+	// ShutdownPhase reports the current shutdown phase (1) among "deregister",
+	// "drain", "force_close" and "stop"; all are 0 while serving.
+	ShutdownPhase = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "outbound_lb_shutdown_phase",
+		Help: "Current shutdown phase (1), all 0 while serving",
+	}, []string{"phase"})
+
+	// TunnelsForceClosed counts tunnels closed because they were still open
+	// when the shutdown timeout expired.
+	TunnelsForceClosed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "outbound_lb_tunnels_force_closed_total",
+		Help: "Total tunnels closed for still being open after shutdown_timeout",
+	})
+
+	// FailoverTotal counts requests redirected to a failover endpoint.
+	FailoverTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "outbound_lb_failover_total",
+		Help: "Total requests redirected to a failover endpoint",
+	}, []string{"host"})
+
+	// RetriesTotal counts upstream attempts retried on another outbound IP.
+	RetriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "outbound_lb_retries_total",
+		Help: "Total upstream attempts retried on another outbound IP by method",
+	}, []string{"method"})
+
+	// RetriesExhausted counts requests that still failed after being retried.
+	RetriesExhausted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "outbound_lb_retries_exhausted_total",
+		Help: "Total requests that failed on every outbound IP they were retried on by method",
+	}, []string{"method"})
+
+	// HedgedRequests counts requests hedged through a second outbound IP.
+	HedgedRequests = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "outbound_lb_hedged_requests_total",
+		Help: "Total slow requests hedged through a second outbound IP",
+	})
+
+	// HedgeWins counts hedged requests answered first by the hedge.
+	HedgeWins = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "outbound_lb_hedge_wins_total",
+		Help: "Total hedged requests where the second outbound IP answered first",
+	})
+
+	// UpstreamProtocol counts upstream responses by HTTP protocol.
+	UpstreamProtocol = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "outbound_lb_upstream_protocol_total",
+		Help: "Total upstream responses by HTTP protocol (h1, h2, h3)",
+	}, []string{"protocol"})
+
+	// HTTP3Fallbacks counts HTTP/3 attempts that failed and were retried over TCP.
+	HTTP3Fallbacks = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "outbound_lb_http3_fallbacks_total",
+		Help: "Total upstream HTTP/3 attempts that failed and fell back to HTTP/2 or HTTP/1.1",
+	})
+
+	// IPCooldowns counts cooldowns started after an IP hit its per-host use budget.
+	IPCooldowns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "outbound_lb_ip_cooldowns_total",
+		Help: "Total cooldowns started per IP after reaching the per-host use limit",
+	}, []string{"ip"})
+
+	// IPDraining reports whether an outbound IP is in drain mode (1) or not (0).
+	IPDraining = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "outbound_lb_ip_draining",
+		Help: "Whether the outbound IP is draining (1) or not (0)",
+	}, []string{"ip"})
+
 	// HistoryEntries tracks entries in the balancer history.
 	HistoryEntries = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "outbound_lb_history_entries",
@@ -82,6 +360,32 @@ var (
 		Help: "Current number of unique hosts in balancer history",
 	})
 
+	// SharedStatePeers is the number of other instances whose selection
+	// history was read at the last shared state sync.
+	SharedStatePeers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "outbound_lb_shared_state_peers",
+		Help: "Number of peer instances in the last shared balancer state sync",
+	})
+
+	// ClusterMembers is the number of other instances known through gossip.
+	ClusterMembers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "outbound_lb_cluster_members",
+		Help: "Number of other cluster members known through gossip",
+	})
+
+	// ClusterInvalidMessages counts gossip messages dropped because they
+	// could not be authenticated or decoded.
+	ClusterInvalidMessages = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "outbound_lb_cluster_invalid_messages_total",
+		Help: "Total gossip messages dropped as unauthenticated or malformed",
+	})
+
+	// SharedStateErrors counts failed shared state syncs.
+	SharedStateErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "outbound_lb_shared_state_errors_total",
+		Help: "Total failed shared balancer state syncs",
+	})
+
 	// Health check metrics
 
 	// HealthCheckTotal counts total health checks by IP and result.
@@ -96,6 +400,24 @@ var (
 		Help: "Health status per IP (1=healthy, 0=unhealthy)",
 	}, []string{"ip"})
 
+	// PassiveHealthFailures counts failures observed in proxied traffic by IP and reason.
+	PassiveHealthFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "outbound_lb_passive_health_failures_total",
+		Help: "Total passive health failures observed in proxied traffic by IP and reason",
+	}, []string{"ip", "reason"}) // reason: "connect" or "5xx_rate"
+
+	// CircuitState tracks circuit breaker state per IP (0=closed, 1=open, 2=half-open).
+	CircuitState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "outbound_lb_circuit_state",
+		Help: "Circuit breaker state per IP (0=closed, 1=open, 2=half-open)",
+	}, []string{"ip"})
+
+	// CircuitTransitions counts circuit breaker state transitions per IP.
+	CircuitTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "outbound_lb_circuit_transitions_total",
+		Help: "Total circuit breaker state transitions per IP",
+	}, []string{"ip", "from", "to"})
+
 	// HealthCheckDuration tracks health check duration.
 	HealthCheckDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
 		Name:    "outbound_lb_health_check_duration_seconds",
@@ -114,16 +436,110 @@ var (
 		Name: "outbound_lb_unhealthy_ips",
 		Help: "Number of unhealthy IPs",
 	})
+
+	// RequestLogsSuppressed reports the request log entries dropped by log
+	// sampling, read from the source set by SetRequestLogsSuppressedSource.
+	RequestLogsSuppressed = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "outbound_lb_request_logs_suppressed_total",
+		Help: "Request log entries dropped by log sampling",
+	}, func() float64 {
+		if fn := requestLogsSuppressed.Load(); fn != nil {
+			return float64((*fn)())
+		}
+		return 0
+	})
+
+	// WebhookEvents counts webhook notifications by result (sent, failed,
+	// rate_limited, dropped).
+	WebhookEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "outbound_lb_webhook_events_total",
+		Help: "Total webhook notifications by result",
+	}, []string{"result"})
 )
 
+// requestLogsSuppressed counts the request log entries dropped by sampling.
+var requestLogsSuppressed atomic.Pointer[func() uint64]
+
+// SetRequestLogsSuppressedSource sets the function counting the request log
+// entries dropped by sampling for RequestLogsSuppressed.
+func SetRequestLogsSuppressedSource(fn func() uint64) {
+	requestLogsSuppressed.Store(&fn)
+}
+
 // Stats holds runtime statistics for the /stats endpoint.
 type Stats struct {
-	ActiveConnections int64            `json:"active_connections"`
-	TotalRequests     int64            `json:"total_requests"`
-	BytesSent         int64            `json:"bytes_sent"`
-	BytesReceived     int64            `json:"bytes_received"`
-	ConnectionsPerIP  map[string]int64 `json:"connections_per_ip"`
-	SelectionsPerIP   map[string]int64 `json:"selections_per_ip"`
+	ActiveConnections int64 `json:"active_connections"`
+	TotalRequests     int64 `json:"total_requests"`
+	BytesSent         int64 `json:"bytes_sent"`
+	BytesReceived     int64 `json:"bytes_received"`
+	// UpstreamBytesSent and UpstreamBytesReceived count the upstream side,
+	// which differs from the client side for plain HTTP (headers, TLS and
+	// compression).
+	UpstreamBytesSent     int64              `json:"upstream_bytes_sent"`
+	UpstreamBytesReceived int64              `json:"upstream_bytes_received"`
+	UpstreamBytesPerIP    map[string]IPBytes `json:"upstream_bytes_per_ip"`
+	ConnectionsPerIP      map[string]int64   `json:"connections_per_ip"`
+	SelectionsPerIP       map[string]int64   `json:"selections_per_ip"`
+	// Circuits holds per-IP circuit breaker state (only when enabled).
+	Circuits map[string]CircuitInfo `json:"circuits,omitempty"`
+	// Draining lists the IPs in drain mode.
+	Draining []string `json:"draining,omitempty"`
+	// Balancer holds the selection history of the balancer.
+	Balancer *BalancerInfo `json:"balancer,omitempty"`
+	// Limiter holds connection usage against the limits.
+	Limiter *LimiterInfo `json:"limiter,omitempty"`
+	// Health holds per-IP health check state (only when enabled).
+	Health map[string]HealthInfo `json:"health,omitempty"`
+}
+
+// BalancerInfo is the selection history kept by the balancer.
+type BalancerInfo struct {
+	TotalHosts   int            `json:"total_hosts"`
+	TotalEntries int            `json:"total_entries"`
+	EntriesPerIP map[string]int `json:"entries_per_ip"`
+	// PeerEntriesPerIP is the history of the other cluster instances per IP.
+	PeerEntriesPerIP map[string]int `json:"peer_entries_per_ip,omitempty"`
+}
+
+// LimiterInfo is the connection usage against the limits.
+type LimiterInfo struct {
+	Active   int64              `json:"active"`
+	MaxTotal int                `json:"max_total"`
+	MaxPerIP int                `json:"max_per_ip"`
+	PerIP    map[string]IPUsage `json:"per_ip"`
+}
+
+// IPUsage is the connection usage of a single IP.
+type IPUsage struct {
+	Active int64 `json:"active"`
+	Limit  int   `json:"limit"`
+	// OverLimit is how many connections exceed a lowered limit while the IP
+	// drains.
+	OverLimit int64 `json:"over_limit,omitempty"`
+	// Peers is the connections of the other cluster members, counted
+	// against the limit.
+	Peers int64 `json:"peers,omitempty"`
+}
+
+// HealthInfo is the health check state of a single IP.
+type HealthInfo struct {
+	State                string    `json:"state"`
+	ConsecutiveFailures  int       `json:"consecutive_failures"`
+	ConsecutiveSuccesses int       `json:"consecutive_successes"`
+	LastCheck            time.Time `json:"last_check"`
+	LastError            string    `json:"last_error,omitempty"`
+}
+
+// IPBytes is the upstream traffic of a single IP.
+type IPBytes struct {
+	Sent     int64 `json:"sent"`
+	Received int64 `json:"received"`
+}
+
+// CircuitInfo is the circuit breaker state of a single IP.
+type CircuitInfo struct {
+	State    string `json:"state"`
+	Failures int    `json:"failures"`
 }
 
 // StatsCollector collects runtime statistics.
@@ -132,23 +548,74 @@ type StatsCollector struct {
 	totalRequests     atomic.Int64
 	bytesSent         atomic.Int64
 	bytesReceived     atomic.Int64
-	connectionsPerIP  map[string]*atomic.Int64
-	selectionsPerIP   map[string]*atomic.Int64
+	upstreamSent      atomic.Int64
+	upstreamReceived  atomic.Int64
+	perIP             map[netip.Addr]*ipStats
+	ipsMu             sync.RWMutex
+	circuitSource     atomic.Pointer[func() map[string]CircuitInfo]
+	drainSource       atomic.Pointer[func() []netip.Addr]
+	balancerSource    atomic.Pointer[func() BalancerInfo]
+	limiterSource     atomic.Pointer[func() LimiterInfo]
+	healthSource      atomic.Pointer[func() map[string]HealthInfo]
+	hosts             atomic.Pointer[hostTable]
+	statsd            atomic.Pointer[StatsD]
+}
+
+// ipStats holds the statistics of a single outbound IP, with its textual
+// form for metric labels.
+type ipStats struct {
+	label       string
+	connections atomic.Int64
+	selections  atomic.Int64
+	bytes       ipBytes
 }
 
 // NewStatsCollector creates a new stats collector.
-func NewStatsCollector(ips []string) *StatsCollector {
+func NewStatsCollector(ips []netip.Addr) *StatsCollector {
 	sc := &StatsCollector{
-		connectionsPerIP: make(map[string]*atomic.Int64),
-		selectionsPerIP:  make(map[string]*atomic.Int64),
+		perIP: make(map[netip.Addr]*ipStats, len(ips)),
 	}
 	for _, ip := range ips {
-		sc.connectionsPerIP[ip] = &atomic.Int64{}
-		sc.selectionsPerIP[ip] = &atomic.Int64{}
+		sc.perIP[ip] = &ipStats{label: ip.String()}
 	}
 	return sc
 }
 
+// AddIP starts collecting per-IP statistics for ip.
+func (sc *StatsCollector) AddIP(ip netip.Addr) {
+	sc.ipsMu.Lock()
+	defer sc.ipsMu.Unlock()
+	if _, ok := sc.perIP[ip]; !ok {
+		sc.perIP[ip] = &ipStats{label: ip.String()}
+	}
+}
+
+// RemoveIP drops the per-IP statistics for ip.
+func (sc *StatsCollector) RemoveIP(ip netip.Addr) {
+	sc.ipsMu.Lock()
+	delete(sc.perIP, ip)
+	sc.ipsMu.Unlock()
+	label := ip.String()
+	ConnectionsPerIP.DeleteLabelValues(label)
+	UpstreamBytesPerIP.DeleteLabelValues(label, "sent")
+	UpstreamBytesPerIP.DeleteLabelValues(label, "received")
+	UpstreamPhaseDuration.DeletePartialMatch(prometheus.Labels{"ip": label})
+	UpstreamResponses.DeletePartialMatch(prometheus.Labels{"ip": label})
+	UpstreamErrors.DeletePartialMatch(prometheus.Labels{"ip": label})
+}
+
+// ip returns the statistics of ip and its label. The statistics are nil if ip
+// is not tracked.
+func (sc *StatsCollector) ip(ip netip.Addr) (*ipStats, string) {
+	sc.ipsMu.RLock()
+	st := sc.perIP[ip]
+	sc.ipsMu.RUnlock()
+	if st == nil {
+		return nil, ip.String()
+	}
+	return st, st.label
+}
+
 // IncActiveConnections increments active connections.
 func (sc *StatsCollector) IncActiveConnections() {
 	sc.activeConnections.Add(1)
@@ -164,60 +631,285 @@ func (sc *StatsCollector) DecActiveConnections() {
 // IncTotalRequests increments total requests.
 func (sc *StatsCollector) IncTotalRequests() {
 	sc.totalRequests.Add(1)
+	if s := sc.statsd.Load(); s != nil {
+		s.Count("requests", 1)
+	}
 }
 
 // AddBytesSent adds to bytes sent counter.
 func (sc *StatsCollector) AddBytesSent(n int64) {
 	sc.bytesSent.Add(n)
 	BytesSent.Add(float64(n))
+	if s := sc.statsd.Load(); s != nil {
+		s.Count("bytes_sent", n)
+	}
 }
 
 // AddBytesReceived adds to bytes received counter.
 func (sc *StatsCollector) AddBytesReceived(n int64) {
 	sc.bytesReceived.Add(n)
 	BytesReceived.Add(float64(n))
+	if s := sc.statsd.Load(); s != nil {
+		s.Count("bytes_received", n)
+	}
+}
+
+// UpstreamBytes returns the counter for bytes exchanged with upstreams through
+// ip. The counter can be kept and used for the lifetime of a connection.
+func (sc *StatsCollector) UpstreamBytes(ip netip.Addr) *ByteCounter {
+	st, label := sc.ip(ip)
+	c := &ByteCounter{
+		sc:           sc,
+		ip:           label,
+		sentProm:     UpstreamBytesPerIP.WithLabelValues(label, "sent"),
+		receivedProm: UpstreamBytesPerIP.WithLabelValues(label, "received"),
+	}
+	if st != nil {
+		c.perIP = &st.bytes
+	}
+	return c
+}
+
+// AddUpstreamBytes adds bytes sent to and received from upstreams through ip.
+func (sc *StatsCollector) AddUpstreamBytes(ip netip.Addr, sent, received int64) {
+	c := sc.UpstreamBytes(ip)
+	c.AddSent(sent)
+	c.AddReceived(received)
 }
 
 // IncConnectionsForIP increments connections for an IP.
-func (sc *StatsCollector) IncConnectionsForIP(ip string) {
-	if counter, ok := sc.connectionsPerIP[ip]; ok {
-		counter.Add(1)
+func (sc *StatsCollector) IncConnectionsForIP(ip netip.Addr) {
+	st, label := sc.ip(ip)
+	if st != nil {
+		st.connections.Add(1)
 	}
-	ConnectionsPerIP.WithLabelValues(ip).Inc()
+	ConnectionsPerIP.WithLabelValues(label).Inc()
 }
 
 // DecConnectionsForIP decrements connections for an IP.
-func (sc *StatsCollector) DecConnectionsForIP(ip string) {
-	if counter, ok := sc.connectionsPerIP[ip]; ok {
-		counter.Add(-1)
+func (sc *StatsCollector) DecConnectionsForIP(ip netip.Addr) {
+	st, label := sc.ip(ip)
+	if st != nil {
+		st.connections.Add(-1)
 	}
-	ConnectionsPerIP.WithLabelValues(ip).Dec()
+	ConnectionsPerIP.WithLabelValues(label).Dec()
 }
 
 // IncSelectionsForIP increments selections for an IP.
-func (sc *StatsCollector) IncSelectionsForIP(ip, host string) {
-	if counter, ok := sc.selectionsPerIP[ip]; ok {
-		counter.Add(1)
+func (sc *StatsCollector) IncSelectionsForIP(ip netip.Addr, host string) {
+	st, label := sc.ip(ip)
+	if st != nil {
+		st.selections.Add(1)
+	}
+	BalancerSelections.WithLabelValues(label, HostLabel(host)).Inc()
+	if s := sc.statsd.Load(); s != nil {
+		s.Count("balancer_selections", 1, "ip:"+label)
+	}
+}
+
+// SelectionsPerIP returns the total balancer selections per IP.
+func (sc *StatsCollector) SelectionsPerIP() map[string]int64 {
+	sc.ipsMu.RLock()
+	defer sc.ipsMu.RUnlock()
+	selsPerIP := make(map[string]int64, len(sc.perIP))
+	for _, st := range sc.perIP {
+		selsPerIP[st.label] = st.selections.Load()
 	}
-	BalancerSelections.WithLabelValues(ip, host).Inc()
+	return selsPerIP
+}
+
+// SetCircuitSource sets the function reporting per-IP circuit breaker state for GetStats.
+func (sc *StatsCollector) SetCircuitSource(fn func() map[string]CircuitInfo) {
+	sc.circuitSource.Store(&fn)
+}
+
+// SetDrainSource sets the function reporting the IPs in drain mode for GetStats.
+func (sc *StatsCollector) SetDrainSource(fn func() []netip.Addr) {
+	sc.drainSource.Store(&fn)
+}
+
+// SetBalancerSource sets the function reporting the balancer history for GetStats.
+func (sc *StatsCollector) SetBalancerSource(fn func() BalancerInfo) {
+	sc.balancerSource.Store(&fn)
+}
+
+// SetLimiterSource sets the function reporting connection limit usage for GetStats.
+func (sc *StatsCollector) SetLimiterSource(fn func() LimiterInfo) {
+	sc.limiterSource.Store(&fn)
+}
+
+// SetHealthSource sets the function reporting per-IP health check state for GetStats.
+func (sc *StatsCollector) SetHealthSource(fn func() map[string]HealthInfo) {
+	sc.healthSource.Store(&fn)
+}
+
+// Circuits returns per-IP circuit breaker state.
+// Returns false if no circuit breaker is configured.
+func (sc *StatsCollector) Circuits() (map[string]CircuitInfo, bool) {
+	fn := sc.circuitSource.Load()
+	if fn == nil {
+		return nil, false
+	}
+	return (*fn)(), true
 }
 
 // GetStats returns current statistics.
 func (sc *StatsCollector) GetStats() Stats {
-	connsPerIP := make(map[string]int64)
-	for ip, counter := range sc.connectionsPerIP {
-		connsPerIP[ip] = counter.Load()
+	sc.ipsMu.RLock()
+	connsPerIP := make(map[string]int64, len(sc.perIP))
+	bytesPerIP := make(map[string]IPBytes, len(sc.perIP))
+	for _, st := range sc.perIP {
+		connsPerIP[st.label] = st.connections.Load()
+		bytesPerIP[st.label] = IPBytes{Sent: st.bytes.sent.Load(), Received: st.bytes.received.Load()}
+	}
+	sc.ipsMu.RUnlock()
+	selsPerIP := sc.SelectionsPerIP()
+	circuits, _ := sc.Circuits()
+	var draining []string
+	if fn := sc.drainSource.Load(); fn != nil {
+		draining = netutil.AddrStrings((*fn)())
+	}
+	var balancer *BalancerInfo
+	if fn := sc.balancerSource.Load(); fn != nil {
+		info := (*fn)()
+		balancer = &info
+	}
+	var limiter *LimiterInfo
+	if fn := sc.limiterSource.Load(); fn != nil {
+		info := (*fn)()
+		limiter = &info
 	}
-	selsPerIP := make(map[string]int64)
-	for ip, counter := range sc.selectionsPerIP {
-		selsPerIP[ip] = counter.Load()
+	var health map[string]HealthInfo
+	if fn := sc.healthSource.Load(); fn != nil {
+		health = (*fn)()
 	}
 	return Stats{
-		ActiveConnections: sc.activeConnections.Load(),
-		TotalRequests:     sc.totalRequests.Load(),
-		BytesSent:         sc.bytesSent.Load(),
-		BytesReceived:     sc.bytesReceived.Load(),
-		ConnectionsPerIP:  connsPerIP,
-		SelectionsPerIP:   selsPerIP,
+		Circuits:              circuits,
+		Draining:              draining,
+		Balancer:              balancer,
+		Limiter:               limiter,
+		Health:                health,
+		ActiveConnections:     sc.activeConnections.Load(),
+		TotalRequests:         sc.totalRequests.Load(),
+		BytesSent:             sc.bytesSent.Load(),
+		BytesReceived:         sc.bytesReceived.Load(),
+		UpstreamBytesSent:     sc.upstreamSent.Load(),
+		UpstreamBytesReceived: sc.upstreamReceived.Load(),
+		UpstreamBytesPerIP:    bytesPerIP,
+		ConnectionsPerIP:      connsPerIP,
+		SelectionsPerIP:       selsPerIP,
+	}
+}
+
+// Counters are the cumulative counters of a StatsCollector, saved across
+// restarts so that /stats totals do not start over on every deploy.
+type Counters struct {
+	TotalRequests         int64              `json:"total_requests"`
+	BytesSent             int64              `json:"bytes_sent"`
+	BytesReceived         int64              `json:"bytes_received"`
+	UpstreamBytesSent     int64              `json:"upstream_bytes_sent"`
+	UpstreamBytesReceived int64              `json:"upstream_bytes_received"`
+	UpstreamBytesPerIP    map[string]IPBytes `json:"upstream_bytes_per_ip"`
+	SelectionsPerIP       map[string]int64   `json:"selections_per_ip"`
+}
+
+// Counters returns the cumulative counters.
+func (sc *StatsCollector) Counters() Counters {
+	sc.ipsMu.RLock()
+	bytesPerIP := make(map[string]IPBytes, len(sc.perIP))
+	for _, st := range sc.perIP {
+		bytesPerIP[st.label] = IPBytes{Sent: st.bytes.sent.Load(), Received: st.bytes.received.Load()}
+	}
+	sc.ipsMu.RUnlock()
+	return Counters{
+		TotalRequests:         sc.totalRequests.Load(),
+		BytesSent:             sc.bytesSent.Load(),
+		BytesReceived:         sc.bytesReceived.Load(),
+		UpstreamBytesSent:     sc.upstreamSent.Load(),
+		UpstreamBytesReceived: sc.upstreamReceived.Load(),
+		UpstreamBytesPerIP:    bytesPerIP,
+		SelectionsPerIP:       sc.SelectionsPerIP(),
+	}
+}
+
+// RestoreCounters adds saved counters to the current ones. Per-IP counters
+// of IPs no longer configured, or not valid addresses, are dropped. Prometheus counters are not
+// affected: they start over on restart, as Prometheus expects.
+func (sc *StatsCollector) RestoreCounters(c Counters) {
+	sc.totalRequests.Add(c.TotalRequests)
+	sc.bytesSent.Add(c.BytesSent)
+	sc.bytesReceived.Add(c.BytesReceived)
+	sc.upstreamSent.Add(c.UpstreamBytesSent)
+	sc.upstreamReceived.Add(c.UpstreamBytesReceived)
+
+	sc.ipsMu.RLock()
+	defer sc.ipsMu.RUnlock()
+	for ip, b := range c.UpstreamBytesPerIP {
+		if st := sc.savedIP(ip); st != nil {
+			st.bytes.sent.Add(b.Sent)
+			st.bytes.received.Add(b.Received)
+		}
+	}
+	for ip, n := range c.SelectionsPerIP {
+		if st := sc.savedIP(ip); st != nil {
+			st.selections.Add(n)
+		}
+	}
+}
+
+// savedIP returns the statistics of the IP saved as ip, or nil. sc.ipsMu must
+// be held.
+func (sc *StatsCollector) savedIP(ip string) *ipStats {
+	addr, err := netutil.ParseAddr(ip)
+	if err != nil {
+		return nil
+	}
+	return sc.perIP[addr]
+}
+
+// ipBytes is the upstream traffic of a single IP.
+type ipBytes struct {
+	sent     atomic.Int64
+	received atomic.Int64
+}
+
+// ByteCounter counts bytes exchanged with upstreams through one outbound IP.
+type ByteCounter struct {
+	sc           *StatsCollector
+	ip           string
+	perIP        *ipBytes // nil if the IP is not tracked
+	sentProm     prometheus.Counter
+	receivedProm prometheus.Counter
+}
+
+// AddSent adds n bytes sent to the upstream.
+func (c *ByteCounter) AddSent(n int64) {
+	if n <= 0 {
+		return
+	}
+	c.sc.upstreamSent.Add(n)
+	if c.perIP != nil {
+		c.perIP.sent.Add(n)
+	}
+	UpstreamBytesSent.Add(float64(n))
+	c.sentProm.Add(float64(n))
+	if s := c.sc.statsd.Load(); s != nil {
+		s.Count("upstream_bytes", n, "ip:"+c.ip, "direction:sent")
+	}
+}
+
+// AddReceived adds n bytes received from the upstream.
+func (c *ByteCounter) AddReceived(n int64) {
+	if n <= 0 {
+		return
+	}
+	c.sc.upstreamReceived.Add(n)
+	if c.perIP != nil {
+		c.perIP.received.Add(n)
+	}
+	UpstreamBytesReceived.Add(float64(n))
+	c.receivedProm.Add(float64(n))
+	if s := c.sc.statsd.Load(); s != nil {
+		s.Count("upstream_bytes", n, "ip:"+c.ip, "direction:received")
 	}
 }
@@ -1,24 +1,27 @@
 package metrics
 
 import (
+	"net/netip"
 	"testing"
+
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
 )
 
 func TestNewStatsCollector(t *testing.T) {
 	ips := []string{"192.168.1.1", "192.168.1.2"}
-	sc := NewStatsCollector(ips)
+	sc := NewStatsCollector(netutil.MustParseAddrs(ips))
 
 	if sc == nil {
 		t.Fatal("expected non-nil stats collector")
 	}
 
-	if len(sc.connectionsPerIP) != 2 {
-		t.Errorf("expected 2 IPs in connectionsPerIP, got %d", len(sc.connectionsPerIP))
+	if len(sc.perIP) != 2 {
+		t.Errorf("expected 2 IPs in perIP, got %d", len(sc.perIP))
 	}
 }
 
 func TestStatsCollector_ActiveConnections(t *testing.T) {
-	sc := NewStatsCollector([]string{"192.168.1.1"})
+	sc := NewStatsCollector(netutil.MustParseAddrs([]string{"192.168.1.1"}))
 
 	sc.IncActiveConnections()
 	sc.IncActiveConnections()
@@ -36,7 +39,7 @@ func TestStatsCollector_ActiveConnections(t *testing.T) {
 }
 
 func TestStatsCollector_TotalRequests(t *testing.T) {
-	sc := NewStatsCollector([]string{"192.168.1.1"})
+	sc := NewStatsCollector(netutil.MustParseAddrs([]string{"192.168.1.1"}))
 
 	sc.IncTotalRequests()
 	sc.IncTotalRequests()
@@ -49,7 +52,7 @@ func TestStatsCollector_TotalRequests(t *testing.T) {
 }
 
 func TestStatsCollector_Bytes(t *testing.T) {
-	sc := NewStatsCollector([]string{"192.168.1.1"})
+	sc := NewStatsCollector(netutil.MustParseAddrs([]string{"192.168.1.1"}))
 
 	sc.AddBytesSent(1000)
 	sc.AddBytesReceived(500)
@@ -63,13 +66,38 @@ func TestStatsCollector_Bytes(t *testing.T) {
 	}
 }
 
+func TestStatsCollector_UpstreamBytes(t *testing.T) {
+	sc := NewStatsCollector(netutil.MustParseAddrs([]string{"192.168.1.1"}))
+
+	sc.AddBytesSent(1000)
+	sc.AddUpstreamBytes(netip.MustParseAddr("192.168.1.1"), 300, 1200)
+	mapped, err := netutil.ParseAddr("::ffff:192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter := sc.UpstreamBytes(mapped)
+	counter.AddSent(20)
+	counter.AddReceived(-5)
+
+	stats := sc.GetStats()
+	if stats.UpstreamBytesSent != 320 || stats.UpstreamBytesReceived != 1200 {
+		t.Errorf("expected 320/1200 upstream bytes, got %d/%d", stats.UpstreamBytesSent, stats.UpstreamBytesReceived)
+	}
+	if stats.BytesSent != 1000 {
+		t.Errorf("expected client bytes to be counted separately, got %d", stats.BytesSent)
+	}
+	if got := stats.UpstreamBytesPerIP["192.168.1.1"]; got.Sent != 320 || got.Received != 1200 {
+		t.Errorf("unexpected per-IP upstream bytes: %+v", got)
+	}
+}
+
 func TestStatsCollector_ConnectionsPerIP(t *testing.T) {
 	ips := []string{"192.168.1.1", "192.168.1.2"}
-	sc := NewStatsCollector(ips)
+	sc := NewStatsCollector(netutil.MustParseAddrs(ips))
 
-	sc.IncConnectionsForIP("192.168.1.1")
-	sc.IncConnectionsForIP("192.168.1.1")
-	sc.IncConnectionsForIP("192.168.1.2")
+	sc.IncConnectionsForIP(netip.MustParseAddr("192.168.1.1"))
+	sc.IncConnectionsForIP(netip.MustParseAddr("192.168.1.1"))
+	sc.IncConnectionsForIP(netip.MustParseAddr("192.168.1.2"))
 
 	stats := sc.GetStats()
 	if stats.ConnectionsPerIP["192.168.1.1"] != 2 {
@@ -79,7 +107,7 @@ func TestStatsCollector_ConnectionsPerIP(t *testing.T) {
 		t.Errorf("expected 1 connection for 192.168.1.2, got %d", stats.ConnectionsPerIP["192.168.1.2"])
 	}
 
-	sc.DecConnectionsForIP("192.168.1.1")
+	sc.DecConnectionsForIP(netip.MustParseAddr("192.168.1.1"))
 	stats = sc.GetStats()
 	if stats.ConnectionsPerIP["192.168.1.1"] != 1 {
 		t.Errorf("expected 1 connection for 192.168.1.1 after decrement, got %d", stats.ConnectionsPerIP["192.168.1.1"])
@@ -88,11 +116,11 @@ func TestStatsCollector_ConnectionsPerIP(t *testing.T) {
 
 func TestStatsCollector_SelectionsPerIP(t *testing.T) {
 	ips := []string{"192.168.1.1", "192.168.1.2"}
-	sc := NewStatsCollector(ips)
+	sc := NewStatsCollector(netutil.MustParseAddrs(ips))
 
-	sc.IncSelectionsForIP("192.168.1.1", "example.com")
-	sc.IncSelectionsForIP("192.168.1.1", "example.com")
-	sc.IncSelectionsForIP("192.168.1.2", "other.com")
+	sc.IncSelectionsForIP(netip.MustParseAddr("192.168.1.1"), "example.com")
+	sc.IncSelectionsForIP(netip.MustParseAddr("192.168.1.1"), "example.com")
+	sc.IncSelectionsForIP(netip.MustParseAddr("192.168.1.2"), "other.com")
 
 	stats := sc.GetStats()
 	if stats.SelectionsPerIP["192.168.1.1"] != 2 {
@@ -104,12 +132,63 @@ func TestStatsCollector_SelectionsPerIP(t *testing.T) {
 }
 
 func TestStatsCollector_UnknownIP(t *testing.T) {
-	sc := NewStatsCollector([]string{"192.168.1.1"})
+	sc := NewStatsCollector(netutil.MustParseAddrs([]string{"192.168.1.1"}))
 
 	// Should not panic for unknown IP
-	sc.IncConnectionsForIP("192.168.1.99")
-	sc.DecConnectionsForIP("192.168.1.99")
-	sc.IncSelectionsForIP("192.168.1.99", "example.com")
+	sc.IncConnectionsForIP(netip.MustParseAddr("192.168.1.99"))
+	sc.DecConnectionsForIP(netip.MustParseAddr("192.168.1.99"))
+	sc.IncSelectionsForIP(netip.MustParseAddr("192.168.1.99"), "example.com")
+}
+
+func TestStatsCollector_AddRemoveIP(t *testing.T) {
+	sc := NewStatsCollector(netutil.MustParseAddrs([]string{"192.168.1.1"}))
+
+	sc.AddIP(netip.MustParseAddr("192.168.1.2"))
+	sc.IncSelectionsForIP(netip.MustParseAddr("192.168.1.2"), "example.com")
+	if got := sc.GetStats().SelectionsPerIP["192.168.1.2"]; got != 1 {
+		t.Errorf("expected 1 selection for added IP, got %d", got)
+	}
+
+	sc.RemoveIP(netip.MustParseAddr("192.168.1.2"))
+	stats := sc.GetStats()
+	if _, ok := stats.SelectionsPerIP["192.168.1.2"]; ok {
+		t.Error("expected removed IP to be dropped from selections")
+	}
+	if _, ok := stats.ConnectionsPerIP["192.168.1.2"]; ok {
+		t.Error("expected removed IP to be dropped from connections")
+	}
+	if _, ok := stats.UpstreamBytesPerIP["192.168.1.2"]; ok {
+		t.Error("expected removed IP to be dropped from upstream bytes")
+	}
+}
+
+func TestStatsCollector_RestoreCounters(t *testing.T) {
+	before := NewStatsCollector(netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2"}))
+	before.IncTotalRequests()
+	before.AddBytesSent(100)
+	before.AddUpstreamBytes(netip.MustParseAddr("192.168.1.1"), 30, 40)
+	before.IncSelectionsForIP(netip.MustParseAddr("192.168.1.1"), "example.com")
+	before.IncSelectionsForIP(netip.MustParseAddr("192.168.1.2"), "example.com")
+	saved := before.Counters()
+
+	// 192.168.1.2 is no longer configured after the restart
+	after := NewStatsCollector(netutil.MustParseAddrs([]string{"192.168.1.1"}))
+	after.IncTotalRequests()
+	after.RestoreCounters(saved)
+
+	stats := after.GetStats()
+	if stats.TotalRequests != 2 || stats.BytesSent != 100 {
+		t.Errorf("expected restored counters added to current ones, got %d requests, %d bytes", stats.TotalRequests, stats.BytesSent)
+	}
+	if stats.UpstreamBytesSent != 30 || stats.UpstreamBytesPerIP["192.168.1.1"] != (IPBytes{Sent: 30, Received: 40}) {
+		t.Errorf("unexpected upstream bytes: %d, %+v", stats.UpstreamBytesSent, stats.UpstreamBytesPerIP)
+	}
+	if stats.SelectionsPerIP["192.168.1.1"] != 1 {
+		t.Errorf("expected 1 restored selection, got %d", stats.SelectionsPerIP["192.168.1.1"])
+	}
+	if _, ok := stats.SelectionsPerIP["192.168.1.2"]; ok {
+		t.Error("expected counters of unconfigured IPs to be dropped")
+	}
 }
 
 func TestStats_Struct(t *testing.T) {
@@ -126,3 +205,47 @@ func TestStats_Struct(t *testing.T) {
 		t.Error("stats struct field mismatch")
 	}
 }
+
+func TestStatsCollector_CircuitSource(t *testing.T) {
+	sc := NewStatsCollector(netutil.MustParseAddrs([]string{"192.168.1.1"}))
+
+	if stats := sc.GetStats(); stats.Circuits != nil {
+		t.Errorf("expected no circuits without a source, got %v", stats.Circuits)
+	}
+
+	sc.SetCircuitSource(func() map[string]CircuitInfo {
+		return map[string]CircuitInfo{"192.168.1.1": {State: "open", Failures: 5}}
+	})
+	if got := sc.GetStats().Circuits["192.168.1.1"]; got.State != "open" || got.Failures != 5 {
+		t.Errorf("unexpected circuit info: %+v", got)
+	}
+}
+
+func TestStatsCollector_Sources(t *testing.T) {
+	sc := NewStatsCollector(netutil.MustParseAddrs([]string{"192.168.1.1"}))
+
+	if stats := sc.GetStats(); stats.Balancer != nil || stats.Limiter != nil || stats.Health != nil {
+		t.Errorf("expected no balancer, limiter or health stats without sources, got %+v", stats)
+	}
+
+	sc.SetBalancerSource(func() BalancerInfo {
+		return BalancerInfo{TotalHosts: 2, TotalEntries: 3, EntriesPerIP: map[string]int{"192.168.1.1": 3}}
+	})
+	sc.SetLimiterSource(func() LimiterInfo {
+		return LimiterInfo{Active: 1, MaxTotal: 100, MaxPerIP: 10, PerIP: map[string]IPUsage{"192.168.1.1": {Active: 1, Limit: 10}}}
+	})
+	sc.SetHealthSource(func() map[string]HealthInfo {
+		return map[string]HealthInfo{"192.168.1.1": {State: "unhealthy", ConsecutiveFailures: 3}}
+	})
+
+	stats := sc.GetStats()
+	if stats.Balancer == nil || stats.Balancer.TotalHosts != 2 || stats.Balancer.EntriesPerIP["192.168.1.1"] != 3 {
+		t.Errorf("unexpected balancer stats: %+v", stats.Balancer)
+	}
+	if stats.Limiter == nil || stats.Limiter.PerIP["192.168.1.1"].Limit != 10 {
+		t.Errorf("unexpected limiter stats: %+v", stats.Limiter)
+	}
+	if got := stats.Health["192.168.1.1"]; got.State != "unhealthy" || got.ConsecutiveFailures != 3 {
+		t.Errorf("unexpected health info: %+v", got)
+	}
+}
@@ -0,0 +1,23 @@
+// Package metrics provides Prometheus metrics for the proxy.
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// pushTimeout bounds a push so an unreachable gateway cannot stall shutdown.
+const pushTimeout = 10 * time.Second
+
+// Push sends the current value of all registered metrics to the Pushgateway at
+// url under the given job, replacing anything previously pushed for that job.
+// It is meant for short-lived runs whose metrics endpoint is never scraped.
+func Push(url, job string) error {
+	return push.New(url, job).
+		Gatherer(prometheus.DefaultGatherer).
+		Client(&http.Client{Timeout: pushTimeout}).
+		Push()
+}
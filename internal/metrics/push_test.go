@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPush(t *testing.T) {
+	var method, path, body string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer gateway.Close()
+
+	TunnelConnections.Inc()
+	if err := Push(gateway.URL, "crawl"); err != nil {
+		t.Fatalf("Push() error = %v", err)
+	}
+
+	if method != http.MethodPut {
+		t.Errorf("method = %s, want PUT", method)
+	}
+	if path != "/metrics/job/crawl" {
+		t.Errorf("path = %s, want /metrics/job/crawl", path)
+	}
+	if !strings.Contains(body, "outbound_lb_tunnel_connections_total") {
+		t.Error("pushed metrics should include outbound_lb_* metrics")
+	}
+}
+
+func TestPush_GatewayError(t *testing.T) {
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer gateway.Close()
+
+	if err := Push(gateway.URL, "crawl"); err == nil {
+		t.Error("expected error when the gateway rejects the push")
+	}
+}
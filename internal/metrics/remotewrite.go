@@ -0,0 +1,148 @@
+// Package metrics provides Prometheus metrics for the proxy.
+package metrics
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// remoteLabel is a label of a remote-write series.
+type remoteLabel struct {
+	name, value string
+}
+
+// remoteSeries is a single sample of a remote-write series.
+type remoteSeries struct {
+	labels []remoteLabel
+	value  float64
+}
+
+// RemoteWrite sends the current value of all registered metrics to the
+// Prometheus remote-write endpoint at rawURL, as series labeled with job and
+// instance. Credentials in the URL are sent with basic authentication.
+func RemoteWrite(rawURL, job, instance string) error {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("gathering metrics: %w", err)
+	}
+	body := snappy.Encode(nil, encodeWriteRequest(families, job, instance, time.Now()))
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid remote-write URL: %w", err)
+	}
+	user := u.User
+	u.User = nil
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if user != nil {
+		password, _ := user.Password()
+		req.SetBasicAuth(user.Username(), password)
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := (&http.Client{Timeout: pushTimeout}).Do(req)
+	if err != nil {
+		return fmt.Errorf("remote write: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("remote write: unexpected status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// flattenFamilies turns gathered metric families into series the way
+// Prometheus exposes them: histograms into _bucket, _sum and _count series,
+// summaries into quantile, _sum and _count series.
+func flattenFamilies(families []*dto.MetricFamily, job, instance string) []remoteSeries {
+	var series []remoteSeries
+	for _, mf := range families {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			add := func(suffix string, value float64, extra ...remoteLabel) {
+				labels := []remoteLabel{{"__name__", name + suffix}, {"job", job}, {"instance", instance}}
+				for _, lp := range m.GetLabel() {
+					labels = append(labels, remoteLabel{lp.GetName(), lp.GetValue()})
+				}
+				labels = append(labels, extra...)
+				// Remote write requires labels sorted by name and unique; job and
+				// instance win over metric labels of the same name
+				slices.SortStableFunc(labels, func(a, b remoteLabel) int { return cmp.Compare(a.name, b.name) })
+				labels = slices.CompactFunc(labels, func(a, b remoteLabel) bool { return a.name == b.name })
+				series = append(series, remoteSeries{labels: labels, value: value})
+			}
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add("", m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add("", m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add("", m.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, b := range h.GetBucket() {
+					add("_bucket", float64(b.GetCumulativeCount()), remoteLabel{"le", strconv.FormatFloat(b.GetUpperBound(), 'f', -1, 64)})
+				}
+				add("_bucket", float64(h.GetSampleCount()), remoteLabel{"le", "+Inf"})
+				add("_sum", h.GetSampleSum())
+				add("_count", float64(h.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					add("", q.GetValue(), remoteLabel{"quantile", strconv.FormatFloat(q.GetQuantile(), 'f', -1, 64)})
+				}
+				add("_sum", s.GetSampleSum())
+				add("_count", float64(s.GetSampleCount()))
+			}
+		}
+	}
+	return series
+}
+
+// encodeWriteRequest encodes the metric families as a remote-write
+// WriteRequest protobuf message with one sample per series at now.
+func encodeWriteRequest(families []*dto.MetricFamily, job, instance string, now time.Time) []byte {
+	var req []byte
+	for _, s := range flattenFamilies(families, job, instance) {
+		var ts []byte
+		for _, l := range s.labels {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, l.name)
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, l.value)
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, label)
+		}
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(s.value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(now.UnixMilli()))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, sample)
+
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, ts)
+	}
+	return req
+}
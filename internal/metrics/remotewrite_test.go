@@ -0,0 +1,108 @@
+package metrics
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/snappy"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestRemoteWrite(t *testing.T) {
+	var body []byte
+	var header http.Header
+	var user, password string
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		user, password, _ = r.BasicAuth()
+		compressed, _ := io.ReadAll(r.Body)
+		body, _ = snappy.Decode(nil, compressed)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer endpoint.Close()
+
+	TunnelConnections.Inc()
+	u := strings.Replace(endpoint.URL, "http://", "http://writer:secret@", 1) + "/api/v1/write"
+	if err := RemoteWrite(u, "crawl", "egress-1"); err != nil {
+		t.Fatalf("RemoteWrite() error = %v", err)
+	}
+
+	if header.Get("Content-Encoding") != "snappy" || header.Get("Content-Type") != "application/x-protobuf" {
+		t.Errorf("unexpected headers %v", header)
+	}
+	if header.Get("X-Prometheus-Remote-Write-Version") != "0.1.0" {
+		t.Errorf("expected the remote-write version header, got %v", header)
+	}
+	if user != "writer" || password != "secret" {
+		t.Errorf("expected basic auth from the URL, got %q:%q", user, password)
+	}
+	for _, s := range []string{"outbound_lb_tunnel_connections_total", "crawl", "egress-1"} {
+		if !bytes.Contains(body, []byte(s)) {
+			t.Errorf("expected %q in the write request", s)
+		}
+	}
+}
+
+func TestRemoteWrite_ErrorStatus(t *testing.T) {
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "out of order sample", http.StatusBadRequest)
+	}))
+	defer endpoint.Close()
+
+	err := RemoteWrite(endpoint.URL, "crawl", "egress-1")
+	if err == nil || !strings.Contains(err.Error(), "out of order sample") {
+		t.Errorf("expected the endpoint error, got %v", err)
+	}
+}
+
+func TestFlattenFamilies_Histogram(t *testing.T) {
+	families := []*dto.MetricFamily{{
+		Name: proto.String("latency_seconds"),
+		Type: dto.MetricType_HISTOGRAM.Enum(),
+		Metric: []*dto.Metric{{
+			Label: []*dto.LabelPair{{Name: proto.String("ip"), Value: proto.String("192.168.1.100")}},
+			Histogram: &dto.Histogram{
+				SampleCount: proto.Uint64(3),
+				SampleSum:   proto.Float64(1.5),
+				Bucket:      []*dto.Bucket{{UpperBound: proto.Float64(0.5), CumulativeCount: proto.Uint64(2)}},
+			},
+		}},
+	}}
+
+	series := flattenFamilies(families, "crawl", "egress-1")
+	if len(series) != 4 {
+		t.Fatalf("expected le=0.5, le=+Inf, _sum and _count series, got %d", len(series))
+	}
+	got := map[string]float64{}
+	for _, s := range series {
+		var name, le string
+		for i, l := range s.labels {
+			if i > 0 && s.labels[i-1].name >= l.name {
+				t.Errorf("labels not sorted: %v", s.labels)
+			}
+			switch l.name {
+			case "__name__":
+				name = l.value
+			case "le":
+				le = l.value
+			}
+		}
+		got[name+le] = s.value
+	}
+	want := map[string]float64{
+		"latency_seconds_bucket0.5":  2,
+		"latency_seconds_bucket+Inf": 3,
+		"latency_seconds_sum":        1.5,
+		"latency_seconds_count":      3,
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %v, want %v", k, got[k], v)
+		}
+	}
+}
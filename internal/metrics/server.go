@@ -3,21 +3,73 @@ package metrics
 
 import (
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/netip"
+	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
 )
 
+// openPaths are the endpoints served to every client whatever SetAccess, for
+// health probes and for agents, which authenticate to the registry on their
+// own.
+var openPaths = map[string]bool{
+	"/health":   true,
+	"/ready":    true,
+	"/registry": true,
+}
+
+// isAdminPath reports whether path is one of the endpoints that change the
+// running proxy or expose its configuration. They are only served once
+// SetAccess restricts the server, so that they are never open to every
+// client of the metrics port.
+func isAdminPath(path string) bool {
+	return path == "/drain" || strings.HasPrefix(path, "/admin/")
+}
+
+// maxPreviewSize bounds the configurations posted to /admin/config/preview.
+const maxPreviewSize = 1 << 20
+
+// defaultTopHosts is how many hosts /stats/hosts lists without a "top"
+// parameter.
+const defaultTopHosts = 20
+
+// access restricts the metrics and admin endpoints to some clients.
+type access struct {
+	user  string
+	pass  string
+	allow []netip.Prefix
+}
+
 // Server is the metrics HTTP server.
 type Server struct {
 	server    *http.Server
+	mux       *http.ServeMux
 	stats     *StatsCollector
 	ready     atomic.Bool
+	check     atomic.Pointer[func() error]
+	shutdown  atomic.Pointer[func()]
 	startTime time.Time
+	drain     atomic.Pointer[func(ip netip.Addr, drain bool) error]
+	cluster   atomic.Pointer[func() any]
+	rejected  atomic.Pointer[func() any]
+	preview   atomic.Pointer[func(data []byte) (any, error)]
+	access    atomic.Pointer[access]
+	cert      atomic.Pointer[tls.Certificate]
 }
 
 // NewServer creates a new metrics server.
@@ -28,14 +80,24 @@ func NewServer(port int, stats *StatsCollector) *Server {
 	}
 
 	mux := http.NewServeMux()
+	s.mux = mux
 	mux.Handle("/metrics", promhttp.Handler())
 	mux.HandleFunc("/health", s.healthHandler)
 	mux.HandleFunc("/ready", s.readyHandler)
 	mux.HandleFunc("/stats", s.statsHandler)
+	mux.HandleFunc("/stats/circuit", s.circuitHandler)
+	mux.HandleFunc("/stats/hosts", s.hostsHandler)
+	mux.HandleFunc("/admin/drain", s.drainHandler)
+	mux.HandleFunc("/drain", s.shutdownHandler)
+	mux.HandleFunc("/admin/config/preview", s.previewHandler)
+	mux.HandleFunc("/cluster/status", s.clusterHandler)
+	mux.HandleFunc("/debug/rejections", s.rejectionsHandler)
+	mux.HandleFunc("/dashboard", s.dashboardHandler)
+	mux.HandleFunc("/", s.rootHandler)
 
 	s.server = &http.Server{
 		Addr:         fmt.Sprintf(":%d", port),
-		Handler:      mux,
+		Handler:      s.protect(mux),
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 10 * time.Second,
 	}
@@ -48,16 +110,191 @@ func (s *Server) Start() error {
 	return s.server.ListenAndServe()
 }
 
+// Serve serves the metrics endpoints on ln, over TLS once ReloadTLS has
+// loaded a certificate.
+func (s *Server) Serve(ln net.Listener) error {
+	if s.cert.Load() != nil {
+		ln = tls.NewListener(ln, s.tlsConfig())
+	}
+	return s.server.Serve(ln)
+}
+
+// ServeUnix serves the metrics endpoints on the unix socket listener ln, over
+// plain HTTP since only local processes can connect.
+func (s *Server) ServeUnix(ln net.Listener) error {
+	return s.server.Serve(ln)
+}
+
+// ReloadTLS loads the certificate and key the server serves TLS with,
+// replacing the current pair for new connections. On error the current pair
+// is kept.
+func (s *Server) ReloadTLS(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("loading metrics certificate: %w", err)
+	}
+	s.cert.Store(&cert)
+	return nil
+}
+
+// tlsConfig returns the TLS configuration serving whichever certificate is
+// current at handshake time.
+func (s *Server) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert := s.cert.Load()
+			if cert == nil {
+				return nil, errors.New("no metrics certificate loaded")
+			}
+			return cert, nil
+		},
+	}
+}
+
+// SetAccess restricts the metrics and admin endpoints to the clients in
+// allow (any client when empty) presenting the basic auth credentials user
+// and pass (none when user is empty). /health, /ready and /registry stay
+// open; /drain and /admin/ are refused until access is restricted.
+func (s *Server) SetAccess(user, pass string, allow []netip.Prefix) {
+	if user == "" && len(allow) == 0 {
+		s.access.Store(nil)
+		return
+	}
+	s.access.Store(&access{user: user, pass: pass, allow: allow})
+}
+
+// protect enforces SetAccess in front of next.
+func (s *Server) protect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a := s.access.Load()
+		if a == nil && isAdminPath(r.URL.Path) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]any{
+				"error": "admin endpoints require --metrics-auth or --metrics-allow",
+			})
+			return
+		}
+		if a == nil || openPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(a.allow) > 0 && !allowed(a.allow, r.RemoteAddr) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]any{
+				"error": "forbidden",
+			})
+			return
+		}
+		if a.user != "" {
+			user, pass, ok := r.BasicAuth()
+			userOK := subtle.ConstantTimeCompare([]byte(user), []byte(a.user)) == 1
+			passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(a.pass)) == 1
+			if !ok || !userOK || !passOK {
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("WWW-Authenticate", `Basic realm="outbound-lb"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				json.NewEncoder(w).Encode(map[string]any{
+					"error": "unauthorized",
+				})
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowed reports whether the client at remoteAddr is in one of prefixes.
+func allowed(prefixes []netip.Prefix, remoteAddr string) bool {
+	ip, err := netutil.HostAddr(remoteAddr)
+	if err != nil {
+		return false
+	}
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 // Shutdown gracefully shuts down the server.
 func (s *Server) Shutdown(ctx context.Context) error {
 	return s.server.Shutdown(ctx)
 }
 
+// SetDrainControl sets the function that puts an IP into or out of drain
+// mode for the /admin/drain endpoint, which is disabled until set.
+func (s *Server) SetDrainControl(fn func(ip netip.Addr, drain bool) error) {
+	s.drain.Store(&fn)
+}
+
+// SetShutdown sets the function that starts the graceful shutdown for the
+// /drain endpoint, which is disabled until set.
+func (s *Server) SetShutdown(fn func()) {
+	s.shutdown.Store(&fn)
+}
+
+// SetClusterStatus sets the function that reports the multi-instance state
+// for the /cluster/status endpoint, which is disabled until set.
+func (s *Server) SetClusterStatus(fn func() any) {
+	s.cluster.Store(&fn)
+}
+
+// SetRejections sets the function that lists recently rejected requests for
+// the /debug/rejections endpoint, which is disabled until set.
+func (s *Server) SetRejections(fn func() any) {
+	s.rejected.Store(&fn)
+}
+
+// SetConfigPreview sets the function that reports what reloading the
+// configuration from data (YAML), or from the config file when data is nil,
+// would change, for the /admin/config/preview endpoint, which is disabled
+// until set.
+func (s *Server) SetConfigPreview(fn func(data []byte) (any, error)) {
+	s.preview.Store(&fn)
+}
+
+// Handle registers an additional handler for pattern. Must be called before
+// Start.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// EnableDebug serves the Go runtime profiles under /debug/pprof/ and the
+// expvar variables at /debug/vars. Must be called before Start.
+func (s *Server) EnableDebug() {
+	s.mux.HandleFunc("/debug/pprof/", pprof.Index)
+	s.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	s.mux.Handle("/debug/pprof/profile", noWriteTimeout(http.HandlerFunc(pprof.Profile)))
+	s.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	s.mux.Handle("/debug/pprof/trace", noWriteTimeout(http.HandlerFunc(pprof.Trace)))
+	s.mux.Handle("/debug/vars", expvar.Handler())
+}
+
+// noWriteTimeout lifts the server write timeout for handlers that stream
+// for as long as the client asks, like CPU profiles and traces.
+func noWriteTimeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		next.ServeHTTP(w, r)
+	})
+}
+
 // SetReady sets the ready state.
 func (s *Server) SetReady(ready bool) {
 	s.ready.Store(ready)
 }
 
+// SetReadyCheck sets a check /ready runs while ready; an error reports the
+// server not ready with the error as the reason.
+func (s *Server) SetReadyCheck(fn func() error) {
+	s.check.Store(&fn)
+}
+
 func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -69,17 +306,27 @@ func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) readyHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	if s.ready.Load() {
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]any{
-			"status": "ready",
-		})
-	} else {
+	if !s.ready.Load() {
 		w.WriteHeader(http.StatusServiceUnavailable)
 		json.NewEncoder(w).Encode(map[string]any{
 			"status": "not ready",
 		})
+		return
+	}
+	if fn := s.check.Load(); fn != nil {
+		if err := (*fn)(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]any{
+				"status": "not ready",
+				"reason": err.Error(),
+			})
+			return
+		}
 	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "ready",
+	})
 }
 
 func (s *Server) statsHandler(w http.ResponseWriter, r *http.Request) {
@@ -87,3 +334,239 @@ func (s *Server) statsHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(s.stats.GetStats())
 }
+
+func (s *Server) circuitHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	circuits, ok := s.stats.Circuits()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]any{
+			"error": "circuit breaker not enabled",
+		})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(circuits)
+}
+
+// hostsHandler lists the busiest destination hosts. The "top" query parameter
+// limits the number of hosts (default 20, 0 for all) and "sort" orders them
+// by requests (default), bytes or errors.
+func (s *Server) hostsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	top := defaultTopHosts
+	if v := r.URL.Query().Get("top"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]any{
+				"error": "invalid top parameter",
+			})
+			return
+		}
+		top = n
+	}
+	sort := r.URL.Query().Get("sort")
+	switch sort {
+	case "":
+		sort = SortByRequests
+	case SortByRequests, SortByBytes, SortByErrors:
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]any{
+			"error": "invalid sort parameter",
+		})
+		return
+	}
+
+	hosts, ok := s.stats.TopHosts(top, sort)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]any{
+			"error": "host stats disabled",
+		})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"sort":  sort,
+		"hosts": hosts,
+	})
+}
+
+// drainHandler lists the draining IPs (GET), or puts the IP given by the "ip"
+// query parameter into (POST) or out of (DELETE) drain mode.
+func (s *Server) drainHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fn := s.drain.Load()
+	if fn == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]any{
+			"error": "drain control not enabled",
+		})
+		return
+	}
+
+	var drain bool
+	switch r.Method {
+	case http.MethodGet:
+		draining := s.stats.GetStats().Draining
+		if draining == nil {
+			draining = []string{}
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]any{
+			"draining": draining,
+		})
+		return
+	case http.MethodPost:
+		drain = true
+	case http.MethodDelete:
+		drain = false
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]any{
+			"error": "method not allowed",
+		})
+		return
+	}
+
+	param := r.URL.Query().Get("ip")
+	if param == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]any{
+			"error": "missing ip parameter",
+		})
+		return
+	}
+	ip, err := netutil.ParseAddr(param)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]any{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err := (*fn)(ip, drain); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]any{
+			"error": err.Error(),
+		})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"ip":       ip.String(),
+		"draining": drain,
+	})
+}
+
+// shutdownHandler fails readiness and starts the graceful shutdown, for
+// Kubernetes preStop hooks. Only POST is accepted, so that a link or an image
+// loaded by a browser cannot trigger it.
+func (s *Server) shutdownHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fn := s.shutdown.Load()
+	if fn == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]any{
+			"error": "drain not enabled",
+		})
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]any{
+			"error": "method not allowed",
+		})
+		return
+	}
+
+	s.ready.Store(false)
+	(*fn)()
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "draining",
+	})
+}
+
+// previewHandler reports what a configuration reload would change without
+// applying it: GET previews the config file, POST the YAML in the body.
+func (s *Server) previewHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fn := s.preview.Load()
+	if fn == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]any{
+			"error": "no config file watched",
+		})
+		return
+	}
+
+	var data []byte
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var err error
+		data, err = io.ReadAll(http.MaxBytesReader(w, r.Body, maxPreviewSize))
+		if err != nil || len(data) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]any{
+				"error": "missing or too large configuration body",
+			})
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]any{
+			"error": "method not allowed",
+		})
+		return
+	}
+
+	preview, err := (*fn)(data)
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]any{
+			"error": err.Error(),
+		})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(preview)
+}
+
+// clusterHandler reports peer instances, their health and synchronization lag.
+func (s *Server) clusterHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fn := s.cluster.Load()
+	if fn == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]any{
+			"error": "no multi-instance features enabled",
+		})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode((*fn)())
+}
+
+// rejectionsHandler lists the most recent requests rejected by the proxy.
+func (s *Server) rejectionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fn := s.rejected.Load()
+	if fn == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]any{
+			"error": "rejection history disabled",
+		})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"rejections": (*fn)(),
+	})
+}
@@ -5,12 +5,15 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"testing"
 	"time"
+
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
 )
 
 func TestNewServer(t *testing.T) {
-	stats := NewStatsCollector([]string{"192.168.1.1"})
+	stats := NewStatsCollector(netutil.MustParseAddrs([]string{"192.168.1.1"}))
 	server := NewServer(9090, stats)
 
 	if server == nil {
@@ -19,7 +22,7 @@ func TestNewServer(t *testing.T) {
 }
 
 func TestServer_HealthHandler(t *testing.T) {
-	stats := NewStatsCollector([]string{"192.168.1.1"})
+	stats := NewStatsCollector(netutil.MustParseAddrs([]string{"192.168.1.1"}))
 	server := NewServer(9090, stats)
 
 	req := httptest.NewRequest(http.MethodGet, "/health", nil)
@@ -45,7 +48,7 @@ func TestServer_HealthHandler(t *testing.T) {
 }
 
 func TestServer_ReadyHandler_NotReady(t *testing.T) {
-	stats := NewStatsCollector([]string{"192.168.1.1"})
+	stats := NewStatsCollector(netutil.MustParseAddrs([]string{"192.168.1.1"}))
 	server := NewServer(9090, stats)
 
 	req := httptest.NewRequest(http.MethodGet, "/ready", nil)
@@ -61,7 +64,7 @@ func TestServer_ReadyHandler_NotReady(t *testing.T) {
 }
 
 func TestServer_ReadyHandler_Ready(t *testing.T) {
-	stats := NewStatsCollector([]string{"192.168.1.1"})
+	stats := NewStatsCollector(netutil.MustParseAddrs([]string{"192.168.1.1"}))
 	server := NewServer(9090, stats)
 	server.SetReady(true)
 
@@ -78,7 +81,7 @@ func TestServer_ReadyHandler_Ready(t *testing.T) {
 }
 
 func TestServer_StatsHandler(t *testing.T) {
-	stats := NewStatsCollector([]string{"192.168.1.1", "192.168.1.2"})
+	stats := NewStatsCollector(netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2"}))
 	stats.IncActiveConnections()
 	stats.IncTotalRequests()
 	stats.AddBytesSent(1000)
@@ -113,7 +116,7 @@ func TestServer_StatsHandler(t *testing.T) {
 }
 
 func TestServer_SetReady(t *testing.T) {
-	stats := NewStatsCollector([]string{"192.168.1.1"})
+	stats := NewStatsCollector(netutil.MustParseAddrs([]string{"192.168.1.1"}))
 	server := NewServer(9090, stats)
 
 	if server.ready.Load() {
@@ -132,7 +135,7 @@ func TestServer_SetReady(t *testing.T) {
 }
 
 func TestServer_Shutdown(t *testing.T) {
-	stats := NewStatsCollector([]string{"192.168.1.1"})
+	stats := NewStatsCollector(netutil.MustParseAddrs([]string{"192.168.1.1"}))
 	server := NewServer(19999, stats)
 
 	// Start server in background
@@ -151,3 +154,102 @@ func TestServer_Shutdown(t *testing.T) {
 		t.Errorf("unexpected shutdown error: %v", err)
 	}
 }
+
+func TestServer_SetAccess(t *testing.T) {
+	stats := NewStatsCollector(netutil.MustParseAddrs([]string{"192.168.1.1"}))
+	server := NewServer(9090, stats)
+	server.SetAccess("admin", "secret", []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")})
+
+	tests := []struct {
+		name   string
+		path   string
+		remote string
+		user   string
+		pass   string
+		want   int
+	}{
+		{name: "allowed with credentials", path: "/stats", remote: "10.1.2.3:5000", user: "admin", pass: "secret", want: http.StatusOK},
+		{name: "allowed without credentials", path: "/metrics", remote: "10.1.2.3:5000", want: http.StatusUnauthorized},
+		{name: "wrong password", path: "/stats", remote: "10.1.2.3:5000", user: "admin", pass: "wrong", want: http.StatusUnauthorized},
+		{name: "outside allowlist", path: "/stats", remote: "192.168.1.10:5000", user: "admin", pass: "secret", want: http.StatusForbidden},
+		{name: "health stays open", path: "/health", remote: "192.168.1.10:5000", want: http.StatusOK},
+		{name: "ready stays open", path: "/ready", remote: "192.168.1.10:5000", want: http.StatusServiceUnavailable},
+		{name: "admin with credentials", path: "/admin/drain", remote: "10.1.2.3:5000", user: "admin", pass: "secret", want: http.StatusNotFound},
+		{name: "admin without credentials", path: "/admin/drain", remote: "10.1.2.3:5000", want: http.StatusUnauthorized},
+		{name: "drain outside allowlist", path: "/drain", remote: "192.168.1.10:5000", want: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.RemoteAddr = tt.remote
+			if tt.user != "" {
+				req.SetBasicAuth(tt.user, tt.pass)
+			}
+			w := httptest.NewRecorder()
+			server.server.Handler.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+
+	// Clearing the access rules opens every endpoint again
+	server.SetAccess("", "", nil)
+	req := httptest.NewRequest(http.MethodGet, "/stats", nil)
+	req.RemoteAddr = "192.168.1.10:5000"
+	w := httptest.NewRecorder()
+	server.server.Handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("status without access rules = %d, want 200", w.Code)
+	}
+
+	// ...except the admin endpoints, which are never open to every client
+	server.SetShutdown(func() {})
+	for _, path := range []string{"/drain", "/admin/drain", "/admin/config/preview"} {
+		w = httptest.NewRecorder()
+		server.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, nil))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s without access rules: status = %d, want 403", path, w.Code)
+		}
+	}
+}
+
+func TestServer_EnableDebug(t *testing.T) {
+	stats := NewStatsCollector(netutil.MustParseAddrs([]string{"192.168.1.1"}))
+	server := NewServer(9090, stats)
+
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		server.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+	if code := get("/debug/pprof/"); code != http.StatusNotFound {
+		t.Errorf("pprof before EnableDebug: status = %d, want 404", code)
+	}
+
+	server.EnableDebug()
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/goroutine?debug=1", "/debug/pprof/cmdline", "/debug/vars"} {
+		if code := get(path); code != http.StatusOK {
+			t.Errorf("%s: status = %d, want 200", path, code)
+		}
+	}
+
+	// Debug endpoints are protected like the others
+	server.SetAccess("admin", "secret", nil)
+	if code := get("/debug/pprof/heap"); code != http.StatusUnauthorized {
+		t.Errorf("pprof with credentials required: status = %d, want 401", code)
+	}
+}
+
+func TestServer_ReloadTLS_Missing(t *testing.T) {
+	stats := NewStatsCollector(netutil.MustParseAddrs([]string{"192.168.1.1"}))
+	server := NewServer(9090, stats)
+
+	if err := server.ReloadTLS("/nonexistent/tls.crt", "/nonexistent/tls.key"); err == nil {
+		t.Error("ReloadTLS() with missing files should fail")
+	}
+	if server.cert.Load() != nil {
+		t.Error("expected no certificate after a failed load")
+	}
+}
@@ -0,0 +1,202 @@
+// Package metrics provides Prometheus metrics for the proxy.
+package metrics
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statsdMaxPacket is the largest UDP payload sent to the agent, small
+// enough to avoid fragmentation on an Ethernet MTU.
+const statsdMaxPacket = 1432
+
+// statsdFlushInterval is how often metrics are sent and gauges are sampled.
+const statsdFlushInterval = time.Second
+
+// StatsD sends metrics to a StatsD or DogStatsD agent over UDP. Counters are
+// summed and gauges sampled in the process, then sent every
+// statsdFlushInterval in packets of several lines.
+type StatsD struct {
+	conn      net.Conn
+	prefix    string
+	tags      []string // sent with every metric (DogStatsD only)
+	dogstatsd bool
+
+	mu       sync.Mutex
+	counters map[statsdKey]int64
+	gauges   map[statsdKey]float64
+	sample   func(*StatsD) // sets the gauges before each flush
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// statsdKey identifies a metric: its full name and its DogStatsD tags.
+type statsdKey struct {
+	name string
+	tags string
+}
+
+// NewStatsD creates an emitter sending to the agent at address (host:port),
+// prefixing metric names with prefix. With dogstatsd, tags are sent with
+// the DogStatsD extension; otherwise tag values are appended to the metric
+// name and tags must be empty.
+func NewStatsD(address, prefix string, tags []string, dogstatsd bool) (*StatsD, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to statsd: %w", err)
+	}
+	s := &StatsD{
+		conn:      conn,
+		prefix:    prefix,
+		tags:      tags,
+		dogstatsd: dogstatsd,
+		counters:  make(map[statsdKey]int64),
+		gauges:    make(map[statsdKey]float64),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// Count adds value to the counter name. Tags are key:value pairs.
+func (s *StatsD) Count(name string, value int64, tags ...string) {
+	key := s.key(name, tags)
+	s.mu.Lock()
+	s.counters[key] += value
+	s.mu.Unlock()
+}
+
+// Gauge sets the gauge name to value. Tags are key:value pairs.
+func (s *StatsD) Gauge(name string, value float64, tags ...string) {
+	key := s.key(name, tags)
+	s.mu.Lock()
+	s.gauges[key] = value
+	s.mu.Unlock()
+}
+
+// key returns the key of a metric with its prefix and tags.
+func (s *StatsD) key(name string, tags []string) statsdKey {
+	if s.dogstatsd {
+		all := append(append([]string(nil), s.tags...), tags...)
+		return statsdKey{name: s.prefix + name, tags: strings.Join(all, ",")}
+	}
+	// Plain StatsD has no tags: each value becomes a name segment
+	var b strings.Builder
+	b.WriteString(s.prefix)
+	b.WriteString(name)
+	for _, tag := range tags {
+		_, v, _ := strings.Cut(tag, ":")
+		b.WriteByte('.')
+		b.WriteString(statsdSegment.Replace(v))
+	}
+	return statsdKey{name: b.String()}
+}
+
+// statsdSegment replaces the characters StatsD gives a meaning to in names.
+var statsdSegment = strings.NewReplacer(".", "_", ":", "_", "|", "_", "@", "_")
+
+// appendLine appends the StatsD line of a metric.
+func appendLine(b []byte, key statsdKey, value, kind string) []byte {
+	b = append(b, key.name...)
+	b = append(b, ':')
+	b = append(b, value...)
+	b = append(b, '|')
+	b = append(b, kind...)
+	if key.tags != "" {
+		b = append(b, "|#"...)
+		b = append(b, key.tags...)
+	}
+	return b
+}
+
+// flush samples the gauges and sends the metrics gathered since the last
+// flush, in packets of at most statsdMaxPacket bytes.
+func (s *StatsD) flush() {
+	s.mu.Lock()
+	sample := s.sample
+	s.mu.Unlock()
+	if sample != nil {
+		sample(s)
+	}
+
+	s.mu.Lock()
+	var lines [][]byte
+	for key, value := range s.counters {
+		lines = append(lines, appendLine(nil, key, strconv.FormatInt(value, 10), "c"))
+	}
+	for key, value := range s.gauges {
+		lines = append(lines, appendLine(nil, key, strconv.FormatFloat(value, 'f', -1, 64), "g"))
+	}
+	clear(s.counters)
+	clear(s.gauges)
+	s.mu.Unlock()
+
+	var packet []byte
+	for _, line := range lines {
+		if len(packet) > 0 && len(packet)+1+len(line) > statsdMaxPacket {
+			// UDP: a lost packet is only a gap in the metrics
+			s.conn.Write(packet)
+			packet = packet[:0]
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	if len(packet) > 0 {
+		s.conn.Write(packet)
+	}
+}
+
+// run flushes every statsdFlushInterval until Close.
+func (s *StatsD) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(statsdFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.stop:
+			s.flush()
+			return
+		}
+	}
+}
+
+// setSample sets the function setting gauges before each flush.
+func (s *StatsD) setSample(fn func(*StatsD)) {
+	s.mu.Lock()
+	s.sample = fn
+	s.mu.Unlock()
+}
+
+// Close sends the pending metrics and closes the connection.
+func (s *StatsD) Close() error {
+	close(s.stop)
+	<-s.done
+	return s.conn.Close()
+}
+
+// EnableStatsD makes the collector also send its counters to s, and sample
+// the active connections into it before each flush.
+func (sc *StatsCollector) EnableStatsD(s *StatsD) {
+	s.setSample(sc.statsdGauges)
+	sc.statsd.Store(s)
+}
+
+// statsdGauges sends the active connections, in total and per IP, to s.
+func (sc *StatsCollector) statsdGauges(s *StatsD) {
+	s.Gauge("active_connections", float64(sc.activeConnections.Load()))
+	sc.ipsMu.RLock()
+	defer sc.ipsMu.RUnlock()
+	for _, st := range sc.perIP {
+		s.Gauge("connections_per_ip", float64(st.connections.Load()), "ip:"+st.label)
+	}
+}
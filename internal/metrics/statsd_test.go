@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
+)
+
+// statsdListener returns a UDP listener and a function reading the lines of
+// the next packet sent to it.
+func statsdListener(t *testing.T) (string, func() []string) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	return pc.LocalAddr().String(), func() []string {
+		buf := make([]byte, 65536)
+		pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("no packet received: %v", err)
+		}
+		lines := strings.Split(string(buf[:n]), "\n")
+		slices.Sort(lines)
+		return lines
+	}
+}
+
+func TestStatsD_DogStatsD(t *testing.T) {
+	addr, read := statsdListener(t)
+	s, err := NewStatsD(addr, "outbound_lb.", []string{"env:prod"}, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer s.Close()
+
+	s.Count("requests", 1)
+	s.Count("requests", 2)
+	s.Count("upstream_bytes", 512, "ip:192.168.1.100", "direction:sent")
+	s.Gauge("active_connections", 7)
+	s.flush()
+
+	want := []string{
+		"outbound_lb.active_connections:7|g|#env:prod",
+		"outbound_lb.requests:3|c|#env:prod",
+		"outbound_lb.upstream_bytes:512|c|#env:prod,ip:192.168.1.100,direction:sent",
+	}
+	if got := read(); !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestStatsD_PlainNames(t *testing.T) {
+	addr, read := statsdListener(t)
+	s, err := NewStatsD(addr, "lb.", nil, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer s.Close()
+
+	s.Count("upstream_bytes", 512, "ip:192.168.1.100", "direction:sent")
+	s.flush()
+
+	want := []string{"lb.upstream_bytes.192_168_1_100.sent:512|c"}
+	if got := read(); !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestStatsCollector_EnableStatsD(t *testing.T) {
+	addr, read := statsdListener(t)
+	s, err := NewStatsD(addr, "", nil, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	sc := NewStatsCollector(netutil.MustParseAddrs([]string{"192.168.1.100"}))
+	sc.EnableStatsD(s)
+	sc.IncTotalRequests()
+	sc.IncConnectionsForIP(netip.MustParseAddr("192.168.1.100"))
+	sc.IncActiveConnections()
+	sc.AddUpstreamBytes(netip.MustParseAddr("192.168.1.100"), 100, 0)
+
+	// Close sends what is pending, gauges included
+	s.Close()
+
+	got := read()
+	for _, line := range []string{
+		"requests:1|c",
+		"active_connections:1|g",
+		"connections_per_ip:1|g|#ip:192.168.1.100",
+		"upstream_bytes:100|c|#ip:192.168.1.100,direction:sent",
+	} {
+		if !slices.Contains(got, line) {
+			t.Errorf("expected %q in %q", line, got)
+		}
+	}
+}
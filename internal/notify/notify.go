@@ -0,0 +1,222 @@
+// Package notify posts events about state changes (IP health, circuit
+// breakers, connection limits, configuration reloads) to webhooks.
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/logger"
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+)
+
+// Event types.
+const (
+	EventIPUnhealthy      = "ip_unhealthy"
+	EventIPRecovered      = "ip_recovered"
+	EventCircuitOpened    = "circuit_opened"
+	EventCircuitClosed    = "circuit_closed"
+	EventLimiterSaturated = "limiter_saturated"
+	EventConfigReloaded   = "config_reloaded"
+)
+
+// Webhook payload formats.
+const (
+	FormatJSON  = "json"
+	FormatSlack = "slack"
+)
+
+const (
+	// queueSize is how many events wait for delivery before new ones are
+	// dropped.
+	queueSize = 100
+	// sendTimeout bounds a single webhook request.
+	sendTimeout = 10 * time.Second
+	// closeTimeout bounds how long Close waits for queued events.
+	closeTimeout = 5 * time.Second
+)
+
+// retryBackoff is the wait before the first retry, doubled on each one.
+var retryBackoff = time.Second
+
+// Event is a state change posted to the webhooks.
+type Event struct {
+	Type    string         `json:"type"`
+	Time    time.Time      `json:"time"`
+	IP      string         `json:"ip,omitempty"`
+	Message string         `json:"message"`
+	Details map[string]any `json:"details,omitempty"`
+}
+
+// Config holds the configuration of a Notifier.
+type Config struct {
+	// URLs are the webhooks every event is posted to.
+	URLs []string
+	// Format is the payload format: FormatJSON posts the event, FormatSlack
+	// a Slack-compatible {"text": ...} message.
+	Format string
+	// RatePerMinute caps the events posted per minute; events over it are
+	// dropped (0 disables the cap).
+	RatePerMinute int
+	// Retries is how many times a failed post is retried, with exponential
+	// backoff.
+	Retries int
+}
+
+// Notifier posts events to webhooks from a background goroutine, so that
+// Notify never blocks the component reporting the event.
+type Notifier struct {
+	cfg    Config
+	client *http.Client
+	events chan Event
+	done   chan struct{}
+
+	mu       sync.Mutex
+	closed   bool
+	tokens   float64
+	refilled time.Time
+}
+
+// New creates a Notifier and starts delivering events.
+func New(cfg Config) *Notifier {
+	n := &Notifier{
+		cfg:      cfg,
+		client:   &http.Client{Timeout: sendTimeout},
+		events:   make(chan Event, queueSize),
+		done:     make(chan struct{}),
+		tokens:   float64(cfg.RatePerMinute),
+		refilled: time.Now(),
+	}
+	go n.run()
+	return n
+}
+
+// Notify queues e for delivery, setting its time if unset. Events over the
+// rate limit or a full queue are dropped. A nil Notifier ignores events.
+func (n *Notifier) Notify(e Event) {
+	if n == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return
+	}
+	if !n.allow(e.Time) {
+		metrics.WebhookEvents.WithLabelValues("rate_limited").Inc()
+		logger.Debug("webhook_event_rate_limited", "type", e.Type, "ip", e.IP)
+		return
+	}
+	select {
+	case n.events <- e:
+	default:
+		metrics.WebhookEvents.WithLabelValues("dropped").Inc()
+		logger.Warn("webhook_event_dropped", "type", e.Type, "ip", e.IP, "reason", "queue full")
+	}
+}
+
+// allow takes a token from the rate limit bucket, refilled at RatePerMinute
+// and holding up to a minute's worth. n.mu must be held.
+func (n *Notifier) allow(now time.Time) bool {
+	rate := float64(n.cfg.RatePerMinute)
+	if rate <= 0 {
+		return true
+	}
+	n.tokens = min(rate, n.tokens+now.Sub(n.refilled).Minutes()*rate)
+	n.refilled = now
+	if n.tokens < 1 {
+		return false
+	}
+	n.tokens--
+	return true
+}
+
+// run delivers queued events until the queue is closed.
+func (n *Notifier) run() {
+	defer close(n.done)
+	for e := range n.events {
+		body, err := n.payload(e)
+		if err != nil {
+			logger.Error("webhook_payload_failed", "type", e.Type, "error", err)
+			continue
+		}
+		for _, url := range n.cfg.URLs {
+			if err := n.send(url, body); err != nil {
+				metrics.WebhookEvents.WithLabelValues("failed").Inc()
+				logger.Warn("webhook_failed", "type", e.Type, "url", url, "error", err)
+			} else {
+				metrics.WebhookEvents.WithLabelValues("sent").Inc()
+			}
+		}
+	}
+}
+
+// payload returns the request body of e in the configured format.
+func (n *Notifier) payload(e Event) ([]byte, error) {
+	if n.cfg.Format == FormatSlack {
+		return json.Marshal(map[string]string{"text": "[outbound-lb] " + e.Message})
+	}
+	return json.Marshal(e)
+}
+
+// send posts body to url, retrying network errors, 429 and 5xx responses.
+func (n *Notifier) send(url string, body []byte) error {
+	var err error
+	backoff := retryBackoff
+	for attempt := 0; attempt <= n.cfg.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		var retry bool
+		if retry, err = n.post(url, body); err == nil || !retry {
+			return err
+		}
+	}
+	return err
+}
+
+// post makes a single request and reports whether a failure is worth
+// retrying.
+func (n *Notifier) post(url string, body []byte) (retry bool, err error) {
+	resp, err := n.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode/100 == 2:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	default:
+		return false, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+}
+
+// Close stops accepting events and waits up to closeTimeout for the queued
+// ones to be delivered.
+func (n *Notifier) Close() {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return
+	}
+	n.closed = true
+	close(n.events)
+	n.mu.Unlock()
+
+	select {
+	case <-n.done:
+	case <-time.After(closeTimeout):
+		logger.Warn("webhook_events_pending", "reason", "shutdown timeout")
+	}
+}
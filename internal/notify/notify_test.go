@@ -0,0 +1,130 @@
+package notify
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// recorder is a webhook recording the bodies it receives.
+type recorder struct {
+	mu     sync.Mutex
+	bodies [][]byte
+}
+
+func (r *recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	r.mu.Lock()
+	r.bodies = append(r.bodies, body)
+	r.mu.Unlock()
+}
+
+func (r *recorder) received() [][]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.bodies
+}
+
+func TestNotifier_JSON(t *testing.T) {
+	rec := &recorder{}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	n := New(Config{URLs: []string{srv.URL, srv.URL}, Format: FormatJSON})
+	n.Notify(Event{Type: EventIPUnhealthy, IP: "10.0.0.1", Message: "Outbound IP 10.0.0.1 is unhealthy"})
+	n.Close()
+
+	bodies := rec.received()
+	if len(bodies) != 2 {
+		t.Fatalf("received %d requests, want one per URL", len(bodies))
+	}
+	var e Event
+	if err := json.Unmarshal(bodies[0], &e); err != nil {
+		t.Fatalf("invalid payload %s: %v", bodies[0], err)
+	}
+	if e.Type != EventIPUnhealthy || e.IP != "10.0.0.1" || e.Time.IsZero() {
+		t.Errorf("event = %+v", e)
+	}
+}
+
+func TestNotifier_Slack(t *testing.T) {
+	rec := &recorder{}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	n := New(Config{URLs: []string{srv.URL}, Format: FormatSlack})
+	n.Notify(Event{Type: EventConfigReloaded, Message: "Configuration reloaded"})
+	n.Close()
+
+	bodies := rec.received()
+	if len(bodies) != 1 {
+		t.Fatalf("received %d requests, want 1", len(bodies))
+	}
+	if got, want := string(bodies[0]), `{"text":"[outbound-lb] Configuration reloaded"}`; got != want {
+		t.Errorf("payload = %s, want %s", got, want)
+	}
+}
+
+func TestNotifier_Retries(t *testing.T) {
+	defer func(b time.Duration) { retryBackoff = b }(retryBackoff)
+	retryBackoff = time.Millisecond
+
+	var attempts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	n := New(Config{URLs: []string{srv.URL}, Retries: 3})
+	n.Notify(Event{Type: EventCircuitOpened, Message: "Circuit opened"})
+	n.Close()
+	if got := attempts.Load(); got != 3 {
+		t.Errorf("attempts = %d, want 3 (two failures, then success)", got)
+	}
+
+	// Client errors are not retried
+	attempts.Store(0)
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer bad.Close()
+	n = New(Config{URLs: []string{bad.URL}, Retries: 3})
+	n.Notify(Event{Type: EventCircuitOpened, Message: "Circuit opened"})
+	n.Close()
+	if got := attempts.Load(); got != 1 {
+		t.Errorf("attempts on 400 = %d, want 1", got)
+	}
+}
+
+func TestNotifier_RateLimit(t *testing.T) {
+	rec := &recorder{}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	n := New(Config{URLs: []string{srv.URL}, RatePerMinute: 2})
+	for range 5 {
+		n.Notify(Event{Type: EventLimiterSaturated, Message: "Total connection limit reached"})
+	}
+	n.Close()
+	if got := len(rec.received()); got != 2 {
+		t.Errorf("received %d events, want 2 within the rate limit", got)
+	}
+}
+
+func TestNotifier_NilAndClosed(t *testing.T) {
+	var n *Notifier
+	n.Notify(Event{Type: EventConfigReloaded})
+
+	n = New(Config{})
+	n.Close()
+	n.Notify(Event{Type: EventConfigReloaded})
+	n.Close()
+}
@@ -0,0 +1,191 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventSelections reports the balancer selections of the last second. It is
+// only sent to Stream clients.
+const EventSelections = "selections"
+
+const (
+	// subscriberBuffer is how many events a slow Stream client may fall
+	// behind before events are dropped for it.
+	subscriberBuffer = 64
+	// selectionsInterval is how often Stream clients receive selections.
+	selectionsInterval = time.Second
+)
+
+// Sink receives events. Notify must not block.
+type Sink interface {
+	Notify(e Event)
+}
+
+// multi passes events to several sinks.
+type multi []Sink
+
+func (m multi) Notify(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	for _, s := range m {
+		s.Notify(e)
+	}
+}
+
+// Multi returns a Sink passing events to all of sinks.
+func Multi(sinks ...Sink) Sink {
+	return multi(sinks)
+}
+
+// Stream serves events as Server-Sent Events, for dashboards and CLIs to
+// watch the proxy live. Clients also receive an EventSelections event every
+// second when a selections source is set.
+type Stream struct {
+	selections func() map[string]int64
+
+	mu     sync.Mutex
+	subs   map[chan Event]struct{}
+	closed chan struct{}
+}
+
+// NewStream creates a Stream. selections returns the total balancer
+// selections per IP, from which the per-second rates are computed (nil
+// disables EventSelections).
+func NewStream(selections func() map[string]int64) *Stream {
+	return &Stream{
+		selections: selections,
+		subs:       make(map[chan Event]struct{}),
+		closed:     make(chan struct{}),
+	}
+}
+
+// Notify sends e to every connected client, dropping it for clients whose
+// buffer is full.
+func (s *Stream) Notify(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Close disconnects all clients, which would otherwise keep a server
+// shutdown waiting.
+func (s *Stream) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.closed:
+	default:
+		close(s.closed)
+	}
+}
+
+// subscribe registers a client channel; the returned function unregisters it.
+func (s *Stream) subscribe() (chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+	s.mu.Lock()
+	s.subs[ch] = struct{}{}
+	s.mu.Unlock()
+	return ch, func() {
+		s.mu.Lock()
+		delete(s.subs, ch)
+		s.mu.Unlock()
+	}
+}
+
+// ServeHTTP streams events until the client disconnects. The "types" query
+// parameter restricts the stream to a comma-separated list of event types.
+func (s *Stream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var types []string
+	if v := r.URL.Query().Get("types"); v != "" {
+		types = strings.Split(v, ",")
+	}
+	wanted := func(t string) bool { return types == nil || slices.Contains(types, t) }
+
+	rc := http.NewResponseController(w)
+	// The stream lasts as long as the client wants, past any write timeout
+	rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	events, unsubscribe := s.subscribe()
+	defer unsubscribe()
+
+	var tick <-chan time.Time
+	var last map[string]int64
+	if s.selections != nil && wanted(EventSelections) {
+		ticker := time.NewTicker(selectionsInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+		last = s.selections()
+	}
+
+	for {
+		var e Event
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.closed:
+			return
+		case e = <-events:
+			if !wanted(e.Type) {
+				continue
+			}
+		case now := <-tick:
+			e, last = selectionsEvent(now, last, s.selections())
+		}
+		data, err := json.Marshal(e)
+		if err != nil {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// selectionsEvent returns the EventSelections event for the selections made
+// since last, and the totals to compute the next one from.
+func selectionsEvent(now time.Time, last, current map[string]int64) (Event, map[string]int64) {
+	perIP := make(map[string]int64, len(current))
+	var total int64
+	for ip, n := range current {
+		// IPs added since the last tick count from zero
+		delta := max(n-last[ip], 0)
+		perIP[ip] = delta
+		total += delta
+	}
+	return Event{
+		Type:    EventSelections,
+		Time:    now,
+		Message: fmt.Sprintf("%d selections in the last second", total),
+		Details: map[string]any{"total": total, "per_ip": perIP},
+	}, current
+}
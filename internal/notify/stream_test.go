@@ -0,0 +1,146 @@
+package notify
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// readEvent reads the next event from an SSE stream.
+func readEvent(t *testing.T, r *bufio.Reader) (string, Event) {
+	t.Helper()
+	var typ string
+	var e Event
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			return typ, e
+		case strings.HasPrefix(line, "event: "):
+			typ = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e); err != nil {
+				t.Fatalf("invalid data %q: %v", line, err)
+			}
+		}
+	}
+}
+
+// connect opens the stream at url and waits until it is subscribed.
+func connect(t *testing.T, s *Stream, url string) *bufio.Reader {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		s.mu.Lock()
+		n := len(s.subs)
+		s.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("client not subscribed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return bufio.NewReader(resp.Body)
+}
+
+func TestStream_Events(t *testing.T) {
+	s := NewStream(nil)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	defer s.Close()
+
+	r := connect(t, s, srv.URL+"?types=config_reloaded")
+	s.Notify(Event{Type: EventIPUnhealthy, IP: "10.0.0.1", Message: "filtered out"})
+	s.Notify(Event{Type: EventConfigReloaded, Message: "Configuration reloaded"})
+
+	typ, e := readEvent(t, r)
+	if typ != EventConfigReloaded || e.Type != EventConfigReloaded || e.Time.IsZero() {
+		t.Errorf("event %q = %+v, want config_reloaded", typ, e)
+	}
+}
+
+func TestStream_Selections(t *testing.T) {
+	var mu sync.Mutex
+	totals := map[string]int64{"10.0.0.1": 5, "10.0.0.2": 1}
+	s := NewStream(func() map[string]int64 {
+		mu.Lock()
+		defer mu.Unlock()
+		m := make(map[string]int64, len(totals))
+		for ip, n := range totals {
+			m[ip] = n
+		}
+		return m
+	})
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	defer s.Close()
+
+	r := connect(t, s, srv.URL)
+	mu.Lock()
+	totals["10.0.0.1"] += 3
+	mu.Unlock()
+
+	typ, e := readEvent(t, r)
+	if typ != EventSelections {
+		t.Fatalf("event type = %q, want selections", typ)
+	}
+	if total := e.Details["total"]; total != float64(3) {
+		t.Errorf("total = %v, want 3", total)
+	}
+	perIP, _ := e.Details["per_ip"].(map[string]any)
+	if perIP["10.0.0.1"] != float64(3) || perIP["10.0.0.2"] != float64(0) {
+		t.Errorf("per_ip = %v", perIP)
+	}
+}
+
+func TestStream_Close(t *testing.T) {
+	s := NewStream(nil)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	r := connect(t, s, srv.URL)
+	s.Close()
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Error("stream should end on Close")
+	}
+}
+
+func TestMulti(t *testing.T) {
+	a, b := NewStream(nil), NewStream(nil)
+	chA, unsubA := a.subscribe()
+	defer unsubA()
+	chB, unsubB := b.subscribe()
+	defer unsubB()
+
+	var n *Notifier
+	Multi(n, a, b).Notify(Event{Type: EventConfigReloaded})
+	for _, ch := range []chan Event{chA, chB} {
+		select {
+		case e := <-ch:
+			if e.Time.IsZero() {
+				t.Error("event time not set")
+			}
+		default:
+			t.Error("event not passed to every sink")
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"net/netip"
+
+	"github.com/cr0hn/outbound-lb/internal/logger"
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
+)
+
+// ClientAllowed reports whether the client at remoteAddr may use the proxy:
+// it must not be in client_deny and, when client_allow is set, must be in
+// it. Refused clients are logged and counted.
+func (s *Server) ClientAllowed(remoteAddr string) bool {
+	if len(s.clientAllow) == 0 && len(s.clientDeny) == 0 {
+		return true
+	}
+	ip, _ := netutil.HostAddr(remoteAddr)
+
+	var list string
+	switch {
+	case prefixesContain(s.clientDeny, ip):
+		list = "deny"
+	case len(s.clientAllow) > 0 && !prefixesContain(s.clientAllow, ip):
+		list = "allow"
+	default:
+		return true
+	}
+	logger.Info("client_acl_denied", "client_ip", addrHost(remoteAddr), "list", list)
+	metrics.ClientACLRejections.WithLabelValues(list).Inc()
+	return false
+}
+
+// prefixesContain reports whether ip is in one of prefixes.
+func prefixesContain(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
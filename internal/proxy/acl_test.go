@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+)
+
+func TestServer_ClientAllowed(t *testing.T) {
+	server := newTestServer(t)
+	server.clientAllow = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32")}
+	server.clientDeny = []netip.Prefix{netip.MustParsePrefix("10.0.0.13/32")}
+
+	tests := []struct {
+		remote string
+		want   bool
+	}{
+		{"10.1.2.3:5000", true},
+		{"[2001:db8::1]:5000", true},
+		{"[::ffff:10.1.2.3]:5000", true},
+		{"10.0.0.13:5000", false},
+		{"192.0.2.1:5000", false},
+		{"not-an-address", false},
+	}
+	for _, tt := range tests {
+		if got := server.ClientAllowed(tt.remote); got != tt.want {
+			t.Errorf("ClientAllowed(%q) = %v, want %v", tt.remote, got, tt.want)
+		}
+	}
+
+	// Without lists every client is allowed
+	server.clientAllow, server.clientDeny = nil, nil
+	if !server.ClientAllowed("192.0.2.1:5000") {
+		t.Error("ClientAllowed() = false without access lists")
+	}
+}
+
+func TestHandler_ClientDenied(t *testing.T) {
+	opts := DefaultTestServerOptions()
+	opts.Auth = "user:pass"
+	server := newTestServerWithOptions(t, opts)
+	server.clientDeny = []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}
+	server.rejections = NewRejectionLog(10)
+	handler := NewHandler(server)
+
+	denied := testutil.ToFloat64(metrics.ClientACLRejections.WithLabelValues("deny"))
+	failures := testutil.ToFloat64(metrics.AuthFailures)
+
+	// Refused before authentication, even with valid credentials
+	req := newTestRequest(t, http.MethodGet, "http://example.com/")
+	req.RemoteAddr = "192.0.2.1:1000"
+	req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("user:pass")))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	assertStatusCode(t, w, http.StatusForbidden)
+	if got := testutil.ToFloat64(metrics.ClientACLRejections.WithLabelValues("deny")) - denied; got != 1 {
+		t.Errorf("client ACL rejections = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(metrics.AuthFailures) - failures; got != 0 {
+		t.Errorf("auth failures = %v, want 0", got)
+	}
+	if r := server.Rejections(); len(r) != 1 || r[0].Reason != RejectClientACL {
+		t.Errorf("rejections = %+v, want one client_acl rejection", r)
+	}
+}
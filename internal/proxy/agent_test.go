@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
+)
+
+// newAgentSetup starts an agent proxy owning 127.0.0.1 and 127.0.0.2 and a
+// frontend without local IPs that uses 127.0.0.2 through the agent. The
+// backend reports the outbound IP and any leaked pin header.
+func newAgentSetup(t *testing.T) (frontend *Server, backend *httptest.Server) {
+	t.Helper()
+
+	backend = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		w.Header().Set("X-Remote-IP", host)
+		w.Header().Set("X-Pin-Header", r.Header.Get(OutboundIPHeader))
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(backend.Close)
+
+	agent := newTestServerWithIPs(t, []string{"127.0.0.1", "127.0.0.2"})
+	agent.cfg.RegistryURL = "http://frontend:9090/registry"
+	agentProxy := httptest.NewServer(NewHandler(agent))
+	t.Cleanup(agentProxy.Close)
+
+	frontend = newTestServerWithIPs(t, nil)
+	agentURL, _ := url.Parse(agentProxy.URL)
+	added, _ := frontend.SetRemoteIPs(map[netip.Addr]*url.URL{netip.MustParseAddr("127.0.0.2"): agentURL})
+	if len(added) != 1 || added[0] != netip.MustParseAddr("127.0.0.2") {
+		t.Fatalf("expected remote IP to be added, got %v", added)
+	}
+	return frontend, backend
+}
+
+func TestServer_RemoteIP_HTTP(t *testing.T) {
+	frontend, backend := newAgentSetup(t)
+
+	rr := httptest.NewRecorder()
+	NewHandler(frontend).ServeHTTP(rr, newTestRequest(t, http.MethodGet, backend.URL+"/"))
+
+	assertStatusCode(t, rr, http.StatusOK)
+	assertHeader(t, rr, "X-Remote-IP", "127.0.0.2")
+	assertHeader(t, rr, "X-Pin-Header", "")
+}
+
+func TestServer_RemoteIP_CONNECT(t *testing.T) {
+	frontend, backend := newAgentSetup(t)
+	frontendProxy := httptest.NewServer(NewHandler(frontend))
+	defer frontendProxy.Close()
+
+	conn, err := net.Dial("tcp", frontendProxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial frontend: %v", err)
+	}
+	defer conn.Close()
+
+	target := backend.Listener.Addr().String()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatalf("read CONNECT response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 for CONNECT, got %d", resp.StatusCode)
+	}
+
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", target)
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("read tunneled response: %v", err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("X-Remote-IP"); got != "127.0.0.2" {
+		t.Errorf("expected tunnel through 127.0.0.2, got %s", got)
+	}
+}
+
+func TestServer_SetRemoteIPs_KeepsLocal(t *testing.T) {
+	server := newTestServerWithIPs(t, []string{"127.0.0.1"})
+	defer server.stopDrains()
+
+	agentURL, _ := url.Parse("http://10.0.0.5:3128")
+	server.SetRemoteIPs(map[netip.Addr]*url.URL{netip.MustParseAddr("127.0.0.1"): agentURL, netip.MustParseAddr("127.0.0.3"): agentURL})
+	if server.transportPool.Upstream(netip.MustParseAddr("127.0.0.1")) != nil {
+		t.Error("expected local IP to stay local")
+	}
+	if server.transportPool.Upstream(netip.MustParseAddr("127.0.0.3")) == nil {
+		t.Error("expected remote IP to go through its agent")
+	}
+
+	// A config reload of the local IPs keeps the remote ones
+	added, removed := server.UpdateIPs(netutil.MustParseAddrs([]string{"127.0.0.1", "127.0.0.4"}))
+	if len(added) != 1 || added[0] != netip.MustParseAddr("127.0.0.4") || len(removed) != 0 {
+		t.Errorf("unexpected diff: added %v, removed %v", added, removed)
+	}
+
+	_, removed = server.SetRemoteIPs(nil)
+	if len(removed) != 1 || removed[0] != netip.MustParseAddr("127.0.0.3") {
+		t.Errorf("expected remote IP to be removed, got %v", removed)
+	}
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/netip"
+	"strconv"
+
+	"github.com/cr0hn/outbound-lb/internal/balancer"
+	"github.com/cr0hn/outbound-lb/internal/logger"
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+)
+
+// limitRequestBody caps the body of r at max_request_body. Requests
+// announcing a larger body are refused right away; others fail once they send
+// more, see requestTooLarge. It reports whether r may proceed.
+func (h *Handler) limitRequestBody(w http.ResponseWriter, r *http.Request, host string) bool {
+	limit := h.server.cfg.MaxRequestBody
+	if limit <= 0 || r.Body == nil || r.Body == http.NoBody {
+		return true
+	}
+	if r.ContentLength > limit {
+		h.requestTooLarge(w, r, host)
+		return false
+	}
+	// The connection is closed after the response once the limit is hit
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	return true
+}
+
+// requestTooLarge refuses r, whose body is over max_request_body, with 413.
+func (h *Handler) requestTooLarge(w http.ResponseWriter, r *http.Request, host string) {
+	metrics.BodyLimitExceeded.WithLabelValues("request").Inc()
+	h.server.Reject(r.Method, balancer.ClientFromContext(r.Context()), host, RejectRequestBody, http.StatusRequestEntityTooLarge, netip.Addr{})
+	h.sendError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+	metrics.RequestsTotal.WithLabelValues(r.Method, strconv.Itoa(http.StatusRequestEntityTooLarge)).Inc()
+}
+
+// isRequestTooLarge reports whether err comes from a request body over
+// max_request_body.
+func isRequestTooLarge(err error) bool {
+	var tooLarge *http.MaxBytesError
+	return errors.As(err, &tooLarge)
+}
+
+// responseTooLarge reports whether resp announces a body over
+// max_response_body, logging and counting it.
+func (h *Handler) responseTooLarge(resp *http.Response, host string, ip netip.Addr) bool {
+	limit := h.server.cfg.MaxResponseBody
+	if limit <= 0 || resp.ContentLength <= limit {
+		return false
+	}
+	logger.Warn("response_body_too_large", "host", host, "ip", ip, "content_length", resp.ContentLength, "limit", limit)
+	metrics.BodyLimitExceeded.WithLabelValues("response").Inc()
+	return true
+}
+
+// copyResponseBody copies the body of resp, received through ip for user, to
+// w within the bandwidth limits, up to max_response_body. Streamed bodies that
+// exceed it abort the response, so the client does not mistake the truncated
+// body for a complete one.
+func (h *Handler) copyResponseBody(w io.Writer, resp *http.Response, user, host string, ip netip.Addr) (int64, error) {
+	body := h.server.bandwidth.Throttle(user, ip.String()).Reader(resp.Body)
+	limit := h.server.cfg.MaxResponseBody
+	if limit <= 0 {
+		return io.Copy(w, body)
+	}
+	n, err := io.Copy(w, io.LimitReader(body, limit))
+	if err != nil || n < limit {
+		return n, err
+	}
+	if extra, _ := io.ReadFull(resp.Body, make([]byte, 1)); extra == 0 {
+		return n, nil
+	}
+	logger.Warn("response_body_too_large", "host", host, "ip", ip, "bytes", n, "limit", limit)
+	metrics.BodyLimitExceeded.WithLabelValues("response").Inc()
+	panic(http.ErrAbortHandler)
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestHandler_MaxRequestBody(t *testing.T) {
+	backend := newTestBackendWithHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.Copy(io.Discard, r.Body); err != nil {
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	defer backend.Close()
+
+	server := newTestServerWithIPs(t, []string{"127.0.0.1"})
+	server.cfg.MaxRequestBody = 10
+	server.rejections = NewRejectionLog(10)
+	handler := NewHandler(server)
+
+	tests := []struct {
+		name    string
+		body    string
+		chunked bool
+		want    int
+	}{
+		{"within the limit", "0123456789", false, http.StatusOK},
+		{"announced over the limit", "0123456789a", false, http.StatusRequestEntityTooLarge},
+		{"streamed over the limit", strings.Repeat("x", 100), true, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, backend.URL+"/", strings.NewReader(tt.body))
+			if tt.chunked {
+				req.Body = io.NopCloser(iotest.HalfReader(strings.NewReader(tt.body)))
+				req.ContentLength = -1
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			assertStatusCode(t, w, tt.want)
+		})
+	}
+
+	for _, r := range server.Rejections() {
+		if r.Reason != RejectRequestBody || r.Status != http.StatusRequestEntityTooLarge {
+			t.Errorf("rejection = %+v, want a request_body rejection", r)
+		}
+	}
+	if got := len(server.Rejections()); got != 2 {
+		t.Errorf("rejections = %d, want 2", got)
+	}
+}
+
+func TestServer_MaxResponseBody(t *testing.T) {
+	backend := newTestBackendWithHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		body := strings.Repeat("x", 100)
+		if r.URL.Path == "/streamed" {
+			// No Content-Length: the size is only known while copying
+			w.(http.Flusher).Flush()
+		} else {
+			w.Header().Set("Content-Length", "100")
+		}
+		io.WriteString(w, body)
+	})
+	defer backend.Close()
+
+	server := newTestServerWithIPs(t, []string{"127.0.0.1"})
+	server.cfg.MaxResponseBody = 50
+	addr := startProxy(t, server)
+	proxyURL, _ := url.Parse("http://" + addr)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	resp, err := client.Get(backend.URL + "/announced")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("announced status = %d, want 502", resp.StatusCode)
+	}
+
+	// The connection is aborted, before or after the headers depending on
+	// buffering
+	resp, err = client.Get(backend.URL + "/streamed")
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if body, err := io.ReadAll(resp.Body); err == nil {
+		t.Errorf("streamed body read %d bytes without error, want the response aborted", len(body))
+	}
+}
@@ -0,0 +1,27 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+
+	"github.com/cr0hn/outbound-lb/internal/balancer"
+	"github.com/cr0hn/outbound-lb/internal/logger"
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+)
+
+// AcquireClientConn takes one of the connections of the client of ctx, its
+// authenticated user or else its IP, for a request to host. It returns a
+// function giving the connection back, or limiter.ErrClientLimitReached after
+// recording the rejection.
+func (s *Server) AcquireClientConn(ctx context.Context, method, host string) (func(), error) {
+	client := balancer.ClientFromContext(ctx)
+	release, err := s.clients.Acquire(client)
+	if err != nil {
+		logger.Debug("client_limit_reached", "client", client, "max_conns", s.cfg.ClientMaxConns)
+		metrics.ClientLimitRejections.Inc()
+		s.Reject(method, client, host, RejectClientLimit, http.StatusTooManyRequests, netip.Addr{})
+		return nil, err
+	}
+	return release, nil
+}
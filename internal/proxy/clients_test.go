@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cr0hn/outbound-lb/internal/limiter"
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestHandler_ClientMaxConns(t *testing.T) {
+	backend := newTestBackendWithHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	defer backend.Close()
+
+	server := newTestServerWithIPs(t, []string{"127.0.0.1"})
+	server.clients = limiter.NewClients(1)
+	server.rejections = NewRejectionLog(10)
+	handler := NewHandler(server)
+
+	// The client already has its one connection open
+	release, err := server.clients.Acquire("192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := testutil.ToFloat64(metrics.ClientLimitRejections)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, backend.URL+"/", nil))
+	assertStatusCode(t, w, http.StatusTooManyRequests)
+
+	// Other clients are not affected
+	req := httptest.NewRequest(http.MethodGet, backend.URL+"/", nil)
+	req.RemoteAddr = "192.0.2.2:1234"
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assertStatusCode(t, w, http.StatusOK)
+
+	release()
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, backend.URL+"/", nil))
+	assertStatusCode(t, w, http.StatusOK)
+
+	if got := testutil.ToFloat64(metrics.ClientLimitRejections) - before; got != 1 {
+		t.Errorf("client limit rejections = %v, want 1", got)
+	}
+	rejections := server.Rejections()
+	if len(rejections) != 1 || rejections[0].Reason != RejectClientLimit || rejections[0].Client != "192.0.2.1" {
+		t.Errorf("rejections = %+v, want one client_limit rejection of 192.0.2.1", rejections)
+	}
+	if got := server.clients.Count("192.0.2.1"); got != 0 {
+		t.Errorf("open connections of 192.0.2.1 = %d, want 0 after the requests", got)
+	}
+}
@@ -2,15 +2,20 @@
 package proxy
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/netip"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/cr0hn/outbound-lb/internal/bandwidth"
 	"github.com/cr0hn/outbound-lb/internal/logger"
 	"github.com/cr0hn/outbound-lb/internal/metrics"
 )
@@ -27,8 +32,6 @@ func NewConnectHandler(server *Server) *ConnectHandler {
 
 // ServeHTTP handles a CONNECT request.
 func (h *ConnectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	start := time.Now()
-
 	// Get or generate request ID for tracing
 	requestID := RequestIDFromContext(r.Context())
 	if requestID == "" {
@@ -40,61 +43,28 @@ func (h *ConnectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		host = r.URL.Host
 	}
 
-	logger.Trace("connect_request_received", "request_id", requestID, "host", host, "remote", r.RemoteAddr)
+	sessionID := SessionIDFromContext(r.Context())
 
-	// Select outbound IP
-	logger.Trace("connect_ip_selection_start", "host", host)
-	ip, err := h.server.selectIP(host)
-	if err != nil {
-		logger.Trace("connect_ip_selection_failed", "host", host, "error", err)
-		http.Error(w, "No available outbound IPs", http.StatusServiceUnavailable)
-		metrics.LimitRejections.WithLabelValues("total").Inc()
-		return
-	}
-	logger.Trace("connect_ip_selected", "host", host, "ip", ip)
+	logger.Trace("connect_request_received", "request_id", requestID, "session_id", sessionID, "host", host, "remote", r.RemoteAddr)
 
-	// Acquire connection slot
-	logger.Trace("connect_acquire_attempt", "ip", ip)
-	if err := h.server.limiter.Acquire(ip); err != nil {
-		logger.Trace("connect_acquire_failed", "ip", ip, "error", err)
-		http.Error(w, "Connection limit reached", http.StatusServiceUnavailable)
-		metrics.LimitRejections.WithLabelValues("per_ip").Inc()
-		logger.LogConnectionLimit("per_ip", ip, int(h.server.limiter.GetIPCount(ip)), h.server.cfg.MaxConnsPerIP)
+	tun, err := h.server.OpenTunnel(r.Context(), http.MethodConnect, host)
+	if err != nil {
+		writeTunnelError(w, http.MethodConnect, host, err)
 		return
 	}
-	logger.Trace("connect_acquired", "ip", ip)
-	defer h.server.limiter.Release(ip)
-
-	// Update metrics
-	h.server.stats.IncActiveConnections()
-	h.server.stats.IncConnectionsForIP(ip)
-	defer func() {
-		h.server.stats.DecActiveConnections()
-		h.server.stats.DecConnectionsForIP(ip)
-	}()
-
-	// Record selection
-	h.server.balancer.Record(host, ip)
-	h.server.stats.IncSelectionsForIP(ip, host)
-	logger.LogBalancerSelection(host, ip, len(h.server.cfg.IPs))
-
-	metrics.TunnelConnections.Inc()
-
-	// Create dialer for this IP
-	dialer := NewDialer(ip, h.server.cfg.Timeout, h.server.cfg.IdleTimeout)
-
-	// Connect to target
-	logger.Trace("connect_dial_start", "host", host, "ip", ip)
-	targetConn, err := dialer.Dial("tcp", host)
-	if err != nil {
-		logger.Trace("connect_dial_failed", "host", host, "ip", ip, "error", err)
-		logger.LogError("connect_dial", err, "host", host, "ip", ip)
-		http.Error(w, "Failed to connect to target", http.StatusBadGateway)
-		metrics.RequestsTotal.WithLabelValues("CONNECT", "502").Inc()
+	defer tun.Close()
+
+	// HTTP/2 carries the tunnel in the CONNECT stream itself
+	if r.ProtoMajor == 2 {
+		h.server.echoEgress(r.Context(), w.Header(), tun.IP())
+		w.WriteHeader(http.StatusOK)
+		if err := http.NewResponseController(w).Flush(); err != nil {
+			logger.LogError("connect_response", err, "host", host)
+			return
+		}
+		tun.Relay(newStreamConn(w, r), r.RemoteAddr, requestID, sessionID)
 		return
 	}
-	logger.Trace("connect_dial_success", "host", host, "ip", ip, "local", targetConn.LocalAddr(), "remote", targetConn.RemoteAddr())
-	defer targetConn.Close()
 
 	// Hijack client connection
 	hijacker, ok := w.(http.Hijacker)
@@ -115,30 +85,78 @@ func (h *ConnectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	defer clientConn.Close()
 
 	// Send 200 Connection Established
-	_, err = clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
-	if err != nil {
+	header := make(http.Header)
+	h.server.echoEgress(r.Context(), header, tun.IP())
+	if err := writeEstablished(clientConn, header); err != nil {
 		logger.LogError("connect_response", err, "host", host)
 		return
 	}
 
-	// Bidirectional copy with idle timeout
-	bytesIn, bytesOut := h.tunnel(clientConn, targetConn, h.server.cfg.IdleTimeout)
+	tun.Relay(clientConn, r.RemoteAddr, requestID, sessionID)
+}
+
+// writeEstablished writes the 200 response to a CONNECT request, with
+// header.
+func writeEstablished(w io.Writer, header http.Header) error {
+	var b bytes.Buffer
+	b.WriteString("HTTP/1.1 200 Connection Established\r\n")
+	header.Write(&b)
+	b.WriteString("\r\n")
+	_, err := w.Write(b.Bytes())
+	return err
+}
 
-	// Log and record metrics
-	duration := time.Since(start).Milliseconds()
-	logger.LogRequest("CONNECT", host, r.RemoteAddr, ip, 200, duration, bytesIn, bytesOut)
+// writeTunnelError answers a request whose tunnel to host could not be
+// opened with the error returned by OpenTunnel.
+func writeTunnelError(w http.ResponseWriter, method, host string, err error) {
+	var upstreamErr *UpstreamError
+	switch {
+	case errors.As(err, &upstreamErr):
+		status := writeUpstreamError(w, host, upstreamErr.Err)
+		metrics.RequestsTotal.WithLabelValues(method, strconv.Itoa(status)).Inc()
+	case errors.Is(err, ErrConnectionLimit):
+		http.Error(w, "Connection limit reached", http.StatusServiceUnavailable)
+	default:
+		http.Error(w, "No available outbound IPs", http.StatusServiceUnavailable)
+	}
+}
 
-	h.server.stats.IncTotalRequests()
-	h.server.stats.AddBytesReceived(bytesIn)
-	h.server.stats.AddBytesSent(bytesOut)
+// dial connects to target, host itself or one of its failover targets,
+// through ip. IPs owned by an agent are reached through a tunnel opened by
+// that agent. Connections to hosts with a PROXY protocol rule start with a
+// header announcing the client address from ctx.
+func (h *ConnectHandler) dial(ctx context.Context, host, target string, ip netip.Addr) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	logger.Trace("connect_dial_start", "host", target, "ip", ip)
+	if upstream := h.server.transportPool.Upstream(ip); upstream != nil {
+		conn, err = dialAgent(context.Background(), upstream, ip, target, h.server.Timeout())
+	} else {
+		dialer := NewDialer(ip, h.server.Timeout(), h.server.IdleTimeout())
+		dialer.keepAlive = h.server.transportPool.Tuning().KeepAlive
+		dialer.resolver = h.server.resolvers.For(ip)
+		dialer.control = h.server.transportPool.socketControl(ip)
+		// The dial keeps the destination address check of ctx but not its
+		// cancellation
+		conn, err = dialer.DialContext(context.WithoutCancel(ctx), "tcp", target)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	metrics.RequestsTotal.WithLabelValues("CONNECT", "200").Inc()
-	metrics.RequestDuration.WithLabelValues("CONNECT").Observe(time.Since(start).Seconds())
+	if version := h.server.proxyHeaderVersion(host, ip); version != 0 {
+		if err := writeProxyHeader(conn, version, ClientAddrFromContext(ctx)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
 }
 
 // tunnel performs bidirectional copy between two connections with idle timeout.
-// The timeout is reset on each successful read/write operation.
-func (h *ConnectHandler) tunnel(client, target net.Conn, idleTimeout time.Duration) (bytesIn, bytesOut int64) {
+// The timeout is reset on each successful read/write operation. Both
+// directions are paced by throttle, if not nil.
+func (h *ConnectHandler) tunnel(client, target net.Conn, idleTimeout time.Duration, throttle *bandwidth.Throttle) (bytesIn, bytesOut int64) {
 	var wg sync.WaitGroup
 	var in, out atomic.Int64
 	wg.Add(2)
@@ -153,30 +171,30 @@ func (h *ConnectHandler) tunnel(client, target net.Conn, idleTimeout time.Durati
 	// Client -> Target
 	go func() {
 		defer wg.Done()
-		n, err := copyWithIdleTimeout(target, client, idleTimeout)
+		n, err := copyWithIdleTimeout(target, client, idleTimeout, throttle)
 		if err != nil && !errors.Is(err, net.ErrClosed) && !isTimeoutError(err) {
 			logger.LogError("tunnel_client_to_target", err)
 		}
 		in.Store(n)
 		logger.Trace("tunnel_transfer_complete", "direction", "client_to_target", "bytes", n)
 		// Signal EOF to target
-		if tc, ok := target.(*net.TCPConn); ok {
-			tc.CloseWrite()
+		if cw, ok := target.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
 		}
 	}()
 
 	// Target -> Client
 	go func() {
 		defer wg.Done()
-		n, err := copyWithIdleTimeout(client, target, idleTimeout)
+		n, err := copyWithIdleTimeout(client, target, idleTimeout, throttle)
 		if err != nil && !errors.Is(err, net.ErrClosed) && !isTimeoutError(err) {
 			logger.LogError("tunnel_target_to_client", err)
 		}
 		out.Store(n)
 		logger.Trace("tunnel_transfer_complete", "direction", "target_to_client", "bytes", n)
 		// Signal EOF to client
-		if tc, ok := client.(*net.TCPConn); ok {
-			tc.CloseWrite()
+		if cw, ok := client.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
 		}
 	}()
 
@@ -186,8 +204,10 @@ func (h *ConnectHandler) tunnel(client, target net.Conn, idleTimeout time.Durati
 }
 
 // copyWithIdleTimeout copies from src to dst, resetting the deadline after each successful read.
-func copyWithIdleTimeout(dst, src net.Conn, idleTimeout time.Duration) (int64, error) {
-	buf := make([]byte, 32*1024) // 32KB buffer
+// Reads are paced by throttle, if not nil.
+func copyWithIdleTimeout(dst, src net.Conn, idleTimeout time.Duration, throttle *bandwidth.Throttle) (int64, error) {
+	// 32KB buffer, smaller for slow rates so that waits stay short
+	buf := make([]byte, throttle.Chunk(32*1024))
 	var total int64
 
 	for {
@@ -196,6 +216,8 @@ func copyWithIdleTimeout(dst, src net.Conn, idleTimeout time.Duration) (int64, e
 
 		n, readErr := src.Read(buf)
 		if n > 0 {
+			throttle.Wait(n)
+
 			// Reset write deadline on successful read
 			dst.SetWriteDeadline(time.Now().Add(idleTimeout))
 
@@ -9,6 +9,7 @@ import (
 	"github.com/cr0hn/outbound-lb/internal/config"
 	"github.com/cr0hn/outbound-lb/internal/limiter"
 	"github.com/cr0hn/outbound-lb/internal/metrics"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
 )
 
 func newTestServerForConnect(t *testing.T) *Server {
@@ -27,10 +28,10 @@ func newTestServerForConnect(t *testing.T) *Server {
 		LogFormat:     "json",
 	}
 
-	stats := metrics.NewStatsCollector(cfg.IPs)
-	lim := limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, cfg.IPs)
+	stats := metrics.NewStatsCollector(netutil.MustParseAddrs(cfg.IPs))
+	lim := limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, netutil.MustParseAddrs(cfg.IPs))
 	balCfg := balancer.Config{
-		IPs:           cfg.IPs,
+		IPs:           netutil.MustParseAddrs(cfg.IPs),
 		HistoryWindow: int64(cfg.HistoryWindow.Seconds()),
 		HistorySize:   cfg.HistorySize,
 		Limiter:       lim,
@@ -82,7 +83,7 @@ func TestConnectHandler_tunnel(t *testing.T) {
 
 	// Run tunnel - clientRead is the "client" conn, targetRead is the "target" conn
 	// This is a simplified test that verifies the function doesn't panic
-	bytesIn, bytesOut := handler.tunnel(clientRead, targetRead, 60*time.Second)
+	bytesIn, bytesOut := handler.tunnel(clientRead, targetRead, 60*time.Second, nil)
 
 	clientRead.Close()
 	targetRead.Close()
@@ -111,7 +112,7 @@ func TestConnectHandler_tunnel_EmptyData(t *testing.T) {
 	}()
 
 	// Run tunnel
-	bytesIn, bytesOut := handler.tunnel(clientRead, targetRead, 60*time.Second)
+	bytesIn, bytesOut := handler.tunnel(clientRead, targetRead, 60*time.Second, nil)
 
 	clientRead.Close()
 	targetRead.Close()
@@ -155,7 +156,7 @@ func TestConnectHandler_tunnel_ConcurrentRaceDetection(t *testing.T) {
 			// Run tunnel in goroutine
 			go func() {
 				defer close(done)
-				bytesIn, bytesOut := handler.tunnel(clientRead, targetRead, 60*time.Second)
+				bytesIn, bytesOut := handler.tunnel(clientRead, targetRead, 60*time.Second, nil)
 				// Verify bytes were transferred (values should match atomic operations)
 				if bytesIn < 0 || bytesOut < 0 {
 					t.Errorf("invalid byte counts: in=%d, out=%d", bytesIn, bytesOut)
@@ -211,7 +212,7 @@ func TestConnectHandler_tunnel_BidirectionalTransfer(t *testing.T) {
 
 	go func() {
 		defer close(done)
-		bytesIn, bytesOut = handler.tunnel(clientConn, targetConn, 60*time.Second)
+		bytesIn, bytesOut = handler.tunnel(clientConn, targetConn, 60*time.Second, nil)
 	}()
 
 	select {
@@ -0,0 +1,257 @@
+// Package proxy provides the HTTP/HTTPS proxy server.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/cr0hn/outbound-lb/internal/config"
+	"github.com/cr0hn/outbound-lb/internal/dns"
+	"github.com/cr0hn/outbound-lb/internal/logger"
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
+)
+
+// Destination denial reasons, used as metric labels.
+const (
+	// DenyRule means a deny destination rule matched.
+	DenyRule = "rule"
+	// DenyPrivate means the destination is in a non-public address range.
+	DenyPrivate = "private"
+	// DenyConnectPort means a CONNECT request targeted a port not in
+	// connect_allowed_ports.
+	DenyConnectPort = "connect_port"
+)
+
+// nonPublicPrefixes are the ranges blocked by default besides loopback,
+// private, link-local and unspecified addresses.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),     // "this network"
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT, also used by some metadata services
+	netip.MustParsePrefix("192.0.0.0/24"),  // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"), // benchmarking
+}
+
+// isNonPublic reports whether addr is in a range that is never a public
+// internet destination.
+func isNonPublic(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() {
+		return true
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowDestination reports whether clients may reach hostport. Denied
+// requests are counted and recorded as rejections of client. Allowed requests
+// must be sent with the returned context, whose dials check the addresses
+// they connect to against the policy again.
+func (s *Server) AllowDestination(ctx context.Context, method, client, hostport string) (context.Context, bool) {
+	reason := s.destinations.Check(ctx, hostport)
+	if reason == "" {
+		return s.destinations.withDialCheck(ctx), true
+	}
+	metrics.DestinationDenied.WithLabelValues(reason).Inc()
+	s.Reject(method, client, hostport, RejectDestination, http.StatusForbidden, netip.Addr{})
+	return ctx, false
+}
+
+// DeniedAddrError is returned when dialing a destination that resolved to an
+// address the destination policy denies.
+type DeniedAddrError struct {
+	// Host is the destination host.
+	Host string
+	// Addr is the denied address and port.
+	Addr netip.AddrPort
+	// Reason is DenyRule or DenyPrivate.
+	Reason string
+}
+
+func (e *DeniedAddrError) Error() string {
+	return "destination " + e.Host + " resolved to denied address " + e.Addr.String() + " (" + e.Reason + ")"
+}
+
+// isDeniedAddr reports whether err is a DeniedAddrError.
+func isDeniedAddr(err error) bool {
+	var denied *DeniedAddrError
+	return errors.As(err, &denied)
+}
+
+// AllowConnectPort reports whether tunnels opened with method, CONNECT or
+// SOCKS5, may target the port of hostport. Denied requests are counted and
+// recorded as rejections of client.
+func (s *Server) AllowConnectPort(method, client, hostport string) bool {
+	if len(s.connectPorts) == 0 {
+		return true
+	}
+	if _, portStr, err := net.SplitHostPort(hostport); err == nil {
+		port, _ := strconv.Atoi(portStr)
+		if slices.ContainsFunc(s.connectPorts, func(r netutil.PortRange) bool { return r.Contains(port) }) {
+			return true
+		}
+	}
+	metrics.DestinationDenied.WithLabelValues(DenyConnectPort).Inc()
+	s.Reject(method, client, hostport, RejectDestination, http.StatusForbidden, netip.Addr{})
+	return false
+}
+
+// destinationRule is a config.DestinationRule with its matchers prepared.
+type destinationRule struct {
+	allow bool
+	host  netutil.HostPattern
+	cidr  netip.Prefix // invalid when unset
+	ports []int
+}
+
+// DestinationPolicy decides which destinations clients may reach.
+type DestinationPolicy struct {
+	rules        []destinationRule
+	blockPrivate bool
+	resolve      resolveFunc
+}
+
+// NewDestinationPolicy creates a DestinationPolicy from the configured rules.
+// With blockPrivate set, destinations in non-public address ranges are denied
+// unless a rule allows them. Invalid rules are skipped (Config.Validate
+// rejects them).
+func NewDestinationPolicy(rules []config.DestinationRule, blockPrivate bool) *DestinationPolicy {
+	p := &DestinationPolicy{
+		rules:        make([]destinationRule, 0, len(rules)),
+		blockPrivate: blockPrivate,
+		resolve: func(ctx context.Context, host string) ([]netip.Addr, error) {
+			return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		},
+	}
+	for i, rule := range rules {
+		host, err := netutil.CompileHostPattern(rule.Host, "")
+		if err != nil {
+			logger.Warn("destination_rule_invalid", "index", i, "error", err)
+			continue
+		}
+		compiled := destinationRule{
+			allow: rule.Action == "allow",
+			host:  host,
+			ports: rule.Ports,
+		}
+		if rule.CIDR != "" {
+			prefix, err := netutil.ParsePrefix(rule.CIDR)
+			if err != nil {
+				logger.Warn("destination_rule_invalid", "index", i, "error", err)
+				continue
+			}
+			compiled.cidr = prefix
+		}
+		p.rules = append(p.rules, compiled)
+	}
+	return p
+}
+
+// withDialCheck returns a context whose dials only connect to addresses the
+// policy allows. Check resolves the destination before the outbound IP is
+// chosen; a nameserver answering with a public address then, and a private
+// one when the transport resolves the host again (DNS rebinding), would
+// otherwise get the connection through. Dials resolve once, check the
+// addresses and connect to them as literals.
+func (p *DestinationPolicy) withDialCheck(ctx context.Context) context.Context {
+	if p == nil || !p.needsAddrs() {
+		return ctx
+	}
+	return dns.ContextWithAddrCheck(ctx, p.checkAddr)
+}
+
+// checkAddr refuses to dial addr, an address host resolved to, if the policy
+// denies it.
+func (p *DestinationPolicy) checkAddr(host string, addr netip.AddrPort) error {
+	reason := p.decide(strings.ToLower(host), int(addr.Port()), addr.Addr().Unmap())
+	if reason == "" {
+		return nil
+	}
+	metrics.DestinationDenied.WithLabelValues(reason).Inc()
+	logger.Warn("destination_address_denied", "host", host, "addr", addr, "reason", reason)
+	return &DeniedAddrError{Host: host, Addr: addr, Reason: reason}
+}
+
+// needsAddrs reports whether checking a destination needs its addresses.
+func (p *DestinationPolicy) needsAddrs() bool {
+	return p.blockPrivate || slices.ContainsFunc(p.rules, func(r destinationRule) bool { return r.cidr.IsValid() })
+}
+
+// Check returns why clients may not reach hostport (DenyRule or DenyPrivate),
+// or "" if they may. Host names are resolved and every address they resolve
+// to must be allowed. Hosts that cannot be resolved are left to fail on dial.
+func (p *DestinationPolicy) Check(ctx context.Context, hostport string) string {
+	if p == nil || (len(p.rules) == 0 && !p.blockPrivate) {
+		return ""
+	}
+
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	port, _ := strconv.Atoi(portStr)
+
+	var addrs []netip.Addr
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addrs = []netip.Addr{addr.Unmap()}
+	} else if p.needsAddrs() {
+		addrs, err = p.resolve(ctx, host)
+		if err != nil {
+			logger.Debug("destination_resolve_failed", "host", host, "error", err)
+		}
+	}
+
+	if len(addrs) == 0 {
+		return p.decide(host, port, netip.Addr{})
+	}
+	for _, addr := range addrs {
+		if reason := p.decide(host, port, addr.Unmap()); reason != "" {
+			return reason
+		}
+	}
+	return ""
+}
+
+// decide applies the rules to one address of the destination (invalid when
+// unknown), falling back to the non-public range check.
+func (p *DestinationPolicy) decide(host string, port int, addr netip.Addr) string {
+	for _, rule := range p.rules {
+		if !rule.matches(host, port, addr) {
+			continue
+		}
+		if rule.allow {
+			return ""
+		}
+		return DenyRule
+	}
+	if p.blockPrivate && addr.IsValid() && isNonPublic(addr) {
+		return DenyPrivate
+	}
+	return ""
+}
+
+// matches reports whether every condition of the rule holds.
+func (r destinationRule) matches(host string, port int, addr netip.Addr) bool {
+	if len(r.ports) > 0 && !slices.Contains(r.ports, port) {
+		return false
+	}
+	if !r.host.Match(host) {
+		return false
+	}
+	if r.cidr.IsValid() && (!addr.IsValid() || !r.cidr.Contains(addr)) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cr0hn/outbound-lb/internal/config"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
+)
+
+func TestDestinationPolicy_Check(t *testing.T) {
+	p := NewDestinationPolicy([]config.DestinationRule{
+		{Action: "allow", Host: "*.internal.example.com", Ports: []int{443}},
+		{Action: "allow", CIDR: "10.1.0.0/16"},
+		{Action: "deny", Host: "*.blocked.example"},
+		{Action: "deny", Ports: []int{25}},
+	}, true)
+	p.resolve = func(ctx context.Context, host string) ([]netip.Addr, error) {
+		switch host {
+		case "api.internal.example.com":
+			return []netip.Addr{netip.MustParseAddr("10.2.0.5")}, nil
+		case "rebind.example.com":
+			return []netip.Addr{netip.MustParseAddr("93.184.216.34"), netip.MustParseAddr("169.254.169.254")}, nil
+		case "svc.example.com":
+			return []netip.Addr{netip.MustParseAddr("10.1.2.3")}, nil
+		}
+		return []netip.Addr{netip.MustParseAddr("93.184.216.34")}, nil
+	}
+
+	tests := []struct {
+		hostport string
+		want     string
+	}{
+		{"example.com:443", ""},
+		{"93.184.216.34:80", ""},
+		{"127.0.0.1:8080", DenyPrivate},
+		{"[::1]:8080", DenyPrivate},
+		{"169.254.169.254:80", DenyPrivate},
+		{"[::ffff:192.168.1.1]:80", DenyPrivate},
+		{"100.100.100.200:80", DenyPrivate},
+		{"rebind.example.com:80", DenyPrivate},
+		{"api.internal.example.com:443", ""},
+		{"api.internal.example.com:80", DenyPrivate},
+		{"svc.example.com:8080", ""},
+		{"x.blocked.example:443", DenyRule},
+		{"example.com:25", DenyRule},
+	}
+	for _, tt := range tests {
+		if got := p.Check(context.Background(), tt.hostport); got != tt.want {
+			t.Errorf("Check(%q) = %q, want %q", tt.hostport, got, tt.want)
+		}
+	}
+
+	var open *DestinationPolicy
+	if got := open.Check(context.Background(), "127.0.0.1:80"); got != "" {
+		t.Errorf("nil policy Check() = %q, want allowed", got)
+	}
+}
+
+func TestServer_DestinationDenied(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	s := newTestServerWithOptions(t, DefaultTestServerOptions())
+	s.destinations = NewDestinationPolicy(nil, true)
+	proxyAddr := startProxy(t, s)
+
+	target := backend.Listener.Addr().String()
+	requests := map[string]string{
+		"GET":     fmt.Sprintf("GET %s/ HTTP/1.1\r\nHost: %s\r\n\r\n", backend.URL, target),
+		"CONNECT": fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target),
+	}
+	for method, req := range requests {
+		conn, err := net.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprint(conn, req)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s to loopback: status = %d, want 403", method, resp.StatusCode)
+		}
+	}
+
+	if got := s.Rejections(); len(got) != 2 || got[0].Reason != RejectDestination {
+		t.Errorf("rejections = %+v, want 2 destination rejections", got)
+	}
+}
+
+func TestServer_ConnectAllowedPorts(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	target := backend.Listener.Addr().String()
+	_, portStr, _ := net.SplitHostPort(target)
+	port, _ := strconv.Atoi(portStr)
+
+	s := newTestServerWithOptions(t, DefaultTestServerOptions())
+	proxyAddr := startProxy(t, s)
+
+	connect := func() int {
+		conn, err := net.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	s.connectPorts = []netutil.PortRange{{Low: 443, High: 443}}
+	if got := connect(); got != http.StatusForbidden {
+		t.Errorf("CONNECT to port %d with only 443 allowed: status = %d, want 403", port, got)
+	}
+
+	s.connectPorts = append(s.connectPorts, netutil.PortRange{Low: uint16(port), High: uint16(port)})
+	if got := connect(); got != http.StatusOK {
+		t.Errorf("CONNECT to allowed port %d: status = %d, want 200", port, got)
+	}
+}
+
+func TestServer_DestinationRebinding(t *testing.T) {
+	var hits atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer backend.Close()
+	_, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+	target := net.JoinHostPort("localhost", port)
+
+	// The policy check sees a public address; the dial resolves localhost
+	// to loopback, as a rebinding nameserver would answer the second query
+	s := newTestServerWithOptions(t, DefaultTestServerOptions())
+	s.destinations = NewDestinationPolicy(nil, true)
+	s.destinations.resolve = func(ctx context.Context, host string) ([]netip.Addr, error) {
+		return []netip.Addr{netip.MustParseAddr("203.0.113.10")}, nil
+	}
+	proxyAddr := startProxy(t, s)
+
+	requests := map[string]string{
+		"GET":     fmt.Sprintf("GET http://%s/ HTTP/1.1\r\nHost: %s\r\n\r\n", target, target),
+		"CONNECT": fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target),
+	}
+	for method, req := range requests {
+		conn, err := net.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprint(conn, req)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusForbidden || resp.Header.Get(ErrorClassHeader) != ErrorClassDestinationDenied {
+			t.Errorf("%s to a host rebound to loopback: status = %d, class = %q, want 403 %s",
+				method, resp.StatusCode, resp.Header.Get(ErrorClassHeader), ErrorClassDestinationDenied)
+		}
+	}
+	if n := hits.Load(); n != 0 {
+		t.Errorf("backend got %d requests, want none", n)
+	}
+}
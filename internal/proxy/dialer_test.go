@@ -3,6 +3,7 @@ package proxy
 import (
 	"context"
 	"net"
+	"net/netip"
 	"testing"
 	"time"
 )
@@ -22,7 +23,7 @@ func TestDialer_Dial(t *testing.T) {
 		}
 	}()
 
-	d := NewDialer("127.0.0.1", 5*time.Second, 10*time.Second)
+	d := NewDialer(netip.MustParseAddr("127.0.0.1"), 5*time.Second, 10*time.Second)
 
 	conn, err := d.Dial("tcp", listener.Addr().String())
 	if err != nil {
@@ -46,7 +47,7 @@ func TestDialer_DialContext(t *testing.T) {
 		}
 	}()
 
-	d := NewDialer("127.0.0.1", 5*time.Second, 10*time.Second)
+	d := NewDialer(netip.MustParseAddr("127.0.0.1"), 5*time.Second, 10*time.Second)
 
 	ctx := context.Background()
 	conn, err := d.DialContext(ctx, "tcp", listener.Addr().String())
@@ -57,7 +58,7 @@ func TestDialer_DialContext(t *testing.T) {
 }
 
 func TestDialer_DialContext_Timeout(t *testing.T) {
-	d := NewDialer("127.0.0.1", 100*time.Millisecond, 10*time.Second)
+	d := NewDialer(netip.MustParseAddr("127.0.0.1"), 100*time.Millisecond, 10*time.Second)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
 	defer cancel()
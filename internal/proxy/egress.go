@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+	"slices"
+
+	"github.com/cr0hn/outbound-lb/internal/balancer"
+	"github.com/cr0hn/outbound-lb/internal/config"
+	"github.com/cr0hn/outbound-lb/internal/logger"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
+)
+
+// Headers letting trusted clients choose the egress of their requests. They
+// are never forwarded upstream.
+const (
+	// EgressIPHeader names the outbound IP a request must go through. The
+	// outbound IP used is echoed back in it whenever the client chose.
+	EgressIPHeader = "X-Outbound-IP"
+	// EgressPoolHeader names the pool a request must go through.
+	EgressPoolHeader = "X-Outbound-Pool"
+)
+
+// ExposedEgressHeader carries the outbound IP used in every response when
+// expose_egress_header is set.
+const ExposedEgressHeader = "X-Egress-IP"
+
+// egressChosenKey is the context key marking requests whose client chose the
+// egress.
+type egressChosenKey struct{}
+
+// chooseEgress restricts selection for r to the outbound IP or pool named in
+// its egress headers, if its client may choose, and removes the headers.
+// Headers of other clients are ignored. It returns the status and message to
+// answer with when the choice is unknown or outside the user's rule.
+func (s *Server) chooseEgress(r *http.Request) (context.Context, int, string) {
+	ctx := r.Context()
+	ip, pool := r.Header.Get(EgressIPHeader), r.Header.Get(EgressPoolHeader)
+	r.Header.Del(EgressIPHeader)
+	r.Header.Del(EgressPoolHeader)
+	if ip == "" && pool == "" {
+		return ctx, 0, ""
+	}
+	rule := s.userRules[requestUser(ctx)]
+	if !rule.SelectEgress && !s.egressTrusted(r.RemoteAddr) {
+		logger.Debug("egress_choice_ignored", "remote", r.RemoteAddr, "ip", ip, "pool", pool)
+		return ctx, 0, ""
+	}
+
+	switch {
+	case ip != "" && pool != "":
+		return ctx, http.StatusBadRequest, "Only one of " + EgressIPHeader + " and " + EgressPoolHeader + " may be set"
+	case ip != "":
+		known, ok := s.outboundIP(ip)
+		if !ok {
+			return ctx, http.StatusBadRequest, "Unknown outbound IP"
+		}
+		if !s.ruleAllowsIP(rule, known) {
+			return ctx, http.StatusForbidden, "Outbound IP not allowed"
+		}
+		ctx = balancer.ContextWithRequiredIP(ctx, known)
+	default:
+		if _, ok := s.pools[pool]; !ok {
+			return ctx, http.StatusBadRequest, "Unknown outbound pool"
+		}
+		if rule.IP != "" || (rule.Pool != "" && rule.Pool != pool) {
+			return ctx, http.StatusForbidden, "Outbound pool not allowed"
+		}
+		ctx = balancer.ContextWithPool(ctx, pool)
+	}
+	return context.WithValue(ctx, egressChosenKey{}, true), 0, ""
+}
+
+// egressTrusted reports whether the client at remoteAddr may choose the
+// egress of its requests.
+func (s *Server) egressTrusted(remoteAddr string) bool {
+	ip, err := netutil.HostAddr(remoteAddr)
+	if err != nil {
+		return false
+	}
+	for _, prefix := range s.egressSelectTrusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// outboundIP returns the outbound IP ip names, if it is one.
+func (s *Server) outboundIP(ip string) (netip.Addr, bool) {
+	addr, err := netutil.ParseAddr(ip)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	s.ipsMu.Lock()
+	defer s.ipsMu.Unlock()
+	return addr, slices.Contains(s.ips, addr)
+}
+
+// ruleAllowsIP reports whether a user under rule may go through ip.
+func (s *Server) ruleAllowsIP(rule config.UserRule, ip netip.Addr) bool {
+	switch {
+	case rule.IP != "":
+		return s.userIPs[rule.Name] == ip
+	case rule.Pool != "":
+		return slices.Contains(s.pools[rule.Pool], ip)
+	}
+	return true
+}
+
+// echoEgress sets the egress headers of a response to ip, the outbound IP
+// used: the exposed egress header if enabled, and the egress IP header if
+// the client chose the egress.
+func (s *Server) echoEgress(ctx context.Context, header http.Header, ip netip.Addr) {
+	if s.cfg.ExposeEgressHeader {
+		header.Set(ExposedEgressHeader, ip.String())
+	}
+	if chosen, _ := ctx.Value(egressChosenKey{}).(bool); chosen {
+		header.Set(EgressIPHeader, ip.String())
+	}
+}
@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/cr0hn/outbound-lb/internal/balancer"
+	"github.com/cr0hn/outbound-lb/internal/config"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
+)
+
+func TestHandler_ChooseEgress(t *testing.T) {
+	sources := make(chan string, 1)
+	backend := newTestBackendWithHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(EgressIPHeader) != "" || r.Header.Get(EgressPoolHeader) != "" {
+			t.Error("egress header forwarded upstream")
+		}
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		sources <- host
+		w.WriteHeader(http.StatusOK)
+	})
+	defer backend.Close()
+
+	ips := []string{"127.0.0.1", "127.0.0.2"}
+	server := newTestServerWithIPs(t, ips)
+	server.cfg.Pools = map[string][]string{"second": {"127.0.0.2"}}
+	server.setPools(server.cfg.Pools)
+	router, err := balancer.NewRouter(server.cfg.Pools, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.balancer = balancer.New(balancer.Config{IPs: netutil.MustParseAddrs(ips), HistoryWindow: 300, HistorySize: 100, Limiter: server.limiter, Router: router})
+	server.egressSelectTrusted = []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}
+	handler := NewHandler(server)
+
+	tests := []struct {
+		name   string
+		remote string
+		ip     string
+		pool   string
+		want   int
+		source string // outbound IP the backend sees, "" for any
+		echo   string
+	}{
+		{"ip", "192.0.2.1:1000", "127.0.0.2", "", http.StatusOK, "127.0.0.2", "127.0.0.2"},
+		{"pool", "192.0.2.1:1000", "", "second", http.StatusOK, "127.0.0.2", "127.0.0.2"},
+		{"untrusted client", "198.51.100.1:1000", "127.0.0.2", "", http.StatusOK, "", ""},
+		{"unknown ip", "192.0.2.1:1000", "10.9.9.9", "", http.StatusBadRequest, "", ""},
+		{"unknown pool", "192.0.2.1:1000", "", "missing", http.StatusBadRequest, "", ""},
+		{"ip and pool", "192.0.2.1:1000", "127.0.0.2", "second", http.StatusBadRequest, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newTestRequest(t, http.MethodGet, backend.URL+"/")
+			req.RemoteAddr = tt.remote
+			if tt.ip != "" {
+				req.Header.Set(EgressIPHeader, tt.ip)
+			}
+			if tt.pool != "" {
+				req.Header.Set(EgressPoolHeader, tt.pool)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			assertStatusCode(t, w, tt.want)
+			if got := w.Header().Get(EgressIPHeader); got != tt.echo {
+				t.Errorf("%s = %q, want %q", EgressIPHeader, got, tt.echo)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			if got := <-sources; tt.source != "" && got != tt.source {
+				t.Errorf("backend saw %s, want %s", got, tt.source)
+			}
+		})
+	}
+}
+
+func TestServer_ExposeEgressHeader(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.Close()
+
+	server := newTestServerWithIPs(t, []string{"127.0.0.1"})
+	server.cfg.ExposeEgressHeader = true
+	addr := startProxy(t, server)
+
+	// Proxied responses
+	w := httptest.NewRecorder()
+	NewHandler(server).ServeHTTP(w, newTestRequest(t, http.MethodGet, backend.URL+"/"))
+	assertStatusCode(t, w, http.StatusOK)
+	if got := w.Header().Get(ExposedEgressHeader); got != "127.0.0.1" {
+		t.Errorf("%s = %q, want 127.0.0.1", ExposedEgressHeader, got)
+	}
+	if got := w.Header().Get(EgressIPHeader); got != "" {
+		t.Errorf("%s = %q for a request without a choice", EgressIPHeader, got)
+	}
+
+	// The CONNECT 200 response
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	target := backend.Listener.Addr().String()
+	if _, err := conn.Write([]byte("CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT status = %d, want 200", resp.StatusCode)
+	}
+	if got := resp.Header.Get(ExposedEgressHeader); got != "127.0.0.1" {
+		t.Errorf("CONNECT %s = %q, want 127.0.0.1", ExposedEgressHeader, got)
+	}
+}
+
+func TestServer_ChooseEgress_UserRule(t *testing.T) {
+	server := newTestServerWithIPs(t, []string{"127.0.0.1", "127.0.0.2", "127.0.0.3"})
+	server.cfg.Pools = map[string][]string{
+		"residential": {"127.0.0.1", "127.0.0.2"},
+		"datacenter":  {"127.0.0.3"},
+	}
+	server.setPools(server.cfg.Pools)
+	server.setUserRules([]config.UserRule{
+		{Name: "tenant-a", Pool: "residential", SelectEgress: true},
+		{Name: "tenant-b"},
+	})
+
+	tests := []struct {
+		name   string
+		user   string
+		header string
+		value  string
+		want   int
+	}{
+		{"ip in own pool", "tenant-a", EgressIPHeader, "127.0.0.2", 0},
+		{"ip outside own pool", "tenant-a", EgressIPHeader, "127.0.0.3", http.StatusForbidden},
+		{"own pool", "tenant-a", EgressPoolHeader, "residential", 0},
+		{"other pool", "tenant-a", EgressPoolHeader, "datacenter", http.StatusForbidden},
+		{"user not allowed to choose", "tenant-b", EgressIPHeader, "127.0.0.3", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			req = req.WithContext(balancer.ContextWithClient(context.Background(), "user:"+tt.user))
+			req.Header.Set(tt.header, tt.value)
+			ctx, status, _ := server.chooseEgress(req)
+			if status != tt.want {
+				t.Errorf("status = %d, want %d", status, tt.want)
+			}
+			if req.Header.Get(tt.header) != "" {
+				t.Error("egress header not removed")
+			}
+			chosen := balancer.RequiredIPFromContext(ctx).IsValid() || balancer.PoolFromContext(ctx) != ""
+			if chosen != (tt.want == 0 && tt.user == "tenant-a") {
+				t.Errorf("choice applied = %v", chosen)
+			}
+		})
+	}
+}
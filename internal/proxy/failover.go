@@ -0,0 +1,98 @@
+// Package proxy provides the HTTP/HTTPS proxy server.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/cr0hn/outbound-lb/internal/config"
+	"github.com/cr0hn/outbound-lb/internal/logger"
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+)
+
+// FailoverTable resolves the ordered list of upstream targets for a destination.
+type FailoverTable struct {
+	rules map[string][]string
+}
+
+// NewFailoverTable creates a FailoverTable from the configured rules.
+func NewFailoverTable(rules []config.FailoverRule) *FailoverTable {
+	ft := &FailoverTable{
+		rules: make(map[string][]string, len(rules)),
+	}
+	for _, rule := range rules {
+		host := strings.ToLower(rule.Host)
+		ft.rules[host] = append(ft.rules[host], rule.Fallbacks...)
+	}
+	return ft
+}
+
+// Targets returns the targets to try for hostport, starting with hostport itself.
+// Fallbacks without a port inherit the port of the original target.
+func (ft *FailoverTable) Targets(hostport string) []string {
+	if ft == nil || len(ft.rules) == 0 {
+		return []string{hostport}
+	}
+
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, port = hostport, ""
+	}
+
+	fallbacks := ft.rules[strings.ToLower(host)]
+	if len(fallbacks) == 0 {
+		return []string{hostport}
+	}
+
+	targets := make([]string, 0, len(fallbacks)+1)
+	targets = append(targets, hostport)
+	for _, fb := range fallbacks {
+		if _, _, err := net.SplitHostPort(fb); err != nil && port != "" {
+			fb = net.JoinHostPort(fb, port)
+		}
+		targets = append(targets, fb)
+	}
+	return targets
+}
+
+// failoverTargetKey is the context key of the failover target a request is
+// sent to instead of its host.
+type failoverTargetKey struct{}
+
+// withFailoverTarget returns a context sending requests to target instead of
+// their host.
+func withFailoverTarget(ctx context.Context, target string) context.Context {
+	return context.WithValue(ctx, failoverTargetKey{}, target)
+}
+
+// failoverTarget returns the target set by withFailoverTarget, or "".
+func failoverTarget(ctx context.Context) string {
+	target, _ := ctx.Value(failoverTargetKey{}).(string)
+	return target
+}
+
+// allowFailover reports whether requests to host may fail over to target
+// ("host:port"). Fallbacks go through the destination policy like the host
+// itself, so that a failover rule cannot reach a denied destination.
+func (s *Server) allowFailover(ctx context.Context, host, target string) bool {
+	reason := s.destinations.Check(ctx, target)
+	if reason == "" {
+		return true
+	}
+	metrics.DestinationDenied.WithLabelValues(reason).Inc()
+	logger.Warn("upstream_failover_denied", "host", host, "target", target, "reason", reason)
+	return false
+}
+
+// isDialError reports whether err happened while establishing the upstream
+// connection, i.e. before any part of the request was sent.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return opErr.Op == "dial"
+	}
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr)
+}
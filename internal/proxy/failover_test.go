@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/cr0hn/outbound-lb/internal/config"
+)
+
+func TestFailoverTable_Targets(t *testing.T) {
+	ft := NewFailoverTable([]config.FailoverRule{
+		{Host: "API.example.com", Fallbacks: []string{"api-eu.example.com", "api-us.example.com:8443"}},
+	})
+
+	tests := []struct {
+		name     string
+		hostport string
+		want     []string
+	}{
+		{"no rule", "other.example.com:443", []string{"other.example.com:443"}},
+		{"inherits port", "api.example.com:443", []string{"api.example.com:443", "api-eu.example.com:443", "api-us.example.com:8443"}},
+		{"no port", "api.example.com", []string{"api.example.com", "api-eu.example.com", "api-us.example.com:8443"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ft.Targets(tt.hostport)
+			if len(got) != len(tt.want) {
+				t.Fatalf("Targets(%q) = %v, want %v", tt.hostport, got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("Targets(%q)[%d] = %q, want %q", tt.hostport, i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestFailoverTable_Nil(t *testing.T) {
+	var ft *FailoverTable
+	got := ft.Targets("example.com:80")
+	if len(got) != 1 || got[0] != "example.com:80" {
+		t.Errorf("expected only the original target, got %v", got)
+	}
+}
+
+func TestHandler_Failover(t *testing.T) {
+	var gotHost string
+	backend := newTestBackendWithHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		gotHost = r.Host
+		w.WriteHeader(http.StatusOK)
+	})
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	// Reserve a port and close it so the primary is unreachable
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	deadAddr := ln.Addr().String()
+	ln.Close()
+	deadHost, _, _ := net.SplitHostPort(deadAddr)
+
+	server := newTestServer(t)
+	server.failover = NewFailoverTable([]config.FailoverRule{
+		{Host: deadHost, Fallbacks: []string{backendURL.Host}},
+	})
+	handler := NewHandler(server)
+
+	req := httptest.NewRequest(http.MethodGet, "http://"+deadAddr+"/", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	assertStatusCode(t, rr, http.StatusOK)
+	if gotHost != backendURL.Host {
+		t.Errorf("expected fallback to receive Host %s, got %s", backendURL.Host, gotHost)
+	}
+}
+
+// deadAddr returns the address of a port nothing listens on.
+func deadAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func TestHandler_Failover_AfterEveryIP(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	primary := deadAddr(t)
+	primaryHost, _, _ := net.SplitHostPort(primary)
+	server := newTestServerWithIPs(t, []string{"127.0.0.1", "127.0.0.2"})
+	server.failover = NewFailoverTable([]config.FailoverRule{
+		{Host: primaryHost, Fallbacks: []string{backendURL.Host}},
+	})
+
+	rr := httptest.NewRecorder()
+	NewHandler(server).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://"+primary+"/", nil))
+
+	assertStatusCode(t, rr, http.StatusOK)
+	// The primary is tried through both IPs, without a retry budget, before
+	// the fallback
+	if got := server.balancer.GetStats().TotalEntries; got != 3 {
+		t.Errorf("expected 3 selections (2 for the primary, 1 for the fallback), got %d", got)
+	}
+}
+
+func TestHandler_Failover_DeniedTarget(t *testing.T) {
+	var reached bool
+	backend := newTestBackendWithHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+		w.WriteHeader(http.StatusOK)
+	})
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	_, port, _ := net.SplitHostPort(deadAddr(t))
+	server := newTestServer(t)
+	server.failover = NewFailoverTable([]config.FailoverRule{
+		{Host: "localhost", Fallbacks: []string{backendURL.Host}},
+	})
+	server.destinations = NewDestinationPolicy([]config.DestinationRule{
+		{Action: "deny", Host: "127.0.0.1"},
+	}, false)
+
+	rr := httptest.NewRecorder()
+	NewHandler(server).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://localhost:"+port+"/", nil))
+
+	assertStatusCode(t, rr, http.StatusBadGateway)
+	if reached {
+		t.Error("expected the denied fallback not to be reached")
+	}
+}
@@ -0,0 +1,178 @@
+// Package proxy provides the HTTP/HTTPS proxy server.
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/balancer"
+	"github.com/cr0hn/outbound-lb/internal/config"
+	"github.com/cr0hn/outbound-lb/internal/logger"
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
+)
+
+// gatewayRoute is a config.GatewayRoute with its upstream parsed.
+type gatewayRoute struct {
+	host        netutil.HostPattern
+	pathPrefix  string
+	upstream    *url.URL
+	stripPrefix bool
+}
+
+// matches reports whether the route applies to a request for host (without
+// port, lower case) and urlPath.
+func (gr *gatewayRoute) matches(host, urlPath string) bool {
+	return gr.host.Match(host) && hasPathPrefix(urlPath, gr.pathPrefix)
+}
+
+// hasPathPrefix reports whether urlPath is prefix or lies below it, so that
+// "/api" matches "/api" and "/api/users" but not "/apis".
+func hasPathPrefix(urlPath, prefix string) bool {
+	if prefix == "" || prefix == "/" {
+		return true
+	}
+	if !strings.HasPrefix(urlPath, prefix) {
+		return false
+	}
+	return len(urlPath) == len(prefix) || strings.HasSuffix(prefix, "/") || urlPath[len(prefix)] == '/'
+}
+
+// rewritePath returns the upstream path for a request to urlPath.
+func (gr *gatewayRoute) rewritePath(urlPath string) string {
+	if gr.stripPrefix {
+		urlPath = strings.TrimPrefix(urlPath, strings.TrimSuffix(gr.pathPrefix, "/"))
+		if !strings.HasPrefix(urlPath, "/") {
+			urlPath = "/" + urlPath
+		}
+	}
+	return strings.TrimSuffix(gr.upstream.Path, "/") + urlPath
+}
+
+// Gateway is a reverse proxy: it forwards ordinary HTTP requests to the
+// upstream of the first matching route, selecting outbound IPs the same way
+// as for proxied requests. It lets clients that cannot use a forward proxy
+// benefit from the outbound IPs.
+type Gateway struct {
+	handler *Handler
+	routes  []gatewayRoute
+}
+
+// NewGateway creates a Gateway forwarding through server. Routes with an
+// invalid upstream are skipped (Config.Validate rejects them).
+func NewGateway(server *Server, routes []config.GatewayRoute) *Gateway {
+	g := &Gateway{
+		handler: NewHandler(server),
+		routes:  make([]gatewayRoute, 0, len(routes)),
+	}
+	for i, route := range routes {
+		u, err := url.Parse(route.Upstream)
+		if err != nil || u.Host == "" {
+			logger.Warn("gateway_route_invalid", "index", i, "upstream", route.Upstream)
+			continue
+		}
+		host, err := netutil.CompileHostPattern(route.Host, "")
+		if err != nil {
+			logger.Warn("gateway_route_invalid", "index", i, "error", err)
+			continue
+		}
+		g.routes = append(g.routes, gatewayRoute{
+			host:        host,
+			pathPrefix:  route.PathPrefix,
+			upstream:    u,
+			stripPrefix: route.StripPrefix,
+		})
+	}
+	return g
+}
+
+// match returns the first route for r, or nil.
+func (g *Gateway) match(r *http.Request) *gatewayRoute {
+	host := netutil.HostOf(r.Host)
+	for i := range g.routes {
+		if g.routes[i].matches(host, r.URL.Path) {
+			return &g.routes[i]
+		}
+	}
+	return nil
+}
+
+// ServeHTTP forwards a request received on the gateway listener.
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	requestID := GenerateRequestID()
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	ctx = ContextWithRequestID(ctx, requestID)
+	sessionID := SessionIDFromContext(ctx)
+
+	logger.Trace("gateway_request_received", "request_id", requestID, "session_id", sessionID, "method", r.Method, "host", r.Host, "remote", r.RemoteAddr, "url", r.URL.String())
+
+	if !g.handler.server.ClientAllowed(r.RemoteAddr) {
+		g.handler.server.Reject(r.Method, g.handler.getClientIP(r), r.Host, RejectClientACL, http.StatusForbidden, netip.Addr{})
+		http.Error(w, "Client not allowed", http.StatusForbidden)
+		metrics.RequestsTotal.WithLabelValues(r.Method, "403").Inc()
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		http.Error(w, "CONNECT is not supported by the gateway", http.StatusMethodNotAllowed)
+		metrics.RequestsTotal.WithLabelValues(r.Method, "405").Inc()
+		return
+	}
+
+	route := g.match(r)
+	if route == nil {
+		logger.Debug("gateway_no_route", "request_id", requestID, "host", r.Host, "path", r.URL.Path)
+		http.Error(w, "No gateway route", http.StatusNotFound)
+		metrics.RequestsTotal.WithLabelValues(r.Method, "404").Inc()
+		return
+	}
+
+	// Clients pick neither the destination nor the outbound IP
+	clientIP := g.handler.getClientIP(r)
+	r = r.WithContext(balancer.ContextWithClient(ctx, clientIP))
+	if !g.handler.server.AllowMethod(r.Context(), r.Method, clientIP, r.Host) {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		metrics.RequestsTotal.WithLabelValues(r.Method, "405").Inc()
+		return
+	}
+	r.Header.Del(OutboundIPHeader)
+	r.Header.Del(EgressIPHeader)
+	r.Header.Del(EgressPoolHeader)
+	r.Header.Set("X-Forwarded-Host", r.Host)
+	r.Header.Set("X-Forwarded-Proto", "http")
+
+	target := *r.URL
+	target.Scheme = route.upstream.Scheme
+	target.Host = route.upstream.Host
+	target.Path = route.rewritePath(r.URL.Path)
+	target.RawPath = ""
+	r.URL = &target
+	r.Host = route.upstream.Host
+
+	releaseClient, err := g.handler.server.AcquireClientConn(r.Context(), r.Method, route.upstream.Host)
+	if err != nil {
+		http.Error(w, "Client connection limit reached", http.StatusTooManyRequests)
+		metrics.RequestsTotal.WithLabelValues(r.Method, "429").Inc()
+		return
+	}
+	defer releaseClient()
+
+	if err := g.handler.server.WaitRate(r.Context(), r.Method, clientIP, route.upstream.Host); err != nil {
+		if r.Context().Err() != nil {
+			return
+		}
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+		metrics.RequestsTotal.WithLabelValues(r.Method, "429").Inc()
+		return
+	}
+
+	g.handler.proxy(w, r, route.upstream.Host, start, requestID, sessionID)
+}
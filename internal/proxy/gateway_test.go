@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cr0hn/outbound-lb/internal/config"
+)
+
+func TestHasPathPrefix(t *testing.T) {
+	tests := []struct {
+		path, prefix string
+		want         bool
+	}{
+		{"/anything", "", true},
+		{"/anything", "/", true},
+		{"/api", "/api", true},
+		{"/api/users", "/api", true},
+		{"/apis", "/api", false},
+		{"/api/users", "/api/", true},
+		{"/other", "/api", false},
+	}
+	for _, tt := range tests {
+		if got := hasPathPrefix(tt.path, tt.prefix); got != tt.want {
+			t.Errorf("hasPathPrefix(%q, %q) = %v, want %v", tt.path, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestGatewayRoute_RewritePath(t *testing.T) {
+	tests := []struct {
+		name  string
+		route config.GatewayRoute
+		path  string
+		want  string
+	}{
+		{"keep", config.GatewayRoute{PathPrefix: "/api", Upstream: "http://a"}, "/api/users", "/api/users"},
+		{"strip", config.GatewayRoute{PathPrefix: "/api", Upstream: "http://a", StripPrefix: true}, "/api/users", "/users"},
+		{"strip trailing slash", config.GatewayRoute{PathPrefix: "/api/", Upstream: "http://a", StripPrefix: true}, "/api/users", "/users"},
+		{"strip all", config.GatewayRoute{PathPrefix: "/api", Upstream: "http://a", StripPrefix: true}, "/api", "/"},
+		{"upstream path", config.GatewayRoute{PathPrefix: "/api", Upstream: "http://a/v2/", StripPrefix: true}, "/api/users", "/v2/users"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewGateway(nil, []config.GatewayRoute{tt.route})
+			if got := g.routes[0].rewritePath(tt.path); got != tt.want {
+				t.Errorf("rewritePath(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGateway(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Forwarded-Host", r.Header.Get("X-Forwarded-Host"))
+		w.Header().Set("X-Forwarded-For", r.Header.Get("X-Forwarded-For"))
+		io.WriteString(w, r.Host+r.URL.RequestURI())
+	}))
+	defer backend.Close()
+
+	s := newTestServerWithOptions(t, DefaultTestServerOptions())
+	s.cfg.Gateway = []config.GatewayRoute{
+		{Host: "api.internal", PathPrefix: "/v1", Upstream: backend.URL + "/api", StripPrefix: true},
+		{PathPrefix: "/static", Upstream: backend.URL},
+	}
+	s.gatewayServer = s.newHTTPServer(0, NewGateway(s, s.cfg.Gateway))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeGateway(ln)
+	defer s.gatewayServer.Close()
+	gatewayURL := "http://" + ln.Addr().String()
+	backendHost := backend.Listener.Addr().String()
+
+	get := func(host, path string) (*http.Response, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, gatewayURL+path, nil)
+		req.Host = host
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s%s: %v", host, path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	resp, body := get("api.internal:8080", "/v1/users?id=1")
+	if resp.StatusCode != http.StatusOK || body != backendHost+"/api/users?id=1" {
+		t.Errorf("routed request = %d %q, want 200 %q", resp.StatusCode, body, backendHost+"/api/users?id=1")
+	}
+	if got := resp.Header.Get("X-Forwarded-Host"); got != "api.internal:8080" {
+		t.Errorf("X-Forwarded-Host = %q, want api.internal:8080", got)
+	}
+	if got := resp.Header.Get("X-Forwarded-For"); got != "127.0.0.1" {
+		t.Errorf("X-Forwarded-For = %q, want 127.0.0.1", got)
+	}
+
+	// Routes are tried in order; the second one matches any host
+	resp, body = get("other.internal", "/static/app.js")
+	if resp.StatusCode != http.StatusOK || body != backendHost+"/static/app.js" {
+		t.Errorf("second route = %d %q, want 200 %q", resp.StatusCode, body, backendHost+"/static/app.js")
+	}
+
+	resp, _ = get("other.internal", "/v1/users")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unrouted request status = %d, want 404", resp.StatusCode)
+	}
+
+	if got := s.stats.GetStats().TotalRequests; got != 2 {
+		t.Errorf("total requests = %d, want 2", got)
+	}
+}
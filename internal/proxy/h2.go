@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// streamConn presents the stream of an HTTP/2 CONNECT request as a net.Conn,
+// so it can be relayed like a hijacked HTTP/1.1 connection. Reads come from
+// the request body and writes go to the response, flushed right away.
+type streamConn struct {
+	body   io.ReadCloser
+	w      http.ResponseWriter
+	rc     *http.ResponseController
+	local  net.Addr
+	remote net.Addr
+	mu     sync.Mutex
+	closed bool // no more writes
+	done   bool // no more reads
+}
+
+// newStreamConn wraps the stream of the CONNECT request r answered through w.
+func newStreamConn(w http.ResponseWriter, r *http.Request) *streamConn {
+	local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return &streamConn{
+		body:   r.Body,
+		w:      w,
+		rc:     http.NewResponseController(w),
+		local:  local,
+		remote: streamAddr(r.RemoteAddr),
+	}
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	n, err := c.body.Read(p)
+	if err != nil {
+		c.mu.Lock()
+		if c.done {
+			err = io.EOF
+		}
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+func (c *streamConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.rc.Flush()
+}
+
+// Close stops reading from and writing to the client. The stream itself
+// ends when the handler returns.
+func (c *streamConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	return c.CloseWrite()
+}
+
+// CloseWrite signals that the target is done sending. An HTTP/2 response
+// ends only when the handler returns, so reading from the client stops too,
+// letting the relay finish and end the stream.
+func (c *streamConn) CloseWrite() error {
+	c.mu.Lock()
+	c.done = true
+	c.mu.Unlock()
+	return c.body.Close()
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return c.local }
+func (c *streamConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	if err := c.rc.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.rc.SetWriteDeadline(t)
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error  { return c.rc.SetReadDeadline(t) }
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return c.rc.SetWriteDeadline(t) }
+
+// streamAddr is a client address known only in its string form.
+type streamAddr string
+
+func (a streamAddr) Network() string { return "tcp" }
+func (a streamAddr) String() string  { return string(a) }
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// startH2CProxy serves s with HTTP/2 enabled on a plain loopback listener and
+// returns its address and a transport speaking prior-knowledge h2c to it.
+func startH2CProxy(t *testing.T, s *Server) (string, *http.Transport) {
+	t.Helper()
+	s.cfg.HTTP2 = true
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+	t.Cleanup(func() { s.httpServer.Close() })
+
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	tr := &http.Transport{Protocols: &protocols}
+	t.Cleanup(tr.CloseIdleConnections)
+	return ln.Addr().String(), tr
+}
+
+func TestServer_H2C_Request(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	addr, tr := startH2CProxy(t, newTestServerWithOptions(t, DefaultTestServerOptions()))
+
+	// Over HTTP/2 the target is carried in :authority
+	req, _ := http.NewRequest(http.MethodGet, "http://"+addr+"/hello", nil)
+	req.Host = backendURL.Host
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip() error = %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.ProtoMajor != 2 {
+		t.Errorf("proto = %s, want HTTP/2", resp.Proto)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != "/hello" {
+		t.Errorf("response = %d %q, want 200 %q", resp.StatusCode, body, "/hello")
+	}
+}
+
+func TestServer_H2C_Connect(t *testing.T) {
+	// Echo server as the tunnel target
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		conn, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	addr, tr := startH2CProxy(t, newTestServerWithOptions(t, DefaultTestServerOptions()))
+
+	pr, pw := io.Pipe()
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Scheme: "http", Host: addr},
+		Host:   echo.Addr().String(),
+		Header: make(http.Header),
+		Body:   pr,
+	}
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip() error = %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT status = %d, want 200", resp.StatusCode)
+	}
+
+	// Data flows both ways over the stream
+	if _, err := pw.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(resp.Body, buf)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil || string(buf) != "ping" {
+			t.Fatalf("read %q, %v, want %q", buf, err, "ping")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no data through the CONNECT stream")
+	}
+
+	// Closing the client side ends the tunnel and the stream
+	pw.Close()
+	go func() {
+		_, err := io.ReadAll(resp.Body)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("stream ended with error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream did not end after the client closed")
+	}
+}
+
+func TestServer_TLSListener_H2(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir(), "proxy")
+	s := newTestServerWithOptions(t, DefaultTestServerOptions())
+	s.cfg.ListenTLSCert = certFile
+	s.cfg.ListenTLSKey = keyFile
+	s.cfg.HTTP2 = true
+	addr := startTLSProxy(t, s)
+
+	if proto := handshake(t, addr).NegotiatedProtocol; proto != "h2" {
+		t.Errorf("NegotiatedProtocol = %q, want h2", proto)
+	}
+}
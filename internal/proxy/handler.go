@@ -4,13 +4,18 @@ package proxy
 import (
 	"context"
 	"fmt"
-	"io"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/cr0hn/outbound-lb/internal/balancer"
 	"github.com/cr0hn/outbound-lb/internal/logger"
 	"github.com/cr0hn/outbound-lb/internal/metrics"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
 )
 
 // hopByHopHeaders contains headers that should not be forwarded to the upstream server.
@@ -65,14 +70,118 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Update request with new context
 	r = r.WithContext(ctx)
 
-	logger.Trace("request_received", "request_id", requestID, "method", r.Method, "host", r.Host, "remote", r.RemoteAddr, "url", r.URL.String())
+	sessionID := SessionIDFromContext(ctx)
+
+	logger.Trace("request_received", "request_id", requestID, "session_id", sessionID, "method", r.Method, "host", r.Host, "remote", r.RemoteAddr, "url", r.URL.String())
+
+	// Clients outside the allowed networks are refused before anything else
+	if !h.server.ClientAllowed(r.RemoteAddr) {
+		h.server.Reject(r.Method, h.getClientIP(r), r.Host, RejectClientACL, http.StatusForbidden, netip.Addr{})
+		h.sendError(w, http.StatusForbidden, "Client not allowed")
+		return
+	}
+
+	// Clients banned after repeated authentication failures are refused
+	// before their credentials are checked
+	if until, banned := h.server.AuthBanned(r.RemoteAddr); banned {
+		h.server.Reject(r.Method, h.getClientIP(r), r.Host, RejectAuthBanned, http.StatusTooManyRequests, netip.Addr{})
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(until).Seconds())+1))
+		h.sendError(w, http.StatusTooManyRequests, "Too many failed authentication attempts")
+		return
+	}
 
 	// Check authentication
 	if !h.server.authenticate(w, r) {
 		logger.Trace("request_auth_failed", "remote", r.RemoteAddr)
+		h.server.Reject(r.Method, h.getClientIP(r), r.Host, RejectAuth, http.StatusProxyAuthRequired, netip.Addr{})
+		return
+	}
+
+	// Attach client identity for session affinity
+	r = r.WithContext(balancer.ContextWithClient(r.Context(), h.clientIdentity(r)))
+
+	// API keys are for the proxy only
+	if h.server.cfg.AuthKeysFile != "" {
+		r.Header.Del(h.server.cfg.AuthKeyHeader)
+	}
+
+	// Clients may only use the methods the policy allows
+	if !h.server.AllowMethod(r.Context(), r.Method, h.getClientIP(r), r.Host) {
+		h.sendError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		metrics.RequestsTotal.WithLabelValues(r.Method, strconv.Itoa(http.StatusMethodNotAllowed)).Inc()
 		return
 	}
 
+	// Agents use the outbound IP chosen by the frontend; the header is never
+	// forwarded upstream
+	if header := r.Header.Get(OutboundIPHeader); header != "" {
+		r.Header.Del(OutboundIPHeader)
+		if h.server.cfg.RegistryURL != "" {
+			ip, err := netutil.ParseAddr(header)
+			if err != nil {
+				h.sendError(w, http.StatusBadRequest, "Invalid outbound IP")
+				return
+			}
+			r = r.WithContext(balancer.ContextWithRequiredIP(r.Context(), ip))
+		}
+	}
+
+	// Trusted clients may choose the outbound IP or pool themselves
+	ctx, status, msg := h.server.chooseEgress(r)
+	if status != 0 {
+		h.sendError(w, status, msg)
+		metrics.RequestsTotal.WithLabelValues(r.Method, strconv.Itoa(status)).Inc()
+		return
+	}
+	r = r.WithContext(ctx)
+
+	// CONNECT tunnels may only target the allowed ports, so the proxy cannot
+	// be used as an open relay
+	if r.Method == http.MethodConnect && !h.server.AllowConnectPort(r.Method, balancer.ClientFromContext(r.Context()), r.Host) {
+		h.sendError(w, http.StatusForbidden, "CONNECT to this port is not allowed")
+		metrics.RequestsTotal.WithLabelValues(r.Method, strconv.Itoa(http.StatusForbidden)).Inc()
+		return
+	}
+
+	// Clients may only reach destinations the policy allows
+	ctx, allowed := h.server.AllowDestination(r.Context(), r.Method, balancer.ClientFromContext(r.Context()), requestTarget(r))
+	if !allowed {
+		h.sendError(w, http.StatusForbidden, "Destination not allowed")
+		metrics.RequestsTotal.WithLabelValues(r.Method, strconv.Itoa(http.StatusForbidden)).Inc()
+		return
+	}
+	r = r.WithContext(ctx)
+
+	// No client may take more than its share of the connections
+	releaseClient, err := h.server.AcquireClientConn(r.Context(), r.Method, requestTarget(r))
+	if err != nil {
+		h.sendError(w, http.StatusTooManyRequests, "Client connection limit reached")
+		metrics.RequestsTotal.WithLabelValues(r.Method, strconv.Itoa(http.StatusTooManyRequests)).Inc()
+		return
+	}
+	defer releaseClient()
+
+	// Requests wait for their turn under the request rate limits
+	if err := h.server.WaitRate(r.Context(), r.Method, balancer.ClientFromContext(r.Context()), requestTarget(r)); err != nil {
+		if r.Context().Err() != nil {
+			return
+		}
+		w.Header().Set("Retry-After", "1")
+		h.sendError(w, http.StatusTooManyRequests, "Rate limit exceeded")
+		metrics.RequestsTotal.WithLabelValues(r.Method, strconv.Itoa(http.StatusTooManyRequests)).Inc()
+		return
+	}
+
+	// Authenticated users stay within their quotas
+	releaseQuota, err := h.server.AcquireQuota(r.Context(), r.Method, requestTarget(r))
+	if err != nil {
+		status := QuotaStatus(err)
+		h.sendError(w, status, "Quota exceeded: "+err.Error())
+		metrics.RequestsTotal.WithLabelValues(r.Method, strconv.Itoa(status)).Inc()
+		return
+	}
+	defer releaseQuota()
+
 	// CONNECT requests are handled separately
 	if r.Method == http.MethodConnect {
 		h.server.connectHandler.ServeHTTP(w, r)
@@ -85,70 +194,174 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		host = r.URL.Host
 	}
 
-	logger.Trace("ip_selection_start", "host", host)
+	h.proxy(w, r, host, start, requestID, sessionID)
+}
 
-	// Select outbound IP
-	ip, err := h.server.selectIP(host)
-	if err != nil {
-		logger.Trace("ip_selection_failed", "host", host, "error", err)
-		h.sendError(w, http.StatusServiceUnavailable, "No available outbound IPs")
-		metrics.LimitRejections.WithLabelValues("total").Inc()
+// proxy sends r to host and writes the response.
+func (h *Handler) proxy(w http.ResponseWriter, r *http.Request, host string, start time.Time, requestID, sessionID string) {
+	// WebSocket upgrades take over the connection
+	if isWebSocketUpgrade(r) {
+		h.serveWebSocket(w, r, host, start, requestID, sessionID)
 		return
 	}
 
-	logger.Trace("ip_selected", "host", host, "ip", ip)
-
-	// Acquire connection slot
-	logger.Trace("connection_acquire_attempt", "ip", ip)
-	if err := h.server.limiter.Acquire(ip); err != nil {
-		logger.Trace("connection_acquire_failed", "ip", ip, "error", err)
-		h.sendError(w, http.StatusServiceUnavailable, "Connection limit reached")
-		metrics.LimitRejections.WithLabelValues("per_ip").Inc()
-		logger.LogConnectionLimit("per_ip", ip, int(h.server.limiter.GetIPCount(ip)), h.server.cfg.MaxConnsPerIP)
+	if !h.limitRequestBody(w, r, host) {
 		return
 	}
-	logger.Trace("connection_acquired", "ip", ip)
-	defer h.server.limiter.Release(ip)
 
-	// Update metrics
-	h.server.stats.IncActiveConnections()
-	h.server.stats.IncConnectionsForIP(ip)
-	defer func() {
-		h.server.stats.DecActiveConnections()
-		h.server.stats.DecConnectionsForIP(ip)
-	}()
+	// Prefer outbound IPs that can reach the destination's address family
+	r = r.WithContext(h.server.withDestinationFamilies(r.Context(), host))
+
+	// Fail over to the next target only once the current one could not be
+	// reached through any outbound IP. Requests with a body are not failed
+	// over since it was consumed.
+	dest := &url.URL{Scheme: "http", Host: r.Host}
+	if r.URL.IsAbs() {
+		dest = r.URL
+	}
+	targets := h.server.failover.Targets(dest.Host)
+	if r.Body != nil && r.Body != http.NoBody {
+		targets = targets[:1]
+	}
+	var (
+		ip      netip.Addr
+		attempt int
+		err     error
+	)
+	for i, target := range targets {
+		tr := r
+		if i > 0 {
+			if !h.server.allowFailover(r.Context(), host, targetAddr(&url.URL{Scheme: dest.Scheme, Host: target})) {
+				continue
+			}
+			logger.Warn("upstream_failover", "host", host, "target", target, "error", err)
+			metrics.FailoverTotal.WithLabelValues(metrics.HostLabel(host)).Inc()
+			tr = r.WithContext(withFailoverTarget(r.Context(), target))
+		}
+		ip, attempt, err = h.tryIPs(w, tr, host, start, requestID, sessionID, i < len(targets)-1)
+		if err == nil {
+			return
+		}
+		if !isDialError(err) {
+			break
+		}
+	}
+	h.upstreamFailed(w, r, host, ip, err, attempt)
+}
+
+// tryIPs tries outbound IPs until the upstream is reached, moving on to
+// another IP after a failure while the retry budget lasts, and writes the
+// response. With failover set, connection failures move on to another IP
+// until none is left, whatever the budget, so that the next failover target
+// is only tried once no IP reaches this one.
+//
+// Returns nil once the request was answered, or the last error, the last IP
+// tried and its attempt number without writing anything if the upstream could
+// not be reached.
+func (h *Handler) tryIPs(w http.ResponseWriter, r *http.Request, host string, start time.Time, requestID, sessionID string, failover bool) (netip.Addr, int, error) {
+	var excluded []netip.Addr
+	var lastErr error
+	for attempt := 0; ; attempt++ {
+		selectCtx := r.Context()
+		if len(excluded) > 0 {
+			selectCtx = balancer.ContextWithExcluded(selectCtx, excluded...)
+		}
+
+		logger.Trace("ip_selection_start", "host", host)
+
+		// Select outbound IP and take a connection slot on it, first waiting
+		// in the connection queue if the limits are reached
+		ip, release, err := h.server.acquireOutbound(selectCtx, host, attempt == 0)
+		if isLimitError(err) {
+			logger.Trace("connection_acquire_failed", "ip", ip, "error", err)
+			h.sendError(w, http.StatusServiceUnavailable, "Connection limit reached")
+			metrics.LimitRejections.WithLabelValues("per_ip").Inc()
+			logger.LogConnectionLimit("per_ip", ip, int(h.server.limiter.GetIPCount(ip)), h.server.cfg.MaxConnsPerIP)
+			h.server.Reject(r.Method, balancer.ClientFromContext(r.Context()), host, limitReason(err), http.StatusServiceUnavailable, ip)
+			return ip, attempt, nil
+		}
+		if err != nil {
+			logger.Trace("ip_selection_failed", "host", host, "error", err)
+			if attempt > 0 {
+				// No other IP left to retry on
+				return excluded[len(excluded)-1], attempt, lastErr
+			}
+			h.sendError(w, http.StatusServiceUnavailable, "No available outbound IPs")
+			metrics.LimitRejections.WithLabelValues("total").Inc()
+			h.server.Reject(r.Method, balancer.ClientFromContext(r.Context()), host, RejectNoIPs, http.StatusServiceUnavailable, netip.Addr{})
+			return netip.Addr{}, attempt, nil
+		}
+
+		logger.Trace("connection_acquired", "host", host, "ip", ip)
+
+		err = h.forward(w, r, host, ip, release, start, requestID, sessionID)
+		if err == nil {
+			return ip, attempt, nil
+		}
+		retry := h.server.shouldRetry(r, attempt, err) || (failover && isDialError(err) && !isDeniedAddr(err))
+		if !retry {
+			return ip, attempt, err
+		}
+		excluded = append(excluded, ip)
+		lastErr = err
+		if !h.server.waitRetry(r.Context(), r.Method, host, ip, attempt+1, err) {
+			return ip, attempt, err
+		}
+	}
+}
+
+// forward proxies the request through ip, holding its connection slot until
+// release, and writes the response. Returns the upstream error without
+// writing anything if the upstream could not be reached, so the caller can
+// retry on another IP.
+func (h *Handler) forward(w http.ResponseWriter, r *http.Request, host string, ip netip.Addr, release func(), start time.Time, requestID, sessionID string) error {
+	defer release()
 
 	// Record selection
 	h.server.balancer.Record(host, ip)
 	h.server.stats.IncSelectionsForIP(ip, host)
 	logger.LogBalancerSelection(host, ip, len(h.server.cfg.IPs))
 
-	// Get transport for this IP
-	transport := h.server.transportPool.Get(ip)
-
-	// Create outgoing request
-	outReq := h.createOutgoingRequest(r)
-
-	// Execute request
-	logger.Trace("upstream_request_start", "host", host, "ip", ip, "method", r.Method)
-	resp, err := transport.RoundTrip(outReq)
+	// Execute request, hedging slow idempotent requests through a second IP
+	var (
+		resp *http.Response
+		err  error
+	)
+	if h.server.hedgeable(r) {
+		var done func()
+		resp, ip, done, err = h.hedgedRoundTrip(r, host, ip)
+		defer done()
+	} else {
+		resp, err = h.roundTrip(r, host, ip)
+	}
 	if err != nil {
 		logger.Trace("upstream_request_failed", "host", host, "ip", ip, "error", err)
-		logger.LogError("proxy_request", err, "host", host, "ip", ip)
-		h.sendError(w, http.StatusBadGateway, "Failed to connect to upstream")
-		metrics.RequestsTotal.WithLabelValues(r.Method, "502").Inc()
-		return
+		if isRequestTooLarge(err) {
+			h.requestTooLarge(w, r, host)
+			return nil
+		}
+		return err
 	}
 	defer resp.Body.Close()
 
 	logger.Trace("upstream_response_received", "host", host, "ip", ip, "status", resp.StatusCode)
+	h.server.recordUpstreamStatus(ip, resp.StatusCode)
+
+	// Responses announcing a body over the limit are refused before sending
+	// anything
+	if h.responseTooLarge(resp, host, ip) {
+		h.sendError(w, http.StatusBadGateway, "Upstream response too large")
+		metrics.RequestsTotal.WithLabelValues(r.Method, strconv.Itoa(http.StatusBadGateway)).Inc()
+		return nil
+	}
 
 	// Copy response headers
 	h.copyHeaders(w.Header(), resp.Header)
+	h.server.echoEgress(r.Context(), w.Header(), ip)
 	w.WriteHeader(resp.StatusCode)
 
 	// Copy response body
-	bytesCopied, err := io.Copy(w, resp.Body)
+	bytesCopied, err := h.copyResponseBody(w, resp, requestUser(r.Context()), host, ip)
 	if err != nil {
 		// Cannot send error to client - headers already sent
 		logger.LogError("response_copy", err, "host", host, "ip", ip)
@@ -158,16 +371,61 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// Log and record metrics
 	duration := time.Since(start).Milliseconds()
-	logger.LogRequest(r.Method, host, r.RemoteAddr, ip, resp.StatusCode, duration, r.ContentLength, bytesCopied)
+	user := requestUser(r.Context())
+	logger.LogRequest(r.Method, host, r.RemoteAddr, ip.String(), resp.StatusCode, duration, r.ContentLength, bytesCopied,
+		"request_id", requestID, "session_id", sessionID, "user", user)
+	h.server.recordUser(user, max(r.ContentLength, 0), bytesCopied)
 
 	h.server.stats.IncTotalRequests()
 	h.server.stats.AddBytesSent(bytesCopied)
 	if r.ContentLength > 0 {
 		h.server.stats.AddBytesReceived(r.ContentLength)
 	}
+	h.server.stats.RecordHost(host, ip, bytesCopied, r.ContentLength, resp.StatusCode >= 500)
 
 	metrics.RequestsTotal.WithLabelValues(r.Method, fmt.Sprintf("%d", resp.StatusCode)).Inc()
 	metrics.RequestDuration.WithLabelValues(r.Method).Observe(time.Since(start).Seconds())
+	return nil
+}
+
+// roundTrip sends r upstream through ip, to the failover target of its
+// context if any.
+func (h *Handler) roundTrip(r *http.Request, host string, ip netip.Addr) (*http.Response, error) {
+	transport := h.server.transportPool.RoundTripper(ip)
+	outReq := h.createOutgoingRequest(r)
+	if version := h.server.proxyHeaderVersion(outReq.URL.Host, ip); version != 0 {
+		transport = h.server.transportPool.ProxyProtocolTransport(ip, version, ClientAddrFromContext(r.Context()))
+	}
+	if h.server.transportPool.Upstream(ip) != nil {
+		outReq.Header.Set(OutboundIPHeader, ip.String())
+	}
+	outReq = outReq.WithContext(withUpstreamTrace(outReq.Context(), ip))
+	if target := failoverTarget(r.Context()); target != "" {
+		outReq.URL.Host = target
+		outReq.Host = target
+	}
+
+	logger.Trace("upstream_request_start", "host", outReq.URL.Host, "ip", ip, "method", r.Method)
+	resp, err := transport.RoundTrip(outReq)
+	// Requests cancelled by the client or a faster hedge, or whose body is
+	// too large, say nothing about the IP
+	if r.Context().Err() == nil && !isRequestTooLarge(err) {
+		h.server.recordUpstreamResult(ip, err)
+	}
+	return resp, err
+}
+
+// upstreamFailed reports a request whose upstream could not be reached through
+// ip, the last of attempt+1 IPs tried.
+func (h *Handler) upstreamFailed(w http.ResponseWriter, r *http.Request, host string, ip netip.Addr, err error, attempt int) {
+	logger.LogError("proxy_request", err, "host", host, "ip", ip, "retries", attempt)
+	if attempt > 0 {
+		metrics.RetriesExhausted.WithLabelValues(r.Method).Inc()
+	}
+	h.server.echoEgress(r.Context(), w.Header(), ip)
+	status := writeUpstreamError(w, host, err)
+	metrics.RequestsTotal.WithLabelValues(r.Method, strconv.Itoa(status)).Inc()
+	h.server.stats.RecordHost(host, ip, 0, 0, true)
 }
 
 // createOutgoingRequest creates the outgoing request from the incoming request.
@@ -183,15 +441,27 @@ func (h *Handler) createOutgoingRequest(r *http.Request) *http.Request {
 	// Remove hop-by-hop headers
 	h.removeHopByHopHeaders(outReq.Header)
 
-	// Set X-Forwarded-For
-	if clientIP := h.getClientIP(r); clientIP != "" {
-		if prior := outReq.Header.Get("X-Forwarded-For"); prior != "" {
-			outReq.Header.Set("X-Forwarded-For", prior+", "+clientIP)
-		} else {
-			outReq.Header.Set("X-Forwarded-For", clientIP)
+	// Reveal, pass on or hide the client according to the anonymity mode
+	switch h.server.cfg.AnonymityMode {
+	case "passthrough":
+	case "strip":
+		for _, name := range forwardingHeaders {
+			outReq.Header.Del(name)
+		}
+	default:
+		if clientIP := h.getClientIP(r); clientIP != "" {
+			if prior := outReq.Header.Get("X-Forwarded-For"); prior != "" {
+				outReq.Header.Set("X-Forwarded-For", prior+", "+clientIP)
+			} else {
+				outReq.Header.Set("X-Forwarded-For", clientIP)
+			}
 		}
 	}
 
+	// Apply per-destination path and header rules
+	h.server.rewriteRules.Apply(outReq.URL)
+	h.server.headerRules.Apply(outReq.URL.Host, outReq.Header)
+
 	return outReq
 }
 
@@ -227,8 +497,37 @@ func isHopByHop(header string) bool {
 	return hopByHopHeaders[header]
 }
 
+// requestTarget returns the "host:port" a proxy request is for.
+func requestTarget(r *http.Request) string {
+	if r.Method == http.MethodConnect {
+		return r.Host
+	}
+	if r.URL.IsAbs() {
+		return targetAddr(r.URL)
+	}
+	return targetAddr(&url.URL{Scheme: "http", Host: r.Host})
+}
+
+// targetAddr returns the "host:port" to connect to for u, adding the
+// default port of its scheme.
+func targetAddr(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	if u.Scheme == "https" || u.Scheme == "wss" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
 // getClientIP extracts the client IP from the request.
+// IP addresses are normalized so that e.g. ::ffff:1.2.3.4 and 1.2.3.4 are the same client.
 func (h *Handler) getClientIP(r *http.Request) string {
+	if addr, err := netutil.HostAddr(r.RemoteAddr); err == nil {
+		return addr.String()
+	}
+
 	// Handle IPv6 addresses in brackets [::1]:port
 	if strings.HasPrefix(r.RemoteAddr, "[") {
 		if idx := strings.LastIndex(r.RemoteAddr, "]:"); idx != -1 {
@@ -244,6 +543,20 @@ func (h *Handler) getClientIP(r *http.Request) string {
 	return r.RemoteAddr
 }
 
+// clientIdentity returns the authenticated proxy user, or the client IP when
+// authentication is disabled and no client certificate names a user.
+func (h *Handler) clientIdentity(r *http.Request) string {
+	if user, ok := h.server.certUser(r); ok {
+		return "user:" + user
+	}
+	if h.server.AuthRequired() && !listenerNoAuth(r.Context()) {
+		if user, ok := h.server.authUser(r); ok {
+			return "user:" + user
+		}
+	}
+	return h.getClientIP(r)
+}
+
 // sendError sends an error response.
 func (h *Handler) sendError(w http.ResponseWriter, status int, message string) {
 	http.Error(w, message, status)
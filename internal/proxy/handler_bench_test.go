@@ -10,6 +10,7 @@ import (
 	"github.com/cr0hn/outbound-lb/internal/config"
 	"github.com/cr0hn/outbound-lb/internal/limiter"
 	"github.com/cr0hn/outbound-lb/internal/metrics"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
 )
 
 func newBenchServer(b *testing.B) *Server {
@@ -28,10 +29,10 @@ func newBenchServer(b *testing.B) *Server {
 		LogFormat:     "json",
 	}
 
-	stats := metrics.NewStatsCollector(cfg.IPs)
-	lim := limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, cfg.IPs)
+	stats := metrics.NewStatsCollector(netutil.MustParseAddrs(cfg.IPs))
+	lim := limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, netutil.MustParseAddrs(cfg.IPs))
 	balCfg := balancer.Config{
-		IPs:           cfg.IPs,
+		IPs:           netutil.MustParseAddrs(cfg.IPs),
 		HistoryWindow: int64(cfg.HistoryWindow.Seconds()),
 		HistorySize:   cfg.HistorySize,
 		Limiter:       lim,
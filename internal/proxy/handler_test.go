@@ -1,17 +1,22 @@
 package proxy
 
 import (
+	"encoding/base64"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/cr0hn/outbound-lb/internal/balancer"
 	"github.com/cr0hn/outbound-lb/internal/config"
+	"github.com/cr0hn/outbound-lb/internal/health"
 	"github.com/cr0hn/outbound-lb/internal/limiter"
 	"github.com/cr0hn/outbound-lb/internal/metrics"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
 )
 
 func newTestServer(t *testing.T) *Server {
@@ -30,10 +35,10 @@ func newTestServer(t *testing.T) *Server {
 		LogFormat:     "json",
 	}
 
-	stats := metrics.NewStatsCollector(cfg.IPs)
-	lim := limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, cfg.IPs)
+	stats := metrics.NewStatsCollector(netutil.MustParseAddrs(cfg.IPs))
+	lim := limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, netutil.MustParseAddrs(cfg.IPs))
 	balCfg := balancer.Config{
-		IPs:           cfg.IPs,
+		IPs:           netutil.MustParseAddrs(cfg.IPs),
 		HistoryWindow: int64(cfg.HistoryWindow.Seconds()),
 		HistorySize:   cfg.HistorySize,
 		Limiter:       lim,
@@ -135,6 +140,9 @@ func TestHandler_getClientIP(t *testing.T) {
 		{"IPv6 link-local with port", "[fe80::1%eth0]:9000", "fe80::1%eth0"},
 		{"IPv4 without port", "192.168.1.1", "192.168.1.1"},
 		{"IPv6 without port (malformed)", "[::1]", "[::1]"},
+		{"IPv4-mapped IPv6 with port", "[::ffff:192.168.1.1]:12345", "192.168.1.1"},
+		{"IPv4-mapped IPv6 without port", "::ffff:10.0.0.1", "10.0.0.1"},
+		{"global IPv6 with zone", "[2001:db8::1%eth0]:8080", "2001:db8::1"},
 	}
 
 	for _, tt := range tests {
@@ -213,3 +221,127 @@ func TestHandler_createOutgoingRequest_ExistingXFF(t *testing.T) {
 		t.Errorf("expected X-Forwarded-For to be '10.0.0.1, 192.168.1.100', got %s", xff)
 	}
 }
+
+func TestHandler_createOutgoingRequest_AnonymityMode(t *testing.T) {
+	tests := []struct {
+		mode string
+		want map[string]string
+	}{
+		{"append", map[string]string{"X-Forwarded-For": "10.0.0.1, 192.168.1.100", "Via": "1.1 edge", "Forwarded": "for=10.0.0.1", "X-Real-Ip": "10.0.0.1"}},
+		{"passthrough", map[string]string{"X-Forwarded-For": "10.0.0.1", "Via": "1.1 edge", "Forwarded": "for=10.0.0.1", "X-Real-Ip": "10.0.0.1"}},
+		{"strip", map[string]string{"X-Forwarded-For": "", "Via": "", "Forwarded": "", "X-Real-Ip": ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			server := newTestServer(t)
+			server.cfg.AnonymityMode = tt.mode
+			handler := NewHandler(server)
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/path", nil)
+			req.RemoteAddr = "192.168.1.100:12345"
+			req.Header.Set("X-Forwarded-For", "10.0.0.1")
+			req.Header.Set("Via", "1.1 edge")
+			req.Header.Set("Forwarded", "for=10.0.0.1")
+			req.Header.Set("X-Real-IP", "10.0.0.1")
+
+			outReq := handler.createOutgoingRequest(req)
+			for name, want := range tt.want {
+				if got := outReq.Header.Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestHandler_clientIdentity(t *testing.T) {
+	server := newTestServer(t)
+	handler := NewHandler(server)
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.RemoteAddr = "192.0.2.10:5555"
+	if got := handler.clientIdentity(req); got != "192.0.2.10" {
+		t.Errorf("expected client IP identity, got %q", got)
+	}
+
+	// With auth enabled, the proxy user identifies the client
+	server.cfg.Auth = "alice:secret"
+	req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("alice:secret")))
+	if got := handler.clientIdentity(req); got != "user:alice" {
+		t.Errorf("expected user identity, got %q", got)
+	}
+}
+
+func TestHandler_CircuitBreaker(t *testing.T) {
+	backend := newTestBackendWithHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	defer backend.Close()
+
+	// Reserve a port and close it so the upstream is unreachable
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	deadURL := "http://" + ln.Addr().String() + "/"
+	ln.Close()
+
+	server := newTestServer(t)
+	cb := balancer.NewCircuitBreaker(balancer.CircuitBreakerConfig{
+		FailureThreshold: 2,
+		SuccessThreshold: 1,
+		Timeout:          time.Minute,
+	})
+	server.SetCircuitBreaker(cb)
+	handler := NewHandler(server)
+
+	do := func(url string, want int) {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, url, nil))
+		assertStatusCode(t, rr, want)
+	}
+
+	do(deadURL, http.StatusBadGateway)
+	if failures := cb.Info()["127.0.0.1"].Failures; failures != 1 {
+		t.Errorf("expected 1 recorded failure, got %d", failures)
+	}
+
+	// A success resets the failure count
+	do(backend.URL+"/", http.StatusOK)
+	if failures := cb.Info()["127.0.0.1"].Failures; failures != 0 {
+		t.Errorf("expected failures reset after success, got %d", failures)
+	}
+
+	do(deadURL, http.StatusBadGateway)
+	do(deadURL, http.StatusBadGateway)
+	if state := cb.GetState(netip.MustParseAddr("127.0.0.1")); state != balancer.StateOpen {
+		t.Errorf("expected open circuit after repeated upstream failures, got %s", state)
+	}
+}
+
+func TestHandler_PassiveHealth(t *testing.T) {
+	backend := newTestBackendWithHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	defer backend.Close()
+
+	server := newTestServer(t)
+	hc := health.NewHealthChecker(health.HealthCheckerConfig{
+		IPs:              netutil.MustParseAddrs([]string{"127.0.0.1"}),
+		FailureThreshold: 2,
+		SuccessThreshold: 1,
+	})
+	server.SetPassiveHealth(health.NewPassiveMonitor(hc, 2, 50))
+	handler := NewHandler(server)
+
+	for i := 0; i < 4; i++ {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, backend.URL+"/", nil))
+		assertStatusCode(t, rr, http.StatusServiceUnavailable)
+	}
+
+	if hc.IsHealthy(netip.MustParseAddr("127.0.0.1")) {
+		t.Error("expected IP marked unhealthy by upstream 5xx rate")
+	}
+}
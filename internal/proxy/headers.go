@@ -0,0 +1,92 @@
+// Package proxy provides the HTTP/HTTPS proxy server.
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/cr0hn/outbound-lb/internal/config"
+	"github.com/cr0hn/outbound-lb/internal/logger"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
+)
+
+// clientIdentityHeaders are the headers removed by rules that strip the
+// client identity.
+var clientIdentityHeaders = []string{
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Real-Ip",
+	"X-Client-Ip",
+	"True-Client-Ip",
+	"Forwarded",
+	"Via",
+	"From",
+}
+
+// forwardingHeaders are the headers removed in the strip anonymity mode.
+var forwardingHeaders = []string{
+	"X-Forwarded-For",
+	"Via",
+	"Forwarded",
+	"X-Real-Ip",
+}
+
+// headerRule is a config.HeaderRule with its matcher prepared.
+type headerRule struct {
+	host      netutil.HostPattern
+	userAgent string
+	remove    []string
+}
+
+// HeaderRules rewrites outgoing request headers per destination host.
+type HeaderRules struct {
+	rules []headerRule
+}
+
+// NewHeaderRules creates HeaderRules from the configured rules. Rules are
+// evaluated in order; the first match wins. Invalid rules are skipped
+// (Config.Validate rejects them).
+func NewHeaderRules(rules []config.HeaderRule) *HeaderRules {
+	hr := &HeaderRules{rules: make([]headerRule, 0, len(rules))}
+	for i, rule := range rules {
+		host, err := netutil.CompileHostPattern(rule.Host, rule.Regex)
+		if err != nil {
+			logger.Warn("header_rule_invalid", "index", i, "error", err)
+			continue
+		}
+		compiled := headerRule{host: host, userAgent: rule.UserAgent}
+		compiled.remove = append(compiled.remove, rule.RemoveHeaders...)
+		if rule.StripClientIdentity {
+			compiled.remove = append(compiled.remove, clientIdentityHeaders...)
+		}
+		hr.rules = append(hr.rules, compiled)
+	}
+	return hr
+}
+
+// Apply rewrites header, the headers of a request to hostport, according to
+// the first matching rule.
+func (hr *HeaderRules) Apply(hostport string, header http.Header) {
+	if hr == nil || len(hr.rules) == 0 {
+		return
+	}
+
+	host := netutil.HostOf(hostport)
+	for _, rule := range hr.rules {
+		if !rule.host.Match(host) {
+			continue
+		}
+
+		for _, name := range rule.remove {
+			if http.CanonicalHeaderKey(name) == "User-Agent" {
+				// An empty value stops the transport from adding its own
+				header.Set("User-Agent", "")
+				continue
+			}
+			header.Del(name)
+		}
+		if rule.userAgent != "" {
+			header.Set("User-Agent", rule.userAgent)
+		}
+		return
+	}
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cr0hn/outbound-lb/internal/config"
+)
+
+func TestHeaderRules_Apply(t *testing.T) {
+	hr := NewHeaderRules([]config.HeaderRule{
+		{Host: "*.shop.example.com", UserAgent: "Mozilla/5.0 (crawler)"},
+		{Regex: `^api[0-9]+\.example\.com$`, RemoveHeaders: []string{"Cookie", "user-agent"}},
+		{Host: "*", StripClientIdentity: true},
+	})
+
+	tests := []struct {
+		name     string
+		hostport string
+		want     map[string]string
+		absent   []string
+	}{
+		{
+			name:     "user agent set by glob",
+			hostport: "www.shop.example.com:443",
+			want:     map[string]string{"User-Agent": "Mozilla/5.0 (crawler)", "X-Forwarded-For": "10.0.0.1", "Cookie": "id=1"},
+		},
+		{
+			name:     "headers removed by regex",
+			hostport: "API1.example.com",
+			want:     map[string]string{"User-Agent": "", "X-Forwarded-For": "10.0.0.1"},
+			absent:   []string{"Cookie"},
+		},
+		{
+			name:     "catch-all strips client identity",
+			hostport: "other.org:80",
+			want:     map[string]string{"User-Agent": "curl/8.0", "Cookie": "id=1"},
+			absent:   []string{"X-Forwarded-For", "Via", "Forwarded"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			header.Set("User-Agent", "curl/8.0")
+			header.Set("Cookie", "id=1")
+			header.Set("X-Forwarded-For", "10.0.0.1")
+			header.Set("Via", "1.1 corp-proxy")
+			header.Set("Forwarded", "for=10.0.0.1")
+
+			hr.Apply(tt.hostport, header)
+
+			for k, v := range tt.want {
+				if got := header.Get(k); got != v {
+					t.Errorf("%s = %q, want %q", k, got, v)
+				}
+			}
+			for _, k := range tt.absent {
+				if _, ok := header[http.CanonicalHeaderKey(k)]; ok {
+					t.Errorf("%s should be removed", k)
+				}
+			}
+		})
+	}
+}
+
+func TestHeaderRules_Nil(t *testing.T) {
+	var hr *HeaderRules
+	header := http.Header{"User-Agent": {"curl/8.0"}}
+	hr.Apply("example.com", header)
+	if header.Get("User-Agent") != "curl/8.0" {
+		t.Error("nil HeaderRules should not modify headers")
+	}
+}
+
+func TestHandler_HeaderRules(t *testing.T) {
+	var gotUA string
+	var hasUA, hasXFF bool
+	backend := newTestBackendWithHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		gotUA = r.Header.Get("User-Agent")
+		_, hasUA = r.Header["User-Agent"]
+		_, hasXFF = r.Header["X-Forwarded-For"]
+		w.WriteHeader(http.StatusOK)
+	})
+	defer backend.Close()
+
+	server := newTestServer(t)
+	server.headerRules = NewHeaderRules([]config.HeaderRule{
+		{Host: "127.0.0.1", UserAgent: "normalized/1.0", StripClientIdentity: true},
+	})
+	handler := NewHandler(server)
+
+	req := httptest.NewRequest(http.MethodGet, backend.URL+"/", nil)
+	req.Header.Set("User-Agent", "client/2.3")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assertStatusCode(t, rr, http.StatusOK)
+
+	if gotUA != "normalized/1.0" {
+		t.Errorf("upstream User-Agent = %q, want normalized/1.0", gotUA)
+	}
+	if hasXFF {
+		t.Error("X-Forwarded-For should be stripped")
+	}
+
+	// Removing the User-Agent must not let the transport add its own
+	server.headerRules = NewHeaderRules([]config.HeaderRule{
+		{Host: "127.0.0.1", RemoveHeaders: []string{"User-Agent"}},
+	})
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assertStatusCode(t, rr, http.StatusOK)
+	if hasUA {
+		t.Errorf("upstream should receive no User-Agent, got %q", gotUA)
+	}
+}
@@ -0,0 +1,136 @@
+// Package proxy provides the HTTP/HTTPS proxy server.
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/balancer"
+	"github.com/cr0hn/outbound-lb/internal/logger"
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+)
+
+// hedgeResult is the outcome of one attempt of a hedged request.
+type hedgeResult struct {
+	resp   *http.Response
+	err    error
+	ip     netip.Addr
+	cancel context.CancelFunc
+	// release frees the attempt's connection slot (nil for the primary,
+	// whose slot belongs to the caller).
+	release func()
+}
+
+// hedgeable reports whether r may be hedged: hedging is enabled and r is a
+// GET or HEAD request without a body.
+func (s *Server) hedgeable(r *http.Request) bool {
+	if s.cfg.HedgeAfter <= 0 {
+		return false
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	return r.Body == nil || r.Body == http.NoBody
+}
+
+// hedgedRoundTrip sends r upstream through ip and, if no response arrived
+// after the hedge delay, a second copy through another outbound IP. The first
+// successful response wins and the other attempt is cancelled.
+//
+// Returns the response, the IP it came through and a function that must be
+// called once the response has been consumed. If both attempts fail, the
+// error of the last one is returned.
+func (h *Handler) hedgedRoundTrip(r *http.Request, host string, ip netip.Addr) (*http.Response, netip.Addr, func(), error) {
+	results := make(chan hedgeResult, 2)
+	cancels := make(map[netip.Addr]context.CancelFunc, 2)
+	launch := func(ip netip.Addr, release func()) {
+		ctx, cancel := context.WithCancel(r.Context())
+		cancels[ip] = cancel
+		go func() {
+			resp, err := h.roundTrip(r.WithContext(ctx), host, ip)
+			results <- hedgeResult{resp: resp, err: err, ip: ip, cancel: cancel, release: release}
+		}()
+	}
+	launch(ip, nil)
+
+	timer := time.NewTimer(h.server.cfg.HedgeAfter)
+	defer timer.Stop()
+
+	pending := 1
+	var res hedgeResult
+	select {
+	case res = <-results:
+		return res.resp, res.ip, res.done, res.err
+	case <-timer.C:
+	}
+
+	// The primary is slow: race it against another IP
+	hedgeIP, release, ok := h.server.acquireHedgeIP(r.Context(), host, ip)
+	if ok {
+		metrics.HedgedRequests.Inc()
+		logger.Debug("request_hedged", "host", host, "ip", ip, "hedge_ip", hedgeIP, "after", h.server.cfg.HedgeAfter)
+		launch(hedgeIP, release)
+		pending++
+	}
+
+	for pending > 0 {
+		res = <-results
+		pending--
+		if res.err == nil {
+			break
+		}
+		res.done()
+	}
+	if res.err != nil {
+		// Every attempt failed and has been cleaned up already
+		return nil, res.ip, func() {}, res.err
+	}
+	if res.ip == hedgeIP {
+		metrics.HedgeWins.Inc()
+	}
+
+	// Cancel the loser and free its resources once it gives up
+	if pending > 0 {
+		for attemptIP, cancel := range cancels {
+			if attemptIP != res.ip {
+				cancel()
+			}
+		}
+		go func() {
+			loser := <-results
+			if loser.resp != nil {
+				loser.resp.Body.Close()
+			}
+			loser.done()
+		}()
+	}
+	return res.resp, res.ip, res.done, nil
+}
+
+// done cancels the attempt and frees its connection slot.
+func (res hedgeResult) done() {
+	res.cancel()
+	if res.release != nil {
+		res.release()
+	}
+}
+
+// acquireHedgeIP selects an outbound IP other than ip for host and takes a
+// connection slot on it. Returns false if no other IP is available.
+func (s *Server) acquireHedgeIP(ctx context.Context, host string, ip netip.Addr) (netip.Addr, func(), bool) {
+	hedgeIP, err := s.selectIP(balancer.ContextWithExcluded(ctx, ip), host)
+	if err != nil {
+		logger.Trace("hedge_ip_selection_failed", "host", host, "error", err)
+		return netip.Addr{}, nil, false
+	}
+	release, err := s.acquireIP(ctx, hedgeIP)
+	if err != nil {
+		logger.Trace("hedge_acquire_failed", "ip", hedgeIP, "error", err)
+		return netip.Addr{}, nil, false
+	}
+	s.balancer.Record(host, hedgeIP)
+	s.stats.IncSelectionsForIP(hedgeIP, host)
+	return hedgeIP, release, true
+}
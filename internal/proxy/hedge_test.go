@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/balancer"
+	"github.com/cr0hn/outbound-lb/internal/config"
+	"github.com/cr0hn/outbound-lb/internal/limiter"
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
+)
+
+func newHedgeTestServer(t *testing.T, hedgeAfter time.Duration) *Server {
+	t.Helper()
+	cfg := &config.Config{
+		IPs:           []string{"127.0.0.1", "127.0.0.2"},
+		Timeout:       5 * time.Second,
+		IdleTimeout:   60 * time.Second,
+		MaxConnsPerIP: 100,
+		MaxConnsTotal: 1000,
+		HistoryWindow: 5 * time.Minute,
+		HistorySize:   100,
+		HedgeAfter:    hedgeAfter,
+	}
+
+	stats := metrics.NewStatsCollector(netutil.MustParseAddrs(cfg.IPs))
+	lim := limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, netutil.MustParseAddrs(cfg.IPs))
+	bal := balancer.New(balancer.Config{
+		IPs:           netutil.MustParseAddrs(cfg.IPs),
+		HistoryWindow: int64(cfg.HistoryWindow.Seconds()),
+		HistorySize:   cfg.HistorySize,
+		Limiter:       lim,
+	})
+	return NewServer(cfg, bal, lim, stats)
+}
+
+func TestHandler_Hedging(t *testing.T) {
+	// Requests from 127.0.0.1 hang until cancelled, others answer at once
+	backend := newTestBackendWithHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		if host == "127.0.0.1" {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		w.Write([]byte("fast"))
+	})
+	defer backend.Close()
+
+	server := newHedgeTestServer(t, 50*time.Millisecond)
+	handler := NewHandler(server)
+
+	for i := 0; i < 4; i++ {
+		start := time.Now()
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, backend.URL+"/", nil))
+		assertStatusCode(t, rr, http.StatusOK)
+		if rr.Body.String() != "fast" {
+			t.Errorf("expected response from the fast IP, got %q", rr.Body.String())
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("hedged request took %v", elapsed)
+		}
+	}
+
+	// The loser's slot is released once its attempt is cancelled
+	deadline := time.Now().Add(2 * time.Second)
+	for server.stats.GetStats().ActiveConnections != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected all connection slots released, %d active", server.stats.GetStats().ActiveConnections)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServer_Hedgeable(t *testing.T) {
+	tests := []struct {
+		name       string
+		hedgeAfter time.Duration
+		method     string
+		body       string
+		want       bool
+	}{
+		{name: "get", hedgeAfter: time.Second, method: http.MethodGet, want: true},
+		{name: "head", hedgeAfter: time.Second, method: http.MethodHead, want: true},
+		{name: "disabled", method: http.MethodGet, want: false},
+		{name: "post", hedgeAfter: time.Second, method: http.MethodPost, want: false},
+		{name: "get with body", hedgeAfter: time.Second, method: http.MethodGet, body: "data", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newHedgeTestServer(t, tt.hedgeAfter)
+			var req *http.Request
+			if tt.body != "" {
+				req = httptest.NewRequest(tt.method, "http://example.com/", strings.NewReader(tt.body))
+			} else {
+				req = httptest.NewRequest(tt.method, "http://example.com/", nil)
+			}
+			if got := server.hedgeable(req); got != tt.want {
+				t.Errorf("hedgeable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,305 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+
+	"github.com/cr0hn/outbound-lb/internal/dns"
+	"github.com/cr0hn/outbound-lb/internal/logger"
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+)
+
+const (
+	// http3HandshakeIdleTimeout bounds the QUIC handshake (to twice this) so
+	// that paths blocking UDP fall back to TCP quickly.
+	http3HandshakeIdleTimeout = 1500 * time.Millisecond
+	// http3BrokenFor is how long HTTP/3 is not tried again for a host after
+	// an attempt failed.
+	http3BrokenFor = 5 * time.Minute
+	// altSvcDefaultMaxAge is the lifetime of an Alt-Svc entry without "ma".
+	altSvcDefaultMaxAge = 24 * time.Hour
+)
+
+// http3Upstream is an HTTP/3 transport sending from one outbound IP.
+type http3Upstream struct {
+	transport *http3.Transport
+	quic      *quic.Transport
+	conn      net.PacketConn
+}
+
+// createHTTP3 creates the HTTP/3 transport for ip, with its UDP socket bound
+// to ip and carrying its socket options.
+func (tp *TransportPool) createHTTP3(ip netip.Addr) (*http3Upstream, error) {
+	network := "udp6"
+	if ip.Is4() {
+		network = "udp4"
+	}
+	lc := net.ListenConfig{Control: tp.socketControl(ip)}
+	udp, err := lc.ListenPacket(context.Background(), network, netip.AddrPortFrom(ip, 0).String())
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.PacketConn = udp
+	if tp.byteCounter != nil {
+		conn = &countingPacketConn{PacketConn: udp, counter: tp.byteCounter(ip)}
+	}
+	qt := &quic.Transport{Conn: conn}
+
+	return &http3Upstream{
+		quic: qt,
+		conn: udp,
+		transport: &http3.Transport{
+			TLSClientConfig: tp.tlsConfig,
+			QUICConfig:      &quic.Config{HandshakeIdleTimeout: http3HandshakeIdleTimeout},
+			Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+				raddr, err := tp.resolveUDP(ctx, ip, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				return qt.DialEarly(ctx, raddr, tlsCfg, cfg)
+			},
+		},
+	}, nil
+}
+
+// resolveUDP resolves addr to a UDP address of the network's family with the
+// resolver of ip.
+func (tp *TransportPool) resolveUDP(ctx context.Context, ip netip.Addr, network, addr string) (*net.UDPAddr, error) {
+	if tp.resolvers == nil {
+		return net.ResolveUDPAddr(network, addr)
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := tp.resolvers.For(ip).LookupNetIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if err := dns.CheckAddrs(ctx, host, port, addrs); err != nil {
+		return nil, err
+	}
+	addrs = dns.SameFamily(addrs, network == "udp4")
+	if len(addrs) == 0 {
+		return nil, &net.AddrError{Err: "no suitable address found", Addr: host}
+	}
+	return net.UDPAddrFromAddrPort(netip.AddrPortFrom(addrs[0], uint16(port))), nil
+}
+
+// Close closes the connections and the socket of the transport.
+func (u *http3Upstream) Close() {
+	u.transport.Close()
+	u.quic.Close()
+	u.conn.Close()
+}
+
+// http3For returns the HTTP/3 transport to send req through ip with, or nil
+// if req should go over TCP. Only bodiless HTTPS requests to hosts that
+// advertised HTTP/3 qualify, so a failed attempt can be replayed over TCP.
+func (tp *TransportPool) http3For(ip netip.Addr, req *http.Request) *http3.Transport {
+	if tp.altSvc == nil || req.URL.Scheme != "https" || (req.Body != nil && req.Body != http.NoBody) {
+		return nil
+	}
+	if !tp.altSvc.usable(altSvcKey(req.URL)) {
+		return nil
+	}
+
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	if tp.upstreams[ip] != nil {
+		// Agents are reached through their HTTP proxy
+		return nil
+	}
+	if u, ok := tp.http3[ip]; ok {
+		return u.transport
+	}
+	u, err := tp.createHTTP3(ip)
+	if err != nil {
+		logger.Warn("http3_unavailable", "ip", ip, "error", err)
+		return nil
+	}
+	tp.http3[ip] = u
+	return u.transport
+}
+
+// upstreamTransport sends requests through one outbound IP, over HTTP/3 when
+// possible and over the TCP transport otherwise.
+type upstreamTransport struct {
+	pool *TransportPool
+	ip   netip.Addr
+	tcp  *http.Transport
+}
+
+// RoundTripper returns the round tripper for requests through ip. With
+// HTTP/3 enabled, hosts that advertise it through Alt-Svc are reached over
+// QUIC, falling back to HTTP/2 or HTTP/1.1 if that fails.
+func (tp *TransportPool) RoundTripper(ip netip.Addr) http.RoundTripper {
+	return &upstreamTransport{pool: tp, ip: ip, tcp: tp.Get(ip)}
+}
+
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if h3 := t.pool.http3For(t.ip, req); h3 != nil {
+		resp, err := h3.RoundTrip(req)
+		if err == nil {
+			countProtocol(resp)
+			return resp, nil
+		}
+		if req.Context().Err() != nil {
+			return nil, err
+		}
+		logger.Debug("http3_fallback", "host", req.URL.Host, "ip", t.ip, "error", err)
+		t.pool.altSvc.markBroken(altSvcKey(req.URL))
+		metrics.HTTP3Fallbacks.Inc()
+	}
+
+	resp, err := t.tcp.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if t.pool.altSvc != nil && req.URL.Scheme == "https" {
+		t.pool.altSvc.learn(altSvcKey(req.URL), resp.Header.Get("Alt-Svc"))
+	}
+	countProtocol(resp)
+	return resp, nil
+}
+
+// countProtocol counts resp in the per-protocol upstream metric.
+func countProtocol(resp *http.Response) {
+	protocol := "h1"
+	switch resp.ProtoMajor {
+	case 2:
+		protocol = "h2"
+	case 3:
+		protocol = "h3"
+	}
+	metrics.UpstreamProtocol.WithLabelValues(protocol).Inc()
+}
+
+// altSvcCache remembers which hosts advertised HTTP/3 and which recently
+// failed it.
+type altSvcCache struct {
+	h3     map[string]time.Time // host:port -> advertisement expiry
+	broken map[string]time.Time // host:port -> when to try HTTP/3 again
+	now    func() time.Time
+	mu     sync.Mutex
+}
+
+func newAltSvcCache() *altSvcCache {
+	return &altSvcCache{
+		h3:     make(map[string]time.Time),
+		broken: make(map[string]time.Time),
+		now:    time.Now,
+	}
+}
+
+// usable reports whether HTTP/3 should be tried for key.
+func (c *altSvcCache) usable(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if until, ok := c.broken[key]; ok {
+		if now.Before(until) {
+			return false
+		}
+		delete(c.broken, key)
+	}
+	expiry, ok := c.h3[key]
+	if ok && !now.Before(expiry) {
+		delete(c.h3, key)
+		return false
+	}
+	return ok
+}
+
+// learn updates key from the Alt-Svc header of one of its responses.
+func (c *altSvcCache) learn(key, header string) {
+	if header == "" {
+		return
+	}
+	_, port, _ := net.SplitHostPort(key)
+	maxAge, ok := parseAltSvc(header, port)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !ok {
+		delete(c.h3, key)
+		return
+	}
+	c.h3[key] = c.now().Add(maxAge)
+}
+
+// markBroken stops HTTP/3 from being tried for key for a while.
+func (c *altSvcCache) markBroken(key string) {
+	c.mu.Lock()
+	c.broken[key] = c.now().Add(http3BrokenFor)
+	c.mu.Unlock()
+}
+
+// altSvcKey returns the host:port an Alt-Svc advertisement applies to.
+func altSvcKey(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// parseAltSvc returns the lifetime of an HTTP/3 alternative on the same host
+// and port in an Alt-Svc header value (RFC 7838). Alternatives on other
+// hosts or ports are ignored.
+func parseAltSvc(value, port string) (time.Duration, bool) {
+	for _, entry := range strings.Split(value, ",") {
+		params := strings.Split(entry, ";")
+		proto, authority, ok := strings.Cut(strings.TrimSpace(params[0]), "=")
+		if !ok || proto != "h3" || strings.Trim(authority, `"`) != ":"+port {
+			continue
+		}
+		maxAge := altSvcDefaultMaxAge
+		for _, p := range params[1:] {
+			k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+			if k != "ma" {
+				continue
+			}
+			if secs, err := strconv.Atoi(strings.Trim(v, `"`)); err == nil && secs >= 0 {
+				maxAge = time.Duration(secs) * time.Second
+			}
+		}
+		return maxAge, true
+	}
+	return 0, false
+}
+
+// countingPacketConn is a net.PacketConn that counts the bytes read and
+// written.
+type countingPacketConn struct {
+	net.PacketConn
+	counter *metrics.ByteCounter
+}
+
+func (c *countingPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	c.counter.AddReceived(int64(n))
+	return n, addr, err
+}
+
+func (c *countingPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(p, addr)
+	c.counter.AddSent(int64(n))
+	return n, err
+}
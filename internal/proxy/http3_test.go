@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
+)
+
+func TestParseAltSvc(t *testing.T) {
+	tests := []struct {
+		value  string
+		maxAge time.Duration
+		ok     bool
+	}{
+		{`h3=":443"`, altSvcDefaultMaxAge, true},
+		{`h3=":443"; ma=3600`, time.Hour, true},
+		{`h2=":443", h3=":443"; ma=60; persist=1`, time.Minute, true},
+		{`h3-29=":443"; ma=60`, 0, false},
+		{`h3=":8443"; ma=60`, 0, false},
+		{`h3="other.example.com:443"`, 0, false},
+		{`clear`, 0, false},
+		{`h3=":443"; ma=invalid`, altSvcDefaultMaxAge, true},
+	}
+	for _, tt := range tests {
+		maxAge, ok := parseAltSvc(tt.value, "443")
+		if ok != tt.ok || maxAge != tt.maxAge {
+			t.Errorf("parseAltSvc(%q) = %v, %v, want %v, %v", tt.value, maxAge, ok, tt.maxAge, tt.ok)
+		}
+	}
+}
+
+func TestAltSvcCache(t *testing.T) {
+	now := time.Now()
+	c := newAltSvcCache()
+	c.now = func() time.Time { return now }
+	key := "example.com:443"
+
+	if c.usable(key) {
+		t.Fatal("usable before any advertisement")
+	}
+	c.learn(key, `h3=":443"; ma=60`)
+	if !c.usable(key) {
+		t.Fatal("not usable after advertisement")
+	}
+
+	c.markBroken(key)
+	if c.usable(key) {
+		t.Error("usable while marked broken")
+	}
+	now = now.Add(http3BrokenFor)
+	c.learn(key, `h3=":443"; ma=60`)
+	if !c.usable(key) {
+		t.Error("not usable once the broken period is over")
+	}
+
+	now = now.Add(time.Minute)
+	if c.usable(key) {
+		t.Error("usable after the advertisement expired")
+	}
+
+	c.learn(key, `h3=":443"`)
+	c.learn(key, "clear")
+	if c.usable(key) {
+		t.Error("usable after the advertisement was cleared")
+	}
+}
+
+// startH3Backend starts an HTTPS backend on TCP that advertises HTTP/3, and
+// the HTTP/3 server for it on the same UDP port. Both answer with the
+// protocol the request arrived over.
+func startH3Backend(t *testing.T) (string, *tls.Config, *http3.Server) {
+	t.Helper()
+	certFile, keyFile := writeTestCert(t, t.TempDir(), "backend")
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemData, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(pemData)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	udp, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		ln.Close()
+		t.Skipf("UDP port %d unavailable: %v", port, err)
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Alt-Svc", fmt.Sprintf(`h3=":%d"; ma=60`, port))
+		io.WriteString(w, r.Proto)
+	})
+
+	backend := httptest.NewUnstartedServer(handler)
+	backend.Listener.Close()
+	backend.Listener = ln
+	backend.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	backend.EnableHTTP2 = true
+	backend.StartTLS()
+	t.Cleanup(backend.Close)
+
+	h3 := &http3.Server{
+		Handler:   handler,
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}),
+	}
+	go h3.Serve(udp)
+	t.Cleanup(func() {
+		h3.Close()
+		udp.Close()
+	})
+
+	return fmt.Sprintf("https://127.0.0.1:%d", port), &tls.Config{RootCAs: roots}, h3
+}
+
+func TestTransportPool_HTTP3(t *testing.T) {
+	backendURL, tlsCfg, h3 := startH3Backend(t)
+
+	// The transport is created on first use, after tlsConfig is set
+	tp := NewTransportPool(nil, 5*time.Second, WithHTTP3())
+	tp.tlsConfig = tlsCfg
+	defer tp.Close()
+	rt := tp.RoundTripper(netip.MustParseAddr("127.0.0.1"))
+
+	send := func(method string, body io.Reader) string {
+		t.Helper()
+		req, err := http.NewRequest(method, backendURL, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		defer resp.Body.Close()
+		proto, _ := io.ReadAll(resp.Body)
+		return string(proto)
+	}
+
+	// The first request learns the advertisement over TCP
+	if proto := send(http.MethodGet, nil); proto != "HTTP/2.0" {
+		t.Errorf("first request over %s, want HTTP/2.0", proto)
+	}
+	if proto := send(http.MethodGet, nil); proto != "HTTP/3.0" {
+		t.Errorf("second request over %s, want HTTP/3.0", proto)
+	}
+	// Requests with a body cannot be replayed, so they stay on TCP
+	if proto := send(http.MethodPost, strings.NewReader("data")); proto != "HTTP/2.0" {
+		t.Errorf("POST over %s, want HTTP/2.0", proto)
+	}
+
+	// Without the HTTP/3 server, requests fall back to TCP and stop trying
+	h3.Close()
+	tp.Close()
+	for i := 0; i < 2; i++ {
+		if proto := send(http.MethodGet, nil); proto != "HTTP/2.0" {
+			t.Errorf("request %d after HTTP/3 went away over %s, want HTTP/2.0", i+1, proto)
+		}
+	}
+	u, _ := url.Parse(backendURL)
+	if tp.altSvc.usable(altSvcKey(u)) {
+		t.Error("HTTP/3 still usable after a failed attempt")
+	}
+}
+
+func TestTransportPool_HTTP3Disabled(t *testing.T) {
+	tp := NewTransportPool(netutil.MustParseAddrs([]string{"127.0.0.1"}), 5*time.Second)
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	if h3 := tp.http3For(netip.MustParseAddr("127.0.0.1"), req); h3 != nil {
+		t.Error("HTTP/3 used without WithHTTP3")
+	}
+}
@@ -8,6 +8,9 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -15,6 +18,7 @@ import (
 	"github.com/cr0hn/outbound-lb/internal/config"
 	"github.com/cr0hn/outbound-lb/internal/limiter"
 	"github.com/cr0hn/outbound-lb/internal/metrics"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
 )
 
 func createTestProxyServer(t *testing.T, auth string, maxPerIP, maxTotal int) (*Server, func()) {
@@ -34,10 +38,10 @@ func createTestProxyServer(t *testing.T, auth string, maxPerIP, maxTotal int) (*
 		LogFormat:     "json",
 	}
 
-	stats := metrics.NewStatsCollector(cfg.IPs)
-	lim := limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, cfg.IPs)
+	stats := metrics.NewStatsCollector(netutil.MustParseAddrs(cfg.IPs))
+	lim := limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, netutil.MustParseAddrs(cfg.IPs))
 	balCfg := balancer.Config{
-		IPs:           cfg.IPs,
+		IPs:           netutil.MustParseAddrs(cfg.IPs),
 		HistoryWindow: int64(cfg.HistoryWindow.Seconds()),
 		HistorySize:   cfg.HistorySize,
 		Limiter:       lim,
@@ -171,26 +175,26 @@ func TestProxy_ConnectionLimitingIntegration(t *testing.T) {
 
 	// Simulate acquiring connections
 	for i := 0; i < 2; i++ {
-		err := server.limiter.Acquire("127.0.0.1")
+		err := server.limiter.Acquire(netip.MustParseAddr("127.0.0.1"))
 		if err != nil {
 			t.Errorf("acquire %d should succeed: %v", i, err)
 		}
 	}
 
 	// Third should fail
-	err := server.limiter.Acquire("127.0.0.1")
+	err := server.limiter.Acquire(netip.MustParseAddr("127.0.0.1"))
 	if err != limiter.ErrIPLimitReached {
 		t.Errorf("expected ErrIPLimitReached, got: %v", err)
 	}
 
 	// Verify stats
-	if server.limiter.GetIPCount("127.0.0.1") != 2 {
-		t.Errorf("expected IP count 2, got %d", server.limiter.GetIPCount("127.0.0.1"))
+	if server.limiter.GetIPCount(netip.MustParseAddr("127.0.0.1")) != 2 {
+		t.Errorf("expected IP count 2, got %d", server.limiter.GetIPCount(netip.MustParseAddr("127.0.0.1")))
 	}
 
 	// Release and retry
-	server.limiter.Release("127.0.0.1")
-	err = server.limiter.Acquire("127.0.0.1")
+	server.limiter.Release(netip.MustParseAddr("127.0.0.1"))
+	err = server.limiter.Acquire(netip.MustParseAddr("127.0.0.1"))
 	if err != nil {
 		t.Errorf("acquire after release should succeed: %v", err)
 	}
@@ -201,11 +205,11 @@ func TestProxy_BalancerIntegration(t *testing.T) {
 	defer cleanup()
 
 	// Test IP selection
-	ip, err := server.selectIP("example.com")
+	ip, err := server.selectIP(context.Background(), "example.com")
 	if err != nil {
 		t.Errorf("selectIP should succeed: %v", err)
 	}
-	if ip != "127.0.0.1" {
+	if ip != netip.MustParseAddr("127.0.0.1") {
 		t.Errorf("expected 127.0.0.1, got %s", ip)
 	}
 
@@ -223,13 +227,13 @@ func TestProxy_TransportPoolIntegration(t *testing.T) {
 	defer cleanup()
 
 	// Get transport for known IP
-	transport1 := server.transportPool.Get("127.0.0.1")
+	transport1 := server.transportPool.Get(netip.MustParseAddr("127.0.0.1"))
 	if transport1 == nil {
 		t.Error("expected non-nil transport")
 	}
 
 	// Get same transport again
-	transport2 := server.transportPool.Get("127.0.0.1")
+	transport2 := server.transportPool.Get(netip.MustParseAddr("127.0.0.1"))
 	if transport1 != transport2 {
 		t.Error("expected same transport instance")
 	}
@@ -257,24 +261,31 @@ func TestProxy_WaitForConnections(t *testing.T) {
 	defer cleanup()
 
 	// Simulate active connection
-	server.limiter.Acquire("127.0.0.1")
+	server.limiter.Acquire(netip.MustParseAddr("127.0.0.1"))
 
 	// Wait should timeout since we have a connection
 	start := time.Now()
-	server.WaitForConnections(100 * time.Millisecond)
+	drained := server.WaitForConnections(100 * time.Millisecond)
 	elapsed := time.Since(start)
 
+	if drained {
+		t.Error("WaitForConnections reported drained with an active connection")
+	}
 	if elapsed < 100*time.Millisecond {
 		t.Errorf("WaitForConnections returned too quickly: %v", elapsed)
 	}
 
 	// Release and wait again
-	server.limiter.Release("127.0.0.1")
+	server.limiter.Release(netip.MustParseAddr("127.0.0.1"))
 
 	start = time.Now()
-	server.WaitForConnections(5 * time.Second)
+	drained = server.WaitForConnections(5 * time.Second)
 	elapsed = time.Since(start)
 
+	if !drained {
+		t.Error("WaitForConnections reported a timeout after release")
+	}
+
 	// Should return quickly now
 	if elapsed > 500*time.Millisecond {
 		t.Errorf("WaitForConnections took too long after release: %v", elapsed)
@@ -332,10 +343,10 @@ func TestServer_Start(t *testing.T) {
 		LogFormat:     "json",
 	}
 
-	stats := metrics.NewStatsCollector(cfg.IPs)
-	lim := limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, cfg.IPs)
+	stats := metrics.NewStatsCollector(netutil.MustParseAddrs(cfg.IPs))
+	lim := limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, netutil.MustParseAddrs(cfg.IPs))
 	balCfg := balancer.Config{
-		IPs:           cfg.IPs,
+		IPs:           netutil.MustParseAddrs(cfg.IPs),
 		HistoryWindow: int64(cfg.HistoryWindow.Seconds()),
 		HistorySize:   cfg.HistorySize,
 		Limiter:       lim,
@@ -419,3 +430,54 @@ func TestHandler_RealBackend(t *testing.T) {
 	// this might actually work depending on the transport
 	t.Logf("Backend test response: %d", w.Code)
 }
+
+func TestServer_StartUnix(t *testing.T) {
+	server, cleanup := createTestProxyServer(t, "", 100, 1000)
+	defer cleanup()
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	server.cfg.ListenUnix = path
+	server.cfg.UnixSocketMode = "0600"
+	server.unixServer = server.newHTTPServer(0, NewHandler(server))
+	if !server.UnixEnabled() {
+		t.Fatal("expected unix listener to be enabled")
+	}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- server.StartUnix() }()
+	defer server.StopAccepting(context.Background())
+
+	backend := newTestBackend(t)
+	defer backend.Close()
+
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: "proxy"}),
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+
+	// The listener may not be up yet
+	var resp *http.Response
+	var err error
+	for range 50 {
+		if resp, err = client.Get(backend.URL); err == nil {
+			break
+		}
+		select {
+		case startErr := <-errCh:
+			t.Fatalf("StartUnix() error = %v", startErr)
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	if err != nil {
+		t.Fatalf("request through unix socket failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200, got %d", resp.StatusCode)
+	}
+}
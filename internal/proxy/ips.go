@@ -0,0 +1,154 @@
+// Package proxy provides the HTTP/HTTPS proxy server.
+package proxy
+
+import (
+	"net/netip"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/logger"
+)
+
+// drainPollInterval is how often a removed IP is checked for open connections.
+const drainPollInterval = 500 * time.Millisecond
+
+// UpdateIPs makes ips the set of local outbound IPs at runtime, adding and
+// removing IPs as needed. Returns the IPs added and removed.
+func (s *Server) UpdateIPs(ips []netip.Addr) (added, removed []netip.Addr) {
+	s.ipsMu.Lock()
+	defer s.ipsMu.Unlock()
+
+	s.localIPs = slices.Clone(ips)
+	return s.applyIPs()
+}
+
+// SetRemoteIPs makes upstreams the set of outbound IPs owned by agents,
+// reached through the agent proxy each one maps to. Local IPs take precedence
+// over remote ones. Returns the IPs added and removed.
+func (s *Server) SetRemoteIPs(upstreams map[netip.Addr]*url.URL) (added, removed []netip.Addr) {
+	s.ipsMu.Lock()
+	defer s.ipsMu.Unlock()
+
+	s.remote = upstreams
+	return s.applyIPs()
+}
+
+// applyIPs makes the union of the local and remote IPs the set of outbound
+// IPs. Must be called with ipsMu held.
+func (s *Server) applyIPs() (added, removed []netip.Addr) {
+	ips := slices.Clone(s.localIPs)
+	var remote []netip.Addr
+	for ip := range s.remote {
+		if !slices.Contains(s.localIPs, ip) {
+			remote = append(remote, ip)
+		}
+	}
+	slices.SortFunc(remote, netip.Addr.Compare)
+	ips = append(ips, remote...)
+
+	for _, ip := range remote {
+		s.transportPool.SetUpstream(ip, s.remote[ip])
+	}
+	for _, ip := range s.localIPs {
+		s.transportPool.SetUpstream(ip, nil)
+	}
+
+	for _, ip := range ips {
+		if !slices.Contains(s.ips, ip) {
+			added = append(added, ip)
+		}
+	}
+	for _, ip := range s.ips {
+		if !slices.Contains(ips, ip) {
+			removed = append(removed, ip)
+		}
+	}
+
+	for _, ip := range removed {
+		s.RemoveIP(ip)
+	}
+	for _, ip := range added {
+		s.AddIP(ip)
+	}
+	s.ips = slices.Clone(ips)
+	s.dualStack.Store(hasBothFamilies(ips))
+	return added, removed
+}
+
+// AddIP starts using ip for outbound connections at runtime. Adding an IP
+// that is still draining after removal keeps it.
+func (s *Server) AddIP(ip netip.Addr) {
+	s.drainMu.Lock()
+	if stop, ok := s.draining[ip]; ok {
+		close(stop)
+		delete(s.draining, ip)
+	}
+	s.drainMu.Unlock()
+
+	s.limiter.AddIP(ip)
+	s.stats.AddIP(ip)
+	s.transportPool.AddIP(ip)
+	s.balancer.AddIP(ip)
+	logger.Info("ip_added", "ip", ip)
+}
+
+// RemoveIP stops selecting ip for new connections at runtime. Connections
+// already bound to it are left to finish; once none remain, its transport,
+// connection limit, stats and circuit state are dropped.
+func (s *Server) RemoveIP(ip netip.Addr) {
+	s.balancer.RemoveIP(ip)
+
+	stop := make(chan struct{})
+	s.drainMu.Lock()
+	if prev, ok := s.draining[ip]; ok {
+		close(prev)
+	}
+	s.draining[ip] = stop
+	s.drainMu.Unlock()
+
+	logger.Info("ip_draining", "ip", ip, "connections", s.limiter.GetIPCount(ip))
+	go s.drain(ip, stop)
+}
+
+// drain waits for the connections through a removed ip to finish and then
+// releases its resources, unless stop is closed first.
+func (s *Server) drain(ip netip.Addr, stop chan struct{}) {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for s.limiter.GetIPCount(ip) > 0 {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+
+	s.drainMu.Lock()
+	if s.draining[ip] != stop {
+		// Re-added or removed again in the meantime
+		s.drainMu.Unlock()
+		return
+	}
+	delete(s.draining, ip)
+	s.drainMu.Unlock()
+
+	s.transportPool.RemoveIP(ip)
+	s.limiter.RemoveIP(ip)
+	s.stats.RemoveIP(ip)
+	if s.circuitBreaker != nil {
+		s.circuitBreaker.Reset(ip)
+	}
+	logger.Info("ip_drained", "ip", ip)
+}
+
+// stopDrains abandons all pending drains.
+func (s *Server) stopDrains() {
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+	for ip, stop := range s.draining {
+		close(stop)
+		delete(s.draining, ip)
+	}
+}
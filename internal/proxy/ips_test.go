@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
+)
+
+// waitDrained waits until ip is no longer draining on s.
+func waitDrained(t *testing.T, s *Server, ip string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		s.drainMu.Lock()
+		_, draining := s.draining[netip.MustParseAddr(ip)]
+		s.drainMu.Unlock()
+		if !draining {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s still draining", ip)
+}
+
+func TestServer_UpdateIPs(t *testing.T) {
+	server := newTestServerWithIPs(t, []string{"127.0.0.1"})
+	defer server.stopDrains()
+
+	added, removed := server.UpdateIPs(netutil.MustParseAddrs([]string{"127.0.0.1", "127.0.0.2"}))
+	if !slices.Equal(added, netutil.MustParseAddrs([]string{"127.0.0.2"})) || len(removed) != 0 {
+		t.Fatalf("unexpected diff: added %v, removed %v", added, removed)
+	}
+	if _, ok := server.stats.GetStats().SelectionsPerIP["127.0.0.2"]; !ok {
+		t.Error("expected added IP in stats")
+	}
+
+	// A connection is still open through the IP being removed
+	if err := server.limiter.Acquire(netip.MustParseAddr("127.0.0.1")); err != nil {
+		t.Fatalf("Acquire() error: %v", err)
+	}
+	added, removed = server.UpdateIPs(netutil.MustParseAddrs([]string{"127.0.0.2"}))
+	if len(added) != 0 || !slices.Equal(removed, netutil.MustParseAddrs([]string{"127.0.0.1"})) {
+		t.Fatalf("unexpected diff: added %v, removed %v", added, removed)
+	}
+
+	for i := 0; i < 5; i++ {
+		ip, err := server.selectIP(context.Background(), "example.com")
+		if err != nil {
+			t.Fatalf("selectIP() error: %v", err)
+		}
+		if ip != netip.MustParseAddr("127.0.0.2") {
+			t.Fatalf("expected removed IP not to be selected, got %s", ip)
+		}
+	}
+
+	time.Sleep(2 * drainPollInterval)
+	if _, ok := server.stats.GetStats().SelectionsPerIP["127.0.0.1"]; !ok {
+		t.Error("expected removed IP to be kept while its connection is open")
+	}
+
+	server.limiter.Release(netip.MustParseAddr("127.0.0.1"))
+	waitDrained(t, server, "127.0.0.1")
+	if _, ok := server.stats.GetStats().SelectionsPerIP["127.0.0.1"]; ok {
+		t.Error("expected drained IP to be dropped from stats")
+	}
+}
+
+func TestServer_UpdateIPs_ReAddWhileDraining(t *testing.T) {
+	server := newTestServerWithIPs(t, []string{"127.0.0.1", "127.0.0.2"})
+	defer server.stopDrains()
+
+	if err := server.limiter.Acquire(netip.MustParseAddr("127.0.0.1")); err != nil {
+		t.Fatalf("Acquire() error: %v", err)
+	}
+	server.UpdateIPs(netutil.MustParseAddrs([]string{"127.0.0.2"}))
+	server.UpdateIPs(netutil.MustParseAddrs([]string{"127.0.0.1", "127.0.0.2"}))
+
+	waitDrained(t, server, "127.0.0.1")
+	server.limiter.Release(netip.MustParseAddr("127.0.0.1"))
+	time.Sleep(2 * drainPollInterval)
+
+	if _, ok := server.stats.GetStats().SelectionsPerIP["127.0.0.1"]; !ok {
+		t.Error("expected re-added IP to be kept")
+	}
+	if server.limiter.GetIPCount(netip.MustParseAddr("127.0.0.1")) != 0 {
+		t.Errorf("expected count 0, got %d", server.limiter.GetIPCount(netip.MustParseAddr("127.0.0.1")))
+	}
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/cr0hn/outbound-lb/internal/config"
+	"github.com/cr0hn/outbound-lb/internal/logger"
+)
+
+// noAuthKey is the context key marking connections accepted on a listener
+// that does not require authentication.
+type noAuthKey struct{}
+
+// listenerNoAuth reports whether ctx belongs to a connection accepted on a
+// listener that does not require authentication.
+func listenerNoAuth(ctx context.Context) bool {
+	noAuth, _ := ctx.Value(noAuthKey{}).(bool)
+	return noAuth
+}
+
+// extraListener is an additional proxy listener from the listeners setting.
+type extraListener struct {
+	cfg    config.Listener
+	server *http.Server
+	cert   atomic.Pointer[tls.Certificate]
+}
+
+// newExtraListeners creates the servers of the additional listeners, serving
+// handler.
+func (s *Server) newExtraListeners(handler http.Handler) {
+	for _, lc := range s.cfg.Listeners {
+		l := &extraListener{cfg: lc, server: s.newHTTPServer(0, handler)}
+		l.server.Addr = lc.Address
+		if lc.NoAuth {
+			connContext := l.server.ConnContext
+			l.server.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+				return context.WithValue(connContext(ctx, c), noAuthKey{}, true)
+			}
+		}
+		s.listeners = append(s.listeners, l)
+	}
+}
+
+// ListenerAddrs returns the addresses of the additional listeners.
+func (s *Server) ListenerAddrs() []string {
+	addrs := make([]string, len(s.listeners))
+	for i, l := range s.listeners {
+		addrs[i] = l.cfg.Address
+	}
+	return addrs
+}
+
+// StartListener listens on the additional listener with address addr and
+// serves proxy clients on it.
+func (s *Server) StartListener(addr string) error {
+	var l *extraListener
+	for _, candidate := range s.listeners {
+		if candidate.cfg.Address == addr {
+			l = candidate
+		}
+	}
+	if l == nil {
+		return fmt.Errorf("no listener configured on %s", addr)
+	}
+
+	ln, err := s.Listen(addr)
+	if err != nil {
+		return err
+	}
+	return s.serveListener(l, ln)
+}
+
+// serveListener serves proxy clients of the additional listener l on ln.
+func (s *Server) serveListener(l *extraListener, ln net.Listener) error {
+	tlsEnabled := l.cfg.TLSCert != ""
+	logger.Info("starting proxy listener",
+		"addr", l.cfg.Address,
+		"auth_enabled", s.AuthRequired() && !l.cfg.NoAuth,
+		"tls", tlsEnabled,
+	)
+	ln = s.ProxyProtocolListener(ln)
+
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	if s.cfg.HTTP2 {
+		protocols.SetHTTP2(tlsEnabled)
+		protocols.SetUnencryptedHTTP2(!tlsEnabled)
+	}
+	l.server.Protocols = &protocols
+
+	if tlsEnabled {
+		if err := l.reloadTLS(); err != nil {
+			ln.Close()
+			return err
+		}
+		l.server.TLSConfig = s.listenerTLSConfig(l)
+		return l.server.ServeTLS(ln, "", "")
+	}
+	return l.server.Serve(ln)
+}
+
+// ReloadListenerTLS reloads the certificates of the additional listeners
+// served over TLS. On error the current pair of that listener is kept.
+func (s *Server) ReloadListenerTLS() error {
+	var firstErr error
+	for _, l := range s.listeners {
+		if l.cfg.TLSCert == "" {
+			continue
+		}
+		if err := l.reloadTLS(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// reloadTLS loads the certificate and key of l.
+func (l *extraListener) reloadTLS() error {
+	cert, err := tls.LoadX509KeyPair(l.cfg.TLSCert, l.cfg.TLSKey)
+	if err != nil {
+		return fmt.Errorf("loading certificate of listener %s: %w", l.cfg.Address, err)
+	}
+	l.cert.Store(&cert)
+	logger.Info("listener_certificate_loaded",
+		"listener", l.cfg.Address,
+		"cert", l.cfg.TLSCert,
+		"subject", cert.Leaf.Subject.String(),
+		"not_after", cert.Leaf.NotAfter,
+	)
+	return nil
+}
+
+// listenerTLSConfig returns the TLS configuration of l, serving whichever
+// certificate is current at handshake time.
+func (s *Server) listenerTLSConfig(l *extraListener) *tls.Config {
+	protos := []string{"http/1.1"}
+	if s.cfg.HTTP2 {
+		protos = []string{"h2", "http/1.1"}
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: protos,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert := l.cert.Load()
+			if cert == nil {
+				return nil, errNoListenerCert
+			}
+			return cert, nil
+		},
+	}
+}
+
+// stopListeners closes the additional listeners and waits for their in-flight
+// HTTP requests.
+func (s *Server) stopListeners(ctx context.Context) {
+	for _, l := range s.listeners {
+		if err := l.server.Shutdown(ctx); err != nil {
+			logger.Error("listener shutdown error", "addr", l.cfg.Address, "error", err)
+		}
+	}
+}
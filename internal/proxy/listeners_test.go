@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/cr0hn/outbound-lb/internal/config"
+)
+
+// startExtraListener serves the additional listener l of s on a free
+// loopback port and returns its address.
+func startExtraListener(t *testing.T, s *Server, l *extraListener) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.serveListener(l, ln)
+	t.Cleanup(func() { l.server.Close() })
+	return ln.Addr().String()
+}
+
+func TestServer_Listeners(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	certFile, keyFile := writeTestCert(t, t.TempDir(), "listener")
+	opts := DefaultTestServerOptions()
+	opts.Auth = "user:pass"
+	s := newTestServerWithOptions(t, opts)
+	s.cfg.Listeners = []config.Listener{
+		{Address: "127.0.0.1:3129", NoAuth: true},
+		{Address: "127.0.0.1:3130", TLSCert: certFile, TLSKey: keyFile},
+	}
+	s.newExtraListeners(NewHandler(s))
+	if got := s.ListenerAddrs(); len(got) != 2 || got[0] != "127.0.0.1:3129" || got[1] != "127.0.0.1:3130" {
+		t.Fatalf("ListenerAddrs() = %v", got)
+	}
+	plainAddr := startExtraListener(t, s, s.listeners[0])
+	tlsAddr := startExtraListener(t, s, s.listeners[1])
+
+	get := func(proxyURL *url.URL) int {
+		t.Helper()
+		client := &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyURL),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}}
+		resp, err := client.Get(backend.URL)
+		if err != nil {
+			t.Fatalf("request through %s: %v", proxyURL.Host, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// The no_auth listener needs no credentials
+	if status := get(&url.URL{Scheme: "http", Host: plainAddr}); status != http.StatusOK {
+		t.Errorf("no_auth listener status = %d, want 200", status)
+	}
+
+	// The TLS listener keeps the proxy credentials
+	if status := get(&url.URL{Scheme: "https", Host: tlsAddr}); status != http.StatusProxyAuthRequired {
+		t.Errorf("TLS listener without credentials status = %d, want 407", status)
+	}
+	if status := get(&url.URL{Scheme: "https", Host: tlsAddr, User: url.UserPassword("user", "pass")}); status != http.StatusOK {
+		t.Errorf("TLS listener with credentials status = %d, want 200", status)
+	}
+}
+
+func TestServer_StartListener_Unknown(t *testing.T) {
+	s := newTestServerWithOptions(t, DefaultTestServerOptions())
+	if err := s.StartListener("127.0.0.1:3129"); err == nil {
+		t.Error("StartListener() on an unconfigured address should fail")
+	}
+}
+
+func TestServer_ReloadListenerTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "listener-1")
+	s := newTestServerWithOptions(t, DefaultTestServerOptions())
+	s.cfg.Listeners = []config.Listener{
+		{Address: "127.0.0.1:3129"},
+		{Address: "127.0.0.1:3130", TLSCert: certFile, TLSKey: keyFile},
+	}
+	s.newExtraListeners(NewHandler(s))
+	addr := startExtraListener(t, s, s.listeners[1])
+	if cn := handshake(t, addr).PeerCertificates[0].Subject.CommonName; cn != "listener-1" {
+		t.Fatalf("certificate CN = %q, want listener-1", cn)
+	}
+
+	// Plain listeners are skipped and the TLS one serves the rotated pair
+	writeTestCert(t, dir, "listener-2")
+	if err := s.ReloadListenerTLS(); err != nil {
+		t.Fatalf("ReloadListenerTLS() error = %v", err)
+	}
+	if cn := handshake(t, addr).PeerCertificates[0].Subject.CommonName; cn != "listener-2" {
+		t.Errorf("certificate CN after reload = %q, want listener-2", cn)
+	}
+
+	// A broken pair keeps the current certificate
+	if err := os.WriteFile(keyFile, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ReloadListenerTLS(); err == nil {
+		t.Error("ReloadListenerTLS() with a broken key should fail")
+	}
+	if cn := handshake(t, addr).PeerCertificates[0].Subject.CommonName; cn != "listener-2" {
+		t.Errorf("certificate CN after failed reload = %q, want listener-2", cn)
+	}
+}
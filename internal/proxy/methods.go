@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+)
+
+// AllowMethod reports whether the client of ctx may send requests with
+// method: it must not be in denied_methods and must be in the user's methods
+// or, for users without them, in allowed_methods when set. Refused requests
+// are counted and recorded as rejections of client.
+func (s *Server) AllowMethod(ctx context.Context, method, client, hostport string) bool {
+	allowed := s.cfg.AllowedMethods
+	if rule, ok := s.userRules[requestUser(ctx)]; ok && len(rule.Methods) > 0 {
+		allowed = rule.Methods
+	}
+	if !containsMethod(s.cfg.DeniedMethods, method) && (len(allowed) == 0 || containsMethod(allowed, method)) {
+		return true
+	}
+	metrics.MethodRejections.WithLabelValues(method).Inc()
+	s.Reject(method, client, hostport, RejectMethod, http.StatusMethodNotAllowed, netip.Addr{})
+	return false
+}
+
+// containsMethod reports whether methods lists method, ignoring case.
+func containsMethod(methods []string, method string) bool {
+	return slices.ContainsFunc(methods, func(m string) bool { return strings.EqualFold(m, method) })
+}
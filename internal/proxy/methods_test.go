@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/cr0hn/outbound-lb/internal/balancer"
+	"github.com/cr0hn/outbound-lb/internal/config"
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+)
+
+func TestServer_AllowMethod(t *testing.T) {
+	server := newTestServer(t)
+	server.cfg.AllowedMethods = []string{"GET", "POST", "CONNECT", "TRACE"}
+	server.cfg.DeniedMethods = []string{"TRACE"}
+	server.userRules = map[string]config.UserRule{
+		"reader": {Name: "reader", Methods: []string{"GET"}},
+		"admin":  {Name: "admin", Methods: []string{"GET", "DELETE", "TRACE"}},
+	}
+
+	anonymous := balancer.ContextWithClient(context.Background(), "10.0.0.1")
+	reader := balancer.ContextWithClient(context.Background(), "user:reader")
+	admin := balancer.ContextWithClient(context.Background(), "user:admin")
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		method string
+		want   bool
+	}{
+		{"allowed method", anonymous, http.MethodPost, true},
+		{"case insensitive", anonymous, "connect", true},
+		{"method not allowed", anonymous, http.MethodDelete, false},
+		{"denied method", anonymous, http.MethodTrace, false},
+		{"user methods replace allowed", reader, http.MethodPost, false},
+		{"user method", admin, http.MethodDelete, true},
+		{"denied method wins over user methods", admin, http.MethodTrace, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := server.AllowMethod(tt.ctx, tt.method, "10.0.0.1", "example.com"); got != tt.want {
+				t.Errorf("AllowMethod(%s) = %v, want %v", tt.method, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandler_MethodDenied(t *testing.T) {
+	server := newTestServer(t)
+	server.cfg.DeniedMethods = []string{"TRACE"}
+	server.rejections = NewRejectionLog(10)
+	handler := NewHandler(server)
+
+	rejected := testutil.ToFloat64(metrics.MethodRejections.WithLabelValues(http.MethodTrace))
+	req := newTestRequest(t, http.MethodTrace, "http://example.com/")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	assertStatusCode(t, w, http.StatusMethodNotAllowed)
+	if got := testutil.ToFloat64(metrics.MethodRejections.WithLabelValues(http.MethodTrace)) - rejected; got != 1 {
+		t.Errorf("method rejections = %v, want 1", got)
+	}
+	if r := server.Rejections(); len(r) != 1 || r[0].Reason != RejectMethod {
+		t.Errorf("rejections = %+v, want one method rejection", r)
+	}
+}
@@ -0,0 +1,18 @@
+package proxy
+
+import (
+	"context"
+
+	"github.com/cr0hn/outbound-lb/internal/limiter"
+)
+
+// priority returns the connection priority of the client of ctx: the
+// priority of its user rule, or default_priority.
+func (s *Server) priority(ctx context.Context) limiter.Priority {
+	if rule, ok := s.userRules[requestUser(ctx)]; ok && rule.Priority != "" {
+		p, _ := limiter.ParsePriority(rule.Priority)
+		return p
+	}
+	p, _ := limiter.ParsePriority(s.cfg.DefaultPriority)
+	return p
+}
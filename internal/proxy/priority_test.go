@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/cr0hn/outbound-lb/internal/config"
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+)
+
+func TestHandler_ReservedConnections(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.Close()
+
+	opts := DefaultTestServerOptions()
+	opts.Auth = "ops:pass"
+	opts.MaxConnsTotal = 2
+	server := newTestServerWithOptions(t, opts)
+	server.cfg.DefaultPriority = "low"
+	server.limiter.SetReserved(1, 0)
+	server.rejections = NewRejectionLog(10)
+	handler := NewHandler(server)
+
+	// Bulk traffic holds the only unreserved slot
+	if err := server.limiter.Acquire(netip.MustParseAddr("127.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	defer server.limiter.Release(netip.MustParseAddr("127.0.0.1"))
+
+	get := func() int {
+		t.Helper()
+		req := newTestRequest(t, http.MethodGet, backend.URL+"/")
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("ops:pass")))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	before := testutil.ToFloat64(metrics.PriorityRejections.WithLabelValues("low"))
+
+	if code := get(); code != http.StatusServiceUnavailable {
+		t.Errorf("low-priority status = %d, want 503", code)
+	}
+
+	// The user's own priority replaces the default
+	server.setUserRules([]config.UserRule{{Name: "ops", Priority: "high"}})
+	if code := get(); code != http.StatusOK {
+		t.Errorf("high-priority status = %d, want 200", code)
+	}
+
+	if got := testutil.ToFloat64(metrics.PriorityRejections.WithLabelValues("low")) - before; got != 1 {
+		t.Errorf("low-priority rejections = %v, want 1", got)
+	}
+	rejections := server.Rejections()
+	if len(rejections) != 1 || rejections[0].Reason != RejectReserved {
+		t.Errorf("rejections = %+v, want one reserved rejection", rejections)
+	}
+}
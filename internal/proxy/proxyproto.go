@@ -0,0 +1,103 @@
+// Package proxy provides the HTTP/HTTPS proxy server.
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+
+	"github.com/cr0hn/outbound-lb/internal/config"
+	"github.com/cr0hn/outbound-lb/internal/logger"
+	"github.com/cr0hn/outbound-lb/internal/proxyproto"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
+)
+
+// clientAddrKey is the context key for the client's network address.
+type clientAddrKey struct{}
+
+// ContextWithClientAddr returns a new context carrying the address of the
+// client connection, announced to upstreams that expect PROXY protocol.
+func ContextWithClientAddr(ctx context.Context, addr net.Addr) context.Context {
+	return context.WithValue(ctx, clientAddrKey{}, addr)
+}
+
+// ClientAddrFromContext returns the client address attached to ctx, or nil.
+func ClientAddrFromContext(ctx context.Context) net.Addr {
+	addr, _ := ctx.Value(clientAddrKey{}).(net.Addr)
+	return addr
+}
+
+// parseClientAddr parses an http.Request RemoteAddr, returning nil if it is
+// not an IP and port.
+func parseClientAddr(remoteAddr string) net.Addr {
+	ap, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.TCPAddrFromAddrPort(ap)
+}
+
+// proxyProtocolRule is a config.ProxyProtocolRule with its matcher prepared.
+type proxyProtocolRule struct {
+	host    netutil.HostPattern
+	version int
+}
+
+// ProxyProtocolRules selects the destinations whose upstream connections
+// start with a PROXY protocol header.
+type ProxyProtocolRules struct {
+	rules []proxyProtocolRule
+}
+
+// NewProxyProtocolRules creates ProxyProtocolRules from the configured rules.
+// Rules are evaluated in order; the first match wins. Invalid rules are
+// skipped (Config.Validate rejects them).
+func NewProxyProtocolRules(rules []config.ProxyProtocolRule) *ProxyProtocolRules {
+	pr := &ProxyProtocolRules{rules: make([]proxyProtocolRule, 0, len(rules))}
+	for i, rule := range rules {
+		host, err := netutil.CompileHostPattern(rule.Host, rule.Regex)
+		if err != nil {
+			logger.Warn("proxy_protocol_rule_invalid", "index", i, "error", err)
+			continue
+		}
+		pr.rules = append(pr.rules, proxyProtocolRule{host: host, version: rule.Version})
+	}
+	return pr
+}
+
+// Version returns the PROXY protocol version to send to hostport, or 0 if no
+// rule matches.
+func (pr *ProxyProtocolRules) Version(hostport string) int {
+	if pr == nil || len(pr.rules) == 0 {
+		return 0
+	}
+
+	host := netutil.HostOf(hostport)
+	for _, rule := range pr.rules {
+		if rule.host.Match(host) {
+			return rule.version
+		}
+	}
+	return 0
+}
+
+// proxyHeaderVersion returns the PROXY protocol version to send on
+// connections to hostport through ip, or 0 for none. Connections through
+// agent IPs are opened by the agent and never carry a header.
+func (s *Server) proxyHeaderVersion(hostport string, ip netip.Addr) int {
+	if s.transportPool.Upstream(ip) != nil {
+		return 0
+	}
+	return s.proxyProtocol.Version(hostport)
+}
+
+// writeProxyHeader sends the PROXY protocol header announcing a connection
+// from client to the remote end of conn.
+func writeProxyHeader(conn net.Conn, version int, client net.Addr) error {
+	header, err := proxyproto.Header(version, client, conn.RemoteAddr())
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(header)
+	return err
+}
@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/cr0hn/outbound-lb/internal/config"
+)
+
+func TestProxyProtocolRules_Version(t *testing.T) {
+	pr := NewProxyProtocolRules([]config.ProxyProtocolRule{
+		{Host: "*.edge.example.com", Version: 2},
+		{Regex: `^origin[0-9]+\.example\.com$`, Version: 1},
+	})
+
+	tests := []struct {
+		hostport string
+		want     int
+	}{
+		{"a.edge.example.com:443", 2},
+		{"A.EDGE.example.com", 2},
+		{"origin7.example.com:80", 1},
+		{"edge.example.com:443", 0},
+		{"other.example.com", 0},
+	}
+	for _, tt := range tests {
+		if got := pr.Version(tt.hostport); got != tt.want {
+			t.Errorf("Version(%q) = %d, want %d", tt.hostport, got, tt.want)
+		}
+	}
+
+	var empty *ProxyProtocolRules
+	if got := empty.Version("a.edge.example.com"); got != 0 {
+		t.Errorf("nil rules Version() = %d, want 0", got)
+	}
+}
+
+// proxyProtocolTarget accepts connections, reads a PROXY protocol v1 header
+// from each and hands the header and connection to serve.
+func proxyProtocolTarget(t *testing.T, serve func(header string, conn net.Conn, br *bufio.Reader)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				header, err := br.ReadString('\n')
+				if err != nil {
+					return
+				}
+				serve(header, conn, br)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// startProxy serves s on a loopback listener and returns its address.
+func startProxy(t *testing.T, s *Server) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+	t.Cleanup(func() { s.httpServer.Close() })
+	return ln.Addr().String()
+}
+
+func TestServer_UpstreamProxyProtocol_HTTP(t *testing.T) {
+	// Replies with the PROXY header the connection started with
+	target := proxyProtocolTarget(t, func(header string, conn net.Conn, br *bufio.Reader) {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, req.Body)
+		body := strings.TrimSpace(header)
+		fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+	})
+	_, targetPort, _ := net.SplitHostPort(target)
+
+	s := newTestServerWithOptions(t, DefaultTestServerOptions())
+	s.proxyProtocol = NewProxyProtocolRules([]config.ProxyProtocolRule{{Host: "127.0.0.1", Version: 1}})
+	proxyAddr := startProxy(t, s)
+
+	proxyURL, _ := url.Parse("http://" + proxyAddr)
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	defer tr.CloseIdleConnections()
+
+	for i := 0; i < 2; i++ {
+		resp, err := (&http.Client{Transport: tr}).Get("http://" + target + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		// Every request gets a connection announcing its own client
+		fields := strings.Fields(string(body))
+		if len(fields) != 6 || fields[0] != "PROXY" || fields[1] != "TCP4" || fields[2] != "127.0.0.1" || fields[5] != targetPort {
+			t.Errorf("request %d: target got header %q", i+1, body)
+		}
+	}
+}
+
+func TestServer_UpstreamProxyProtocol_Connect(t *testing.T) {
+	headers := make(chan string, 1)
+	target := proxyProtocolTarget(t, func(header string, conn net.Conn, br *bufio.Reader) {
+		headers <- header
+		io.Copy(conn, br)
+	})
+
+	s := newTestServerWithOptions(t, DefaultTestServerOptions())
+	s.proxyProtocol = NewProxyProtocolRules([]config.ProxyProtocolRule{{Host: "127.0.0.1", Version: 1}})
+	proxyAddr := startProxy(t, s)
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT: %v %v", resp, err)
+	}
+
+	_, targetPort, _ := net.SplitHostPort(target)
+	_, clientPort, _ := net.SplitHostPort(conn.LocalAddr().String())
+	want := fmt.Sprintf("PROXY TCP4 127.0.0.1 127.0.0.1 %s %s\r\n", clientPort, targetPort)
+	if got := <-headers; got != want {
+		t.Errorf("target got header %q, want %q", got, want)
+	}
+
+	// The tunnel carries the client data after the header
+	io.WriteString(conn, "ping\n")
+	if line, _ := br.ReadString('\n'); line != "ping\n" {
+		t.Errorf("echo = %q, want %q", line, "ping\n")
+	}
+}
+
+func TestServer_InboundProxyProtocol(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Forwarded-For"))
+	}))
+	defer backend.Close()
+
+	s := newTestServerWithOptions(t, DefaultTestServerOptions())
+	s.proxyTrusted = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+	proxyAddr := startProxy(t, s)
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "PROXY TCP4 203.0.113.9 127.0.0.1 40000 3128\r\n")
+	fmt.Fprintf(conn, "GET %s/ HTTP/1.1\r\nHost: %s\r\n\r\n", backend.URL, backend.Listener.Addr())
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "203.0.113.9" {
+		t.Errorf("X-Forwarded-For = %q, want the client announced by the load balancer", body)
+	}
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"slices"
+
+	"github.com/cr0hn/outbound-lb/internal/balancer"
+	"github.com/cr0hn/outbound-lb/internal/limiter"
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+)
+
+// acquireOutbound selects an outbound IP for host and takes a connection slot
+// on it. When queue is set and the slot limits are reached, the request waits
+// in the connection queue, if enabled, for a slot to be released. An IP whose
+// unreserved slots are taken is skipped for the others. Errors are those of
+// selectIP and the limiter; ip is set for limiter errors.
+func (s *Server) acquireOutbound(ctx context.Context, host string, queue bool) (ip netip.Addr, release func(), err error) {
+	var waiter *limiter.Waiter
+	selectCtx, skipped := ctx, netip.Addr{}
+	for {
+		ip, err = s.selectIP(selectCtx, host)
+		if err == nil {
+			release, err = s.acquireIP(ctx, ip)
+			if err == nil {
+				break
+			}
+			if errors.Is(err, limiter.ErrIPReservedLimitReached) {
+				// Other IPs may still have unreserved slots
+				excluded := slices.Clip(balancer.ExcludedFromContext(selectCtx))
+				selectCtx = balancer.ContextWithExcluded(selectCtx, append(excluded, ip)...)
+				skipped = ip
+				continue
+			}
+		} else if skipped.IsValid() && errors.Is(err, balancer.ErrNoAvailableIPs) {
+			ip, err = skipped, limiter.ErrIPReservedLimitReached
+		}
+		if !queue || !s.queueable(err) {
+			break
+		}
+		if waiter == nil {
+			if waiter, _ = s.queue.Join(); waiter == nil {
+				break
+			}
+			metrics.QueueDepth.Inc()
+			// Try once more so that a release since the failure is not missed
+			continue
+		}
+		if waiter.Wait(ctx) != nil {
+			break
+		}
+		selectCtx, skipped = ctx, netip.Addr{}
+	}
+
+	if errors.Is(err, limiter.ErrReservedLimitReached) {
+		metrics.PriorityRejections.WithLabelValues(s.priority(ctx).String()).Inc()
+	}
+	if waiter != nil {
+		metrics.QueueDepth.Dec()
+		outcome := "acquired"
+		if err != nil {
+			outcome = "timeout"
+		}
+		metrics.QueueWait.WithLabelValues(outcome).Observe(waiter.Leave().Seconds())
+	}
+	return ip, release, err
+}
+
+// queueable reports whether a request failing with err may wait for a slot:
+// the slot limits are reached, or every outbound IP is at its limit.
+func (s *Server) queueable(err error) bool {
+	if isLimitError(err) {
+		return true
+	}
+	return errors.Is(err, balancer.ErrNoAvailableIPs) && s.limiter.GetTotalCount() > 0
+}
+
+// isLimitError reports whether err is a connection slot limit error.
+func isLimitError(err error) bool {
+	return errors.Is(err, limiter.ErrIPLimitReached) || errors.Is(err, limiter.ErrTotalLimitReached) ||
+		errors.Is(err, limiter.ErrReservedLimitReached)
+}
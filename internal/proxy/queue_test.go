@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/cr0hn/outbound-lb/internal/limiter"
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+)
+
+func TestHandler_QueueWaitsForSlot(t *testing.T) {
+	backend := newTestBackendWithHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	defer backend.Close()
+
+	server := newTestServerWithLimits(t, 10, 1)
+	server.queue = limiter.NewQueue(server.limiter, 1, 5*time.Second)
+	handler := NewHandler(server)
+	if err := server.limiter.Acquire(netip.MustParseAddr("127.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(50*time.Millisecond, func() { server.limiter.Release(netip.MustParseAddr("127.0.0.1")) })
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, backend.URL+"/", nil))
+	assertStatusCode(t, w, http.StatusOK)
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("request answered after %v, want it queued until the release", elapsed)
+	}
+
+	if got := testutil.ToFloat64(metrics.QueueDepth); got != 0 {
+		t.Errorf("queue depth = %v, want 0", got)
+	}
+	if len(server.Rejections()) != 0 {
+		t.Errorf("rejections = %+v, want none", server.Rejections())
+	}
+}
+
+func TestHandler_QueueTimeout(t *testing.T) {
+	server := newTestServerWithLimits(t, 10, 1)
+	server.queue = limiter.NewQueue(server.limiter, 1, 20*time.Millisecond)
+	handler := NewHandler(server)
+	if err := server.limiter.Acquire(netip.MustParseAddr("127.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	defer server.limiter.Release(netip.MustParseAddr("127.0.0.1"))
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newTestRequest(t, http.MethodGet, "http://example.com/"))
+	assertStatusCode(t, w, http.StatusServiceUnavailable)
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("request answered after %v, want it queued for the timeout", elapsed)
+	}
+
+	got := server.Rejections()
+	if len(got) != 1 || got[0].Reason != RejectTotalLimit {
+		t.Errorf("rejections = %+v, want one total_limit rejection", got)
+	}
+}
+
+func TestHandler_QueueFull(t *testing.T) {
+	server := newTestServerWithLimits(t, 10, 1)
+	server.queue = limiter.NewQueue(server.limiter, 1, time.Second)
+	handler := NewHandler(server)
+	if err := server.limiter.Acquire(netip.MustParseAddr("127.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	defer server.limiter.Release(netip.MustParseAddr("127.0.0.1"))
+	waiter, err := server.queue.Join()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer waiter.Leave()
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newTestRequest(t, http.MethodGet, "http://example.com/"))
+	assertStatusCode(t, w, http.StatusServiceUnavailable)
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("request answered after %v, want it refused right away", elapsed)
+	}
+}
+
+func TestServer_AcquireOutboundSkipsReservedIP(t *testing.T) {
+	opts := DefaultTestServerOptions()
+	opts.IPs = []string{"127.0.0.1", "127.0.0.2"}
+	opts.MaxConnsPerIP = 2
+	opts.MaxConnsTotal = 8
+	server := newTestServerWithOptions(t, opts)
+	server.cfg.DefaultPriority = "low"
+	server.limiter.SetReserved(4, 0) // low priority gets one slot per IP
+
+	// 127.0.0.1 has no unreserved slot left
+	held := netip.MustParseAddr("127.0.0.1")
+	if err := server.limiter.Acquire(held); err != nil {
+		t.Fatal(err)
+	}
+	defer server.limiter.Release(held)
+
+	ip, release, err := server.acquireOutbound(context.Background(), "example.com", false)
+	if err != nil {
+		t.Fatalf("acquireOutbound() error = %v", err)
+	}
+	defer release()
+	if want := netip.MustParseAddr("127.0.0.2"); ip != want {
+		t.Errorf("acquireOutbound() ip = %v, want %v", ip, want)
+	}
+
+	ip, _, err = server.acquireOutbound(context.Background(), "example.com", false)
+	if !errors.Is(err, limiter.ErrIPReservedLimitReached) || !ip.IsValid() {
+		t.Errorf("acquireOutbound() = %v, %v, want a reserved limit error on an IP", ip, err)
+	}
+}
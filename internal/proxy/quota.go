@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/netip"
+
+	"github.com/cr0hn/outbound-lb/internal/balancer"
+	"github.com/cr0hn/outbound-lb/internal/config"
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+	"github.com/cr0hn/outbound-lb/internal/quota"
+	"github.com/cr0hn/outbound-lb/internal/store"
+)
+
+// newQuotas returns the per-user quotas of cfg, counting the daily transfer
+// in st (in memory when nil), or nil when no quota is set.
+func newQuotas(cfg *config.Config, st store.Store) *quota.Quotas {
+	perUser := make(map[string]quota.Limits, len(cfg.Users))
+	for _, rule := range cfg.Users {
+		perUser[rule.Name] = quota.Limits{
+			MaxConns:          rule.MaxConns,
+			RequestsPerMinute: rule.MaxRequestsPerMinute,
+			BytesPerDay:       rule.MaxBytesPerDay,
+		}
+	}
+	q := quota.New(quota.Limits{
+		MaxConns:          cfg.UserMaxConns,
+		RequestsPerMinute: cfg.UserMaxRequestsPerMinute,
+		BytesPerDay:       cfg.UserMaxBytesPerDay,
+	}, perUser, st, cfg.SharedStatePrefix)
+	if !q.Enabled() {
+		return nil
+	}
+	return q
+}
+
+// AcquireQuota counts a request of the proxy user of ctx to host against its
+// quotas and takes one of its connections. It returns a function giving the
+// connection back, or the quota error after recording the rejection.
+// Anonymous clients have no quotas.
+func (s *Server) AcquireQuota(ctx context.Context, method, host string) (func(), error) {
+	user := requestUser(ctx)
+	if s.quotas == nil || user == "" {
+		return func() {}, nil
+	}
+	release, err := s.quotas.Acquire(user)
+	if err != nil {
+		metrics.UserQuotaRejections.WithLabelValues(user, quotaLabel(err)).Inc()
+		s.Reject(method, balancer.ClientFromContext(ctx), host, RejectQuota, QuotaStatus(err), netip.Addr{})
+		return nil, err
+	}
+	return release, nil
+}
+
+// QuotaStatus returns the HTTP status reported for a quota error: 403 once
+// the daily transfer quota is exhausted, 429 otherwise.
+func QuotaStatus(err error) int {
+	if errors.Is(err, quota.ErrBytesLimit) {
+		return http.StatusForbidden
+	}
+	return http.StatusTooManyRequests
+}
+
+// quotaLabel returns the quota label of a quota error in metrics.
+func quotaLabel(err error) string {
+	switch {
+	case errors.Is(err, quota.ErrConnLimit):
+		return "connections"
+	case errors.Is(err, quota.ErrRateLimit):
+		return "requests"
+	default:
+		return "bytes"
+	}
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/cr0hn/outbound-lb/internal/config"
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+)
+
+func TestHandler_UserQuotas(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.Close()
+
+	opts := DefaultTestServerOptions()
+	opts.Auth = "tenant:pass"
+	server := newTestServerWithOptions(t, opts)
+	server.cfg.UserMaxRequestsPerMinute = 1
+	server.cfg.Users = []config.UserRule{{Name: "tenant", MaxBytesPerDay: 1}}
+	server.quotas = newQuotas(server.cfg, nil)
+	handler := NewHandler(server)
+
+	get := func() int {
+		t.Helper()
+		req := newTestRequest(t, http.MethodGet, backend.URL+"/")
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("tenant:pass")))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	rejected := func(quota string) float64 {
+		return testutil.ToFloat64(metrics.UserQuotaRejections.WithLabelValues("tenant", quota))
+	}
+
+	if code := get(); code != http.StatusOK {
+		t.Fatalf("first request status = %d, want 200", code)
+	}
+
+	// The first response used up the transfer quota of the day
+	bytes := rejected("bytes")
+	if code := get(); code != http.StatusForbidden {
+		t.Errorf("status over the transfer quota = %d, want 403", code)
+	}
+	if rejected("bytes")-bytes != 1 {
+		t.Error("transfer quota rejection not counted")
+	}
+
+	// Without a transfer quota, the rate limit applies
+	server.cfg.Users = nil
+	server.quotas = newQuotas(server.cfg, nil)
+	get()
+	requests := rejected("requests")
+	if code := get(); code != http.StatusTooManyRequests {
+		t.Errorf("status over the rate limit = %d, want 429", code)
+	}
+	if rejected("requests")-requests != 1 {
+		t.Error("rate limit rejection not counted")
+	}
+	if r := server.Rejections()[0]; r.Reason != RejectQuota || r.Status != http.StatusTooManyRequests {
+		t.Errorf("unexpected rejection: %+v", r)
+	}
+}
+
+func TestNewQuotas_Disabled(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Users = []config.UserRule{{Name: "tenant", Pool: "residential"}}
+	if newQuotas(cfg, nil) != nil {
+		t.Error("newQuotas() returned quotas without limits")
+	}
+}
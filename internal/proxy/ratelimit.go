@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+	"github.com/cr0hn/outbound-lb/internal/ratelimit"
+)
+
+// WaitRate waits for the turn of a request to hostport under the global and
+// per-destination request rates. Requests that would wait longer than
+// rate_limit_max_wait, or while rate_limit_max_waiters requests wait, are
+// counted and recorded as rejections of client, and the ratelimit error is
+// returned. The error of ctx is returned if it ends while waiting, and the
+// turn of the request goes back to the others.
+func (s *Server) WaitRate(ctx context.Context, method, client, hostport string) error {
+	res, err := s.rateLimit.Reserve(strings.ToLower(addrHost(hostport)))
+	if err != nil {
+		scope := "host"
+		switch {
+		case errors.Is(err, ratelimit.ErrGlobalLimit):
+			scope = "global"
+		case errors.Is(err, ratelimit.ErrTooManyWaiters):
+			scope = "waiters"
+		}
+		metrics.RateLimited.WithLabelValues(scope).Inc()
+		s.Reject(method, client, hostport, RejectRateLimit, http.StatusTooManyRequests, netip.Addr{})
+		return err
+	}
+	if res == nil {
+		return nil
+	}
+
+	metrics.RateLimitWait.Observe(res.Delay().Seconds())
+	timer := time.NewTimer(res.Delay())
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		res.Done()
+		return nil
+	case <-ctx.Done():
+		res.Cancel()
+		return ctx.Err()
+	}
+}
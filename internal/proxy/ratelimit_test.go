@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+	"github.com/cr0hn/outbound-lb/internal/ratelimit"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestHandler_HostRateLimit(t *testing.T) {
+	backend := newTestBackendWithHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	defer backend.Close()
+
+	server := newTestServerWithIPs(t, []string{"127.0.0.1"})
+	server.rateLimit = ratelimit.New(0, 1, 0, 0)
+	server.rejections = NewRejectionLog(10)
+	handler := NewHandler(server)
+	before := testutil.ToFloat64(metrics.RateLimited.WithLabelValues("host"))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, backend.URL+"/", nil))
+	assertStatusCode(t, w, http.StatusOK)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, backend.URL+"/", nil))
+	assertStatusCode(t, w, http.StatusTooManyRequests)
+	if got := w.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After = %q, want 1", got)
+	}
+
+	if got := testutil.ToFloat64(metrics.RateLimited.WithLabelValues("host")) - before; got != 1 {
+		t.Errorf("rate limited = %v, want 1", got)
+	}
+	rejections := server.Rejections()
+	if len(rejections) != 1 || rejections[0].Reason != RejectRateLimit || rejections[0].Status != http.StatusTooManyRequests {
+		t.Errorf("rejections = %+v, want one rate_limit rejection", rejections)
+	}
+}
+
+func TestHandler_RateLimitWait(t *testing.T) {
+	backend := newTestBackendWithHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	defer backend.Close()
+
+	server := newTestServerWithIPs(t, []string{"127.0.0.1"})
+	server.rateLimit = ratelimit.New(10, 0, time.Second, 0)
+	handler := NewHandler(server)
+
+	start := time.Now()
+	for i := 0; i < 12; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, backend.URL+"/", nil))
+		assertStatusCode(t, w, http.StatusOK)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("12 requests at 10/s took %v, want them paced", elapsed)
+	}
+}
+
+func TestServer_WaitRateCancelled(t *testing.T) {
+	server := newTestServerWithIPs(t, []string{"127.0.0.1"})
+	server.rateLimit = ratelimit.New(1, 0, time.Second, 1)
+
+	if err := server.WaitRate(context.Background(), http.MethodGet, "client", "example.com:80"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := server.WaitRate(ctx, http.MethodGet, "client", "example.com:80"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("WaitRate() with a cancelled context = %v, want context.Canceled", err)
+	}
+	// The cancelled request left the queue and gave its turn back
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := server.WaitRate(ctx, http.MethodGet, "client", "example.com:80"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("WaitRate() = %v, want it to wait in the queue", err)
+	}
+}
@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/logger"
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+)
+
+// reapInterval is how often the tunnel reaper looks for tunnels to close.
+const reapInterval = 5 * time.Second
+
+// reapedTunnel is an open tunnel watched by the reaper.
+type reapedTunnel struct {
+	host   string
+	start  time.Time
+	active atomic.Int64 // unix nanoseconds of the last byte read
+	close  func()
+}
+
+// TunnelReaper closes tunnels open for longer than a max lifetime or that
+// moved no byte in either direction for longer than a max idle time, so that
+// leaked long-lived tunnels do not hold connection slots forever.
+type TunnelReaper struct {
+	maxDuration time.Duration
+	maxIdle     time.Duration
+	tunnels     map[*reapedTunnel]struct{}
+	now         func() time.Time
+	stopCh      chan struct{}
+	wg          sync.WaitGroup
+	mu          sync.Mutex
+}
+
+// NewTunnelReaper creates a TunnelReaper closing tunnels older than
+// maxDuration or idle for longer than maxIdle. Zero values disable either.
+func NewTunnelReaper(maxDuration, maxIdle time.Duration) *TunnelReaper {
+	return &TunnelReaper{
+		maxDuration: maxDuration,
+		maxIdle:     maxIdle,
+		tunnels:     make(map[*reapedTunnel]struct{}),
+		now:         time.Now,
+		stopCh:      make(chan struct{}),
+	}
+}
+
+// Add watches a tunnel to host opened at start, returning client and target
+// wrapped to record their activity. closeFn must tear the tunnel down. The
+// returned remove function stops watching it and must be called when the
+// tunnel ends.
+func (tr *TunnelReaper) Add(host string, start time.Time, client, target net.Conn, closeFn func()) (net.Conn, net.Conn, func()) {
+	t := &reapedTunnel{host: host, start: start, close: closeFn}
+	t.active.Store(tr.now().UnixNano())
+	tr.mu.Lock()
+	tr.tunnels[t] = struct{}{}
+	tr.mu.Unlock()
+
+	remove := func() {
+		tr.mu.Lock()
+		delete(tr.tunnels, t)
+		tr.mu.Unlock()
+	}
+	if tr.maxIdle <= 0 {
+		return client, target, remove
+	}
+	return &activityConn{Conn: client, t: t, now: tr.now}, &activityConn{Conn: target, t: t, now: tr.now}, remove
+}
+
+// Len returns the number of watched tunnels.
+func (tr *TunnelReaper) Len() int {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return len(tr.tunnels)
+}
+
+// Start starts the background reap loop.
+func (tr *TunnelReaper) Start() {
+	tr.wg.Add(1)
+	go tr.loop()
+}
+
+// Stop stops the background reap loop.
+func (tr *TunnelReaper) Stop() {
+	close(tr.stopCh)
+	tr.wg.Wait()
+}
+
+func (tr *TunnelReaper) loop() {
+	defer tr.wg.Done()
+
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			tr.reap()
+		case <-tr.stopCh:
+			return
+		}
+	}
+}
+
+// reap closes the tunnels over their lifetime or idle time and returns how
+// many it closed.
+func (tr *TunnelReaper) reap() int {
+	now := tr.now()
+	var reaped []*reapedTunnel
+	var reasons []string
+	tr.mu.Lock()
+	for t := range tr.tunnels {
+		reason := ""
+		switch {
+		case tr.maxDuration > 0 && now.Sub(t.start) > tr.maxDuration:
+			reason = "lifetime"
+		case tr.maxIdle > 0 && now.Sub(time.Unix(0, t.active.Load())) > tr.maxIdle:
+			reason = "idle"
+		default:
+			continue
+		}
+		delete(tr.tunnels, t)
+		reaped = append(reaped, t)
+		reasons = append(reasons, reason)
+	}
+	tr.mu.Unlock()
+
+	for i, t := range reaped {
+		logger.Info("tunnel_reaped", "host", t.host, "reason", reasons[i], "age", now.Sub(t.start).String())
+		metrics.TunnelsReaped.WithLabelValues(reasons[i]).Inc()
+		t.close()
+	}
+	return len(reaped)
+}
+
+// activityConn records the time of the last successful read of a tunnel.
+type activityConn struct {
+	net.Conn
+	t   *reapedTunnel
+	now func() time.Time
+}
+
+func (c *activityConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.t.active.Store(c.now().UnixNano())
+	}
+	return n, err
+}
+
+// CloseWrite half-closes the underlying connection if it supports it.
+func (c *activityConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+)
+
+// newTestTunnelReaper returns a reaper on a clock advanced by the returned
+// function.
+func newTestTunnelReaper(maxDuration, maxIdle time.Duration) (*TunnelReaper, func(time.Duration)) {
+	tr := NewTunnelReaper(maxDuration, maxIdle)
+	now := time.Unix(1000, 0)
+	tr.now = func() time.Time { return now }
+	return tr, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestTunnelReaper_Lifetime(t *testing.T) {
+	tr, advance := newTestTunnelReaper(time.Minute, 0)
+	client, target := net.Pipe()
+	defer client.Close()
+	defer target.Close()
+
+	closed := false
+	_, _, remove := tr.Add("api.example.com:443", tr.now(), client, target, func() { closed = true })
+	defer remove()
+	before := testutil.ToFloat64(metrics.TunnelsReaped.WithLabelValues("lifetime"))
+
+	advance(30 * time.Second)
+	if n := tr.reap(); n != 0 || closed {
+		t.Fatalf("reaped %d tunnels within their lifetime", n)
+	}
+
+	advance(time.Minute)
+	if n := tr.reap(); n != 1 || !closed {
+		t.Fatalf("reaped %d tunnels, want the expired one closed", n)
+	}
+	if tr.Len() != 0 {
+		t.Errorf("expected reaped tunnel to be forgotten, %d watched", tr.Len())
+	}
+	if got := testutil.ToFloat64(metrics.TunnelsReaped.WithLabelValues("lifetime")) - before; got != 1 {
+		t.Errorf("lifetime reaps = %v, want 1", got)
+	}
+}
+
+func TestTunnelReaper_Idle(t *testing.T) {
+	tr, advance := newTestTunnelReaper(0, time.Minute)
+	clientEnd, client := net.Pipe()
+	defer clientEnd.Close()
+	defer client.Close()
+	targetEnd, target := net.Pipe()
+	defer targetEnd.Close()
+	defer target.Close()
+
+	closed := false
+	client, _, remove := tr.Add("api.example.com:443", tr.now(), client, target, func() { closed = true })
+	defer remove()
+
+	// Traffic in either direction keeps the tunnel alive
+	advance(50 * time.Second)
+	go clientEnd.Write([]byte("ping"))
+	if _, err := client.Read(make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	advance(50 * time.Second)
+	if n := tr.reap(); n != 0 || closed {
+		t.Fatalf("reaped %d tunnels with recent traffic", n)
+	}
+
+	advance(20 * time.Second)
+	if n := tr.reap(); n != 1 || !closed {
+		t.Fatalf("reaped %d tunnels, want the idle one closed", n)
+	}
+}
+
+func TestTunnelReaper_Remove(t *testing.T) {
+	tr, advance := newTestTunnelReaper(time.Minute, 0)
+	client, target := net.Pipe()
+	defer client.Close()
+	defer target.Close()
+
+	_, _, remove := tr.Add("api.example.com:443", tr.now(), client, target, func() {
+		t.Error("expected removed tunnel not to be closed")
+	})
+	remove()
+
+	advance(2 * time.Minute)
+	if n := tr.reap(); n != 0 {
+		t.Errorf("reaped %d removed tunnels", n)
+	}
+}
@@ -0,0 +1,164 @@
+// Package proxy provides the HTTP/HTTPS proxy server.
+package proxy
+
+import (
+	"errors"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/limiter"
+	"github.com/cr0hn/outbound-lb/internal/logger"
+)
+
+// Rejection reasons.
+const (
+	// RejectAuth means the client presented missing or invalid credentials.
+	RejectAuth = "auth"
+	// RejectClientACL means the client IP was refused by client_allow or
+	// client_deny.
+	RejectClientACL = "client_acl"
+	// RejectAuthBanned means the client IP was banned after repeated
+	// authentication failures.
+	RejectAuthBanned = "auth_banned"
+	// RejectNoIPs means no outbound IP was available for the destination.
+	RejectNoIPs = "no_ips"
+	// RejectIPLimit means the selected outbound IP was at max_conns_per_ip.
+	RejectIPLimit = "per_ip_limit"
+	// RejectTotalLimit means the proxy was at max_conns_total.
+	RejectTotalLimit = "total_limit"
+	// RejectMethod means the request method was not allowed for the client.
+	RejectMethod = "method"
+	// RejectDestination means the destination policy denied the target.
+	RejectDestination = "destination"
+	// RejectRequestBody means the request body was over max_request_body.
+	RejectRequestBody = "request_body"
+	// RejectReserved means the connection slots left were reserved for
+	// clients of higher priority.
+	RejectReserved = "reserved"
+	// RejectClientLimit means the client had as many open connections as
+	// client_max_conns allows.
+	RejectClientLimit = "client_limit"
+	// RejectRateLimit means the global or destination request rate was used
+	// up for longer than rate_limit_max_wait.
+	RejectRateLimit = "rate_limit"
+	// RejectQuota means the proxy user was over one of its quotas.
+	RejectQuota = "user_quota"
+)
+
+// Rejection is a request turned away by the proxy before reaching the
+// upstream, with the connection counts and limits at that moment.
+type Rejection struct {
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason"`
+	Status int       `json:"status"`
+	Method string    `json:"method"`
+	Client string    `json:"client"`
+	Host   string    `json:"host"`
+	// IP is the selected outbound IP, for connection limit rejections.
+	IP            string `json:"ip,omitempty"`
+	IPConnections int64  `json:"ip_connections,omitempty"`
+	Connections   int64  `json:"connections"`
+	MaxConnsPerIP int    `json:"max_conns_per_ip"`
+	MaxConnsTotal int    `json:"max_conns_total"`
+}
+
+// RejectionLog keeps the most recent rejections in a fixed-size ring.
+type RejectionLog struct {
+	entries []Rejection
+	next    int
+	full    bool
+	mu      sync.Mutex
+}
+
+// NewRejectionLog creates a log keeping the last size rejections.
+func NewRejectionLog(size int) *RejectionLog {
+	return &RejectionLog{entries: make([]Rejection, size)}
+}
+
+// Add records a rejection, replacing the oldest one when the log is full.
+func (l *RejectionLog) Add(r Rejection) {
+	if len(l.entries) == 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries[l.next] = r
+	l.next = (l.next + 1) % len(l.entries)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// Recent returns the recorded rejections, newest first.
+func (l *RejectionLog) Recent() []Rejection {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n := l.next
+	if l.full {
+		n = len(l.entries)
+	}
+	result := make([]Rejection, 0, n)
+	for i := 1; i <= n; i++ {
+		result = append(result, l.entries[(l.next-i+len(l.entries))%len(l.entries)])
+	}
+	return result
+}
+
+// limitReason returns the rejection reason for a limiter error.
+func limitReason(err error) string {
+	switch {
+	case errors.Is(err, limiter.ErrTotalLimitReached):
+		return RejectTotalLimit
+	case errors.Is(err, limiter.ErrReservedLimitReached):
+		return RejectReserved
+	}
+	return RejectIPLimit
+}
+
+// Reject logs a request rejected with the given reason and HTTP status (or its
+// equivalent for other front-ends) at the configured level and records it for
+// /debug/rejections. ip is the selected outbound IP, if any.
+func (s *Server) Reject(method, client, host, reason string, status int, ip netip.Addr) {
+	maxPerIP, maxTotal := s.limiter.Limits()
+	r := Rejection{
+		Time:          time.Now(),
+		Reason:        reason,
+		Status:        status,
+		Method:        method,
+		Client:        client,
+		Host:          host,
+		Connections:   s.limiter.GetTotalCount(),
+		MaxConnsPerIP: maxPerIP,
+		MaxConnsTotal: maxTotal,
+	}
+	if ip.IsValid() {
+		r.IP = ip.String()
+		r.IPConnections = s.limiter.GetIPCount(ip)
+	}
+
+	logger.Log(s.cfg.RejectionLogLevel, "request_rejected",
+		"reason", r.Reason,
+		"status", r.Status,
+		"method", r.Method,
+		"client", r.Client,
+		"host", r.Host,
+		"ip", r.IP,
+		"ip_connections", r.IPConnections,
+		"connections", r.Connections,
+		"max_conns_per_ip", r.MaxConnsPerIP,
+		"max_conns_total", r.MaxConnsTotal,
+	)
+	if s.rejections != nil {
+		s.rejections.Add(r)
+	}
+}
+
+// Rejections returns the most recent rejected requests, newest first.
+func (s *Server) Rejections() []Rejection {
+	if s.rejections == nil {
+		return []Rejection{}
+	}
+	return s.rejections.Recent()
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestRejectionLog_RecentNewestFirst(t *testing.T) {
+	log := NewRejectionLog(3)
+	if got := log.Recent(); len(got) != 0 {
+		t.Fatalf("empty log returned %d rejections", len(got))
+	}
+
+	for _, host := range []string{"a", "b", "c", "d"} {
+		log.Add(Rejection{Host: host})
+	}
+
+	got := log.Recent()
+	want := []string{"d", "c", "b"}
+	if len(got) != len(want) {
+		t.Fatalf("got %d rejections, want %d", len(got), len(want))
+	}
+	for i, r := range got {
+		if r.Host != want[i] {
+			t.Errorf("rejection %d host = %q, want %q", i, r.Host, want[i])
+		}
+	}
+}
+
+func TestHandler_RecordsAuthRejection(t *testing.T) {
+	opts := DefaultTestServerOptions()
+	opts.Auth = "user:pass"
+	server := newTestServerWithOptions(t, opts)
+	handler := NewHandler(server)
+
+	req := newTestRequest(t, http.MethodGet, "http://example.com/")
+	req.RemoteAddr = "192.0.2.10:5000"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assertStatusCode(t, w, http.StatusProxyAuthRequired)
+
+	got := server.Rejections()
+	if len(got) != 1 {
+		t.Fatalf("got %d rejections, want 1", len(got))
+	}
+	r := got[0]
+	if r.Reason != RejectAuth || r.Status != http.StatusProxyAuthRequired || r.Client != "192.0.2.10" || r.Host != "example.com" {
+		t.Errorf("unexpected rejection: %+v", r)
+	}
+}
+
+func TestHandler_RecordsLimitRejection(t *testing.T) {
+	server := newTestServerWithLimits(t, 10, 1)
+	handler := NewHandler(server)
+	if err := server.limiter.Acquire(netip.MustParseAddr("127.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	defer server.limiter.Release(netip.MustParseAddr("127.0.0.1"))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newTestRequest(t, http.MethodGet, "http://example.com/"))
+	assertStatusCode(t, w, http.StatusServiceUnavailable)
+
+	got := server.Rejections()
+	if len(got) != 1 {
+		t.Fatalf("got %d rejections, want 1", len(got))
+	}
+	r := got[0]
+	if r.Reason != RejectTotalLimit || r.IP != "127.0.0.1" || r.Connections != 1 || r.MaxConnsPerIP != 10 || r.MaxConnsTotal != 1 {
+		t.Errorf("unexpected rejection: %+v", r)
+	}
+}
@@ -0,0 +1,257 @@
+// Package proxy provides the HTTP/HTTPS proxy server.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/balancer"
+	"github.com/cr0hn/outbound-lb/internal/logger"
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+)
+
+var (
+	// ErrNoOutboundIPs means no outbound IP could be selected for the target.
+	ErrNoOutboundIPs = errors.New("no available outbound IPs")
+	// ErrConnectionLimit means the selected outbound IP has no free connection slot.
+	ErrConnectionLimit = errors.New("connection limit reached")
+)
+
+// UpstreamError is returned by OpenTunnel when the target could not be
+// reached through any of the outbound IPs tried.
+type UpstreamError struct {
+	// Host is the requested target.
+	Host string
+	// IP is the last outbound IP tried.
+	IP netip.Addr
+	// Retries is the number of other IPs tried before IP.
+	Retries int
+	// Class is the error class, one of the ErrorClass constants.
+	Class string
+	// Err is the dial error.
+	Err error
+}
+
+func (e *UpstreamError) Error() string {
+	return "upstream " + e.Host + " via " + e.IP.String() + ": " + e.Err.Error()
+}
+
+func (e *UpstreamError) Unwrap() error {
+	return e.Err
+}
+
+// Status returns the HTTP status a proxy response reports for the error:
+// 504 for DNS failures, 403 for denied destinations, 502 otherwise.
+func (e *UpstreamError) Status() int {
+	return upstreamErrorStatus(e.Class)
+}
+
+// Tunnel is an open connection to a target through an outbound IP, holding
+// its connection slot until closed.
+type Tunnel struct {
+	server  *Server
+	conn    net.Conn
+	ip      netip.Addr
+	host    string
+	method  string
+	user    string // authenticated proxy user, empty if anonymous
+	status  int    // reported for the relayed connection
+	start   time.Time
+	release func()
+	once    sync.Once
+}
+
+// OpenTunnel connects to host ("host:port") through an outbound IP chosen by
+// the balancer, moving on to another IP after a failure while the retry budget
+// lasts, and to the failover targets of host once no IP reaches it. method
+// labels the tunnel in logs and metrics. The context may carry the client
+// identity for session affinity.
+//
+// Errors are ErrNoOutboundIPs, ErrConnectionLimit or an *UpstreamError.
+func (s *Server) OpenTunnel(ctx context.Context, method, host string) (*Tunnel, error) {
+	start := time.Now()
+	ctx = s.withDestinationFamilies(ctx, host)
+
+	targets := s.failover.Targets(host)
+	var err error
+	for i, target := range targets {
+		if i > 0 {
+			if !s.allowFailover(ctx, host, target) {
+				continue
+			}
+			logger.Warn("upstream_failover", "host", host, "target", target, "error", err)
+			metrics.FailoverTotal.WithLabelValues(metrics.HostLabel(host)).Inc()
+		}
+		var tun *Tunnel
+		tun, err = s.openVia(ctx, method, host, target, start, i < len(targets)-1)
+		if err == nil {
+			return tun, nil
+		}
+		var upstreamErr *UpstreamError
+		if !errors.As(err, &upstreamErr) || !isDialError(upstreamErr.Err) {
+			break
+		}
+	}
+	return nil, err
+}
+
+// openVia connects to target for a tunnel to host, trying outbound IPs as
+// OpenTunnel does. With failover set, connection failures move on to another
+// IP until none is left, whatever the retry budget.
+func (s *Server) openVia(ctx context.Context, method, host, target string, start time.Time, failover bool) (*Tunnel, error) {
+	var (
+		ip       netip.Addr
+		excluded []netip.Addr
+		lastErr  error
+	)
+	for attempt := 0; ; attempt++ {
+		selectCtx := ctx
+		if len(excluded) > 0 {
+			selectCtx = balancer.ContextWithExcluded(selectCtx, excluded...)
+		}
+
+		// Select outbound IP and take a connection slot on it, first waiting
+		// in the connection queue if the limits are reached
+		logger.Trace("connect_ip_selection_start", "host", host)
+		selected, release, err := s.acquireOutbound(selectCtx, host, attempt == 0)
+		if isLimitError(err) {
+			logger.Trace("connect_acquire_failed", "ip", selected, "error", err)
+			metrics.LimitRejections.WithLabelValues("per_ip").Inc()
+			logger.LogConnectionLimit("per_ip", selected, int(s.limiter.GetIPCount(selected)), s.cfg.MaxConnsPerIP)
+			s.Reject(method, balancer.ClientFromContext(ctx), host, limitReason(err), http.StatusServiceUnavailable, selected)
+			return nil, ErrConnectionLimit
+		}
+		if err != nil {
+			logger.Trace("connect_ip_selection_failed", "host", host, "error", err)
+			if attempt > 0 {
+				// No other IP left to retry on
+				return nil, s.dialFailed(method, host, ip, lastErr, attempt)
+			}
+			metrics.LimitRejections.WithLabelValues("total").Inc()
+			s.Reject(method, balancer.ClientFromContext(ctx), host, RejectNoIPs, http.StatusServiceUnavailable, netip.Addr{})
+			return nil, ErrNoOutboundIPs
+		}
+		ip = selected
+		logger.Trace("connect_acquired", "host", host, "ip", ip)
+
+		// Record selection
+		s.balancer.Record(host, ip)
+		s.stats.IncSelectionsForIP(ip, host)
+		logger.LogBalancerSelection(host, ip, len(s.cfg.IPs))
+
+		if attempt == 0 && target == host {
+			metrics.TunnelConnections.Inc()
+		}
+
+		conn, err := s.connectHandler.dial(withUpstreamTrace(ctx, ip), host, target, ip)
+		s.recordUpstreamResult(ip, err)
+		if err == nil {
+			logger.Trace("connect_dial_success", "host", host, "ip", ip, "local", conn.LocalAddr(), "remote", conn.RemoteAddr())
+			return &Tunnel{server: s, conn: conn, ip: ip, host: host, method: method, user: requestUser(ctx), status: http.StatusOK, start: start, release: release}, nil
+		}
+		release()
+		logger.Trace("connect_dial_failed", "host", host, "ip", ip, "error", err)
+		retry := s.canRetry(http.MethodConnect, attempt, err) || (failover && isDialError(err) && !isDeniedAddr(err))
+		if !retry {
+			return nil, s.dialFailed(method, host, ip, err, attempt)
+		}
+		excluded = append(excluded, ip)
+		lastErr = err
+		if !s.waitRetry(ctx, method, host, ip, attempt+1, err) {
+			return nil, s.dialFailed(method, host, ip, err, attempt)
+		}
+	}
+}
+
+// dialFailed logs a tunnel whose target could not be reached through ip, the
+// last of attempt+1 IPs tried, and returns the error reported to the caller.
+func (s *Server) dialFailed(method, host string, ip netip.Addr, err error, attempt int) *UpstreamError {
+	logger.LogError("connect_dial", err, "host", host, "ip", ip, "retries", attempt)
+	if attempt > 0 {
+		metrics.RetriesExhausted.WithLabelValues(method).Inc()
+	}
+	s.stats.RecordHost(host, ip, 0, 0, true)
+	return &UpstreamError{Host: host, IP: ip, Retries: attempt, Class: classifyUpstreamError(err), Err: err}
+}
+
+// IP returns the outbound IP the tunnel goes through.
+func (t *Tunnel) IP() netip.Addr {
+	return t.ip
+}
+
+// LocalAddr returns the local address of the connection to the target.
+func (t *Tunnel) LocalAddr() net.Addr {
+	return t.conn.LocalAddr()
+}
+
+// Relay copies data between client and the target until both sides are done
+// or idle for the idle timeout, then records the tunnel in logs and metrics.
+// remoteAddr identifies the client in logs. The tunnel is closed on return.
+func (t *Tunnel) Relay(client net.Conn, remoteAddr, requestID, sessionID string) {
+	defer t.Close()
+	s := t.server
+	s.recordUpstreamStatus(t.ip, t.status)
+
+	// Let shutdown close the tunnel once the drain timeout expires
+	defer s.trackRelay(t, func() {
+		client.Close()
+		t.conn.Close()
+	})()
+
+	// Watch for the target host moving away from the connected address
+	if s.tunnels != nil {
+		remove := s.tunnels.Add(t.host, t.conn.RemoteAddr(), func() {
+			client.Close()
+			t.conn.Close()
+		})
+		defer remove()
+	}
+
+	// Close the tunnel once it outlives its lifetime or idle budget
+	target := t.conn
+	if s.reaper != nil {
+		var remove func()
+		client, target, remove = s.reaper.Add(t.host, t.start, client, t.conn, func() {
+			client.Close()
+			t.conn.Close()
+		})
+		defer remove()
+	}
+
+	// Bidirectional copy with idle timeout, within the bandwidth limits
+	throttle := s.bandwidth.Throttle(t.user, t.ip.String())
+	bytesIn, bytesOut := s.connectHandler.tunnel(client, target, s.IdleTimeout(), throttle)
+
+	// Log and record metrics
+	duration := time.Since(t.start)
+	logger.LogRequest(t.method, t.host, remoteAddr, t.ip.String(), t.status, duration.Milliseconds(), bytesIn, bytesOut,
+		"request_id", requestID, "session_id", sessionID, "user", t.user)
+	s.recordUser(t.user, bytesIn, bytesOut)
+
+	s.stats.IncTotalRequests()
+	s.stats.AddBytesReceived(bytesIn)
+	s.stats.AddBytesSent(bytesOut)
+	// Tunnels relay bytes unchanged, so both sides see the same traffic
+	s.stats.AddUpstreamBytes(t.ip, bytesIn, bytesOut)
+	s.stats.RecordHost(t.host, t.ip, bytesOut, bytesIn, t.status >= 500)
+
+	metrics.RequestsTotal.WithLabelValues(t.method, strconv.Itoa(t.status)).Inc()
+	metrics.RequestDuration.WithLabelValues(t.method).Observe(duration.Seconds())
+}
+
+// Close closes the connection to the target and frees its connection slot.
+// It is safe to call more than once.
+func (t *Tunnel) Close() error {
+	var err error
+	t.once.Do(func() {
+		err = t.conn.Close()
+		t.release()
+	})
+	return err
+}
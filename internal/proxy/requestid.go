@@ -13,6 +13,9 @@ import (
 // requestIDKey is the context key for request IDs.
 type requestIDKey struct{}
 
+// sessionIDKey is the context key for client connection session IDs.
+type sessionIDKey struct{}
+
 // requestCounter provides a monotonically increasing counter for request IDs.
 var requestCounter atomic.Uint64
 
@@ -43,3 +46,17 @@ func RequestIDFromContext(ctx context.Context) string {
 	}
 	return ""
 }
+
+// ContextWithSessionID returns a new context with the session ID attached.
+func ContextWithSessionID(ctx context.Context, sessionID string) context.Context {
+	return context.WithValue(ctx, sessionIDKey{}, sessionID)
+}
+
+// SessionIDFromContext extracts the client connection session ID from the context.
+// Returns empty string if no session ID is present.
+func SessionIDFromContext(ctx context.Context) string {
+	if id, ok := ctx.Value(sessionIDKey{}).(string); ok {
+		return id
+	}
+	return ""
+}
@@ -0,0 +1,66 @@
+// Package proxy provides the HTTP/HTTPS proxy server.
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/cr0hn/outbound-lb/internal/balancer"
+	"github.com/cr0hn/outbound-lb/internal/dns"
+	"github.com/cr0hn/outbound-lb/internal/logger"
+)
+
+// Preferred address families of outbound IPs for dual-stack destinations.
+const (
+	// PreferFamilyAny selects IPs of either family.
+	PreferFamilyAny = "any"
+	// PreferFamilyIPv4 selects IPv4 IPs while one is available.
+	PreferFamilyIPv4 = "ipv4"
+	// PreferFamilyIPv6 selects IPv6 IPs while one is available.
+	PreferFamilyIPv6 = "ipv6"
+)
+
+// hasBothFamilies reports whether ips has both IPv4 and IPv6 addresses.
+func hasBothFamilies(ips []netip.Addr) bool {
+	var v4, v6 bool
+	for _, ip := range ips {
+		if ip.Is4() {
+			v4 = true
+		} else {
+			v6 = true
+		}
+	}
+	return v4 && v6
+}
+
+// withDestinationFamilies returns a context restricting IP selection to the
+// address families host resolves to, when the outbound IPs span both, and
+// preferring the configured family when host resolves to both.
+// Failed lookups leave selection unrestricted; the dial reports them.
+func (s *Server) withDestinationFamilies(ctx context.Context, host string) context.Context {
+	if !s.dualStack.Load() {
+		return ctx
+	}
+	name, _, err := net.SplitHostPort(host)
+	if err != nil {
+		name = strings.Trim(host, "[]")
+	}
+	addrs, err := s.resolvers.Default().LookupNetIP(ctx, name)
+	if err != nil {
+		logger.Trace("destination_resolve_failed", "host", name, "error", err)
+		return ctx
+	}
+	ipv4, ipv6 := dns.Families(addrs)
+	ctx = balancer.ContextWithFamilies(ctx, ipv4, ipv6)
+	if ipv4 && ipv6 {
+		switch s.cfg.PreferFamily {
+		case PreferFamilyIPv4:
+			ctx = balancer.ContextWithPreferredFamily(ctx, true)
+		case PreferFamilyIPv6:
+			ctx = balancer.ContextWithPreferredFamily(ctx, false)
+		}
+	}
+	return ctx
+}
@@ -0,0 +1,81 @@
+// Package proxy provides the HTTP/HTTPS proxy server.
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/logger"
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+)
+
+// idempotentMethods are the methods that may be resent after part of the
+// request could have reached the upstream.
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+// shouldRetry reports whether a request that failed with err on its attempt-th
+// retry (0 for the first try) may be retried on another outbound IP.
+// Requests with a body are never retried since the transport consumed it.
+// Connection failures are retried for any method as nothing reached the
+// upstream; other errors only for idempotent methods.
+func (s *Server) shouldRetry(r *http.Request, attempt int, err error) bool {
+	if r.Method != http.MethodConnect && r.Body != nil && r.Body != http.NoBody {
+		return false
+	}
+	return s.canRetry(r.Method, attempt, err)
+}
+
+// canRetry reports whether a bodyless request with the given method that
+// failed with err on its attempt-th retry may be retried on another IP.
+// Denied destinations are denied through every IP.
+func (s *Server) canRetry(method string, attempt int, err error) bool {
+	if attempt >= s.cfg.RetryAttempts || isDeniedAddr(err) {
+		return false
+	}
+	return isConnectFailure(err) || idempotentMethods[method]
+}
+
+// waitRetry logs and counts a retry away from ip and sleeps the backoff for
+// the given retry (1 for the first), doubling it on each retry.
+// Returns false if the request was cancelled while waiting.
+func (s *Server) waitRetry(ctx context.Context, method, host string, ip netip.Addr, retry int, err error) bool {
+	metrics.RetriesTotal.WithLabelValues(method).Inc()
+	logger.Warn("upstream_retry", "host", host, "failed_ip", ip, "retry", retry, "error", err)
+
+	if s.cfg.RetryBackoff <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(s.cfg.RetryBackoff << (retry - 1))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// acquireIP takes a connection slot on ip, at the priority of the client of
+// ctx, and counts the connection. The returned release function undoes both
+// and must be called exactly once.
+func (s *Server) acquireIP(ctx context.Context, ip netip.Addr) (release func(), err error) {
+	if err := s.limiter.AcquirePriority(ip, s.priority(ctx)); err != nil {
+		return nil, err
+	}
+	s.stats.IncActiveConnections()
+	s.stats.IncConnectionsForIP(ip)
+	return func() {
+		s.stats.DecActiveConnections()
+		s.stats.DecConnectionsForIP(ip)
+		s.limiter.Release(ip)
+	}, nil
+}
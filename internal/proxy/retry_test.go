@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/balancer"
+	"github.com/cr0hn/outbound-lb/internal/config"
+	"github.com/cr0hn/outbound-lb/internal/limiter"
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
+)
+
+// newRetryTestServer creates a server whose first IP cannot be bound (TEST-NET
+// address), so every attempt through it fails to dial.
+func newRetryTestServer(t *testing.T, retryAttempts int) *Server {
+	t.Helper()
+	cfg := &config.Config{
+		IPs:           []string{"192.0.2.1", "127.0.0.1"},
+		Timeout:       5 * time.Second,
+		IdleTimeout:   60 * time.Second,
+		MaxConnsPerIP: 100,
+		MaxConnsTotal: 1000,
+		HistoryWindow: 5 * time.Minute,
+		HistorySize:   100,
+		RetryAttempts: retryAttempts,
+		RetryBackoff:  time.Millisecond,
+	}
+
+	stats := metrics.NewStatsCollector(netutil.MustParseAddrs(cfg.IPs))
+	lim := limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, netutil.MustParseAddrs(cfg.IPs))
+	bal := balancer.New(balancer.Config{
+		IPs:           netutil.MustParseAddrs(cfg.IPs),
+		HistoryWindow: int64(cfg.HistoryWindow.Seconds()),
+		HistorySize:   cfg.HistorySize,
+		Limiter:       lim,
+	})
+	return NewServer(cfg, bal, lim, stats)
+}
+
+func TestHandler_RetryOnAlternateIP(t *testing.T) {
+	backend := newTestBackendWithHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	defer backend.Close()
+
+	tests := []struct {
+		name          string
+		retryAttempts int
+		want502       bool
+	}{
+		{name: "without retries", retryAttempts: 0, want502: true},
+		{name: "with retries", retryAttempts: 1, want502: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newRetryTestServer(t, tt.retryAttempts)
+			handler := NewHandler(server)
+
+			// The balancer spreads requests, so the unbindable IP is picked
+			got502 := false
+			for i := 0; i < 4; i++ {
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, backend.URL+"/", nil))
+				if rr.Code == http.StatusBadGateway {
+					got502 = true
+				} else {
+					assertStatusCode(t, rr, http.StatusOK)
+				}
+			}
+			if got502 != tt.want502 {
+				t.Errorf("got 502 = %v, want %v", got502, tt.want502)
+			}
+			if active := server.stats.GetStats().ActiveConnections; active != 0 {
+				t.Errorf("expected all connection slots released, %d active", active)
+			}
+		})
+	}
+}
+
+func TestHandler_RetryNoAlternateIP(t *testing.T) {
+	server := newRetryTestServer(t, 3)
+	server.cfg.IPs = []string{"192.0.2.1"}
+	server.balancer = balancer.New(balancer.Config{IPs: netutil.MustParseAddrs(server.cfg.IPs), HistoryWindow: 300, HistorySize: 100})
+	handler := NewHandler(server)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://127.0.0.1:1/", nil))
+	assertStatusCode(t, rr, http.StatusBadGateway)
+}
+
+func TestConnectHandler_RetryOnAlternateIP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	server := newRetryTestServer(t, 1)
+	for i := 0; i < 4; i++ {
+		req := httptest.NewRequest(http.MethodConnect, "http://"+ln.Addr().String(), nil)
+		req.Host = ln.Addr().String()
+		rr := httptest.NewRecorder()
+		server.connectHandler.ServeHTTP(rr, req)
+
+		// The recorder cannot be hijacked, so a reached target yields 500
+		assertStatusCode(t, rr, http.StatusInternalServerError)
+	}
+}
+
+func TestServer_ShouldRetry(t *testing.T) {
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	readErr := errors.New("unexpected EOF")
+
+	tests := []struct {
+		name    string
+		method  string
+		body    string
+		attempt int
+		err     error
+		want    bool
+	}{
+		{name: "dial error", method: http.MethodPost, err: dialErr, want: true},
+		{name: "idempotent method", method: http.MethodGet, err: readErr, want: true},
+		{name: "non-idempotent method", method: http.MethodPost, err: readErr, want: false},
+		{name: "request with body", method: http.MethodPut, body: "data", err: dialErr, want: false},
+		{name: "budget exhausted", method: http.MethodGet, attempt: 2, err: dialErr, want: false},
+		{name: "connect dial error", method: http.MethodConnect, err: dialErr, want: true},
+	}
+
+	server := newRetryTestServer(t, 2)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req *http.Request
+			if tt.body != "" {
+				req = httptest.NewRequest(tt.method, "http://example.com/", strings.NewReader(tt.body))
+			} else {
+				req = httptest.NewRequest(tt.method, "http://example.com/", nil)
+			}
+			if got := server.shouldRetry(req, tt.attempt, tt.err); got != tt.want {
+				t.Errorf("shouldRetry() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
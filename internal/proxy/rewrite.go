@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/cr0hn/outbound-lb/internal/config"
+	"github.com/cr0hn/outbound-lb/internal/logger"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
+)
+
+// rewriteRule is a config.RewriteRule with its matchers prepared.
+type rewriteRule struct {
+	host    netutil.HostPattern
+	match   *regexp.Regexp
+	replace string
+}
+
+// RewriteRules rewrites outgoing request paths and queries per destination
+// host.
+type RewriteRules struct {
+	rules []rewriteRule
+}
+
+// NewRewriteRules creates RewriteRules from the configured rules. Rules are
+// evaluated in order; the first rule matching both the host and the path and
+// query wins. Invalid rules are skipped (Config.Validate rejects them).
+func NewRewriteRules(rules []config.RewriteRule) *RewriteRules {
+	rr := &RewriteRules{rules: make([]rewriteRule, 0, len(rules))}
+	for i, rule := range rules {
+		match, err := regexp.Compile(rule.Match)
+		if err != nil {
+			logger.Warn("rewrite_rule_invalid", "index", i, "error", err)
+			continue
+		}
+		host, err := netutil.CompileHostPattern(rule.Host, rule.Regex)
+		if err != nil {
+			logger.Warn("rewrite_rule_invalid", "index", i, "error", err)
+			continue
+		}
+		rr.rules = append(rr.rules, rewriteRule{host: host, match: match, replace: rule.Replace})
+	}
+	return rr
+}
+
+// Apply rewrites the path and query of u, the URL of a request, according to
+// the first matching rule. It reports whether u was rewritten. Rewrites that
+// do not yield a valid request URI leave u unchanged.
+func (rr *RewriteRules) Apply(u *url.URL) bool {
+	if rr == nil || len(rr.rules) == 0 {
+		return false
+	}
+
+	host := strings.ToLower(u.Hostname())
+	uri := u.RequestURI()
+	for _, rule := range rr.rules {
+		if !rule.host.Match(host) || !rule.match.MatchString(uri) {
+			continue
+		}
+
+		rewritten := rule.match.ReplaceAllString(uri, rule.replace)
+		next, err := url.ParseRequestURI(rewritten)
+		if err != nil {
+			logger.Warn("request_rewrite_invalid", "host", host, "uri", rewritten, "error", err)
+			return false
+		}
+		u.Path, u.RawPath, u.RawQuery = next.Path, next.RawPath, next.RawQuery
+		logger.Debug("request_rewritten", "host", host, "from", uri, "to", rewritten)
+		return true
+	}
+	return false
+}
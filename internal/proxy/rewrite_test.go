@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/cr0hn/outbound-lb/internal/config"
+)
+
+func TestRewriteRules_Apply(t *testing.T) {
+	rr := NewRewriteRules([]config.RewriteRule{
+		{Host: "api.example.com", Match: `^/v1/`, Replace: "/v2/"},
+		{Regex: `^shop[0-9]*\.example\.com$`, Match: `([?&])session=[^&]*&?`, Replace: "$1"},
+		{Host: "*.example.org", Match: `^/(?P<item>[a-z]+)$`, Replace: "/items?name=${item}"},
+		{Host: "broken.example.com", Match: `^/`, Replace: "relative/"},
+	})
+
+	tests := []struct {
+		name    string
+		url     string
+		want    string
+		changed bool
+	}{
+		{
+			name:    "path prefix replaced",
+			url:     "http://API.example.com/v1/users?id=1",
+			want:    "http://API.example.com/v2/users?id=1",
+			changed: true,
+		},
+		{
+			name:    "query parameter removed",
+			url:     "http://shop2.example.com/cart?session=abc&item=3",
+			want:    "http://shop2.example.com/cart?item=3",
+			changed: true,
+		},
+		{
+			name:    "named submatch moved to the query",
+			url:     "http://www.example.org/widget",
+			want:    "http://www.example.org/items?name=widget",
+			changed: true,
+		},
+		{
+			name: "host matches but path does not",
+			url:  "http://api.example.com/v3/users",
+			want: "http://api.example.com/v3/users",
+		},
+		{
+			name: "no host match",
+			url:  "http://other.com/v1/users",
+			want: "http://other.com/v1/users",
+		},
+		{
+			name: "invalid rewrite leaves the URL unchanged",
+			url:  "http://broken.example.com/path",
+			want: "http://broken.example.com/path",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if changed := rr.Apply(u); changed != tt.changed {
+				t.Errorf("Apply() = %v, want %v", changed, tt.changed)
+			}
+			if got := u.String(); got != tt.want {
+				t.Errorf("URL = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteRules_Nil(t *testing.T) {
+	var rr *RewriteRules
+	u, _ := url.Parse("http://example.com/path")
+	if rr.Apply(u) {
+		t.Error("nil RewriteRules rewrote the URL")
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/cr0hn/outbound-lb/internal/config"
 	"github.com/cr0hn/outbound-lb/internal/limiter"
 	"github.com/cr0hn/outbound-lb/internal/metrics"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
 )
 
 // TestProxy_10KConnections tests handling of 10,000 concurrent connections.
@@ -36,10 +37,10 @@ func TestProxy_10KConnections(t *testing.T) {
 		LogFormat:     "json",
 	}
 
-	stats := metrics.NewStatsCollector(cfg.IPs)
-	lim := limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, cfg.IPs)
+	stats := metrics.NewStatsCollector(netutil.MustParseAddrs(cfg.IPs))
+	lim := limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, netutil.MustParseAddrs(cfg.IPs))
 	balCfg := balancer.Config{
-		IPs:           cfg.IPs,
+		IPs:           netutil.MustParseAddrs(cfg.IPs),
 		HistoryWindow: int64(cfg.HistoryWindow.Seconds()),
 		HistorySize:   cfg.HistorySize,
 		Limiter:       lim,
@@ -137,10 +138,10 @@ func TestProxy_HighConcurrency(t *testing.T) {
 		LogFormat:     "json",
 	}
 
-	stats := metrics.NewStatsCollector(cfg.IPs)
-	lim := limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, cfg.IPs)
+	stats := metrics.NewStatsCollector(netutil.MustParseAddrs(cfg.IPs))
+	lim := limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, netutil.MustParseAddrs(cfg.IPs))
 	balCfg := balancer.Config{
-		IPs:           cfg.IPs,
+		IPs:           netutil.MustParseAddrs(cfg.IPs),
 		HistoryWindow: int64(cfg.HistoryWindow.Seconds()),
 		HistorySize:   cfg.HistorySize,
 		Limiter:       lim,
@@ -211,10 +212,10 @@ func TestProxy_SustainedLoad(t *testing.T) {
 		LogFormat:     "json",
 	}
 
-	stats := metrics.NewStatsCollector(cfg.IPs)
-	lim := limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, cfg.IPs)
+	stats := metrics.NewStatsCollector(netutil.MustParseAddrs(cfg.IPs))
+	lim := limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, netutil.MustParseAddrs(cfg.IPs))
 	balCfg := balancer.Config{
-		IPs:           cfg.IPs,
+		IPs:           netutil.MustParseAddrs(cfg.IPs),
 		HistoryWindow: int64(cfg.HistoryWindow.Seconds()),
 		HistorySize:   cfg.HistorySize,
 		Limiter:       lim,
@@ -310,10 +311,10 @@ func TestProxy_MultipleIPs(t *testing.T) {
 		LogFormat:     "json",
 	}
 
-	statsCollector := metrics.NewStatsCollector(cfg.IPs)
-	lim := limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, cfg.IPs)
+	statsCollector := metrics.NewStatsCollector(netutil.MustParseAddrs(cfg.IPs))
+	lim := limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, netutil.MustParseAddrs(cfg.IPs))
 	balCfg := balancer.Config{
-		IPs:           cfg.IPs,
+		IPs:           netutil.MustParseAddrs(cfg.IPs),
 		HistoryWindow: int64(cfg.HistoryWindow.Seconds()),
 		HistorySize:   cfg.HistorySize,
 		Limiter:       lim,
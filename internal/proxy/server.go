@@ -4,129 +4,735 @@ package proxy
 import (
 	"context"
 	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"fmt"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/cr0hn/outbound-lb/internal/auth"
 	"github.com/cr0hn/outbound-lb/internal/balancer"
+	"github.com/cr0hn/outbound-lb/internal/bandwidth"
 	"github.com/cr0hn/outbound-lb/internal/config"
+	"github.com/cr0hn/outbound-lb/internal/dns"
+	"github.com/cr0hn/outbound-lb/internal/health"
 	"github.com/cr0hn/outbound-lb/internal/limiter"
 	"github.com/cr0hn/outbound-lb/internal/logger"
 	"github.com/cr0hn/outbound-lb/internal/metrics"
+	"github.com/cr0hn/outbound-lb/internal/proxyproto"
+	"github.com/cr0hn/outbound-lb/internal/quota"
+	"github.com/cr0hn/outbound-lb/internal/ratelimit"
+	"github.com/cr0hn/outbound-lb/internal/store"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
 )
 
 // Server is the HTTP/HTTPS proxy server.
 type Server struct {
-	cfg            *config.Config
-	httpServer     *http.Server
-	balancer       balancer.Balancer
-	limiter        *limiter.Limiter
-	transportPool  *TransportPool
-	stats          *metrics.StatsCollector
-	connectHandler *ConnectHandler
+	cfg                 *config.Config
+	httpServer          *http.Server
+	gatewayServer       *http.Server
+	unixServer          *http.Server
+	listeners           []*extraListener
+	balancer            balancer.Balancer
+	limiter             *limiter.Limiter
+	queue               *limiter.Queue
+	clients             *limiter.Clients
+	transportPool       *TransportPool
+	stats               *metrics.StatsCollector
+	connectHandler      *ConnectHandler
+	failover            *FailoverTable
+	headerRules         *HeaderRules
+	rewriteRules        *RewriteRules
+	proxyProtocol       *ProxyProtocolRules
+	proxyTrusted        []netip.Prefix
+	egressSelectTrusted []netip.Prefix
+	clientAllow         []netip.Prefix
+	clientDeny          []netip.Prefix
+	destinations        *DestinationPolicy
+	connectPorts        []netutil.PortRange
+	resolvers           *dns.Resolvers
+	dualStack           atomic.Bool // outbound IPs of both address families
+	circuitBreaker      *balancer.CircuitBreaker
+	tunnels             *TunnelTracker
+	reaper              *TunnelReaper
+	relays              map[*Tunnel]func()
+	relaysMu            sync.Mutex
+	rejections          *RejectionLog
+	passiveHealth       *health.PassiveMonitor
+	listenerCert        atomic.Pointer[tls.Certificate]
+	clientCAs           atomic.Pointer[x509.CertPool]
+	authUsers           atomic.Pointer[auth.Users]
+	authKeys            atomic.Pointer[auth.Keys]
+	hmacSecret          atomic.Pointer[string]
+	timeout             atomic.Int64 // time.Duration, changed on reload
+	idleTimeout         atomic.Int64 // time.Duration, changed on reload
+	lockout             *auth.Lockout
+	userRules           map[string]config.UserRule
+	userIPs             map[string]netip.Addr   // outbound IP of each user rule with one
+	pools               map[string][]netip.Addr // outbound IPs of each pool
+	quotas              *quota.Quotas
+	bandwidth           *bandwidth.Limiter
+	rateLimit           *ratelimit.Limiter
+	ips                 []netip.Addr
+	localIPs            []netip.Addr
+	remote              map[netip.Addr]*url.URL
+	ipsMu               sync.Mutex
+	draining            map[netip.Addr]chan struct{}
+	drainMu             sync.Mutex
 }
 
 // NewServer creates a new proxy server.
 func NewServer(cfg *config.Config, bal balancer.Balancer, lim *limiter.Limiter, stats *metrics.StatsCollector) *Server {
+	ips := netutil.MustParseAddrs(cfg.IPs)
+	transportOpts := []TransportOption{
+		WithTransportTuning(transportTuning(cfg)),
+		WithByteCounter(stats.UpstreamBytes),
+	}
+	if cfg.UpstreamHTTP3 {
+		transportOpts = append(transportOpts, WithHTTP3())
+	}
+	resolvers := dns.NewResolvers(cfg.DNSServers, cfg.DNSServersPerIP, dns.CacheOptions{
+		Size:        cfg.DNSCacheSize,
+		NegativeTTL: cfg.DNSCacheNegativeTTL,
+	})
+	transportOpts = append(transportOpts, WithResolvers(resolvers), WithSocketOptions(cfg.SocketOptions()))
+
 	s := &Server{
 		cfg:           cfg,
 		balancer:      bal,
 		limiter:       lim,
-		transportPool: NewTransportPool(cfg.IPs, cfg.Timeout),
+		queue:         limiter.NewQueue(lim, cfg.QueueSize, cfg.QueueTimeout),
+		clients:       limiter.NewClients(cfg.ClientMaxConns),
+		transportPool: NewTransportPool(ips, cfg.Timeout, transportOpts...),
 		stats:         stats,
+		failover:      NewFailoverTable(cfg.Failover),
+		headerRules:   NewHeaderRules(cfg.HeaderRules),
+		rewriteRules:  NewRewriteRules(cfg.RewriteRules),
+		rateLimit:     ratelimit.New(cfg.MaxRPS, cfg.HostMaxRPS, cfg.RateLimitMaxWait, cfg.RateLimitMaxWaiters),
+		bandwidth: bandwidth.New(bandwidth.Limits{
+			PerTunnel: cfg.BandwidthPerTunnel,
+			PerUser:   cfg.BandwidthPerUser,
+			PerIP:     cfg.BandwidthPerIP,
+		}),
+		proxyProtocol: NewProxyProtocolRules(cfg.UpstreamProxyProtocol),
+		destinations:  NewDestinationPolicy(cfg.DestinationRules, cfg.BlockPrivateDestinations),
+		resolvers:     resolvers,
+		ips:           ips,
+		localIPs:      ips,
+		draining:      make(map[netip.Addr]chan struct{}),
+		relays:        make(map[*Tunnel]func()),
+	}
+	for _, entry := range cfg.ProxyProtocolTrusted {
+		if prefix, err := netutil.ParsePrefix(entry); err == nil {
+			s.proxyTrusted = append(s.proxyTrusted, prefix)
+		}
+	}
+	for _, entry := range cfg.EgressSelectTrusted {
+		if prefix, err := netutil.ParsePrefix(entry); err == nil {
+			s.egressSelectTrusted = append(s.egressSelectTrusted, prefix)
+		}
+	}
+	for _, entry := range cfg.ClientAllow {
+		if prefix, err := netutil.ParsePrefix(entry); err == nil {
+			s.clientAllow = append(s.clientAllow, prefix)
+		}
+	}
+	for _, entry := range cfg.ClientDeny {
+		if prefix, err := netutil.ParsePrefix(entry); err == nil {
+			s.clientDeny = append(s.clientDeny, prefix)
+		}
+	}
+	s.destinations.resolve = resolvers.Default().LookupNetIP
+	s.timeout.Store(int64(cfg.Timeout))
+	s.idleTimeout.Store(int64(cfg.IdleTimeout))
+	s.dualStack.Store(hasBothFamilies(ips))
+	for _, entry := range cfg.ConnectAllowedPorts {
+		if r, err := netutil.ParsePortRange(entry); err == nil {
+			s.connectPorts = append(s.connectPorts, r)
+		}
+	}
+	if cfg.RejectionHistory > 0 {
+		s.rejections = NewRejectionLog(cfg.RejectionHistory)
+	}
+	if cfg.TunnelDNSCheckInterval > 0 {
+		s.tunnels = NewTunnelTracker(cfg.TunnelDNSCheckInterval, cfg.TunnelDNSChangePolicy == TunnelDNSPolicyDrain)
+	}
+	if cfg.MaxTunnelDuration > 0 || cfg.MaxTunnelIdle > 0 {
+		s.reaper = NewTunnelReaper(cfg.MaxTunnelDuration, cfg.MaxTunnelIdle)
+	}
+	if len(cfg.Users) > 0 {
+		s.setUserRules(cfg.Users)
+	}
+	s.setPools(cfg.Pools)
+	s.quotas = newQuotas(cfg, nil)
+	if cfg.AuthMaxFailures > 0 {
+		s.lockout = auth.NewLockout(cfg.AuthMaxFailures, cfg.AuthFailureWindow, cfg.AuthBanDuration)
+	}
+	if err := s.ReloadAuthFile(); err != nil {
+		// Without accounts every password is refused
+		logger.Error("auth_file_load_failed", "error", err)
+	}
+	if err := s.ReloadAuthKeys(); err != nil {
+		logger.Error("auth_keys_load_failed", "error", err)
 	}
 
 	// Create handlers
 	handler := NewHandler(s)
 	s.connectHandler = NewConnectHandler(s)
 
-	s.httpServer = &http.Server{
-		Addr:         fmt.Sprintf(":%d", cfg.Port),
-		Handler:      handler,
-		ReadTimeout:  cfg.Timeout,
-		WriteTimeout: cfg.Timeout,
-		IdleTimeout:  cfg.IdleTimeout,
+	s.httpServer = s.newHTTPServer(cfg.Port, handler)
+	if cfg.GatewayPort != 0 {
+		s.gatewayServer = s.newHTTPServer(cfg.GatewayPort, NewGateway(s, cfg.Gateway))
+	}
+	if cfg.ListenUnix != "" {
+		s.unixServer = s.newHTTPServer(0, handler)
 	}
+	s.newExtraListeners(handler)
 
 	return s
 }
 
+// newHTTPServer creates an http.Server for a client-facing listener on port.
+// The request read and response write deadlines follow reloads; the header
+// and keep-alive timeouts keep their startup values.
+func (s *Server) newHTTPServer(port int, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              fmt.Sprintf(":%d", port),
+		Handler:           s.withDeadlines(handler),
+		ReadHeaderTimeout: s.cfg.Timeout,
+		IdleTimeout:       s.cfg.IdleTimeout,
+		// Each client connection gets a session ID shared by all its requests
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			ctx = ContextWithClientAddr(ctx, c.RemoteAddr())
+			return ContextWithSessionID(ctx, GenerateRequestID())
+		},
+	}
+}
+
+// SetCircuitBreaker sets the circuit breaker fed with upstream outcomes.
+// Must be called before Start.
+func (s *Server) SetCircuitBreaker(cb *balancer.CircuitBreaker) {
+	s.circuitBreaker = cb
+}
+
+// SetQuotaStore sets the store counting the daily transfer of the proxy
+// users, shared by the instances of a cluster. Must be called before Start.
+func (s *Server) SetQuotaStore(st store.Store) {
+	s.quotas = newQuotas(s.cfg, st)
+}
+
+// SetPassiveHealth sets the monitor fed with upstream outcomes for passive
+// health checking. Must be called before Start.
+func (s *Server) SetPassiveHealth(pm *health.PassiveMonitor) {
+	s.passiveHealth = pm
+}
+
+// recordUpstreamResult counts the outcome of reaching the upstream via ip and
+// feeds it to the circuit breaker and passive health checks.
+func (s *Server) recordUpstreamResult(ip netip.Addr, err error) {
+	// A denied destination says nothing about the IP
+	if isDeniedAddr(err) {
+		return
+	}
+	if err != nil {
+		metrics.UpstreamErrors.WithLabelValues(ip.String(), classifyUpstreamError(err)).Inc()
+	}
+	if s.passiveHealth != nil && err != nil && isConnectFailure(err) {
+		s.passiveHealth.ObserveError(ip, err)
+	}
+	if s.circuitBreaker == nil {
+		return
+	}
+	if err != nil {
+		s.circuitBreaker.RecordFailure(ip)
+		return
+	}
+	s.circuitBreaker.RecordSuccess(ip)
+}
+
+// recordUpstreamStatus counts an upstream response status received via ip and
+// feeds it to passive health checks.
+func (s *Server) recordUpstreamStatus(ip netip.Addr, statusCode int) {
+	metrics.UpstreamResponses.WithLabelValues(ip.String(), statusClass(statusCode)).Inc()
+	if s.passiveHealth != nil {
+		s.passiveHealth.ObserveResponse(ip, statusCode)
+	}
+}
+
+// statusClass returns the class of an HTTP status code, such as "5xx".
+func statusClass(code int) string {
+	return strconv.Itoa(code/100) + "xx"
+}
+
+// isConnectFailure reports whether err means the upstream could not be reached
+// through the outbound IP: dial errors and TLS handshake failures.
+func isConnectFailure(err error) bool {
+	return isDialError(err) || classifyUpstreamError(err) == ErrorClassTLS
+}
+
+// Listen listens on the TCP address addr, with SO_REUSEPORT when reuse_port
+// is set so that a new process can take over the address during an upgrade.
+func (s *Server) Listen(addr string) (net.Listener, error) {
+	return netutil.Listen(addr, s.cfg.ReusePort)
+}
+
 // Start starts the proxy server.
 func (s *Server) Start() error {
+	ln, err := s.Listen(s.httpServer.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve serves proxy clients on ln, over TLS when a listener certificate is
+// configured.
+func (s *Server) Serve(ln net.Listener) error {
 	logger.Info("starting proxy server",
 		"port", s.cfg.Port,
 		"ips", s.cfg.IPs,
-		"auth_enabled", s.cfg.Auth != "",
+		"auth_enabled", s.AuthRequired(),
+		"tls", s.TLSEnabled(),
+		"http2", s.cfg.HTTP2,
+		"proxy_protocol", len(s.proxyTrusted) > 0,
+	)
+	if s.tunnels != nil {
+		s.tunnels.Start()
+	}
+	if s.reaper != nil {
+		s.reaper.Start()
+	}
+	s.bandwidth.Start(throughputInterval, reportThroughput)
+	ln = s.ProxyProtocolListener(ln)
+
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	if s.cfg.HTTP2 {
+		protocols.SetHTTP2(s.TLSEnabled())
+		protocols.SetUnencryptedHTTP2(!s.TLSEnabled())
+	}
+	s.httpServer.Protocols = &protocols
+
+	if s.TLSEnabled() {
+		if err := s.ReloadTLS(s.cfg.ListenTLSCert, s.cfg.ListenTLSKey); err != nil {
+			ln.Close()
+			return err
+		}
+		if err := s.ReloadClientCA(); err != nil {
+			ln.Close()
+			return err
+		}
+		s.httpServer.TLSConfig = s.tlsConfig()
+		return s.httpServer.ServeTLS(ln, "", "")
+	}
+	return s.httpServer.Serve(ln)
+}
+
+// UnixEnabled reports whether the unix socket listener is configured.
+func (s *Server) UnixEnabled() bool {
+	return s.unixServer != nil
+}
+
+// StartUnix listens on the listen_unix socket and serves proxy clients on it,
+// over plain HTTP since only local processes can connect. It must only be
+// called if UnixEnabled.
+func (s *Server) StartUnix() error {
+	mode, err := s.cfg.UnixSocketFileMode()
+	if err != nil {
+		return err
+	}
+	ln, err := netutil.ListenUnix(s.cfg.ListenUnix, mode)
+	if err != nil {
+		return err
+	}
+	logger.Info("starting proxy unix listener", "path", s.cfg.ListenUnix, "mode", s.cfg.UnixSocketMode)
+
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(s.cfg.HTTP2)
+	s.unixServer.Protocols = &protocols
+	return s.unixServer.Serve(ln)
+}
+
+// GatewayEnabled reports whether the gateway listener is configured.
+func (s *Server) GatewayEnabled() bool {
+	return s.gatewayServer != nil
+}
+
+// StartGateway starts the gateway listener. It must only be called if
+// GatewayEnabled.
+func (s *Server) StartGateway() error {
+	ln, err := s.Listen(s.gatewayServer.Addr)
+	if err != nil {
+		return err
+	}
+	return s.ServeGateway(ln)
+}
+
+// ServeGateway serves gateway clients on ln.
+func (s *Server) ServeGateway(ln net.Listener) error {
+	logger.Info("starting gateway server",
+		"port", s.cfg.GatewayPort,
+		"routes", len(s.cfg.Gateway),
 	)
-	return s.httpServer.ListenAndServe()
+	return s.gatewayServer.Serve(s.ProxyProtocolListener(ln))
+}
+
+// ProxyProtocolListener returns ln reading PROXY protocol headers from the
+// trusted load balancers, so that connections report the real client address.
+// Without trusted sources configured ln is returned unchanged.
+func (s *Server) ProxyProtocolListener(ln net.Listener) net.Listener {
+	if len(s.proxyTrusted) == 0 {
+		return ln
+	}
+	return proxyproto.NewListener(ln, s.proxyProtocolTrusted, s.cfg.Timeout)
+}
+
+// proxyProtocolTrusted reports whether addr is a trusted load balancer.
+func (s *Server) proxyProtocolTrusted(addr net.Addr) bool {
+	ip, err := netutil.HostAddr(addr.String())
+	if err != nil {
+		return false
+	}
+	for _, prefix := range s.proxyTrusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
 
 // Shutdown gracefully shuts down the server.
 func (s *Server) Shutdown(ctx context.Context) error {
 	logger.Info("shutting down proxy server")
+	if s.tunnels != nil {
+		s.tunnels.Stop()
+	}
+	if s.reaper != nil {
+		s.reaper.Stop()
+	}
+	s.bandwidth.Stop()
+	s.stopDrains()
 	s.transportPool.Close()
+	return s.StopAccepting(ctx)
+}
+
+// StopAccepting closes the proxy, additional, unix socket and gateway
+// listeners and waits for the in-flight HTTP requests, leaving CONNECT tunnels
+// open so that they can be drained with WaitForConnections. With reuse_port,
+// new connections go to the other processes listening on the same ports;
+// those still queued on these listeners, not yet accepted, are reset.
+func (s *Server) StopAccepting(ctx context.Context) error {
+	s.stopListeners(ctx)
+	if s.unixServer != nil {
+		if err := s.unixServer.Shutdown(ctx); err != nil {
+			logger.Error("unix listener shutdown error", "error", err)
+		}
+	}
+	if s.gatewayServer != nil {
+		if err := s.gatewayServer.Shutdown(ctx); err != nil {
+			logger.Error("gateway server shutdown error", "error", err)
+		}
+	}
 	return s.httpServer.Shutdown(ctx)
 }
 
 // authenticate checks if the request is authenticated.
 func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) bool {
-	// No auth configured
-	if s.cfg.Auth == "" {
+	if !s.AuthRequired() || listenerNoAuth(r.Context()) {
 		return true
 	}
 
-	username, password, ok := s.cfg.GetAuthCredentials()
-	if !ok {
-		return true // Invalid config, skip auth
+	// A verified client certificate needs no other credentials
+	if _, ok := s.certUser(r); ok {
+		return true
 	}
 
-	// Get Proxy-Authorization header
-	auth := r.Header.Get("Proxy-Authorization")
-	if auth == "" {
+	// API keys may come in their own header
+	if key := s.requestKey(r); key != "" {
+		if _, ok := s.AuthenticateKey(key, r.RemoteAddr); !ok {
+			s.sendProxyAuthRequired(w)
+			return false
+		}
+		return true
+	}
+
+	reqUser, reqPass, ok := parseProxyAuth(r)
+	if !ok {
 		s.sendProxyAuthRequired(w)
 		metrics.AuthFailures.Inc()
 		return false
 	}
 
-	// Parse Basic auth
-	const prefix = "Basic "
-	if !strings.HasPrefix(auth, prefix) {
+	if _, ok := s.Authenticate(reqUser, reqPass, r.RemoteAddr); !ok {
 		s.sendProxyAuthRequired(w)
-		metrics.AuthFailures.Inc()
 		return false
 	}
+	return true
+}
 
-	decoded, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+// AuthRequired reports whether clients must present credentials, i.e. valid
+// static credentials, a credentials or API keys file or a signing secret are
+// configured.
+func (s *Server) AuthRequired() bool {
+	return s.passwordAuth() || s.cfg.AuthKeysFile != "" || s.cfg.AuthHMACSecret != ""
+}
+
+// passwordAuth reports whether users may authenticate with a password, from
+// the static credentials or the credentials file.
+func (s *Server) passwordAuth() bool {
+	_, _, staticOK := s.cfg.GetAuthCredentials()
+	return staticOK || s.cfg.AuthFile != ""
+}
+
+// ReloadAuthFile reads the credentials file, replacing the current accounts.
+// On error the current accounts are kept. It does nothing without a
+// credentials file.
+func (s *Server) ReloadAuthFile() error {
+	if s.cfg.AuthFile == "" {
+		return nil
+	}
+	users, err := auth.LoadUsers(s.cfg.AuthFile)
 	if err != nil {
-		s.sendProxyAuthRequired(w)
-		metrics.AuthFailures.Inc()
-		return false
+		return fmt.Errorf("loading credentials file: %w", err)
 	}
+	s.authUsers.Store(users)
+	logger.Info("auth_file_loaded", "path", s.cfg.AuthFile, "users", users.Len())
+	return nil
+}
 
-	credentials := string(decoded)
-	colonIdx := strings.Index(credentials, ":")
-	if colonIdx < 0 {
-		s.sendProxyAuthRequired(w)
-		metrics.AuthFailures.Inc()
-		return false
+// ReloadAuthKeys reads the API keys file, replacing the current keys. On
+// error the current keys are kept. It does nothing without an API keys file.
+func (s *Server) ReloadAuthKeys() error {
+	if s.cfg.AuthKeysFile == "" {
+		return nil
+	}
+	keys, err := auth.LoadKeys(s.cfg.AuthKeysFile)
+	if err != nil {
+		return fmt.Errorf("loading API keys file: %w", err)
 	}
+	s.authKeys.Store(keys)
+	logger.Info("auth_keys_loaded", "path", s.cfg.AuthKeysFile, "keys", keys.Len())
+	return nil
+}
 
-	reqUser := credentials[:colonIdx]
-	reqPass := credentials[colonIdx+1:]
+// ReloadHMACSecret re-reads the signed credentials secret file, replacing the
+// current secret. On error the current secret is kept. It does nothing
+// without a secret file.
+func (s *Server) ReloadHMACSecret() error {
+	if s.cfg.AuthHMACSecretFile == "" {
+		return nil
+	}
+	secret, err := config.ReadSecretFile(s.cfg.AuthHMACSecretFile)
+	if err != nil {
+		return fmt.Errorf("loading HMAC secret file: %w", err)
+	}
+	s.hmacSecret.Store(&secret)
+	logger.Info("auth_hmac_secret_loaded", "path", s.cfg.AuthHMACSecretFile)
+	return nil
+}
 
-	// Use constant-time comparison to prevent timing attacks
-	userMatch := subtle.ConstantTimeCompare([]byte(reqUser), []byte(username)) == 1
-	passMatch := subtle.ConstantTimeCompare([]byte(reqPass), []byte(password)) == 1
-	if !userMatch || !passMatch {
-		logger.Warn("authentication failed", "user", reqUser, "remote", r.RemoteAddr)
-		s.sendProxyAuthRequired(w)
-		metrics.AuthFailures.Inc()
-		return false
+// hmacKey returns the signed credentials secret, as last read from its file.
+func (s *Server) hmacKey() string {
+	if secret := s.hmacSecret.Load(); secret != nil {
+		return *secret
 	}
+	return s.cfg.AuthHMACSecret
+}
 
-	return true
+// AuthenticateKey checks an API key presented by the client at remoteAddr
+// and returns the proxy user it belongs to. Failures are logged and counted.
+func (s *Server) AuthenticateKey(key, remoteAddr string) (string, bool) {
+	user, ok := s.keyUser(key)
+	if !ok {
+		logger.Warn("authentication failed", "api_key", true, "remote", remoteAddr)
+		s.authFailed(remoteAddr)
+		return "", false
+	}
+	return user, true
+}
+
+// AuthBanned reports whether the client at remoteAddr is banned after
+// failing to authenticate too often, and until when.
+func (s *Server) AuthBanned(remoteAddr string) (time.Time, bool) {
+	if s.lockout == nil {
+		return time.Time{}, false
+	}
+	return s.lockout.Banned(addrHost(remoteAddr))
+}
+
+// authFailed counts a failed authentication of the client at remoteAddr,
+// banning it after too many.
+func (s *Server) authFailed(remoteAddr string) {
+	metrics.AuthFailures.Inc()
+	if s.lockout == nil {
+		return
+	}
+	ip := addrHost(remoteAddr)
+	if until, banned := s.lockout.Fail(ip); banned {
+		logger.Warn("auth_client_banned", "client_ip", ip, "until", until, "failures", s.cfg.AuthMaxFailures)
+		metrics.AuthBans.Inc()
+	}
+}
+
+// addrHost returns the host of a host:port address, or addr itself.
+func addrHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// keyUser returns the proxy user an API key belongs to.
+func (s *Server) keyUser(key string) (string, bool) {
+	keys := s.authKeys.Load()
+	if keys == nil {
+		return "", false
+	}
+	return keys.Lookup(key)
+}
+
+// requestKey returns the API key in the key header of r, if API keys are
+// enabled.
+func (s *Server) requestKey(r *http.Request) string {
+	if s.cfg.AuthKeysFile == "" {
+		return ""
+	}
+	return r.Header.Get(s.cfg.AuthKeyHeader)
+}
+
+// Authenticate checks credentials presented by the client at remoteAddr
+// against the signing secret, the static credentials and the credentials
+// file, or as an API key when user is empty. It returns the proxy user, which
+// is the embedded id for signed credentials. Failures are logged and counted.
+func (s *Server) Authenticate(user, pass, remoteAddr string) (string, bool) {
+	if _, banned := s.AuthBanned(remoteAddr); banned {
+		logger.Debug("authentication refused", "remote", remoteAddr, "reason", "banned")
+		return "", false
+	}
+
+	// API keys come as the password of an empty user
+	if user == "" && s.cfg.AuthKeysFile != "" {
+		return s.AuthenticateKey(pass, remoteAddr)
+	}
+
+	// Signed, expiring credentials carry everything in the username
+	if secret := s.hmacKey(); secret != "" {
+		id, err := auth.VerifyCredential(secret, user, time.Now())
+		if err == nil {
+			return id, true
+		}
+		if !s.passwordAuth() {
+			logger.Warn("authentication failed", "user", user, "remote", remoteAddr, "error", err)
+			s.authFailed(remoteAddr)
+			return "", false
+		}
+	}
+
+	if !s.checkPassword(user, pass) {
+		logger.Warn("authentication failed", "user", user, "remote", remoteAddr)
+		s.authFailed(remoteAddr)
+		return "", false
+	}
+
+	return user, true
+}
+
+// checkPassword reports whether user and pass match the static credentials
+// or an account of the credentials file.
+func (s *Server) checkPassword(user, pass string) bool {
+	if username, password, ok := s.cfg.GetAuthCredentials(); ok {
+		// Use constant-time comparison to prevent timing attacks
+		userMatch := subtle.ConstantTimeCompare([]byte(user), []byte(username)) == 1
+		passMatch := subtle.ConstantTimeCompare([]byte(pass), []byte(password)) == 1
+		if userMatch && passMatch {
+			return true
+		}
+	}
+	if users := s.authUsers.Load(); users != nil {
+		return users.Verify(user, pass)
+	}
+	return false
+}
+
+// authUser returns the name of the proxy user presenting credentials on r.
+// For signed credentials this is the id embedded in the username, for API
+// keys the user the key belongs to, for client certificates the user the
+// certificate names.
+func (s *Server) authUser(r *http.Request) (string, bool) {
+	if user, ok := s.certUser(r); ok {
+		return user, true
+	}
+	if key := s.requestKey(r); key != "" {
+		return s.keyUser(key)
+	}
+	user, pass, ok := parseProxyAuth(r)
+	if !ok {
+		return "", false
+	}
+	if user == "" && s.cfg.AuthKeysFile != "" {
+		return s.keyUser(pass)
+	}
+	if secret := s.hmacKey(); secret != "" {
+		if id, err := auth.VerifyCredential(secret, user, time.Now()); err == nil {
+			return id, true
+		}
+	}
+	return user, true
+}
+
+// requestUser returns the authenticated proxy user carried by ctx, or ""
+// for anonymous clients.
+func requestUser(ctx context.Context) string {
+	user, ok := strings.CutPrefix(balancer.ClientFromContext(ctx), "user:")
+	if !ok {
+		return ""
+	}
+	return user
+}
+
+// recordUser counts a request of user and the bytes received from and sent
+// to its client, also against its daily transfer quota. It does nothing for
+// anonymous clients.
+func (s *Server) recordUser(user string, bytesIn, bytesOut int64) {
+	if user == "" {
+		return
+	}
+	if s.quotas != nil {
+		s.quotas.AddBytes(user, bytesIn+bytesOut)
+	}
+	metrics.UserRequests.WithLabelValues(user).Inc()
+	if bytesIn > 0 {
+		metrics.UserBytes.WithLabelValues(user, "received").Add(float64(bytesIn))
+	}
+	if bytesOut > 0 {
+		metrics.UserBytes.WithLabelValues(user, "sent").Add(float64(bytesOut))
+	}
+}
+
+// parseProxyAuth returns the Basic credentials from the Proxy-Authorization header.
+func parseProxyAuth(r *http.Request) (username, password string, ok bool) {
+	header := r.Header.Get("Proxy-Authorization")
+	const prefix = "Basic "
+	if !strings.HasPrefix(header, prefix) {
+		return "", "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(header[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+
+	username, password, ok = strings.Cut(string(decoded), ":")
+	return username, password, ok
 }
 
 // sendProxyAuthRequired sends a 407 Proxy Authentication Required response.
@@ -136,13 +742,56 @@ func (s *Server) sendProxyAuthRequired(w http.ResponseWriter) {
 }
 
 // selectIP selects an outbound IP for the given host.
-func (s *Server) selectIP(host string) (string, error) {
-	return s.balancer.Select(host)
+// The context may carry the client identity used for session affinity.
+func (s *Server) selectIP(ctx context.Context, host string) (netip.Addr, error) {
+	return s.balancer.SelectWithContext(s.withUserRule(ctx), host)
+}
+
+// setUserRules sets the per-user rules, with the outbound IP of each rule
+// naming one parsed once. Rules come from validated configuration.
+func (s *Server) setUserRules(rules []config.UserRule) {
+	s.userRules = make(map[string]config.UserRule, len(rules))
+	s.userIPs = make(map[string]netip.Addr)
+	for _, rule := range rules {
+		s.userRules[rule.Name] = rule
+		if rule.IP != "" {
+			s.userIPs[rule.Name] = netutil.MustParseAddr(rule.IP)
+		}
+	}
+}
+
+// setPools sets the outbound IPs of each named pool, parsed once. Pools come
+// from validated configuration.
+func (s *Server) setPools(pools map[string][]string) {
+	s.pools = make(map[string][]netip.Addr, len(pools))
+	for name, ips := range pools {
+		s.pools[name] = netutil.MustParseAddrs(ips)
+	}
+}
+
+// withUserRule restricts selection to the outbound IP or pool the proxy user
+// of ctx is mapped to, if any. An IP already required by a frontend instance
+// is kept, as the frontend applied the rule.
+func (s *Server) withUserRule(ctx context.Context) context.Context {
+	if len(s.userRules) == 0 || balancer.RequiredIPFromContext(ctx).IsValid() {
+		return ctx
+	}
+	rule, ok := s.userRules[requestUser(ctx)]
+	if !ok {
+		return ctx
+	}
+	switch {
+	case rule.IP != "":
+		return balancer.ContextWithRequiredIP(ctx, s.userIPs[rule.Name])
+	case rule.Pool != "":
+		return balancer.ContextWithPool(ctx, rule.Pool)
+	}
+	return ctx
 }
 
 // ConnectionContext holds information about an acquired connection.
 type ConnectionContext struct {
-	IP        string
+	IP        netip.Addr
 	Host      string
 	RequestID string
 	release   func()
@@ -161,7 +810,7 @@ func (c *ConnectionContext) Release() {
 func (s *Server) AcquireConnection(host, requestID string) (*ConnectionContext, error) {
 	// Select outbound IP
 	logger.Trace("connection_acquire_start", "request_id", requestID, "host", host)
-	ip, err := s.selectIP(host)
+	ip, err := s.selectIP(context.Background(), host)
 	if err != nil {
 		logger.Trace("connection_ip_selection_failed", "request_id", requestID, "host", host, "error", err)
 		return nil, err
@@ -196,8 +845,9 @@ func (s *Server) AcquireConnection(host, requestID string) (*ConnectionContext,
 	}, nil
 }
 
-// WaitForConnections waits for active connections to complete.
-func (s *Server) WaitForConnections(timeout time.Duration) {
+// WaitForConnections waits for active connections to complete, for at most
+// timeout unless it is 0. It reports whether all connections completed.
+func (s *Server) WaitForConnections(timeout time.Duration) bool {
 	deadline := time.Now().Add(timeout)
 	ticker := time.NewTicker(100 * time.Millisecond)
 	defer ticker.Stop()
@@ -207,14 +857,45 @@ func (s *Server) WaitForConnections(timeout time.Duration) {
 		case <-ticker.C:
 			if s.limiter.GetTotalCount() == 0 {
 				logger.Info("all connections closed")
-				return
+				return true
 			}
-			if time.Now().After(deadline) {
+			if timeout > 0 && time.Now().After(deadline) {
 				logger.Warn("timeout waiting for connections",
 					"active", s.limiter.GetTotalCount(),
 				)
-				return
+				return false
 			}
 		}
 	}
 }
+
+// trackRelay registers a tunnel being relayed for CloseTunnels. closeFn must
+// tear the tunnel down. The returned function unregisters it and must be
+// called when the relay ends.
+func (s *Server) trackRelay(t *Tunnel, closeFn func()) (remove func()) {
+	s.relaysMu.Lock()
+	s.relays[t] = closeFn
+	s.relaysMu.Unlock()
+	return func() {
+		s.relaysMu.Lock()
+		delete(s.relays, t)
+		s.relaysMu.Unlock()
+	}
+}
+
+// CloseTunnels closes the CONNECT, SOCKS5 and WebSocket tunnels being relayed
+// and returns how many it closed, e.g. when they outlive the shutdown timeout.
+func (s *Server) CloseTunnels() int {
+	s.relaysMu.Lock()
+	closers := make([]func(), 0, len(s.relays))
+	for t, closeFn := range s.relays {
+		closers = append(closers, closeFn)
+		delete(s.relays, t)
+	}
+	s.relaysMu.Unlock()
+
+	for _, closeFn := range closers {
+		closeFn()
+	}
+	return len(closers)
+}
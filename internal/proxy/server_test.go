@@ -1,16 +1,30 @@
 package proxy
 
 import (
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/cr0hn/outbound-lb/internal/auth"
 	"github.com/cr0hn/outbound-lb/internal/balancer"
 	"github.com/cr0hn/outbound-lb/internal/config"
 	"github.com/cr0hn/outbound-lb/internal/limiter"
 	"github.com/cr0hn/outbound-lb/internal/metrics"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
 )
 
 func newTestServerWithAuth(t *testing.T, auth string) *Server {
@@ -30,10 +44,10 @@ func newTestServerWithAuth(t *testing.T, auth string) *Server {
 		LogFormat:     "json",
 	}
 
-	stats := metrics.NewStatsCollector(cfg.IPs)
-	lim := limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, cfg.IPs)
+	stats := metrics.NewStatsCollector(netutil.MustParseAddrs(cfg.IPs))
+	lim := limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, netutil.MustParseAddrs(cfg.IPs))
 	balCfg := balancer.Config{
-		IPs:           cfg.IPs,
+		IPs:           netutil.MustParseAddrs(cfg.IPs),
 		HistoryWindow: int64(cfg.HistoryWindow.Seconds()),
 		HistorySize:   cfg.HistorySize,
 		Limiter:       lim,
@@ -58,10 +72,10 @@ func TestServer_NewServer(t *testing.T) {
 		LogFormat:     "json",
 	}
 
-	stats := metrics.NewStatsCollector(cfg.IPs)
-	lim := limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, cfg.IPs)
+	stats := metrics.NewStatsCollector(netutil.MustParseAddrs(cfg.IPs))
+	lim := limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, netutil.MustParseAddrs(cfg.IPs))
 	balCfg := balancer.Config{
-		IPs:           cfg.IPs,
+		IPs:           netutil.MustParseAddrs(cfg.IPs),
 		HistoryWindow: int64(cfg.HistoryWindow.Seconds()),
 		HistorySize:   cfg.HistorySize,
 		Limiter:       lim,
@@ -202,11 +216,11 @@ func TestServer_Authenticate_PasswordWithColon(t *testing.T) {
 func TestServer_SelectIP(t *testing.T) {
 	server := newTestServerWithAuth(t, "")
 
-	ip, err := server.selectIP("example.com")
+	ip, err := server.selectIP(context.Background(), "example.com")
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
-	if ip != "127.0.0.1" {
+	if ip != netip.MustParseAddr("127.0.0.1") {
 		t.Errorf("expected 127.0.0.1, got %s", ip)
 	}
 }
@@ -239,3 +253,449 @@ func TestServer_WaitForConnections_NoConnections(t *testing.T) {
 		t.Errorf("expected quick return, took %v", elapsed)
 	}
 }
+
+func TestServer_CloseTunnels(t *testing.T) {
+	server := newTestServerWithAuth(t, "")
+	clientEnd, client := net.Pipe()
+	defer clientEnd.Close()
+	targetEnd, target := net.Pipe()
+	defer targetEnd.Close()
+
+	tun := &Tunnel{server: server, conn: target, ip: netip.MustParseAddr("127.0.0.1"), host: "api.example.com:443",
+		method: http.MethodConnect, status: http.StatusOK, start: time.Now(), release: func() {}}
+	done := make(chan struct{})
+	go func() {
+		tun.Relay(client, "127.0.0.1:50000", "req", "session")
+		close(done)
+	}()
+
+	// Wait for the relay to be registered
+	deadline := time.Now().Add(time.Second)
+	for {
+		server.relaysMu.Lock()
+		n := len(server.relays)
+		server.relaysMu.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel was not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := server.CloseTunnels(); n != 1 {
+		t.Fatalf("CloseTunnels() = %d, want 1", n)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("relay did not end after CloseTunnels")
+	}
+	if n := server.CloseTunnels(); n != 0 {
+		t.Errorf("second CloseTunnels() = %d, want 0", n)
+	}
+}
+
+func TestServer_Authenticate_SignedCredentials(t *testing.T) {
+	server := newTestServerWithAuth(t, "")
+	server.cfg.AuthHMACSecret = "shared-secret"
+
+	tests := []struct {
+		name     string
+		username string
+		want     bool
+	}{
+		{"valid", auth.SignCredential("shared-secret", "job-1", time.Now().Add(time.Hour)), true},
+		{"expired", auth.SignCredential("shared-secret", "job-1", time.Now().Add(-time.Minute)), false},
+		{"wrong secret", auth.SignCredential("other-secret", "job-1", time.Now().Add(time.Hour)), false},
+		{"unsigned", "job-1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			encoded := base64.StdEncoding.EncodeToString([]byte(tt.username + ":x"))
+			req.Header.Set("Proxy-Authorization", "Basic "+encoded)
+			w := httptest.NewRecorder()
+
+			if got := server.authenticate(w, req); got != tt.want {
+				t.Errorf("authenticate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServer_ReloadHMACSecret(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hmac-secret")
+	if err := os.WriteFile(path, []byte("old-secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	server := newTestServerWithAuth(t, "")
+	server.cfg.AuthHMACSecret = "old-secret"
+	server.cfg.AuthHMACSecretFile = path
+
+	signed := func(secret string) string {
+		return auth.SignCredential(secret, "job-1", time.Now().Add(time.Hour))
+	}
+	if _, ok := server.Authenticate(signed("old-secret"), "x", "192.0.2.1:1"); !ok {
+		t.Fatal("credential signed with the current secret was refused")
+	}
+
+	// The secret follows the file
+	if err := os.WriteFile(path, []byte("new-secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.ReloadHMACSecret(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := server.Authenticate(signed("new-secret"), "x", "192.0.2.1:1"); !ok {
+		t.Error("credential signed with the rotated secret was refused")
+	}
+	if _, ok := server.Authenticate(signed("old-secret"), "x", "192.0.2.1:1"); ok {
+		t.Error("credential signed with the old secret was accepted")
+	}
+
+	// An empty file keeps the current secret
+	os.WriteFile(path, nil, 0o600)
+	if err := server.ReloadHMACSecret(); err == nil {
+		t.Error("ReloadHMACSecret() accepted an empty file")
+	}
+	if _, ok := server.Authenticate(signed("new-secret"), "x", "192.0.2.1:1"); !ok {
+		t.Error("credential was refused after a failed reload")
+	}
+}
+
+func TestServer_UpdateTimeouts(t *testing.T) {
+	server := newTestServerWithAuth(t, "")
+	tr := server.transportPool.Get(netip.MustParseAddr("127.0.0.1"))
+
+	cfg := *server.cfg
+	cfg.Timeout = 100 * time.Millisecond
+	cfg.IdleTimeout = 5 * time.Second
+	cfg.ResponseHeaderTimeout = 2 * time.Second
+	server.UpdateTimeouts(&cfg)
+
+	if server.Timeout() != cfg.Timeout || server.IdleTimeout() != cfg.IdleTimeout {
+		t.Errorf("timeouts = %v/%v, want %v/%v", server.Timeout(), server.IdleTimeout(), cfg.Timeout, cfg.IdleTimeout)
+	}
+	if got := server.transportPool.Get(netip.MustParseAddr("127.0.0.1")); got == tr || got.ResponseHeaderTimeout != cfg.ResponseHeaderTimeout {
+		t.Error("expected the upstream transport to be rebuilt with the new tuning")
+	}
+
+	// Requests read slower than the new timeout are cut short
+	readErr := make(chan error, 1)
+	srv := httptest.NewServer(server.withDeadlines(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.Copy(io.Discard, r.Body)
+		readErr <- err
+	})))
+	defer srv.Close()
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go func() {
+		pw.Write([]byte("chunk"))
+		time.Sleep(500 * time.Millisecond)
+		pw.Close()
+	}()
+	req, _ := http.NewRequest(http.MethodPost, srv.URL, pr)
+	go http.DefaultClient.Do(req)
+	select {
+	case err := <-readErr:
+		if err == nil {
+			t.Error("expected the request body read to time out")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler did not finish")
+	}
+}
+
+func TestServer_Authenticate_SignedAndStatic(t *testing.T) {
+	server := newTestServerWithAuth(t, "user:pass")
+	server.cfg.AuthHMACSecret = "shared-secret"
+
+	for _, creds := range []string{"user:pass", auth.SignCredential("shared-secret", "job-1", time.Now().Add(time.Hour)) + ":"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(creds)))
+		w := httptest.NewRecorder()
+
+		if !server.authenticate(w, req) {
+			t.Errorf("expected authentication to pass for %q", creds)
+		}
+	}
+}
+
+func TestServer_Authenticate_AuthFile(t *testing.T) {
+	hash := func(pass string) string {
+		h, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(h)
+	}
+	path := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(path, []byte("alice:"+hash("one")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	server := newTestServerWithAuth(t, "")
+	server.cfg.AuthFile = path
+	if err := server.ReloadAuthFile(); err != nil {
+		t.Fatal(err)
+	}
+	if !server.AuthRequired() {
+		t.Fatal("AuthRequired() = false with a credentials file")
+	}
+	if _, ok := server.Authenticate("alice", "one", "192.0.2.1:1"); !ok {
+		t.Error("alice was refused")
+	}
+	if _, ok := server.Authenticate("bob", "two", "192.0.2.1:1"); ok {
+		t.Error("bob was accepted before being added")
+	}
+
+	// Accounts follow the file
+	if err := os.WriteFile(path, []byte("bob:"+hash("two")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.ReloadAuthFile(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := server.Authenticate("bob", "two", "192.0.2.1:1"); !ok {
+		t.Error("bob was refused after being added")
+	}
+	if _, ok := server.Authenticate("alice", "one", "192.0.2.1:1"); ok {
+		t.Error("alice was accepted after being removed")
+	}
+
+	// An invalid file keeps the current accounts
+	os.WriteFile(path, []byte("bob:plaintext\n"), 0o600)
+	if err := server.ReloadAuthFile(); err == nil {
+		t.Error("ReloadAuthFile() accepted an invalid file")
+	}
+	if _, ok := server.Authenticate("bob", "two", "192.0.2.1:1"); !ok {
+		t.Error("bob was refused after a failed reload")
+	}
+}
+
+func TestHandler_APIKeys(t *testing.T) {
+	forwarded := make(chan string, 1)
+	backend := newTestBackendWithHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		forwarded <- r.Header.Get("X-Proxy-Key")
+	})
+	defer backend.Close()
+
+	sum := sha256.Sum256([]byte("k-ci"))
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte("ci:"+hex.EncodeToString(sum[:])+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	opts := DefaultTestServerOptions()
+	opts.Auth = "user:pass"
+	server := newTestServerWithOptions(t, opts)
+	server.cfg.AuthKeysFile = path
+	if err := server.ReloadAuthKeys(); err != nil {
+		t.Fatal(err)
+	}
+	handler := NewHandler(server)
+
+	tests := []struct {
+		name   string
+		header string
+		basic  string
+		want   int
+	}{
+		{"header", "k-ci", "", http.StatusOK},
+		{"basic password", "", ":k-ci", http.StatusOK},
+		{"static credentials", "", "user:pass", http.StatusOK},
+		{"unknown header key", "k-other", "", http.StatusProxyAuthRequired},
+		{"unknown basic key", "", ":k-other", http.StatusProxyAuthRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newTestRequest(t, http.MethodGet, backend.URL+"/")
+			if tt.header != "" {
+				req.Header.Set("X-Proxy-Key", tt.header)
+			}
+			if tt.basic != "" {
+				req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(tt.basic)))
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			assertStatusCode(t, w, tt.want)
+			if tt.want != http.StatusOK {
+				return
+			}
+			if got := <-forwarded; got != "" {
+				t.Errorf("upstream got key header %q", got)
+			}
+		})
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Proxy-Key", "k-ci")
+	if user, ok := server.authUser(req); !ok || user != "ci" {
+		t.Errorf("authUser() = %q, %v, want ci", user, ok)
+	}
+	if user, ok := server.Authenticate("", "k-ci", "192.0.2.1:1"); !ok || user != "ci" {
+		t.Errorf("Authenticate(\"\", key) = %q, %v, want ci", user, ok)
+	}
+}
+
+func TestHandler_AuthLockout(t *testing.T) {
+	opts := DefaultTestServerOptions()
+	opts.Auth = "user:pass"
+	server := newTestServerWithOptions(t, opts)
+	server.cfg.AuthMaxFailures = 2
+	server.lockout = auth.NewLockout(2, time.Minute, time.Minute)
+	handler := NewHandler(server)
+
+	request := func(remote, creds string) *httptest.ResponseRecorder {
+		req := newTestRequest(t, http.MethodGet, "http://example.com/")
+		req.RemoteAddr = remote
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(creds)))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	bans := testutil.ToFloat64(metrics.AuthBans)
+	assertStatusCode(t, request("192.0.2.1:1000", "user:wrong"), http.StatusProxyAuthRequired)
+	assertStatusCode(t, request("192.0.2.1:1001", "user:guess"), http.StatusProxyAuthRequired)
+	if got := testutil.ToFloat64(metrics.AuthBans) - bans; got != 1 {
+		t.Errorf("bans = %v, want 1", got)
+	}
+
+	// Banned clients are refused even with valid credentials
+	w := request("192.0.2.1:1002", "user:pass")
+	assertStatusCode(t, w, http.StatusTooManyRequests)
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("ban response has no Retry-After")
+	}
+	if _, ok := server.Authenticate("user", "pass", "192.0.2.1:1003"); ok {
+		t.Error("Authenticate() accepted a banned client")
+	}
+
+	// Other clients are not affected
+	if _, ok := server.Authenticate("user", "pass", "192.0.2.2:1000"); !ok {
+		t.Error("Authenticate() refused another client")
+	}
+}
+
+func TestRecordUser(t *testing.T) {
+	ctx := balancer.ContextWithClient(context.Background(), "user:carol")
+	if got := requestUser(ctx); got != "carol" {
+		t.Fatalf("requestUser() = %q, want carol", got)
+	}
+	if got := requestUser(balancer.ContextWithClient(context.Background(), "10.0.0.1")); got != "" {
+		t.Errorf("requestUser() = %q for an anonymous client", got)
+	}
+
+	requests := testutil.ToFloat64(metrics.UserRequests.WithLabelValues("carol"))
+	sent := testutil.ToFloat64(metrics.UserBytes.WithLabelValues("carol", "sent"))
+	server := newTestServerWithAuth(t, "")
+	server.recordUser("carol", 10, 25)
+	if got := testutil.ToFloat64(metrics.UserRequests.WithLabelValues("carol")) - requests; got != 1 {
+		t.Errorf("user requests grew by %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(metrics.UserBytes.WithLabelValues("carol", "sent")) - sent; got != 25 {
+		t.Errorf("user bytes sent grew by %v, want 25", got)
+	}
+}
+
+func TestServer_WithUserRule(t *testing.T) {
+	server := newTestServerWithIPs(t, []string{"127.0.0.1", "127.0.0.2"})
+	server.setUserRules([]config.UserRule{
+		{Name: "tenant-a", Pool: "residential"},
+		{Name: "tenant-b", IP: "127.0.0.2"},
+	})
+	user := func(name string) context.Context {
+		return balancer.ContextWithClient(context.Background(), "user:"+name)
+	}
+
+	ctx := server.withUserRule(user("tenant-a"))
+	if got := balancer.PoolFromContext(ctx); got != "residential" {
+		t.Errorf("tenant-a pool = %q, want residential", got)
+	}
+	ctx = server.withUserRule(user("tenant-b"))
+	if got := balancer.RequiredIPFromContext(ctx); got != netip.MustParseAddr("127.0.0.2") {
+		t.Errorf("tenant-b IP = %q, want 127.0.0.2", got)
+	}
+	if ip, err := server.selectIP(user("tenant-b"), "example.com"); err != nil || ip != netip.MustParseAddr("127.0.0.2") {
+		t.Errorf("selectIP(tenant-b) = %s, %v, want 127.0.0.2", ip, err)
+	}
+
+	// Unmapped users and anonymous clients are not restricted
+	for _, ctx := range []context.Context{user("other"), balancer.ContextWithClient(context.Background(), "127.0.0.1")} {
+		ctx = server.withUserRule(ctx)
+		if balancer.PoolFromContext(ctx) != "" || balancer.RequiredIPFromContext(ctx).IsValid() {
+			t.Error("selection restricted for a client without a rule")
+		}
+	}
+
+	// An IP chosen by a frontend instance is kept
+	ctx = server.withUserRule(balancer.ContextWithRequiredIP(user("tenant-b"), netip.MustParseAddr("127.0.0.1")))
+	if got := balancer.RequiredIPFromContext(ctx); got != netip.MustParseAddr("127.0.0.1") {
+		t.Errorf("required IP = %q, want the frontend's 127.0.0.1", got)
+	}
+}
+
+func TestServer_SessionIDPerConnection(t *testing.T) {
+	server := newTestServerWithAuth(t, "")
+
+	sessions := make(chan string, 3)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessions <- SessionIDFromContext(r.Context())
+	}))
+	ts.Config.ConnContext = server.httpServer.ConnContext
+	ts.Start()
+	defer ts.Close()
+
+	client := ts.Client()
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(ts.URL)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+	}
+	client.CloseIdleConnections()
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	first, second, third := <-sessions, <-sessions, <-sessions
+	if first == "" {
+		t.Fatal("expected session ID on request context")
+	}
+	if first != second {
+		t.Errorf("expected keep-alive requests to share a session ID, got %s and %s", first, second)
+	}
+	if third == first {
+		t.Error("expected a new session ID for a new connection")
+	}
+}
+
+func TestServer_RecordUpstreamPerIP(t *testing.T) {
+	server := newTestServer(t)
+	ip := netip.MustParseAddr("192.0.2.80")
+	defer metrics.UpstreamResponses.DeletePartialMatch(prometheus.Labels{"ip": ip.String()})
+	defer metrics.UpstreamErrors.DeletePartialMatch(prometheus.Labels{"ip": ip.String()})
+
+	server.recordUpstreamStatus(ip, http.StatusOK)
+	server.recordUpstreamStatus(ip, http.StatusNoContent)
+	server.recordUpstreamStatus(ip, http.StatusTooManyRequests)
+	server.recordUpstreamStatus(ip, http.StatusBadGateway)
+	server.recordUpstreamResult(ip, &net.DNSError{Err: "no such host", Name: "missing.example.com", IsNotFound: true})
+	server.recordUpstreamResult(ip, nil)
+
+	for class, want := range map[string]float64{"2xx": 2, "4xx": 1, "5xx": 1, "3xx": 0} {
+		if got := testutil.ToFloat64(metrics.UpstreamResponses.WithLabelValues(ip.String(), class)); got != want {
+			t.Errorf("expected %v %s responses, got %v", want, class, got)
+		}
+	}
+	if got := testutil.ToFloat64(metrics.UpstreamErrors.WithLabelValues(ip.String(), ErrorClassDNSNotFound)); got != 1 {
+		t.Errorf("expected 1 dns_not_found error, got %v", got)
+	}
+}
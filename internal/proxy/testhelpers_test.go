@@ -10,6 +10,7 @@ import (
 	"github.com/cr0hn/outbound-lb/internal/config"
 	"github.com/cr0hn/outbound-lb/internal/limiter"
 	"github.com/cr0hn/outbound-lb/internal/metrics"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
 )
 
 // TestServerOptions holds options for creating test servers.
@@ -52,6 +53,9 @@ func newTestConfig(opts TestServerOptions) *config.Config {
 	cfg.LogLevel = "error"
 	cfg.LogFormat = "json"
 	cfg.Auth = opts.Auth
+	// Test backends listen on loopback, on random ports
+	cfg.BlockPrivateDestinations = false
+	cfg.ConnectAllowedPorts = nil
 	return cfg
 }
 
@@ -60,10 +64,10 @@ func newTestServerWithOptions(t *testing.T, opts TestServerOptions) *Server {
 	t.Helper()
 
 	cfg := newTestConfig(opts)
-	stats := metrics.NewStatsCollector(cfg.IPs)
-	lim := limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, cfg.IPs)
+	stats := metrics.NewStatsCollector(netutil.MustParseAddrs(cfg.IPs))
+	lim := limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, netutil.MustParseAddrs(cfg.IPs))
 	balCfg := balancer.Config{
-		IPs:           cfg.IPs,
+		IPs:           netutil.MustParseAddrs(cfg.IPs),
 		HistoryWindow: int64(cfg.HistoryWindow.Seconds()),
 		HistorySize:   cfg.HistorySize,
 		Limiter:       lim,
@@ -0,0 +1,21 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+)
+
+// throughputInterval is how often the throughput gauges are updated.
+const throughputInterval = 5 * time.Second
+
+// reportThroughput exports the throughput of users and outbound IPs, in
+// bytes per second.
+func reportThroughput(users, ips map[string]float64) {
+	for user, rate := range users {
+		metrics.UserThroughput.WithLabelValues(user).Set(rate)
+	}
+	for ip, rate := range ips {
+		metrics.IPThroughput.WithLabelValues(ip).Set(rate)
+	}
+}
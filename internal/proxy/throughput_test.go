@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/bandwidth"
+)
+
+func TestHandler_BandwidthPerTunnel(t *testing.T) {
+	backend := newTestBackendWithHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, strings.Repeat("x", 1500))
+	})
+	defer backend.Close()
+
+	server := newTestServerWithIPs(t, []string{"127.0.0.1"})
+	server.bandwidth = bandwidth.New(bandwidth.Limits{PerTunnel: 1000})
+	handler := NewHandler(server)
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newTestRequest(t, http.MethodGet, backend.URL+"/"))
+	assertStatusCode(t, w, http.StatusOK)
+	if w.Body.Len() != 1500 {
+		t.Fatalf("body = %d bytes, want 1500", w.Body.Len())
+	}
+	// The first second's worth goes through at once, the rest at the rate
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("response took %v, want about 500ms at 1000 bytes/s", elapsed)
+	}
+
+	if _, ips := server.bandwidth.Sample(); ips["127.0.0.1"] <= 0 {
+		t.Errorf("throughput of 127.0.0.1 = %v, want > 0", ips["127.0.0.1"])
+	}
+}
@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/config"
+)
+
+// Timeout returns the timeout of client requests and upstream dials.
+func (s *Server) Timeout() time.Duration {
+	return time.Duration(s.timeout.Load())
+}
+
+// IdleTimeout returns the time a tunnel may go without traffic.
+func (s *Server) IdleTimeout() time.Duration {
+	return time.Duration(s.idleTimeout.Load())
+}
+
+// UpdateTimeouts applies the timeouts and transport tuning of cfg at
+// runtime. They apply to new requests, tunnels and upstream connections;
+// the upstream transports are rebuilt when their settings change.
+func (s *Server) UpdateTimeouts(cfg *config.Config) {
+	s.timeout.Store(int64(cfg.Timeout))
+	s.idleTimeout.Store(int64(cfg.IdleTimeout))
+	s.transportPool.Reconfigure(cfg.Timeout, transportTuning(cfg))
+}
+
+// transportTuning returns the upstream connection timeouts of cfg.
+func transportTuning(cfg *config.Config) TransportTuning {
+	return TransportTuning{
+		KeepAlive:             cfg.TCPKeepAlive,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout,
+		ExpectContinueTimeout: cfg.ExpectContinueTimeout,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+	}
+}
+
+// withDeadlines limits the time to read each request and write its response
+// to the current timeout. The deadlines are set per request rather than on
+// the http.Server, whose settings cannot change while it serves.
+func (s *Server) withDeadlines(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if d := s.Timeout(); d > 0 {
+			deadline := time.Now().Add(d)
+			rc := http.NewResponseController(w)
+			rc.SetReadDeadline(deadline)
+			rc.SetWriteDeadline(deadline)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
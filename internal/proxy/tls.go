@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/cr0hn/outbound-lb/internal/auth"
+	"github.com/cr0hn/outbound-lb/internal/logger"
+)
+
+// errNoListenerCert is returned by the listener when no certificate is loaded.
+var errNoListenerCert = errors.New("no listener certificate loaded")
+
+// TLSEnabled reports whether the proxy listener serves TLS.
+func (s *Server) TLSEnabled() bool {
+	return s.cfg.ListenTLSCert != ""
+}
+
+// ReloadTLS loads the listener certificate and key, replacing the current
+// pair for new connections. On error the current pair is kept. It does
+// nothing when the listener does not serve TLS.
+func (s *Server) ReloadTLS(certFile, keyFile string) error {
+	if !s.TLSEnabled() {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("loading listener certificate: %w", err)
+	}
+	s.listenerCert.Store(&cert)
+	logger.Info("listener_certificate_loaded",
+		"cert", certFile,
+		"subject", cert.Leaf.Subject.String(),
+		"not_after", cert.Leaf.NotAfter,
+	)
+	return nil
+}
+
+// ReloadClientCA loads the CA bundle verifying client certificates,
+// replacing the current one for new connections. On error the current bundle
+// is kept. It does nothing without a client CA.
+func (s *Server) ReloadClientCA() error {
+	if s.cfg.ListenTLSClientCA == "" {
+		return nil
+	}
+	pool, err := auth.LoadCertPool(s.cfg.ListenTLSClientCA)
+	if err != nil {
+		return fmt.Errorf("loading client CA: %w", err)
+	}
+	s.clientCAs.Store(pool)
+	logger.Info("client_ca_loaded", "path", s.cfg.ListenTLSClientCA)
+	return nil
+}
+
+// tlsConfig returns the listener TLS configuration, serving whichever
+// certificate is current at handshake time and, with a client CA, verifying
+// client certificates against whichever bundle is current.
+func (s *Server) tlsConfig() *tls.Config {
+	protos := []string{"http/1.1"}
+	if s.cfg.HTTP2 {
+		protos = []string{"h2", "http/1.1"}
+	}
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: protos,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert := s.listenerCert.Load()
+			if cert == nil {
+				return nil, errNoListenerCert
+			}
+			return cert, nil
+		},
+	}
+	if s.cfg.ListenTLSClientCA != "" {
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		if s.cfg.ListenTLSClientCertRequired {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		base := cfg.Clone()
+		cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c := base.Clone()
+			c.ClientCAs = s.clientCAs.Load()
+			return c, nil
+		}
+	}
+	return cfg
+}
+
+// certUser returns the proxy user named by the verified client certificate
+// of r, if any.
+func (s *Server) certUser(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", false
+	}
+	return auth.CertUser(r.TLS.VerifiedChains[0][0], s.cfg.ListenTLSClientIdentity)
+}
@@ -0,0 +1,315 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 with the given
+// common name to dir and returns the certificate and key paths. It is valid
+// both as a server and as a client certificate.
+func writeTestCert(t *testing.T, dir, cn string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// startTLSProxy serves s over TLS on a free loopback port and returns its address.
+func startTLSProxy(t *testing.T, s *Server) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+	t.Cleanup(func() { s.httpServer.Close() })
+	return ln.Addr().String()
+}
+
+// handshake connects to addr over TLS and returns the connection state.
+func handshake(t *testing.T, addr string) tls.ConnectionState {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"h2", "http/1.1"},
+	})
+	if err != nil {
+		t.Fatalf("TLS handshake: %v", err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState()
+}
+
+func TestServer_TLSListener(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "proxy-1")
+	s := newTestServerWithOptions(t, DefaultTestServerOptions())
+	s.cfg.ListenTLSCert = certFile
+	s.cfg.ListenTLSKey = keyFile
+	addr := startTLSProxy(t, s)
+
+	// HTTP/1.1 is negotiated even when the client prefers h2
+	state := handshake(t, addr)
+	if state.NegotiatedProtocol != "http/1.1" {
+		t.Errorf("NegotiatedProtocol = %q, want http/1.1", state.NegotiatedProtocol)
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(&url.URL{Scheme: "https", Host: addr}),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	resp, err := client.Get(backend.URL)
+	if err != nil {
+		t.Fatalf("request through TLS proxy: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+
+	// CONNECT tunnels work over the TLS listener
+	tlsBackend := httptest.NewTLSServer(backend.Config.Handler)
+	defer tlsBackend.Close()
+	resp, err = client.Get(tlsBackend.URL)
+	if err != nil {
+		t.Fatalf("CONNECT through TLS proxy: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("tunneled status = %d, want 200", resp.StatusCode)
+	}
+
+	// A rotated certificate is served to new connections
+	writeTestCert(t, dir, "proxy-2")
+	if err := s.ReloadTLS(certFile, keyFile); err != nil {
+		t.Fatalf("ReloadTLS() error = %v", err)
+	}
+	if cn := handshake(t, addr).PeerCertificates[0].Subject.CommonName; cn != "proxy-2" {
+		t.Errorf("certificate CN after reload = %q, want proxy-2", cn)
+	}
+
+	// A broken pair keeps the current certificate
+	if err := s.ReloadTLS(certFile, filepath.Join(dir, "missing.key")); err == nil {
+		t.Error("ReloadTLS() with missing key should fail")
+	}
+	if cn := handshake(t, addr).PeerCertificates[0].Subject.CommonName; cn != "proxy-2" {
+		t.Errorf("certificate CN after failed reload = %q, want proxy-2", cn)
+	}
+}
+
+func TestServer_ReloadTLS_Disabled(t *testing.T) {
+	s := newTestServerWithOptions(t, DefaultTestServerOptions())
+	if err := s.ReloadTLS("/missing.crt", "/missing.key"); err != nil {
+		t.Errorf("ReloadTLS() without a TLS listener error = %v, want nil", err)
+	}
+	if s.listenerCert.Load() != nil {
+		t.Error("ReloadTLS() without a TLS listener loaded a certificate")
+	}
+}
+
+func TestServer_TLSClientCert(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	// The self-signed client certificate is its own CA
+	certFile, keyFile := writeTestCert(t, t.TempDir(), "proxy")
+	clientCertFile, clientKeyFile := writeTestCert(t, t.TempDir(), "tenant-a")
+	clientCert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := DefaultTestServerOptions()
+	opts.Auth = "user:pass"
+	s := newTestServerWithOptions(t, opts)
+	s.cfg.ListenTLSCert = certFile
+	s.cfg.ListenTLSKey = keyFile
+	s.cfg.ListenTLSClientCA = clientCertFile
+	s.cfg.ListenTLSClientCertRequired = true
+	s.cfg.ListenTLSClientIdentity = "cn"
+	addr := startTLSProxy(t, s)
+
+	// Clients without a certificate fail the handshake
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(&url.URL{Scheme: "https", Host: addr}),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	if resp, err := client.Get(backend.URL); err == nil {
+		resp.Body.Close()
+		t.Fatal("request without a client certificate succeeded")
+	}
+
+	// The certificate replaces proxy credentials and names the user
+	requests := testutil.ToFloat64(metrics.UserRequests.WithLabelValues("tenant-a"))
+	client = &http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyURL(&url.URL{Scheme: "https", Host: addr}),
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates:       []tls.Certificate{clientCert},
+		},
+	}}
+	resp, err := client.Get(backend.URL)
+	if err != nil {
+		t.Fatalf("request with a client certificate: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+	if got := testutil.ToFloat64(metrics.UserRequests.WithLabelValues("tenant-a")) - requests; got != 1 {
+		t.Errorf("tenant-a requests = %v, want 1", got)
+	}
+}
+
+func TestServer_TLSClientCert_UntrustedCA(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir(), "proxy")
+	caFile, _ := writeTestCert(t, t.TempDir(), "ca")
+	clientCertFile, clientKeyFile := writeTestCert(t, t.TempDir(), "tenant-a")
+	clientCert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestServerWithOptions(t, DefaultTestServerOptions())
+	s.cfg.ListenTLSCert = certFile
+	s.cfg.ListenTLSKey = keyFile
+	s.cfg.ListenTLSClientCA = caFile
+	addr := startTLSProxy(t, s)
+
+	// Optional certificates are still verified. The client sends its
+	// certificate even though the server asks for another CA.
+	client := &http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyURL(&url.URL{Scheme: "https", Host: addr}),
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &clientCert, nil
+			},
+		},
+	}}
+	if resp, err := client.Get("http://example.com/"); err == nil {
+		resp.Body.Close()
+		t.Error("request with an untrusted client certificate succeeded")
+	}
+
+	// Clients without a certificate are accepted
+	handshake(t, addr)
+}
+
+func TestServer_ReloadClientCA(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir(), "proxy")
+	caDir := t.TempDir()
+	caFile, _ := writeTestCert(t, caDir, "ca")
+	clientCertFile, clientKeyFile := writeTestCert(t, t.TempDir(), "tenant-a")
+	clientCert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestServerWithOptions(t, DefaultTestServerOptions())
+	s.cfg.ListenTLSCert = certFile
+	s.cfg.ListenTLSKey = keyFile
+	s.cfg.ListenTLSClientCA = caFile
+	s.cfg.ListenTLSClientCertRequired = true
+	addr := startTLSProxy(t, s)
+
+	dial := func() error {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates:       []tls.Certificate{clientCert},
+		})
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		// TLS 1.3 reports a rejected client certificate on the first read
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if _, err := conn.Read(make([]byte, 1)); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			return err
+		}
+		return nil
+	}
+	if dial() == nil {
+		t.Fatal("handshake with a certificate of another CA succeeded")
+	}
+
+	// The rotated bundle trusts the client for new connections
+	bundle, err := os.ReadFile(clientCertFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(caFile, bundle, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ReloadClientCA(); err != nil {
+		t.Fatalf("ReloadClientCA() error = %v", err)
+	}
+	if err := dial(); err != nil {
+		t.Errorf("handshake after reloading the client CA: %v", err)
+	}
+
+	// A broken bundle keeps the current one
+	if err := os.WriteFile(caFile, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ReloadClientCA(); err == nil {
+		t.Error("ReloadClientCA() with a broken bundle should fail")
+	}
+	if err := dial(); err != nil {
+		t.Errorf("handshake after a failed reload: %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+// Package proxy provides the HTTP/HTTPS proxy server.
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+)
+
+// Upstream request phases timed by withUpstreamTrace.
+const (
+	phaseDNS     = "dns"
+	phaseConnect = "connect"
+	phaseTLS     = "tls"
+	phaseTTFB    = "ttfb"
+)
+
+// upstreamTrace times the phases of upstream requests through one outbound IP.
+type upstreamTrace struct {
+	ip       string // label
+	mu       sync.Mutex
+	dns      time.Time
+	connects map[string]time.Time
+	tls      time.Time
+	wrote    time.Time
+}
+
+// withUpstreamTrace returns ctx timing the DNS lookup, TCP connect, TLS
+// handshake and time to first byte of upstream requests made with it through
+// ip into outbound_lb_upstream_phase_duration_seconds. Time to first byte
+// runs from the request being written to the first response byte. Reused
+// connections only report it, and lookups answered by the DNS cache report
+// nothing.
+func withUpstreamTrace(ctx context.Context, ip netip.Addr) context.Context {
+	t := &upstreamTrace{ip: ip.String()}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.start(&t.dns)
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			t.done(&t.dns, phaseDNS, info.Err)
+		},
+		ConnectStart: func(network, addr string) {
+			// Lookups through custom nameservers dial them over UDP
+			if !strings.HasPrefix(network, "tcp") {
+				return
+			}
+			t.mu.Lock()
+			if t.connects == nil {
+				t.connects = make(map[string]time.Time)
+			}
+			t.connects[addr] = time.Now()
+			t.mu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			t.mu.Lock()
+			start, ok := t.connects[addr]
+			delete(t.connects, addr)
+			t.mu.Unlock()
+			if ok && err == nil {
+				metrics.UpstreamPhaseDuration.WithLabelValues(t.ip, phaseConnect).Observe(time.Since(start).Seconds())
+			}
+		},
+		TLSHandshakeStart: func() {
+			t.start(&t.tls)
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			t.done(&t.tls, phaseTLS, err)
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			if info.Err == nil {
+				t.start(&t.wrote)
+			}
+		},
+		GotFirstResponseByte: func() {
+			t.done(&t.wrote, phaseTTFB, nil)
+		},
+	})
+}
+
+// start records the start of a phase in at.
+func (t *upstreamTrace) start(at *time.Time) {
+	t.mu.Lock()
+	*at = time.Now()
+	t.mu.Unlock()
+}
+
+// done observes the phase started at at, unless it failed.
+func (t *upstreamTrace) done(at *time.Time, phase string, err error) {
+	t.mu.Lock()
+	start := *at
+	*at = time.Time{}
+	t.mu.Unlock()
+	if start.IsZero() || err != nil {
+		return
+	}
+	metrics.UpstreamPhaseDuration.WithLabelValues(t.ip, phase).Observe(time.Since(start).Seconds())
+}
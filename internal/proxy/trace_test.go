@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+)
+
+func TestUpstreamTrace_Phases(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer backend.Close()
+
+	const ip = "192.0.2.70"
+	req, err := http.NewRequestWithContext(withUpstreamTrace(context.Background(), netip.MustParseAddr(ip)), http.MethodGet, backend.URL, nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	resp, err := backend.Client().Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	// The backend is reached by address, so there is no DNS lookup
+	for _, phase := range []string{phaseConnect, phaseTLS, phaseTTFB} {
+		if !metrics.UpstreamPhaseDuration.DeleteLabelValues(ip, phase) {
+			t.Errorf("expected a %s observation for %s", phase, ip)
+		}
+	}
+	if metrics.UpstreamPhaseDuration.DeleteLabelValues(ip, phaseDNS) {
+		t.Errorf("expected no dns observation for an address")
+	}
+}
+
+func TestUpstreamTrace_ReusedConnection(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.Close()
+	client := backend.Client()
+
+	const ip = "192.0.2.71"
+	get := func() {
+		t.Helper()
+		req, err := http.NewRequestWithContext(withUpstreamTrace(context.Background(), netip.MustParseAddr(ip)), http.MethodGet, backend.URL, nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	get()
+	metrics.UpstreamPhaseDuration.DeletePartialMatch(prometheus.Labels{"ip": ip})
+
+	// The second request reuses the connection: only time to first byte
+	get()
+	if metrics.UpstreamPhaseDuration.DeleteLabelValues(ip, phaseConnect) {
+		t.Error("expected no connect observation on a reused connection")
+	}
+	if !metrics.UpstreamPhaseDuration.DeleteLabelValues(ip, phaseTTFB) {
+		t.Error("expected a ttfb observation on a reused connection")
+	}
+}
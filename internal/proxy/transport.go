@@ -3,24 +3,123 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
 	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"sync"
+	"syscall"
 	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/dns"
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
 )
 
 // TransportPool manages http.Transport instances per outbound IP.
 type TransportPool struct {
-	transports map[string]*http.Transport
-	timeout    time.Duration
-	mu         sync.RWMutex
+	transports  map[netip.Addr]*http.Transport
+	upstreams   map[netip.Addr]*url.URL
+	timeout     time.Duration
+	tuning      TransportTuning
+	byteCounter func(ip netip.Addr) *metrics.ByteCounter
+	tlsConfig   *tls.Config // nil uses the defaults
+	http3       map[netip.Addr]*http3Upstream
+	altSvc      *altSvcCache   // nil when HTTP/3 is disabled
+	resolvers   *dns.Resolvers // nil uses the dialer's own resolution
+	sockopts    map[netip.Addr]netutil.SocketOptions
+	mu          sync.RWMutex
+}
+
+// TransportTuning holds the timeouts of upstream connections other than the
+// dial timeout.
+type TransportTuning struct {
+	KeepAlive             time.Duration
+	IdleConnTimeout       time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ExpectContinueTimeout time.Duration
+	ResponseHeaderTimeout time.Duration
+}
+
+// DefaultTransportTuning returns the tuning transports use unless set.
+func DefaultTransportTuning() TransportTuning {
+	return TransportTuning{
+		KeepAlive:             DefaultTCPKeepAlive,
+		IdleConnTimeout:       DefaultIdleConnTimeout,
+		TLSHandshakeTimeout:   DefaultTLSHandshakeTimeout,
+		ExpectContinueTimeout: DefaultExpectContinueTimeout,
+	}
+}
+
+// TransportOption is a functional option for TransportPool.
+type TransportOption func(*TransportPool)
+
+// WithResponseHeaderTimeout limits how long to wait for the upstream response
+// headers. The timer only starts once the request body has been fully sent,
+// so long streaming uploads are not cut short (0 = no limit).
+func WithResponseHeaderTimeout(d time.Duration) TransportOption {
+	return func(tp *TransportPool) {
+		tp.tuning.ResponseHeaderTimeout = d
+	}
+}
+
+// WithTransportTuning sets the timeouts of upstream connections.
+func WithTransportTuning(tuning TransportTuning) TransportOption {
+	return func(tp *TransportPool) {
+		tp.tuning = tuning
+	}
+}
+
+// WithByteCounter counts the bytes exchanged with upstreams on each connection
+// using the counter returned by fn for its outbound IP.
+func WithByteCounter(fn func(ip netip.Addr) *metrics.ByteCounter) TransportOption {
+	return func(tp *TransportPool) {
+		tp.byteCounter = fn
+	}
+}
+
+// WithHTTP3 sends requests to hosts that advertise HTTP/3 through Alt-Svc
+// over QUIC from the outbound IP, falling back to TCP if that fails.
+func WithHTTP3() TransportOption {
+	return func(tp *TransportPool) {
+		tp.altSvc = newAltSvcCache()
+	}
+}
+
+// WithResolvers resolves destination hosts with the resolver of the outbound
+// IP each connection goes through.
+func WithResolvers(rs *dns.Resolvers) TransportOption {
+	return func(tp *TransportPool) {
+		tp.resolvers = rs
+	}
+}
+
+// WithSocketOptions sets socket options on the connections through the IPs
+// in opts.
+func WithSocketOptions(opts map[netip.Addr]netutil.SocketOptions) TransportOption {
+	return func(tp *TransportPool) {
+		tp.sockopts = opts
+	}
+}
+
+// socketControl returns the net.Dialer.Control function setting the socket
+// options of ip, or nil if it has none.
+func (tp *TransportPool) socketControl(ip netip.Addr) func(network, address string, c syscall.RawConn) error {
+	return tp.sockopts[ip].Control()
 }
 
 // NewTransportPool creates a new transport pool.
-func NewTransportPool(ips []string, timeout time.Duration) *TransportPool {
+func NewTransportPool(ips []netip.Addr, timeout time.Duration, opts ...TransportOption) *TransportPool {
 	tp := &TransportPool{
-		transports: make(map[string]*http.Transport),
+		transports: make(map[netip.Addr]*http.Transport),
+		upstreams:  make(map[netip.Addr]*url.URL),
+		http3:      make(map[netip.Addr]*http3Upstream),
 		timeout:    timeout,
+		tuning:     DefaultTransportTuning(),
+	}
+	for _, opt := range opts {
+		opt(tp)
 	}
 
 	for _, ip := range ips {
@@ -31,7 +130,7 @@ func NewTransportPool(ips []string, timeout time.Duration) *TransportPool {
 }
 
 // Get returns the transport for the given IP.
-func (tp *TransportPool) Get(ip string) *http.Transport {
+func (tp *TransportPool) Get(ip netip.Addr) *http.Transport {
 	tp.mu.RLock()
 	t, exists := tp.transports[ip]
 	tp.mu.RUnlock()
@@ -53,31 +152,227 @@ func (tp *TransportPool) Get(ip string) *http.Transport {
 	return t
 }
 
-// createTransport creates a new http.Transport bound to the given IP.
-func (tp *TransportPool) createTransport(ip string) *http.Transport {
-	localAddr := &net.TCPAddr{
-		IP: net.ParseIP(ip),
+// AddIP creates the transport for ip if it does not exist yet.
+func (tp *TransportPool) AddIP(ip netip.Addr) {
+	tp.Get(ip)
+}
+
+// RemoveIP drops the transport for ip and closes its idle connections.
+// Requests still using the transport are not interrupted.
+func (tp *TransportPool) RemoveIP(ip netip.Addr) {
+	tp.mu.Lock()
+	t, exists := tp.transports[ip]
+	h3 := tp.http3[ip]
+	delete(tp.transports, ip)
+	delete(tp.upstreams, ip)
+	delete(tp.http3, ip)
+	tp.mu.Unlock()
+
+	if exists {
+		t.CloseIdleConnections()
+	}
+	if h3 != nil {
+		h3.Close()
+	}
+}
+
+// SetUpstream makes requests through ip go via the agent proxy at upstream,
+// which owns ip, or directly from this host when upstream is nil. An existing
+// transport for ip is replaced if the upstream changes.
+func (tp *TransportPool) SetUpstream(ip netip.Addr, upstream *url.URL) {
+	tp.mu.Lock()
+	prev := tp.upstreams[ip]
+	if sameURL(prev, upstream) {
+		tp.mu.Unlock()
+		return
+	}
+	if upstream != nil {
+		tp.upstreams[ip] = upstream
+	} else {
+		delete(tp.upstreams, ip)
+	}
+	t, exists := tp.transports[ip]
+	if exists {
+		tp.transports[ip] = tp.createTransport(ip)
+	}
+	tp.mu.Unlock()
+
+	if exists {
+		t.CloseIdleConnections()
+	}
+}
+
+// Reconfigure replaces the dial timeout and tuning of the transports. New
+// transports are built for every IP and the idle connections of the old
+// ones are closed; requests already using them are not interrupted.
+func (tp *TransportPool) Reconfigure(timeout time.Duration, tuning TransportTuning) {
+	tp.mu.Lock()
+	if timeout == tp.timeout && tuning == tp.tuning {
+		tp.mu.Unlock()
+		return
+	}
+	tp.timeout, tp.tuning = timeout, tuning
+	old := tp.transports
+	tp.transports = make(map[netip.Addr]*http.Transport, len(old))
+	for ip := range old {
+		tp.transports[ip] = tp.createTransport(ip)
 	}
+	tp.mu.Unlock()
+
+	for _, t := range old {
+		t.CloseIdleConnections()
+	}
+}
+
+// Timeout returns the dial timeout of upstream connections.
+func (tp *TransportPool) Timeout() time.Duration {
+	tp.mu.RLock()
+	defer tp.mu.RUnlock()
+	return tp.timeout
+}
+
+// Tuning returns the timeouts of upstream connections.
+func (tp *TransportPool) Tuning() TransportTuning {
+	tp.mu.RLock()
+	defer tp.mu.RUnlock()
+	return tp.tuning
+}
+
+// Upstream returns the agent proxy that owns ip, or nil for a local IP.
+func (tp *TransportPool) Upstream(ip netip.Addr) *url.URL {
+	tp.mu.RLock()
+	defer tp.mu.RUnlock()
+	return tp.upstreams[ip]
+}
+
+// sameURL reports whether a and b are both nil or the same URL.
+func sameURL(a, b *url.URL) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.String() == b.String()
+}
+
+// createTransport creates a new http.Transport bound to the given IP, or going
+// through the agent proxy that owns it.
+func (tp *TransportPool) createTransport(ip netip.Addr) *http.Transport {
+	if upstream := tp.upstreams[ip]; upstream != nil {
+		return tp.createAgentTransport(ip, upstream)
+	}
+
+	localAddr := net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, 0))
 
 	dialer := &net.Dialer{
 		LocalAddr: localAddr,
 		Timeout:   tp.timeout,
-		KeepAlive: 30 * time.Second,
+		KeepAlive: tp.tuning.KeepAlive,
+		Control:   tp.socketControl(ip),
 	}
 
 	return &http.Transport{
 		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			return dialer.DialContext(ctx, network, addr)
+			var conn net.Conn
+			var err error
+			if tp.resolvers != nil {
+				conn, err = tp.resolvers.For(ip).DialContext(ctx, dialer, network, addr)
+			} else {
+				conn, err = dialer.DialContext(ctx, network, addr)
+			}
+			if err != nil {
+				return nil, err
+			}
+			return tp.countBytes(ip, conn), nil
 		},
 		MaxIdleConns:          100,
 		MaxIdleConnsPerHost:   10,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
+		IdleConnTimeout:       tp.tuning.IdleConnTimeout,
+		TLSHandshakeTimeout:   tp.tuning.TLSHandshakeTimeout,
+		ExpectContinueTimeout: tp.tuning.ExpectContinueTimeout,
+		ResponseHeaderTimeout: tp.tuning.ResponseHeaderTimeout,
+		TLSClientConfig:       tp.tlsConfig,
 		ForceAttemptHTTP2:     true,
 	}
 }
 
+// ProxyProtocolTransport returns a transport for one request through ip whose
+// upstream connection starts with a PROXY protocol header announcing client.
+// The connection is closed after the request since the header only holds for
+// that client.
+func (tp *TransportPool) ProxyProtocolTransport(ip netip.Addr, version int, client net.Addr) *http.Transport {
+	tp.mu.RLock()
+	t := tp.createTransport(ip)
+	tp.mu.RUnlock()
+	dial := t.DialContext
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeProxyHeader(conn, version, client); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+	t.DisableKeepAlives = true
+	return t
+}
+
+// createAgentTransport creates a new http.Transport that sends requests through
+// the agent proxy at upstream, asking it to use ip.
+func (tp *TransportPool) createAgentTransport(ip netip.Addr, upstream *url.URL) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   tp.timeout,
+		KeepAlive: tp.tuning.KeepAlive,
+	}
+
+	return &http.Transport{
+		Proxy:              http.ProxyURL(upstream),
+		ProxyConnectHeader: http.Header{OutboundIPHeader: {ip.String()}},
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return tp.countBytes(ip, conn), nil
+		},
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   10,
+		IdleConnTimeout:       tp.tuning.IdleConnTimeout,
+		TLSHandshakeTimeout:   tp.tuning.TLSHandshakeTimeout,
+		ExpectContinueTimeout: tp.tuning.ExpectContinueTimeout,
+		ResponseHeaderTimeout: tp.tuning.ResponseHeaderTimeout,
+		ForceAttemptHTTP2:     true,
+	}
+}
+
+// countBytes wraps a connection dialed for ip to count its traffic, if byte
+// counting is enabled.
+func (tp *TransportPool) countBytes(ip netip.Addr, conn net.Conn) net.Conn {
+	if tp.byteCounter == nil {
+		return conn
+	}
+	return &countingConn{Conn: conn, counter: tp.byteCounter(ip)}
+}
+
+// countingConn is a net.Conn that counts the bytes read and written.
+type countingConn struct {
+	net.Conn
+	counter *metrics.ByteCounter
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.counter.AddReceived(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.counter.AddSent(int64(n))
+	return n, err
+}
+
 // Close closes all transports.
 func (tp *TransportPool) Close() {
 	tp.mu.Lock()
@@ -86,21 +381,29 @@ func (tp *TransportPool) Close() {
 	for _, t := range tp.transports {
 		t.CloseIdleConnections()
 	}
+	for ip, h3 := range tp.http3 {
+		h3.Close()
+		delete(tp.http3, ip)
+	}
 }
 
 // Dialer creates connections bound to a specific outbound IP.
 type Dialer struct {
-	localIP     string
+	localIP     netip.Addr
 	timeout     time.Duration
 	idleTimeout time.Duration
+	keepAlive   time.Duration
+	resolver    *dns.Resolver // nil uses the system resolver
+	control     func(network, address string, c syscall.RawConn) error
 }
 
 // NewDialer creates a new Dialer.
-func NewDialer(localIP string, timeout, idleTimeout time.Duration) *Dialer {
+func NewDialer(localIP netip.Addr, timeout, idleTimeout time.Duration) *Dialer {
 	return &Dialer{
 		localIP:     localIP,
 		timeout:     timeout,
 		idleTimeout: idleTimeout,
+		keepAlive:   DefaultTCPKeepAlive,
 	}
 }
 
@@ -111,15 +414,17 @@ func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
 
 // DialContext creates a connection to the given address with context.
 func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
-	localAddr := &net.TCPAddr{
-		IP: net.ParseIP(d.localIP),
-	}
+	localAddr := net.TCPAddrFromAddrPort(netip.AddrPortFrom(d.localIP, 0))
 
 	dialer := &net.Dialer{
 		LocalAddr: localAddr,
 		Timeout:   d.timeout,
-		KeepAlive: 30 * time.Second,
+		KeepAlive: d.keepAlive,
+		Control:   d.control,
 	}
 
+	if d.resolver != nil {
+		return d.resolver.DialContext(ctx, dialer, network, addr)
+	}
 	return dialer.DialContext(ctx, network, addr)
 }
@@ -1,13 +1,21 @@
 package proxy
 
 import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
 )
 
 func TestNewTransportPool(t *testing.T) {
 	ips := []string{"127.0.0.1", "127.0.0.2"}
-	tp := NewTransportPool(ips, 30*time.Second)
+	tp := NewTransportPool(netutil.MustParseAddrs(ips), 30*time.Second)
 
 	if tp == nil {
 		t.Fatal("expected non-nil transport pool")
@@ -20,22 +28,22 @@ func TestNewTransportPool(t *testing.T) {
 
 func TestTransportPool_Get(t *testing.T) {
 	ips := []string{"127.0.0.1"}
-	tp := NewTransportPool(ips, 30*time.Second)
+	tp := NewTransportPool(netutil.MustParseAddrs(ips), 30*time.Second)
 
 	// Get existing transport
-	tr := tp.Get("127.0.0.1")
+	tr := tp.Get(netip.MustParseAddr("127.0.0.1"))
 	if tr == nil {
 		t.Error("expected non-nil transport for existing IP")
 	}
 
 	// Get same transport again
-	tr2 := tp.Get("127.0.0.1")
+	tr2 := tp.Get(netip.MustParseAddr("127.0.0.1"))
 	if tr != tr2 {
 		t.Error("expected same transport instance for same IP")
 	}
 
 	// Get transport for new IP (should create one)
-	tr3 := tp.Get("127.0.0.3")
+	tr3 := tp.Get(netip.MustParseAddr("127.0.0.3"))
 	if tr3 == nil {
 		t.Error("expected non-nil transport for new IP")
 	}
@@ -43,20 +51,132 @@ func TestTransportPool_Get(t *testing.T) {
 
 func TestTransportPool_Close(t *testing.T) {
 	ips := []string{"127.0.0.1"}
-	tp := NewTransportPool(ips, 30*time.Second)
+	tp := NewTransportPool(netutil.MustParseAddrs(ips), 30*time.Second)
 
 	// Should not panic
 	tp.Close()
 }
 
+func TestTransportPool_AddRemoveIP(t *testing.T) {
+	tp := NewTransportPool(netutil.MustParseAddrs([]string{"127.0.0.1"}), 30*time.Second)
+
+	tp.AddIP(netip.MustParseAddr("127.0.0.2"))
+	tr := tp.Get(netip.MustParseAddr("127.0.0.2"))
+
+	tp.RemoveIP(netip.MustParseAddr("127.0.0.2"))
+	if tp.Get(netip.MustParseAddr("127.0.0.2")) == tr {
+		t.Error("expected removed transport to be dropped")
+	}
+
+	// Removing an unknown IP is a no-op
+	tp.RemoveIP(netip.MustParseAddr("127.0.0.9"))
+}
+
+func TestTransportPool_Reconfigure(t *testing.T) {
+	tp := NewTransportPool(netutil.MustParseAddrs([]string{"127.0.0.1", "127.0.0.2"}), 30*time.Second)
+	defer tp.Close()
+	tr := tp.Get(netip.MustParseAddr("127.0.0.1"))
+
+	// Unchanged settings keep the transports
+	tp.Reconfigure(30*time.Second, DefaultTransportTuning())
+	if tp.Get(netip.MustParseAddr("127.0.0.1")) != tr {
+		t.Error("expected unchanged settings to keep the transport")
+	}
+
+	tuning := DefaultTransportTuning()
+	tuning.IdleConnTimeout = 10 * time.Second
+	tuning.TLSHandshakeTimeout = 3 * time.Second
+	tp.Reconfigure(5*time.Second, tuning)
+
+	if tp.Timeout() != 5*time.Second || tp.Tuning() != tuning {
+		t.Errorf("Timeout() = %v, Tuning() = %+v", tp.Timeout(), tp.Tuning())
+	}
+	if len(tp.transports) != 2 {
+		t.Errorf("expected 2 transports, got %d", len(tp.transports))
+	}
+	got := tp.Get(netip.MustParseAddr("127.0.0.1"))
+	if got == tr {
+		t.Fatal("expected the transport to be replaced")
+	}
+	if got.IdleConnTimeout != tuning.IdleConnTimeout || got.TLSHandshakeTimeout != tuning.TLSHandshakeTimeout {
+		t.Errorf("transport tuning = %v/%v, want %v/%v", got.IdleConnTimeout, got.TLSHandshakeTimeout, tuning.IdleConnTimeout, tuning.TLSHandshakeTimeout)
+	}
+}
+
+func TestTransportPool_ResponseHeaderTimeout(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		if r.URL.Path == "/slow" {
+			time.Sleep(300 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	tp := NewTransportPool(netutil.MustParseAddrs([]string{"127.0.0.1"}), 5*time.Second, WithResponseHeaderTimeout(100*time.Millisecond))
+	defer tp.Close()
+	tr := tp.Get(netip.MustParseAddr("127.0.0.1"))
+
+	// Slow response headers time out
+	req, _ := http.NewRequest(http.MethodGet, upstream.URL+"/slow", nil)
+	if _, err := tr.RoundTrip(req); err == nil {
+		t.Error("expected response header timeout")
+	}
+
+	// A streaming upload slower than the timeout is not cut short
+	pr, pw := io.Pipe()
+	go func() {
+		for i := 0; i < 5; i++ {
+			pw.Write([]byte("chunk"))
+			time.Sleep(50 * time.Millisecond)
+		}
+		pw.Close()
+	}()
+	req, _ = http.NewRequest(http.MethodPost, upstream.URL+"/upload", pr)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("expected streaming upload to succeed, got %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200, got %d", resp.StatusCode)
+	}
+}
+
+func TestTransportPool_ByteCounter(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+
+	stats := metrics.NewStatsCollector(netutil.MustParseAddrs([]string{"127.0.0.1"}))
+	tp := NewTransportPool(netutil.MustParseAddrs([]string{"127.0.0.1"}), 5*time.Second, WithByteCounter(stats.UpstreamBytes))
+	defer tp.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, upstream.URL+"/", strings.NewReader("payload"))
+	resp, err := tp.Get(netip.MustParseAddr("127.0.0.1")).RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip() error: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	// Wire bytes include the request line, headers and status line
+	got := stats.GetStats().UpstreamBytesPerIP["127.0.0.1"]
+	if got.Sent <= int64(len("payload")) || got.Received <= int64(len("hello")) {
+		t.Errorf("expected upstream wire bytes beyond the bodies, got %+v", got)
+	}
+}
+
 func TestNewDialer(t *testing.T) {
-	d := NewDialer("127.0.0.1", 30*time.Second, 60*time.Second)
+	d := NewDialer(netip.MustParseAddr("127.0.0.1"), 30*time.Second, 60*time.Second)
 
 	if d == nil {
 		t.Fatal("expected non-nil dialer")
 	}
 
-	if d.localIP != "127.0.0.1" {
+	if d.localIP != netip.MustParseAddr("127.0.0.1") {
 		t.Errorf("expected localIP 127.0.0.1, got %s", d.localIP)
 	}
 
@@ -0,0 +1,173 @@
+// Package proxy provides the HTTP/HTTPS proxy server.
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/logger"
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
+)
+
+// Tunnel DNS change policies.
+const (
+	// TunnelDNSPolicyLog only reports tunnels whose target moved.
+	TunnelDNSPolicyLog = "log"
+	// TunnelDNSPolicyDrain closes tunnels whose target moved so clients reconnect.
+	TunnelDNSPolicyDrain = "drain"
+)
+
+// resolveFunc resolves a host name to its current addresses.
+type resolveFunc func(ctx context.Context, host string) ([]netip.Addr, error)
+
+// trackedTunnel is an open CONNECT tunnel and the address it is connected to.
+type trackedTunnel struct {
+	host   string
+	remote netip.Addr
+	stale  bool
+	close  func()
+}
+
+// TunnelTracker periodically re-resolves the target hosts of open tunnels and
+// detects tunnels still connected to an address the host no longer resolves to,
+// e.g. after a target-side failover.
+type TunnelTracker struct {
+	interval time.Duration
+	drain    bool
+	resolve  resolveFunc
+	tunnels  map[*trackedTunnel]struct{}
+	stopCh   chan struct{}
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+}
+
+// NewTunnelTracker creates a new TunnelTracker checking every interval.
+// With drain set, stale tunnels are closed; otherwise they are only reported.
+func NewTunnelTracker(interval time.Duration, drain bool) *TunnelTracker {
+	return &TunnelTracker{
+		interval: interval,
+		drain:    drain,
+		resolve: func(ctx context.Context, host string) ([]netip.Addr, error) {
+			return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		},
+		tunnels: make(map[*trackedTunnel]struct{}),
+		stopCh:  make(chan struct{}),
+	}
+}
+
+// Add tracks a tunnel to hostport connected to remote. closeFn must tear the
+// tunnel down. The returned function stops tracking it and must be called
+// when the tunnel ends. Tunnels to IP literals are not tracked.
+func (tt *TunnelTracker) Add(hostport string, remote net.Addr, closeFn func()) (remove func()) {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	addr, err := netutil.HostAddr(remote.String())
+	if err != nil || netutil.IsIPv4(host) || netutil.IsIPv6(host) {
+		return func() {}
+	}
+
+	t := &trackedTunnel{host: host, remote: addr, close: closeFn}
+	tt.mu.Lock()
+	tt.tunnels[t] = struct{}{}
+	tt.mu.Unlock()
+
+	return func() {
+		tt.mu.Lock()
+		delete(tt.tunnels, t)
+		tt.mu.Unlock()
+	}
+}
+
+// Len returns the number of tracked tunnels.
+func (tt *TunnelTracker) Len() int {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	return len(tt.tunnels)
+}
+
+// Start starts the background check loop.
+func (tt *TunnelTracker) Start() {
+	tt.wg.Add(1)
+	go tt.loop()
+}
+
+// Stop stops the background check loop.
+func (tt *TunnelTracker) Stop() {
+	close(tt.stopCh)
+	tt.wg.Wait()
+}
+
+func (tt *TunnelTracker) loop() {
+	defer tt.wg.Done()
+
+	ticker := time.NewTicker(tt.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			tt.check()
+		case <-tt.stopCh:
+			return
+		}
+	}
+}
+
+// check re-resolves every tracked host once and handles tunnels whose remote
+// address is no longer among the host's addresses. Returns the number of
+// newly detected stale tunnels.
+func (tt *TunnelTracker) check() int {
+	tt.mu.Lock()
+	byHost := make(map[string][]*trackedTunnel)
+	for t := range tt.tunnels {
+		if !t.stale {
+			byHost[t.host] = append(byHost[t.host], t)
+		}
+	}
+	tt.mu.Unlock()
+
+	detected := 0
+	for host, tunnels := range byHost {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		addrs, err := tt.resolve(ctx, host)
+		cancel()
+		if err != nil || len(addrs) == 0 {
+			// Resolution failures say nothing about where the host moved
+			logger.Debug("tunnel_dns_check_failed", "host", host, "error", err)
+			continue
+		}
+		for i := range addrs {
+			addrs[i] = netutil.NormalizeAddr(addrs[i])
+		}
+
+		for _, t := range tunnels {
+			if slices.Contains(addrs, t.remote) {
+				continue
+			}
+			tt.mu.Lock()
+			t.stale = true
+			tt.mu.Unlock()
+			detected++
+
+			metrics.TunnelDNSChanges.Inc()
+			logger.Warn("tunnel_target_address_changed",
+				"host", host,
+				"connected", t.remote.String(),
+				"resolved", addrs,
+				"drain", tt.drain,
+			)
+			if tt.drain {
+				t.close()
+				metrics.TunnelsDrained.Inc()
+			}
+		}
+	}
+	return detected
+}
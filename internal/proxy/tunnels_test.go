@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func newTestTunnelTracker(drain bool, resolved map[string][]netip.Addr) *TunnelTracker {
+	tt := NewTunnelTracker(time.Minute, drain)
+	tt.resolve = func(ctx context.Context, host string) ([]netip.Addr, error) {
+		return resolved[host], nil
+	}
+	return tt
+}
+
+func TestTunnelTracker_DetectsMovedTarget(t *testing.T) {
+	resolved := map[string][]netip.Addr{
+		"api.example.com": {netip.MustParseAddr("10.0.0.1")},
+	}
+	tt := newTestTunnelTracker(false, resolved)
+
+	closed := false
+	remove := tt.Add("api.example.com:443", &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}, func() { closed = true })
+	defer remove()
+
+	if n := tt.check(); n != 0 {
+		t.Errorf("expected no stale tunnels while DNS is unchanged, got %d", n)
+	}
+
+	resolved["api.example.com"] = []netip.Addr{netip.MustParseAddr("10.0.0.2")}
+	if n := tt.check(); n != 1 {
+		t.Errorf("expected 1 stale tunnel after DNS change, got %d", n)
+	}
+	if closed {
+		t.Error("expected tunnel to stay open with the log policy")
+	}
+
+	// Stale tunnels are only reported once
+	if n := tt.check(); n != 0 {
+		t.Errorf("expected stale tunnel to be reported once, got %d", n)
+	}
+}
+
+func TestTunnelTracker_Drain(t *testing.T) {
+	resolved := map[string][]netip.Addr{
+		"api.example.com": {netip.MustParseAddr("10.0.0.2")},
+	}
+	tt := newTestTunnelTracker(true, resolved)
+
+	closed := false
+	remove := tt.Add("api.example.com:443", &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}, func() { closed = true })
+
+	tt.check()
+	if !closed {
+		t.Error("expected stale tunnel to be closed with the drain policy")
+	}
+
+	remove()
+	if tt.Len() != 0 {
+		t.Errorf("expected tunnel to be untracked after remove, got %d", tt.Len())
+	}
+}
+
+func TestTunnelTracker_SkipsIPLiterals(t *testing.T) {
+	tt := newTestTunnelTracker(true, nil)
+
+	tt.Add("10.0.0.1:443", &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}, func() {
+		t.Error("tunnel to IP literal must not be drained")
+	})
+	if tt.Len() != 0 {
+		t.Errorf("expected IP literal tunnel not to be tracked, got %d", tt.Len())
+	}
+}
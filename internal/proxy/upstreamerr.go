@@ -0,0 +1,110 @@
+// Package proxy provides the HTTP/HTTPS proxy server.
+package proxy
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// ErrorClassHeader carries the class of an upstream error in proxy error
+// responses, so clients can tell a bad hostname from a broken egress path.
+const ErrorClassHeader = "X-Outbound-LB-Error"
+
+// Upstream error classes.
+const (
+	// ErrorClassDNSNotFound means the upstream host does not exist (NXDOMAIN).
+	ErrorClassDNSNotFound = "dns_not_found"
+	// ErrorClassDNSTimeout means resolving the upstream host timed out.
+	ErrorClassDNSTimeout = "dns_timeout"
+	// ErrorClassDNS means resolving the upstream host failed otherwise.
+	ErrorClassDNS = "dns_error"
+	// ErrorClassTLS means the TLS handshake with the upstream failed.
+	ErrorClassTLS = "tls_error"
+	// ErrorClassConnect means the upstream could not be connected to.
+	ErrorClassConnect = "connect_error"
+	// ErrorClassDestinationDenied means the upstream host resolved to an
+	// address the destination policy denies.
+	ErrorClassDestinationDenied = "destination_denied"
+	// ErrorClassUpstream is any other upstream failure.
+	ErrorClassUpstream = "upstream_error"
+)
+
+// upstreamErrorMessages are the client-facing messages per error class.
+var upstreamErrorMessages = map[string]string{
+	ErrorClassDNSNotFound:       "Upstream host not found",
+	ErrorClassDNSTimeout:        "Upstream DNS lookup timed out",
+	ErrorClassDNS:               "Upstream DNS lookup failed",
+	ErrorClassTLS:               "TLS handshake with upstream failed",
+	ErrorClassConnect:           "Failed to connect to upstream",
+	ErrorClassDestinationDenied: "Destination not allowed",
+	ErrorClassUpstream:          "Upstream request failed",
+}
+
+// upstreamErrorResponse is the JSON body of proxy error responses.
+type upstreamErrorResponse struct {
+	Error string `json:"error"`
+	Class string `json:"class"`
+	Host  string `json:"host"`
+}
+
+// classifyUpstreamError returns the error class of an upstream failure.
+func classifyUpstreamError(err error) string {
+	if isDeniedAddr(err) {
+		return ErrorClassDestinationDenied
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		switch {
+		case dnsErr.IsNotFound:
+			return ErrorClassDNSNotFound
+		case dnsErr.IsTimeout:
+			return ErrorClassDNSTimeout
+		default:
+			return ErrorClassDNS
+		}
+	}
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var verifyErr *tls.CertificateVerificationError
+	if errors.As(err, &recordErr) || errors.As(err, &alertErr) || errors.As(err, &verifyErr) {
+		return ErrorClassTLS
+	}
+	if isDialError(err) {
+		return ErrorClassConnect
+	}
+	return ErrorClassUpstream
+}
+
+// upstreamErrorStatus returns the response status for an error class:
+// 504 for DNS failures, 403 for denied destinations, 502 otherwise.
+func upstreamErrorStatus(class string) int {
+	switch class {
+	case ErrorClassDNSNotFound, ErrorClassDNSTimeout, ErrorClassDNS:
+		return http.StatusGatewayTimeout
+	case ErrorClassDestinationDenied:
+		return http.StatusForbidden
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// writeUpstreamError writes the error response for an upstream failure
+// reaching host and returns its status code.
+func writeUpstreamError(w http.ResponseWriter, host string, err error) int {
+	class := classifyUpstreamError(err)
+	status := upstreamErrorStatus(class)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set(ErrorClassHeader, class)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(upstreamErrorResponse{
+		Error: upstreamErrorMessages[class],
+		Class: class,
+		Host:  host,
+	})
+	return status
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClassifyUpstreamError(t *testing.T) {
+	dialErr := func(err error) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: err}
+	}
+
+	tests := []struct {
+		name       string
+		err        error
+		wantClass  string
+		wantStatus int
+	}{
+		{
+			name:       "nxdomain",
+			err:        dialErr(&net.DNSError{Err: "no such host", Name: "nope.invalid", IsNotFound: true}),
+			wantClass:  ErrorClassDNSNotFound,
+			wantStatus: http.StatusGatewayTimeout,
+		},
+		{
+			name:       "dns timeout",
+			err:        dialErr(&net.DNSError{Err: "i/o timeout", Name: "slow.example", IsTimeout: true}),
+			wantClass:  ErrorClassDNSTimeout,
+			wantStatus: http.StatusGatewayTimeout,
+		},
+		{
+			name:       "dns failure",
+			err:        dialErr(&net.DNSError{Err: "server misbehaving", Name: "broken.example"}),
+			wantClass:  ErrorClassDNS,
+			wantStatus: http.StatusGatewayTimeout,
+		},
+		{
+			name:       "connection refused",
+			err:        dialErr(errors.New("connection refused")),
+			wantClass:  ErrorClassConnect,
+			wantStatus: http.StatusBadGateway,
+		},
+		{
+			name:       "tls alert",
+			err:        fmt.Errorf("remote error: %w", tls.AlertError(40)),
+			wantClass:  ErrorClassTLS,
+			wantStatus: http.StatusBadGateway,
+		},
+		{
+			name:       "other",
+			err:        errors.New("unexpected EOF"),
+			wantClass:  ErrorClassUpstream,
+			wantStatus: http.StatusBadGateway,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			class := classifyUpstreamError(tt.err)
+			if class != tt.wantClass {
+				t.Errorf("class = %q, want %q", class, tt.wantClass)
+			}
+			if status := upstreamErrorStatus(class); status != tt.wantStatus {
+				t.Errorf("status = %d, want %d", status, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestWriteUpstreamError(t *testing.T) {
+	rr := httptest.NewRecorder()
+	err := &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "nope.invalid", IsNotFound: true}}
+
+	if status := writeUpstreamError(rr, "nope.invalid:80", err); status != http.StatusGatewayTimeout {
+		t.Errorf("expected 504, got %d", status)
+	}
+	assertStatusCode(t, rr, http.StatusGatewayTimeout)
+	assertHeader(t, rr, ErrorClassHeader, ErrorClassDNSNotFound)
+	assertHeader(t, rr, "Content-Type", "application/json")
+
+	var body upstreamErrorResponse
+	if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+	if body.Class != ErrorClassDNSNotFound || body.Host != "nope.invalid:80" || body.Error == "" {
+		t.Errorf("unexpected body: %+v", body)
+	}
+}
+
+func TestHandler_UpstreamErrorClass(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	deadAddr := ln.Addr().String()
+	ln.Close()
+
+	server := newTestServer(t)
+
+	rr := httptest.NewRecorder()
+	NewHandler(server).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://"+deadAddr+"/", nil))
+	assertStatusCode(t, rr, http.StatusBadGateway)
+	assertHeader(t, rr, ErrorClassHeader, ErrorClassConnect)
+
+	rr = httptest.NewRecorder()
+	server.connectHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodConnect, deadAddr, nil))
+	assertStatusCode(t, rr, http.StatusBadGateway)
+	assertHeader(t, rr, ErrorClassHeader, ErrorClassConnect)
+}
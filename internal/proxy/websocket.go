@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/logger"
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+)
+
+// isWebSocketUpgrade reports whether r asks to switch its HTTP/1.1
+// connection to the WebSocket protocol.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return r.ProtoMajor == 1 &&
+		headerHasToken(r.Header, "Connection", "upgrade") &&
+		strings.EqualFold(strings.TrimSpace(r.Header.Get("Upgrade")), "websocket")
+}
+
+// headerHasToken reports whether the comma-separated values of header key
+// contain token, compared case-insensitively.
+func headerHasToken(header http.Header, key, token string) bool {
+	for _, value := range header.Values(key) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serveWebSocket proxies a WebSocket upgrade request. The request is sent
+// over a tunnel through an outbound IP; once the upstream switches protocols
+// the client connection is hijacked and relayed over the tunnel like a
+// CONNECT tunnel. Any other answer is passed on as a normal response.
+func (h *Handler) serveWebSocket(w http.ResponseWriter, r *http.Request, host string, start time.Time, requestID, sessionID string) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		h.sendError(w, http.StatusInternalServerError, "Hijacking not supported")
+		metrics.RequestsTotal.WithLabelValues(r.Method, "500").Inc()
+		return
+	}
+
+	// The upgrade headers are hop-by-hop but are what this hop is about
+	outReq := h.createOutgoingRequest(r)
+	outReq.Header.Set("Connection", "Upgrade")
+	outReq.Header.Set("Upgrade", r.Header.Get("Upgrade"))
+	target := targetAddr(outReq.URL)
+
+	logger.Trace("websocket_upgrade_received", "request_id", requestID, "session_id", sessionID, "host", target, "remote", r.RemoteAddr)
+
+	tun, err := h.server.OpenTunnel(r.Context(), r.Method, target)
+	if err != nil {
+		writeTunnelError(w, r.Method, target, err)
+		return
+	}
+	defer tun.Close()
+
+	resp, br, err := h.upgrade(r.Context(), tun, outReq)
+	if err != nil {
+		logger.LogError("websocket_upgrade", err, "host", target, "ip", tun.IP())
+		status := writeUpstreamError(w, host, err)
+		metrics.RequestsTotal.WithLabelValues(r.Method, strconv.Itoa(status)).Inc()
+		h.server.stats.RecordHost(host, tun.IP(), 0, 0, true)
+		return
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		h.upgradeRefused(w, r, resp, host, tun.IP(), start, requestID, sessionID)
+		return
+	}
+
+	clientConn, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		logger.LogError("websocket_hijack", err, "host", target)
+		h.sendError(w, http.StatusInternalServerError, "Failed to hijack connection")
+		metrics.RequestsTotal.WithLabelValues(r.Method, "500").Inc()
+		return
+	}
+	defer clientConn.Close()
+
+	h.server.echoEgress(r.Context(), resp.Header, tun.IP())
+	if err := resp.Write(clientConn); err != nil {
+		logger.LogError("websocket_response", err, "host", target)
+		return
+	}
+
+	// Frames may already have been read along with the handshakes
+	var client net.Conn = clientConn
+	if clientBuf.Reader.Buffered() > 0 {
+		client = &bufferedConn{Conn: clientConn, r: clientBuf.Reader}
+	}
+	if br.Buffered() > 0 {
+		tun.conn = &bufferedConn{Conn: tun.conn, r: br}
+	}
+	tun.status = resp.StatusCode
+	tun.Relay(client, r.RemoteAddr, requestID, sessionID)
+}
+
+// upgrade sends the upgrade request over the tunnel, with TLS for https
+// targets, and reads the response. The returned reader holds any data the
+// upstream sent after it.
+func (h *Handler) upgrade(ctx context.Context, tun *Tunnel, outReq *http.Request) (*http.Response, *bufio.Reader, error) {
+	timeout := h.server.Timeout()
+	if outReq.URL.Scheme == "https" {
+		cfg := &tls.Config{}
+		if h.server.transportPool.tlsConfig != nil {
+			cfg = h.server.transportPool.tlsConfig.Clone()
+		}
+		cfg.ServerName = outReq.URL.Hostname()
+		cfg.NextProtos = []string{"http/1.1"}
+		tlsConn := tls.Client(tun.conn, cfg)
+		hsCtx, cancel := context.WithTimeout(ctx, timeout)
+		err := tlsConn.HandshakeContext(hsCtx)
+		cancel()
+		if err != nil {
+			return nil, nil, err
+		}
+		tun.conn = tlsConn
+	}
+
+	tun.conn.SetDeadline(time.Now().Add(timeout))
+	defer tun.conn.SetDeadline(time.Time{})
+	if err := outReq.Write(tun.conn); err != nil {
+		return nil, nil, err
+	}
+	br := bufio.NewReader(tun.conn)
+	resp, err := http.ReadResponse(br, outReq)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, br, nil
+}
+
+// upgradeRefused passes on the response of an upstream that did not switch
+// protocols.
+func (h *Handler) upgradeRefused(w http.ResponseWriter, r *http.Request, resp *http.Response, host string, ip netip.Addr, start time.Time, requestID, sessionID string) {
+	defer resp.Body.Close()
+	h.server.recordUpstreamStatus(ip, resp.StatusCode)
+
+	h.copyHeaders(w.Header(), resp.Header)
+	h.server.echoEgress(r.Context(), w.Header(), ip)
+	w.WriteHeader(resp.StatusCode)
+	bytesCopied, err := h.copyResponseBody(w, resp, requestUser(r.Context()), host, ip)
+	if err != nil {
+		logger.LogError("response_copy", err, "host", host, "ip", ip)
+	}
+
+	duration := time.Since(start)
+	user := requestUser(r.Context())
+	logger.LogRequest(r.Method, host, r.RemoteAddr, ip.String(), resp.StatusCode, duration.Milliseconds(), r.ContentLength, bytesCopied,
+		"request_id", requestID, "session_id", sessionID, "user", user)
+	h.server.recordUser(user, max(r.ContentLength, 0), bytesCopied)
+	h.server.stats.IncTotalRequests()
+	h.server.stats.AddBytesSent(bytesCopied)
+	h.server.stats.RecordHost(host, ip, bytesCopied, r.ContentLength, resp.StatusCode >= 500)
+	metrics.RequestsTotal.WithLabelValues(r.Method, strconv.Itoa(resp.StatusCode)).Inc()
+	metrics.RequestDuration.WithLabelValues(r.Method).Observe(duration.Seconds())
+}
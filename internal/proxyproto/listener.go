@@ -0,0 +1,144 @@
+package proxyproto
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/logger"
+)
+
+// Listener is a net.Listener whose connections from trusted peers must start
+// with a PROXY protocol header. Their RemoteAddr is the source address the
+// header announces. Connections from other peers are returned unchanged.
+//
+// Headers are read in the background, so a slow or silent peer does not
+// hold up other connections.
+type Listener struct {
+	net.Listener
+	trusted func(addr net.Addr) bool
+	timeout time.Duration
+
+	conns     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewListener wraps ln. trusted reports whether a peer is allowed (and
+// required) to send a header; timeout bounds how long reading it may take.
+func NewListener(ln net.Listener, trusted func(addr net.Addr) bool, timeout time.Duration) *Listener {
+	l := &Listener{
+		Listener: ln,
+		trusted:  trusted,
+		timeout:  timeout,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error, 1),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+// acceptLoop accepts connections until the listener is closed. Other errors,
+// such as running out of file descriptors, are handed to Accept, whose caller
+// decides whether to retry, and accepting goes on.
+func (l *Listener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.done:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if !l.trusted(conn.RemoteAddr()) {
+			l.deliver(conn)
+			continue
+		}
+		go l.readHeader(conn)
+	}
+}
+
+// readHeader reads the header of a connection from a trusted peer and
+// delivers it, or closes it if the header is missing or invalid.
+func (l *Listener) readHeader(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(l.timeout))
+	br := bufio.NewReader(conn)
+	src, err := ReadHeader(br)
+	if err != nil {
+		logger.Debug("proxy_protocol_header_invalid", "remote", conn.RemoteAddr(), "error", err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	l.deliver(&Conn{Conn: conn, br: br, src: src})
+}
+
+// deliver hands conn to Accept, closing it if the listener is closed.
+func (l *Listener) deliver(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// Accept returns the next connection, with its header read if the peer is
+// trusted.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the listener. Connections whose header is still being read
+// are closed once it has been read.
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// Conn is a connection that started with a PROXY protocol header.
+type Conn struct {
+	net.Conn
+	br  *bufio.Reader
+	src net.Addr
+}
+
+// Read reads data after the header.
+func (c *Conn) Read(p []byte) (int, error) {
+	if c.br.Buffered() > 0 {
+		return c.br.Read(p)
+	}
+	return c.Conn.Read(p)
+}
+
+// RemoteAddr returns the source address announced by the header, or the
+// peer address for LOCAL and UNKNOWN headers.
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// CloseWrite shuts down the writing side of the connection, if supported.
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
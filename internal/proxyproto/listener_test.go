@@ -0,0 +1,153 @@
+package proxyproto
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// dialAndSend connects to ln and writes data.
+func dialAndSend(t *testing.T, ln net.Listener, data string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if data != "" {
+		io.WriteString(conn, data)
+	}
+	return conn
+}
+
+// accept accepts one connection from ln or fails after a timeout.
+func accept(t *testing.T, ln net.Listener) net.Conn {
+	t.Helper()
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := ln.Accept()
+		ch <- result{conn, err}
+	}()
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		t.Cleanup(func() { r.conn.Close() })
+		return r.conn
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept() timed out")
+		return nil
+	}
+}
+
+func newTestListener(t *testing.T, trusted bool) *Listener {
+	t.Helper()
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := NewListener(inner, func(net.Addr) bool { return trusted }, time.Second)
+	t.Cleanup(func() { ln.Close() })
+	return ln
+}
+
+func TestListener_Trusted(t *testing.T) {
+	ln := newTestListener(t, true)
+
+	// A silent peer does not hold up the next connection
+	dialAndSend(t, ln, "")
+	dialAndSend(t, ln, "PROXY TCP4 203.0.113.9 127.0.0.1 40000 3128\r\nhello")
+
+	conn := accept(t, ln)
+	if got := conn.RemoteAddr().String(); got != "203.0.113.9:40000" {
+		t.Errorf("RemoteAddr() = %s, want 203.0.113.9:40000", got)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("Read() = %q, %v, want %q", buf, err, "hello")
+	}
+	if _, ok := conn.(interface{ CloseWrite() error }); !ok {
+		t.Error("connection does not support CloseWrite")
+	}
+}
+
+func TestListener_TrustedInvalidHeader(t *testing.T) {
+	ln := newTestListener(t, true)
+
+	client := dialAndSend(t, ln, "GET / HTTP/1.1\r\n\r\n")
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Error("connection without a header was not closed")
+	}
+}
+
+func TestListener_Untrusted(t *testing.T) {
+	ln := newTestListener(t, false)
+
+	client := dialAndSend(t, ln, "PROXY TCP4 203.0.113.9 127.0.0.1 40000 3128\r\n")
+	conn := accept(t, ln)
+	if got, want := conn.RemoteAddr().String(), client.LocalAddr().String(); got != want {
+		t.Errorf("RemoteAddr() = %s, want the peer %s", got, want)
+	}
+	// The header is not consumed
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "PROXY" {
+		t.Errorf("Read() = %q, %v, want %q", buf, err, "PROXY")
+	}
+}
+
+func TestListener_Close(t *testing.T) {
+	ln := newTestListener(t, true)
+	ln.Close()
+	if _, err := ln.Accept(); err == nil {
+		t.Error("Accept() after Close succeeded")
+	}
+}
+
+// flakyListener returns err from its first Accept, then the connections
+// of the listener it wraps.
+type flakyListener struct {
+	net.Listener
+	err  error
+	once sync.Once
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	var err error
+	l.once.Do(func() { err = l.err })
+	if err != nil {
+		return nil, err
+	}
+	return l.Listener.Accept()
+}
+
+func TestListener_AcceptErrorKeepsAccepting(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	emfile := &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept4", syscall.EMFILE)}
+	ln := NewListener(&flakyListener{Listener: inner, err: emfile}, func(net.Addr) bool { return false }, time.Second)
+	t.Cleanup(func() { ln.Close() })
+
+	if _, err := ln.Accept(); !errors.Is(err, syscall.EMFILE) {
+		t.Fatalf("Accept() error = %v, want EMFILE", err)
+	}
+	dialAndSend(t, ln, "hello")
+	accept(t, ln)
+
+	ln.Close()
+	if _, err := ln.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept() after Close() error = %v, want net.ErrClosed", err)
+	}
+}
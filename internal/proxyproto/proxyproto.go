@@ -0,0 +1,198 @@
+// Package proxyproto encodes and decodes PROXY protocol headers (versions 1
+// and 2), which announce the original client address of a relayed TCP
+// connection.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// v2Signature starts every version 2 header.
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	v2VersionProxy = 0x21 // version 2, PROXY command
+	v2VersionLocal = 0x20 // version 2, LOCAL command
+	v2FamilyTCP4   = 0x11
+	v2FamilyTCP6   = 0x21
+	v2FamilyUnspec = 0x00
+)
+
+// Header returns the PROXY protocol header of the given version (1 or 2)
+// announcing a TCP connection from src to dst. When either address is not a
+// TCP address, the header announces an unknown connection, which tells the
+// receiver to use the real connection addresses.
+func Header(version int, src, dst net.Addr) ([]byte, error) {
+	srcAddr, srcOK := addrPort(src)
+	dstAddr, dstOK := addrPort(dst)
+	known := srcOK && dstOK
+
+	// Both addresses must be of the same family
+	if known && srcAddr.Addr().Is4() != dstAddr.Addr().Is4() {
+		srcAddr = netip.AddrPortFrom(netip.AddrFrom16(srcAddr.Addr().As16()), srcAddr.Port())
+		dstAddr = netip.AddrPortFrom(netip.AddrFrom16(dstAddr.Addr().As16()), dstAddr.Port())
+	}
+
+	switch version {
+	case 1:
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		proto := "TCP4"
+		if !srcAddr.Addr().Is4() {
+			proto = "TCP6"
+		}
+		return []byte("PROXY " + proto + " " +
+			srcAddr.Addr().String() + " " + dstAddr.Addr().String() + " " +
+			strconv.Itoa(int(srcAddr.Port())) + " " + strconv.Itoa(int(dstAddr.Port())) + "\r\n"), nil
+	case 2:
+		if !known {
+			return append(append([]byte{}, v2Signature...), v2VersionLocal, v2FamilyUnspec, 0, 0), nil
+		}
+		var addrs []byte
+		family := byte(v2FamilyTCP4)
+		if srcAddr.Addr().Is4() {
+			src4, dst4 := srcAddr.Addr().As4(), dstAddr.Addr().As4()
+			addrs = append(src4[:], dst4[:]...)
+		} else {
+			family = v2FamilyTCP6
+			src16, dst16 := srcAddr.Addr().As16(), dstAddr.Addr().As16()
+			addrs = append(src16[:], dst16[:]...)
+		}
+		addrs = binary.BigEndian.AppendUint16(addrs, srcAddr.Port())
+		addrs = binary.BigEndian.AppendUint16(addrs, dstAddr.Port())
+
+		header := append([]byte{}, v2Signature...)
+		header = append(header, v2VersionProxy, family)
+		header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+		return append(header, addrs...), nil
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", version)
+	}
+}
+
+// addrPort returns the address and port of a TCP address, with IPv4-mapped
+// IPv6 addresses unmapped.
+func addrPort(addr net.Addr) (netip.AddrPort, bool) {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok || tcp == nil {
+		return netip.AddrPort{}, false
+	}
+	ap := tcp.AddrPort()
+	if !ap.Addr().IsValid() {
+		return netip.AddrPort{}, false
+	}
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), true
+}
+
+// ErrInvalidHeader is returned by ReadHeader when the connection does not
+// start with a valid PROXY protocol header.
+var ErrInvalidHeader = errors.New("invalid PROXY protocol header")
+
+// v1MaxLength is the longest valid version 1 header, including CRLF.
+const v1MaxLength = 107
+
+// ReadHeader reads a version 1 or 2 PROXY protocol header from br and returns
+// the source address it announces. It returns nil for LOCAL and UNKNOWN
+// headers and for address families other than TCP over IPv4 and IPv6, whose
+// connections should be attributed to the real peer.
+func ReadHeader(br *bufio.Reader) (net.Addr, error) {
+	first, err := br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] == v2Signature[0] {
+		return readV2(br)
+	}
+	return readV1(br)
+}
+
+// readV1 reads a text header: "PROXY TCP4 <src> <dst> <sport> <dport>\r\n".
+func readV1(br *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= v1MaxLength {
+			return nil, fmt.Errorf("%w: version 1 header too long", ErrInvalidHeader)
+		}
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, ErrInvalidHeader
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if (fields[1] != "TCP4" && fields[1] != "TCP6") || len(fields) != 6 {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidHeader, line)
+	}
+	src, err := netip.ParseAddr(fields[2])
+	if err != nil || src.Is4() != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("%w: source address %q", ErrInvalidHeader, fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: source port %q", ErrInvalidHeader, fields[4])
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, uint16(port))), nil
+}
+
+// readV2 reads a binary header.
+func readV2(br *bufio.Reader) (net.Addr, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(br, fixed); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(fixed[:12], v2Signature) {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidHeader)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(fixed[14:]))
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return nil, err
+	}
+
+	switch fixed[12] {
+	case v2VersionLocal:
+		return nil, nil
+	case v2VersionProxy:
+	default:
+		return nil, fmt.Errorf("%w: version/command %#x", ErrInvalidHeader, fixed[12])
+	}
+
+	var src netip.Addr
+	var portOffset int
+	switch fixed[13] {
+	case v2FamilyTCP4:
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("%w: short IPv4 addresses", ErrInvalidHeader)
+		}
+		src = netip.AddrFrom4([4]byte(payload[:4]))
+		portOffset = 8
+	case v2FamilyTCP6:
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("%w: short IPv6 addresses", ErrInvalidHeader)
+		}
+		src = netip.AddrFrom16([16]byte(payload[:16]))
+		portOffset = 32
+	default:
+		// UDP, UNIX sockets and unspecified families: the addresses are
+		// of no use for a TCP connection
+		return nil, nil
+	}
+	port := binary.BigEndian.Uint16(payload[portOffset:])
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, port)), nil
+}
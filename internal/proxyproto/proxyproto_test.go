@@ -0,0 +1,122 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func tcpAddr(s string) *net.TCPAddr {
+	addr, err := net.ResolveTCPAddr("tcp", s)
+	if err != nil {
+		panic(err)
+	}
+	return addr
+}
+
+func TestHeader_V1(t *testing.T) {
+	tests := []struct {
+		name     string
+		src, dst net.Addr
+		want     string
+	}{
+		{"ipv4", tcpAddr("192.0.2.1:51000"), tcpAddr("198.51.100.7:443"), "PROXY TCP4 192.0.2.1 198.51.100.7 51000 443\r\n"},
+		{"ipv6", tcpAddr("[2001:db8::1]:51000"), tcpAddr("[2001:db8::2]:80"), "PROXY TCP6 2001:db8::1 2001:db8::2 51000 80\r\n"},
+		{"mapped", tcpAddr("[::ffff:192.0.2.1]:51000"), tcpAddr("198.51.100.7:443"), "PROXY TCP4 192.0.2.1 198.51.100.7 51000 443\r\n"},
+		{"mixed", tcpAddr("192.0.2.1:51000"), tcpAddr("[2001:db8::2]:80"), "PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 51000 80\r\n"},
+		{"unknown", nil, tcpAddr("198.51.100.7:443"), "PROXY UNKNOWN\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Header(1, tt.src, tt.dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Header() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeader_V2(t *testing.T) {
+	got, err := Header(2, tcpAddr("192.0.2.1:51000"), tcpAddr("198.51.100.7:443"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append([]byte("\r\n\r\n\x00\r\nQUIT\n"),
+		0x21, 0x11, 0x00, 0x0c,
+		192, 0, 2, 1,
+		198, 51, 100, 7,
+		0xc7, 0x38, // 51000
+		0x01, 0xbb, // 443
+	)
+	if !bytes.Equal(got, want) {
+		t.Errorf("Header() = %x, want %x", got, want)
+	}
+
+	got, err = Header(2, tcpAddr("[2001:db8::1]:1"), tcpAddr("[2001:db8::2]:2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 16+36 || got[13] != 0x21 || got[15] != 36 {
+		t.Errorf("IPv6 header = %x", got)
+	}
+
+	got, err = Header(2, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x20, 0x00, 0x00, 0x00); !bytes.Equal(got, want) {
+		t.Errorf("unknown header = %x, want %x", got, want)
+	}
+}
+
+func TestHeader_InvalidVersion(t *testing.T) {
+	if _, err := Header(3, nil, nil); err == nil {
+		t.Error("Header(3) succeeded, want error")
+	}
+}
+
+func TestReadHeader(t *testing.T) {
+	v2, _ := Header(2, tcpAddr("[2001:db8::1]:51000"), tcpAddr("[2001:db8::2]:443"))
+	v2Local, _ := Header(2, nil, nil)
+
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{"v1 ipv4", "PROXY TCP4 192.0.2.1 198.51.100.7 51000 443\r\nGET", "192.0.2.1:51000", false},
+		{"v1 ipv6", "PROXY TCP6 2001:db8::1 2001:db8::2 51000 443\r\n", "[2001:db8::1]:51000", false},
+		{"v1 unknown", "PROXY UNKNOWN 1 2 3 4\r\n", "", false},
+		{"v2 ipv6", string(v2) + "GET", "[2001:db8::1]:51000", false},
+		{"v2 local", string(v2Local), "", false},
+		{"v1 family mismatch", "PROXY TCP4 2001:db8::1 2001:db8::2 1 2\r\n", "", true},
+		{"v1 bad port", "PROXY TCP4 192.0.2.1 198.51.100.7 70000 443\r\n", "", true},
+		{"not a header", "GET / HTTP/1.1\r\n", "", true},
+		{"v1 too long", "PROXY " + strings.Repeat("x", 200) + "\r\n", "", true},
+		{"v2 bad signature", "\r\n\r\n\x00\r\nQUIX\n\x21\x11\x00\x00", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, err := ReadHeader(bufio.NewReader(strings.NewReader(tt.input)))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadHeader() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got := ""
+			if src != nil {
+				got = src.String()
+			}
+			if got != tt.want {
+				t.Errorf("ReadHeader() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+// Package quota enforces per-user connection, request rate and transfer
+// quotas.
+package quota
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/logger"
+	"github.com/cr0hn/outbound-lb/internal/store"
+)
+
+// storeTimeout bounds each store operation of a request.
+const storeTimeout = time.Second
+
+var (
+	// ErrConnLimit is returned when the user has as many open connections as
+	// allowed.
+	ErrConnLimit = errors.New("user connection limit reached")
+	// ErrRateLimit is returned when the user sent as many requests as
+	// allowed in the last minute.
+	ErrRateLimit = errors.New("user request rate limit reached")
+	// ErrBytesLimit is returned when the user transferred as many bytes as
+	// allowed today (UTC).
+	ErrBytesLimit = errors.New("user daily transfer quota exhausted")
+)
+
+// Limits are the quotas of a user. Zero values are unlimited.
+type Limits struct {
+	// MaxConns caps concurrent requests and tunnels.
+	MaxConns int
+	// RequestsPerMinute caps the request rate. Up to a minute's worth of
+	// requests may be sent in a burst.
+	RequestsPerMinute int
+	// BytesPerDay caps the bytes exchanged with the client per UTC day.
+	BytesPerDay int64
+}
+
+// IsZero reports whether no quota is set.
+func (l Limits) IsZero() bool {
+	return l == Limits{}
+}
+
+// usage is the connections and request rate of a user. The bytes a user
+// transferred are counted in the store.
+type usage struct {
+	conns    int
+	tokens   float64 // requests left in the rate bucket
+	refilled time.Time
+}
+
+// idle reports whether u holds no connection and has a full rate bucket at
+// now, so that forgetting it changes nothing. A bucket refills in a minute.
+func (u *usage) idle(now time.Time) bool {
+	return u.conns == 0 && now.Sub(u.refilled) >= time.Minute
+}
+
+// Quotas tracks the usage of each user against its limits.
+type Quotas struct {
+	defaults Limits
+	perUser  map[string]Limits
+	store    store.Store
+	prefix   string
+	users    map[string]*usage
+	swept    time.Time
+	mu       sync.Mutex
+	now      func() time.Time
+}
+
+// New creates Quotas applying defaults to every user, except the users in
+// perUser, whose non-zero limits replace the defaults. The daily transfer
+// of each user is counted in st under prefix, in memory when st is nil.
+func New(defaults Limits, perUser map[string]Limits, st store.Store, prefix string) *Quotas {
+	if st == nil {
+		st = store.NewMemory()
+	}
+	return &Quotas{
+		defaults: defaults,
+		perUser:  perUser,
+		store:    st,
+		prefix:   prefix + ":quota:bytes:",
+		users:    make(map[string]*usage),
+		now:      time.Now,
+	}
+}
+
+// Enabled reports whether any user has a quota.
+func (q *Quotas) Enabled() bool {
+	if q == nil {
+		return false
+	}
+	if !q.defaults.IsZero() {
+		return true
+	}
+	for _, l := range q.perUser {
+		if !l.IsZero() {
+			return true
+		}
+	}
+	return false
+}
+
+// Limits returns the limits of user.
+func (q *Quotas) Limits(user string) Limits {
+	l := q.defaults
+	if own, ok := q.perUser[user]; ok {
+		if own.MaxConns != 0 {
+			l.MaxConns = own.MaxConns
+		}
+		if own.RequestsPerMinute != 0 {
+			l.RequestsPerMinute = own.RequestsPerMinute
+		}
+		if own.BytesPerDay != 0 {
+			l.BytesPerDay = own.BytesPerDay
+		}
+	}
+	return l
+}
+
+// Acquire counts a request of user and takes one of its connections. It
+// returns a function giving the connection back, or ErrBytesLimit,
+// ErrConnLimit or ErrRateLimit, checked in that order, without counting
+// anything.
+func (q *Quotas) Acquire(user string) (func(), error) {
+	limits := q.Limits(user)
+	if limits.IsZero() {
+		return func() {}, nil
+	}
+
+	if limits.BytesPerDay > 0 && q.bytes(user) >= limits.BytesPerDay {
+		return nil, ErrBytesLimit
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u := q.usage(user, limits)
+	if limits.MaxConns > 0 && u.conns >= limits.MaxConns {
+		return nil, ErrConnLimit
+	}
+	if limits.RequestsPerMinute > 0 {
+		if u.tokens < 1 {
+			return nil, ErrRateLimit
+		}
+		u.tokens--
+	}
+
+	u.conns++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			u.conns--
+			q.mu.Unlock()
+		})
+	}, nil
+}
+
+// AddBytes counts n bytes exchanged with the client of user against its
+// daily quota.
+func (q *Quotas) AddBytes(user string, n int64) {
+	limits := q.Limits(user)
+	if limits.BytesPerDay == 0 || n <= 0 {
+		return
+	}
+	key, ttl := q.bytesKey(user)
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	if _, err := q.store.Incr(ctx, key, n, ttl); err != nil {
+		logger.Warn("quota_store_error", "user", user, "error", err)
+	}
+}
+
+// bytes returns the bytes user transferred today. A store error counts as
+// nothing transferred, so that an unreachable store does not lock users out.
+func (q *Quotas) bytes(user string) int64 {
+	key, _ := q.bytesKey(user)
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	data, err := q.store.Get(ctx, key)
+	if errors.Is(err, store.ErrNotFound) {
+		return 0
+	}
+	if err != nil {
+		logger.Warn("quota_store_error", "user", user, "error", err)
+		return 0
+	}
+	n, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		logger.Warn("quota_store_error", "user", user, "error", err)
+		return 0
+	}
+	return n
+}
+
+// bytesKey returns the store key counting the bytes user transfers today
+// (UTC), and the time left until the day rolls over, which expires the key.
+func (q *Quotas) bytesKey(user string) (string, time.Duration) {
+	now := q.now().UTC()
+	day := now.Truncate(24 * time.Hour)
+	return q.prefix + user + ":" + day.Format(time.DateOnly), day.Add(24 * time.Hour).Sub(now)
+}
+
+// usage returns the usage of user, refilling its rate bucket as time goes
+// by. Once a minute, the idle users are forgotten. q.mu must be held.
+func (q *Quotas) usage(user string, limits Limits) *usage {
+	now := q.now()
+	if now.Sub(q.swept) >= time.Minute {
+		for name, u := range q.users {
+			if u.idle(now) {
+				delete(q.users, name)
+			}
+		}
+		q.swept = now
+	}
+	u, ok := q.users[user]
+	if !ok {
+		u = &usage{tokens: float64(limits.RequestsPerMinute), refilled: now}
+		q.users[user] = u
+	}
+	if limits.RequestsPerMinute > 0 {
+		rate := float64(limits.RequestsPerMinute) / time.Minute.Seconds()
+		u.tokens = min(u.tokens+now.Sub(u.refilled).Seconds()*rate, float64(limits.RequestsPerMinute))
+	}
+	u.refilled = now
+	return u
+}
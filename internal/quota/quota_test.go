@@ -0,0 +1,162 @@
+package quota
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/store"
+)
+
+func TestQuotas_MaxConns(t *testing.T) {
+	q := New(Limits{MaxConns: 2}, nil, nil, "test")
+
+	release, err := q.Acquire("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Acquire("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Acquire("alice"); err != ErrConnLimit {
+		t.Errorf("third Acquire() error = %v, want ErrConnLimit", err)
+	}
+	// Users are counted separately
+	if _, err := q.Acquire("bob"); err != nil {
+		t.Errorf("Acquire(bob) error = %v", err)
+	}
+
+	release()
+	release() // idempotent
+	if _, err := q.Acquire("alice"); err != nil {
+		t.Errorf("Acquire() after release error = %v", err)
+	}
+	if _, err := q.Acquire("alice"); err != ErrConnLimit {
+		t.Errorf("Acquire() error = %v, want ErrConnLimit after a double release", err)
+	}
+}
+
+func TestQuotas_RequestsPerMinute(t *testing.T) {
+	q := New(Limits{RequestsPerMinute: 3}, nil, nil, "test")
+	now := time.Unix(1700000000, 0)
+	q.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		release, err := q.Acquire("alice")
+		if err != nil {
+			t.Fatalf("request %d: %v", i+1, err)
+		}
+		release()
+	}
+	if _, err := q.Acquire("alice"); err != ErrRateLimit {
+		t.Errorf("fourth Acquire() error = %v, want ErrRateLimit", err)
+	}
+
+	// One request is allowed every 20s
+	now = now.Add(20 * time.Second)
+	if _, err := q.Acquire("alice"); err != nil {
+		t.Errorf("Acquire() after 20s error = %v", err)
+	}
+	if _, err := q.Acquire("alice"); err != ErrRateLimit {
+		t.Errorf("Acquire() error = %v, want ErrRateLimit", err)
+	}
+}
+
+func TestQuotas_BytesPerDay(t *testing.T) {
+	q := New(Limits{}, map[string]Limits{"alice": {BytesPerDay: 1000}}, nil, "test")
+	now := time.Date(2026, 1, 1, 23, 0, 0, 0, time.UTC)
+	q.now = func() time.Time { return now }
+
+	q.AddBytes("alice", 600)
+	if _, err := q.Acquire("alice"); err != nil {
+		t.Fatal(err)
+	}
+	q.AddBytes("alice", 400)
+	if _, err := q.Acquire("alice"); err != ErrBytesLimit {
+		t.Errorf("Acquire() error = %v, want ErrBytesLimit", err)
+	}
+
+	// Users without a quota are not tracked
+	q.AddBytes("bob", 5000)
+	if _, err := q.Acquire("bob"); err != nil {
+		t.Errorf("Acquire(bob) error = %v", err)
+	}
+
+	// The quota starts over at midnight UTC
+	now = now.Add(time.Hour)
+	if _, err := q.Acquire("alice"); err != nil {
+		t.Errorf("Acquire() on the next day error = %v", err)
+	}
+}
+
+func TestQuotas_SharedStore(t *testing.T) {
+	ctx := context.Background()
+	st := store.NewMemory()
+	limits := map[string]Limits{"alice": {BytesPerDay: 1000}}
+	a := New(Limits{}, limits, st, "cluster")
+	b := New(Limits{}, limits, st, "cluster")
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	a.now = func() time.Time { return now }
+	b.now = a.now
+
+	a.AddBytes("alice", 600)
+	b.AddBytes("alice", 400)
+	if _, err := a.Acquire("alice"); err != ErrBytesLimit {
+		t.Errorf("Acquire() error = %v, want ErrBytesLimit counting both instances", err)
+	}
+	keys, _ := st.Keys(ctx, "cluster:quota:bytes:")
+	if want := []string{"cluster:quota:bytes:alice:2026-01-01"}; !slices.Equal(keys, want) {
+		t.Errorf("Keys() = %v, want %v", keys, want)
+	}
+	if _, ttl := a.bytesKey("alice"); ttl != 12*time.Hour {
+		t.Errorf("bytesKey() ttl = %v, want 12h until midnight UTC", ttl)
+	}
+}
+
+func TestQuotas_EvictsIdleUsers(t *testing.T) {
+	q := New(Limits{MaxConns: 1, RequestsPerMinute: 60}, nil, nil, "test")
+	now := time.Unix(1700000000, 0)
+	q.now = func() time.Time { return now }
+
+	release, _ := q.Acquire("alice")
+	release()
+	busy, _ := q.Acquire("bob")
+	defer busy()
+
+	now = now.Add(2 * time.Minute)
+	if _, err := q.Acquire("carol"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := q.users["alice"]; ok {
+		t.Error("idle user alice was not evicted")
+	}
+	if _, ok := q.users["bob"]; !ok {
+		t.Error("user bob with an open connection was evicted")
+	}
+	if _, err := q.Acquire("bob"); err != ErrConnLimit {
+		t.Errorf("Acquire(bob) error = %v, want ErrConnLimit", err)
+	}
+}
+
+func TestQuotas_Limits(t *testing.T) {
+	q := New(Limits{MaxConns: 10, RequestsPerMinute: 60}, map[string]Limits{
+		"alice": {MaxConns: 2},
+	}, nil, "test")
+	if got, want := q.Limits("alice"), (Limits{MaxConns: 2, RequestsPerMinute: 60}); got != want {
+		t.Errorf("Limits(alice) = %+v, want %+v", got, want)
+	}
+	if got, want := q.Limits("bob"), (Limits{MaxConns: 10, RequestsPerMinute: 60}); got != want {
+		t.Errorf("Limits(bob) = %+v, want %+v", got, want)
+	}
+	if !q.Enabled() {
+		t.Error("Enabled() = false")
+	}
+	if New(Limits{}, map[string]Limits{"alice": {}}, nil, "test").Enabled() {
+		t.Error("Enabled() = true without limits")
+	}
+	var nilQuotas *Quotas
+	if nilQuotas.Enabled() {
+		t.Error("nil Quotas Enabled() = true")
+	}
+}
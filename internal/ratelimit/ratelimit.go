@@ -0,0 +1,209 @@
+// Package ratelimit caps the request rate to each destination host and
+// overall.
+package ratelimit
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrGlobalLimit is returned when the proxy-wide request rate is used
+	// up for longer than the max wait.
+	ErrGlobalLimit = errors.New("global request rate limit reached")
+	// ErrHostLimit is returned when the request rate to the destination host
+	// is used up for longer than the max wait.
+	ErrHostLimit = errors.New("destination request rate limit reached")
+	// ErrTooManyWaiters is returned when as many requests as allowed are
+	// already waiting for their turn.
+	ErrTooManyWaiters = errors.New("too many requests waiting for the request rate")
+)
+
+// sweepInterval is how often idle host buckets are forgotten.
+const sweepInterval = time.Minute
+
+// bucket is a token bucket of requests refilled at rate per second, holding
+// up to a second's worth (at least one request).
+type bucket struct {
+	rate     float64
+	burst    float64
+	tokens   float64
+	refilled time.Time
+}
+
+func newBucket(rate float64, now time.Time) *bucket {
+	burst := max(rate, 1)
+	return &bucket{rate: rate, burst: burst, tokens: burst, refilled: now}
+}
+
+// refill adds the tokens earned since the last refill.
+func (b *bucket) refill(now time.Time) {
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.refilled).Seconds()*b.rate)
+	b.refilled = now
+}
+
+// wait returns how long until the bucket holds a request. b must be refilled.
+func (b *bucket) wait() time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Limiter caps the request rate to each destination host and overall.
+// Requests over the rate wait for their turn, up to the max wait.
+type Limiter struct {
+	global     *bucket // nil when unlimited
+	perHost    float64
+	maxWait    time.Duration
+	maxWaiters int
+	waiters    int
+	hosts      map[string]*bucket
+	swept      time.Time
+	mu         sync.Mutex
+	now        func() time.Time
+}
+
+// New creates a Limiter allowing globalRate requests per second overall and
+// hostRate per destination host (zero values are unlimited). Requests may
+// wait up to maxWait for their turn, and up to maxWaiters of them at once
+// (0 = unlimited).
+func New(globalRate, hostRate float64, maxWait time.Duration, maxWaiters int) *Limiter {
+	l := &Limiter{
+		perHost:    hostRate,
+		maxWait:    maxWait,
+		maxWaiters: maxWaiters,
+		hosts:      make(map[string]*bucket),
+		now:        time.Now,
+	}
+	if globalRate > 0 {
+		l.global = newBucket(globalRate, l.now())
+	}
+	return l
+}
+
+// Enabled reports whether any rate is limited.
+func (l *Limiter) Enabled() bool {
+	return l != nil && (l.global != nil || l.perHost > 0)
+}
+
+// Reservation is the turn of a request that must wait before it is sent.
+// Exactly one of Done or Cancel must be called once the wait is over.
+type Reservation struct {
+	l      *Limiter
+	wait   time.Duration
+	global *bucket
+	host   *bucket
+	once   sync.Once
+}
+
+// Delay returns how long the request must wait before it is sent. It is 0
+// for a nil Reservation.
+func (r *Reservation) Delay() time.Duration {
+	if r == nil {
+		return 0
+	}
+	return r.wait
+}
+
+// Done ends the wait of a request sent after Delay.
+func (r *Reservation) Done() {
+	if r == nil {
+		return
+	}
+	r.once.Do(func() {
+		r.l.mu.Lock()
+		r.l.waiters--
+		r.l.mu.Unlock()
+	})
+}
+
+// Cancel ends the wait of a request that will not be sent, such as one
+// whose client went away, and gives its turn back to the requests queued
+// behind it.
+func (r *Reservation) Cancel() {
+	if r == nil {
+		return
+	}
+	r.once.Do(func() {
+		r.l.mu.Lock()
+		r.l.waiters--
+		if r.global != nil {
+			r.global.tokens = min(r.global.burst, r.global.tokens+1)
+		}
+		if r.host != nil {
+			r.host.tokens = min(r.host.burst, r.host.tokens+1)
+		}
+		r.l.mu.Unlock()
+	})
+}
+
+// Reserve takes the turn of a request to host. It returns nil when the
+// request may be sent right away, or the Reservation of a request that must
+// wait. When the wait would exceed the max wait, or too many requests are
+// waiting, nothing is taken and ErrGlobalLimit, ErrHostLimit or
+// ErrTooManyWaiters is returned.
+func (l *Limiter) Reserve(host string) (*Reservation, error) {
+	if !l.Enabled() {
+		return nil, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	var wait time.Duration
+	if l.global != nil {
+		l.global.refill(now)
+		wait = l.global.wait()
+		if wait > l.maxWait {
+			return nil, ErrGlobalLimit
+		}
+	}
+	var hb *bucket
+	if l.perHost > 0 {
+		hb = l.hosts[host]
+		if hb == nil {
+			hb = newBucket(l.perHost, now)
+			l.hosts[host] = hb
+		}
+		hb.refill(now)
+		hostWait := hb.wait()
+		if hostWait > l.maxWait {
+			return nil, ErrHostLimit
+		}
+		wait = max(wait, hostWait)
+	}
+	if wait > 0 && l.maxWaiters > 0 && l.waiters >= l.maxWaiters {
+		return nil, ErrTooManyWaiters
+	}
+
+	if l.global != nil {
+		l.global.tokens--
+	}
+	if hb != nil {
+		hb.tokens--
+	}
+	if wait == 0 {
+		return nil, nil
+	}
+	l.waiters++
+	return &Reservation{l: l, wait: wait, global: l.global, host: hb}, nil
+}
+
+// sweep forgets hosts whose bucket refilled, at most once per sweep
+// interval. l.mu must be held.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < sweepInterval {
+		return
+	}
+	l.swept = now
+	for host, b := range l.hosts {
+		b.refill(now)
+		if b.tokens >= b.burst {
+			delete(l.hosts, host)
+		}
+	}
+}
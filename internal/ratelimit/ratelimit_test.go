@@ -0,0 +1,115 @@
+package ratelimit
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLimiter_Host(t *testing.T) {
+	l := New(0, 2, 0, 0)
+	now := time.Unix(1700000000, 0)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if res, err := l.Reserve("a.example.com"); err != nil || res != nil {
+			t.Fatalf("request %d: Reserve() = %v, %v", i+1, res.Delay(), err)
+		}
+	}
+	if _, err := l.Reserve("a.example.com"); !errors.Is(err, ErrHostLimit) {
+		t.Errorf("third Reserve() error = %v, want ErrHostLimit", err)
+	}
+	// Hosts are limited separately
+	if _, err := l.Reserve("b.example.com"); err != nil {
+		t.Errorf("Reserve() for another host = %v", err)
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if _, err := l.Reserve("a.example.com"); err != nil {
+		t.Errorf("Reserve() after refill = %v", err)
+	}
+}
+
+func TestLimiter_Wait(t *testing.T) {
+	l := New(10, 0, 250*time.Millisecond, 0)
+	now := time.Unix(1700000000, 0)
+	l.now = func() time.Time { return now }
+	l.global.refilled = now
+
+	for i := 0; i < 10; i++ {
+		l.Reserve("a.example.com")
+	}
+	// Requests over the rate queue up in turn until the max wait
+	for i, want := range []time.Duration{100, 200} {
+		res, err := l.Reserve("b.example.com")
+		if err != nil || res.Delay() != want*time.Millisecond {
+			t.Errorf("queued request %d: Reserve() = %v, %v, want %vms", i+1, res.Delay(), err, int(want))
+		}
+	}
+	if _, err := l.Reserve("c.example.com"); !errors.Is(err, ErrGlobalLimit) {
+		t.Errorf("Reserve() past the max wait = %v, want ErrGlobalLimit", err)
+	}
+}
+
+func TestLimiter_MaxWaiters(t *testing.T) {
+	l := New(10, 0, time.Second, 2)
+	now := time.Unix(1700000000, 0)
+	l.now = func() time.Time { return now }
+	l.global.refilled = now
+
+	for i := 0; i < 10; i++ {
+		l.Reserve("a.example.com")
+	}
+	first, _ := l.Reserve("a.example.com")
+	second, _ := l.Reserve("a.example.com")
+	if _, err := l.Reserve("a.example.com"); !errors.Is(err, ErrTooManyWaiters) {
+		t.Fatalf("Reserve() with 2 waiters = %v, want ErrTooManyWaiters", err)
+	}
+
+	// A request sent after its wait leaves the queue
+	first.Done()
+	first.Done()
+	third, err := l.Reserve("a.example.com")
+	if err != nil || third.Delay() != 300*time.Millisecond {
+		t.Fatalf("Reserve() after Done = %v, %v, want 300ms", third.Delay(), err)
+	}
+
+	// A cancelled request gives its turn back
+	third.Cancel()
+	third.Done()
+	second.Cancel()
+	if l.waiters != 0 {
+		t.Errorf("waiters = %d after every wait ended", l.waiters)
+	}
+	if res, err := l.Reserve("a.example.com"); err != nil || res.Delay() != 200*time.Millisecond {
+		t.Errorf("Reserve() after Cancel = %v, %v, want 200ms", res.Delay(), err)
+	}
+}
+
+func TestLimiter_Sweep(t *testing.T) {
+	l := New(0, 1, 0, 0)
+	now := time.Unix(1700000000, 0)
+	l.now = func() time.Time { return now }
+
+	l.Reserve("a.example.com")
+	now = now.Add(2 * sweepInterval)
+	l.Reserve("b.example.com")
+	if _, ok := l.hosts["a.example.com"]; ok {
+		t.Error("idle host was not swept")
+	}
+	if _, ok := l.hosts["b.example.com"]; !ok {
+		t.Error("active host was swept")
+	}
+}
+
+func TestLimiter_Disabled(t *testing.T) {
+	var nilLimiter *Limiter
+	for _, l := range []*Limiter{nilLimiter, New(0, 0, 0, 0)} {
+		if l.Enabled() {
+			t.Error("Enabled() = true without rates")
+		}
+		if res, err := l.Reserve("a.example.com"); res != nil || err != nil {
+			t.Errorf("Reserve() = %v, %v without rates", res.Delay(), err)
+		}
+	}
+}
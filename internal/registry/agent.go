@@ -0,0 +1,186 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/logger"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
+)
+
+// ttlIntervals is how many heartbeat intervals a registration outlives its
+// last renewal, so a single missed heartbeat does not drop the agent.
+const ttlIntervals = 3
+
+// Agent registers the outbound IPs of this instance into the registry of a
+// frontend instance and keeps the registration alive.
+type Agent struct {
+	registryURL string
+	proxyURL    string
+	token       string
+	interval    time.Duration
+	client      *http.Client
+	ips         []string
+	lastSuccess time.Time
+	lastErr     error
+	failures    int
+	mu          sync.Mutex
+	stopCh      chan struct{}
+	wg          sync.WaitGroup
+}
+
+// NewAgent creates an agent that announces proxyURL with ips to the registry
+// at registryURL every interval.
+func NewAgent(registryURL, proxyURL, token string, interval time.Duration, ips []netip.Addr) *Agent {
+	return &Agent{
+		registryURL: registryURL,
+		proxyURL:    proxyURL,
+		token:       token,
+		interval:    interval,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		ips:         netutil.AddrStrings(ips),
+		stopCh:      make(chan struct{}),
+	}
+}
+
+// Start registers right away and then renews the registration every interval.
+func (a *Agent) Start() {
+	a.wg.Add(1)
+	go a.loop()
+}
+
+// Stop stops the renewals and deregisters the agent.
+func (a *Agent) Stop() {
+	close(a.stopCh)
+	a.wg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := a.deregister(ctx); err != nil {
+		logger.Warn("registry_deregister_failed", "registry", a.registryURL, "error", err)
+	}
+}
+
+// SetIPs changes the announced IPs and renews the registration right away.
+func (a *Agent) SetIPs(ips []netip.Addr) {
+	a.mu.Lock()
+	a.ips = netutil.AddrStrings(ips)
+	a.mu.Unlock()
+
+	if err := a.register(context.Background()); err != nil {
+		logger.Warn("registry_register_failed", "registry", a.registryURL, "error", err)
+	}
+}
+
+func (a *Agent) loop() {
+	defer a.wg.Done()
+
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+
+	failing := false
+	for {
+		err := a.register(context.Background())
+		switch {
+		case err != nil && !failing:
+			logger.Warn("registry_register_failed", "registry", a.registryURL, "error", err)
+		case err == nil && failing:
+			logger.Info("registry_register_recovered", "registry", a.registryURL)
+		}
+		failing = err != nil
+
+		select {
+		case <-ticker.C:
+		case <-a.stopCh:
+			return
+		}
+	}
+}
+
+// register announces the current IPs to the registry.
+func (a *Agent) register(ctx context.Context) error {
+	a.mu.Lock()
+	reg := Registration{
+		ProxyURL:   a.proxyURL,
+		IPs:        a.ips,
+		TTLSeconds: int((ttlIntervals * a.interval).Seconds()),
+	}
+	a.mu.Unlock()
+
+	body, err := json.Marshal(reg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.registryURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	err = a.do(req)
+
+	a.mu.Lock()
+	a.lastErr = err
+	if err != nil {
+		a.failures++
+	} else {
+		a.lastSuccess = time.Now()
+		a.failures = 0
+	}
+	a.mu.Unlock()
+	return err
+}
+
+// deregister removes the registration from the registry.
+func (a *Agent) deregister(ctx context.Context) error {
+	u, err := url.Parse(a.registryURL)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("proxy_url", a.proxyURL)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	return a.do(req)
+}
+
+// SetToken replaces the bearer token sent to the registry, for rotation.
+func (a *Agent) SetToken(token string) {
+	a.mu.Lock()
+	a.token = token
+	a.mu.Unlock()
+}
+
+// do sends a registry request and checks its status.
+func (a *Agent) do(req *http.Request) error {
+	a.mu.Lock()
+	token := a.token
+	a.mu.Unlock()
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var body struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return fmt.Errorf("registry returned %s: %s", resp.Status, body.Error)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package registry
+
+import (
+	"sort"
+	"time"
+)
+
+// Status is the cluster view of an instance: the agents registered with it
+// as a frontend and its own registration as an agent.
+type Status struct {
+	// Role is "frontend", "agent" or "frontend+agent".
+	Role         string       `json:"role"`
+	Peers        []PeerStatus `json:"peers,omitempty"`
+	Registration *AgentStatus `json:"registration,omitempty"`
+}
+
+// PeerStatus describes an agent registered with this frontend.
+type PeerStatus struct {
+	ProxyURL string   `json:"proxy_url"`
+	IPs      []string `json:"ips"`
+	// Healthy is false once the agent has missed a renewal.
+	Healthy bool `json:"healthy"`
+	// LagSeconds is the time since the last renewal.
+	LagSeconds       float64   `json:"lag_seconds"`
+	LastSeen         time.Time `json:"last_seen"`
+	ExpiresInSeconds float64   `json:"expires_in_seconds"`
+}
+
+// AgentStatus describes the registration of this instance as an agent.
+type AgentStatus struct {
+	Registry    string     `json:"registry"`
+	IPs         []string   `json:"ips"`
+	Healthy     bool       `json:"healthy"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	// LagSeconds is the time since the last successful renewal.
+	LagSeconds float64 `json:"lag_seconds"`
+	Failures   int     `json:"consecutive_failures"`
+	LastError  string  `json:"last_error,omitempty"`
+}
+
+// ClusterStatus returns the cluster view of an instance acting as a frontend
+// (reg), an agent (agent) or both. Either may be nil.
+func ClusterStatus(reg *Registry, agent *Agent) Status {
+	var s Status
+	switch {
+	case reg != nil && agent != nil:
+		s.Role = "frontend+agent"
+	case reg != nil:
+		s.Role = "frontend"
+	default:
+		s.Role = "agent"
+	}
+	if reg != nil {
+		s.Peers = reg.Peers()
+	}
+	if agent != nil {
+		st := agent.Status()
+		s.Registration = &st
+	}
+	return s
+}
+
+// Peers returns the status of the registered agents, ordered by proxy URL.
+// An agent is healthy while it has missed no renewal.
+func (reg *Registry) Peers() []PeerStatus {
+	now := reg.now()
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	peers := make([]PeerStatus, 0, len(reg.entries))
+	for _, e := range reg.entries {
+		ttl := time.Duration(e.TTLSeconds) * time.Second
+		lag := now.Sub(e.renewed)
+		peers = append(peers, PeerStatus{
+			ProxyURL:         redact(e.ProxyURL),
+			IPs:              e.IPs,
+			Healthy:          lag <= 2*ttl/ttlIntervals,
+			LagSeconds:       lag.Seconds(),
+			LastSeen:         e.renewed,
+			ExpiresInSeconds: e.expires.Sub(now).Seconds(),
+		})
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].ProxyURL < peers[j].ProxyURL })
+	return peers
+}
+
+// Status returns the state of the registration of this agent. It is healthy
+// while the last renewal succeeded.
+func (a *Agent) Status() AgentStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	st := AgentStatus{
+		Registry: a.registryURL,
+		IPs:      a.ips,
+		Healthy:  a.lastErr == nil && !a.lastSuccess.IsZero(),
+		Failures: a.failures,
+	}
+	if !a.lastSuccess.IsZero() {
+		last := a.lastSuccess
+		st.LastSuccess = &last
+		st.LagSeconds = time.Since(last).Seconds()
+	}
+	if a.lastErr != nil {
+		st.LastError = a.lastErr.Error()
+	}
+	return st
+}
@@ -0,0 +1,329 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/balancer"
+	"github.com/cr0hn/outbound-lb/internal/logger"
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+	"github.com/cr0hn/outbound-lb/internal/proxy"
+)
+
+// MethodLabel labels SOCKS5 tunnels in logs and metrics, next to the HTTP
+// methods of the proxy.
+const MethodLabel = "SOCKS5"
+
+// ErrServerClosed is returned by Start and Serve after Shutdown.
+var ErrServerClosed = errors.New("socks: server closed")
+
+// Server is the SOCKS5 server. It accepts CONNECT requests only and opens
+// their tunnels through the proxy server.
+type Server struct {
+	addr     string
+	proxy    *proxy.Server
+	timeout  atomic.Int64
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+}
+
+// NewServer creates a SOCKS5 server listening on port. timeout limits the
+// handshake with clients.
+func NewServer(port int, p *proxy.Server, timeout time.Duration) *Server {
+	s := &Server{
+		addr:  fmt.Sprintf(":%d", port),
+		proxy: p,
+		conns: make(map[net.Conn]struct{}),
+	}
+	s.SetTimeout(timeout)
+	return s
+}
+
+// SetTimeout changes the handshake timeout of new clients.
+func (s *Server) SetTimeout(timeout time.Duration) {
+	s.timeout.Store(int64(timeout))
+}
+
+// Start listens on the configured port and serves clients.
+func (s *Server) Start() error {
+	ln, err := s.proxy.Listen(s.addr)
+	if err != nil {
+		return err
+	}
+	logger.Info("starting socks server", "addr", s.addr, "auth_enabled", s.proxy.AuthRequired())
+	return s.Serve(s.proxy.ProxyProtocolListener(ln))
+}
+
+// Serve accepts clients on ln until Shutdown.
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	s.listener = ln
+	s.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			defer s.untrack(conn)
+			s.handle(conn)
+		}()
+	}
+}
+
+// Shutdown stops accepting clients and waits for open tunnels to finish until
+// ctx is done, then closes the remaining ones.
+func (s *Server) Shutdown(ctx context.Context) error {
+	logger.Info("shutting down socks server")
+	s.StopAccepting()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// StopAccepting closes the listener and leaves open tunnels running, so that
+// they drain with the proxy server's WaitForConnections.
+func (s *Server) StopAccepting() {
+	s.mu.Lock()
+	s.closed = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.mu.Unlock()
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	conn.Close()
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+}
+
+// handle serves one client: negotiates auth, reads the request and relays the
+// tunnel.
+func (s *Server) handle(conn net.Conn) {
+	remote := conn.RemoteAddr().String()
+	requestID := proxy.GenerateRequestID()
+	sessionID := proxy.GenerateRequestID()
+
+	conn.SetDeadline(time.Now().Add(time.Duration(s.timeout.Load())))
+
+	// Clients outside the allowed networks are dropped before negotiation
+	if !s.proxy.ClientAllowed(remote) {
+		client, _, _ := net.SplitHostPort(remote)
+		s.proxy.Reject(MethodLabel, client, "", proxy.RejectClientACL, http.StatusForbidden, netip.Addr{})
+		return
+	}
+
+	user, ok := s.negotiate(conn, remote)
+	if !ok {
+		return
+	}
+
+	host, err := readRequest(conn)
+	if err != nil {
+		logger.Debug("socks_request_invalid", "remote", remote, "error", err)
+		switch {
+		case errors.Is(err, errUnsupportedCommand):
+			writeReply(conn, replyCommandNotSupported, nil)
+		case errors.Is(err, errUnsupportedAddress):
+			writeReply(conn, replyAddressNotSupported, nil)
+		}
+		return
+	}
+
+	logger.Trace("socks_request_received", "request_id", requestID, "session_id", sessionID, "host", host, "remote", remote)
+
+	// Attach client identity for session affinity, as for proxy requests
+	identity := "user:" + user
+	if user == "" {
+		identity, _, _ = net.SplitHostPort(remote)
+	}
+	ctx := balancer.ContextWithClient(context.Background(), identity)
+	ctx = proxy.ContextWithClientAddr(ctx, conn.RemoteAddr())
+
+	// SOCKS5 tunnels are subject to the policy for CONNECT
+	if !s.proxy.AllowMethod(ctx, http.MethodConnect, identity, host) {
+		metrics.RequestsTotal.WithLabelValues(MethodLabel, strconv.Itoa(http.StatusMethodNotAllowed)).Inc()
+		writeReply(conn, replyNotAllowed, nil)
+		return
+	}
+
+	// Tunnels may only target the allowed ports, as CONNECT tunnels
+	if !s.proxy.AllowConnectPort(MethodLabel, identity, host) {
+		metrics.RequestsTotal.WithLabelValues(MethodLabel, strconv.Itoa(http.StatusForbidden)).Inc()
+		writeReply(conn, replyNotAllowed, nil)
+		return
+	}
+
+	ctx, allowed := s.proxy.AllowDestination(ctx, MethodLabel, identity, host)
+	if !allowed {
+		metrics.RequestsTotal.WithLabelValues(MethodLabel, strconv.Itoa(http.StatusForbidden)).Inc()
+		writeReply(conn, replyNotAllowed, nil)
+		return
+	}
+
+	releaseClient, err := s.proxy.AcquireClientConn(ctx, MethodLabel, host)
+	if err != nil {
+		metrics.RequestsTotal.WithLabelValues(MethodLabel, strconv.Itoa(http.StatusTooManyRequests)).Inc()
+		writeReply(conn, replyNotAllowed, nil)
+		return
+	}
+	defer releaseClient()
+
+	if err := s.proxy.WaitRate(ctx, MethodLabel, identity, host); err != nil {
+		metrics.RequestsTotal.WithLabelValues(MethodLabel, strconv.Itoa(http.StatusTooManyRequests)).Inc()
+		writeReply(conn, replyNotAllowed, nil)
+		return
+	}
+
+	releaseQuota, err := s.proxy.AcquireQuota(ctx, MethodLabel, host)
+	if err != nil {
+		metrics.RequestsTotal.WithLabelValues(MethodLabel, strconv.Itoa(proxy.QuotaStatus(err))).Inc()
+		writeReply(conn, replyNotAllowed, nil)
+		return
+	}
+	defer releaseQuota()
+
+	tun, err := s.proxy.OpenTunnel(ctx, MethodLabel, host)
+	if err != nil {
+		var upstreamErr *proxy.UpstreamError
+		if errors.As(err, &upstreamErr) {
+			metrics.RequestsTotal.WithLabelValues(MethodLabel, strconv.Itoa(upstreamErr.Status())).Inc()
+		}
+		writeReply(conn, replyCode(err), nil)
+		return
+	}
+	defer tun.Close()
+
+	if err := writeReply(conn, replySucceeded, tun.LocalAddr()); err != nil {
+		logger.LogError("socks_response", err, "host", host)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	tun.Relay(conn, remote, requestID, sessionID)
+}
+
+// negotiate selects the auth method offered by the client and authenticates
+// it. Without auth configured no credentials are required. Returns the proxy
+// user, empty without auth.
+func (s *Server) negotiate(conn net.Conn, remote string) (string, bool) {
+	methods, err := readMethods(conn)
+	if err != nil {
+		logger.Debug("socks_handshake_invalid", "remote", remote, "error", err)
+		return "", false
+	}
+
+	if !s.proxy.AuthRequired() {
+		if !slices.Contains(methods, methodNoAuth) {
+			conn.Write([]byte{socksVersion, methodNoAcceptable})
+			return "", false
+		}
+		_, err := conn.Write([]byte{socksVersion, methodNoAuth})
+		return "", err == nil
+	}
+
+	if !slices.Contains(methods, methodUserPass) {
+		conn.Write([]byte{socksVersion, methodNoAcceptable})
+		metrics.AuthFailures.Inc()
+		s.rejectAuth(remote)
+		return "", false
+	}
+	if _, err := conn.Write([]byte{socksVersion, methodUserPass}); err != nil {
+		return "", false
+	}
+
+	reqUser, reqPass, err := readUserPass(conn)
+	if err != nil {
+		logger.Debug("socks_auth_invalid", "remote", remote, "error", err)
+		return "", false
+	}
+	user, ok := s.proxy.Authenticate(reqUser, reqPass, remote)
+	if !ok {
+		conn.Write([]byte{userPassVersion, userPassFailure})
+		s.rejectAuth(remote)
+		return "", false
+	}
+	if _, err := conn.Write([]byte{userPassVersion, userPassSuccess}); err != nil {
+		return "", false
+	}
+	return user, true
+}
+
+// rejectAuth records a client that failed to authenticate. Its destination
+// is not known yet.
+func (s *Server) rejectAuth(remote string) {
+	client, _, _ := net.SplitHostPort(remote)
+	s.proxy.Reject(MethodLabel, client, "", proxy.RejectAuth, http.StatusProxyAuthRequired, netip.Addr{})
+}
+
+// replyCode maps an OpenTunnel error to a SOCKS5 reply code.
+func replyCode(err error) byte {
+	var upstreamErr *proxy.UpstreamError
+	if !errors.As(err, &upstreamErr) {
+		return replyGeneralFailure
+	}
+	switch upstreamErr.Class {
+	case proxy.ErrorClassDNSNotFound, proxy.ErrorClassDNSTimeout, proxy.ErrorClassDNS:
+		return replyHostUnreachable
+	case proxy.ErrorClassConnect:
+		return replyConnectionRefused
+	case proxy.ErrorClassDestinationDenied:
+		return replyNotAllowed
+	default:
+		return replyGeneralFailure
+	}
+}
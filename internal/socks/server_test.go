@@ -0,0 +1,260 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cr0hn/outbound-lb/internal/balancer"
+	"github.com/cr0hn/outbound-lb/internal/config"
+	"github.com/cr0hn/outbound-lb/internal/limiter"
+	"github.com/cr0hn/outbound-lb/internal/metrics"
+	"github.com/cr0hn/outbound-lb/internal/proxy"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
+)
+
+// startSocks starts a SOCKS5 server in front of a proxy using 127.0.0.1,
+// allowing tunnels to connectPorts or to any port without them, and returns
+// its address.
+func startSocks(t *testing.T, auth string, connectPorts ...string) string {
+	t.Helper()
+
+	cfg := config.DefaultConfig()
+	cfg.IPs = []string{"127.0.0.1"}
+	cfg.Timeout = 5 * time.Second
+	cfg.IdleTimeout = 5 * time.Second
+	cfg.Auth = auth
+	// Test targets listen on loopback, on random ports
+	cfg.BlockPrivateDestinations = false
+	cfg.ConnectAllowedPorts = connectPorts
+	stats := metrics.NewStatsCollector(netutil.MustParseAddrs(cfg.IPs))
+	lim := limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, netutil.MustParseAddrs(cfg.IPs))
+	bal := balancer.New(balancer.Config{
+		IPs:           netutil.MustParseAddrs(cfg.IPs),
+		HistoryWindow: int64(cfg.HistoryWindow.Seconds()),
+		HistorySize:   cfg.HistorySize,
+		Limiter:       lim,
+	})
+	t.Cleanup(bal.Stop)
+
+	srv := NewServer(0, proxy.NewServer(cfg, bal, lim, stats), cfg.Timeout)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	})
+	return ln.Addr().String()
+}
+
+// startEcho starts a TCP server echoing everything back and returns its address.
+func startEcho(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func dial(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readN(t *testing.T, conn net.Conn, n int) []byte {
+	t.Helper()
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return buf
+}
+
+// connectRequest builds a CONNECT request for a domain target.
+func connectRequest(cmd byte, host string, port int) []byte {
+	req := append([]byte{socksVersion, cmd, 0x00, atypDomain, byte(len(host))}, host...)
+	return binary.BigEndian.AppendUint16(req, uint16(port))
+}
+
+func targetPort(t *testing.T, addr string) int {
+	t.Helper()
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tcpAddr.Port
+}
+
+func TestServer_ConnectNoAuth(t *testing.T) {
+	addr := startSocks(t, "")
+	target := startEcho(t)
+	conn := dial(t, addr)
+
+	conn.Write([]byte{socksVersion, 1, methodNoAuth})
+	if got := readN(t, conn, 2); !bytes.Equal(got, []byte{socksVersion, methodNoAuth}) {
+		t.Fatalf("method reply = %v", got)
+	}
+
+	conn.Write(connectRequest(cmdConnect, "127.0.0.1", targetPort(t, target)))
+	reply := readN(t, conn, 10)
+	if reply[1] != replySucceeded {
+		t.Fatalf("reply code = %d, want %d", reply[1], replySucceeded)
+	}
+	if reply[3] != atypIPv4 || !net.IP(reply[4:8]).Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("bound address = %v, want 127.0.0.1", reply[3:8])
+	}
+
+	conn.Write([]byte("ping"))
+	if got := readN(t, conn, 4); string(got) != "ping" {
+		t.Errorf("echo = %q, want %q", got, "ping")
+	}
+}
+
+func TestServer_UserPassAuth(t *testing.T) {
+	addr := startSocks(t, "user:secret")
+	target := startEcho(t)
+
+	tests := []struct {
+		name   string
+		pass   string
+		status byte
+	}{
+		{name: "valid credentials", pass: "secret", status: userPassSuccess},
+		{name: "wrong password", pass: "wrong", status: userPassFailure},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := dial(t, addr)
+			conn.Write([]byte{socksVersion, 2, methodNoAuth, methodUserPass})
+			if got := readN(t, conn, 2); !bytes.Equal(got, []byte{socksVersion, methodUserPass}) {
+				t.Fatalf("method reply = %v", got)
+			}
+
+			auth := append([]byte{userPassVersion, 4}, "user"...)
+			auth = append(append(auth, byte(len(tt.pass))), tt.pass...)
+			conn.Write(auth)
+			if got := readN(t, conn, 2); got[1] != tt.status {
+				t.Fatalf("auth status = %d, want %d", got[1], tt.status)
+			}
+			if tt.status != userPassSuccess {
+				return
+			}
+
+			conn.Write(connectRequest(cmdConnect, "127.0.0.1", targetPort(t, target)))
+			if reply := readN(t, conn, 10); reply[1] != replySucceeded {
+				t.Fatalf("reply code = %d, want %d", reply[1], replySucceeded)
+			}
+		})
+	}
+}
+
+func TestServer_AuthRequiredRejectsNoAuth(t *testing.T) {
+	addr := startSocks(t, "user:secret")
+	conn := dial(t, addr)
+
+	conn.Write([]byte{socksVersion, 1, methodNoAuth})
+	if got := readN(t, conn, 2); got[1] != methodNoAcceptable {
+		t.Errorf("method = %#x, want %#x", got[1], methodNoAcceptable)
+	}
+}
+
+func TestServer_RequestErrors(t *testing.T) {
+	addr := startSocks(t, "")
+
+	// A port nothing listens on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := targetPort(t, ln.Addr().String())
+	ln.Close()
+
+	tests := []struct {
+		name string
+		req  []byte
+		code byte
+	}{
+		{name: "bind not supported", req: connectRequest(0x02, "127.0.0.1", 80), code: replyCommandNotSupported},
+		{name: "connection refused", req: connectRequest(cmdConnect, "127.0.0.1", closedPort), code: replyConnectionRefused},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := dial(t, addr)
+			conn.Write([]byte{socksVersion, 1, methodNoAuth})
+			readN(t, conn, 2)
+
+			conn.Write(tt.req)
+			if reply := readN(t, conn, 10); reply[1] != tt.code {
+				t.Errorf("reply code = %d, want %d", reply[1], tt.code)
+			}
+		})
+	}
+}
+
+func TestServer_ConnectPortNotAllowed(t *testing.T) {
+	addr := startSocks(t, "", "443")
+	target := startEcho(t)
+	conn := dial(t, addr)
+
+	conn.Write([]byte{socksVersion, 1, methodNoAuth})
+	readN(t, conn, 2)
+
+	conn.Write(connectRequest(cmdConnect, "127.0.0.1", targetPort(t, target)))
+	if reply := readN(t, conn, 10); reply[1] != replyNotAllowed {
+		t.Errorf("reply code = %d, want %d", reply[1], replyNotAllowed)
+	}
+}
+
+func TestReadRequest_AddressTypes(t *testing.T) {
+	tests := []struct {
+		name string
+		req  []byte
+		want string
+	}{
+		{name: "ipv4", req: []byte{socksVersion, cmdConnect, 0, atypIPv4, 10, 0, 0, 1, 0x01, 0xBB}, want: "10.0.0.1:443"},
+		{name: "ipv6", req: append(append([]byte{socksVersion, cmdConnect, 0, atypIPv6}, net.ParseIP("2001:db8::1")...), 0x00, 0x50), want: "[2001:db8::1]:80"},
+		{name: "domain", req: connectRequest(cmdConnect, "example.com", 8080), want: "example.com:8080"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readRequest(bytes.NewReader(tt.req))
+			if err != nil {
+				t.Fatalf("readRequest() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("readRequest() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+// Package socks provides a SOCKS5 front-end to the proxy, sharing its outbound
+// IP selection, connection limits, health feedback and metrics.
+package socks
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// Protocol constants (RFC 1928, RFC 1929).
+const (
+	socksVersion = 0x05
+
+	methodNoAuth       = 0x00
+	methodUserPass     = 0x02
+	methodNoAcceptable = 0xFF
+
+	userPassVersion = 0x01
+	userPassSuccess = 0x00
+	userPassFailure = 0x01
+
+	cmdConnect = 0x01
+
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+)
+
+// Reply codes.
+const (
+	replySucceeded           = 0x00
+	replyGeneralFailure      = 0x01
+	replyNotAllowed          = 0x02
+	replyHostUnreachable     = 0x04
+	replyConnectionRefused   = 0x05
+	replyCommandNotSupported = 0x07
+	replyAddressNotSupported = 0x08
+)
+
+// errUnsupportedCommand and errUnsupportedAddress are request errors answered
+// with the matching reply code.
+var (
+	errUnsupportedCommand = errors.New("unsupported command")
+	errUnsupportedAddress = errors.New("unsupported address type")
+)
+
+// readMethods reads the client greeting and returns the offered auth methods.
+func readMethods(r io.Reader) ([]byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != socksVersion {
+		return nil, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return nil, err
+	}
+	return methods, nil
+}
+
+// readUserPass reads a username/password sub-negotiation request.
+func readUserPass(r io.Reader) (user, pass string, err error) {
+	var version [1]byte
+	if _, err := io.ReadFull(r, version[:]); err != nil {
+		return "", "", err
+	}
+	if version[0] != userPassVersion {
+		return "", "", fmt.Errorf("unsupported auth version %d", version[0])
+	}
+	if user, err = readString(r); err != nil {
+		return "", "", err
+	}
+	if pass, err = readString(r); err != nil {
+		return "", "", err
+	}
+	return user, pass, nil
+}
+
+// readString reads a string prefixed with its one-byte length.
+func readString(r io.Reader) (string, error) {
+	var length [1]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return "", err
+	}
+	buf := make([]byte, length[0])
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// readRequest reads a request and returns its target as "host:port".
+// Only CONNECT is supported.
+func readRequest(r io.Reader) (string, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+
+	var host string
+	switch header[3] {
+	case atypIPv4, atypIPv6:
+		size := net.IPv4len
+		if header[3] == atypIPv6 {
+			size = net.IPv6len
+		}
+		addr := make([]byte, size)
+		if _, err := io.ReadFull(r, addr); err != nil {
+			return "", err
+		}
+		host = net.IP(addr).String()
+	case atypDomain:
+		name, err := readString(r)
+		if err != nil {
+			return "", err
+		}
+		host = name
+	default:
+		return "", errUnsupportedAddress
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	if header[1] != cmdConnect {
+		return "", errUnsupportedCommand
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// writeReply writes a reply with the given code and bound address, which may
+// be nil for failures.
+func writeReply(w io.Writer, code byte, bound net.Addr) error {
+	ip := net.IPv4zero.To4()
+	port := 0
+	if addr, ok := bound.(*net.TCPAddr); ok {
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			ip = ip4
+		} else if addr.IP != nil {
+			ip = addr.IP.To16()
+		}
+		port = addr.Port
+	}
+
+	atyp := byte(atypIPv4)
+	if len(ip) == net.IPv6len {
+		atyp = atypIPv6
+	}
+	reply := append([]byte{socksVersion, code, 0x00, atyp}, ip...)
+	reply = binary.BigEndian.AppendUint16(reply, uint16(port))
+	_, err := w.Write(reply)
+	return err
+}
@@ -0,0 +1,178 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileSuffix is appended to the escaped key to name its file.
+const fileSuffix = ".json"
+
+// fileEntry is the on-disk form of a value.
+type fileEntry struct {
+	Value   []byte     `json:"value"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// File is a Store keeping one file per key in a directory. Files are replaced
+// atomically, so a crash never leaves a partially written value. It is meant
+// for a single process; concurrent processes sharing the directory may lose
+// counter updates.
+type File struct {
+	dir string
+	now func() time.Time
+	mu  sync.Mutex
+}
+
+// NewFile creates a store in dir, creating the directory if needed.
+func NewFile(dir string) (*File, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("store: %w", err)
+	}
+	return &File{dir: dir, now: time.Now}, nil
+}
+
+func (f *File) path(key string) string {
+	return filepath.Join(f.dir, url.PathEscape(key)+fileSuffix)
+}
+
+// read returns the live entry for key. Must be called with mu held.
+func (f *File) read(key string) (fileEntry, error) {
+	data, err := os.ReadFile(f.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return fileEntry{}, ErrNotFound
+	}
+	if err != nil {
+		return fileEntry{}, fmt.Errorf("store: %w", err)
+	}
+	var e fileEntry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return fileEntry{}, fmt.Errorf("store: corrupt value for %s: %w", key, err)
+	}
+	if e.Expires != nil && !f.now().Before(*e.Expires) {
+		os.Remove(f.path(key))
+		return fileEntry{}, ErrNotFound
+	}
+	return e, nil
+}
+
+// write replaces the file for key. Must be called with mu held.
+func (f *File) write(key string, e fileEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("store: %w", err)
+	}
+	tmp, err := os.CreateTemp(f.dir, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("store: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("store: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("store: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), f.path(key)); err != nil {
+		return fmt.Errorf("store: %w", err)
+	}
+	return nil
+}
+
+// Get returns the value of key.
+func (f *File) Get(_ context.Context, key string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e, err := f.read(key)
+	if err != nil {
+		return nil, err
+	}
+	return e.Value, nil
+}
+
+// Set stores value under key.
+func (f *File) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	e := fileEntry{Value: value}
+	if ttl > 0 {
+		expires := f.now().Add(ttl)
+		e.Expires = &expires
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.write(key, e)
+}
+
+// Delete removes key.
+func (f *File) Delete(_ context.Context, key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := os.Remove(f.path(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("store: %w", err)
+	}
+	return nil
+}
+
+// Keys returns the live keys starting with prefix.
+func (f *File) Keys(_ context.Context, prefix string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return nil, fmt.Errorf("store: %w", err)
+	}
+	var keys []string
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), fileSuffix)
+		if !ok || entry.IsDir() || strings.HasPrefix(name, ".tmp-") {
+			continue
+		}
+		key, err := url.PathUnescape(name)
+		if err != nil || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if _, err := f.read(key); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// Incr adds delta to the counter at key.
+func (f *File) Incr(_ context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e, err := f.read(key)
+	created := errors.Is(err, ErrNotFound)
+	if err != nil && !created {
+		return 0, err
+	}
+	n, err := addCounter(e.Value, delta)
+	if err != nil {
+		return 0, fmt.Errorf("store: incr %s: %w", key, err)
+	}
+	e.Value = []byte(strconv.FormatInt(n, 10))
+	if created && ttl > 0 {
+		expires := f.now().Add(ttl)
+		e.Expires = &expires
+	}
+	if err := f.write(key, e); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Close is a no-op.
+func (f *File) Close() error {
+	return nil
+}
@@ -0,0 +1,88 @@
+// Package store provides the key-value storage shared by persistence
+// features, with in-memory, file and Redis backends.
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// ErrNotFound is returned when a key does not exist or has expired.
+var ErrNotFound = errors.New("store: key not found")
+
+// Store is a key-value store. Implementations are safe for concurrent use.
+type Store interface {
+	// Get returns the value of key, or ErrNotFound.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Set stores value under key. A positive ttl expires the key after it;
+	// zero keeps it until deleted.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Delete removes key. Deleting a missing key is not an error.
+	Delete(ctx context.Context, key string) error
+	// Keys returns the keys starting with prefix, in no particular order.
+	Keys(ctx context.Context, prefix string) ([]string, error)
+	// Incr adds delta to the integer counter at key, creating it at zero,
+	// and returns the new value. A positive ttl expires a key created by
+	// Incr after it; the expiry of an existing key is kept.
+	Incr(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error)
+	// Close releases the resources of the store.
+	Close() error
+}
+
+// Open creates the store described by rawURL:
+//
+//	memory://                          in-process, lost on restart
+//	file:///var/lib/outbound-lb        one file per key in a directory
+//	redis://[:password@]host:port[/db] a Redis server
+func Open(rawURL string) (Store, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid store URL: %w", err)
+	}
+	switch u.Scheme {
+	case "memory":
+		return NewMemory(), nil
+	case "file":
+		if u.Path == "" {
+			return nil, fmt.Errorf("invalid store URL: %q (file store needs a directory path)", rawURL)
+		}
+		f, err := NewFile(u.Path)
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	case "redis":
+		r, err := NewRedis(u)
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	default:
+		return nil, fmt.Errorf("unsupported store: %q (must be memory://, file:// or redis://)", u.Redacted())
+	}
+}
+
+// GetJSON decodes the JSON value of key into v.
+func GetJSON(ctx context.Context, s Store, key string, v any) error {
+	data, err := s.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("store: decode %s: %w", key, err)
+	}
+	return nil
+}
+
+// SetJSON stores v encoded as JSON under key.
+func SetJSON(ctx context.Context, s Store, key string, v any, ttl time.Duration) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("store: encode %s: %w", key, err)
+	}
+	return s.Set(ctx, key, data, ttl)
+}
@@ -0,0 +1,294 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testStores returns one store of each backend.
+func testStores(t *testing.T) map[string]Store {
+	t.Helper()
+	file, err := NewFile(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse("redis://:secret@" + startFakeRedis(t, "secret") + "/2")
+	redis, err := NewRedis(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { redis.Close() })
+	return map[string]Store{"memory": NewMemory(), "file": file, "redis": redis}
+}
+
+func TestStore_GetSetDelete(t *testing.T) {
+	ctx := context.Background()
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if _, err := s.Get(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get(missing) error = %v, want ErrNotFound", err)
+			}
+
+			key := "history/api.example.com:443"
+			if err := s.Set(ctx, key, []byte("value"), 0); err != nil {
+				t.Fatalf("Set() error = %v", err)
+			}
+			got, err := s.Get(ctx, key)
+			if err != nil || string(got) != "value" {
+				t.Fatalf("Get() = %q, %v, want %q", got, err, "value")
+			}
+
+			if err := s.Delete(ctx, key); err != nil {
+				t.Fatalf("Delete() error = %v", err)
+			}
+			if _, err := s.Get(ctx, key); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get() after Delete error = %v, want ErrNotFound", err)
+			}
+			if err := s.Delete(ctx, key); err != nil {
+				t.Errorf("Delete() of missing key error = %v", err)
+			}
+		})
+	}
+}
+
+func TestStore_Keys(t *testing.T) {
+	ctx := context.Background()
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, key := range []string{"quota/a", "quota/b*", "health/a"} {
+				if err := s.Set(ctx, key, []byte("1"), 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			keys, err := s.Keys(ctx, "quota/")
+			if err != nil {
+				t.Fatalf("Keys() error = %v", err)
+			}
+			slices.Sort(keys)
+			if want := []string{"quota/a", "quota/b*"}; !slices.Equal(keys, want) {
+				t.Errorf("Keys() = %v, want %v", keys, want)
+			}
+		})
+	}
+}
+
+func TestStore_Incr(t *testing.T) {
+	ctx := context.Background()
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if n, err := s.Incr(ctx, "usage", 5, 0); err != nil || n != 5 {
+				t.Fatalf("Incr() = %d, %v, want 5", n, err)
+			}
+			if n, err := s.Incr(ctx, "usage", -2, 0); err != nil || n != 3 {
+				t.Fatalf("Incr() = %d, %v, want 3", n, err)
+			}
+
+			s.Set(ctx, "text", []byte("abc"), 0)
+			if _, err := s.Incr(ctx, "text", 1, 0); err == nil {
+				t.Error("Incr() of non-integer value should fail")
+			}
+		})
+	}
+}
+
+func TestStore_JSON(t *testing.T) {
+	ctx := context.Background()
+	type snapshot struct {
+		Hosts map[string][]string `json:"hosts"`
+	}
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			in := snapshot{Hosts: map[string][]string{"example.com": {"10.0.0.1"}}}
+			if err := SetJSON(ctx, s, "snapshot", in, 0); err != nil {
+				t.Fatalf("SetJSON() error = %v", err)
+			}
+			var out snapshot
+			if err := GetJSON(ctx, s, "snapshot", &out); err != nil {
+				t.Fatalf("GetJSON() error = %v", err)
+			}
+			if got := out.Hosts["example.com"]; len(got) != 1 || got[0] != "10.0.0.1" {
+				t.Errorf("GetJSON() = %+v, want %+v", out, in)
+			}
+		})
+	}
+}
+
+func TestStore_TTL(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	clock := func() time.Time { return now }
+
+	mem := NewMemory()
+	mem.now = clock
+	file, err := NewFile(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.now = clock
+
+	for name, s := range map[string]Store{"memory": mem, "file": file} {
+		t.Run(name, func(t *testing.T) {
+			now = time.Now()
+			s.Set(ctx, "short", []byte("1"), time.Minute)
+			s.Set(ctx, "forever", []byte("1"), 0)
+
+			now = now.Add(30 * time.Second)
+			if _, err := s.Get(ctx, "short"); err != nil {
+				t.Errorf("Get() before expiry error = %v", err)
+			}
+			// Counters keep the expiry of the key
+			s.Incr(ctx, "short", 1, time.Hour)
+			// and expire when created with a ttl
+			s.Incr(ctx, "counter", 1, time.Minute)
+
+			now = now.Add(time.Minute)
+			if _, err := s.Get(ctx, "short"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get() after expiry error = %v, want ErrNotFound", err)
+			}
+			if keys, _ := s.Keys(ctx, ""); !slices.Equal(keys, []string{"forever"}) {
+				t.Errorf("Keys() = %v, want [forever]", keys)
+			}
+		})
+	}
+}
+
+func TestOpen(t *testing.T) {
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{url: "memory://"},
+		{url: "file://" + t.TempDir()},
+		{url: "redis://localhost:6379/0"},
+		{url: "file://", wantErr: true},
+		{url: "redis:///0", wantErr: true},
+		{url: "redis://localhost/db", wantErr: true},
+		{url: "etcd://localhost:2379", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			s, err := Open(tt.url)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Open(%q) error = %v, wantErr %v", tt.url, err, tt.wantErr)
+			}
+			if s != nil {
+				s.Close()
+			}
+		})
+	}
+}
+
+// startFakeRedis starts a server speaking enough RESP for the Redis store,
+// requiring password, and returns its address. Expiry is not implemented.
+func startFakeRedis(t *testing.T, password string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	var mu sync.Mutex
+	data := make(map[string][]byte)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				authed := false
+				for {
+					reply, err := readReply(br)
+					if err != nil {
+						return
+					}
+					var args []string
+					for _, a := range reply.([]any) {
+						args = append(args, string(a.([]byte)))
+					}
+					mu.Lock()
+					resp := fakeRedisCommand(data, args, password, &authed)
+					mu.Unlock()
+					conn.Write([]byte(resp))
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func fakeRedisCommand(data map[string][]byte, args []string, password string, authed *bool) string {
+	bulk := func(s string) string { return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s) }
+
+	cmd := strings.ToUpper(args[0])
+	if cmd == "AUTH" {
+		if args[1] != password {
+			return "-WRONGPASS invalid password\r\n"
+		}
+		*authed = true
+		return "+OK\r\n"
+	}
+	if !*authed {
+		return "-NOAUTH Authentication required.\r\n"
+	}
+
+	switch cmd {
+	case "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		v, ok := data[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return bulk(string(v))
+	case "SET":
+		data[args[1]] = []byte(args[2])
+		return "+OK\r\n"
+	case "DEL":
+		delete(data, args[1])
+		return ":1\r\n"
+	case "INCRBY":
+		n := int64(0)
+		if v, ok := data[args[1]]; ok {
+			var err error
+			if n, err = strconv.ParseInt(string(v), 10, 64); err != nil {
+				return "-ERR value is not an integer or out of range\r\n"
+			}
+		}
+		delta, _ := strconv.ParseInt(args[2], 10, 64)
+		n += delta
+		data[args[1]] = []byte(strconv.FormatInt(n, 10))
+		return fmt.Sprintf(":%d\r\n", n)
+	case "PEXPIRE":
+		if _, ok := data[args[1]]; !ok {
+			return ":0\r\n"
+		}
+		return ":1\r\n"
+	case "SCAN":
+		var keys []string
+		for k := range data {
+			if ok, _ := path.Match(args[3], k); ok {
+				keys = append(keys, bulk(k))
+			}
+		}
+		return "*2\r\n" + bulk("0") + fmt.Sprintf("*%d\r\n", len(keys)) + strings.Join(keys, "")
+	default:
+		return "-ERR unknown command\r\n"
+	}
+}
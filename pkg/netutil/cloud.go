@@ -0,0 +1,254 @@
+package netutil
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// Cloud providers DiscoverCloudIPs reads instance metadata from.
+const (
+	CloudAWS = "aws"
+	CloudGCP = "gcp"
+)
+
+// cloudMetadataTimeout bounds a cloud discovery, all metadata requests
+// included.
+const cloudMetadataTimeout = 10 * time.Second
+
+// Metadata service endpoints. Replaced in tests.
+var (
+	awsMetadataURL = "http://169.254.169.254"
+	gcpMetadataURL = "http://metadata.google.internal"
+)
+
+// metadataClient sends the metadata requests. It never goes through
+// HTTP_PROXY: the metadata service is only reachable from the instance, and a
+// proxy would get the IMDSv2 token.
+var metadataClient = &http.Client{Transport: &http.Transport{Proxy: nil}}
+
+// errMetadataNotFound is returned for metadata paths that do not exist, such
+// as the IPv6 addresses of an interface without any.
+var errMetadataNotFound = errors.New("not found")
+
+// DiscoverCloudIPs returns the private addresses the cloud provider attached
+// to the network interfaces of this instance, read from its metadata service:
+//   - aws: the primary and secondary private IPv4 addresses and the IPv6
+//     addresses of every network interface (IMDSv2);
+//   - gcp: the primary internal IPv4 address and the alias IP ranges of every
+//     network interface, expanded to their addresses.
+//
+// With publicOnly, only IPv4 addresses with a public address associated
+// (an elastic IP on AWS, an external IP on GCP) are returned, since those
+// are the ones that egress from a dedicated public address. With filters,
+// only addresses within one of the listed CIDR ranges are returned.
+func DiscoverCloudIPs(provider string, publicOnly bool, filters []string) ([]string, error) {
+	var prefixes []netip.Prefix
+	for _, f := range filters {
+		prefix, err := netip.ParsePrefix(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR: %s", f)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cloudMetadataTimeout)
+	defer cancel()
+
+	var addrs []netip.Addr
+	var err error
+	switch provider {
+	case CloudAWS:
+		addrs, err = awsAddrs(ctx, publicOnly)
+	case CloudGCP:
+		addrs, err = gcpAddrs(ctx, publicOnly)
+	default:
+		return nil, fmt.Errorf("unknown cloud provider: %s", provider)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading %s instance metadata: %w", provider, err)
+	}
+
+	var result []string
+	seen := make(map[netip.Addr]bool)
+	for _, a := range addrs {
+		if seen[a] || (len(prefixes) > 0 && !matchesFilter("", a, nil, prefixes)) {
+			continue
+		}
+		seen[a] = true
+		result = append(result, a.String())
+	}
+	return result, nil
+}
+
+// metadataGet reads a metadata path, returning errMetadataNotFound on 404.
+func metadataGet(ctx context.Context, url string, header http.Header) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	case http.StatusNotFound:
+		return nil, errMetadataNotFound
+	default:
+		return nil, fmt.Errorf("unexpected status %d for %s", resp.StatusCode, req.URL.Path)
+	}
+}
+
+// metadataLines returns the non-empty lines of a metadata listing, or none
+// when the path does not exist.
+func metadataLines(ctx context.Context, url string, header http.Header) ([]string, error) {
+	data, err := metadataGet(ctx, url, header)
+	if errors.Is(err, errMetadataNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// awsAddrs reads the addresses of the network interfaces from the EC2
+// instance metadata service.
+func awsAddrs(ctx context.Context, publicOnly bool) ([]netip.Addr, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, awsMetadataURL+"/latest/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("getting token: %w", err)
+	}
+	token, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("getting token: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("getting token: unexpected status %d", resp.StatusCode)
+	}
+	header := http.Header{"X-Aws-Ec2-Metadata-Token": {string(token)}}
+
+	base := awsMetadataURL + "/latest/meta-data/network/interfaces/macs/"
+	macs, err := metadataLines(ctx, base, header)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []netip.Addr
+	for _, mac := range macs {
+		mac = strings.TrimSuffix(mac, "/")
+		var lines []string
+		if publicOnly {
+			// Each association maps a public address to a private one
+			publics, err := metadataLines(ctx, base+mac+"/ipv4-associations/", header)
+			if err != nil {
+				return nil, err
+			}
+			for _, public := range publics {
+				private, err := metadataLines(ctx, base+mac+"/ipv4-associations/"+public, header)
+				if err != nil {
+					return nil, err
+				}
+				lines = append(lines, private...)
+			}
+		} else {
+			if lines, err = metadataLines(ctx, base+mac+"/local-ipv4s", header); err != nil {
+				return nil, err
+			}
+			ipv6s, err := metadataLines(ctx, base+mac+"/ipv6s", header)
+			if err != nil {
+				return nil, err
+			}
+			lines = append(lines, ipv6s...)
+		}
+		for _, line := range lines {
+			a, err := netip.ParseAddr(line)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q for interface %s", line, mac)
+			}
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs, nil
+}
+
+// gcpInterface is a network interface in the GCE metadata.
+type gcpInterface struct {
+	IP            string   `json:"ip"`
+	IPAliases     []string `json:"ipAliases"`
+	AccessConfigs []struct {
+		ExternalIP string `json:"externalIp"`
+	} `json:"accessConfigs"`
+}
+
+// gcpAddrs reads the addresses of the network interfaces from the GCE
+// metadata server.
+func gcpAddrs(ctx context.Context, publicOnly bool) ([]netip.Addr, error) {
+	data, err := metadataGet(ctx, gcpMetadataURL+"/computeMetadata/v1/instance/network-interfaces/?recursive=true&alt=json",
+		http.Header{"Metadata-Flavor": {"Google"}})
+	if err != nil {
+		return nil, err
+	}
+	var ifaces []gcpInterface
+	if err := json.Unmarshal(data, &ifaces); err != nil {
+		return nil, fmt.Errorf("decoding network interfaces: %w", err)
+	}
+
+	var addrs []netip.Addr
+	for _, iface := range ifaces {
+		external := false
+		for _, ac := range iface.AccessConfigs {
+			external = external || ac.ExternalIP != ""
+		}
+		// External IPs are NATed to the primary address only
+		if !publicOnly || external {
+			a, err := netip.ParseAddr(iface.IP)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q", iface.IP)
+			}
+			addrs = append(addrs, a)
+		}
+		if publicOnly {
+			continue
+		}
+		for _, alias := range iface.IPAliases {
+			prefix, err := netip.ParsePrefix(alias)
+			if err != nil {
+				return nil, fmt.Errorf("invalid alias IP range %q", alias)
+			}
+			prefix = prefix.Masked()
+			// Alias ranges are routed to the instance whole, so every
+			// address is usable
+			if hostBits := prefix.Addr().BitLen() - prefix.Bits(); hostBits >= 63 || 1<<hostBits > maxExpandedPrefix {
+				return nil, fmt.Errorf("alias IP range %s is too large (at most %d addresses)", alias, maxExpandedPrefix)
+			}
+			for a := prefix.Addr(); a.IsValid() && prefix.Contains(a); a = a.Next() {
+				addrs = append(addrs, a)
+			}
+		}
+	}
+	return addrs, nil
+}
@@ -0,0 +1,118 @@
+package netutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+// fakeMetadata serves paths from a map, requiring header to be set, and
+// points url at it for the test.
+func fakeMetadata(t *testing.T, url *string, header, value string, paths map[string]string) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && r.URL.Path == "/latest/api/token" {
+			w.Write([]byte("token"))
+			return
+		}
+		if r.Header.Get(header) != value {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, ok := paths[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	orig := *url
+	*url = srv.URL
+	t.Cleanup(func() { *url = orig })
+}
+
+func TestDiscoverCloudIPs_AWS(t *testing.T) {
+	const base = "/latest/meta-data/network/interfaces/macs/"
+	fakeMetadata(t, &awsMetadataURL, "X-aws-ec2-metadata-token", "token", map[string]string{
+		base:                                   "0e:00:00:00:00:01/\n0e:00:00:00:00:02/",
+		base + "0e:00:00:00:00:01/local-ipv4s": "10.0.0.5\n10.0.0.6\n10.0.0.7",
+		base + "0e:00:00:00:00:01/ipv6s":       "2001:db8::10",
+		base + "0e:00:00:00:00:01/ipv4-associations/":            "203.0.113.6",
+		base + "0e:00:00:00:00:01/ipv4-associations/203.0.113.6": "10.0.0.6",
+		base + "0e:00:00:00:00:02/local-ipv4s":                   "10.0.1.5",
+	})
+
+	tests := []struct {
+		name       string
+		publicOnly bool
+		filters    []string
+		want       []string
+	}{
+		{name: "all addresses", want: []string{"10.0.0.5", "10.0.0.6", "10.0.0.7", "2001:db8::10", "10.0.1.5"}},
+		{name: "elastic IPs only", publicOnly: true, want: []string{"10.0.0.6"}},
+		{name: "CIDR filter", filters: []string{"10.0.1.0/24"}, want: []string{"10.0.1.5"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DiscoverCloudIPs(CloudAWS, tt.publicOnly, tt.filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("DiscoverCloudIPs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiscoverCloudIPs_GCP(t *testing.T) {
+	fakeMetadata(t, &gcpMetadataURL, "Metadata-Flavor", "Google", map[string]string{
+		"/computeMetadata/v1/instance/network-interfaces/": `[
+			{"ip": "10.128.0.2", "ipAliases": ["10.1.0.0/30"], "accessConfigs": [{"externalIp": "203.0.113.9", "type": "ONE_TO_ONE_NAT"}]},
+			{"ip": "10.129.0.2", "ipAliases": [], "accessConfigs": []}
+		]`,
+	})
+
+	got, err := DiscoverCloudIPs(CloudGCP, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.128.0.2", "10.1.0.0", "10.1.0.1", "10.1.0.2", "10.1.0.3", "10.129.0.2"}
+	if !slices.Equal(got, want) {
+		t.Errorf("DiscoverCloudIPs() = %v, want %v", got, want)
+	}
+
+	got, err = DiscoverCloudIPs(CloudGCP, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10.128.0.2"}; !slices.Equal(got, want) {
+		t.Errorf("DiscoverCloudIPs() with publicOnly = %v, want %v", got, want)
+	}
+}
+
+func TestDiscoverCloudIPs_Errors(t *testing.T) {
+	if _, err := DiscoverCloudIPs("azure", false, nil); err == nil {
+		t.Error("expected error for an unknown provider")
+	}
+	if _, err := DiscoverCloudIPs(CloudAWS, false, []string{"eth0"}); err == nil {
+		t.Error("expected error for a non-CIDR filter")
+	}
+
+	// A metadata service refusing requests fails the discovery
+	fakeMetadata(t, &gcpMetadataURL, "Metadata-Flavor", "Other", nil)
+	if _, err := DiscoverCloudIPs(CloudGCP, false, nil); err == nil {
+		t.Error("expected error when the metadata service refuses the request")
+	}
+}
+
+func TestMetadataClient_NoProxy(t *testing.T) {
+	// ProxyFromEnvironment never proxies loopback, so the fake metadata
+	// server cannot tell; check the transport instead
+	transport, ok := metadataClient.Transport.(*http.Transport)
+	if !ok || transport.Proxy != nil {
+		t.Error("metadata requests must not go through HTTP_PROXY")
+	}
+}
@@ -0,0 +1,71 @@
+package netutil
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// DiscoverIPs returns the addresses assigned to local interfaces, except
+// loopback and link-local ones, ordered by interface name. With filters, only
+// addresses on one of the listed interfaces or within one of the listed CIDR
+// ranges are returned. Interfaces that do not exist are not an error, since
+// they may be attached later.
+func DiscoverIPs(filters []string) ([]string, error) {
+	var ifaceNames []string
+	var prefixes []netip.Prefix
+	for _, f := range filters {
+		if strings.Contains(f, "/") {
+			prefix, err := netip.ParsePrefix(f)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR: %s", f)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		ifaceNames = append(ifaceNames, f)
+	}
+
+	ifaces, err := interfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(ifaces))
+	for name := range ifaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var result []string
+	seen := make(map[netip.Addr]bool)
+	for _, name := range names {
+		for _, a := range ifaces[name] {
+			if a.IsLoopback() || a.IsLinkLocalUnicast() || seen[a] {
+				continue
+			}
+			if len(filters) > 0 && !matchesFilter(name, a, ifaceNames, prefixes) {
+				continue
+			}
+			seen[a] = true
+			result = append(result, a.String())
+		}
+	}
+	return result, nil
+}
+
+// matchesFilter reports whether address a of interface name is on one of
+// ifaceNames or within one of prefixes.
+func matchesFilter(name string, a netip.Addr, ifaceNames []string, prefixes []netip.Prefix) bool {
+	for _, n := range ifaceNames {
+		if n == name {
+			return true
+		}
+	}
+	for _, p := range prefixes {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
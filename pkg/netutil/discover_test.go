@@ -0,0 +1,58 @@
+package netutil
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestDiscoverIPs(t *testing.T) {
+	fakeInterfaces(t, map[string][]string{
+		"lo":   {"127.0.0.1", "::1"},
+		"eth1": {"203.0.113.1", "203.0.113.2", "fe80::1"},
+		"eth0": {"10.0.0.5", "2001:db8::10"},
+	})
+
+	tests := []struct {
+		name    string
+		filters []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "all non-loopback addresses",
+			want: []string{"10.0.0.5", "2001:db8::10", "203.0.113.1", "203.0.113.2"},
+		},
+		{
+			name:    "interface filter",
+			filters: []string{"eth1"},
+			want:    []string{"203.0.113.1", "203.0.113.2"},
+		},
+		{
+			name:    "CIDR filter",
+			filters: []string{"203.0.113.2/32", "2001:db8::/32"},
+			want:    []string{"2001:db8::10", "203.0.113.2"},
+		},
+		{
+			name:    "missing interface",
+			filters: []string{"eth9"},
+			want:    nil,
+		},
+		{
+			name:    "invalid CIDR",
+			filters: []string{"203.0.113.0/99"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DiscoverIPs(tt.filters)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DiscoverIPs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("DiscoverIPs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+// Package netutil provides network utility functions.
+package netutil
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// maxExpandedPrefix caps how many addresses a single CIDR may expand to.
+const maxExpandedPrefix = 4096
+
+// interfaceAddrs returns the addresses assigned to each local interface, by
+// interface name. Replaced in tests.
+var interfaceAddrs = func() (map[string][]netip.Addr, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("listing interfaces: %w", err)
+	}
+
+	result := make(map[string][]netip.Addr, len(ifaces))
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("getting addresses of %s: %w", iface.Name, err)
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				if a, ok := netip.AddrFromSlice(ipNet.IP); ok {
+					result[iface.Name] = append(result[iface.Name], a.Unmap())
+				}
+			}
+		}
+	}
+	return result, nil
+}
+
+// ExpandIPs expands outbound IP specifications into concrete addresses.
+// Each spec is an IP address (kept as is), a CIDR range or an interface name:
+//   - a CIDR range expands to its host addresses (for IPv4 ranges larger than
+//     /31, without the network and broadcast addresses), all of which must be
+//     assigned to a local interface;
+//   - an interface name expands to its addresses, except link-local ones.
+//
+// Duplicates are dropped, keeping the first occurrence.
+func ExpandIPs(specs []string) ([]string, error) {
+	var local map[string][]netip.Addr
+	lookup := func() (map[string][]netip.Addr, error) {
+		if local != nil {
+			return local, nil
+		}
+		var err error
+		local, err = interfaceAddrs()
+		return local, err
+	}
+
+	var result []string
+	seen := make(map[string]bool)
+	add := func(ip string) {
+		if !seen[ip] {
+			seen[ip] = true
+			result = append(result, ip)
+		}
+	}
+
+	for _, spec := range specs {
+		if net.ParseIP(spec) != nil {
+			add(spec)
+			continue
+		}
+
+		ifaces, err := lookup()
+		if err != nil {
+			return nil, err
+		}
+
+		if strings.Contains(spec, "/") {
+			addrs, err := expandPrefix(spec, ifaces)
+			if err != nil {
+				return nil, err
+			}
+			for _, a := range addrs {
+				add(a.String())
+			}
+			continue
+		}
+
+		addrs, ok := ifaces[spec]
+		if !ok {
+			return nil, fmt.Errorf("invalid IP address, CIDR or interface: %s", spec)
+		}
+		// Link-local addresses are skipped: IPv6 ones cannot be bound without a zone
+		usable := slices.DeleteFunc(slices.Clone(addrs), netip.Addr.IsLinkLocalUnicast)
+		if len(usable) == 0 {
+			return nil, fmt.Errorf("interface %s has no usable addresses", spec)
+		}
+		for _, a := range usable {
+			add(a.String())
+		}
+	}
+	return result, nil
+}
+
+// expandPrefix returns the host addresses of the CIDR range spec, checking
+// that each one is assigned to one of the local interfaces.
+func expandPrefix(spec string, ifaces map[string][]netip.Addr) ([]netip.Addr, error) {
+	prefix, err := netip.ParsePrefix(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR: %s", spec)
+	}
+	prefix = prefix.Masked()
+
+	hostBits := prefix.Addr().BitLen() - prefix.Bits()
+	if hostBits >= 63 || 1<<hostBits > maxExpandedPrefix {
+		return nil, fmt.Errorf("CIDR %s is too large (at most %d addresses)", spec, maxExpandedPrefix)
+	}
+
+	assigned := make(map[netip.Addr]bool)
+	for _, addrs := range ifaces {
+		for _, a := range addrs {
+			assigned[a] = true
+		}
+	}
+
+	var addrs, missing []netip.Addr
+	for a := prefix.Addr(); a.IsValid() && prefix.Contains(a); a = a.Next() {
+		addrs = append(addrs, a)
+	}
+	if prefix.Addr().Is4() && hostBits > 1 {
+		// Network and broadcast addresses
+		addrs = addrs[1 : len(addrs)-1]
+	}
+	for _, a := range addrs {
+		if !assigned[a] {
+			missing = append(missing, a)
+		}
+	}
+
+	if len(missing) > 0 {
+		const shown = 5
+		list := make([]string, 0, shown)
+		for _, a := range missing[:min(len(missing), shown)] {
+			list = append(list, a.String())
+		}
+		more := ""
+		if len(missing) > shown {
+			more = fmt.Sprintf(" and %d more", len(missing)-shown)
+		}
+		return nil, fmt.Errorf("CIDR %s: %s%s not assigned to a local interface", spec, strings.Join(list, ", "), more)
+	}
+	return addrs, nil
+}
@@ -0,0 +1,121 @@
+package netutil
+
+import (
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// fakeInterfaces replaces the local interface lookup for the test.
+func fakeInterfaces(t *testing.T, ifaces map[string][]string) {
+	t.Helper()
+	orig := interfaceAddrs
+	t.Cleanup(func() { interfaceAddrs = orig })
+
+	result := make(map[string][]netip.Addr, len(ifaces))
+	for name, addrs := range ifaces {
+		for _, a := range addrs {
+			result[name] = append(result[name], netip.MustParseAddr(a))
+		}
+	}
+	interfaceAddrs = func() (map[string][]netip.Addr, error) {
+		return result, nil
+	}
+}
+
+func TestExpandIPs(t *testing.T) {
+	fakeInterfaces(t, map[string][]string{
+		"lo":   {"127.0.0.1", "::1"},
+		"eth1": {"203.0.113.1", "203.0.113.2", "2001:db8::10", "fe80::1"},
+		"eth2": {"198.51.100.7"},
+		"eth3": {"fe80::2"},
+	})
+
+	tests := []struct {
+		name    string
+		specs   []string
+		want    []string
+		wantErr string
+	}{
+		{
+			name:  "plain IPs are kept",
+			specs: []string{"192.168.1.1", "10.0.0.1"},
+			want:  []string{"192.168.1.1", "10.0.0.1"},
+		},
+		{
+			name:  "CIDR without network and broadcast",
+			specs: []string{"203.0.113.0/30"},
+			want:  []string{"203.0.113.1", "203.0.113.2"},
+		},
+		{
+			name:  "single address CIDR",
+			specs: []string{"198.51.100.7/32"},
+			want:  []string{"198.51.100.7"},
+		},
+		{
+			name:  "interface skips link-local",
+			specs: []string{"eth1"},
+			want:  []string{"203.0.113.1", "203.0.113.2", "2001:db8::10"},
+		},
+		{
+			name:  "duplicates dropped",
+			specs: []string{"203.0.113.1", "eth1", "eth2", "198.51.100.7/32"},
+			want:  []string{"203.0.113.1", "203.0.113.2", "2001:db8::10", "198.51.100.7"},
+		},
+		{
+			name:    "CIDR with unassigned addresses",
+			specs:   []string{"203.0.113.0/29"},
+			wantErr: "203.0.113.3, 203.0.113.4, 203.0.113.5, 203.0.113.6 not assigned",
+		},
+		{
+			name:    "CIDR too large",
+			specs:   []string{"10.0.0.0/8"},
+			wantErr: "too large",
+		},
+		{
+			name:    "invalid CIDR",
+			specs:   []string{"203.0.113.0/33"},
+			wantErr: "invalid CIDR",
+		},
+		{
+			name:    "unknown interface",
+			specs:   []string{"eth9"},
+			wantErr: "invalid IP address, CIDR or interface: eth9",
+		},
+		{
+			name:    "interface without usable addresses",
+			specs:   []string{"eth3"},
+			wantErr: "no usable addresses",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ExpandIPs(tt.specs)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandIPs_Loopback(t *testing.T) {
+	// Uses the real interfaces of the host
+	got, err := ExpandIPs([]string{"127.0.0.1/32"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !slices.Equal(got, []string{"127.0.0.1"}) {
+		t.Errorf("got %v, want [127.0.0.1]", got)
+	}
+}
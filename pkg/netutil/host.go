@@ -0,0 +1,75 @@
+package netutil
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// HostPattern matches destination host names against either a glob in
+// path.Match syntax ("*.example.com") or a regular expression. The zero
+// HostPattern matches every host.
+type HostPattern struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+// CompileHostPattern compiles a host glob or a regular expression; at most one
+// of them may be set. Globs are case-insensitive.
+func CompileHostPattern(glob, regex string) (HostPattern, error) {
+	switch {
+	case glob != "" && regex != "":
+		return HostPattern{}, errors.New("host and regex are mutually exclusive")
+	case regex != "":
+		re, err := regexp.Compile(regex)
+		if err != nil {
+			return HostPattern{}, fmt.Errorf("invalid regex: %w", err)
+		}
+		return HostPattern{re: re}, nil
+	case glob != "":
+		if _, err := path.Match(glob, ""); err != nil {
+			return HostPattern{}, fmt.Errorf("invalid host pattern: %w", err)
+		}
+		return HostPattern{glob: strings.ToLower(glob)}, nil
+	default:
+		return HostPattern{}, nil
+	}
+}
+
+// IsZero reports whether p matches every host.
+func (p HostPattern) IsZero() bool {
+	return p.glob == "" && p.re == nil
+}
+
+// Match reports whether host, in lower case and without port, matches p.
+func (p HostPattern) Match(host string) bool {
+	if p.re != nil {
+		return p.re.MatchString(host)
+	}
+	if p.glob == "" {
+		return true
+	}
+	ok, _ := path.Match(p.glob, host)
+	return ok
+}
+
+// String returns the glob or regular expression of p.
+func (p HostPattern) String() string {
+	if p.re != nil {
+		return p.re.String()
+	}
+	return p.glob
+}
+
+// HostOf returns the host of hostport in lower case, or hostport itself
+// when it has no port.
+func HostOf(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	return strings.ToLower(host)
+}
@@ -0,0 +1,46 @@
+package netutil
+
+import "testing"
+
+func TestHostPattern(t *testing.T) {
+	tests := []struct {
+		glob, regex string
+		host        string
+		want        bool
+	}{
+		{"*.example.com", "", "api.example.com", true},
+		{"*.EXAMPLE.com", "", "api.example.com", true},
+		{"*.example.com", "", "example.com", false},
+		{"", `^api\d+\.example\.com$`, "api1.example.com", true},
+		{"", `^api\d+\.example\.com$`, "www.example.com", false},
+		{"", "", "anything.test", true},
+	}
+	for _, tt := range tests {
+		p, err := CompileHostPattern(tt.glob, tt.regex)
+		if err != nil {
+			t.Fatalf("CompileHostPattern(%q, %q) error = %v", tt.glob, tt.regex, err)
+		}
+		if got := p.Match(tt.host); got != tt.want {
+			t.Errorf("CompileHostPattern(%q, %q).Match(%q) = %v, want %v", tt.glob, tt.regex, tt.host, got, tt.want)
+		}
+	}
+
+	for _, bad := range [][2]string{{"[", ""}, {"", "("}, {"*.example.com", "example"}} {
+		if _, err := CompileHostPattern(bad[0], bad[1]); err == nil {
+			t.Errorf("CompileHostPattern(%q, %q) error = nil", bad[0], bad[1])
+		}
+	}
+}
+
+func TestHostOf(t *testing.T) {
+	tests := map[string]string{
+		"API.example.com:443": "api.example.com",
+		"example.com":         "example.com",
+		"[::1]:8080":          "::1",
+	}
+	for in, want := range tests {
+		if got := HostOf(in); got != want {
+			t.Errorf("HostOf(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -4,6 +4,8 @@ package netutil
 import (
 	"fmt"
 	"net"
+	"net/netip"
+	"strings"
 )
 
 // ValidateLocalIP checks if an IP address exists on a local interface.
@@ -96,3 +98,96 @@ func NormalizeHost(host string) string {
 	// Lowercase for consistency
 	return h
 }
+
+// NormalizeAddr returns a canonical form of addr for use as a map key:
+// IPv4-mapped IPv6 addresses are unmapped to IPv4 and zones are dropped
+// unless the address is link-local, where the zone identifies the link.
+func NormalizeAddr(addr netip.Addr) netip.Addr {
+	addr = addr.Unmap()
+	if !addr.IsLinkLocalUnicast() && !addr.IsLinkLocalMulticast() {
+		addr = addr.WithZone("")
+	}
+	return addr
+}
+
+// ParseAddr parses an IP address and normalizes it with NormalizeAddr.
+func ParseAddr(s string) (netip.Addr, error) {
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return NormalizeAddr(addr), nil
+}
+
+// HostAddr extracts the IP address from a "host:port" or bare address string
+// and normalizes it with NormalizeAddr.
+func HostAddr(hostport string) (netip.Addr, error) {
+	if ap, err := netip.ParseAddrPort(hostport); err == nil {
+		return NormalizeAddr(ap.Addr()), nil
+	}
+	return ParseAddr(hostport)
+}
+
+// ParseAddrs parses and normalizes a list of IP addresses, such as an IP
+// pool, failing on the first invalid one.
+func ParseAddrs(ips []string) ([]netip.Addr, error) {
+	addrs := make([]netip.Addr, 0, len(ips))
+	for _, ip := range ips {
+		addr, err := ParseAddr(ip)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP address: %s", ip)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// MustParseAddr is like ParseAddr but panics on invalid input. It is meant
+// for addresses already validated, such as those of a validated
+// configuration.
+func MustParseAddr(ip string) netip.Addr {
+	addr, err := ParseAddr(ip)
+	if err != nil {
+		panic(err)
+	}
+	return addr
+}
+
+// MustParseAddrs is like ParseAddrs but panics on invalid input. It is meant
+// for lists already validated, such as those of a validated configuration.
+func MustParseAddrs(ips []string) []netip.Addr {
+	addrs, err := ParseAddrs(ips)
+	if err != nil {
+		panic(err)
+	}
+	return addrs
+}
+
+// AddrStrings returns the textual form of each address.
+func AddrStrings(addrs []netip.Addr) []string {
+	ips := make([]string, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.String()
+	}
+	return ips
+}
+
+// ParsePrefix parses a CIDR range or a single IP address, which becomes a
+// range of that one address. IPv4-mapped IPv6 addresses are unmapped.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		if addr := prefix.Addr(); addr.Is4In6() && prefix.Bits() >= 96 {
+			return netip.PrefixFrom(addr.Unmap(), prefix.Bits()-96).Masked(), nil
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
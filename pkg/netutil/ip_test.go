@@ -158,3 +158,100 @@ func TestValidateLocalIPs(t *testing.T) {
 		t.Error("expected error for invalid IP format")
 	}
 }
+
+func TestParseAddr(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+		wantErr  bool
+	}{
+		{"192.168.1.1", "192.168.1.1", false},
+		{"::ffff:192.168.1.1", "192.168.1.1", false},
+		{"2001:db8::1", "2001:db8::1", false},
+		{"2001:db8::1%eth0", "2001:db8::1", false},
+		{"fe80::1%eth0", "fe80::1%eth0", false},
+		{"invalid", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			addr, err := ParseAddr(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseAddr(%s) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if !tt.wantErr && addr.String() != tt.expected {
+				t.Errorf("ParseAddr(%s) = %s, expected %s", tt.input, addr, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseAddrs(t *testing.T) {
+	addrs, err := ParseAddrs([]string{"2001:0db8:0000::1", "::ffff:192.168.1.1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := AddrStrings(addrs); len(got) != 2 || got[0] != "2001:db8::1" || got[1] != "192.168.1.1" {
+		t.Errorf("expected equivalent forms to be normalized, got %v", got)
+	}
+
+	if _, err := ParseAddrs([]string{"192.168.1.1", "invalid"}); err == nil {
+		t.Error("expected error for invalid address")
+	}
+}
+
+func TestHostAddr(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+		wantErr  bool
+	}{
+		{"192.168.1.1:8080", "192.168.1.1", false},
+		{"[::ffff:10.0.0.1]:443", "10.0.0.1", false},
+		{"[fe80::1%eth0]:9000", "fe80::1%eth0", false},
+		{"10.0.0.1", "10.0.0.1", false},
+		{"[::1]", "", true},
+		{"example.com:80", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			addr, err := HostAddr(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("HostAddr(%s) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if !tt.wantErr && addr.String() != tt.expected {
+				t.Errorf("HostAddr(%s) = %s, expected %s", tt.input, addr, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParsePrefix(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+		wantErr  bool
+	}{
+		{"10.0.0.0/8", "10.0.0.0/8", false},
+		{"10.1.2.3/8", "10.0.0.0/8", false},
+		{"10.0.0.1", "10.0.0.1/32", false},
+		{"2001:db8::/32", "2001:db8::/32", false},
+		{"2001:db8::1", "2001:db8::1/128", false},
+		{"::ffff:10.0.0.0/104", "10.0.0.0/8", false},
+		{"10.0.0.0/33", "", true},
+		{"lb.example.com", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			prefix, err := ParsePrefix(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePrefix(%s) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if !tt.wantErr && prefix.String() != tt.expected {
+				t.Errorf("ParsePrefix(%s) = %s, expected %s", tt.input, prefix, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package netutil
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// Listen listens on the TCP address addr. With reusePort set the socket is
+// opened with SO_REUSEPORT, so that another process, e.g. a newer version
+// of the binary, can listen on the same address at the same time.
+func Listen(addr string, reusePort bool) (net.Listener, error) {
+	var lc net.ListenConfig
+	if reusePort {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			if err := c.Control(func(fd uintptr) { sockErr = setReusePort(fd) }); err != nil {
+				return err
+			}
+			return sockErr
+		}
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// ListenUnix listens on the unix socket path with the file permissions mode,
+// replacing a socket left behind by a previous process. The socket file is
+// kept on close so that a newer process that replaced it keeps its own.
+// Accepted connections report the IPv4 loopback address as their remote
+// address, since only local processes can connect.
+func ListenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	ln.SetUnlinkOnClose(false)
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return &localListener{Listener: ln}, nil
+}
+
+// localAddr is the remote address of connections accepted on unix sockets.
+var localAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+// localListener reports the loopback address as the remote address of the
+// connections it accepts.
+type localListener struct {
+	net.Listener
+}
+
+func (l *localListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &localConn{Conn: conn}, nil
+}
+
+// localConn is a connection from a local process.
+type localConn struct {
+	net.Conn
+}
+
+func (c *localConn) RemoteAddr() net.Addr {
+	return localAddr
+}
+
+// CloseWrite half-closes the underlying connection if it supports it.
+func (c *localConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
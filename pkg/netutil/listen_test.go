@@ -0,0 +1,72 @@
+package netutil
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+
+	ln, err := ListenUnix(path, 0o600)
+	if err != nil {
+		t.Fatalf("ListenUnix() error = %v", err)
+	}
+	defer ln.Close()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o600 {
+		t.Errorf("socket mode = %v, want 0600", fi.Mode().Perm())
+	}
+
+	client, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer client.Close()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept() error = %v", err)
+	}
+	defer conn.Close()
+	if got := conn.RemoteAddr().String(); got != "127.0.0.1:0" {
+		t.Errorf("RemoteAddr() = %q, want 127.0.0.1:0", got)
+	}
+}
+
+func TestListenUnix_ReplacesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+
+	first, err := ListenUnix(path, 0o660)
+	if err != nil {
+		t.Fatalf("ListenUnix() error = %v", err)
+	}
+	first.Close()
+
+	second, err := ListenUnix(path, 0o660)
+	if err != nil {
+		t.Fatalf("ListenUnix() over a stale socket error = %v", err)
+	}
+	second.Close()
+}
+
+func TestListenUnix_RefusesRegularFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	if err := os.WriteFile(path, []byte("data"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if ln, err := ListenUnix(path, 0o660); err == nil {
+		ln.Close()
+		t.Fatal("ListenUnix() over a regular file succeeded")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("regular file was removed: %v", err)
+	}
+}
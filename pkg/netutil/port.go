@@ -0,0 +1,48 @@
+package netutil
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PortRange is an inclusive range of TCP/UDP ports.
+type PortRange struct {
+	Low, High uint16
+}
+
+// ParsePortRange parses a single port ("443") or an inclusive range
+// ("8000-8100").
+func ParsePortRange(s string) (PortRange, error) {
+	s = strings.TrimSpace(s)
+	lowStr, highStr, isRange := strings.Cut(s, "-")
+	low, err := parsePort(lowStr)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port range %q: %w", s, err)
+	}
+	if !isRange {
+		return PortRange{Low: low, High: low}, nil
+	}
+	high, err := parsePort(highStr)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port range %q: %w", s, err)
+	}
+	if high < low {
+		return PortRange{}, fmt.Errorf("invalid port range %q: end is lower than start", s)
+	}
+	return PortRange{Low: low, High: high}, nil
+}
+
+// parsePort parses a port number between 1 and 65535.
+func parsePort(s string) (uint16, error) {
+	port, err := strconv.ParseUint(strings.TrimSpace(s), 10, 16)
+	if err != nil || port == 0 {
+		return 0, fmt.Errorf("port must be 1-65535")
+	}
+	return uint16(port), nil
+}
+
+// Contains reports whether port is in the range.
+func (r PortRange) Contains(port int) bool {
+	return port >= int(r.Low) && port <= int(r.High)
+}
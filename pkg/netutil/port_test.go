@@ -0,0 +1,35 @@
+package netutil
+
+import "testing"
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    PortRange
+		wantErr bool
+	}{
+		{"443", PortRange{443, 443}, false},
+		{" 8000-8100 ", PortRange{8000, 8100}, false},
+		{"1-65535", PortRange{1, 65535}, false},
+		{"0", PortRange{}, true},
+		{"65536", PortRange{}, true},
+		{"8100-8000", PortRange{}, true},
+		{"https", PortRange{}, true},
+		{"80-", PortRange{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParsePortRange(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParsePortRange(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParsePortRange(%q) = %v, want %v", tt.input, got, tt.want)
+		}
+	}
+
+	r := PortRange{8000, 8100}
+	if !r.Contains(8000) || !r.Contains(8100) || r.Contains(7999) || r.Contains(8101) {
+		t.Errorf("Contains() of %v is wrong at the bounds", r)
+	}
+}
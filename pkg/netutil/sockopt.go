@@ -0,0 +1,36 @@
+package netutil
+
+import (
+	"syscall"
+)
+
+// SocketOptions are options set on the sockets of outbound connections.
+type SocketOptions struct {
+	// Interface binds the socket to a network device, so traffic leaves
+	// through it whatever the routing table says (Linux only).
+	Interface string
+	// Mark is the firewall mark (SO_MARK) of the socket's packets, for
+	// policy routing rules and firewall matches (Linux only, 0 for none).
+	Mark uint32
+}
+
+// IsZero reports whether no option is set.
+func (o SocketOptions) IsZero() bool {
+	return o == SocketOptions{}
+}
+
+// Control returns a function setting the options on a socket before it is
+// connected, for use as net.Dialer.Control or net.ListenConfig.Control. It
+// returns nil when no option is set.
+func (o SocketOptions) Control() func(network, address string, c syscall.RawConn) error {
+	if o.IsZero() {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		if err := c.Control(func(fd uintptr) { sockErr = setSocketOptions(fd, o) }); err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
@@ -0,0 +1,41 @@
+//go:build linux
+
+package netutil
+
+import (
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// SocketOptionsSupported reports whether SocketOptions can be set on this
+// platform.
+const SocketOptionsSupported = true
+
+// setSocketOptions sets o on the socket fd.
+func setSocketOptions(fd uintptr, o SocketOptions) error {
+	if o.Interface != "" {
+		if err := syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, o.Interface); err != nil {
+			return fmt.Errorf("binding to interface %s: %w", o.Interface, err)
+		}
+	}
+	if o.Mark != 0 {
+		if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, int(o.Mark)); err != nil {
+			return fmt.Errorf("setting fwmark %#x: %w", o.Mark, err)
+		}
+	}
+	return nil
+}
+
+// ReusePortSupported reports whether listeners can be opened with
+// SO_REUSEPORT on this platform.
+const ReusePortSupported = true
+
+// setReusePort sets SO_REUSEPORT on the socket fd.
+func setReusePort(fd uintptr) error {
+	if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); err != nil {
+		return fmt.Errorf("setting SO_REUSEPORT: %w", err)
+	}
+	return nil
+}
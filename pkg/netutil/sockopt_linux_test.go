@@ -0,0 +1,59 @@
+//go:build linux
+
+package netutil
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestSocketOptions_Mark(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	dialer := &net.Dialer{Control: SocketOptions{Mark: 0x10}.Control()}
+	conn, err := dialer.Dial("tcp", ln.Addr().String())
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("setting a firewall mark requires CAP_NET_ADMIN")
+	}
+	if err != nil {
+		t.Fatalf("Dial() with fwmark: %v", err)
+	}
+	defer conn.Close()
+
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mark int
+	raw.Control(func(fd uintptr) {
+		mark, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK)
+	})
+	if err != nil || mark != 0x10 {
+		t.Errorf("SO_MARK = %#x, %v, want 0x10", mark, err)
+	}
+}
+
+func TestListen_ReusePort(t *testing.T) {
+	first, err := Listen("127.0.0.1:0", true)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer first.Close()
+
+	second, err := Listen(first.Addr().String(), true)
+	if err != nil {
+		t.Fatalf("second Listen() on %s error = %v", first.Addr(), err)
+	}
+	second.Close()
+
+	if ln, err := Listen(first.Addr().String(), false); err == nil {
+		ln.Close()
+		t.Error("Listen() without reusePort on a bound address succeeded")
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+
+package netutil
+
+import (
+	"errors"
+)
+
+// SocketOptionsSupported reports whether SocketOptions can be set on this
+// platform.
+const SocketOptionsSupported = false
+
+// setSocketOptions fails: device binding and firewall marks are specific to
+// Linux.
+func setSocketOptions(fd uintptr, o SocketOptions) error {
+	return errors.New("socket options are only supported on Linux")
+}
+
+// ReusePortSupported reports whether listeners can be opened with
+// SO_REUSEPORT on this platform.
+const ReusePortSupported = false
+
+// setReusePort fails: SO_REUSEPORT listeners are only supported on Linux.
+func setReusePort(fd uintptr) error {
+	return errors.New("SO_REUSEPORT is only supported on Linux")
+}
@@ -0,0 +1,39 @@
+package netutil
+
+import (
+	"errors"
+	"net"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+func TestSocketOptions_Control(t *testing.T) {
+	if (SocketOptions{}).Control() != nil {
+		t.Error("Control() of empty options is not nil")
+	}
+	if runtime.GOOS != "linux" {
+		t.Skip("socket options are only supported on Linux")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	dialer := &net.Dialer{Control: SocketOptions{Interface: "lo"}.Control()}
+	conn, err := dialer.Dial("tcp", ln.Addr().String())
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("binding to a device is not permitted here")
+	}
+	if err != nil {
+		t.Fatalf("Dial() bound to lo: %v", err)
+	}
+	conn.Close()
+
+	dialer.Control = SocketOptions{Interface: "nonexistent0"}.Control()
+	if _, err := dialer.Dial("tcp", ln.Addr().String()); err == nil {
+		t.Error("Dial() bound to a missing interface succeeded")
+	}
+}
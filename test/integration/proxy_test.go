@@ -6,6 +6,7 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"net/url"
 	"testing"
 	"time"
@@ -15,6 +16,7 @@ import (
 	"github.com/cr0hn/outbound-lb/internal/limiter"
 	"github.com/cr0hn/outbound-lb/internal/metrics"
 	"github.com/cr0hn/outbound-lb/internal/proxy"
+	"github.com/cr0hn/outbound-lb/pkg/netutil"
 )
 
 func TestProxyIntegration_BasicHTTP(t *testing.T) {
@@ -40,10 +42,10 @@ func TestProxyIntegration_BasicHTTP(t *testing.T) {
 		LogFormat:     "json",
 	}
 
-	stats := metrics.NewStatsCollector(cfg.IPs)
-	lim := limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, cfg.IPs)
+	stats := metrics.NewStatsCollector(netutil.MustParseAddrs(cfg.IPs))
+	lim := limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, netutil.MustParseAddrs(cfg.IPs))
 	balCfg := balancer.Config{
-		IPs:           cfg.IPs,
+		IPs:           netutil.MustParseAddrs(cfg.IPs),
 		HistoryWindow: int64(cfg.HistoryWindow.Seconds()),
 		HistorySize:   cfg.HistorySize,
 		Limiter:       lim,
@@ -57,7 +59,7 @@ func TestProxyIntegration_BasicHTTP(t *testing.T) {
 }
 
 func TestProxyIntegration_MetricsEndpoints(t *testing.T) {
-	stats := metrics.NewStatsCollector([]string{"127.0.0.1"})
+	stats := metrics.NewStatsCollector(netutil.MustParseAddrs([]string{"127.0.0.1"}))
 	metricsServer := metrics.NewServer(0, stats)
 
 	// Start server in background
@@ -87,31 +89,31 @@ func TestProxyIntegration_ConnectionLimiting(t *testing.T) {
 		LogFormat:     "json",
 	}
 
-	stats := metrics.NewStatsCollector(cfg.IPs)
-	lim := limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, cfg.IPs)
+	stats := metrics.NewStatsCollector(netutil.MustParseAddrs(cfg.IPs))
+	lim := limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, netutil.MustParseAddrs(cfg.IPs))
 
 	// Acquire connections up to limit
-	err := lim.Acquire("127.0.0.1")
+	err := lim.Acquire(netip.MustParseAddr("127.0.0.1"))
 	if err != nil {
 		t.Errorf("unexpected error on first acquire: %v", err)
 	}
 
-	err = lim.Acquire("127.0.0.1")
+	err = lim.Acquire(netip.MustParseAddr("127.0.0.1"))
 	if err != nil {
 		t.Errorf("unexpected error on second acquire: %v", err)
 	}
 
 	// Third should fail
-	err = lim.Acquire("127.0.0.1")
+	err = lim.Acquire(netip.MustParseAddr("127.0.0.1"))
 	if err != limiter.ErrIPLimitReached {
 		t.Errorf("expected ErrIPLimitReached, got: %v", err)
 	}
 
 	// Release one
-	lim.Release("127.0.0.1")
+	lim.Release(netip.MustParseAddr("127.0.0.1"))
 
 	// Should succeed again
-	err = lim.Acquire("127.0.0.1")
+	err = lim.Acquire(netip.MustParseAddr("127.0.0.1"))
 	if err != nil {
 		t.Errorf("unexpected error after release: %v", err)
 	}
@@ -134,9 +136,9 @@ func TestProxyIntegration_BalancerDistribution(t *testing.T) {
 		LogFormat:     "json",
 	}
 
-	lim := limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, cfg.IPs)
+	lim := limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, netutil.MustParseAddrs(cfg.IPs))
 	balCfg := balancer.Config{
-		IPs:           cfg.IPs,
+		IPs:           netutil.MustParseAddrs(cfg.IPs),
 		HistoryWindow: int64(cfg.HistoryWindow.Seconds()),
 		HistorySize:   cfg.HistorySize,
 		Limiter:       lim,
@@ -146,7 +148,7 @@ func TestProxyIntegration_BalancerDistribution(t *testing.T) {
 	defer bal.Stop()
 
 	// Make multiple selections and track distribution
-	selections := make(map[string]int)
+	selections := make(map[netip.Addr]int)
 	host := "api.example.com"
 
 	for i := 0; i < 30; i++ {
@@ -186,9 +188,9 @@ func TestProxyIntegration_PerHostIsolation(t *testing.T) {
 		LogFormat:     "json",
 	}
 
-	lim := limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, cfg.IPs)
+	lim := limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, netutil.MustParseAddrs(cfg.IPs))
 	balCfg := balancer.Config{
-		IPs:           cfg.IPs,
+		IPs:           netutil.MustParseAddrs(cfg.IPs),
 		HistoryWindow: int64(cfg.HistoryWindow.Seconds()),
 		HistorySize:   cfg.HistorySize,
 		Limiter:       lim,
@@ -204,7 +206,7 @@ func TestProxyIntegration_PerHostIsolation(t *testing.T) {
 	}
 
 	// host2 should still get balanced distribution
-	selectionsHost2 := make(map[string]int)
+	selectionsHost2 := make(map[netip.Addr]int)
 	for i := 0; i < 10; i++ {
 		ip, _ := bal.Select("host2.com")
 		bal.Record("host2.com", ip)
@@ -250,7 +252,7 @@ func TestProxyIntegration_WithRealBackend(t *testing.T) {
 }
 
 func TestProxyIntegration_StatsCollection(t *testing.T) {
-	stats := metrics.NewStatsCollector([]string{"192.168.1.1", "192.168.1.2"})
+	stats := metrics.NewStatsCollector(netutil.MustParseAddrs([]string{"192.168.1.1", "192.168.1.2"}))
 
 	// Simulate activity
 	stats.IncActiveConnections()
@@ -258,8 +260,8 @@ func TestProxyIntegration_StatsCollection(t *testing.T) {
 	stats.IncTotalRequests()
 	stats.AddBytesSent(1000)
 	stats.AddBytesReceived(500)
-	stats.IncConnectionsForIP("192.168.1.1")
-	stats.IncSelectionsForIP("192.168.1.1", "example.com")
+	stats.IncConnectionsForIP(netip.MustParseAddr("192.168.1.1"))
+	stats.IncSelectionsForIP(netip.MustParseAddr("192.168.1.1"), "example.com")
 
 	// Verify stats
 	s := stats.GetStats()
@@ -292,10 +294,10 @@ func TestProxyIntegration_GracefulShutdown(t *testing.T) {
 		LogFormat:     "json",
 	}
 
-	stats := metrics.NewStatsCollector(cfg.IPs)
-	lim := limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, cfg.IPs)
+	stats := metrics.NewStatsCollector(netutil.MustParseAddrs(cfg.IPs))
+	lim := limiter.New(cfg.MaxConnsPerIP, cfg.MaxConnsTotal, netutil.MustParseAddrs(cfg.IPs))
 	balCfg := balancer.Config{
-		IPs:           cfg.IPs,
+		IPs:           netutil.MustParseAddrs(cfg.IPs),
 		HistoryWindow: int64(cfg.HistoryWindow.Seconds()),
 		HistorySize:   cfg.HistorySize,
 		Limiter:       lim,